@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/agent"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var version = "dev"
+var port int
+var tokenFile string
+var nixStore string
+var maxImportBytes int64
+var signingURL string
+var signingPod string
+var signingTokenFile string
+var nix string
+
+var rootCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Builder agent for Nix remote builders",
+	Long:  "An HTTP agent that runs in builder pods and lets non-SSH clients import and export store paths",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to read agent token")
+		}
+
+		server, err := agent.New(agent.Config{
+			Addr:           fmt.Sprintf(":%d", port),
+			Token:          strings.TrimSpace(string(token)),
+			NixStore:       nixStore,
+			MaxImportBytes: maxImportBytes,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create agent")
+		}
+
+		log.Info().Int("port", port).Msg("Starting builder agent")
+		if err := server.ListenAndServe(ctx); err != nil {
+			log.Fatal().Err(err).Msg("Agent server failed")
+		}
+	},
+}
+
+var signCmd = &cobra.Command{
+	Use:   "sign PATH...",
+	Short: "Sign store paths with the controller's Nix signing key",
+	Long:  "Asks the controller to sign store paths and adds the signatures to the local store, so outputs can be pushed to a binary cache without the builder holding the key",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		token, err := os.ReadFile(signingTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read signing token: %w", err)
+		}
+		return agent.Sign(cmd.Context(), agent.SignConfig{
+			URL:   signingURL,
+			Pod:   signingPod,
+			Token: strings.TrimSpace(string(token)),
+			Nix:   nix,
+		}, args)
+	},
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version number",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("v%s\n", version)
+	},
+}
+
+func init() {
+	rootCmd.Flags().IntVarP(&port, "port", "p", agent.DefaultPort, "Agent HTTP port")
+	rootCmd.Flags().StringVar(&tokenFile, "token-file", "/etc/nix-builder/agent/token", "File containing the bearer token clients must present")
+	rootCmd.Flags().StringVar(&nixStore, "nix-store", "nix-store", "Path to the nix-store binary")
+	rootCmd.Flags().Int64Var(&maxImportBytes, "max-import-bytes", agent.DefaultMaxImportBytes, "Maximum size of a single import upload")
+	signCmd.Flags().StringVar(&signingURL, "url", "", "Controller signing endpoint")
+	signCmd.Flags().StringVar(&signingPod, "pod", "", "This builder pod, as namespace/name")
+	signCmd.Flags().StringVar(&signingTokenFile, "token-file", "/etc/nix-builder/signing/token", "File containing the builder's signing token")
+	signCmd.Flags().StringVar(&nix, "nix", "nix", "Path to the nix binary")
+	signCmd.MarkFlagRequired("url")
+	signCmd.MarkFlagRequired("pod")
+	rootCmd.AddCommand(signCmd)
+	rootCmd.AddCommand(versionCmd)
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
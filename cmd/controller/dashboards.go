@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/controller"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var dashboardsDir string
+
+var exportDashboardsCmd = &cobra.Command{
+	Use:   "export-dashboards",
+	Short: "Write a Grafana dashboard and Prometheus alert rules for the registered metrics",
+	Long:  "Generates a Grafana dashboard and Prometheus alert rules from the metrics the controller and proxy register, so they stay in sync as metrics change",
+	Run: func(cmd *cobra.Command, args []string) {
+		controllerMetrics := prometheus.NewRegistry()
+		if err := controller.RegisterExportMetrics(controllerMetrics); err != nil {
+			log.Fatal().Err(err).Msg("Failed to register controller metrics")
+		}
+		proxyMetrics := prometheus.NewRegistry()
+		if err := proxy.RegisterExportMetrics(proxyMetrics); err != nil {
+			log.Fatal().Err(err).Msg("Failed to register proxy metrics")
+		}
+
+		metrics, err := controller.DescribeMetrics(controllerMetrics, proxyMetrics)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to describe metrics")
+		}
+		dashboard, err := controller.GrafanaDashboard(metrics)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate Grafana dashboard")
+		}
+		alerts, err := controller.AlertRules(metrics)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate alert rules")
+		}
+
+		if err := os.MkdirAll(dashboardsDir, 0o755); err != nil {
+			log.Fatal().Err(err).Msg("Failed to create output directory")
+		}
+		for name, data := range map[string][]byte{
+			"grafana-dashboard.json": dashboard,
+			"prometheus-alerts.yaml": alerts,
+		} {
+			path := filepath.Join(dashboardsDir, name)
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				log.Fatal().Err(err).Str("path", path).Msg("Failed to write file")
+			}
+			log.Info().Str("path", path).Msg("Wrote observability asset")
+		}
+	},
+}
+
+func init() {
+	exportDashboardsCmd.Flags().StringVarP(&dashboardsDir, "output-dir", "o", ".", "Directory to write grafana-dashboard.json and prometheus-alerts.yaml to")
+	rootCmd.AddCommand(exportDashboardsCmd)
+}
@@ -3,30 +3,164 @@ package main
 import (
 	"context"
 	"fmt"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/adminapi"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apimetrics"
 	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/configfile"
 	"github.com/omarjatoi/nix-remote-build-controller/pkg/controller"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/features"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/logging"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/logstore"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/notify"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/readiness"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/tracing"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/vault"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
 
 var (
-	version         = "dev"
-	builderImage    string
-	remotePort      int32
-	nixConfigMap    string
-	sshKeySecret    string
-	healthPort      int
-	shutdownTimeout time.Duration
+	version          = "dev"
+	configFile       string
+	builderImage     string
+	builderCPU       string
+	builderMemory    string
+	remotePort       int32
+	nixConfigMap     string
+	sshKeySecret     string
+	healthPort       int
+	metricsPort      int
+	metricsCertDir   string
+	metricsLabels    []string
+	metricsMaxVals   int
+	kubeAPIQPS       float32
+	kubeAPIBurst     int
+	builderTLS       string
+	builderTLSPort   int32
+	agentPort        int32
+	warmPoolSize     int
+	manageUsers      bool
+	systemBuilders   string
+	systemFeatures   string
+	kvmBuilders      bool
+	kvmResource      string
+	kvmSelector      map[string]string
+	kvmTolerations   []string
+	allowedFeatures  []string
+	warmPoolNS       string
+	poolVariants     string
+	podTemplate      string
+	vaultAddr        string
+	vaultRole        string
+	vaultAuthPath    string
+	vaultKVMount     string
+	vaultKeyPath     string
+	vaultCacheTTL    time.Duration
+	vaultSigningKey  string
+	transitMount     string
+	transitKey       string
+	signingKeyName   string
+	signingAddress   string
+	signingURL       string
+	policyURL        string
+	policyTimeout    time.Duration
+	policyFailOpen   bool
+	policyWebhook    bool
+	webhookPort      int
+	webhookCertDir   string
+	policyConfigMap  string
+	statusConfigMap  string
+	isolateBuilders  bool
+	antiAffinity     string
+	antiAffinityKey  string
+	builderJobs      bool
+	noProvisioning   bool
+	provisioningCM   string
+	adminAddress     string
+	adminTokenFile   string
+	cachePushURL     string
+	cachePushSecret  string
+	cachePushAll     bool
+	jobBackoffLimit  int32
+	createRetries    int32
+	builderSubdomain string
+	completedPodTTL  time.Duration
+	buildRequestTTL  time.Duration
+	netpolPeerNS     string
+	egressCIDRs      []string
+	egressPorts      []int32
+	isolateNS        bool
+	watchNamespaces  []string
+	isolateClasses   []string
+	isolateUsers     []string
+	isolateQuota     map[string]string
+	policyQuery      string
+	dryRun           bool
+	cleanupBakeIn    time.Duration
+	sessionGrace     time.Duration
+	probeSSH         bool
+	captureLogs      bool
+	logTailLines     int64
+	logStoreURL      string
+	logStoreEndpoint string
+	logStoreRegion   string
+	notifyWebhooks   []string
+	notifySlack      []string
+	notifyOn         []string
+	notifyTimeout    time.Duration
+	bestEffortClass  string
+	spotPreset       string
+	spotSelector     map[string]string
+	spotTolerations  []string
+	spotDefault      bool
+	spotReschedules  int32
+	maxRunning       int
+	userMaxBuilders  int
+	userMaxCPU       string
+	userMaxMemory    string
+	validateImages   bool
+	imageSeedPaths   []string
+	validationNS     string
+	storeType        string
+	storeClaim       string
+	storeSize        string
+	storeClass       string
+	storeRetain      bool
+	leaderElect      bool
+	leaderElectNS    string
+	leaderElectID    string
+	shutdownTimeout  time.Duration
+	logLevel         string
+	logFormat        string
+	logLevels        map[string]string
+	otlpEndpoint     string
+	otlpInsecure     bool
+	traceSampleRatio float64
 )
 
 var rootCmd = &cobra.Command{
@@ -37,6 +171,37 @@ var rootCmd = &cobra.Command{
 		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 		defer cancel()
 
+		var config *configfile.File
+		if configFile != "" {
+			var err error
+			config, err = configfile.Load(configFile, cmd.Flags(), reloadableFlags)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load config file")
+			}
+		}
+
+		if err := logging.Setup(logging.Config{Level: logLevel, Format: logFormat, ComponentLevels: logLevels}, os.Stderr); err != nil {
+			log.Fatal().Err(err).Msg("Invalid logging configuration")
+		}
+		ctrl.SetLogger(logging.Logr(logging.ComponentControllerRuntime))
+
+		shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+			Endpoint:    otlpEndpoint,
+			Insecure:    otlpInsecure,
+			SampleRatio: traceSampleRatio,
+			ServiceName: "nix-remote-build-controller",
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up tracing")
+		}
+		defer func() {
+			flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer flushCancel()
+			if err := shutdownTracing(flushCtx); err != nil {
+				log.Warn().Err(err).Msg("Failed to flush traces")
+			}
+		}()
+
 		scheme := runtime.NewScheme()
 		if err := clientgoscheme.AddToScheme(scheme); err != nil {
 			log.Fatal().Err(err).Msg("Failed to add client-go scheme")
@@ -45,36 +210,462 @@ var rootCmd = &cobra.Command{
 			log.Fatal().Err(err).Msg("Failed to add NixBuilder scheme")
 		}
 
+		apiMetrics := apimetrics.New(controller.APIMetricsPrefix)
+		apiMetrics.Install()
+		if err := metrics.Registry.Register(apiMetrics); err != nil {
+			log.Fatal().Err(err).Msg("Failed to register Kubernetes API metrics")
+		}
+
 		k8sConfig, err := ctrl.GetConfig()
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to get Kubernetes config")
 		}
+		if kubeAPIQPS > 0 {
+			k8sConfig.QPS = kubeAPIQPS
+		}
+		if kubeAPIBurst > 0 {
+			k8sConfig.Burst = kubeAPIBurst
+		}
+
+		var cacheOptions cache.Options
+		if len(watchNamespaces) > 0 {
+			if isolateNS {
+				log.Fatal().Msg("--isolated-namespaces creates namespaces outside --watch-namespaces and cannot be combined with it")
+			}
+			cacheOptions.DefaultNamespaces = cachedNamespaces(watchNamespaces)
+		}
 
 		mgr, err := ctrl.NewManager(k8sConfig, ctrl.Options{
-			Scheme: scheme,
+			Scheme:                  scheme,
+			Cache:                   cacheOptions,
+			LeaderElection:          leaderElect,
+			LeaderElectionID:        leaderElectID,
+			LeaderElectionNamespace: leaderElectNS,
+			Metrics: metricsserver.Options{
+				BindAddress:   fmt.Sprintf(":%d", metricsPort),
+				SecureServing: metricsCertDir != "",
+				CertDir:       metricsCertDir,
+			},
+			// Only started once a webhook is registered
+			WebhookServer: webhook.NewServer(webhook.Options{
+				Port:    webhookPort,
+				CertDir: webhookCertDir,
+			}),
 		})
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to create controller manager")
 		}
 
+		buildMetrics, err := controller.NewBuildMetrics(metricsLabels, metricsMaxVals)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid metrics label configuration")
+		}
+		if err := buildMetrics.Register(metrics.Registry); err != nil {
+			log.Fatal().Err(err).Msg("Failed to register build metrics")
+		}
+
+		var vaultClient *vault.Client
+		if vaultAddr != "" {
+			vaultClient = vault.New(vault.Config{
+				Address:  vaultAddr,
+				Role:     vaultRole,
+				AuthPath: vaultAuthPath,
+				KVMount:  vaultKVMount,
+				CacheTTL: vaultCacheTTL,
+			})
+		}
+
+		settings, err := loadSettings()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid builder settings")
+		}
+
+		var sysFeatures map[string]controller.SystemFeature
+		if systemFeatures != "" {
+			sysFeatures, err = controller.LoadSystemFeatures(systemFeatures)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load system features")
+			}
+		}
+		if kvmBuilders {
+			kvm := controller.SystemFeature{
+				NodeSelector: kvmSelector,
+				Resources:    corev1.ResourceList{},
+			}
+			if kvmResource != "" {
+				kvm.Resources[corev1.ResourceName(kvmResource)] = resource.MustParse("1")
+			}
+			for _, value := range kvmTolerations {
+				toleration, err := controller.ParseToleration(value)
+				if err != nil {
+					log.Fatal().Err(err).Msg("Invalid --kvm-tolerations")
+				}
+				kvm.Tolerations = append(kvm.Tolerations, toleration)
+			}
+			sysFeatures = controller.WithKVMProfile(sysFeatures, kvm)
+		} else if len(kvmSelector) > 0 || len(kvmTolerations) > 0 {
+			log.Fatal().Msg("--kvm-node-selector and --kvm-tolerations need --kvm-builders")
+		}
+
+		var variants []controller.PoolVariant
+		if poolVariants != "" {
+			variants, err = controller.LoadPoolVariants(poolVariants)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load warm pool variants")
+			}
+		}
+
+		var template *corev1.PodTemplateSpec
+		if podTemplate != "" {
+			template, err = controller.LoadPodTemplate(podTemplate)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load builder pod template")
+			}
+		}
+
+		defaultStorage := v1alpha1.StorageSpec{
+			Type:      v1alpha1.StorageType(storeType),
+			ClaimName: storeClaim,
+			Retain:    storeRetain,
+		}
+		switch defaultStorage.Type {
+		case "", v1alpha1.StorageEphemeral, v1alpha1.StorageSession, v1alpha1.StorageShared:
+		default:
+			log.Fatal().Str("type", storeType).Msg("Invalid --store-volume-type")
+		}
+		if storeSize != "" {
+			size, err := resource.ParseQuantity(storeSize)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid --store-volume-size")
+			}
+			defaultStorage.Size = &size
+		}
+		if storeClass != "" {
+			defaultStorage.StorageClassName = &storeClass
+		}
+
+		var bakeInUntil time.Time
+		if cleanupBakeIn > 0 {
+			bakeInUntil = time.Now().Add(cleanupBakeIn)
+		}
+
+		// Job pods have generated names, which builder certificates issued
+		// for the pod name cannot match
+		if builderJobs && builderTLS != "" {
+			log.Fatal().Msg("--builder-jobs cannot be combined with --builder-tls-secret")
+		}
+
 		reconciler := &controller.NixBuildRequestReconciler{
 			Client:       mgr.GetClient(),
 			Scheme:       mgr.GetScheme(),
-			BuilderImage: builderImage,
+			BuilderImage: settings.BuilderImage,
 			RemotePort:   remotePort,
 			NixConfigMap: nixConfigMap,
 			SSHKeySecret: sshKeySecret,
+			Metrics:      buildMetrics,
+			Recorder:     mgr.GetEventRecorderFor("nix-remote-build-controller"),
+
+			BuilderTLSSecret: builderTLS,
+			BuilderTLSPort:   builderTLSPort,
+
+			AgentPort: agentPort,
+
+			AllowedExperimentalFeatures: allowedFeatures,
+
+			BuilderResources: settings.BuilderResources,
+
+			Systems:        settings.Systems,
+			SystemFeatures: sysFeatures,
+
+			PodTemplate: template,
+
+			ManageBuilderUsers: manageUsers,
+
+			WarmPoolSize:      warmPoolSize,
+			WarmPoolNamespace: warmPoolNS,
+			WarmPoolVariants:  variants,
+
+			Vault:        vaultClient,
+			VaultKeyPath: vaultKeyPath,
+
+			PolicyFailOpen: policyFailOpen,
+
+			DryRun: dryRun,
+
+			CleanupBakeInUntil: bakeInUntil,
+			SessionGracePeriod: settings.SessionGracePeriod,
+
+			BestEffortPriorityClass: bestEffortClass,
+
+			MaxRunningBuilders: settings.MaxRunningBuilders,
+			UserQuota:          settings.UserQuota,
+
+			ValidateImages:           validateImages,
+			ImageSeedPaths:           imageSeedPaths,
+			ImageValidationNamespace: validationNS,
+
+			DefaultStorage: defaultStorage,
+
+			BuilderJobs:            builderJobs,
+			BuilderJobBackoffLimit: jobBackoffLimit,
+
+			PodCreateRetries: createRetries,
+			BuilderSubdomain: builderSubdomain,
+
+			CompletedPodTTL: completedPodTTL,
+			BuildRequestTTL: buildRequestTTL,
+		}
+		provisioningKey, err := parseNamespacedName(provisioningCM)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid --provisioning-configmap")
+		}
+		reconciler.Provisioning = &controller.ProvisioningSwitch{Client: mgr.GetClient(), ConfigMap: provisioningKey, DryRun: dryRun}
+		if noProvisioning {
+			err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+				return reconciler.Provisioning.Disable(ctx, "--disable-provisioning is set")
+			}))
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to disable builder provisioning")
+			}
+		}
+		if probeSSH {
+			reconciler.SSHProbe = controller.ProbeSSHBanner
+		}
+		if captureLogs || logStoreURL != "" {
+			clientset, err := kubernetes.NewForConfig(k8sConfig)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to create Kubernetes clientset for builder logs")
+			}
+			reconciler.BuildLogs = &controller.BuildLogs{Read: controller.ClientsetLogReader(clientset), TailLines: logTailLines}
+			if logStoreURL != "" {
+				store, err := logstore.New(logstore.Config{URL: logStoreURL, Endpoint: logStoreEndpoint, Region: logStoreRegion})
+				if err != nil {
+					log.Fatal().Err(err).Msg("Invalid log store configuration")
+				}
+				reconciler.BuildLogs.Store = store
+			}
+		}
+		var notifiers notify.All
+		for _, url := range notifyWebhooks {
+			webhook, err := notify.NewWebhook(url, notify.FormatJSON, notifyTimeout)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid --notify-webhook")
+			}
+			notifiers = append(notifiers, webhook)
+		}
+		for _, url := range notifySlack {
+			webhook, err := notify.NewWebhook(url, notify.FormatSlack, notifyTimeout)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid --notify-slack-webhook")
+			}
+			notifiers = append(notifiers, webhook)
+		}
+		if len(notifiers) > 0 {
+			reconciler.Notifier = notifiers
+			for _, phase := range notifyOn {
+				switch p := v1alpha1.BuildPhase(phase); p {
+				case v1alpha1.BuildPhaseCompleted, v1alpha1.BuildPhaseFailed:
+					reconciler.NotifyPhases = append(reconciler.NotifyPhases, p)
+				default:
+					log.Fatal().Str("phase", phase).Msg("--notify-on accepts Completed and Failed")
+				}
+			}
+		}
+		if leaderElect {
+			reconciler.Elected = mgr.Elected()
+		}
+		var checkers policy.All
+		if policyConfigMap != "" {
+			key, err := parseNamespacedName(policyConfigMap)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid --policy-configmap")
+			}
+			checkers = append(checkers, policy.NewRegoChecker(mgr.GetClient(), key, policyQuery))
+		}
+		if policyURL != "" {
+			checkers = append(checkers, policy.NewHTTPChecker(policyURL, policyTimeout))
+		}
+		if len(checkers) > 0 {
+			reconciler.Policy = checkers
+		}
+		if policyWebhook {
+			if len(checkers) == 0 {
+				log.Fatal().Msg("--policy-webhook needs --policy-configmap or --policy-url")
+			}
+			if err := (&controller.PolicyWebhook{Policy: checkers, FailOpen: policyFailOpen}).SetupWebhookWithManager(mgr); err != nil {
+				log.Fatal().Err(err).Msg("Failed to setup policy webhook")
+			}
+		}
+
+		if cachePushURL != "" {
+			reconciler.CachePush = &controller.CachePush{
+				URL:        cachePushURL,
+				SecretName: cachePushSecret,
+				Default:    cachePushAll,
+			}
+		}
+
+		var signer vault.NixSigner
+		switch {
+		case vaultSigningKey != "" && transitKey != "":
+			log.Fatal().Msg("--vault-signing-key-path and --vault-transit-key cannot be combined")
+		case vaultSigningKey != "":
+			signer = &vault.KVSigner{Client: vaultClient, Path: vaultSigningKey}
+		case transitKey != "":
+			if signingKeyName == "" {
+				log.Fatal().Msg("--vault-transit-key needs --signing-key-name")
+			}
+			signer = &vault.TransitSigner{Client: vaultClient, Mount: transitMount, Key: transitKey, Name: signingKeyName}
+		}
+		if signer != nil {
+			if vaultClient == nil || reconciler.CachePush == nil || signingURL == "" {
+				log.Fatal().Msg("signing pushed outputs needs --vault-addr, --cache-push-url and --signing-url")
+			}
+			reconciler.Signing = &controller.Signing{Signer: signer, URL: signingURL}
+			if publicKey, err := signer.PublicKey(context.Background()); err != nil {
+				log.Warn().Err(err).Msg("Failed to read the Nix signing public key from Vault")
+			} else {
+				log.Info().Str("public_key", publicKey).Msg("Signing pushed outputs")
+			}
+		}
+
+		if statusConfigMap != "" {
+			key, err := parseNamespacedName(statusConfigMap)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid --status-configmap")
+			}
+			reconciler.StatusConfigMap = key
+		}
+
+		if isolateBuilders {
+			for _, cidr := range egressCIDRs {
+				if _, _, err := net.ParseCIDR(cidr); err != nil {
+					log.Fatal().Err(err).Msg("Invalid --builder-egress-cidrs")
+				}
+			}
+			reconciler.NetworkPolicy = &controller.BuilderNetworkPolicy{
+				PeerNamespace: netpolPeerNS,
+				EgressCIDRs:   egressCIDRs,
+				EgressPorts:   egressPorts,
+			}
+		}
+
+		if isolateNS {
+			quota := corev1.ResourceList{}
+			for name, value := range isolateQuota {
+				quantity, err := resource.ParseQuantity(value)
+				if err != nil {
+					log.Fatal().Err(err).Str("resource", name).Msg("Invalid --isolated-namespace-quota")
+				}
+				quota[corev1.ResourceName(name)] = quantity
+			}
+			reconciler.NamespaceIsolation = &controller.NamespaceIsolation{
+				SizeClasses: isolateClasses,
+				Requesters:  isolateUsers,
+				Quota:       quota,
+			}
+		}
+
+		switch antiAffinity {
+		case "":
+		case "preferred", "required":
+			reconciler.AntiAffinity = &controller.BuilderAntiAffinity{
+				Required:    antiAffinity == "required",
+				TopologyKey: antiAffinityKey,
+			}
+		default:
+			log.Fatal().Str("anti_affinity", antiAffinity).Msg("--builder-anti-affinity accepts preferred or required")
+		}
+
+		if spotPreset != "" || len(spotSelector) > 0 || len(spotTolerations) > 0 {
+			spot := controller.SpotScheduling{
+				NodeSelector:   map[string]string{},
+				Default:        spotDefault,
+				MaxReschedules: spotReschedules,
+			}
+			if spotPreset != "" {
+				preset, ok := controller.SpotPresets[spotPreset]
+				if !ok {
+					log.Fatal().Str("spot_preset", spotPreset).Msg("--spot-preset accepts gke, eks, karpenter or aks")
+				}
+				maps.Copy(spot.NodeSelector, preset.NodeSelector)
+				spot.Tolerations = append(spot.Tolerations, preset.Tolerations...)
+			}
+			maps.Copy(spot.NodeSelector, spotSelector)
+			for _, value := range spotTolerations {
+				toleration, err := controller.ParseToleration(value)
+				if err != nil {
+					log.Fatal().Err(err).Msg("Invalid --spot-tolerations")
+				}
+				spot.Tolerations = append(spot.Tolerations, toleration)
+			}
+			reconciler.Spot = &spot
+		} else if spotDefault {
+			log.Fatal().Msg("--spot-default needs --spot-preset, --spot-node-selector or --spot-tolerations")
+		}
+
+		if err := metrics.Registry.Register(controller.NewCapacityCollector(reconciler)); err != nil {
+			log.Fatal().Err(err).Msg("Failed to register capacity metrics")
 		}
 
 		if err := reconciler.SetupWithManager(mgr); err != nil {
 			log.Fatal().Err(err).Msg("Failed to setup controller")
 		}
 
+		leaseReconciler := &controller.BuilderLeaseReconciler{
+			Client: mgr.GetClient(),
+			Scheme: mgr.GetScheme(),
+
+			CleanupBakeInUntil: bakeInUntil,
+			DryRun:             dryRun,
+		}
+		if err := leaseReconciler.SetupWithManager(mgr); err != nil {
+			log.Fatal().Err(err).Msg("Failed to setup lease controller")
+		}
+
+		prefetchReconciler := &controller.FlakePrefetchReconciler{
+			Client:       mgr.GetClient(),
+			Scheme:       mgr.GetScheme(),
+			BuilderImage: settings.BuilderImage,
+			CachePush:    reconciler.CachePush,
+			PodTemplate:  template,
+			DryRun:       dryRun,
+		}
+		if err := prefetchReconciler.SetupWithManager(mgr); err != nil {
+			log.Fatal().Err(err).Msg("Failed to setup prefetch controller")
+		}
+
 		// Setup health checks
 		var shuttingDown atomic.Bool
-		if err := setupHealthChecks(mgr, &shuttingDown, healthPort); err != nil {
+		featureReport := func() features.Report {
+			return features.Report{
+				Component: "controller",
+				Version:   version,
+				Features: append(reconciler.Features(),
+					features.Toggle("leader-election", leaderElect, "Lease "+leaderElectID, "--enable-leader-election"),
+					features.Toggle("tracing", otlpEndpoint != "", "OTLP to "+otlpEndpoint, "--otlp-endpoint"),
+					features.Toggle("config-reload", configFile != "", configFile, "--config"),
+					features.Toggle("policy-webhook", policyWebhook, fmt.Sprintf("admission webhook on port %d", webhookPort), "--policy-webhook"),
+					features.Toggle("watch-namespaces", len(watchNamespaces) > 0, strings.Join(watchNamespaces, ","), "--watch-namespaces"),
+				),
+			}
+		}
+		var cachesSynced atomic.Bool
+		if err := setupHealthChecks(mgr, &shuttingDown, &cachesSynced, watchNamespaces, healthPort, featureReport); err != nil {
 			log.Fatal().Err(err).Msg("Failed to setup health checks")
 		}
+		var adminToken []byte
+		if adminTokenFile != "" {
+			if adminToken, err = adminapi.ReadToken(adminTokenFile); err != nil {
+				log.Fatal().Err(err).Msg("Invalid --admin-token-file")
+			}
+		}
+		if err := setupAdminServer(adminAddress, adminToken, reconciler.Provisioning); err != nil {
+			log.Fatal().Err(err).Msg("Failed to setup admin server")
+		}
+		if signer != nil {
+			setupSigningServer(signingAddress, &controller.SigningServer{Reader: mgr.GetAPIReader(), Signer: signer})
+		}
 
 		log.Info().
 			Str("builder_image", builderImage).
@@ -82,11 +673,49 @@ var rootCmd = &cobra.Command{
 			Str("nix_config", nixConfigMap).
 			Str("ssh_key_secret", sshKeySecret).
 			Int("health_port", healthPort).
+			Int("metrics_port", metricsPort).
+			Str("admin_address", adminAddress).
+			Strs("metrics_labels", metricsLabels).
+			Str("builder_tls_secret", builderTLS).
+			Str("vault_addr", vaultAddr).
+			Str("policy_url", policyURL).
+			Str("policy_configmap", policyConfigMap).
+			Str("status_configmap", statusConfigMap).
+			Str("provisioning_configmap", provisioningCM).
+			Bool("dry_run", dryRun).
+			Bool("leader_election", leaderElect).
 			Dur("shutdown_timeout", shutdownTimeout).
 			Msg("Starting Nix remote builder controller")
 
 		log.Info().Msg("Controller manager starting...")
 
+		cached := []client.Object{&v1alpha1.NixBuildRequest{}, &corev1.Pod{}}
+		if builderJobs {
+			cached = append(cached, &batchv1.Job{})
+		}
+		go func() {
+			err := apiMetrics.WaitForCacheSync(ctx, mgr.GetCache(), cached...)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error().Err(err).Msg("Failed to wait for cache sync")
+				}
+				return
+			}
+			cachesSynced.Store(true)
+		}()
+
+		if config != nil {
+			go config.Watch(ctx, func(changed []string) error {
+				settings, err := loadSettings()
+				if err != nil {
+					return err
+				}
+				log.Info().Strs("changed", changed).Msg("Reloaded config file")
+				reconciler.ApplySettings(settings)
+				return nil
+			})
+		}
+
 		mgrDone := make(chan error, 1)
 		go func() {
 			mgrDone <- mgr.Start(ctx)
@@ -131,7 +760,7 @@ var versionCmd = &cobra.Command{
 	},
 }
 
-func setupHealthChecks(mgr ctrl.Manager, shuttingDown *atomic.Bool, port int) error {
+func setupHealthChecks(mgr ctrl.Manager, shuttingDown, cachesSynced *atomic.Bool, watched []string, port int, report func() features.Report) error {
 	mux := http.NewServeMux()
 
 	// Liveness probe - "is the process running?"
@@ -140,17 +769,24 @@ func setupHealthChecks(mgr ctrl.Manager, shuttingDown *atomic.Bool, port int) er
 		w.Write([]byte("ok"))
 	})
 
-	// Readiness probe - "can you handle new requests?"
-	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-		if shuttingDown.Load() {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("shutting down"))
-			return
-		}
+	// Readiness probe - "can you handle new requests?" The API server is
+	// read through the uncached reader, since the cache keeps answering
+	// after the connection to it broke. A controller limited to some
+	// namespaces may not list build requests in others.
+	apiCheck := []client.ListOption{client.Limit(1)}
+	if len(watched) > 0 {
+		apiCheck = append(apiCheck, client.InNamespace(watched[0]))
+	}
+	mux.Handle(readiness.Path, readiness.Handler(
+		readiness.WhileUnset("shutdown", shuttingDown, "shutting down"),
+		readiness.WhileSet("informers", cachesSynced, "informer caches have not synced"),
+		readiness.Check{Name: "api-server", Run: func(ctx context.Context) error {
+			return mgr.GetAPIReader().List(ctx, &v1alpha1.NixBuildRequestList{}, apiCheck...)
+		}},
+	))
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ready"))
-	})
+	// Which optional subsystems this deployment has enabled
+	mux.Handle(features.Path, features.Handler(report))
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
@@ -167,13 +803,262 @@ func setupHealthChecks(mgr ctrl.Manager, shuttingDown *atomic.Bool, port int) er
 	return nil
 }
 
+// setupAdminServer serves the endpoints that change the controller's
+// behavior, away from the health port kubelet and scrapers reach
+func setupAdminServer(address string, token []byte, provisioning *controller.ProvisioningSwitch) error {
+	if err := adminapi.CheckAddress(address, token); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+
+	// Kill switch for provisioning builders during incidents
+	mux.Handle("/provisioning", provisioning)
+
+	server := &http.Server{
+		Addr:    address,
+		Handler: adminapi.Authenticated(token, mux),
+	}
+
+	go func() {
+		log.Info().Str("address", address).Bool("token", len(token) > 0).Msg("Admin server starting")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Admin server failed")
+		}
+	}()
+
+	return nil
+}
+
+// setupSigningServer serves the endpoint builders have their pushed outputs
+// signed at. Every replica serves it, since builders authenticate with their
+// own tokens rather than reaching the leader.
+func setupSigningServer(address string, signing *controller.SigningServer) {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/sign", signing)
+
+	server := &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+
+	go func() {
+		log.Info().Str("address", address).Msg("Signing server starting")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Signing server failed")
+		}
+	}()
+}
+
+// reloadableFlags are the settings a --config file can change while the
+// controller runs
+var reloadableFlags = []string{
+	"builder-image",
+	"builder-cpu",
+	"builder-memory",
+	"system-builders",
+	"session-grace-period",
+	"max-running-builders",
+	"user-max-builders",
+	"user-max-cpu",
+	"user-max-memory",
+}
+
+// loadSettings builds the reconciler's reloadable settings from their flags
+func loadSettings() (controller.Settings, error) {
+	settings := controller.Settings{
+		BuilderImage:       builderImage,
+		SessionGracePeriod: sessionGrace,
+		MaxRunningBuilders: maxRunning,
+		UserQuota:          controller.UserQuota{MaxBuilders: userMaxBuilders},
+	}
+	if systemBuilders != "" {
+		systems, err := controller.LoadSystemBuilders(systemBuilders)
+		if err != nil {
+			return controller.Settings{}, err
+		}
+		settings.Systems = systems
+	}
+	for name, value := range map[corev1.ResourceName]string{corev1.ResourceCPU: builderCPU, corev1.ResourceMemory: builderMemory} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return controller.Settings{}, fmt.Errorf("invalid builder %s %q: %w", name, value, err)
+		}
+		if settings.BuilderResources.Requests == nil {
+			settings.BuilderResources.Requests = corev1.ResourceList{}
+		}
+		settings.BuilderResources.Requests[name] = quantity
+	}
+	for limit, value := range map[*resource.Quantity]string{&settings.UserQuota.CPU: userMaxCPU, &settings.UserQuota.Memory: userMaxMemory} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return controller.Settings{}, fmt.Errorf("invalid per-user limit %q: %w", value, err)
+		}
+		*limit = quantity
+	}
+	return settings, nil
+}
+
+// parseNamespacedName parses a namespace/name reference
+func parseNamespacedName(ref string) (types.NamespacedName, error) {
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || name == "" {
+		return types.NamespacedName{}, fmt.Errorf("expected namespace/name, got %q", ref)
+	}
+	return types.NamespacedName{Namespace: namespace, Name: name}, nil
+}
+
+// cachedNamespaces returns the namespaces the manager's cache watches when
+// --watch-namespaces limits it: the watched ones and those the controller
+// reads its own resources from, such as the warm pool's
+func cachedNamespaces(watched []string) map[string]cache.Config {
+	namespaces := make(map[string]cache.Config)
+	for _, namespace := range watched {
+		namespaces[namespace] = cache.Config{}
+	}
+	namespaces[warmPoolNS] = cache.Config{}
+	if validateImages {
+		namespaces[validationNS] = cache.Config{}
+	}
+	for _, ref := range []string{policyConfigMap, statusConfigMap, provisioningCM} {
+		if key, err := parseNamespacedName(ref); err == nil {
+			namespaces[key.Namespace] = cache.Config{}
+		}
+	}
+	return namespaces
+}
+
+// envList returns the comma-separated values of an environment variable,
+// so that flags holding credentials such as webhook URLs can come from a
+// Secret
+func envList(name string) []string {
+	if value := os.Getenv(name); value != "" {
+		return strings.Split(value, ",")
+	}
+	return nil
+}
+
 func init() {
+	rootCmd.Flags().StringVar(&configFile, "config", "", "YAML file of flag settings, reloaded on change or SIGHUP; flags given on the command line take precedence (optional)")
 	rootCmd.Flags().StringVar(&builderImage, "builder-image", "nixos/nix:latest", "Builder container image")
+	rootCmd.Flags().StringVar(&builderCPU, "builder-cpu", "", "CPU requested for builders whose build request sets no resources (optional)")
+	rootCmd.Flags().StringVar(&builderMemory, "builder-memory", "", "Memory requested for builders whose build request sets no resources (optional)")
 	rootCmd.Flags().Int32Var(&remotePort, "remote-port", 22, "SSH port in builder pods")
 	rootCmd.Flags().StringVar(&nixConfigMap, "nix-config", "", "ConfigMap containing nix.conf (optional)")
 	rootCmd.Flags().StringVar(&sshKeySecret, "ssh-key-secret", "nix-builder-ssh-keys", "Secret containing SSH keypair for builder authentication (must contain 'private' and 'public' keys)")
 	rootCmd.Flags().IntVar(&healthPort, "health-port", 8081, "Health check server port")
+	rootCmd.Flags().IntVar(&metricsPort, "metrics-port", 8080, "Prometheus metrics server port")
+	rootCmd.Flags().StringVar(&metricsCertDir, "metrics-cert-dir", "", "Directory containing tls.crt and tls.key for serving metrics over HTTPS, reloaded on rotation (optional)")
+	rootCmd.Flags().StringSliceVar(&metricsLabels, "metrics-labels", nil, "Build request label keys to propagate as metric labels (e.g. team,repo,pipeline)")
+	rootCmd.Flags().IntVar(&metricsMaxVals, "metrics-label-max-values", 50, "Maximum distinct values tracked per propagated metric label before folding into \"other\" (0 for unlimited)")
+	rootCmd.Flags().Float32Var(&kubeAPIQPS, "kube-api-qps", 0, "Kubernetes API requests per second allowed before client-side throttling (0 for the client-go default of 20)")
+	rootCmd.Flags().IntVar(&kubeAPIBurst, "kube-api-burst", 0, "Kubernetes API requests allowed in a burst above --kube-api-qps (0 for the client-go default of 30)")
+	rootCmd.Flags().StringVar(&builderTLS, "builder-tls-secret", "", "CA secret (tls.crt, tls.key) used to issue mTLS certificates for builder pods (optional)")
+	rootCmd.Flags().Int32Var(&builderTLSPort, "builder-tls-port", 2223, "TLS-wrapped SSH port in builder pods when --builder-tls-secret is set")
+	rootCmd.Flags().StringSliceVar(&allowedFeatures, "allowed-experimental-features", controller.DefaultAllowedExperimentalFeatures, "Nix experimental features build requests may enable via spec.experimentalFeatures")
+	rootCmd.Flags().StringVar(&systemBuilders, "system-builders", "", "YAML file mapping Nix systems to builder images and node selectors")
+	rootCmd.Flags().StringVar(&systemFeatures, "system-features", "", "YAML file mapping Nix system features such as kvm to builder node selectors, tolerations and device resources")
+	rootCmd.Flags().BoolVar(&kvmBuilders, "kvm-builders", false, "Offer the kvm and nixos-test system features on builders given /dev/kvm by a device plugin, unless --system-features places them")
+	rootCmd.Flags().StringVar(&kvmResource, "kvm-resource", string(controller.DefaultKVMResource), "Extended resource a device plugin hands out /dev/kvm as, requested by --kvm-builders builders")
+	rootCmd.Flags().StringToStringVar(&kvmSelector, "kvm-node-selector", nil, "Node labels selecting nodes with /dev/kvm for --kvm-builders builders")
+	rootCmd.Flags().StringSliceVar(&kvmTolerations, "kvm-tolerations", nil, "Taints --kvm-builders builders tolerate, as key=value:Effect or key:Effect")
+	rootCmd.Flags().BoolVar(&manageUsers, "manage-builder-users", false, "Log sessions in to builders as a user derived from the requester and trust only that user")
+	rootCmd.Flags().IntVar(&warmPoolSize, "warm-pool-size", 0, "Number of idle builder pods kept warm for incoming build requests (0 disables the pool)")
+	rootCmd.Flags().StringVar(&podTemplate, "builder-pod-template", "", "YAML file with a PodTemplateSpec merged into every builder pod")
+	rootCmd.Flags().StringVar(&poolVariants, "warm-pool-variants", "", "YAML file of further warm pool variants, each with its own system, image, features, resources and pod counts")
+	rootCmd.Flags().StringVar(&warmPoolNS, "warm-pool-namespace", "default", "Namespace of the warm builder pool; must match the proxy's namespace")
+	rootCmd.Flags().Int32Var(&agentPort, "agent-port", 0, "Port for the builder agent's store import/export API (0 disables the agent)")
+	rootCmd.Flags().StringVar(&vaultAddr, "vault-addr", "", "Vault address; when set the builder public key is read from Vault instead of --ssh-key-secret (optional)")
+	rootCmd.Flags().StringVar(&vaultRole, "vault-role", "nix-remote-build-controller", "Vault Kubernetes auth role")
+	rootCmd.Flags().StringVar(&vaultAuthPath, "vault-auth-path", "kubernetes", "Mount path of the Vault Kubernetes auth method")
+	rootCmd.Flags().StringVar(&vaultKVMount, "vault-kv-mount", "secret", "Mount path of the Vault KV v2 secrets engine")
+	rootCmd.Flags().StringVar(&vaultKeyPath, "vault-key-path", "nix-builder/ssh-keys", "Vault KV path holding the SSH keypair")
+	rootCmd.Flags().DurationVar(&vaultCacheTTL, "vault-cache-ttl", 5*time.Minute, "How long key material read from Vault is cached")
+	rootCmd.Flags().StringVar(&vaultSigningKey, "vault-signing-key-path", "", "Vault KV path holding a Nix secret-key the controller signs pushed outputs with (optional)")
+	rootCmd.Flags().StringVar(&transitMount, "vault-transit-mount", "transit", "Mount path of the Vault Transit secrets engine")
+	rootCmd.Flags().StringVar(&transitKey, "vault-transit-key", "", "Vault Transit ed25519 key that signs pushed outputs, instead of --vault-signing-key-path (optional)")
+	rootCmd.Flags().StringVar(&signingKeyName, "signing-key-name", "", "Name clients know the --vault-transit-key by in trusted-public-keys, such as cache.example.com-1")
+	rootCmd.Flags().StringVar(&signingAddress, "signing-address", ":8083", "Address the signing endpoint for builders listens on")
+	rootCmd.Flags().StringVar(&signingURL, "signing-url", "", "URL builders reach the signing endpoint at, such as http://nix-remote-build-controller-signing.default.svc:8083/v1/sign")
+	rootCmd.Flags().StringVar(&policyURL, "policy-url", "", "External policy endpoint (HTTP or OPA data API) consulted before provisioning builder pods (optional)")
+	rootCmd.Flags().DurationVar(&policyTimeout, "policy-timeout", 5*time.Second, "Timeout for policy endpoint requests")
+	rootCmd.Flags().StringVar(&policyConfigMap, "policy-configmap", "", "ConfigMap (namespace/name) with Rego policies evaluated by the embedded OPA engine (optional)")
+	rootCmd.Flags().StringVar(&policyQuery, "policy-query", policy.DefaultRegoQuery, "Rego query evaluated for --policy-configmap policies")
+	rootCmd.Flags().BoolVar(&policyFailOpen, "policy-fail-open", false, "Allow build requests when the policy endpoint cannot be reached")
+	rootCmd.Flags().BoolVar(&policyWebhook, "policy-webhook", false, "Serve a validating admission webhook that refuses NixBuildRequests the policy denies")
+	rootCmd.Flags().IntVar(&webhookPort, "webhook-port", 9443, "Port of the admission webhook server")
+	rootCmd.Flags().StringVar(&webhookCertDir, "webhook-cert-dir", "", "Directory containing tls.crt and tls.key for the admission webhook server (default /tmp/k8s-webhook-server/serving-certs)")
+	rootCmd.Flags().StringVar(&statusConfigMap, "status-configmap", "", "ConfigMap (namespace/name) mirroring a summary of active builds and the warm pool (optional)")
+	rootCmd.Flags().BoolVar(&isolateBuilders, "builder-network-policy", false, "Create a NetworkPolicy for each builder pod admitting only the proxy and controller and limiting egress to DNS and --builder-egress-cidrs")
+	rootCmd.Flags().StringVar(&netpolPeerNS, "network-policy-peer-namespace", "", "Namespace of the proxy and controller pods allowed to reach builders (default: the builder's namespace)")
+	rootCmd.Flags().StringSliceVar(&egressCIDRs, "builder-egress-cidrs", nil, "Networks isolated builders may reach, such as their substituters' addresses")
+	rootCmd.Flags().Int32SliceVar(&egressPorts, "builder-egress-ports", []int32{80, 443}, "TCP ports isolated builders may reach in --builder-egress-cidrs")
+	rootCmd.Flags().StringVar(&antiAffinity, "builder-anti-affinity", "", "Spread builder pods across --builder-anti-affinity-topology-key domains: preferred or required (default: no spreading)")
+	rootCmd.Flags().StringVar(&antiAffinityKey, "builder-anti-affinity-topology-key", "kubernetes.io/hostname", "Node label builder pods are spread across with --builder-anti-affinity")
+	rootCmd.Flags().StringSliceVar(&watchNamespaces, "watch-namespaces", nil, "Namespaces whose build requests the controller serves, limiting its cache and permissions to them (default: all namespaces)")
+	rootCmd.Flags().BoolVar(&isolateNS, "isolated-namespaces", false, "Allow build requests to run their builder in an ephemeral namespace of its own with spec.isolation=Namespace")
+	rootCmd.Flags().StringSliceVar(&isolateClasses, "isolated-namespace-size-classes", nil, "Size classes whose builders always run in an isolated namespace, with --isolated-namespaces")
+	rootCmd.Flags().StringSliceVar(&isolateUsers, "isolated-namespace-requesters", nil, "Requesters whose builders always run in an isolated namespace, with --isolated-namespaces")
+	rootCmd.Flags().StringToStringVar(&isolateQuota, "isolated-namespace-quota", nil, "ResourceQuota limits of each isolated namespace, such as limits.cpu=8,limits.memory=32Gi; one pod is always allowed")
+	rootCmd.Flags().BoolVar(&builderJobs, "builder-jobs", false, "Run each builder pod under a Job that replaces pods failing before the builder is ready")
+	rootCmd.Flags().Int32Var(&jobBackoffLimit, "builder-job-backoff-limit", controller.DefaultBuilderJobBackoffLimit, "Failed pods a builder Job replaces before its build request fails, with --builder-jobs")
+	rootCmd.Flags().DurationVar(&completedPodTTL, "completed-pod-ttl", controller.DefaultCompletedPodTTL, "How long the builder pod of a completed or failed build request is kept (0 keeps it until the request is deleted)")
+	rootCmd.Flags().DurationVar(&buildRequestTTL, "build-request-ttl", 0, "How long completed and failed build requests are kept before they are deleted (0 keeps them)")
+	rootCmd.Flags().StringVar(&builderSubdomain, "builder-subdomain", "", "Headless Service builder pods are a subdomain of, for proxies using --builder-resolver=service-dns")
+	rootCmd.Flags().Int32Var(&createRetries, "pod-create-retries", controller.DefaultPodCreateRetries, "Times creating a builder pod is retried with exponential backoff before its build request fails")
+	rootCmd.Flags().StringVar(&cachePushURL, "cache-push-url", "", "Nix store URL of a binary cache builders copy build outputs to, such as s3://nix-cache (optional)")
+	rootCmd.Flags().StringVar(&cachePushSecret, "cache-push-secret", "", "Secret in each builder namespace with credentials for --cache-push-url (secret-key, netrc, aws-credentials)")
+	rootCmd.Flags().BoolVar(&cachePushAll, "cache-push-default", false, "Push outputs for build requests that do not set spec.cachePush")
+	rootCmd.Flags().StringSliceVar(&notifyWebhooks, "notify-webhook", envList("NOTIFY_WEBHOOK"), "Webhook URLs sent a JSON document when a build completes or fails (default $NOTIFY_WEBHOOK)")
+	rootCmd.Flags().StringSliceVar(&notifySlack, "notify-slack-webhook", envList("NOTIFY_SLACK_WEBHOOK"), "Slack-compatible incoming webhook URLs told when a build completes or fails (default $NOTIFY_SLACK_WEBHOOK)")
+	rootCmd.Flags().StringSliceVar(&notifyOn, "notify-on", []string{"Completed", "Failed"}, "Build phases notified: Completed, Failed or both")
+	rootCmd.Flags().DurationVar(&notifyTimeout, "notify-timeout", 5*time.Second, "Timeout for each webhook request")
+	rootCmd.Flags().BoolVar(&noProvisioning, "disable-provisioning", false, "Disable builder provisioning when the controller becomes leader, failing new build requests until it is enabled again")
+	rootCmd.Flags().StringVar(&provisioningCM, "provisioning-configmap", "default/nix-builder-provisioning", "ConfigMap (namespace/name) holding the builder provisioning kill switch, followed by every replica")
+	rootCmd.Flags().StringVar(&adminAddress, "admin-address", "127.0.0.1:8082", "Address of the admin server serving /provisioning; must be a loopback address unless --admin-token-file is set")
+	rootCmd.Flags().StringVar(&adminTokenFile, "admin-token-file", "", "File holding the bearer token the admin server requires (optional)")
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Record intended actions in build request status without creating or deleting cluster resources")
+	rootCmd.Flags().DurationVar(&cleanupBakeIn, "cleanup-bake-in", 0, "After startup, only log and flag orphaned pods and expired leases for this long before deleting them")
+	rootCmd.Flags().DurationVar(&sessionGrace, "session-grace-period", 5*time.Minute, "Fail unfinished build requests whose proxy session has sent no heartbeat for this long and delete their builder pods (0 to disable)")
 	rootCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Graceful shutdown timeout")
+	rootCmd.Flags().StringVar(&logLevel, "log-level", "info", "Least severe level logged: trace, debug, info, warn or error")
+	rootCmd.Flags().StringVar(&logFormat, "log-format", logging.FormatJSON, "Log format: json or console")
+	rootCmd.Flags().StringToStringVar(&logLevels, "log-levels", nil, "Levels overriding --log-level for components, such as reconciler=debug,controller-runtime=warn")
+	rootCmd.Flags().StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP gRPC collector address for exporting traces, such as otel-collector:4317 (optional)")
+	rootCmd.Flags().BoolVar(&otlpInsecure, "otlp-insecure", false, "Connect to --otlp-endpoint without TLS")
+	rootCmd.Flags().Float64Var(&traceSampleRatio, "trace-sample-ratio", 1, "Fraction of sessions traced")
+	rootCmd.Flags().StringVar(&storeType, "store-volume-type", "", "Default /nix storage for builders: Ephemeral, Session or Shared")
+	rootCmd.Flags().StringVar(&storeClaim, "store-volume-claim", "", "Claim for Shared storage, or a Session claim name for builders to reuse")
+	rootCmd.Flags().StringVar(&storeSize, "store-volume-size", "", "Size of Session store claims (default 20Gi)")
+	rootCmd.Flags().StringVar(&storeClass, "store-storage-class", "", "Storage class of Session store claims")
+	rootCmd.Flags().BoolVar(&storeRetain, "retain-store-volumes", false, "Keep Session store claims after their build request is deleted")
+	rootCmd.Flags().StringVar(&bestEffortClass, "best-effort-priority-class", "", "PriorityClass for best-effort builder pods; best-effort builds are refused when empty")
+	rootCmd.Flags().StringVar(&spotPreset, "spot-preset", "", "Place spot builders on the spot node pool of gke, eks, karpenter or aks")
+	rootCmd.Flags().StringToStringVar(&spotSelector, "spot-node-selector", nil, "Node labels selecting spot nodes for spot builders, added to --spot-preset")
+	rootCmd.Flags().StringSliceVar(&spotTolerations, "spot-tolerations", nil, "Taints spot builders tolerate, as key=value:Effect or key:Effect, added to --spot-preset")
+	rootCmd.Flags().BoolVar(&spotDefault, "spot-default", false, "Run the builders of build requests that do not set spec.spot on spot nodes")
+	rootCmd.Flags().Int32Var(&spotReschedules, "spot-max-reschedules", controller.DefaultMaxReschedules, "Times a spot builder lost with its node is replaced before its build request fails")
+	rootCmd.Flags().IntVar(&maxRunning, "max-running-builders", 0, "Queue build requests while this many builders are running across the cluster (0 for no limit)")
+	rootCmd.Flags().IntVar(&userMaxBuilders, "user-max-builders", 0, "Fail build requests of a user already holding this many builders across the cluster (0 for no limit)")
+	rootCmd.Flags().StringVar(&userMaxCPU, "user-max-cpu", "", "CPU the builders of one user may request in total across the cluster (optional)")
+	rootCmd.Flags().StringVar(&userMaxMemory, "user-max-memory", "", "Memory the builders of one user may request in total across the cluster (optional)")
+	rootCmd.Flags().BoolVar(&validateImages, "validate-builder-images", false, "Run a validation pod for each builder image before its first build")
+	rootCmd.Flags().StringSliceVar(&imageSeedPaths, "image-seed-paths", nil, "Store paths a builder image must contain to pass validation")
+	rootCmd.Flags().StringVar(&validationNS, "image-validation-namespace", "default", "Namespace of builder image validation pods")
+	rootCmd.Flags().BoolVar(&probeSSH, "probe-builder-ssh", true, "Wait for a builder to send its SSH banner before marking its request Running")
+	rootCmd.Flags().BoolVar(&captureLogs, "capture-builder-logs", false, "Keep the tail of each builder's logs in status.logTail before its pod is deleted")
+	rootCmd.Flags().Int64Var(&logTailLines, "log-tail-lines", controller.DefaultLogTailLines, "Builder log lines kept in status.logTail")
+	rootCmd.Flags().StringVar(&logStoreURL, "log-store", "", "Upload each builder's full log before its pod is deleted, to s3://bucket/prefix or gs://bucket/prefix; implies --capture-builder-logs. Credentials come from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or GCS HMAC keys in the same variables (optional)")
+	rootCmd.Flags().StringVar(&logStoreEndpoint, "log-store-endpoint", "", "API endpoint of an S3-compatible log store such as MinIO (default: AWS for s3://, storage.googleapis.com for gs://)")
+	rootCmd.Flags().StringVar(&logStoreRegion, "log-store-region", "us-east-1", "Region of the log store bucket")
+	rootCmd.Flags().BoolVar(&leaderElect, "enable-leader-election", false, "Elect a single active controller through a coordination Lease so several replicas can run")
+	rootCmd.Flags().StringVar(&leaderElectNS, "leader-election-namespace", "", "Namespace of the leader election Lease (default: the controller's namespace)")
+	rootCmd.Flags().StringVar(&leaderElectID, "leader-election-id", "nix-remote-build-controller.nix.io", "Name of the leader election Lease")
 	rootCmd.AddCommand(versionCmd)
 }
 
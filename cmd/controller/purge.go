@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/controller"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	purgeNamespace string
+	purgePhases    []string
+	purgeOlderThan time.Duration
+	purgeRequester string
+	purgeDryRun    bool
+)
+
+var purgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Delete old build requests by phase, age or requester",
+	Long:  "Deletes the NixBuildRequests matching the given filters, and builder pods whose build request no longer exists, while the controller keeps running",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		phases := make([]v1alpha1.BuildPhase, 0, len(purgePhases))
+		for _, phase := range purgePhases {
+			switch p := v1alpha1.BuildPhase(phase); p {
+			case v1alpha1.BuildPhasePending, v1alpha1.BuildPhaseQueued, v1alpha1.BuildPhaseCreating, v1alpha1.BuildPhaseRunning,
+				v1alpha1.BuildPhaseCompleted, v1alpha1.BuildPhaseFailed:
+				phases = append(phases, p)
+			default:
+				log.Fatal().Str("phase", phase).Msg("Unknown build phase")
+			}
+		}
+
+		scheme := runtime.NewScheme()
+		if err := clientgoscheme.AddToScheme(scheme); err != nil {
+			log.Fatal().Err(err).Msg("Failed to add client-go scheme")
+		}
+		if err := v1alpha1.AddToScheme(scheme); err != nil {
+			log.Fatal().Err(err).Msg("Failed to add NixBuilder scheme")
+		}
+
+		k8sConfig, err := ctrl.GetConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to get Kubernetes config")
+		}
+
+		k8sClient, err := client.New(k8sConfig, client.Options{Scheme: scheme})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create Kubernetes client")
+		}
+
+		if err := controller.Purge(ctx, k8sClient, purgeNamespace, controller.PurgeOptions{
+			Phases:    phases,
+			OlderThan: purgeOlderThan,
+			Requester: purgeRequester,
+			DryRun:    purgeDryRun,
+		}); err != nil {
+			log.Fatal().Err(err).Msg("Purge failed")
+		}
+
+		log.Info().Str("namespace", purgeNamespace).Bool("dry_run", purgeDryRun).Msg("Purge completed")
+	},
+}
+
+func init() {
+	purgeCmd.Flags().StringVarP(&purgeNamespace, "namespace", "n", "default", "Namespace to clean up")
+	purgeCmd.Flags().StringSliceVar(&purgePhases, "phase", nil, "Only purge build requests in these phases (default Completed,Failed)")
+	purgeCmd.Flags().DurationVar(&purgeOlderThan, "older-than", 24*time.Hour, "Only purge build requests that finished at least this long ago")
+	purgeCmd.Flags().StringVar(&purgeRequester, "requester", "", "Only purge build requests from this requester; orphaned pods are kept")
+	purgeCmd.Flags().BoolVar(&purgeDryRun, "dry-run", false, "Only print what would be deleted")
+	rootCmd.AddCommand(purgeCmd)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"os/signal"
+	"syscall"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/controller"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	uninstallNamespace    string
+	uninstallSSHKeySecret string
+	uninstallDryRun       bool
+)
+
+var uninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Remove build requests and controller-created resources from a namespace",
+	Long:  "Deletes all NixBuildRequests and the jobs, pods, secrets, services, network policies, ConfigMaps and isolated namespaces created for them, so removing the system leaves no credentials behind",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		scheme := runtime.NewScheme()
+		if err := clientgoscheme.AddToScheme(scheme); err != nil {
+			log.Fatal().Err(err).Msg("Failed to add client-go scheme")
+		}
+		if err := v1alpha1.AddToScheme(scheme); err != nil {
+			log.Fatal().Err(err).Msg("Failed to add NixBuilder scheme")
+		}
+
+		k8sConfig, err := ctrl.GetConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to get Kubernetes config")
+		}
+
+		k8sClient, err := client.New(k8sConfig, client.Options{Scheme: scheme})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create Kubernetes client")
+		}
+
+		if err := controller.Uninstall(ctx, k8sClient, uninstallNamespace, controller.UninstallOptions{
+			SSHKeySecret: uninstallSSHKeySecret,
+			DryRun:       uninstallDryRun,
+		}); err != nil {
+			log.Fatal().Err(err).Msg("Uninstall failed")
+		}
+
+		log.Info().Str("namespace", uninstallNamespace).Bool("dry_run", uninstallDryRun).Msg("Uninstall completed")
+	},
+}
+
+func init() {
+	uninstallCmd.Flags().StringVarP(&uninstallNamespace, "namespace", "n", "default", "Namespace to clean up")
+	uninstallCmd.Flags().StringVar(&uninstallSSHKeySecret, "ssh-key-secret", "", "Also delete this shared SSH keypair secret (optional)")
+	uninstallCmd.Flags().BoolVar(&uninstallDryRun, "dry-run", false, "Only print what would be deleted")
+	rootCmd.AddCommand(uninstallCmd)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+var version = "dev"
+var namespace string
+var owner string
+var duration time.Duration
+var idleTimeout time.Duration
+var system string
+var image string
+var extendBy time.Duration
+var wait bool
+var forwardPorts []int32
+
+var rootCmd = &cobra.Command{
+	Use:   "lease",
+	Short: "Manage leased Nix builders",
+	Long:  "Request, extend and release long-lived Nix builders for interactive development",
+
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var requestCmd = &cobra.Command{
+	Use:   "request NAME",
+	Short: "Request a leased builder",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, k8sClient, err := setup(cmd)
+		if err != nil {
+			return err
+		}
+
+		lease := &v1alpha1.BuilderLease{
+			ObjectMeta: metav1.ObjectMeta{Name: args[0], Namespace: namespace},
+			Spec: v1alpha1.BuilderLeaseSpec{
+				Owner:        owner,
+				ExpiresAt:    metav1.NewTime(time.Now().Add(duration)),
+				System:       system,
+				Image:        image,
+				ForwardPorts: forwardPorts,
+			},
+		}
+		if idleTimeout > 0 {
+			seconds := int64(idleTimeout.Seconds())
+			lease.Spec.IdleTimeoutSeconds = &seconds
+		}
+		if err := k8sClient.Create(ctx, lease); err != nil {
+			return fmt.Errorf("failed to create lease: %w", err)
+		}
+		fmt.Printf("Lease %s requested until %s\n", lease.Name, lease.Spec.ExpiresAt.Format(time.RFC3339))
+
+		if wait {
+			if err := waitForLease(ctx, k8sClient, lease); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Connect with ssh-ng://%s%s@<proxy>\n", v1alpha1.LeaseUserPrefix, lease.Name)
+		return nil
+	},
+}
+
+var extendCmd = &cobra.Command{
+	Use:   "extend NAME",
+	Short: "Push back a lease's expiry",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, k8sClient, err := setup(cmd)
+		if err != nil {
+			return err
+		}
+
+		var lease v1alpha1.BuilderLease
+		if err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: args[0]}, &lease); err != nil {
+			return fmt.Errorf("failed to get lease: %w", err)
+		}
+		if lease.Status.Phase == v1alpha1.LeasePhaseExpired || lease.Status.Phase == v1alpha1.LeasePhaseFailed {
+			return fmt.Errorf("lease %s is %s; request a new one", lease.Name, lease.Status.Phase)
+		}
+
+		base := lease.Spec.ExpiresAt.Time
+		if now := time.Now(); base.Before(now) {
+			base = now
+		}
+		lease.Spec.ExpiresAt = metav1.NewTime(base.Add(extendBy))
+		if err := k8sClient.Update(ctx, &lease); err != nil {
+			return fmt.Errorf("failed to extend lease: %w", err)
+		}
+		fmt.Printf("Lease %s extended until %s\n", lease.Name, lease.Spec.ExpiresAt.Format(time.RFC3339))
+		return nil
+	},
+}
+
+var releaseCmd = &cobra.Command{
+	Use:   "release NAME",
+	Short: "Release a lease and its builder",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, k8sClient, err := setup(cmd)
+		if err != nil {
+			return err
+		}
+
+		lease := &v1alpha1.BuilderLease{ObjectMeta: metav1.ObjectMeta{Name: args[0], Namespace: namespace}}
+		if err := k8sClient.Delete(ctx, lease); err != nil {
+			return fmt.Errorf("failed to release lease: %w", err)
+		}
+		fmt.Printf("Lease %s released\n", lease.Name)
+		return nil
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List leases",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, k8sClient, err := setup(cmd)
+		if err != nil {
+			return err
+		}
+
+		var leases v1alpha1.BuilderLeaseList
+		if err := k8sClient.List(ctx, &leases, client.InNamespace(namespace)); err != nil {
+			return fmt.Errorf("failed to list leases: %w", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tOWNER\tPHASE\tEXPIRES\tPOD")
+		for _, lease := range leases.Items {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", lease.Name, lease.Spec.Owner, lease.Status.Phase,
+				lease.Spec.ExpiresAt.Format(time.RFC3339), lease.Status.PodName)
+		}
+		return w.Flush()
+	},
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version number",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("v%s\n", version)
+	},
+}
+
+// setup returns a context cancelled on interrupt and a client for the
+// current kubeconfig context
+func setup(cmd *cobra.Command) (context.Context, client.Client, error) {
+	ctx, cancel := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+	cobra.OnFinalize(cancel)
+
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, nil, fmt.Errorf("failed to add NixBuilder scheme: %w", err)
+	}
+
+	k8sConfig, err := config.GetConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get Kubernetes config: %w", err)
+	}
+
+	k8sClient, err := client.New(k8sConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	return ctx, k8sClient, nil
+}
+
+// waitForLease polls until the lease's builder is ready or has failed
+func waitForLease(ctx context.Context, k8sClient client.Client, lease *v1alpha1.BuilderLease) error {
+	fmt.Println("Waiting for builder...")
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(lease), lease); err != nil {
+			return fmt.Errorf("failed to get lease: %w", err)
+		}
+		switch lease.Status.Phase {
+		case v1alpha1.LeasePhaseActive:
+			fmt.Printf("Builder %s is ready\n", lease.Status.PodName)
+			return nil
+		case v1alpha1.LeasePhaseExpired, v1alpha1.LeasePhaseFailed:
+			return fmt.Errorf("lease %s is %s: %s", lease.Name, lease.Status.Phase, lease.Status.Message)
+		}
+	}
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "default", "Namespace the proxy creates builds in")
+
+	requestCmd.Flags().StringVar(&owner, "owner", os.Getenv("USER"), "Identity allowed to use the lease, as authenticated by the proxy")
+	requestCmd.Flags().DurationVar(&duration, "duration", 4*time.Hour, "How long to keep the builder")
+	requestCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", time.Hour, "Reclaim the builder after this long without a session (0 disables)")
+	requestCmd.Flags().StringVar(&system, "system", "", "Nix system the builder must build natively, such as aarch64-linux")
+	requestCmd.Flags().StringVar(&image, "image", "", "Builder image (default: the controller's)")
+	requestCmd.Flags().Int32SliceVar(&forwardPorts, "forward-port", nil, "Builder port that may be forwarded to and from the client (repeatable)")
+	requestCmd.Flags().BoolVar(&wait, "wait", true, "Wait for the builder to be ready")
+
+	extendCmd.Flags().DurationVar(&extendBy, "by", 2*time.Hour, "How much longer to keep the builder")
+
+	rootCmd.AddCommand(requestCmd, extendCmd, releaseCmd, listCmd, versionCmd)
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
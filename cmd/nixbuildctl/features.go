@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/features"
+)
+
+var (
+	featuresController string
+	featuresProxies    []string
+	featuresJSON       bool
+)
+
+var featuresCmd = &cobra.Command{
+	Use:   "features",
+	Short: "Show which optional features the controller and proxy have enabled",
+	Long: "Reads the /features endpoint on the health port of the controller and of proxy replicas, such as " +
+		"http://localhost:8081 with a port-forward, and lists each optional subsystem with whether it is " +
+		"enabled and how it is configured, or which flag enables it",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		urls := featuresProxies
+		if featuresController != "" {
+			urls = append([]string{featuresController}, urls...)
+		}
+		if len(urls) == 0 {
+			return fmt.Errorf("give --controller or --proxy-admin")
+		}
+
+		httpClient := &http.Client{Timeout: 10 * time.Second}
+		reports := make([]*features.Report, 0, len(urls))
+		for _, u := range urls {
+			report, err := features.Fetch(ctx, httpClient, u)
+			if err != nil {
+				return err
+			}
+			reports = append(reports, report)
+		}
+
+		if featuresJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(reports)
+		}
+		for i, report := range reports {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s v%s (%s)\n", report.Component, report.Version, urls[i])
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "FEATURE\tENABLED\tDETAIL")
+			for _, feature := range report.Features {
+				enabled := "no"
+				if feature.Enabled {
+					enabled = "yes"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", feature.Name, enabled, feature.Detail)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	featuresCmd.Flags().StringVar(&featuresController, "controller", "", "Controller health port URL, such as http://localhost:8081 with a port-forward to --health-port")
+	featuresCmd.Flags().StringSliceVar(&featuresProxies, "proxy-admin", nil, "Admin API URLs of proxy replicas, such as http://localhost:8080 with a port-forward to --health-port")
+	featuresCmd.Flags().BoolVar(&featuresJSON, "json", false, "Print the reports as JSON")
+
+	rootCmd.AddCommand(featuresCmd)
+}
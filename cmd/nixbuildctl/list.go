@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/status"
+)
+
+var (
+	listProxy string
+	listAll   bool
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List build sessions with their builder, client and proxy",
+	Long: "Lists the unfinished NixBuildRequests in --namespace with their session, phase, builder pod, client " +
+		"and the proxy replica that created them, oldest first",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		k8sClient, _, err := newClients()
+		if err != nil {
+			return err
+		}
+
+		var buildReqs v1alpha1.NixBuildRequestList
+		if err := k8sClient.List(cmd.Context(), &buildReqs, client.InNamespace(namespace)); err != nil {
+			return fmt.Errorf("failed to list build requests: %w", err)
+		}
+		slices.SortFunc(buildReqs.Items, func(a, b v1alpha1.NixBuildRequest) int {
+			return a.CreationTimestamp.Compare(b.CreationTimestamp.Time)
+		})
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SESSION\tPHASE\tPOD\tCLIENT\tPROXY\tAGE")
+		for _, buildReq := range buildReqs.Items {
+			if listProxy != "" && !createdBy(&buildReq, listProxy) {
+				continue
+			}
+			if !listAll && status.Finished(&buildReq.Status) {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				buildReq.Spec.SessionID,
+				valueOr(string(buildReq.Status.Phase), "Pending"),
+				valueOr(buildReq.Status.PodName, "-"),
+				valueOr(clientOf(&buildReq), "-"),
+				valueOr(proxyOf(&buildReq), "-"),
+				duration.HumanDuration(time.Since(buildReq.CreationTimestamp.Time)))
+		}
+		return w.Flush()
+	},
+}
+
+// proxyOf names the proxy that created a build request: its pod when
+// recorded, otherwise its proxy ID
+func proxyOf(buildReq *v1alpha1.NixBuildRequest) string {
+	if pod := buildReq.Annotations[v1alpha1.ProxyPodAnnotation]; pod != "" {
+		return pod
+	}
+	return buildReq.Labels[v1alpha1.ProxyLabel]
+}
+
+// clientOf describes the client of a build request's session as
+// requester@address, or whichever of the two the proxy recorded
+func clientOf(buildReq *v1alpha1.NixBuildRequest) string {
+	requester := buildReq.Annotations[policy.RequesterAnnotation]
+	addr := buildReq.Annotations[policy.ClientAddressAnnotation]
+	if requester != "" && addr != "" {
+		return requester + "@" + addr
+	}
+	return requester + addr
+}
+
+// createdBy reports whether a build request was created by proxy, given as
+// a pod name, namespace/name or proxy ID
+func createdBy(buildReq *v1alpha1.NixBuildRequest, proxy string) bool {
+	if buildReq.Labels[v1alpha1.ProxyLabel] == proxy {
+		return true
+	}
+	pod := buildReq.Annotations[v1alpha1.ProxyPodAnnotation]
+	_, name, _ := strings.Cut(pod, "/")
+	return pod != "" && (pod == proxy || name == proxy)
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func init() {
+	listCmd.Flags().BoolVarP(&listAll, "all", "a", false, "Include completed and failed build requests")
+	listCmd.Flags().StringVar(&listProxy, "proxy", "", "Only list build requests created by this proxy, as a pod name, namespace/name or --proxy-id")
+
+	rootCmd.AddCommand(listCmd)
+}
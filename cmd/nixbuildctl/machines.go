@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	importProxyHost    string
+	importProxyHostKey string
+	importIdentity     string
+	importOutput       string
+	importBuilders     string
+	importKeySecret    string
+)
+
+// defaultSystems are the systems the controller has builders for without
+// --system-builders
+var defaultSystems = []string{"x86_64-linux", "aarch64-linux", "armv7l-linux", "riscv64-linux"}
+
+var importMachinesCmd = &cobra.Command{
+	Use:   "import-machines <machines-file>",
+	Short: "Convert a Nix machines file into one pointing at the proxy",
+	Long: "Reads an existing /etc/nix/machines listing static SSH builders and writes a machines file with one " +
+		"entry per system, pointing at the proxy. Each entry keeps the combined max-jobs and supported features " +
+		"of the builders it replaces. With --external-builders it also writes a NixExternalBuilder manifest for " +
+		"each builder, so the proxy can keep routing sessions to them.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if importBuilders == "-" && importOutput == "-" {
+			return fmt.Errorf("--external-builders and --output cannot both be standard output")
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open machines file: %w", err)
+		}
+		defer f.Close()
+		machines, err := parseMachines(f)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", args[0], err)
+		}
+
+		hostKey := "-"
+		if importProxyHostKey != "" {
+			key, err := os.ReadFile(importProxyHostKey)
+			if err != nil {
+				return fmt.Errorf("failed to read proxy host key: %w", err)
+			}
+			hostKey = base64.StdEncoding.EncodeToString([]byte(strings.TrimSpace(string(key))))
+		}
+
+		w := os.Stdout
+		if importOutput != "-" {
+			if w, err = os.Create(importOutput); err != nil {
+				return fmt.Errorf("failed to create %s: %w", importOutput, err)
+			}
+			defer w.Close()
+		}
+		for _, m := range proxyMachines(machines, importProxyHost, importIdentity, hostKey) {
+			if _, err := fmt.Fprintln(w, m); err != nil {
+				return err
+			}
+			if !slices.Contains(defaultSystems, m.systems[0]) {
+				fmt.Fprintf(os.Stderr, "warning: %s needs an entry in the controller's --system-builders\n", m.systems[0])
+			}
+		}
+		if importBuilders != "" {
+			if err := writeExternalBuilders(machines); err != nil {
+				return err
+			}
+		}
+		for _, m := range machines {
+			if len(m.mandatoryFeatures) > 0 {
+				fmt.Fprintf(os.Stderr, "warning: dropped mandatory features %s of %s; proxy builders take any build\n",
+					strings.Join(m.mandatoryFeatures, ","), m.uri)
+			}
+		}
+		if importOutput != "-" {
+			return w.Close()
+		}
+		return nil
+	},
+}
+
+// writeExternalBuilders writes the machines as NixExternalBuilder manifests
+// to importBuilders
+func writeExternalBuilders(machines []machine) error {
+	builders, err := externalBuilders(machines, namespace, importKeySecret)
+	if err != nil {
+		return err
+	}
+	var manifests []string
+	for _, builder := range builders {
+		data, err := yaml.Marshal(builder)
+		if err != nil {
+			return err
+		}
+		manifests = append(manifests, string(data))
+	}
+	out := []byte(strings.Join(manifests, "---\n"))
+
+	for _, m := range machines {
+		if m.identity != "" && importKeySecret == "" {
+			fmt.Fprintf(os.Stderr, "warning: identity %s of %s is not imported; the proxy logs in with its client key unless --key-secret names a Secret\n",
+				m.identity, m.uri)
+		}
+		if m.hostKey == "" {
+			fmt.Fprintf(os.Stderr, "warning: %s has no host key; the proxy refuses it unless --insecure-ignore-builder-host-keys is set\n", m.uri)
+		}
+	}
+	if importBuilders == "-" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	if err := os.WriteFile(importBuilders, out, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", importBuilders, err)
+	}
+	return nil
+}
+
+// externalBuilders converts machines into NixExternalBuilder objects in
+// namespace, each named after its host and logging in with keySecret
+func externalBuilders(machines []machine, namespace, keySecret string) ([]v1alpha1.NixExternalBuilder, error) {
+	builders := make([]v1alpha1.NixExternalBuilder, 0, len(machines))
+	names := map[string]int{}
+	for _, m := range machines {
+		uri := m.uri
+		if !strings.Contains(uri, "://") {
+			uri = "ssh://" + uri
+		}
+		address, ok := strings.CutPrefix(uri, "ssh://")
+		if !ok {
+			address, ok = strings.CutPrefix(uri, "ssh-ng://")
+		}
+		if !ok {
+			return nil, fmt.Errorf("machine %s is not an SSH builder", m.uri)
+		}
+
+		name := builderName(address)
+		names[name]++
+		if n := names[name]; n > 1 {
+			name = fmt.Sprintf("%s-%d", name, n)
+		}
+
+		builders = append(builders, v1alpha1.NixExternalBuilder{
+			TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.GroupVersion.String(), Kind: "NixExternalBuilder"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec: v1alpha1.NixExternalBuilderSpec{
+				URI:               uri,
+				Systems:           m.systems,
+				SSHKeySecret:      keySecret,
+				MaxJobs:           int32(m.maxJobs),
+				SpeedFactor:       int32(m.speedFactor),
+				SupportedFeatures: m.supportedFeatures,
+				MandatoryFeatures: m.mandatoryFeatures,
+				PublicHostKey:     m.hostKey,
+			},
+		})
+	}
+	return builders, nil
+}
+
+// builderName turns a builder's [user@]host[:port] into an object name
+func builderName(address string) string {
+	if _, host, ok := strings.Cut(address, "@"); ok {
+		address = host
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, address)
+	if len(name) > 58 {
+		name = name[:58]
+	}
+	if name = strings.Trim(name, "-"); name == "" {
+		return "builder"
+	}
+	return name
+}
+
+// machine is one builder entry of a Nix machines file
+type machine struct {
+	uri               string
+	systems           []string
+	identity          string
+	maxJobs           int
+	speedFactor       int
+	supportedFeatures []string
+	mandatoryFeatures []string
+	hostKey           string
+}
+
+// String formats the machine as a machines file line
+func (m machine) String() string {
+	return strings.Join([]string{
+		m.uri,
+		orDash(strings.Join(m.systems, ",")),
+		orDash(m.identity),
+		strconv.Itoa(m.maxJobs),
+		strconv.Itoa(m.speedFactor),
+		orDash(strings.Join(m.supportedFeatures, ",")),
+		orDash(strings.Join(m.mandatoryFeatures, ",")),
+		orDash(m.hostKey),
+	}, " ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// parseMachines reads a machines file: one builder per line or per
+// ";"-separated entry, with "#" comments and "-" for default fields
+func parseMachines(r io.Reader) ([]machine, error) {
+	var machines []machine
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		for entry := range strings.SplitSeq(line, ";") {
+			fields := strings.Fields(entry)
+			if len(fields) == 0 {
+				continue
+			}
+			if strings.HasPrefix(fields[0], "@") {
+				return nil, fmt.Errorf("included machines file %s is not supported, import it separately", fields[0][1:])
+			}
+			field := func(i int) string {
+				if i < len(fields) && fields[i] != "-" {
+					return fields[i]
+				}
+				return ""
+			}
+			m := machine{
+				uri:               fields[0],
+				systems:           splitList(field(1)),
+				identity:          field(2),
+				maxJobs:           1,
+				speedFactor:       1,
+				supportedFeatures: splitList(field(5)),
+				mandatoryFeatures: splitList(field(6)),
+				hostKey:           field(7),
+			}
+			for i, dst := range map[int]*int{3: &m.maxJobs, 4: &m.speedFactor} {
+				if v := field(i); v != "" {
+					n, err := strconv.Atoi(v)
+					if err != nil {
+						return nil, fmt.Errorf("machine %s: invalid number %q", m.uri, v)
+					}
+					*dst = n
+				}
+			}
+			if len(m.systems) == 0 {
+				return nil, fmt.Errorf("machine %s: no system listed; add the builder's system explicitly", m.uri)
+			}
+			machines = append(machines, m)
+		}
+	}
+	return machines, scanner.Err()
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// proxyMachines replaces static builders with one proxy entry per system.
+// The proxy picks the system from the SSH user, so each gets its own user.
+func proxyMachines(machines []machine, proxyHost, identity, hostKey string) []machine {
+	bySystem := map[string]*machine{}
+	var systems []string
+	for _, m := range machines {
+		for _, system := range m.systems {
+			pm, ok := bySystem[system]
+			if !ok {
+				pm = &machine{
+					uri:      fmt.Sprintf("ssh-ng://nix-%s@%s", system, proxyHost),
+					systems:  []string{system},
+					identity: identity,
+					hostKey:  hostKey,
+				}
+				bySystem[system] = pm
+				systems = append(systems, system)
+			}
+			pm.maxJobs += m.maxJobs
+			pm.speedFactor = max(pm.speedFactor, m.speedFactor)
+			for _, feature := range m.supportedFeatures {
+				if !slices.Contains(pm.supportedFeatures, feature) {
+					pm.supportedFeatures = append(pm.supportedFeatures, feature)
+				}
+			}
+		}
+	}
+
+	out := make([]machine, 0, len(systems))
+	for _, system := range systems {
+		out = append(out, *bySystem[system])
+	}
+	return out
+}
+
+func init() {
+	importMachinesCmd.Flags().StringVar(&importProxyHost, "proxy", "", "Host name clients reach the proxy at")
+	importMachinesCmd.Flags().StringVar(&importProxyHostKey, "proxy-host-key", "", "File with the proxy's SSH host public key, pinned in the generated entries (optional)")
+	importMachinesCmd.Flags().StringVar(&importIdentity, "identity", "", "SSH private key clients authenticate to the proxy with (optional)")
+	importMachinesCmd.Flags().StringVarP(&importOutput, "output", "o", "-", "Machines file to write, or - for standard output")
+	importMachinesCmd.Flags().StringVar(&importBuilders, "external-builders", "", "File to write a NixExternalBuilder manifest per builder to, or - for standard output (optional)")
+	importMachinesCmd.Flags().StringVar(&importKeySecret, "key-secret", "", "kubernetes.io/ssh-auth Secret the proxy logs in to the external builders with (optional)")
+	importMachinesCmd.MarkFlagRequired("proxy")
+
+	rootCmd.AddCommand(importMachinesCmd)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMachines(t *testing.T) {
+	machines, err := parseMachines(strings.NewReader(`
+# static builders
+ssh-ng://builder@mac-1.example.com aarch64-darwin,x86_64-darwin /etc/nix/mac.key 4 2 big-parallel - c3NoLWVkMjU1MTk=
+ssh://arm.example.com aarch64-linux - - - kvm kvm ; x86.example.com x86_64-linux # trailing comment
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []machine{
+		{
+			uri:               "ssh-ng://builder@mac-1.example.com",
+			systems:           []string{"aarch64-darwin", "x86_64-darwin"},
+			identity:          "/etc/nix/mac.key",
+			maxJobs:           4,
+			speedFactor:       2,
+			supportedFeatures: []string{"big-parallel"},
+			hostKey:           "c3NoLWVkMjU1MTk=",
+		},
+		{
+			uri:               "ssh://arm.example.com",
+			systems:           []string{"aarch64-linux"},
+			maxJobs:           1,
+			speedFactor:       1,
+			supportedFeatures: []string{"kvm"},
+			mandatoryFeatures: []string{"kvm"},
+		},
+		{uri: "x86.example.com", systems: []string{"x86_64-linux"}, maxJobs: 1, speedFactor: 1},
+	}
+	if !reflect.DeepEqual(machines, want) {
+		t.Errorf("parseMachines =\n%+v\nwant\n%+v", machines, want)
+	}
+	if got := machines[1].String(); got != "ssh://arm.example.com aarch64-linux - 1 1 kvm kvm -" {
+		t.Errorf("String() = %q", got)
+	}
+
+	for _, file := range []string{
+		"@/etc/nix/machines.d/macs",
+		"ssh://mac.example.com",
+		"ssh://mac.example.com aarch64-darwin - many",
+		"ssh://mac.example.com aarch64-darwin - 1 fast",
+	} {
+		if _, err := parseMachines(strings.NewReader(file)); err == nil {
+			t.Errorf("parseMachines(%q) succeeded", file)
+		}
+	}
+}
+
+func TestProxyMachines(t *testing.T) {
+	machines := []machine{
+		{uri: "ssh://mac-1", systems: []string{"aarch64-darwin"}, maxJobs: 2, speedFactor: 1, supportedFeatures: []string{"big-parallel"}},
+		{uri: "ssh://mac-2", systems: []string{"aarch64-darwin", "x86_64-darwin"}, maxJobs: 4, speedFactor: 3, supportedFeatures: []string{"benchmark", "big-parallel"}},
+	}
+	got := proxyMachines(machines, "nix-proxy.example.com", "/etc/nix/proxy-key", "-")
+	want := []machine{
+		{
+			uri:               "ssh-ng://nix-aarch64-darwin@nix-proxy.example.com",
+			systems:           []string{"aarch64-darwin"},
+			identity:          "/etc/nix/proxy-key",
+			maxJobs:           6,
+			speedFactor:       3,
+			supportedFeatures: []string{"big-parallel", "benchmark"},
+			hostKey:           "-",
+		},
+		{
+			uri:               "ssh-ng://nix-x86_64-darwin@nix-proxy.example.com",
+			systems:           []string{"x86_64-darwin"},
+			identity:          "/etc/nix/proxy-key",
+			maxJobs:           4,
+			speedFactor:       3,
+			supportedFeatures: []string{"benchmark", "big-parallel"},
+			hostKey:           "-",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("proxyMachines =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestExternalBuilders(t *testing.T) {
+	machines := []machine{
+		{uri: "ssh-ng://builder@Mac-1.example.com:2222", systems: []string{"aarch64-darwin"}, maxJobs: 4, speedFactor: 2, hostKey: "c3NoLWVkMjU1MTk="},
+		{uri: "mac-1.example.com", systems: []string{"x86_64-darwin"}, maxJobs: 1, speedFactor: 1},
+	}
+	builders, err := externalBuilders(machines, "nix", "mac-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builders) != 2 {
+		t.Fatalf("got %d builders, want 2", len(builders))
+	}
+	if builders[0].Name != "mac-1-example-com" || builders[1].Name != "mac-1-example-com-2" {
+		t.Errorf("names = %s, %s", builders[0].Name, builders[1].Name)
+	}
+	first := builders[0]
+	if first.Namespace != "nix" || first.Kind != "NixExternalBuilder" || first.APIVersion != "nix.io/v1alpha1" {
+		t.Errorf("object = %+v", first.TypeMeta)
+	}
+	spec := first.Spec
+	if spec.URI != "ssh-ng://builder@Mac-1.example.com:2222" || spec.MaxJobs != 4 || spec.SpeedFactor != 2 ||
+		spec.SSHKeySecret != "mac-key" || spec.PublicHostKey != "c3NoLWVkMjU1MTk=" {
+		t.Errorf("spec = %+v", spec)
+	}
+	if builders[1].Spec.URI != "ssh://mac-1.example.com" {
+		t.Errorf("URI without a scheme = %s, want ssh://", builders[1].Spec.URI)
+	}
+
+	if _, err := externalBuilders([]machine{{uri: "https://cache.example.com", systems: []string{"x86_64-linux"}}}, "nix", ""); err == nil {
+		t.Error("converted a builder that is not reached over SSH")
+	}
+}
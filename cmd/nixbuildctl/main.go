@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/adminapi"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/proxy"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/supportbundle"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+var version = "dev"
+var namespace string
+var sessionID string
+var componentNamespace string
+var proxyAdminURL string
+var adminTokenFile string
+var logLines int64
+var output string
+var usageProxies []string
+var usageWindow time.Duration
+var usageJSON bool
+
+var rootCmd = &cobra.Command{
+	Use:   "nixbuildctl",
+	Short: "Inspect Nix remote builds",
+	Long:  "Troubleshooting tools for the Nix remote build controller and proxy",
+
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var supportBundleCmd = &cobra.Command{
+	Use:   "support-bundle",
+	Short: "Collect a session's build request, pod, events and logs into an archive",
+	Long: "Writes a tar.gz with the session's NixBuildRequest, builder pod, events, builder logs, " +
+		"the proxy and controller log lines mentioning the session and a merged timeline, for attaching to issues",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		k8sClient, clientset, err := newClients()
+		if err != nil {
+			return err
+		}
+
+		token, err := adminToken()
+		if err != nil {
+			return err
+		}
+		if output == "" {
+			output = fmt.Sprintf("support-bundle-%s.tar.gz", sessionID)
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("failed to create bundle: %w", err)
+		}
+		defer f.Close()
+
+		if err := supportbundle.Collect(ctx, k8sClient, clientset, supportbundle.Options{
+			SessionID:          sessionID,
+			Namespace:          namespace,
+			ComponentNamespace: componentNamespace,
+			ProxyAdminURL:      proxyAdminURL,
+			ProxyAdminToken:    token,
+			LogLines:           logLines,
+		}, f); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+		fmt.Printf("Support bundle written to %s\n", output)
+		return nil
+	},
+}
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Report builds, CPU-hours and data transferred per requester",
+	Long: "Sums the usage reports of one or more proxy replicas' admin APIs by requester and namespace. " +
+		"Proxies keep usage for 7 days in hourly buckets.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		token, err := adminToken()
+		if err != nil {
+			return err
+		}
+		var usage []proxy.Usage
+		var since time.Time
+		for _, adminURL := range usageProxies {
+			report, err := fetchUsage(ctx, adminURL, token, usageWindow)
+			if err != nil {
+				return err
+			}
+			usage = append(usage, report.Usage...)
+			if since.IsZero() || report.Since.Before(since) {
+				since = report.Since
+			}
+		}
+		usage = proxy.MergeUsage(usage)
+
+		if usageJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(proxy.UsageReport{Since: since, Until: time.Now(), Usage: usage})
+		}
+		fmt.Printf("Usage since %s\n\n", since.Local().Format(time.DateTime))
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAMESPACE\tREQUESTER\tBUILDS\tCPU-HOURS\tGB TRANSFERRED")
+		for _, u := range usage {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%.2f\t%.2f\n", u.Namespace, u.Requester, u.Builds, u.CPUHours, float64(u.BytesTransferred)/1e9)
+		}
+		return w.Flush()
+	},
+}
+
+// fetchUsage reads a proxy's usage report for window
+func fetchUsage(ctx context.Context, adminURL string, token []byte, window time.Duration) (*proxy.UsageReport, error) {
+	u := strings.TrimSuffix(adminURL, "/") + "/usage?window=" + url.QueryEscape(window.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	adminapi.Authorize(req, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach proxy admin API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy admin API %s returned %s", adminURL, resp.Status)
+	}
+	var report proxy.UsageReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, fmt.Errorf("failed to decode usage report from %s: %w", adminURL, err)
+	}
+	return &report, nil
+}
+
+// adminToken reads the bearer token for proxy admin APIs, if one was given
+func adminToken() ([]byte, error) {
+	if adminTokenFile == "" {
+		return nil, nil
+	}
+	return adminapi.ReadToken(adminTokenFile)
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version number",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("v%s\n", version)
+	},
+}
+
+// newClients returns a client and clientset for the current kubeconfig
+// context. The clientset reads pod logs, which the client cannot.
+func newClients() (client.Client, kubernetes.Interface, error) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, nil, fmt.Errorf("failed to add client-go scheme: %w", err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, nil, fmt.Errorf("failed to add NixBuilder scheme: %w", err)
+	}
+
+	k8sConfig, err := config.GetConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get Kubernetes config: %w", err)
+	}
+
+	k8sClient, err := client.New(k8sConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create Kubernetes clientset: %w", err)
+	}
+	return k8sClient, clientset, nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "default", "Namespace the proxy creates builds in")
+	rootCmd.PersistentFlags().StringVar(&adminTokenFile, "admin-token-file", "", "File holding the bearer token of the proxy admin APIs given by --proxy-admin (optional)")
+
+	supportBundleCmd.Flags().StringVar(&sessionID, "session", "", "Session ID to collect, as logged by the proxy and recorded in spec.sessionId")
+	supportBundleCmd.Flags().StringVar(&componentNamespace, "component-namespace", "default", "Namespace of the proxy and controller pods")
+	supportBundleCmd.Flags().StringVar(&proxyAdminURL, "proxy-admin", "", "Proxy admin API URL, such as http://localhost:8082 with a port-forward to --admin-address, to include the live session (optional)")
+	supportBundleCmd.Flags().Int64Var(&logLines, "log-lines", 5000, "Recent log lines read from each pod")
+	supportBundleCmd.Flags().StringVarP(&output, "output", "o", "", "Archive path (default support-bundle-<session>.tar.gz)")
+	supportBundleCmd.MarkFlagRequired("session")
+
+	usageCmd.Flags().StringSliceVar(&usageProxies, "proxy-admin", nil, "Admin API URLs of every proxy replica, such as http://localhost:8082 with a port-forward to --admin-address")
+	usageCmd.Flags().DurationVar(&usageWindow, "window", 24*time.Hour, "Period to report, up to 168h")
+	usageCmd.Flags().BoolVar(&usageJSON, "json", false, "Print the report as JSON")
+	usageCmd.MarkFlagRequired("proxy-admin")
+
+	rootCmd.AddCommand(supportBundleCmd, usageCmd, versionCmd)
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
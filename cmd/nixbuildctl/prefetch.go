@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+var (
+	prefetchLock     string
+	prefetchInputs   []string
+	prefetchSchedule string
+	prefetchTarget   string
+	prefetchClaim    string
+	prefetchImage    string
+)
+
+var prefetchCmd = &cobra.Command{
+	Use:   "prefetch <name>",
+	Short: "Create or update a FlakePrefetch that fetches flake inputs ahead of builds",
+	Long: "Fetches the inputs of a flake.lock given by --lock, and any --input flake references, into the " +
+		"controller's binary cache or a shared store claim. With --schedule the prefetch repeats on a cron " +
+		"schedule in UTC, such as \"30 7 * * 1-5\" before a weekday build window; without it it runs once.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		spec := v1alpha1.FlakePrefetchSpec{
+			Inputs:    prefetchInputs,
+			Schedule:  prefetchSchedule,
+			Target:    v1alpha1.PrefetchTarget(prefetchTarget),
+			ClaimName: prefetchClaim,
+			Image:     prefetchImage,
+		}
+		if prefetchLock != "" {
+			data, err := os.ReadFile(prefetchLock)
+			if err != nil {
+				return fmt.Errorf("failed to read flake lock: %w", err)
+			}
+			spec.FlakeLock = string(data)
+		}
+		if spec.FlakeLock == "" && len(spec.Inputs) == 0 {
+			return fmt.Errorf("nothing to prefetch: give --lock or --input")
+		}
+
+		k8sClient, _, err := newClients()
+		if err != nil {
+			return err
+		}
+
+		var prefetch v1alpha1.FlakePrefetch
+		err = k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: args[0]}, &prefetch)
+		switch {
+		case apierrors.IsNotFound(err):
+			prefetch = v1alpha1.FlakePrefetch{
+				ObjectMeta: metav1.ObjectMeta{Name: args[0], Namespace: namespace},
+				Spec:       spec,
+			}
+			if err := k8sClient.Create(ctx, &prefetch); err != nil {
+				return fmt.Errorf("failed to create prefetch: %w", err)
+			}
+			fmt.Printf("Prefetch %s created\n", prefetch.Name)
+		case err != nil:
+			return fmt.Errorf("failed to get prefetch %s: %w", args[0], err)
+		default:
+			prefetch.Spec = spec
+			if err := k8sClient.Update(ctx, &prefetch); err != nil {
+				return fmt.Errorf("failed to update prefetch: %w", err)
+			}
+			fmt.Printf("Prefetch %s updated\n", prefetch.Name)
+		}
+		return nil
+	},
+}
+
+func init() {
+	prefetchCmd.Flags().StringVar(&prefetchLock, "lock", "", "flake.lock whose inputs are fetched")
+	prefetchCmd.Flags().StringArrayVar(&prefetchInputs, "input", nil, "Flake reference to fetch, such as github:NixOS/nixpkgs/<rev> (repeatable)")
+	prefetchCmd.Flags().StringVar(&prefetchSchedule, "schedule", "", "Cron schedule in UTC to repeat the prefetch on (default: run once)")
+	prefetchCmd.Flags().StringVar(&prefetchTarget, "target", string(v1alpha1.PrefetchTargetCache), "Where inputs are kept: Cache or Store")
+	prefetchCmd.Flags().StringVar(&prefetchClaim, "claim", "", "Shared store claim the Store target fetches into")
+	prefetchCmd.Flags().StringVar(&prefetchImage, "image", "", "Builder image to run the prefetch in (default: the controller's)")
+
+	rootCmd.AddCommand(prefetchCmd)
+}
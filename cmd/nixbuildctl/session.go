@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/adminapi"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// builderContainer is the container the controller runs Nix in
+const builderContainer = "nix-builder"
+
+var (
+	logsFollow     bool
+	logsTail       int64
+	terminateProxy string
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <session>",
+	Short: "Print or follow the logs of a session's builder",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		k8sClient, clientset, err := newClients()
+		if err != nil {
+			return err
+		}
+		buildReq, err := findSession(ctx, k8sClient, args[0])
+		if err != nil {
+			return err
+		}
+		if buildReq.Status.PodName == "" {
+			return fmt.Errorf("session %s has no builder pod yet (phase %s)", args[0], valueOr(string(buildReq.Status.Phase), "Pending"))
+		}
+
+		podNamespace := valueOr(buildReq.Status.BuilderNamespace, buildReq.Namespace)
+		opts := &corev1.PodLogOptions{Container: builderContainer, Follow: logsFollow}
+		if logsTail >= 0 {
+			opts.TailLines = &logsTail
+		}
+		stream, err := clientset.CoreV1().Pods(podNamespace).GetLogs(buildReq.Status.PodName, opts).Stream(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read logs of builder pod %s: %w", buildReq.Status.PodName, err)
+		}
+		defer stream.Close()
+		if _, err := io.Copy(os.Stdout, stream); err != nil && ctx.Err() == nil {
+			return fmt.Errorf("failed to stream builder logs: %w", err)
+		}
+		return nil
+	},
+}
+
+var terminateCmd = &cobra.Command{
+	Use:   "terminate <session>",
+	Short: "Force-terminate a session and delete its build request",
+	Long: "Evicts the session from the proxy given by --proxy-admin, which disconnects its client, and deletes " +
+		"its NixBuildRequest so the controller removes the builder. Without --proxy-admin the proxy notices the " +
+		"deleted request once its builder is gone.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		k8sClient, _, err := newClients()
+		if err != nil {
+			return err
+		}
+		buildReq, err := findSession(ctx, k8sClient, args[0])
+		if err != nil {
+			return err
+		}
+
+		if terminateProxy != "" {
+			token, err := adminToken()
+			if err != nil {
+				return err
+			}
+			evicted, err := evictSession(ctx, terminateProxy, token, buildReq.Spec.SessionID)
+			if err != nil {
+				return err
+			}
+			if evicted {
+				fmt.Printf("Session %s disconnected by the proxy\n", buildReq.Spec.SessionID)
+			} else {
+				fmt.Printf("Session %s is not connected to %s (proxy: %s)\n", buildReq.Spec.SessionID, terminateProxy, valueOr(proxyOf(buildReq), "unknown"))
+			}
+		}
+
+		if err := k8sClient.Delete(ctx, buildReq); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to delete build request %s: %w", buildReq.Name, err)
+		}
+		fmt.Printf("Build request %s deleted\n", buildReq.Name)
+		return nil
+	},
+}
+
+// findSession returns the build request of a session. The proxy names it
+// after the session; other clients may not, so the namespace is searched
+// by spec.sessionId as well.
+func findSession(ctx context.Context, k8sClient client.Client, sessionID string) (*v1alpha1.NixBuildRequest, error) {
+	var buildReq v1alpha1.NixBuildRequest
+	err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "build-" + sessionID}, &buildReq)
+	if err == nil {
+		return &buildReq, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get build request of session %s: %w", sessionID, err)
+	}
+
+	var buildReqs v1alpha1.NixBuildRequestList
+	if err := k8sClient.List(ctx, &buildReqs, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("failed to list build requests: %w", err)
+	}
+	for i := range buildReqs.Items {
+		if buildReqs.Items[i].Spec.SessionID == sessionID {
+			return &buildReqs.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no build request for session %s in namespace %s", sessionID, namespace)
+}
+
+// evictSession asks a proxy's admin API to disconnect a session, reporting
+// false when the proxy does not hold it
+func evictSession(ctx context.Context, adminURL string, token []byte, sessionID string) (bool, error) {
+	u := strings.TrimSuffix(adminURL, "/") + "/sessions/" + url.PathEscape(sessionID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u, nil)
+	if err != nil {
+		return false, err
+	}
+	adminapi.Authorize(req, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to reach proxy admin API: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("proxy admin API %s returned %s", adminURL, resp.Status)
+	}
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "Keep streaming new log lines")
+	logsCmd.Flags().Int64Var(&logsTail, "tail", -1, "Recent lines to print, or -1 for all")
+
+	terminateCmd.Flags().StringVar(&terminateProxy, "proxy-admin", "", "Admin API URL of the proxy holding the session, such as http://localhost:8082 with a port-forward to --admin-address (optional)")
+
+	rootCmd.AddCommand(logsCmd, terminateCmd)
+}
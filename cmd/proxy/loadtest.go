@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/loadtest"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var (
+	loadtestTarget      string
+	loadtestUser        string
+	loadtestIdentity    string
+	loadtestCommand     string
+	loadtestSessions    int
+	loadtestConcurrency int
+	loadtestClosureSize string
+	loadtestTimeout     time.Duration
+)
+
+var loadtestCmd = &cobra.Command{
+	Use:   "loadtest",
+	Short: "Run synthetic SSH sessions and report latency and throughput",
+	Long:  "Opens synthetic SSH sessions that echo a payload through a proxy (or an in-process proxy in front of a fake builder when --target is empty) and reports latency percentiles and throughput",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		closureSize, err := resource.ParseQuantity(loadtestClosureSize)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid --closure-size")
+		}
+
+		var signer ssh.Signer
+		if loadtestIdentity != "" {
+			keyBytes, err := os.ReadFile(loadtestIdentity)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to read identity file")
+			}
+			signer, err = ssh.ParsePrivateKey(keyBytes)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to parse identity file")
+			}
+		}
+
+		result, err := loadtest.Run(ctx, loadtest.Config{
+			Target:      loadtestTarget,
+			User:        loadtestUser,
+			Signer:      signer,
+			Command:     loadtestCommand,
+			Sessions:    loadtestSessions,
+			Concurrency: loadtestConcurrency,
+			ClosureSize: closureSize.Value(),
+			Timeout:     loadtestTimeout,
+		})
+		if err != nil && err != context.Canceled {
+			log.Fatal().Err(err).Msg("Load test failed")
+		}
+
+		fmt.Printf("sessions:    %d (%d failed)\n", result.Sessions, result.Failures)
+		fmt.Printf("elapsed:     %s\n", result.Elapsed.Round(time.Millisecond))
+		fmt.Printf("throughput:  %.2f MiB/s\n", result.Throughput()/(1<<20))
+		printPercentiles("connect", result.Connect)
+		printPercentiles("first byte", result.FirstByte)
+		printPercentiles("total", result.Total)
+
+		if result.Failures > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func printPercentiles(name string, p loadtest.Percentiles) {
+	fmt.Printf("%-12s p50=%s p90=%s p99=%s max=%s\n", name+":",
+		p.P50.Round(time.Microsecond), p.P90.Round(time.Microsecond),
+		p.P99.Round(time.Microsecond), p.Max.Round(time.Microsecond))
+}
+
+func init() {
+	loadtestCmd.Flags().StringVar(&loadtestTarget, "target", "", "SSH address to load, e.g. the proxy service (default: in-process proxy with a fake builder)")
+	loadtestCmd.Flags().StringVarP(&loadtestUser, "user", "u", "nixbld", "SSH user")
+	loadtestCmd.Flags().StringVarP(&loadtestIdentity, "identity", "i", "", "SSH private key for authentication (optional)")
+	loadtestCmd.Flags().StringVar(&loadtestCommand, "command", "cat", "Command run on each session; must echo stdin to stdout")
+	loadtestCmd.Flags().IntVar(&loadtestSessions, "sessions", 10, "Total number of sessions")
+	loadtestCmd.Flags().IntVar(&loadtestConcurrency, "concurrency", 4, "Sessions in flight at once")
+	loadtestCmd.Flags().StringVar(&loadtestClosureSize, "closure-size", "16Mi", "Bytes sent through each session")
+	loadtestCmd.Flags().DurationVar(&loadtestTimeout, "timeout", 5*time.Minute, "Timeout per session")
+	rootCmd.AddCommand(loadtestCmd)
+}
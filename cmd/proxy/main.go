@@ -5,21 +5,98 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
+	"time"
 
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/adminapi"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/configfile"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/logging"
 	"github.com/omarjatoi/nix-remote-build-controller/pkg/proxy"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/tracing"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/vault"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	ctrl "sigs.k8s.io/controller-runtime"
 )
 
 var version = "dev"
+var configFile string
 var port int
 var healthPort int
 var hostKeyPath string
+var hostCertPath string
+var adminTLSCert string
+var adminTLSKey string
+var adminAddress string
+var adminTokenFile string
+var vaultAddr string
+var vaultRole string
+var vaultAuthPath string
+var vaultKVMount string
+var vaultKeyPath string
+var vaultCacheTTL time.Duration
 var namespace string
+var principalNamespaces []string
+var proxyID string
+var podName string
+var podNamespace string
+var podUID string
 var remoteUser string
 var remotePort int32
 var sshKeySecret string
+var shutdownTimeout time.Duration
+var kubeconfig string
+var kubeContext string
+var kubeAPIQPS float32
+var kubeAPIBurst int
+var authProviders []string
+var authorizedKeysPath string
+var authorizedKeysSecret string
+var authorizedKeysConfigMap string
+var userCAPath string
+var oidcIssuer string
+var oidcAudience string
+var oidcUsernameClaim string
+var authzRulesPath string
+var maxChannelsPerConn int
+var maxSessionGoroutines int
+var maxSessions int
+var connectionRate float64
+var connectionBurst int
+var sessionMaxAge time.Duration
+var logLevel string
+var logFormat string
+var logLevels map[string]string
+var otlpEndpoint string
+var otlpInsecure bool
+var traceSampleRatio float64
+var idleTimeout time.Duration
+var keepAliveInterval time.Duration
+var builderTLSSecret string
+var builderTLSPort int32
+var builderResolver string
+var builderService string
+var clusterDomain string
+var builderExternalHost string
+var builderExternalPort int32
+var insecureBuilderHostKeys bool
+var sessionClientKeys bool
+var preemptionRetries int
+var builderReuseWindow time.Duration
+var queueTimeout time.Duration
+var staticBuildersPath string
+var externalBuilders bool
+var restrictCommands bool
+var sessionIDFormat string
+var sessionIDPrefix string
+var sessionIDSeed uint64
+var allowedCommands []string
+var allowedSubsystems []string
+var auditLog string
+var acceptCIEnv bool
+var ciEnvVars map[string]string
 
 var rootCmd = &cobra.Command{
 	Use:   "proxy",
@@ -29,11 +106,190 @@ var rootCmd = &cobra.Command{
 		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 		defer cancel()
 
-		addr := fmt.Sprintf(":%d", port)
-		sshProxy, err := proxy.NewSSHProxy(ctx, addr, hostKeyPath, namespace, remoteUser, remotePort, healthPort, sshKeySecret)
+		var config *configfile.File
+		if configFile != "" {
+			var err error
+			config, err = configfile.Load(configFile, cmd.Flags(), reloadableFlags)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load config file")
+			}
+		}
+
+		if err := logging.Setup(logging.Config{Level: logLevel, Format: logFormat, ComponentLevels: logLevels}, os.Stderr); err != nil {
+			log.Fatal().Err(err).Msg("Invalid logging configuration")
+		}
+		ctrl.SetLogger(logging.Logr(logging.ComponentControllerRuntime))
+
+		shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+			Endpoint:    otlpEndpoint,
+			Insecure:    otlpInsecure,
+			SampleRatio: traceSampleRatio,
+			ServiceName: "nix-remote-build-proxy",
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up tracing")
+		}
+		defer func() {
+			flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer flushCancel()
+			if err := shutdownTracing(flushCtx); err != nil {
+				log.Warn().Err(err).Msg("Failed to flush traces")
+			}
+		}()
+
+		var vaultClient *vault.Client
+		if vaultAddr != "" {
+			vaultClient = vault.New(vault.Config{
+				Address:  vaultAddr,
+				Role:     vaultRole,
+				AuthPath: vaultAuthPath,
+				KVMount:  vaultKVMount,
+				CacheTTL: vaultCacheTTL,
+			})
+		}
+
+		var authorizer proxy.Authorizer
+		if authzRulesPath != "" {
+			rules, err := proxy.LoadRuleAuthorizer(authzRulesPath)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load authorization rules")
+			}
+			authorizer = rules
+		}
+
+		var audit proxy.AuditSink
+		if auditLog != "" {
+			audit, err = proxy.NewAuditSink(auditLog)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to open audit log")
+			}
+		}
+
+		var ciEnv map[string]string
+		if acceptCIEnv {
+			for name, annotation := range ciEnvVars {
+				if !slices.Contains(v1alpha1.CIContextAnnotations, annotation) {
+					log.Fatal().Str("variable", name).Str("annotation", annotation).Strs("allowed", v1alpha1.CIContextAnnotations).Msg("Invalid --ci-env-vars annotation")
+				}
+			}
+			ciEnv = ciEnvVars
+		}
+
+		var namespaceRules []proxy.NamespaceRule
+		for _, s := range principalNamespaces {
+			rule, err := proxy.ParseNamespaceRule(s)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid --principal-namespaces")
+			}
+			namespaceRules = append(namespaceRules, rule)
+		}
+
+		var staticBuilders []proxy.StaticBuilder
+		if staticBuildersPath != "" {
+			staticBuilders, err = proxy.LoadStaticBuilders(staticBuildersPath)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load static builders")
+			}
+		}
+
+		var commands []string
+		if restrictCommands {
+			commands = allowedCommands
+		}
+
+		var adminToken []byte
+		if adminTokenFile != "" {
+			if adminToken, err = adminapi.ReadToken(adminTokenFile); err != nil {
+				log.Fatal().Err(err).Msg("Invalid --admin-token-file")
+			}
+		}
+
+		sshProxy, err := proxy.NewSSHProxy(ctx, proxy.Config{
+			Version:         version,
+			Addr:            fmt.Sprintf(":%d", port),
+			HostKeyPath:     hostKeyPath,
+			HostCertPath:    hostCertPath,
+			Namespace:       namespace,
+			NamespaceRules:  namespaceRules,
+			ProxyID:         proxyID,
+			PodName:         podName,
+			PodNamespace:    podNamespace,
+			PodUID:          podUID,
+			RemoteUser:      remoteUser,
+			RemotePort:      remotePort,
+			HealthPort:      healthPort,
+			SSHKeySecret:    sshKeySecret,
+			ShutdownTimeout: shutdownTimeout,
+			Kubeconfig:      kubeconfig,
+			KubeContext:     kubeContext,
+			KubeAPIQPS:      kubeAPIQPS,
+			KubeAPIBurst:    kubeAPIBurst,
+
+			Auth: proxy.AuthConfig{
+				Providers:               authProviders,
+				AuthorizedKeysPath:      authorizedKeysPath,
+				AuthorizedKeysSecret:    authorizedKeysSecret,
+				AuthorizedKeysConfigMap: authorizedKeysConfigMap,
+				UserCAPath:              userCAPath,
+				OIDCIssuer:              oidcIssuer,
+				OIDCAudience:            oidcAudience,
+				OIDCUsernameClaim:       oidcUsernameClaim,
+			},
+			Authorizer: authorizer,
+
+			MaxChannelsPerConn:   maxChannelsPerConn,
+			MaxSessionGoroutines: maxSessionGoroutines,
+			MaxSessions:          maxSessions,
+			SessionMaxAge:        sessionMaxAge,
+			ConnectionRate:       connectionRate,
+			ConnectionBurst:      connectionBurst,
+			IdleTimeout:          idleTimeout,
+			KeepAliveInterval:    keepAliveInterval,
+
+			BuilderTLSSecret: builderTLSSecret,
+			BuilderTLSPort:   builderTLSPort,
+			Resolver: proxy.ResolverConfig{
+				Mode:          builderResolver,
+				Service:       builderService,
+				ClusterDomain: clusterDomain,
+				ExternalHost:  builderExternalHost,
+				ExternalPort:  builderExternalPort,
+			},
+
+			SessionClientKeys:             sessionClientKeys,
+			PreemptionRetries:             preemptionRetries,
+			BuilderReuseWindow:            builderReuseWindow,
+			QueueTimeout:                  queueTimeout,
+			StaticBuilders:                staticBuilders,
+			ExternalBuilders:              externalBuilders,
+			InsecureIgnoreBuilderHostKeys: insecureBuilderHostKeys,
+			AllowedCommands:               commands,
+			AllowedSubsystems:             allowedSubsystems,
+			Audit:                         audit,
+			CIEnv:                         ciEnv,
+
+			SessionIDFormat: sessionIDFormat,
+			SessionIDPrefix: sessionIDPrefix,
+			SessionIDSeed:   sessionIDSeed,
+
+			AdminTLSCertPath: adminTLSCert,
+			AdminTLSKeyPath:  adminTLSKey,
+			AdminAddress:     adminAddress,
+			AdminToken:       adminToken,
+
+			Vault:        vaultClient,
+			VaultKeyPath: vaultKeyPath,
+		})
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to create SSH proxy")
 		}
+		if config != nil {
+			go config.Watch(ctx, func(changed []string) error {
+				log.Info().Strs("changed", changed).Msg("Reloaded config file")
+				sshProxy.ApplySettings(proxy.Settings{IdleTimeout: idleTimeout, KeepAliveInterval: keepAliveInterval})
+				return nil
+			})
+		}
 
 		log.Info().Int("port", port).Msg("Starting Nix remote builder SSH proxy")
 		if err := sshProxy.Start(ctx); err != nil && err != context.Canceled {
@@ -50,14 +306,88 @@ var versionCmd = &cobra.Command{
 	},
 }
 
+// reloadableFlags are the settings a --config file can change while the
+// proxy runs
+var reloadableFlags = []string{"idle-timeout", "keepalive-interval"}
+
 func init() {
+	rootCmd.Flags().StringVar(&configFile, "config", "", "YAML file of flag settings, reloaded on change or SIGHUP; flags given on the command line take precedence (optional)")
 	rootCmd.Flags().IntVarP(&port, "port", "p", 2222, "SSH proxy server port")
 	rootCmd.Flags().IntVar(&healthPort, "health-port", 8080, "Health check server port")
 	rootCmd.Flags().StringVarP(&hostKeyPath, "host-key", "k", "", "Path to provided SSH host private key file")
+	rootCmd.Flags().StringVar(&hostCertPath, "host-cert", "", "Path to an OpenSSH host certificate for --host-key (optional)")
 	rootCmd.Flags().StringVarP(&namespace, "namespace", "n", "default", "Kubernetes namespace for build requests")
+	rootCmd.Flags().StringSliceVar(&principalNamespaces, "principal-namespaces", nil, "Rules placing the build requests and leases of matching principals in other namespaces than --namespace, as principal=namespace with * wildcards; the first match applies")
+	hostname, _ := os.Hostname()
+	rootCmd.Flags().StringVar(&proxyID, "proxy-id", hostname, "Identity of this proxy replica; it only watches build requests it created (empty watches all)")
+	rootCmd.Flags().StringVar(&podName, "pod-name", os.Getenv("POD_NAME"), "Name of the proxy's pod, recorded on the build requests it creates (default $POD_NAME)")
+	rootCmd.Flags().StringVar(&podNamespace, "pod-namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the proxy's pod (default $POD_NAMESPACE)")
+	rootCmd.Flags().StringVar(&podUID, "pod-uid", os.Getenv("POD_UID"), "UID of the proxy's pod, so replicas can release build requests of proxy pods that are gone (default $POD_UID)")
 	rootCmd.Flags().StringVarP(&remoteUser, "remote-user", "u", "nixbld", "SSH username for builder pods")
 	rootCmd.Flags().Int32VarP(&remotePort, "remote-port", "r", 22, "SSH port on builder pods")
-	rootCmd.Flags().StringVar(&sshKeySecret, "ssh-key-secret", "nix-builder-ssh-keys", "Secret containing SSH keypair for builder authentication (must contain 'private' and 'public' keys)")
+	rootCmd.Flags().StringVar(&sshKeySecret, "ssh-key-secret", "nix-builder-ssh-keys", "Secret holding the SSH client keypair and host key shared by all proxy replicas; missing keys are generated")
+	rootCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Graceful shutdown timeout for in-flight sessions")
+	rootCmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "Kubeconfig file of the cluster, for a proxy running outside it (default: in-cluster config or $KUBECONFIG)")
+	rootCmd.Flags().StringVar(&kubeContext, "kube-context", "", "Kubeconfig context to use (default: the current context)")
+	rootCmd.Flags().Float32Var(&kubeAPIQPS, "kube-api-qps", 0, "Kubernetes API requests per second allowed before client-side throttling (0 for the client-go default of 20)")
+	rootCmd.Flags().IntVar(&kubeAPIBurst, "kube-api-burst", 0, "Kubernetes API requests allowed in a burst above --kube-api-qps (0 for the client-go default of 30)")
+	rootCmd.Flags().StringSliceVar(&authProviders, "auth", []string{proxy.AuthNone}, "Client authentication providers to try in order: none, file, secret, ca, oidc")
+	rootCmd.Flags().StringVar(&authorizedKeysPath, "auth-authorized-keys", "", "Path to an authorized_keys file for the file auth provider")
+	rootCmd.Flags().StringVar(&authorizedKeysSecret, "auth-authorized-keys-secret", "", "Secret whose 'authorized_keys' key is used by the secret auth provider")
+	rootCmd.Flags().StringVar(&authorizedKeysConfigMap, "auth-authorized-keys-configmap", "", "ConfigMap whose 'authorized_keys' key is used by the configmap auth provider")
+	rootCmd.Flags().StringVar(&userCAPath, "auth-user-ca", "", "Path to trusted SSH user CA public keys for the ca auth provider")
+	rootCmd.Flags().StringVar(&oidcIssuer, "auth-oidc-issuer", "", "OIDC issuer URL for the oidc auth provider")
+	rootCmd.Flags().StringVar(&oidcAudience, "auth-oidc-audience", "", "Expected audience of OIDC ID tokens")
+	rootCmd.Flags().StringVar(&oidcUsernameClaim, "auth-oidc-username-claim", proxy.DefaultOIDCUsernameClaim, "ID token claim used as the client's identity")
+	rootCmd.Flags().StringVar(&authzRulesPath, "authz-rules", "", "Path to a YAML file of authorization rules for session actions (optional; all actions are allowed when unset)")
+	rootCmd.Flags().IntVar(&maxChannelsPerConn, "max-channels-per-conn", proxy.DefaultMaxChannelsPerConn, "Maximum concurrently handled channels per client connection (0 for unlimited)")
+	rootCmd.Flags().IntVar(&maxSessionGoroutines, "max-session-goroutines", proxy.DefaultMaxSessionGoroutines, "Maximum goroutines serving a single client connection (0 for unlimited)")
+	rootCmd.Flags().IntVar(&maxSessions, "max-sessions", proxy.DefaultMaxSessions, "Maximum sessions tracked at once; new connections are refused when full (0 for unlimited)")
+	rootCmd.Flags().Float64Var(&connectionRate, "connection-rate", 0, "New connections allowed per second from each source address; excess connections are refused (0 for unlimited)")
+	rootCmd.Flags().IntVar(&connectionBurst, "connection-burst", proxy.DefaultConnectionBurst, "Connections a source address may open at once before --connection-rate applies")
+	rootCmd.Flags().DurationVar(&sessionMaxAge, "session-max-age", proxy.DefaultSessionMaxAge, "Age after which a session is considered leaked and evicted (0 to disable)")
+	rootCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", 0, "Close sessions and delete their build requests after this long without data (0 to disable)")
+	rootCmd.Flags().DurationVar(&keepAliveInterval, "keepalive-interval", proxy.DefaultKeepAliveInterval, "Interval between SSH keepalives to clients; unanswered clients are disconnected (0 to disable)")
+	rootCmd.Flags().StringVar(&builderTLSSecret, "builder-tls-secret", "", "Builder CA secret name configured on the controller; enables mTLS to builder pods (optional)")
+	rootCmd.Flags().Int32Var(&builderTLSPort, "builder-tls-port", 2223, "TLS-wrapped SSH port on builder pods")
+	rootCmd.Flags().StringVar(&builderResolver, "builder-resolver", proxy.ResolverPodIP, "How builder pods are reached: pod-ip, service-dns, external or port-forward")
+	rootCmd.Flags().StringVar(&builderService, "builder-service", "", "Headless Service builder pods are a subdomain of, with --builder-resolver=service-dns")
+	rootCmd.Flags().StringVar(&clusterDomain, "cluster-domain", proxy.DefaultClusterDomain, "DNS domain of the cluster's Services, with --builder-resolver=service-dns")
+	rootCmd.Flags().StringVar(&builderExternalHost, "builder-external-host", "", "Host template for builders with --builder-resolver=external; {pod}, {namespace} and {ip} are replaced")
+	rootCmd.Flags().Int32Var(&builderExternalPort, "builder-external-port", 0, "Port for builders with --builder-resolver=external (default: the builder's port)")
+	rootCmd.Flags().DurationVar(&queueTimeout, "queue-timeout", 0, "Fail sessions whose build request stays queued this long, advising the client to build locally (0 waits indefinitely)")
+	rootCmd.Flags().BoolVar(&externalBuilders, "external-builders", false, "Add the NixExternalBuilder objects in --namespace to the static builders when the proxy starts")
+	rootCmd.Flags().StringVar(&staticBuildersPath, "static-builders", "", "Path to a Nix machines file of builders outside the cluster, taking sessions for non-Linux systems and sessions the cluster has no capacity for (optional)")
+	rootCmd.Flags().IntVar(&preemptionRetries, "preemption-retries", 3, "Times a session is given a new builder after its builder is preempted or loses its node before it is ready")
+	rootCmd.Flags().DurationVar(&builderReuseWindow, "builder-reuse-window", 0, "Keep the builder of a finished connection this long for the same client key's next connection (0 disables reuse)")
+	rootCmd.Flags().BoolVar(&sessionClientKeys, "session-client-keys", false, "Log in to each builder with a key generated for its session instead of the shared key")
+	rootCmd.Flags().StringVar(&sessionIDFormat, "session-id-format", proxy.SessionIDFormatUUID, "Session ID format: uuid (UUIDv7) or ulid")
+	rootCmd.Flags().StringVar(&sessionIDPrefix, "session-id-prefix", "", "Prefix such as a region or team prepended to session IDs (optional)")
+	rootCmd.Flags().Uint64Var(&sessionIDSeed, "session-id-seed", 0, "Seed making the random part of session IDs reproducible, for replaying load tests (0 uses secure randomness)")
+	rootCmd.Flags().BoolVar(&restrictCommands, "restrict-commands", false, "Only let build sessions exec --allowed-commands on their builder, refusing shells")
+	rootCmd.Flags().StringSliceVar(&allowedCommands, "allowed-commands", proxy.DefaultAllowedCommands, "Commands build sessions may exec with --restrict-commands; a trailing * matches any further arguments")
+	rootCmd.Flags().StringSliceVar(&allowedSubsystems, "allowed-subsystems", nil, "Subsystems, such as sftp, build sessions may start with --restrict-commands")
+	rootCmd.Flags().BoolVar(&acceptCIEnv, "ci-env", false, "Record allowlisted SSH environment variables from clients as CI context annotations on build requests")
+	rootCmd.Flags().StringToStringVar(&ciEnvVars, "ci-env-vars", proxy.DefaultCIEnv, "Environment variables recorded with --ci-env and the annotation each sets")
+	rootCmd.Flags().StringVar(&auditLog, "audit-log", "", "Where to write a JSON audit record for every connection: stdout, a file path, or an http(s) URL to POST to (disabled if empty)")
+	rootCmd.Flags().BoolVar(&insecureBuilderHostKeys, "insecure-ignore-builder-host-keys", false, "Connect to builders without verifying their host keys (not recommended)")
+	rootCmd.Flags().StringVar(&adminAddress, "admin-address", "127.0.0.1:8082", "Address of the admin API listing and evicting sessions and reporting usage; must be a loopback address unless --admin-token-file is set (empty to disable)")
+	rootCmd.Flags().StringVar(&adminTokenFile, "admin-token-file", "", "File holding the bearer token the admin API requires (optional)")
+	rootCmd.Flags().StringVar(&adminTLSCert, "admin-tls-cert", "", "Path to a TLS certificate for serving health endpoints and the admin API over HTTPS (optional)")
+	rootCmd.Flags().StringVar(&adminTLSKey, "admin-tls-key", "", "Path to the private key for --admin-tls-cert")
+	rootCmd.MarkFlagsRequiredTogether("admin-tls-cert", "admin-tls-key")
+	rootCmd.Flags().StringVar(&logLevel, "log-level", "info", "Least severe level logged: trace, debug, info, warn or error")
+	rootCmd.Flags().StringVar(&logFormat, "log-format", logging.FormatJSON, "Log format: json or console")
+	rootCmd.Flags().StringToStringVar(&logLevels, "log-levels", nil, "Levels overriding --log-level for components, such as session=debug,auth=warn")
+	rootCmd.Flags().StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP gRPC collector address for exporting traces, such as otel-collector:4317 (optional)")
+	rootCmd.Flags().BoolVar(&otlpInsecure, "otlp-insecure", false, "Connect to --otlp-endpoint without TLS")
+	rootCmd.Flags().Float64Var(&traceSampleRatio, "trace-sample-ratio", 1, "Fraction of sessions traced")
+	rootCmd.Flags().StringVar(&vaultAddr, "vault-addr", "", "Vault address; when set SSH keys are read from Vault instead of --ssh-key-secret (optional)")
+	rootCmd.Flags().StringVar(&vaultRole, "vault-role", "nix-remote-build-proxy", "Vault Kubernetes auth role")
+	rootCmd.Flags().StringVar(&vaultAuthPath, "vault-auth-path", "kubernetes", "Mount path of the Vault Kubernetes auth method")
+	rootCmd.Flags().StringVar(&vaultKVMount, "vault-kv-mount", "secret", "Mount path of the Vault KV v2 secrets engine")
+	rootCmd.Flags().StringVar(&vaultKeyPath, "vault-key-path", "nix-builder/ssh-keys", "Vault KV path holding the SSH keys")
+	rootCmd.Flags().DurationVar(&vaultCacheTTL, "vault-cache-ttl", 5*time.Minute, "How long key material read from Vault is cached")
 	rootCmd.AddCommand(versionCmd)
 }
 
@@ -55,11 +55,38 @@
           # Native binaries for local development
           controller = buildGoApp pkgs "controller";
           proxy = buildGoApp pkgs "proxy";
+          agent = buildGoApp pkgs "agent";
+          lease = buildGoApp pkgs "lease";
+          nixbuildctl = buildGoApp pkgs "nixbuildctl";
 
           # Container images (uses current system's pkgs - works on Linux runners)
           controller-image = buildImage pkgs "controller" self.packages.${system}.controller;
           proxy-image = buildImage pkgs "proxy" self.packages.${system}.proxy;
 
+          # Run by the builder's Nix daemon after each build with the
+          # outputs in OUT_PATHS. A failed upload fails the build, so the
+          # client never relies on a result the cache does not have.
+          cache-push-hook = pkgs.writeShellScript "cache-push-hook" ''
+            set -eu
+            set -f
+            creds=/etc/nix-builder/cache-push
+            url="$(cat /run/cache-push-url)"
+            if [ -f $creds/aws-credentials ]; then
+              export AWS_SHARED_CREDENTIALS_FILE=$creds/aws-credentials
+            fi
+            opts=""
+            if [ -f $creds/netrc ]; then
+              opts="--option netrc-file $creds/netrc"
+            fi
+            if [ -f /etc/nix-builder/signing/token ]; then
+              ${self.packages.${system}.agent}/bin/agent sign --nix ${pkgs.nix}/bin/nix \
+                --url "$(cat /run/signing-url)" --pod "$(cat /run/signing-pod)" $OUT_PATHS
+            elif [ -f $creds/secret-key ]; then
+              ${pkgs.nix}/bin/nix --extra-experimental-features nix-command store sign --key-file $creds/secret-key $OUT_PATHS
+            fi
+            exec ${pkgs.nix}/bin/nix --extra-experimental-features nix-command copy $opts --to "$url" $OUT_PATHS
+          '';
+
           # Entrypoint script for builder container - runs setup at container start
           builder-entrypoint = pkgs.writeShellScriptBin "entrypoint" ''
             set -e
@@ -67,34 +94,92 @@
             # Create necessary directories
             mkdir -p /etc/ssh /var/empty /home/nixbld/.ssh /tmp /run/sshd
 
-            # Generate host key if needed
+            # Use the host key the controller generated and published for the
+            # proxy to verify, generating one only if none was provided
+            if [ -f /etc/nix-builder/host-key/ssh_host_ed25519_key ]; then
+              cp /etc/nix-builder/host-key/ssh_host_ed25519_key /etc/ssh/ssh_host_ed25519_key
+              chmod 600 /etc/ssh/ssh_host_ed25519_key
+            fi
             if [ ! -f /etc/ssh/ssh_host_ed25519_key ]; then
               ${pkgs.openssh}/bin/ssh-keygen -t ed25519 -f /etc/ssh/ssh_host_ed25519_key -N ""
             fi
 
+            # Show the session the controller assigned this builder to. The
+            # file follows the pod's annotations, so pooled builders pick up
+            # their session once claimed.
+            if [ -f /etc/nix-builder/session/motd ]; then
+              ln -sf /etc/nix-builder/session/motd /etc/motd
+            fi
+
             # Copy authorized_keys from mounted secret (which is read-only)
             # to a writable location
             if [ -f /home/nixbld/.ssh/authorized_keys ]; then
               cp /home/nixbld/.ssh/authorized_keys /tmp/authorized_keys
             fi
 
+            # Create the session's user when the controller manages builder users
+            BUILDER_USER="''${BUILDER_USER:-nixbld}"
+            if [ "$BUILDER_USER" != nixbld ]; then
+              for f in passwd group; do
+                cat /etc/$f > /tmp/$f && rm -f /etc/$f && mv /tmp/$f /etc/$f
+              done
+              echo "$BUILDER_USER:x:1001:1001:Nix Session User:/home/$BUILDER_USER:/bin/sh" >> /etc/passwd
+              echo "$BUILDER_USER:x:1001:" >> /etc/group
+              mkdir -p /home/$BUILDER_USER
+              chown 1001:1001 /home/$BUILDER_USER
+            fi
+
             # Set up SSH config pointing to writable authorized_keys location
             cat > /etc/ssh/sshd_config <<SSHD_CONFIG
             HostKey /etc/ssh/ssh_host_ed25519_key
             AuthorizedKeysFile /tmp/authorized_keys
             PasswordAuthentication no
-            AllowUsers nixbld
+            AllowUsers $BUILDER_USER
             StrictModes no
+            Subsystem sftp internal-sftp
             SSHD_CONFIG
 
             # Fix permissions on home directory (excluding mounted secret)
             chown 1000:1000 /home/nixbld
             chmod 755 /home/nixbld
 
+            # Push build outputs to the binary cache the controller names
+            if [ -n "$CACHE_PUSH_URL" ]; then
+              echo "$CACHE_PUSH_URL" > /run/cache-push-url
+              if [ -n "$SIGNING_URL" ]; then
+                echo "$SIGNING_URL" > /run/signing-url
+                echo "$SIGNING_POD_NAMESPACE/$SIGNING_POD_NAME" > /run/signing-pod
+              fi
+              export NIX_CONFIG="$NIX_CONFIG
+            post-build-hook = ${self.packages.${system}.cache-push-hook}"
+            fi
+
             # Start nix-daemon in the background
             ${pkgs.nix}/bin/nix-daemon &
             sleep 1
 
+            # Wrap sshd in mutual TLS when the controller provides certificates
+            if [ -n "$BUILDER_TLS_PORT" ] && [ -f /etc/nix-builder/tls/tls.crt ]; then
+              cat > /tmp/stunnel.conf <<STUNNEL_CONFIG
+            foreground = no
+            pid = /run/stunnel.pid
+            [ssh]
+            accept = $BUILDER_TLS_PORT
+            connect = 127.0.0.1:22
+            cert = /etc/nix-builder/tls/tls.crt
+            key = /etc/nix-builder/tls/tls.key
+            CAfile = /etc/nix-builder/tls/ca.crt
+            verifyPeer = yes
+            sslVersionMin = TLSv1.3
+            STUNNEL_CONFIG
+              ${pkgs.stunnel}/bin/stunnel /tmp/stunnel.conf
+            fi
+
+            # Start the store import/export agent when the controller enables it
+            if [ -n "$AGENT_PORT" ] && [ -f /etc/nix-builder/agent/token ]; then
+              ${self.packages.${system}.agent}/bin/agent --port "$AGENT_PORT" &
+            fi
+
             # Start SSHD
             exec ${pkgs.openssh}/bin/sshd -D -e
           '';
@@ -119,6 +204,7 @@
               paths = [
                 pkgs.nix
                 pkgs.openssh
+                pkgs.stunnel
                 pkgs.coreutils
                 pkgs.bashInteractive
                 self.packages.${system}.builder-entrypoint
@@ -145,6 +231,7 @@
           buildInputs = with pkgs; [
             go
             golangci-lint
+            kubernetes-controller-tools
             nixfmt-rfc-style
           ];
         };
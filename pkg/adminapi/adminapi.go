@@ -0,0 +1,71 @@
+// Package adminapi serves the controller's and proxy's administrative
+// endpoints, which change behavior rather than report it, on a listener of
+// their own behind a bearer token
+package adminapi
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ReadToken reads the bearer token from a file, such as a mounted Secret
+// key, trimming the trailing newline
+func ReadToken(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin token: %w", err)
+	}
+	token := []byte(strings.TrimSpace(string(data)))
+	if len(token) == 0 {
+		return nil, fmt.Errorf("admin token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// CheckAddress refuses an address other interfaces can reach unless a token
+// protects it
+func CheckAddress(address string, token []byte) error {
+	if len(token) > 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid admin address %q: %w", address, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("admin address %q is not a loopback address and no admin token is set", address)
+}
+
+// Authenticated rejects requests without the bearer token. A nil token
+// lets every request through, for listeners bound to loopback.
+func Authenticated(token []byte, next http.Handler) http.Handler {
+	if len(token) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Authorize adds the bearer token, when there is one, to a request for an
+// admin API
+func Authorize(req *http.Request, token []byte) {
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+string(token))
+	}
+}
@@ -0,0 +1,72 @@
+package adminapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthenticated(t *testing.T) {
+	handler := Authenticated([]byte("s3cret"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tc := range []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic czNjcmV0", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/provisioning", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("Authorization %q = %d, want %d", tc.header, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		token   []byte
+		ok      bool
+	}{
+		{"127.0.0.1:8082", nil, true},
+		{"[::1]:8082", nil, true},
+		{"localhost:8082", nil, true},
+		{":8082", nil, false},
+		{"0.0.0.0:8082", nil, false},
+		{"10.0.0.1:8082", nil, false},
+		{":8082", []byte("s3cret"), true},
+		{"8082", nil, false},
+	} {
+		if err := CheckAddress(tc.address, tc.token); (err == nil) != tc.ok {
+			t.Errorf("CheckAddress(%q, %q) = %v, want ok %v", tc.address, tc.token, err, tc.ok)
+		}
+	}
+}
+
+func TestReadToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := ReadToken(path); err != nil || string(token) != "s3cret" {
+		t.Errorf("ReadToken = %q, %v", token, err)
+	}
+	if err := os.WriteFile(path, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadToken(path); err == nil {
+		t.Error("ReadToken accepted an empty token")
+	}
+}
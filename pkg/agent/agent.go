@@ -0,0 +1,402 @@
+// Package agent implements the HTTP agent that runs inside builder pods and
+// gives non-SSH clients access to the builder's Nix store
+package agent
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultPort is the port the agent listens on in builder pods
+	DefaultPort = 8081
+	// DefaultMaxImportBytes bounds the size of a single import upload
+	DefaultMaxImportBytes = 10 << 30
+
+	storeDir = "/nix/store/"
+
+	// sizeQueryBatch bounds the paths passed to one nix-store --query --size
+	sizeQueryBatch = 500
+)
+
+// StoreDiff lists the store paths added since the agent started, which for
+// a builder with a persistent store is what its session added
+type StoreDiff struct {
+	Paths      []StorePath `json:"paths"`
+	AddedPaths int         `json:"addedPaths"`
+	AddedBytes int64       `json:"addedBytes"`
+}
+
+// StorePath is a store path and its NAR size
+type StorePath struct {
+	Path    string `json:"path"`
+	NarSize int64  `json:"narSize"`
+}
+
+// Config holds the settings used to construct a Server
+type Config struct {
+	Addr string
+	// Token is the bearer token clients must present
+	Token string
+	// NixStore is the nix-store binary; defaults to "nix-store" on PATH
+	NixStore string
+	// MaxImportBytes bounds the size of a single import upload
+	MaxImportBytes int64
+}
+
+// Server serves the agent's HTTP API
+type Server struct {
+	token          []byte
+	nixStore       string
+	maxImportBytes int64
+	httpServer     *http.Server
+
+	// baseline holds the store entries present when the agent started
+	baseline map[string]struct{}
+}
+
+// New creates a Server from cfg
+func New(cfg Config) (*Server, error) {
+	if cfg.Token == "" {
+		return nil, errors.New("agent token must not be empty")
+	}
+	if cfg.NixStore == "" {
+		cfg.NixStore = "nix-store"
+	}
+	if cfg.MaxImportBytes <= 0 {
+		cfg.MaxImportBytes = DefaultMaxImportBytes
+	}
+
+	baseline, err := storeEntries()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the store: %w", err)
+	}
+
+	s := &Server{
+		token:          []byte(cfg.Token),
+		nixStore:       cfg.NixStore,
+		maxImportBytes: cfg.MaxImportBytes,
+		baseline:       baseline,
+	}
+	s.httpServer = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s, nil
+}
+
+// Handler returns the agent's HTTP routes
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("POST /v1/import", s.authenticated(s.handleImport))
+	mux.Handle("GET /v1/export", s.authenticated(s.handleExport))
+	mux.Handle("GET /v1/nar", s.authenticated(s.handleNAR))
+	mux.Handle("GET /v1/tarball", s.authenticated(s.handleTarball))
+	mux.Handle("GET /v1/store-diff", s.authenticated(s.handleStoreDiff))
+	return mux
+}
+
+// ListenAndServe serves until ctx is cancelled
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return s.httpServer.Shutdown(shutdownCtx)
+	}
+}
+
+func (s *Server) authenticated(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), s.token) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// handleImport imports a `nix-store --export` stream into the store and
+// returns the imported paths
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	body := http.MaxBytesReader(w, r.Body, s.maxImportBytes)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(r.Context(), s.nixStore, "--import")
+	cmd.Stdin = body
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		log.Error().Err(err).Str("stderr", stderr.String()).Msg("Failed to import store paths")
+		http.Error(w, fmt.Sprintf("import failed: %s", strings.TrimSpace(stderr.String())), http.StatusBadRequest)
+		return
+	}
+
+	paths := []string{}
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			paths = append(paths, line)
+		}
+	}
+
+	log.Info().Strs("paths", paths).Msg("Imported store paths")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"paths": paths})
+}
+
+// handleExport streams the requested paths in `nix-store --export` format
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	paths, err := storePaths(r.URL.Query()["path"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.stream(w, r, "application/octet-stream", append([]string{"--export"}, paths...))
+}
+
+// handleNAR streams a single path as a NAR
+func (s *Server) handleNAR(w http.ResponseWriter, r *http.Request) {
+	paths, err := storePaths(r.URL.Query()["path"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(paths) != 1 {
+		http.Error(w, "exactly one path is required", http.StatusBadRequest)
+		return
+	}
+	s.stream(w, r, "application/x-nix-nar", []string{"--dump", paths[0]})
+}
+
+// stream runs nix-store with args and copies its output to the response
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, contentType string, args []string) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(r.Context(), s.nixStore, args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		http.Error(w, "failed to start nix-store", http.StatusInternalServerError)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		http.Error(w, "failed to start nix-store", http.StatusInternalServerError)
+		return
+	}
+
+	// Read the first chunk before committing to a status so that errors such
+	// as invalid paths are still reported as errors
+	buf := bufio.NewReader(stdout)
+	w.Header().Set("Content-Type", contentType)
+	if _, err := buf.Peek(1); err != nil {
+		if err := cmd.Wait(); err != nil {
+			http.Error(w, strings.TrimSpace(stderr.String()), http.StatusNotFound)
+		}
+		return
+	}
+
+	if _, err := io.Copy(w, buf); err != nil {
+		log.Warn().Err(err).Strs("args", args).Msg("Failed to stream nix-store output")
+	}
+	if err := cmd.Wait(); err != nil {
+		log.Warn().Err(err).Str("stderr", stderr.String()).Msg("nix-store exited with an error while streaming")
+	}
+}
+
+// handleTarball streams a single path as a gzipped tarball
+func (s *Server) handleTarball(w http.ResponseWriter, r *http.Request) {
+	paths, err := storePaths(r.URL.Query()["path"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(paths) != 1 {
+		http.Error(w, "exactly one path is required", http.StatusBadRequest)
+		return
+	}
+	root := paths[0]
+	if _, err := os.Lstat(root); err != nil {
+		http.Error(w, "path not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeTarball(tw, root); err != nil {
+		log.Warn().Err(err).Str("path", root).Msg("Failed to stream tarball")
+		return
+	}
+	tw.Close()
+	gz.Close()
+}
+
+// handleStoreDiff reports the store paths added since the agent started and
+// their NAR sizes
+func (s *Server) handleStoreDiff(w http.ResponseWriter, r *http.Request) {
+	entries, err := storeEntries()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read the store")
+		http.Error(w, "failed to read the store", http.StatusInternalServerError)
+		return
+	}
+
+	var added []string
+	for name := range entries {
+		if _, ok := s.baseline[name]; !ok {
+			added = append(added, storeDir+name)
+		}
+	}
+	slices.Sort(added)
+
+	diff := StoreDiff{Paths: make([]StorePath, 0, len(added))}
+	for batch := range slices.Chunk(added, sizeQueryBatch) {
+		sizes, err := s.pathSizes(r.Context(), batch)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to query store path sizes")
+			http.Error(w, "failed to query store path sizes", http.StatusInternalServerError)
+			return
+		}
+		for i, path := range batch {
+			diff.Paths = append(diff.Paths, StorePath{Path: path, NarSize: sizes[i]})
+			diff.AddedBytes += sizes[i]
+		}
+	}
+	diff.AddedPaths = len(diff.Paths)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// pathSizes returns the NAR size of each path, in order
+func (s *Server) pathSizes(ctx context.Context, paths []string) ([]int64, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.nixStore, append([]string{"--query", "--size"}, paths...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	lines := strings.Fields(stdout.String())
+	if len(lines) != len(paths) {
+		return nil, fmt.Errorf("got %d sizes for %d paths", len(lines), len(paths))
+	}
+	sizes := make([]int64, len(lines))
+	for i, line := range lines {
+		size, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q: %w", line, err)
+		}
+		sizes[i] = size
+	}
+	return sizes, nil
+}
+
+// storeEntries returns the names of the store paths in the store, skipping
+// Nix's own bookkeeping entries and build locks
+func storeEntries() (map[string]struct{}, error) {
+	dirents, err := os.ReadDir(storeDir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]struct{}, len(dirents))
+	for _, d := range dirents {
+		name := d.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".lock") {
+			continue
+		}
+		entries[name] = struct{}{}
+	}
+	return entries, nil
+}
+
+func writeTarball(tw *tar.Writer, root string) error {
+	base := filepath.Dir(root)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		if header.Name, err = filepath.Rel(base, path); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// storePaths validates that every path names a top-level store path and
+// returns the paths cleaned, so what is validated is what nix-store reads
+func storePaths(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("at least one path is required")
+	}
+	cleaned := make([]string, len(paths))
+	for i, p := range paths {
+		cleaned[i] = filepath.Clean(p)
+		name, ok := strings.CutPrefix(cleaned[i], storeDir)
+		if !ok || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("not a store path: %s", p)
+		}
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestStorePaths(t *testing.T) {
+	paths, err := storePaths([]string{"/nix/store/aaaa-hello/", "/nix/store/./bbbb-glibc", "//nix/store/cccc-bash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/nix/store/aaaa-hello", "/nix/store/bbbb-glibc", "/nix/store/cccc-bash"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("storePaths = %v, want %v", paths, want)
+	}
+
+	for _, path := range []string{
+		"/nix/store",
+		"/nix/store/",
+		"/nix/store/aaaa-hello/bin/hello",
+		"/nix/store/../../etc/shadow",
+		"/nix/store/aaaa-hello/../../../etc",
+		"nix/store/aaaa-hello",
+		"/tmp/aaaa-hello",
+	} {
+		if _, err := storePaths([]string{"/nix/store/aaaa-hello", path}); err == nil {
+			t.Errorf("storePaths accepted %s", path)
+		}
+	}
+	if _, err := storePaths(nil); err == nil {
+		t.Error("storePaths accepted no paths")
+	}
+}
+
+func TestAuthenticated(t *testing.T) {
+	s := &Server{token: []byte("secret")}
+	handler := s.Handler()
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong", http.StatusUnauthorized},
+		{"token prefix", "Bearer secre", http.StatusUnauthorized},
+		{"not bearer", "Basic secret", http.StatusUnauthorized},
+		{"bare token", "secret", http.StatusUnauthorized},
+		// The token is accepted, so the request reaches path validation
+		{"token", "Bearer secret", http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/export?path=/etc/shadow", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("healthz status = %d, want 200 without a token", rec.Code)
+	}
+}
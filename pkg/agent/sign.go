@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BuilderPodHeader names the builder pod, as namespace/name, whose signing
+// token a signing request presents
+const BuilderPodHeader = "X-Nix-Builder-Pod"
+
+// SignRequest asks the controller to sign store paths a builder built
+type SignRequest struct {
+	Paths []PathInfo `json:"paths"`
+}
+
+// PathInfo is the part of a store path's metadata its signature covers
+type PathInfo struct {
+	Path       string   `json:"path"`
+	NarHash    string   `json:"narHash"`
+	NarSize    uint64   `json:"narSize"`
+	References []string `json:"references"`
+}
+
+// SignResponse maps each signed store path to its signature
+type SignResponse struct {
+	Signatures map[string]string `json:"signatures"`
+}
+
+// SignConfig holds the settings Sign uses to reach the controller
+type SignConfig struct {
+	// URL is the controller's signing endpoint
+	URL string
+	// Pod is the builder pod, as namespace/name
+	Pod string
+	// Token is the builder's signing token
+	Token string
+	// Nix is the nix binary; defaults to "nix" on PATH
+	Nix string
+}
+
+// Sign has the controller sign paths and adds the signatures to the local
+// store, so the builder can push signed outputs without holding the key.
+// The signatures reach the store through a throwaway file:// binary cache,
+// which nix store copy-sigs accepts only for paths whose NAR hash matches.
+func Sign(ctx context.Context, cfg SignConfig, paths []string) error {
+	if cfg.Nix == "" {
+		cfg.Nix = "nix"
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	pathInfo := nixCommand(ctx, cfg.Nix, append([]string{"path-info", "--json"}, paths...)...)
+	pathInfo.Stderr = os.Stderr
+	out, err := pathInfo.Output()
+	if err != nil {
+		return fmt.Errorf("nix path-info failed: %w", err)
+	}
+	infos, err := parsePathInfo(out)
+	if err != nil {
+		return err
+	}
+
+	signatures, err := requestSignatures(ctx, cfg, infos)
+	if err != nil {
+		return err
+	}
+
+	cache, err := os.MkdirTemp("", "nix-signatures-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(cache)
+	if err := writeSignatureCache(cache, infos, signatures); err != nil {
+		return err
+	}
+
+	args := append([]string{"store", "copy-sigs", "--substituter", "file://" + cache}, paths...)
+	if out, err := nixCommand(ctx, cfg.Nix, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("nix store copy-sigs failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func nixCommand(ctx context.Context, nix string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, nix, append([]string{"--extra-experimental-features", "nix-command"}, args...)...)
+}
+
+// parsePathInfo reads nix path-info --json output, which is an array of
+// objects before Nix 2.19 and an object keyed by path since
+func parsePathInfo(out []byte) ([]PathInfo, error) {
+	trimmed := bytes.TrimSpace(out)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var infos []PathInfo
+		if err := json.Unmarshal(trimmed, &infos); err != nil {
+			return nil, fmt.Errorf("failed to parse nix path-info output: %w", err)
+		}
+		return infos, nil
+	}
+
+	var byPath map[string]*PathInfo
+	if err := json.Unmarshal(trimmed, &byPath); err != nil {
+		return nil, fmt.Errorf("failed to parse nix path-info output: %w", err)
+	}
+	infos := make([]PathInfo, 0, len(byPath))
+	for path, info := range byPath {
+		if info == nil {
+			return nil, fmt.Errorf("%s is not valid in the store", path)
+		}
+		info.Path = path
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+// requestSignatures sends the paths' metadata to the controller to sign
+func requestSignatures(ctx context.Context, cfg SignConfig, infos []PathInfo) (map[string]string, error) {
+	body, err := json.Marshal(SignRequest{Paths: infos})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	req.Header.Set(BuilderPodHeader, cfg.Pod)
+
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the signing endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("signing endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var signed SignResponse
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return nil, fmt.Errorf("failed to decode signatures: %w", err)
+	}
+	for _, info := range infos {
+		if signed.Signatures[info.Path] == "" {
+			return nil, fmt.Errorf("signing endpoint returned no signature for %s", info.Path)
+		}
+	}
+	return signed.Signatures, nil
+}
+
+// writeSignatureCache lays out a binary cache holding only narinfo files,
+// which is all nix store copy-sigs reads
+func writeSignatureCache(dir string, infos []PathInfo, signatures map[string]string) error {
+	if err := os.WriteFile(filepath.Join(dir, "nix-cache-info"), []byte("StoreDir: /nix/store\n"), 0644); err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := strings.TrimPrefix(info.Path, storeDir)
+		hashPart, _, ok := strings.Cut(name, "-")
+		if !ok || name == info.Path {
+			return fmt.Errorf("%s is not a store path", info.Path)
+		}
+		refs := make([]string, len(info.References))
+		for i, ref := range info.References {
+			refs[i] = strings.TrimPrefix(ref, storeDir)
+		}
+
+		var narinfo strings.Builder
+		fmt.Fprintf(&narinfo, "StorePath: %s\n", info.Path)
+		fmt.Fprintf(&narinfo, "URL: nar/%s.nar\n", hashPart)
+		fmt.Fprintf(&narinfo, "Compression: none\n")
+		fmt.Fprintf(&narinfo, "NarHash: %s\n", info.NarHash)
+		fmt.Fprintf(&narinfo, "NarSize: %d\n", info.NarSize)
+		fmt.Fprintf(&narinfo, "References: %s\n", strings.Join(refs, " "))
+		fmt.Fprintf(&narinfo, "Sig: %s\n", signatures[info.Path])
+		if err := os.WriteFile(filepath.Join(dir, hashPart+".narinfo"), []byte(narinfo.String()), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
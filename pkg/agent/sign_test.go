@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParsePathInfo(t *testing.T) {
+	want := PathInfo{
+		Path:       "/nix/store/aaaa-hello",
+		NarHash:    "sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s",
+		NarSize:    1024,
+		References: []string{"/nix/store/bbbb-glibc"},
+	}
+	for name, out := range map[string]string{
+		"array":  `[{"path":"/nix/store/aaaa-hello","narHash":"sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s","narSize":1024,"references":["/nix/store/bbbb-glibc"],"valid":true}]`,
+		"object": `{"/nix/store/aaaa-hello":{"narHash":"sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s","narSize":1024,"references":["/nix/store/bbbb-glibc"]}}`,
+	} {
+		infos, err := parsePathInfo([]byte(out))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(infos) != 1 || infos[0].Path != want.Path || infos[0].NarHash != want.NarHash ||
+			infos[0].NarSize != want.NarSize || !slices.Equal(infos[0].References, want.References) {
+			t.Errorf("%s: parsePathInfo = %+v, want %+v", name, infos, want)
+		}
+	}
+
+	if _, err := parsePathInfo([]byte(`{"/nix/store/aaaa-hello":null}`)); err == nil {
+		t.Error("parsePathInfo accepted an invalid path")
+	}
+}
+
+func TestRequestSignatures(t *testing.T) {
+	infos := []PathInfo{{Path: "/nix/store/aaaa-hello"}, {Path: "/nix/store/bbbb-glibc"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get(BuilderPodHeader) != "builds/nix-builder-abc" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req SignRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := SignResponse{Signatures: map[string]string{}}
+		for _, info := range req.Paths {
+			if info.Path != "/nix/store/bbbb-glibc" {
+				resp.Signatures[info.Path] = "cache-1:c2ln"
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	cfg := SignConfig{URL: server.URL, Pod: "builds/nix-builder-abc", Token: "secret"}
+	if _, err := requestSignatures(context.Background(), cfg, infos[:1]); err != nil {
+		t.Errorf("requestSignatures: %v", err)
+	}
+	if _, err := requestSignatures(context.Background(), cfg, infos); err == nil {
+		t.Error("requestSignatures accepted a response missing a signature")
+	}
+	cfg.Token = "wrong"
+	if _, err := requestSignatures(context.Background(), cfg, infos[:1]); err == nil {
+		t.Error("requestSignatures succeeded with the wrong token")
+	}
+}
+
+func TestWriteSignatureCache(t *testing.T) {
+	dir := t.TempDir()
+	infos := []PathInfo{{
+		Path:       "/nix/store/aaaa-hello",
+		NarHash:    "sha256-abc=",
+		NarSize:    1024,
+		References: []string{"/nix/store/bbbb-glibc", "/nix/store/aaaa-hello"},
+	}}
+	if err := writeSignatureCache(dir, infos, map[string]string{"/nix/store/aaaa-hello": "cache-1:c2ln"}); err != nil {
+		t.Fatal(err)
+	}
+
+	narinfo, err := os.ReadFile(filepath.Join(dir, "aaaa.narinfo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "StorePath: /nix/store/aaaa-hello\nURL: nar/aaaa.nar\nCompression: none\nNarHash: sha256-abc=\nNarSize: 1024\n" +
+		"References: bbbb-glibc aaaa-hello\nSig: cache-1:c2ln\n"
+	if string(narinfo) != want {
+		t.Errorf("narinfo =\n%s\nwant\n%s", narinfo, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nix-cache-info")); err != nil {
+		t.Error(err)
+	}
+
+	if err := writeSignatureCache(dir, []PathInfo{{Path: "/tmp/hello"}}, nil); err == nil {
+		t.Error("writeSignatureCache accepted a path outside the store")
+	}
+}
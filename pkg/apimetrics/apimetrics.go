@@ -0,0 +1,173 @@
+// Package apimetrics records how a process uses the Kubernetes API: request
+// rates and latencies, throttling by the API server and by client-go's own
+// rate limiter, and how long informer caches take to sync
+package apimetrics
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	toolscache "k8s.io/client-go/tools/cache"
+	clientmetrics "k8s.io/client-go/tools/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// throttleThreshold is the rate limiter wait counted as client-side
+// throttling. client-go logs waits longer than this as throttled requests.
+const throttleThreshold = 50 * time.Millisecond
+
+// Sources of throttling recorded in the throttled metric's source label
+const (
+	// ThrottledServer counts requests the API server rejected with 429 Too
+	// Many Requests
+	ThrottledServer = "server"
+	// ThrottledClient counts requests held back by the client's own QPS and
+	// burst limits
+	ThrottledClient = "client"
+)
+
+// latencyBuckets covers API calls from a few milliseconds to a minute
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Metrics records Kubernetes API usage under metric names starting with
+// prefix, so that the controller and proxy can be told apart on a
+// dashboard. It is a prometheus.Collector of all its metrics.
+type Metrics struct {
+	requests    *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	rateLimiter *prometheus.HistogramVec
+	throttled   *prometheus.CounterVec
+	cacheSync   *prometheus.GaugeVec
+}
+
+// New creates Kubernetes API metrics named prefix_api_*, such as
+// nix_controller_api_requests_total
+func New(prefix string) *Metrics {
+	return &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_api_requests_total",
+			Help: "Kubernetes API requests by HTTP method and response code",
+		}, []string{"method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prefix + "_api_request_duration_seconds",
+			Help:    "Kubernetes API request latency by verb",
+			Buckets: latencyBuckets,
+		}, []string{"verb"}),
+		rateLimiter: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prefix + "_api_rate_limiter_duration_seconds",
+			Help:    "Time Kubernetes API requests waited for the client-side rate limiter by verb",
+			Buckets: latencyBuckets,
+		}, []string{"verb"}),
+		throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_api_throttled_total",
+			Help: "Kubernetes API requests throttled by the API server or the client-side rate limiter",
+		}, []string{"source"}),
+		cacheSync: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + "_api_cache_sync_seconds",
+			Help: "Time the informer cache of each resource took to sync at startup",
+		}, []string{"resource"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.requests, m.duration, m.rateLimiter, m.throttled, m.cacheSync}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// RegisterExport registers the metrics with one series of each, so that
+// their names, types and labels can be gathered to generate dashboards and
+// alerts
+func (m *Metrics) RegisterExport(reg prometheus.Registerer) error {
+	m.requests.WithLabelValues("GET", "200")
+	m.duration.WithLabelValues("GET")
+	m.rateLimiter.WithLabelValues("GET")
+	m.throttled.WithLabelValues(ThrottledServer)
+	m.cacheSync.WithLabelValues("Pod")
+	return reg.Register(m)
+}
+
+// Install has client-go report every API request of this process to the
+// metrics. It must be called before creating any clients. Request results
+// are still passed on to controller-runtime's rest_client_requests_total.
+func (m *Metrics) Install() {
+	clientmetrics.RequestLatency = latencyAdapter{m.duration}
+	clientmetrics.RateLimiterLatency = rateLimiterAdapter{m}
+	clientmetrics.RequestResult = resultAdapter{m: m, next: clientmetrics.RequestResult}
+}
+
+// WaitForCacheSync waits until c has started and the informers for objs have
+// synced, recording how long each took. Informers that do not exist yet are
+// created without blocking, so the cache starts them along with the rest.
+func (m *Metrics) WaitForCacheSync(ctx context.Context, c cache.Cache, objs ...client.Object) error {
+	start := time.Now()
+	informers := make([]cache.Informer, len(objs))
+	for i, obj := range objs {
+		informer, err := c.GetInformer(ctx, obj, cache.BlockUntilSynced(false))
+		if err != nil {
+			return fmt.Errorf("failed to get %s informer: %w", resourceName(obj), err)
+		}
+		informers[i] = informer
+	}
+
+	for i, obj := range objs {
+		if !toolscache.WaitForCacheSync(ctx.Done(), informers[i].HasSynced) {
+			return fmt.Errorf("failed to sync %s cache", resourceName(obj))
+		}
+		m.cacheSync.WithLabelValues(resourceName(obj)).Set(time.Since(start).Seconds())
+	}
+	return nil
+}
+
+func resourceName(obj client.Object) string {
+	return reflect.TypeOf(obj).Elem().Name()
+}
+
+type latencyAdapter struct {
+	metric *prometheus.HistogramVec
+}
+
+func (a latencyAdapter) Observe(_ context.Context, verb string, _ url.URL, latency time.Duration) {
+	a.metric.WithLabelValues(verb).Observe(latency.Seconds())
+}
+
+type rateLimiterAdapter struct {
+	m *Metrics
+}
+
+func (a rateLimiterAdapter) Observe(_ context.Context, verb string, _ url.URL, latency time.Duration) {
+	a.m.rateLimiter.WithLabelValues(verb).Observe(latency.Seconds())
+	if latency > throttleThreshold {
+		a.m.throttled.WithLabelValues(ThrottledClient).Inc()
+	}
+}
+
+type resultAdapter struct {
+	m    *Metrics
+	next clientmetrics.ResultMetric
+}
+
+func (a resultAdapter) Increment(ctx context.Context, code, method, host string) {
+	a.m.requests.WithLabelValues(method, code).Inc()
+	if code == "429" {
+		a.m.throttled.WithLabelValues(ThrottledServer).Inc()
+	}
+	a.next.Increment(ctx, code, method, host)
+}
@@ -0,0 +1,50 @@
+package apimetrics
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	clientmetrics "k8s.io/client-go/tools/metrics"
+)
+
+type countingResult struct{ calls int }
+
+func (c *countingResult) Increment(context.Context, string, string, string) { c.calls++ }
+
+func TestInstallCountsThrottledRequests(t *testing.T) {
+	prevLatency, prevRateLimiter, prevResult := clientmetrics.RequestLatency, clientmetrics.RateLimiterLatency, clientmetrics.RequestResult
+	t.Cleanup(func() {
+		clientmetrics.RequestLatency, clientmetrics.RateLimiterLatency, clientmetrics.RequestResult = prevLatency, prevRateLimiter, prevResult
+	})
+	next := &countingResult{}
+	clientmetrics.RequestResult = next
+
+	m := New("test")
+	m.Install()
+
+	ctx := context.Background()
+	clientmetrics.RequestResult.Increment(ctx, "200", "GET", "api")
+	clientmetrics.RequestResult.Increment(ctx, "429", "POST", "api")
+	clientmetrics.RateLimiterLatency.Observe(ctx, "GET", url.URL{}, time.Millisecond)
+	clientmetrics.RateLimiterLatency.Observe(ctx, "GET", url.URL{}, time.Second)
+	clientmetrics.RequestLatency.Observe(ctx, "GET", url.URL{}, 20*time.Millisecond)
+
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("POST", "429")); got != 1 {
+		t.Errorf("429 requests = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.throttled.WithLabelValues(ThrottledServer)); got != 1 {
+		t.Errorf("server throttled = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.throttled.WithLabelValues(ThrottledClient)); got != 1 {
+		t.Errorf("client throttled = %v, want 1 for the wait over the threshold", got)
+	}
+	if got := testutil.CollectAndCount(m.duration); got != 1 {
+		t.Errorf("latency series = %d, want 1", got)
+	}
+	if next.calls != 2 {
+		t.Errorf("previous result metric called %d times, want 2", next.calls)
+	}
+}
@@ -0,0 +1,9 @@
+// Package v1alpha1 contains the nix.io/v1alpha1 API types. The CRDs in
+// deploy/crd.yaml are generated from the kubebuilder markers on these types
+// by running go generate in this directory, which needs controller-gen from
+// the flake's dev shell.
+//
+// +groupName=nix.io
+package v1alpha1
+
+//go:generate sh -c "controller-gen crd paths=. output:stdout > ../../../../deploy/crd.yaml"
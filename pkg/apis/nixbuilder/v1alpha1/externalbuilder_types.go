@@ -0,0 +1,138 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=neb
+// +kubebuilder:printcolumn:name="URI",type=string,JSONPath=`.spec.uri`
+// +kubebuilder:printcolumn:name="Systems",type=string,JSONPath=`.spec.systems`
+// +kubebuilder:printcolumn:name="Max Jobs",type=integer,JSONPath=`.spec.maxJobs`
+
+// NixExternalBuilder is an SSH builder outside the cluster, such as a Mac,
+// that the proxy routes sessions to directly. It holds the fields of one
+// entry of a Nix machines file.
+type NixExternalBuilder struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec NixExternalBuilderSpec `json:"spec"`
+}
+
+// NixExternalBuilderSpec describes the builder and how to log in to it
+type NixExternalBuilderSpec struct {
+	// URI is the builder's ssh:// or ssh-ng:// URI, such as
+	// ssh-ng://builder@mac-1.example.com
+	URI string `json:"uri"`
+
+	// Systems are the Nix systems the builder builds for
+	// +kubebuilder:validation:MinItems=1
+	Systems []string `json:"systems"`
+
+	// SSHKeySecret names a kubernetes.io/ssh-auth Secret in the builder's
+	// namespace whose private key the proxy logs in with. Empty uses the
+	// proxy's client key.
+	SSHKeySecret string `json:"sshKeySecret,omitempty"`
+
+	// MaxJobs is how many sessions the proxy routes to the builder at once
+	// +kubebuilder:validation:Minimum=1
+	MaxJobs int32 `json:"maxJobs,omitempty"`
+
+	// SpeedFactor is kept from the machines file; the proxy ignores it
+	SpeedFactor int32 `json:"speedFactor,omitempty"`
+
+	// SupportedFeatures and MandatoryFeatures are the builder's Nix system
+	// features; only builds requiring every mandatory feature run on it
+	SupportedFeatures []string `json:"supportedFeatures,omitempty"`
+	MandatoryFeatures []string `json:"mandatoryFeatures,omitempty"`
+
+	// PublicHostKey is the builder's base64-encoded public host key, as in
+	// the last field of a machines file
+	PublicHostKey string `json:"publicHostKey,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// NixExternalBuilderList contains a list of NixExternalBuilder
+type NixExternalBuilderList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []NixExternalBuilder `json:"items"`
+}
+
+// DeepCopyInto copies all properties of this object into another object of the
+// same type that is passed as a pointer.
+func (in *NixExternalBuilder) DeepCopyInto(out *NixExternalBuilder) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy copies the receiver, creating a new NixExternalBuilder.
+func (in *NixExternalBuilder) DeepCopy() *NixExternalBuilder {
+	if in == nil {
+		return nil
+	}
+	out := new(NixExternalBuilder)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *NixExternalBuilder) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies all properties of this object into another object of the
+// same type that is passed as a pointer.
+func (in *NixExternalBuilderSpec) DeepCopyInto(out *NixExternalBuilderSpec) {
+	*out = *in
+	if in.Systems != nil {
+		out.Systems = append([]string(nil), in.Systems...)
+	}
+	if in.SupportedFeatures != nil {
+		out.SupportedFeatures = append([]string(nil), in.SupportedFeatures...)
+	}
+	if in.MandatoryFeatures != nil {
+		out.MandatoryFeatures = append([]string(nil), in.MandatoryFeatures...)
+	}
+}
+
+// DeepCopyInto copies all properties of this object into another object of the
+// same type that is passed as a pointer.
+func (in *NixExternalBuilderList) DeepCopyInto(out *NixExternalBuilderList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]NixExternalBuilder, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver, creating a new NixExternalBuilderList.
+func (in *NixExternalBuilderList) DeepCopy() *NixExternalBuilderList {
+	if in == nil {
+		return nil
+	}
+	out := new(NixExternalBuilderList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *NixExternalBuilderList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
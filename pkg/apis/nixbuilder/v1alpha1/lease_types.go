@@ -0,0 +1,222 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"maps"
+)
+
+// LeaseActivityAnnotation is set by the proxy on a lease whenever a session
+// uses it, in RFC 3339 format
+const LeaseActivityAnnotation = "nix.io/last-activity"
+
+// LeaseUserPrefix marks SSH user names that connect to a leased builder, as
+// in lease-<name>
+const LeaseUserPrefix = "lease-"
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=bl
+// +kubebuilder:printcolumn:name="Owner",type=string,JSONPath=`.spec.owner`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Expires",type=date,JSONPath=`.spec.expiresAt`
+// +kubebuilder:printcolumn:name="Pod",type=string,JSONPath=`.status.podName`
+
+// BuilderLease reserves a long-lived builder for interactive use, such as
+// nix develop, across many SSH sessions
+type BuilderLease struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec BuilderLeaseSpec `json:"spec"`
+	// +optional
+	Status BuilderLeaseStatus `json:"status"`
+}
+
+// BuilderLeaseSpec defines the desired lease
+type BuilderLeaseSpec struct {
+	// Owner is the identity allowed to use the lease, as authenticated by
+	// the proxy
+	Owner string `json:"owner"`
+
+	// ExpiresAt is when the builder is reclaimed. Extending the lease moves
+	// it forward.
+	ExpiresAt metav1.Time `json:"expiresAt"`
+
+	// IdleTimeoutSeconds reclaims the builder after this long without a
+	// session
+	IdleTimeoutSeconds *int64 `json:"idleTimeoutSeconds,omitempty"`
+
+	// System is the Nix system the builder must build for natively
+	System string `json:"system,omitempty"`
+
+	// Image specifies the builder container image
+	Image string `json:"image,omitempty"`
+
+	// Resources defines the pod resource requirements
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// NodeSelector for pod placement
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// ExperimentalFeatures are Nix experimental features enabled on the
+	// builder
+	ExperimentalFeatures []string `json:"experimentalFeatures,omitempty"`
+
+	// NixConfig holds extra nix.conf settings for the builder's daemon
+	NixConfig string `json:"nixConfig,omitempty"`
+
+	// ForwardPorts are the builder ports the owner may forward to and from
+	// their machine, such as a dev server started in a remote shell
+	// +kubebuilder:validation:items:Minimum=1
+	// +kubebuilder:validation:items:Maximum=65535
+	ForwardPorts []int32 `json:"forwardPorts,omitempty"`
+}
+
+// BuilderLeaseStatus defines the observed state of a lease
+type BuilderLeaseStatus struct {
+	// Phase represents the current phase of the lease
+	Phase LeasePhase `json:"phase,omitempty"`
+
+	// BuildRequest names the NixBuildRequest provisioning the builder
+	BuildRequest string `json:"buildRequest,omitempty"`
+
+	// PodName is the name of the leased builder pod
+	PodName string `json:"podName,omitempty"`
+
+	// PodIP is the IP address of the leased builder pod
+	PodIP string `json:"podIP,omitempty"`
+
+	// LastActivity is when a session last used the lease
+	LastActivity *metav1.Time `json:"lastActivity,omitempty"`
+
+	// Message provides human-readable status information
+	Message string `json:"message,omitempty"`
+}
+
+// LeasePhase represents the phase of a builder lease
+// +kubebuilder:validation:Enum=Pending;Active;Expired;Failed
+type LeasePhase string
+
+const (
+	// LeasePhasePending means the builder is being provisioned
+	LeasePhasePending LeasePhase = "Pending"
+	// LeasePhaseActive means the builder is ready for sessions
+	LeasePhaseActive LeasePhase = "Active"
+	// LeasePhaseExpired means the lease ran out or sat idle and its builder
+	// was reclaimed
+	LeasePhaseExpired LeasePhase = "Expired"
+	// LeasePhaseFailed means the builder could not be provisioned or failed
+	LeasePhaseFailed LeasePhase = "Failed"
+)
+
+// LeaseBuildRequestName returns the name of the NixBuildRequest backing a
+// lease
+func LeaseBuildRequestName(leaseName string) string {
+	return "lease-" + leaseName
+}
+
+// +kubebuilder:object:root=true
+
+// BuilderLeaseList contains a list of BuilderLease
+type BuilderLeaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []BuilderLease `json:"items"`
+}
+
+// DeepCopyInto copies all properties of this object into another object of the
+// same type that is passed as a pointer.
+func (in *BuilderLease) DeepCopyInto(out *BuilderLease) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy copies the receiver, creating a new BuilderLease.
+func (in *BuilderLease) DeepCopy() *BuilderLease {
+	if in == nil {
+		return nil
+	}
+	out := new(BuilderLease)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *BuilderLease) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies all properties of this object into another object of the
+// same type that is passed as a pointer.
+func (in *BuilderLeaseList) DeepCopyInto(out *BuilderLeaseList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]BuilderLease, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver, creating a new BuilderLeaseList.
+func (in *BuilderLeaseList) DeepCopy() *BuilderLeaseList {
+	if in == nil {
+		return nil
+	}
+	out := new(BuilderLeaseList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *BuilderLeaseList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (in *BuilderLeaseSpec) DeepCopyInto(out *BuilderLeaseSpec) {
+	*out = *in
+	in.ExpiresAt.DeepCopyInto(&out.ExpiresAt)
+	if in.IdleTimeoutSeconds != nil {
+		in, out := &in.IdleTimeoutSeconds, &out.IdleTimeoutSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	in.Resources.DeepCopyInto(&out.Resources)
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		maps.Copy((*out), *in)
+	}
+	if in.ExperimentalFeatures != nil {
+		in, out := &in.ExperimentalFeatures, &out.ExperimentalFeatures
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ForwardPorts != nil {
+		in, out := &in.ForwardPorts, &out.ForwardPorts
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+}
+
+func (in *BuilderLeaseStatus) DeepCopyInto(out *BuilderLeaseStatus) {
+	*out = *in
+	if in.LastActivity != nil {
+		in, out := &in.LastActivity, &out.LastActivity
+		*out = (*in).DeepCopy()
+	}
+}
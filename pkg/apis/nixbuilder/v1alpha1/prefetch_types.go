@@ -0,0 +1,206 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// PrefetchLabel names the FlakePrefetch a prefetch pod runs for
+const PrefetchLabel = "nix.io/prefetch"
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=fp
+// +kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Last Run",type=date,JSONPath=`.status.lastScheduleTime`
+// +kubebuilder:printcolumn:name="Next Run",type=date,JSONPath=`.status.nextScheduleTime`
+
+// FlakePrefetch fetches flake inputs into the shared binary cache or store
+// ahead of a build window, so that the builds starting in it substitute
+// their sources instead of each fetching them
+type FlakePrefetch struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec FlakePrefetchSpec `json:"spec"`
+	// +optional
+	Status FlakePrefetchStatus `json:"status"`
+}
+
+// FlakePrefetchSpec defines what is fetched, where to and when
+type FlakePrefetchSpec struct {
+	// FlakeLock is the content of a flake.lock whose locked inputs are
+	// fetched. Inputs of type path are skipped, since they only exist on
+	// the client.
+	FlakeLock string `json:"flakeLock,omitempty"`
+
+	// Inputs are further flake references to fetch, such as
+	// github:NixOS/nixpkgs/<rev>
+	Inputs []string `json:"inputs,omitempty"`
+
+	// Schedule is a cron expression in UTC, such as "30 7 * * 1-5" for
+	// weekday mornings. Empty prefetches once.
+	Schedule string `json:"schedule,omitempty"`
+
+	// Target is where fetched inputs are kept. Defaults to Cache.
+	Target PrefetchTarget `json:"target,omitempty"`
+
+	// ClaimName names the ReadWriteMany claim of the shared store the Store
+	// target fetches into
+	ClaimName string `json:"claimName,omitempty"`
+
+	// Image overrides the builder image the prefetch runs in
+	Image string `json:"image,omitempty"`
+
+	// Suspend stops scheduling new runs; a running one finishes
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// PrefetchTarget selects where prefetched inputs are kept
+// +kubebuilder:validation:Enum=Cache;Store
+type PrefetchTarget string
+
+const (
+	// PrefetchTargetCache copies fetched inputs to the controller's binary
+	// cache, the one builders push to
+	PrefetchTargetCache PrefetchTarget = "Cache"
+	// PrefetchTargetStore fetches inputs into a shared store claim that
+	// builders mount with Shared storage
+	PrefetchTargetStore PrefetchTarget = "Store"
+)
+
+// FlakePrefetchStatus defines the observed state of a prefetch
+type FlakePrefetchStatus struct {
+	// Phase is the state of the latest run
+	Phase PrefetchPhase `json:"phase,omitempty"`
+
+	// Inputs is how many inputs a run fetches
+	Inputs int32 `json:"inputs,omitempty"`
+
+	// PodName is the pod of the latest run
+	PodName string `json:"podName,omitempty"`
+
+	// LastScheduleTime is when the latest run started
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+
+	// LastCompletionTime is when the latest run finished
+	LastCompletionTime *metav1.Time `json:"lastCompletionTime,omitempty"`
+
+	// NextScheduleTime is when the next run starts
+	NextScheduleTime *metav1.Time `json:"nextScheduleTime,omitempty"`
+
+	// Message provides human-readable status information
+	Message string `json:"message,omitempty"`
+}
+
+// PrefetchPhase represents the state of a prefetch's latest run
+// +kubebuilder:validation:Enum=Scheduled;Running;Succeeded;Failed
+type PrefetchPhase string
+
+const (
+	// PrefetchPhaseScheduled means no run has started yet
+	PrefetchPhaseScheduled PrefetchPhase = "Scheduled"
+	// PrefetchPhaseRunning means a run is fetching inputs
+	PrefetchPhaseRunning PrefetchPhase = "Running"
+	// PrefetchPhaseSucceeded means the latest run fetched every input
+	PrefetchPhaseSucceeded PrefetchPhase = "Succeeded"
+	// PrefetchPhaseFailed means the latest run failed or the prefetch is
+	// invalid
+	PrefetchPhaseFailed PrefetchPhase = "Failed"
+)
+
+// +kubebuilder:object:root=true
+
+// FlakePrefetchList contains a list of FlakePrefetch
+type FlakePrefetchList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []FlakePrefetch `json:"items"`
+}
+
+// DeepCopyInto copies all properties of this object into another object of the
+// same type that is passed as a pointer.
+func (in *FlakePrefetch) DeepCopyInto(out *FlakePrefetch) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy copies the receiver, creating a new FlakePrefetch.
+func (in *FlakePrefetch) DeepCopy() *FlakePrefetch {
+	if in == nil {
+		return nil
+	}
+	out := new(FlakePrefetch)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *FlakePrefetch) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies all properties of this object into another object of the
+// same type that is passed as a pointer.
+func (in *FlakePrefetchList) DeepCopyInto(out *FlakePrefetchList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]FlakePrefetch, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver, creating a new FlakePrefetchList.
+func (in *FlakePrefetchList) DeepCopy() *FlakePrefetchList {
+	if in == nil {
+		return nil
+	}
+	out := new(FlakePrefetchList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *FlakePrefetchList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (in *FlakePrefetchSpec) DeepCopyInto(out *FlakePrefetchSpec) {
+	*out = *in
+	if in.Inputs != nil {
+		in, out := &in.Inputs, &out.Inputs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+func (in *FlakePrefetchStatus) DeepCopyInto(out *FlakePrefetchStatus) {
+	*out = *in
+	if in.LastScheduleTime != nil {
+		in, out := &in.LastScheduleTime, &out.LastScheduleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastCompletionTime != nil {
+		in, out := &in.LastCompletionTime, &out.LastCompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextScheduleTime != nil {
+		in, out := &in.NextScheduleTime, &out.NextScheduleTime
+		*out = (*in).DeepCopy()
+	}
+}
@@ -0,0 +1,104 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=bq
+// +kubebuilder:printcolumn:name="Max Running",type=integer,JSONPath=`.spec.maxRunning`
+// +kubebuilder:printcolumn:name="Disabled",type=boolean,JSONPath=`.spec.disabled`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BuilderQuota caps the builders running at once for build requests in its
+// namespace. When a namespace has several quotas the lowest applies.
+type BuilderQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+
+	Spec BuilderQuotaSpec `json:"spec"`
+}
+
+// BuilderQuotaSpec defines the namespace's limits
+type BuilderQuotaSpec struct {
+	// MaxRunning is how many build requests in the namespace may hold a
+	// builder at once; further requests are queued
+	// +kubebuilder:validation:Minimum=0
+	MaxRunning int32 `json:"maxRunning"`
+
+	// Disabled stops provisioning builders for new build requests in the
+	// namespace, failing them with DisabledReason. Running builds are left
+	// alone.
+	Disabled       bool   `json:"disabled,omitempty"`
+	DisabledReason string `json:"disabledReason,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// BuilderQuotaList contains a list of BuilderQuota
+type BuilderQuotaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []BuilderQuota `json:"items"`
+}
+
+// DeepCopyInto copies all properties of this object into another object of the
+// same type that is passed as a pointer.
+func (in *BuilderQuota) DeepCopyInto(out *BuilderQuota) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+}
+
+// DeepCopy copies the receiver, creating a new BuilderQuota.
+func (in *BuilderQuota) DeepCopy() *BuilderQuota {
+	if in == nil {
+		return nil
+	}
+	out := new(BuilderQuota)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *BuilderQuota) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies all properties of this object into another object of the
+// same type that is passed as a pointer.
+func (in *BuilderQuotaList) DeepCopyInto(out *BuilderQuotaList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]BuilderQuota, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver, creating a new BuilderQuotaList.
+func (in *BuilderQuotaList) DeepCopy() *BuilderQuotaList {
+	if in == nil {
+		return nil
+	}
+	out := new(BuilderQuotaList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *BuilderQuotaList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
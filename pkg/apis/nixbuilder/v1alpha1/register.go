@@ -19,6 +19,14 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 	scheme.AddKnownTypes(GroupVersion,
 		&NixBuildRequest{},
 		&NixBuildRequestList{},
+		&BuilderLease{},
+		&BuilderLeaseList{},
+		&BuilderQuota{},
+		&BuilderQuotaList{},
+		&FlakePrefetch{},
+		&FlakePrefetchList{},
+		&NixExternalBuilder{},
+		&NixExternalBuilderList{},
 	)
 	metav1.AddToGroupVersion(scheme, GroupVersion)
 	return nil
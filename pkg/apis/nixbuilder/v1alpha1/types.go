@@ -2,28 +2,120 @@ package v1alpha1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"maps"
+	"strings"
 )
 
+// GCRequestedAnnotation is set by the proxy on a build request it failed to
+// delete after its session ended, asking the controller to delete it instead
+const GCRequestedAnnotation = "nix.io/gc-requested"
+
+// SessionHeartbeatAnnotation is refreshed by the proxy with the current time
+// while a build request's session is alive, so the controller can reap
+// requests left behind by a proxy that crashed
+const SessionHeartbeatAnnotation = "nix.io/session-heartbeat"
+
+// ProxyLabel names the proxy that created a build request, so each proxy
+// only watches the requests it serves
+const ProxyLabel = "nix.io/proxy"
+
+// ProxyInstanceAnnotation identifies the proxy process that created a build
+// request. Sessions live in that process's memory, so a restarted proxy with
+// the same ProxyLabel knows requests from another instance are orphaned.
+const ProxyInstanceAnnotation = "nix.io/proxy-instance"
+
+// ProxyPodAnnotation and ProxyPodUIDAnnotation identify the proxy pod that
+// created a build request, as namespace/name and UID. Other replicas release
+// requests whose pod is gone, and operators attribute sessions to a replica.
+const (
+	ProxyPodAnnotation    = "nix.io/proxy-pod"
+	ProxyPodUIDAnnotation = "nix.io/proxy-pod-uid"
+)
+
+// ProxyLabelShared is the ProxyLabel value of build requests any proxy may
+// serve, such as those backing leases
+const ProxyLabelShared = "shared"
+
+// CI context annotations trace a build request back to the CI run that
+// started it. The proxy sets them from allowlisted SSH environment
+// variables; other clients may set them when creating the request.
+const (
+	PipelineIDAnnotation = "nix.io/pipeline-id"
+	CommitSHAAnnotation  = "nix.io/commit-sha"
+	RepositoryAnnotation = "nix.io/repository"
+)
+
+// CIContextAnnotations lists the CI context annotations
+var CIContextAnnotations = []string{PipelineIDAnnotation, CommitSHAAnnotation, RepositoryAnnotation}
+
+// SizeClassLabel selects a builder size class on a build request
+const SizeClassLabel = "nix.io/size-class"
+
+// RequestedByLabel carries the user in a build request's RequestedBy on the
+// request and its builder pod, as returned by RequesterLabelValue, so that
+// a user's builders can be selected
+const RequestedByLabel = "nix.io/requested-by"
+
+// RequesterLabelValue turns a user, which may be an email address or an
+// OIDC subject, into a label value: '@' becomes '_', other characters a
+// label cannot hold become '-', and the value is cut to 63 characters
+func RequesterLabelValue(user string) string {
+	var b strings.Builder
+	for _, c := range user {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+			b.WriteRune(c)
+		case c == '@':
+			b.WriteRune('_')
+		default:
+			b.WriteRune('-')
+		}
+	}
+	value := b.String()
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=nbr
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`,description="Build phase"
+// +kubebuilder:printcolumn:name="Pod",type=string,JSONPath=`.status.podName`,description="Builder pod name"
+// +kubebuilder:printcolumn:name="Pod IP",type=string,JSONPath=`.status.podIP`,description="Builder pod IP"
+// +kubebuilder:printcolumn:name="Repository",type=string,JSONPath=`.metadata.annotations.nix\.io/repository`,description="CI repository",priority=1
+// +kubebuilder:printcolumn:name="Commit",type=string,JSONPath=`.metadata.annotations.nix\.io/commit-sha`,description="CI commit",priority=1
+// +kubebuilder:printcolumn:name="Pipeline",type=string,JSONPath=`.metadata.annotations.nix\.io/pipeline-id`,description="CI pipeline",priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
 // NixBuildRequest represents a request for a Nix build that needs a dedicated builder pod
 type NixBuildRequest struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata"`
 
-	Spec   NixBuildRequestSpec   `json:"spec"`
+	Spec NixBuildRequestSpec `json:"spec"`
+	// +optional
 	Status NixBuildRequestStatus `json:"status"`
 }
 
 // NixBuildRequestSpec defines the desired state of a Nix build request
 type NixBuildRequestSpec struct {
 	// SessionID links this build request to the SSH proxy session
+	// +kubebuilder:validation:MinLength=1
 	SessionID string `json:"sessionId"`
 
 	// Resources defines the pod resource requirements
+	// +optional
 	Resources corev1.ResourceRequirements `json:"resources"`
 
+	// System is the Nix system the builder must build for natively, such as
+	// aarch64-linux. Empty means any node.
+	System string `json:"system,omitempty"`
+
 	// Image specifies the builder container image
 	Image string `json:"image,omitempty"`
 
@@ -32,6 +124,182 @@ type NixBuildRequestSpec struct {
 
 	// NodeSelector for pod placement
 	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// CacheCredentials are binary cache credentials mounted into the builder
+	CacheCredentials *CacheCredentials `json:"cacheCredentials,omitempty"`
+
+	// BuildSecrets are Secrets mounted into the builder for the session,
+	// such as a netrc or tokens for private flake inputs
+	BuildSecrets []BuildSecret `json:"buildSecrets,omitempty"`
+
+	// CachePush uploads the outputs of the session's builds to the
+	// controller's binary cache as each build finishes. Unset follows the
+	// controller's default.
+	CachePush *bool `json:"cachePush,omitempty"`
+
+	// ExperimentalFeatures are Nix experimental features the client needs on
+	// the builder, such as ca-derivations
+	ExperimentalFeatures []string `json:"experimentalFeatures,omitempty"`
+
+	// RequiredFeatures are Nix system features the build needs from its
+	// builder, such as kvm or big-parallel, as listed in a machines file.
+	// The controller places the builder where they are available.
+	RequiredFeatures []string `json:"requiredFeatures,omitempty"`
+
+	// Devices are extended resources the builder needs from device plugins,
+	// such as devices.kubevirt.io/kvm for /dev/kvm, by resource name. Each is
+	// added to the builder's requests and limits.
+	Devices corev1.ResourceList `json:"devices,omitempty"`
+
+	// NixConfig holds extra nix.conf settings for the builder's daemon,
+	// applied on top of the controller's Nix configuration
+	NixConfig string `json:"nixConfig,omitempty"`
+
+	// ClientPublicKey is the session's own SSH public key in authorized_keys
+	// format. When set it is the only key the builder accepts, instead of
+	// the shared builder key.
+	ClientPublicKey string `json:"clientPublicKey,omitempty"`
+
+	// Credentials asks the controller for an SSH key pair of the build's
+	// own, for clients that create build requests through the Kubernetes
+	// API and connect to the builder themselves. Only the builder accepts
+	// the key, only until it expires, and it is revoked when the build
+	// request finishes. Cannot be combined with ClientPublicKey.
+	Credentials *CredentialsSpec `json:"credentials,omitempty"`
+
+	// ClientID identifies the client whose later connections may reuse the
+	// builder, by the fingerprint of the key it authenticated with. The
+	// proxy sets it when builder reuse is enabled.
+	ClientID string `json:"clientId,omitempty"`
+
+	// RequestedBy identifies the client that opened the session, as the
+	// proxy authenticated it. Per-user limits are charged to its user.
+	RequestedBy *Requester `json:"requestedBy,omitempty"`
+
+	// Isolation is empty to run the builder in the build request's namespace
+	// or IsolationNamespace to run it in an ephemeral namespace of its own.
+	// The controller may also isolate requests by size class or requester.
+	Isolation Isolation `json:"isolation,omitempty"`
+
+	// BuildClass is empty for interactive builds or BuildClassBestEffort
+	// for builds that run at low priority and may be preempted
+	BuildClass BuildClass `json:"buildClass,omitempty"`
+
+	// Spot runs the builder on spot or preemptible nodes, which may be
+	// reclaimed at any time. The controller then replaces the builder.
+	// Unset follows the controller's default.
+	Spot *bool `json:"spot,omitempty"`
+
+	// Storage attaches a persistent volume at /nix so the builder keeps its
+	// store between sessions. Defaults to the controller's storage settings.
+	Storage *StorageSpec `json:"storage,omitempty"`
+
+	// PodTTLSecondsAfterFinished is how long the builder pod is kept after
+	// the request completes or fails, replacing the controller's default.
+	// Zero deletes it at once.
+	PodTTLSecondsAfterFinished *int32 `json:"podTTLSecondsAfterFinished,omitempty"`
+
+	// TTLSecondsAfterFinished is how long the request is kept after it
+	// completes or fails before it is deleted, replacing the controller's
+	// default
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+}
+
+// CredentialsSpec describes the key pair issued for a build request
+type CredentialsSpec struct {
+	// TTLSeconds is how long the key is accepted after it is issued.
+	// Defaults to 15 minutes.
+	// +kubebuilder:validation:Minimum=60
+	// +kubebuilder:validation:Maximum=86400
+	TTLSeconds *int32 `json:"ttlSeconds,omitempty"`
+}
+
+// Requester is the authenticated identity behind a build request
+type Requester struct {
+	// User is the authenticated principal, such as a certificate
+	// principal, an OIDC subject or the SSH user
+	User string `json:"user"`
+	// KeyFingerprint is the SHA256 fingerprint of the key the client
+	// authenticated with, if it used one
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+}
+
+// StorageSpec describes the volume holding a builder's /nix
+type StorageSpec struct {
+	// Type is Ephemeral, Session or Shared
+	Type StorageType `json:"type,omitempty"`
+	// ClaimName names the PersistentVolumeClaim. Shared claims must already
+	// exist. Session claims default to <pod>-store and are created when
+	// missing, so naming one lets later sessions reuse it.
+	ClaimName string `json:"claimName,omitempty"`
+	// Size is the requested size of a Session claim the controller creates
+	Size *resource.Quantity `json:"size,omitempty"`
+	// StorageClassName is the storage class of a Session claim the
+	// controller creates
+	StorageClassName *string `json:"storageClassName,omitempty"`
+	// Retain keeps a Session claim after its build request is deleted
+	Retain bool `json:"retain,omitempty"`
+}
+
+// StorageType selects where a builder's /nix lives
+// +kubebuilder:validation:Enum=Ephemeral;Session;Shared
+type StorageType string
+
+const (
+	// StorageEphemeral builders start with only the image's store
+	StorageEphemeral StorageType = "Ephemeral"
+	// StorageSession builders get a ReadWriteOnce claim of their own
+	StorageSession StorageType = "Session"
+	// StorageShared builders mount an existing ReadWriteMany claim
+	StorageShared StorageType = "Shared"
+)
+
+// Isolation sets how far a builder is separated from other workloads
+// +kubebuilder:validation:Enum=Namespace
+type Isolation string
+
+const (
+	// IsolationNamespace builders run in a namespace created for the build
+	// and deleted with it
+	IsolationNamespace Isolation = "Namespace"
+)
+
+// BuildClass sets how a build competes for cluster capacity
+// +kubebuilder:validation:Enum=best-effort
+type BuildClass string
+
+const (
+	// BuildClassBestEffort builds run at low priority and may be preempted
+	// at any time by other workloads
+	BuildClassBestEffort BuildClass = "best-effort"
+)
+
+// BuildSecret mounts a Secret from the build request's namespace read-only
+// at /run/nix-builder/secrets/<name> for the session. Only Secrets labelled
+// nix.io/build-secret=true may be mounted.
+type BuildSecret struct {
+	// Name of the Secret
+	Name string `json:"name"`
+
+	// Keys limits the mounted keys, each of which must be present. Empty
+	// mounts every key.
+	Keys []string `json:"keys,omitempty"`
+}
+
+// CacheCredentials references binary cache credentials (e.g. a Cachix auth
+// token or netrc) that are mounted into the builder pod. Exactly one of
+// SecretRef or CSI must be set.
+type CacheCredentials struct {
+	// SecretRef names a Secret in the build request's namespace, such as one
+	// produced by an ExternalSecret
+	SecretRef *corev1.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// CSI mounts a Secrets Store CSI driver volume
+	CSI *corev1.CSIVolumeSource `json:"csi,omitempty"`
+
+	// RequiredKeys lists keys that must be present in the referenced Secret
+	// before the builder pod is created
+	RequiredKeys []string `json:"requiredKeys,omitempty"`
 }
 
 // NixBuildRequestStatus defines the observed state of a Nix build request
@@ -42,6 +310,15 @@ type NixBuildRequestStatus struct {
 	// PodName is the name of the created builder pod
 	PodName string `json:"podName,omitempty"`
 
+	// BuilderNamespace is the ephemeral namespace holding the builder pod
+	// when the build is isolated in one. Empty is the build request's
+	// namespace.
+	BuilderNamespace string `json:"builderNamespace,omitempty"`
+
+	// JobName is the name of the Job running the builder pod, when the
+	// controller runs builders as Jobs
+	JobName string `json:"jobName,omitempty"`
+
 	// PodIP is the IP address of the builder pod for SSH routing
 	PodIP string `json:"podIP,omitempty"`
 
@@ -51,6 +328,70 @@ type NixBuildRequestStatus struct {
 	// CompletionTime when the build finished
 	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
 
+	// PodScheduledTime when the builder pod was bound to a node
+	PodScheduledTime *metav1.Time `json:"podScheduledTime,omitempty"`
+
+	// PodReadyTime when the builder pod reported Ready
+	PodReadyTime *metav1.Time `json:"podReadyTime,omitempty"`
+
+	// SSHReadyTime when the builder was confirmed to accept SSH connections
+	SSHReadyTime *metav1.Time `json:"sshReadyTime,omitempty"`
+
+	// ExperimentalFeatures are the Nix experimental features enabled on the
+	// builder, so clients know what it supports
+	ExperimentalFeatures []string `json:"experimentalFeatures,omitempty"`
+
+	// AgentEndpoint is the URL of the builder agent, when enabled
+	AgentEndpoint string `json:"agentEndpoint,omitempty"`
+
+	// AgentTokenSecret names the secret holding the bearer token for the
+	// builder agent
+	AgentTokenSecret string `json:"agentTokenSecret,omitempty"`
+
+	// CredentialsSecret names the secret in the build request's namespace
+	// holding the private key issued for spec.credentials. It is deleted
+	// when the build request finishes.
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+
+	// CredentialsExpireTime is when the builder stops accepting the key
+	// issued for spec.credentials
+	CredentialsExpireTime *metav1.Time `json:"credentialsExpireTime,omitempty"`
+
+	// BuilderUser is the user sessions log in to the builder as, when the
+	// controller manages builder users
+	BuilderUser string `json:"builderUser,omitempty"`
+
+	// HostKey is the builder's SSH host public key in authorized_keys
+	// format, which the proxy requires the builder to present
+	HostKey string `json:"hostKey,omitempty"`
+
+	// StoreDiff records what the session added to a persistent /nix store,
+	// as reported by the builder agent when the build request is deleted
+	StoreDiff *StoreDiff `json:"storeDiff,omitempty"`
+
+	// QueuePosition is the build request's place in the queue while it is
+	// Queued, starting at 1
+	QueuePosition int32 `json:"queuePosition,omitempty"`
+
+	// CreateAttempts counts the failed attempts to create the builder pod
+	CreateAttempts int32 `json:"createAttempts,omitempty"`
+
+	// Reschedules counts the builder pods replaced after their spot node
+	// was reclaimed
+	Reschedules int32 `json:"reschedules,omitempty"`
+
+	// NextCreateTime is when creating the builder pod is next retried after
+	// a failed attempt
+	NextCreateTime *metav1.Time `json:"nextCreateTime,omitempty"`
+
+	// LogTail holds the last lines the builder logged, captured before its
+	// pod is deleted so the cause of a failure outlives the pod
+	LogTail string `json:"logTail,omitempty"`
+
+	// LogURL is where the builder's full log was uploaded, when the
+	// controller has a log store
+	LogURL string `json:"logURL,omitempty"`
+
 	// Message provides human-readable status information
 	Message string `json:"message,omitempty"`
 
@@ -58,12 +399,26 @@ type NixBuildRequestStatus struct {
 	Conditions []BuildCondition `json:"conditions,omitempty"`
 }
 
+// StoreDiff summarizes the store paths a session added to its builder
+type StoreDiff struct {
+	// AddedPaths is the number of store paths added
+	AddedPaths int32 `json:"addedPaths"`
+	// AddedBytes is the total NAR size of the added paths
+	AddedBytes int64 `json:"addedBytes"`
+	// ObservedTime is when the agent was asked for the diff
+	ObservedTime metav1.Time `json:"observedTime"`
+}
+
 // BuildPhase represents the phase of a build request
+// +kubebuilder:validation:Enum=Pending;Queued;Creating;Running;Completed;Failed
 type BuildPhase string
 
 const (
 	// BuildPhasePending means the build request has been created but pod is not yet scheduled
 	BuildPhasePending BuildPhase = "Pending"
+	// BuildPhaseQueued means the build request is waiting for a builder slot
+	// under the controller's or its namespace's running builder limit
+	BuildPhaseQueued BuildPhase = "Queued"
 	// BuildPhaseCreating means the pod is being created
 	BuildPhaseCreating BuildPhase = "Creating"
 	// BuildPhaseRunning means the pod is running and ready for SSH connections
@@ -79,6 +434,7 @@ type BuildCondition struct {
 	// Type of condition
 	Type BuildConditionType `json:"type"`
 	// Status of the condition (True, False, Unknown)
+	// +kubebuilder:validation:Enum=True;False;Unknown
 	Status corev1.ConditionStatus `json:"status"`
 	// LastTransitionTime is the last time the condition transitioned
 	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
@@ -92,14 +448,43 @@ type BuildCondition struct {
 type BuildConditionType string
 
 const (
+	// BuildConditionPodScheduled is False while the scheduler cannot place
+	// the builder pod
+	BuildConditionPodScheduled BuildConditionType = "PodScheduled"
+	// BuildConditionPodCreated is False while creating the builder pod
+	// fails, with the reason of the last failure
+	BuildConditionPodCreated BuildConditionType = "PodCreated"
 	// BuildConditionPodReady indicates the builder pod is ready for SSH connections
 	BuildConditionPodReady BuildConditionType = "PodReady"
 	// BuildConditionCompleted indicates the build has completed
 	BuildConditionCompleted BuildConditionType = "Completed"
 	// BuildConditionFailed indicates the build has failed
 	BuildConditionFailed BuildConditionType = "Failed"
+	// BuildConditionCredentialsReady indicates referenced cache credentials were found
+	BuildConditionCredentialsReady BuildConditionType = "CredentialsReady"
+	// BuildConditionPolicyAllowed indicates the build request passed policy checks
+	BuildConditionPolicyAllowed BuildConditionType = "PolicyAllowed"
+	// BuildConditionDryRun records the action a dry-run controller skipped
+	BuildConditionDryRun BuildConditionType = "DryRun"
+	// BuildConditionFeaturesReady indicates the requested experimental
+	// features are enabled on the builder
+	BuildConditionFeaturesReady BuildConditionType = "FeaturesReady"
+	// BuildConditionNixConfigValid indicates the builder's Nix configuration
+	// passed validation; warnings are listed in its message
+	BuildConditionNixConfigValid BuildConditionType = "NixConfigValid"
+	// BuildConditionImageValidated indicates the builder image passed the
+	// controller's validation checks
+	BuildConditionImageValidated BuildConditionType = "ImageValidated"
+	// BuildConditionSecretsReady indicates the build secrets exist and may
+	// be mounted
+	BuildConditionSecretsReady BuildConditionType = "SecretsReady"
+	// BuildConditionNotified records whether the controller's notifier was
+	// told the build finished
+	BuildConditionNotified BuildConditionType = "Notified"
 )
 
+// +kubebuilder:object:root=true
+
 // NixBuildRequestList contains a list of NixBuildRequest
 type NixBuildRequestList struct {
 	metav1.TypeMeta `json:",inline"`
@@ -183,6 +568,121 @@ func (in *NixBuildRequestSpec) DeepCopyInto(out *NixBuildRequestSpec) {
 		*out = make(map[string]string, len(*in))
 		maps.Copy((*out), *in)
 	}
+	if in.CacheCredentials != nil {
+		in, out := &in.CacheCredentials, &out.CacheCredentials
+		*out = new(CacheCredentials)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RequestedBy != nil {
+		in, out := &in.RequestedBy, &out.RequestedBy
+		*out = new(Requester)
+		**out = **in
+	}
+	if in.Credentials != nil {
+		in, out := &in.Credentials, &out.Credentials
+		*out = new(CredentialsSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BuildSecrets != nil {
+		in, out := &in.BuildSecrets, &out.BuildSecrets
+		*out = make([]BuildSecret, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.CachePush != nil {
+		in, out := &in.CachePush, &out.CachePush
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ExperimentalFeatures != nil {
+		in, out := &in.ExperimentalFeatures, &out.ExperimentalFeatures
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RequiredFeatures != nil {
+		in, out := &in.RequiredFeatures, &out.RequiredFeatures
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Devices != nil {
+		in, out := &in.Devices, &out.Devices
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.Spot != nil {
+		in, out := &in.Spot, &out.Spot
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(StorageSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PodTTLSecondsAfterFinished != nil {
+		in, out := &in.PodTTLSecondsAfterFinished, &out.PodTTLSecondsAfterFinished
+		*out = new(int32)
+		**out = **in
+	}
+	if in.TTLSecondsAfterFinished != nil {
+		in, out := &in.TTLSecondsAfterFinished, &out.TTLSecondsAfterFinished
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+func (in *CredentialsSpec) DeepCopyInto(out *CredentialsSpec) {
+	*out = *in
+	if in.TTLSeconds != nil {
+		in, out := &in.TTLSeconds, &out.TTLSeconds
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+func (in *BuildSecret) DeepCopyInto(out *BuildSecret) {
+	*out = *in
+	if in.Keys != nil {
+		in, out := &in.Keys, &out.Keys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+func (in *StorageSpec) DeepCopyInto(out *StorageSpec) {
+	*out = *in
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.StorageClassName != nil {
+		in, out := &in.StorageClassName, &out.StorageClassName
+		*out = new(string)
+		**out = **in
+	}
+}
+
+func (in *CacheCredentials) DeepCopyInto(out *CacheCredentials) {
+	*out = *in
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
+	if in.CSI != nil {
+		in, out := &in.CSI, &out.CSI
+		*out = new(corev1.CSIVolumeSource)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RequiredKeys != nil {
+		in, out := &in.RequiredKeys, &out.RequiredKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 func (in *NixBuildRequestStatus) DeepCopyInto(out *NixBuildRequestStatus) {
@@ -195,6 +695,36 @@ func (in *NixBuildRequestStatus) DeepCopyInto(out *NixBuildRequestStatus) {
 		in, out := &in.CompletionTime, &out.CompletionTime
 		*out = (*in).DeepCopy()
 	}
+	if in.PodScheduledTime != nil {
+		in, out := &in.PodScheduledTime, &out.PodScheduledTime
+		*out = (*in).DeepCopy()
+	}
+	if in.PodReadyTime != nil {
+		in, out := &in.PodReadyTime, &out.PodReadyTime
+		*out = (*in).DeepCopy()
+	}
+	if in.SSHReadyTime != nil {
+		in, out := &in.SSHReadyTime, &out.SSHReadyTime
+		*out = (*in).DeepCopy()
+	}
+	if in.ExperimentalFeatures != nil {
+		in, out := &in.ExperimentalFeatures, &out.ExperimentalFeatures
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.StoreDiff != nil {
+		in, out := &in.StoreDiff, &out.StoreDiff
+		*out = new(StoreDiff)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NextCreateTime != nil {
+		in, out := &in.NextCreateTime, &out.NextCreateTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CredentialsExpireTime != nil {
+		in, out := &in.CredentialsExpireTime, &out.CredentialsExpireTime
+		*out = (*in).DeepCopy()
+	}
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
 		*out = make([]BuildCondition, len(*in))
@@ -204,6 +734,11 @@ func (in *NixBuildRequestStatus) DeepCopyInto(out *NixBuildRequestStatus) {
 	}
 }
 
+func (in *StoreDiff) DeepCopyInto(out *StoreDiff) {
+	*out = *in
+	in.ObservedTime.DeepCopyInto(&out.ObservedTime)
+}
+
 func (in *BuildCondition) DeepCopyInto(out *BuildCondition) {
 	*out = *in
 	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
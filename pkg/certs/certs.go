@@ -0,0 +1,164 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// SecretCAKey is the key in a TLS secret containing the CA certificate
+	SecretCAKey = "ca.crt"
+	// SecretCertKey is the key in a TLS secret containing the certificate
+	SecretCertKey = corev1.TLSCertKey
+	// SecretPrivateKeyKey is the key in a TLS secret containing the private key
+	SecretPrivateKeyKey = corev1.TLSPrivateKeyKey
+)
+
+// CA is a certificate authority used to issue certificates for the mTLS
+// tunnel between the proxy and builder pods
+type CA struct {
+	cert    *x509.Certificate
+	key     any
+	certPEM []byte
+}
+
+// LoadCAFromSecret reads a CA keypair from the tls.crt and tls.key entries
+// of a secret, the layout used by kubernetes.io/tls and cert-manager CA
+// secrets
+func LoadCAFromSecret(secret *corev1.Secret) (*CA, error) {
+	certPEM, ok := secret.Data[SecretCertKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s missing required key '%s'", secret.Name, SecretCertKey)
+	}
+	keyPEM, ok := secret.Data[SecretPrivateKeyKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s missing required key '%s'", secret.Name, SecretPrivateKeyKey)
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA keypair: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate in secret %s is not a CA", secret.Name)
+	}
+
+	return &CA{cert: cert, key: pair.PrivateKey, certPEM: certPEM}, nil
+}
+
+// CertPEM returns the PEM encoded CA certificate
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// IssueServer issues a server certificate valid for the given DNS names
+func (ca *CA) IssueServer(commonName string, dnsNames []string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	return ca.issue(commonName, dnsNames, x509.ExtKeyUsageServerAuth, validity)
+}
+
+// IssueClient issues a client certificate for the given common name
+func (ca *CA) IssueClient(commonName string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	return ca.issue(commonName, nil, x509.ExtKeyUsageClientAuth, validity)
+}
+
+func (ca *CA) issue(commonName string, dnsNames []string, usage x509.ExtKeyUsage, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// ExpiresWithin reports whether the PEM encoded certificate is unparseable or
+// expires within the given window
+func ExpiresWithin(certPEM []byte, window time.Duration) bool {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(window).After(cert.NotAfter)
+}
+
+// ClientTLSConfig builds a mutual TLS client configuration from a secret
+// holding ca.crt, tls.crt and tls.key
+func ClientTLSConfig(secret *corev1.Secret) (*tls.Config, error) {
+	caPEM, ok := secret.Data[SecretCAKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s missing required key '%s'", secret.Name, SecretCAKey)
+	}
+
+	pair, err := tls.X509KeyPair(secret.Data[SecretCertKey], secret.Data[SecretPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse client keypair: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("failed to parse CA certificate from secret %s", secret.Name)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// ProxySecretName returns the name of the secret holding the proxy's client
+// certificate issued from the given CA secret
+func ProxySecretName(caSecret string) string {
+	return caSecret + "-proxy"
+}
+
+// BuilderSecretName returns the name of the secret holding a builder pod's
+// server certificate
+func BuilderSecretName(podName string) string {
+	return podName + "-tls"
+}
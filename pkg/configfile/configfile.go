@@ -0,0 +1,255 @@
+// Package configfile sets command line flags from a YAML file and reloads
+// them when the file changes or the process receives SIGHUP
+package configfile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// ReloadInterval is how often a watched config file is checked for changes.
+// Files mounted from a ConfigMap change within about a minute of the
+// ConfigMap being updated.
+const ReloadInterval = 30 * time.Second
+
+// File is a config file whose keys are the long names of a command's flags,
+// such as builder-image or session-grace-period. Lists set slice flags and
+// maps set key=value flags. Flags given on the command line take precedence
+// over the file.
+type File struct {
+	path  string
+	flags *pflag.FlagSet
+
+	// reloadable are the flags Reload may change
+	reloadable []string
+	// cmdline are the flags given on the command line
+	cmdline map[string]bool
+	// data is the file's content as last applied
+	data []byte
+	// values are the flag values last read from the file
+	values map[string]string
+}
+
+// Load reads the config file at path and sets every flag it names that was
+// not given on the command line. Only the flags in reloadable may be changed
+// by later reloads.
+func Load(path string, flags *pflag.FlagSet, reloadable []string) (*File, error) {
+	f := &File{path: path, flags: flags, reloadable: reloadable, cmdline: make(map[string]bool)}
+	flags.Visit(func(flag *pflag.Flag) {
+		f.cmdline[flag.Name] = true
+	})
+
+	data, values, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range values {
+		if f.cmdline[name] {
+			continue
+		}
+		if err := setFlag(flags.Lookup(name), value); err != nil {
+			return nil, fmt.Errorf("invalid value for %s in %s: %w", name, path, err)
+		}
+	}
+	f.data = data
+	f.values = values
+	return f, nil
+}
+
+// read parses the config file, checking that every key names a flag
+func (f *File) read() ([]byte, map[string]string, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file %s: %w", f.path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		if f.flags.Lookup(name) == nil || name == "config" {
+			return nil, nil, fmt.Errorf("unknown setting %q in config file %s", name, f.path)
+		}
+		s, err := flagValue(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value for %s in %s: %w", name, f.path, err)
+		}
+		values[name] = s
+	}
+	return data, values, nil
+}
+
+// flagValue renders a YAML value in the syntax its flag parses. Lists become
+// comma-separated values and maps comma-separated key=value pairs.
+func flagValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		pairs := make([]string, 0, len(v))
+		for key, item := range v {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		slices.Sort(pairs)
+		return strings.Join(pairs, ","), nil
+	case nil:
+		return "", fmt.Errorf("no value")
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// setFlag sets a flag's value without marking it as given on the command
+// line. Slice flags are replaced rather than appended to.
+func setFlag(flag *pflag.Flag, value string) error {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		var items []string
+		if value != "" {
+			items = strings.Split(value, ",")
+		}
+		return slice.Replace(items)
+	}
+	return flag.Value.Set(value)
+}
+
+// Reload re-reads the config file and updates the reloadable flags to match
+// it, resetting those it no longer sets to their defaults. apply is then
+// called with the flags that changed to put them into effect, even when none
+// did, so that files the flags name are read again. If apply fails, or the
+// config file is invalid, every flag keeps its previous value. Changes to
+// other flags are logged as needing a restart.
+func (f *File) Reload(apply func(changed []string) error) error {
+	return f.reload(apply, true)
+}
+
+// reload is Reload, skipping files whose content has not changed unless
+// force is set
+func (f *File) reload(apply func(changed []string) error, force bool) error {
+	data, values, err := f.read()
+	if err != nil {
+		return err
+	}
+	if !force && bytes.Equal(data, f.data) {
+		return nil
+	}
+
+	previous := make(map[string]string)
+	var changed []string
+	for _, name := range f.reloadable {
+		if f.cmdline[name] {
+			continue
+		}
+		flag := f.flags.Lookup(name)
+		value, ok := values[name]
+		if !ok {
+			value = flag.DefValue
+		}
+		if value == flag.Value.String() {
+			continue
+		}
+		previous[name] = flag.Value.String()
+		changed = append(changed, name)
+		if err = setFlag(flag, value); err != nil {
+			err = fmt.Errorf("invalid value for %s in %s: %w", name, f.path, err)
+			break
+		}
+	}
+	if err == nil {
+		err = apply(changed)
+	}
+	if err != nil {
+		for name, value := range previous {
+			if restoreErr := setFlag(f.flags.Lookup(name), value); restoreErr != nil {
+				log.Error().Err(restoreErr).Str("setting", name).Msg("Failed to restore setting")
+			}
+		}
+		return err
+	}
+
+	for _, name := range changedKeys(f.values, values) {
+		if f.cmdline[name] || slices.Contains(f.reloadable, name) {
+			continue
+		}
+		log.Warn().Str("setting", name).Str("path", f.path).Msg("Setting changed in config file; restart to apply it")
+	}
+	f.data = data
+	f.values = values
+	return nil
+}
+
+// Watch reloads the config file with apply whenever its content changes or
+// the process receives SIGHUP, until ctx ends. A failed reload is logged and
+// leaves the running settings in place.
+func (f *File) Watch(ctx context.Context, apply func(changed []string) error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info().Str("path", f.path).Msg("Received SIGHUP, reloading config file")
+			if err := f.reload(apply, true); err != nil {
+				log.Error().Err(err).Str("path", f.path).Msg("Failed to reload config file, keeping current settings")
+			}
+		case <-ticker.C:
+			if err := f.reload(apply, false); err != nil {
+				log.Error().Err(err).Str("path", f.path).Msg("Failed to reload config file, keeping current settings")
+			}
+		}
+	}
+}
+
+// changedKeys returns the keys whose values differ between old and new,
+// including keys only one of them has
+func changedKeys(old, new map[string]string) []string {
+	var keys []string
+	for key, value := range new {
+		if previous, ok := old[key]; !ok || previous != value {
+			keys = append(keys, key)
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,71 @@
+package configfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func TestReloadAppliesReloadableFlags(t *testing.T) {
+	var image string
+	var grace time.Duration
+	var labels []string
+	var port int
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVar(&image, "builder-image", "nixos/nix:latest", "")
+	flags.DurationVar(&grace, "session-grace-period", 5*time.Minute, "")
+	flags.StringSliceVar(&labels, "metrics-labels", nil, "")
+	flags.IntVar(&port, "metrics-port", 8080, "")
+	if err := flags.Parse([]string{"--metrics-port=9090"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("builder-image: builder:v1\nsession-grace-period: 10m\nmetrics-labels: [team, repo]\nmetrics-port: 8000\n")
+
+	f, err := Load(path, flags, []string{"builder-image", "session-grace-period"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if image != "builder:v1" || grace != 10*time.Minute || !slices.Equal(labels, []string{"team", "repo"}) {
+		t.Errorf("after Load image = %q, grace = %s, labels = %v", image, grace, labels)
+	}
+	if port != 9090 {
+		t.Errorf("port = %d, want the command line to win over the file", port)
+	}
+
+	write("builder-image: builder:v2\n")
+	var changed []string
+	if err := f.Reload(func(c []string) error { changed = c; return nil }); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if image != "builder:v2" || grace != 5*time.Minute {
+		t.Errorf("after Reload image = %q, grace = %s, want the new image and the default grace period", image, grace)
+	}
+	if !slices.Equal(changed, []string{"builder-image", "session-grace-period"}) {
+		t.Errorf("changed = %v", changed)
+	}
+
+	write("builder-image: builder:v3\n")
+	if err := f.Reload(func([]string) error { return errors.New("rejected") }); err == nil {
+		t.Fatal("Reload succeeded although apply failed")
+	}
+	if image != "builder:v2" {
+		t.Errorf("image = %q, want the previous value kept after a failed reload", image)
+	}
+
+	write("no-such-flag: true\n")
+	if err := f.Reload(func([]string) error { return nil }); err == nil {
+		t.Error("Reload accepted an unknown setting")
+	}
+}
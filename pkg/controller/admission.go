@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+// PolicyWebhook is a validating admission webhook that evaluates the build
+// request policy when a NixBuildRequest is created or its spec changes, so
+// denied requests are refused by the API server instead of failing after
+// they were accepted. The reconciler still checks the policy before
+// provisioning, which covers requests admitted while the webhook was down.
+type PolicyWebhook struct {
+	Policy policy.Checker
+	// FailOpen admits build requests, with a warning, when the policy cannot
+	// be evaluated
+	FailOpen bool
+}
+
+// SetupWebhookWithManager registers the webhook with the manager's webhook
+// server at /validate-nix-io-v1alpha1-nixbuildrequest
+func (w *PolicyWebhook) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&nixv1alpha1.NixBuildRequest{}).
+		WithValidator(w).
+		Complete()
+}
+
+// ValidateCreate evaluates the policy for a new build request
+func (w *PolicyWebhook) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	buildReq, ok := obj.(*nixv1alpha1.NixBuildRequest)
+	if !ok {
+		return nil, fmt.Errorf("expected a NixBuildRequest, got %T", obj)
+	}
+	return w.validate(ctx, buildReq)
+}
+
+// ValidateUpdate evaluates the policy again when the spec changes. Status
+// and metadata updates by the controller and proxy are admitted as is.
+func (w *PolicyWebhook) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldReq, ok := oldObj.(*nixv1alpha1.NixBuildRequest)
+	if !ok {
+		return nil, fmt.Errorf("expected a NixBuildRequest, got %T", oldObj)
+	}
+	buildReq, ok := newObj.(*nixv1alpha1.NixBuildRequest)
+	if !ok {
+		return nil, fmt.Errorf("expected a NixBuildRequest, got %T", newObj)
+	}
+	if equality.Semantic.DeepEqual(oldReq.Spec, buildReq.Spec) {
+		return nil, nil
+	}
+	return w.validate(ctx, buildReq)
+}
+
+// ValidateDelete admits every deletion
+func (w *PolicyWebhook) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (w *PolicyWebhook) validate(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (admission.Warnings, error) {
+	decision, err := w.Policy.Check(ctx, policy.InputFor(buildReq))
+	if err != nil {
+		if !w.FailOpen {
+			return nil, fmt.Errorf("policy check failed: %w", err)
+		}
+		log.Warn().Err(err).Str("namespace", buildReq.Namespace).Str("name", buildReq.Name).Msg("Policy check failed, admitting build request")
+		return admission.Warnings{fmt.Sprintf("Policy check failed open: %v", err)}, nil
+	}
+	if !decision.Allowed {
+		message := decision.Message
+		if message == "" {
+			message = "build request denied by policy"
+		}
+		log.Info().Str("namespace", buildReq.Namespace).Str("name", buildReq.Name).Str("reason", message).Msg("Build request refused by policy webhook")
+		return nil, fmt.Errorf("denied by policy: %s", message)
+	}
+	return nil, nil
+}
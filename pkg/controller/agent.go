@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// AgentTokenKey is the key in the agent token secret holding the bearer
+	// token for the builder agent
+	AgentTokenKey = "token"
+
+	agentTokenMountPath = "/etc/nix-builder/agent"
+)
+
+// agentTokenSecretName returns the secret holding a builder's agent token
+func agentTokenSecretName(podName string) string {
+	return podName + "-agent"
+}
+
+// ensureAgentToken creates a random bearer token for the builder's agent in
+// a secret tied to the builder's lifetime, so access ends with the session
+func (r *NixBuildRequestReconciler) ensureAgentToken(ctx context.Context, owner builderOwner, podName string) error {
+	if err := r.createTokenSecret(ctx, owner, agentTokenSecretName(podName), AgentTokenKey); err != nil {
+		return fmt.Errorf("failed to create agent token secret: %w", err)
+	}
+	return nil
+}
+
+// createTokenSecret stores a random bearer token under key in a new secret,
+// leaving a secret that already exists as it is
+func (r *NixBuildRequestReconciler) createTokenSecret(ctx context.Context, owner builderOwner, name, key string) error {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: owner.objectMeta(name),
+		Data: map[string][]byte{
+			key: []byte(base64.RawURLEncoding.EncodeToString(token)),
+		},
+	}
+
+	if err := r.Create(ctx, secret); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// addAgent wires the agent's token secret and port into the pod
+func (r *NixBuildRequestReconciler) addAgent(pod *corev1.Pod) {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: "agent-token",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  agentTokenSecretName(pod.Name),
+				DefaultMode: &[]int32{0400}[0],
+			},
+		},
+	})
+
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "agent-token",
+		MountPath: agentTokenMountPath,
+		ReadOnly:  true,
+	})
+	container.Ports = append(container.Ports, corev1.ContainerPort{
+		Name:          "agent",
+		ContainerPort: r.AgentPort,
+		Protocol:      corev1.ProtocolTCP,
+	})
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "AGENT_PORT",
+		Value: fmt.Sprintf("%d", r.AgentPort),
+	})
+}
+
+// agentEndpoint returns the URL of a running builder's agent
+func (r *NixBuildRequestReconciler) agentEndpoint(podIP string) string {
+	return "http://" + net.JoinHostPort(podIP, strconv.Itoa(int(r.AgentPort)))
+}
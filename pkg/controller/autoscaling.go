@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+const (
+	// SafeToEvictAnnotation tells the cluster autoscaler whether it may evict
+	// a pod to remove its node. Builders serving a session are not, since
+	// evicting one fails the build; idle pooled pods are, since the pool
+	// replaces them.
+	SafeToEvictAnnotation = "cluster-autoscaler.kubernetes.io/safe-to-evict"
+
+	// capacityCollectTimeout bounds listing build requests for a scrape
+	capacityCollectTimeout = 5 * time.Second
+)
+
+// BuilderAntiAffinity spreads builder pods across topology domains, so that
+// concurrent builds land on separate nodes and the cluster autoscaler adds
+// nodes for them instead of packing them together
+type BuilderAntiAffinity struct {
+	// Required makes spreading a scheduling requirement rather than a
+	// preference, leaving builders Pending until a free domain exists
+	Required bool
+	// TopologyKey is the node label whose values are spread across, such as
+	// kubernetes.io/hostname
+	TopologyKey string
+}
+
+// addAntiAffinity makes a builder pod avoid domains already running other
+// builders, in any namespace. The pod template's affinity is kept.
+func (r *NixBuildRequestReconciler) addAntiAffinity(pod *corev1.Pod) {
+	if r.AntiAffinity == nil {
+		return
+	}
+	term := corev1.PodAffinityTerm{
+		LabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nix-builder"}},
+		NamespaceSelector: &metav1.LabelSelector{},
+		TopologyKey:       r.AntiAffinity.TopologyKey,
+	}
+
+	// The affinity may still be shared with the pod template
+	affinity := &corev1.Affinity{}
+	if pod.Spec.Affinity != nil {
+		affinity = pod.Spec.Affinity.DeepCopy()
+	}
+	if affinity.PodAntiAffinity == nil {
+		affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+	}
+	antiAffinity := affinity.PodAntiAffinity
+	if r.AntiAffinity.Required {
+		antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = append(antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, term)
+	} else {
+		antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+			corev1.WeightedPodAffinityTerm{Weight: 100, PodAffinityTerm: term})
+	}
+	pod.Spec.Affinity = affinity
+}
+
+// CapacitySummary compares the build requests waiting for a builder with the
+// builders the controller may run, as a scaling signal for autoscalers
+type CapacitySummary struct {
+	// Waiting counts build requests that do not have a ready builder yet:
+	// Pending, Queued and Creating
+	Waiting int `json:"waiting"`
+	// Running counts build requests whose builder is ready
+	Running int `json:"running"`
+	// MaxRunning is the cap on builders serving build requests, zero when
+	// unbounded
+	MaxRunning int `json:"maxRunning,omitempty"`
+	// Desired is the builder pods needed to serve every unfinished build
+	// request within MaxRunning while keeping each warm pool variant at its
+	// minimum
+	Desired int `json:"desired"`
+}
+
+// capacitySummary derives the capacity figures from a status summary's
+// phase counts and warm pool
+func (r *NixBuildRequestReconciler) capacitySummary(summary *StatusSummary) CapacitySummary {
+	phases := summary.Phases
+	capacity := CapacitySummary{
+		Waiting:    phases[nixv1alpha1.BuildPhasePending] + phases[nixv1alpha1.BuildPhaseQueued] + phases[nixv1alpha1.BuildPhaseCreating],
+		Running:    phases[nixv1alpha1.BuildPhaseRunning],
+		MaxRunning: max(r.settings().MaxRunningBuilders, 0),
+	}
+	capacity.Desired = capacity.Waiting + capacity.Running
+	if capacity.MaxRunning > 0 {
+		capacity.Desired = min(capacity.Desired, capacity.MaxRunning)
+	}
+	for _, pool := range summary.Pool {
+		capacity.Desired += pool.Min
+	}
+	return capacity
+}
+
+// CapacityCollector exports the status summary's build backlog, capacity and
+// warm pool as gauges, so KEDA or an HPA on external metrics can scale nodes
+// or placeholder pods out before builds queue
+type CapacityCollector struct {
+	summarize func(ctx context.Context) (*StatusSummary, error)
+
+	requestsDesc   *prometheus.Desc
+	maxRunningDesc *prometheus.Desc
+	desiredDesc    *prometheus.Desc
+	poolIdleDesc   *prometheus.Desc
+	poolReadyDesc  *prometheus.Desc
+	poolMinDesc    *prometheus.Desc
+}
+
+// NewCapacityCollector creates a collector reading the reconciler's build
+// requests and warm pool on each scrape
+func NewCapacityCollector(r *NixBuildRequestReconciler) *CapacityCollector {
+	return newCapacityCollector(r.statusSummary)
+}
+
+func newCapacityCollector(summarize func(ctx context.Context) (*StatusSummary, error)) *CapacityCollector {
+	return &CapacityCollector{
+		summarize: summarize,
+		requestsDesc: prometheus.NewDesc("nix_build_requests",
+			"Unfinished build requests, by phase", []string{"phase"}, nil),
+		maxRunningDesc: prometheus.NewDesc("nix_builder_max_running",
+			"Cap on builders serving build requests at once, absent when unbounded", nil, nil),
+		desiredDesc: prometheus.NewDesc("nix_builders_desired",
+			"Builder pods needed to serve every unfinished build request within the cap and keep the warm pool at its minimum", nil, nil),
+		poolIdleDesc: prometheus.NewDesc("nix_builder_pool_idle",
+			"Idle pooled builder pods, by pool variant", []string{"variant"}, nil),
+		poolReadyDesc: prometheus.NewDesc("nix_builder_pool_ready",
+			"Idle pooled builder pods that are ready, by pool variant", []string{"variant"}, nil),
+		poolMinDesc: prometheus.NewDesc("nix_builder_pool_min",
+			"Idle pooled builder pods kept warm, by pool variant", []string{"variant"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *CapacityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requestsDesc
+	ch <- c.maxRunningDesc
+	ch <- c.desiredDesc
+	ch <- c.poolIdleDesc
+	ch <- c.poolReadyDesc
+	ch <- c.poolMinDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *CapacityCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), capacityCollectTimeout)
+	defer cancel()
+
+	summary, err := c.summarize(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to collect builder capacity metrics")
+		return
+	}
+
+	for _, phase := range []nixv1alpha1.BuildPhase{nixv1alpha1.BuildPhasePending, nixv1alpha1.BuildPhaseQueued, nixv1alpha1.BuildPhaseCreating, nixv1alpha1.BuildPhaseRunning} {
+		ch <- prometheus.MustNewConstMetric(c.requestsDesc, prometheus.GaugeValue, float64(summary.Phases[phase]), string(phase))
+	}
+	if summary.Capacity.MaxRunning > 0 {
+		ch <- prometheus.MustNewConstMetric(c.maxRunningDesc, prometheus.GaugeValue, float64(summary.Capacity.MaxRunning))
+	}
+	ch <- prometheus.MustNewConstMetric(c.desiredDesc, prometheus.GaugeValue, float64(summary.Capacity.Desired))
+	for _, pool := range summary.Pool {
+		ch <- prometheus.MustNewConstMetric(c.poolIdleDesc, prometheus.GaugeValue, float64(pool.Idle), pool.Variant)
+		ch <- prometheus.MustNewConstMetric(c.poolReadyDesc, prometheus.GaugeValue, float64(pool.Ready), pool.Variant)
+		ch <- prometheus.MustNewConstMetric(c.poolMinDesc, prometheus.GaugeValue, float64(pool.Min), pool.Variant)
+	}
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestBuilderPodsHintClusterAutoscaler(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, buildReq)
+	zoned := &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+			MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "topology.kubernetes.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"eu-west-1a"}}},
+		}}},
+	}}
+	r.PodTemplate = &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Affinity: zoned}}
+	r.AntiAffinity = &BuilderAntiAffinity{TopologyKey: "kubernetes.io/hostname"}
+
+	reconcileOnce(t, r)
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "nix-builder-abc"}, &pod); err != nil {
+		t.Fatalf("builder pod not created: %v", err)
+	}
+	if pod.Annotations[SafeToEvictAnnotation] != "false" {
+		t.Errorf("%s = %q, want false", SafeToEvictAnnotation, pod.Annotations[SafeToEvictAnnotation])
+	}
+	affinity := pod.Spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil {
+		t.Fatalf("affinity = %+v, want the template's node affinity kept", affinity)
+	}
+	preferred := affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	if len(preferred) != 1 || preferred[0].PodAffinityTerm.TopologyKey != "kubernetes.io/hostname" ||
+		preferred[0].PodAffinityTerm.LabelSelector.MatchLabels["app"] != "nix-builder" {
+		t.Errorf("preferred anti-affinity = %+v, want builders spread across hosts", preferred)
+	}
+	if zoned.PodAntiAffinity != nil {
+		t.Error("anti-affinity was added to the pod template")
+	}
+}
+
+func TestCapacityCollectorReportsBacklog(t *testing.T) {
+	queued := newBuildRequest(nixv1alpha1.BuildPhaseQueued)
+	queued.Name = "build-queued"
+	pending := newBuildRequest("")
+	pending.Name = "build-pending"
+	r, _ := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhaseRunning), queued, pending)
+	r.MaxRunningBuilders = 2
+	r.WarmPoolSize = 1
+	r.WarmPoolNamespace = "default"
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(NewCapacityCollector(r)); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			name := family.GetName()
+			for _, label := range metric.Label {
+				name += "/" + label.GetValue()
+			}
+			got[name] = metric.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{
+		"nix_build_requests/Pending":     1,
+		"nix_build_requests/Queued":      1,
+		"nix_build_requests/Creating":    0,
+		"nix_build_requests/Running":     1,
+		"nix_builder_max_running":        2,
+		"nix_builders_desired":           3,
+		"nix_builder_pool_idle/default":  0,
+		"nix_builder_pool_ready/default": 0,
+		"nix_builder_pool_min/default":   1,
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("capacity metrics = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// WouldDeleteAnnotation flags an object the controller would have deleted
+// if the cleanup bake-in period were over. Its value is the reason.
+const WouldDeleteAnnotation = "nix.io/would-delete"
+
+// holdDeletion logs a deletion held back by the cleanup bake-in and flags
+// the object with WouldDeleteAnnotation so operators can review it
+func holdDeletion(ctx context.Context, c client.Client, obj client.Object, reason string, until time.Time) error {
+	log.Warn().
+		Str("name", obj.GetName()).
+		Str("namespace", obj.GetNamespace()).
+		Str("reason", reason).
+		Time("bake_in_until", until).
+		Msg("Holding back deletion during cleanup bake-in")
+	if obj.GetAnnotations()[WouldDeleteAnnotation] == reason {
+		return nil
+	}
+
+	// Patch a copy so that status changes the caller has not written yet
+	// are not replaced by the server's response
+	flagged := obj.DeepCopyObject().(client.Object)
+	annotations := maps.Clone(flagged.GetAnnotations())
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[WouldDeleteAnnotation] = reason
+	flagged.SetAnnotations(annotations)
+	if err := c.Patch(ctx, flagged, client.MergeFrom(obj)); err != nil {
+		return client.IgnoreNotFound(fmt.Errorf("failed to flag %s for deletion: %w", obj.GetName(), err))
+	}
+	obj.SetAnnotations(flagged.GetAnnotations())
+	obj.SetResourceVersion(flagged.GetResourceVersion())
+	return nil
+}
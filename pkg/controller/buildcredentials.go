@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// DefaultCredentialsTTL is how long the key issued for a build request's
+// spec.credentials is accepted when the request sets no TTL
+const DefaultCredentialsTTL = 15 * time.Minute
+
+// Keys in a build request's credentials secret, which has the
+// kubernetes.io/ssh-auth type
+const (
+	// CredentialsExpiresAt holds when the key expires, in RFC 3339 format
+	CredentialsExpiresAt = "expires-at"
+	// CredentialsKnownHosts holds the builder's host key as a known_hosts
+	// line matching any host, since the pod's IP is not known yet
+	CredentialsKnownHosts = "known_hosts"
+)
+
+// credentialsSecretName returns the secret holding the key issued for a
+// build request
+func credentialsSecretName(buildReq *nixv1alpha1.NixBuildRequest) string {
+	return builderPodName(buildReq) + "-credentials"
+}
+
+// credentialsTTL returns how long a build request's issued key is accepted
+func credentialsTTL(buildReq *nixv1alpha1.NixBuildRequest) time.Duration {
+	if seconds := buildReq.Spec.Credentials.TTLSeconds; seconds != nil {
+		return time.Duration(*seconds) * time.Second
+	}
+	return DefaultCredentialsTTL
+}
+
+// validateCredentials checks that a build request does not ask for an issued
+// key alongside a key of its own
+func validateCredentials(buildReq *nixv1alpha1.NixBuildRequest) error {
+	if buildReq.Spec.Credentials != nil && buildReq.Spec.ClientPublicKey != "" {
+		return fmt.Errorf("only one of credentials and clientPublicKey may be set")
+	}
+	return nil
+}
+
+// issueCredentials generates the key pair of a build request that asked for
+// one and authorizes it on the builder pod only. The authorized_keys entry
+// carries the key's expiry, so sshd itself refuses the key once the TTL has
+// passed, and restrict, so it cannot forward ports or agents. The private
+// key goes to a secret in the build request's namespace for the client to
+// read. A retry after a failed pod creation reuses the key already issued.
+func (r *NixBuildRequestReconciler) issueCredentials(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest, podName, hostKey string) error {
+	signer, expires, err := r.existingCredentials(ctx, buildReq)
+	if err != nil {
+		return err
+	}
+	if signer == nil {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to generate credentials key: %w", err)
+		}
+		if signer, err = ssh.NewSignerFromKey(private); err != nil {
+			return fmt.Errorf("failed to create credentials key signer: %w", err)
+		}
+		block, err := ssh.MarshalPrivateKey(private, credentialsSecretName(buildReq))
+		if err != nil {
+			return fmt.Errorf("failed to encode credentials key: %w", err)
+		}
+		expires = r.now().Add(credentialsTTL(buildReq)).Truncate(time.Second)
+
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      credentialsSecretName(buildReq),
+				Namespace: buildReq.Namespace,
+				Labels: map[string]string{
+					ManagedByLabel:         ManagedByValue,
+					"nix.io/build-request": buildReq.Name,
+				},
+				OwnerReferences: []metav1.OwnerReference{buildRequestOwnerReference(buildReq)},
+			},
+			Type: corev1.SecretTypeSSHAuth,
+			Data: map[string][]byte{
+				corev1.SSHAuthPrivateKey: pem.EncodeToMemory(block),
+				CredentialsExpiresAt:     []byte(expires.UTC().Format(time.RFC3339)),
+				CredentialsKnownHosts:    []byte("* " + hostKey + "\n"),
+			},
+		}
+		if err := r.Create(ctx, secret); err != nil {
+			return fmt.Errorf("failed to create credentials secret: %w", err)
+		}
+	}
+
+	authorizedKey := fmt.Sprintf("restrict,expiry-time=%q %s %s\n",
+		expires.UTC().Format("20060102150405Z"),
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		credentialsSecretName(buildReq))
+	if err := r.createAuthorizedKeysSecret(ctx, buildRequestOwner(buildReq), podName, authorizedKey); err != nil {
+		return err
+	}
+
+	buildReq.Status.CredentialsSecret = credentialsSecretName(buildReq)
+	buildReq.Status.CredentialsExpireTime = &metav1.Time{Time: expires}
+	return nil
+}
+
+// existingCredentials reads the key already issued for a build request, or
+// returns a nil signer when there is none
+func (r *NixBuildRequestReconciler) existingCredentials(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (ssh.Signer, time.Time, error) {
+	var secret corev1.Secret
+	err := r.Get(ctx, client.ObjectKey{Namespace: buildReq.Namespace, Name: credentialsSecretName(buildReq)}, &secret)
+	if apierrors.IsNotFound(err) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to get credentials secret: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(secret.Data[corev1.SSHAuthPrivateKey])
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse issued credentials key: %w", err)
+	}
+	expires, err := time.Parse(time.RFC3339, string(secret.Data[CredentialsExpiresAt]))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse issued credentials expiry: %w", err)
+	}
+	return signer, expires, nil
+}
+
+// revokeCredentials deletes the secret holding a build request's issued key.
+// The builder keeps accepting the key until it expires or the pod is
+// deleted, since a running pod's authorized_keys cannot change, so finished
+// requests with credentials also lose their builder at once.
+func (r *NixBuildRequestReconciler) revokeCredentials(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) error {
+	if buildReq.Status.CredentialsSecret == "" || r.DryRun {
+		return nil
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: buildReq.Namespace, Name: buildReq.Status.CredentialsSecret}}
+	if err := r.Delete(ctx, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete credentials secret: %w", err)
+	}
+	log.Ctx(ctx).Info().Str("secret", secret.Name).Msg("Revoked issued builder credentials")
+	return nil
+}
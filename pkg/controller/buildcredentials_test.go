@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcileIssuesAndRevokesCredentials(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Status.PodName = ""
+	ttl := int32(300)
+	buildReq.Spec.Credentials = &nixv1alpha1.CredentialsSpec{TTLSeconds: &ttl}
+	buildReq.Spec.PodTTLSecondsAfterFinished = &[]int32{3600}[0]
+	r, _ := newTestReconciler(t, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.CredentialsSecret == "" || got.Status.CredentialsExpireTime == nil || !got.Status.CredentialsExpireTime.Time.Equal(testEpoch.Add(5*time.Minute)) {
+		t.Fatalf("status = %+v, want issued credentials expiring after the TTL", got.Status)
+	}
+	var credentials corev1.Secret
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.CredentialsSecret}, &credentials); err != nil {
+		t.Fatalf("credentials secret not created: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(credentials.Data[corev1.SSHAuthPrivateKey])
+	if err != nil {
+		t.Fatalf("credentials secret holds no usable key: %v", err)
+	}
+	if credentials.Type != corev1.SecretTypeSSHAuth || !strings.Contains(string(credentials.Data[CredentialsKnownHosts]), got.Status.HostKey) {
+		t.Errorf("credentials secret = %+v, want an ssh-auth secret pinning the builder host key", credentials)
+	}
+
+	var authorized corev1.Secret
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: podAuthorizedKeysSecretName(got.Status.PodName)}, &authorized); err != nil {
+		t.Fatal(err)
+	}
+	_, _, options, _, err := ssh.ParseAuthorizedKey(authorized.Data[authorizedKeysSecretKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	if !strings.Contains(string(authorized.Data[authorizedKeysSecretKey]), public) {
+		t.Errorf("authorized keys = %q, want the issued key", authorized.Data[authorizedKeysSecretKey])
+	}
+	if !slices.Equal(options, []string{"restrict", `expiry-time="20260115103500Z"`}) {
+		t.Errorf("authorized key options = %v, want restrict and the expiry", options)
+	}
+
+	// The session ends: the key is revoked and the builder goes at once
+	// despite the pod TTL
+	got.Status.Phase = nixv1alpha1.BuildPhaseCompleted
+	got.Status.CompletionTime = r.now()
+	if err := r.Status().Update(context.Background(), got); err != nil {
+		t.Fatal(err)
+	}
+	reconcileOnce(t, r)
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: credentials.Name}, &corev1.Secret{}); !apierrors.IsNotFound(err) {
+		t.Errorf("credentials secret after the build finished: %v, want it deleted", err)
+	}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &corev1.Pod{}); !apierrors.IsNotFound(err) {
+		t.Errorf("builder pod after the build finished: %v, want it deleted", err)
+	}
+
+	both := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	both.Spec.Credentials = &nixv1alpha1.CredentialsSpec{}
+	both.Spec.ClientPublicKey = public
+	r, _ = newTestReconciler(t, both)
+	if _, got = reconcileOnce(t, r); got.Status.Phase != nixv1alpha1.BuildPhaseFailed || !strings.HasPrefix(got.Status.Message, "E_INVALID") {
+		t.Errorf("phase = %q, message = %q, want credentials with a client key refused", got.Status.Phase, got.Status.Message)
+	}
+}
@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+const (
+	// DefaultLogTailLines is how many of the builder's last log lines are
+	// kept in status.logTail
+	DefaultLogTailLines = 50
+
+	// maxLogTailBytes bounds status.logTail so it cannot bloat the object
+	maxLogTailBytes = 8 << 10
+
+	// maxUploadedLogBytes bounds the log uploaded to the log store
+	maxUploadedLogBytes = 32 << 20
+)
+
+// PodLogReader reads a container's logs: its last tailLines lines when
+// tailLines is positive, otherwise up to limitBytes from the start
+type PodLogReader func(ctx context.Context, namespace, pod, container string, tailLines, limitBytes int64) ([]byte, error)
+
+// LogStore keeps builder logs after their pod is deleted
+type LogStore interface {
+	// Put writes data under key and returns where it was written
+	Put(ctx context.Context, key, contentType string, data []byte) (string, error)
+}
+
+// BuildLogs captures the builder's logs before its pod is deleted, keeping
+// their tail in status and, with a Store, uploading them in full
+type BuildLogs struct {
+	// Read reads the builder container's logs
+	Read PodLogReader
+	// TailLines is how many of the last lines go into status.logTail
+	TailLines int64
+	// Store receives the full log when set
+	Store LogStore
+}
+
+// ClientsetLogReader returns a PodLogReader using clientset, since the
+// controller-runtime client cannot read logs
+func ClientsetLogReader(clientset kubernetes.Interface) PodLogReader {
+	return func(ctx context.Context, namespace, pod, container string, tailLines, limitBytes int64) ([]byte, error) {
+		opts := &corev1.PodLogOptions{Container: container}
+		if tailLines > 0 {
+			opts.TailLines = &tailLines
+		} else {
+			opts.LimitBytes = &limitBytes
+		}
+		stream, err := clientset.CoreV1().Pods(namespace).GetLogs(pod, opts).Stream(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer stream.Close()
+		return io.ReadAll(stream)
+	}
+}
+
+// captureBuildLogs records the tail of the builder's logs in status and
+// uploads them to the log store, before the pod and its logs are deleted.
+// Build secret values are redacted from both. Failures are only logged so that they never hold up cleanup.
+func (r *NixBuildRequestReconciler) captureBuildLogs(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) {
+	if r.BuildLogs == nil || buildReq.Status.PodName == "" {
+		return
+	}
+	captureTail := buildReq.Status.LogTail == ""
+	upload := r.BuildLogs.Store != nil && buildReq.Status.LogURL == ""
+	if !captureTail && !upload {
+		return
+	}
+
+	// Logs that cannot be redacted are not kept at all
+	redactor, err := r.buildSecretRedactor(ctx, buildReq)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Not capturing builder logs that cannot be redacted")
+		return
+	}
+	redact := func(logs []byte) []byte {
+		if redactor == nil {
+			return logs
+		}
+		return []byte(redactor.Replace(string(logs)))
+	}
+
+	namespace, pod := builderNamespace(buildReq), buildReq.Status.PodName
+	changed := false
+	if captureTail {
+		tailLines := r.BuildLogs.TailLines
+		if tailLines <= 0 {
+			tailLines = DefaultLogTailLines
+		}
+		logs, err := r.BuildLogs.Read(ctx, namespace, pod, builderContainerName, tailLines, 0)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("pod_name", pod).Msg("Failed to read builder logs")
+			return
+		}
+		if tail := logTail(redact(logs)); tail != "" {
+			buildReq.Status.LogTail = tail
+			changed = true
+		}
+	}
+
+	if upload {
+		logs, err := r.BuildLogs.Read(ctx, namespace, pod, builderContainerName, 0, maxUploadedLogBytes)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("pod_name", pod).Msg("Failed to read builder logs")
+		} else {
+			logs = redact(logs)
+			key := fmt.Sprintf("%s/%s/%s.log", buildReq.Namespace, buildReq.Name, buildReq.Spec.SessionID)
+			if location, err := r.BuildLogs.Store.Put(ctx, key, "text/plain; charset=utf-8", logs); err != nil {
+				log.Ctx(ctx).Warn().Err(err).Msg("Failed to upload builder logs")
+			} else {
+				buildReq.Status.LogURL = location
+				changed = true
+				log.Ctx(ctx).Info().Str("location", location).Int("bytes", len(logs)).Msg("Uploaded builder logs")
+			}
+		}
+	}
+
+	if !changed {
+		return
+	}
+	if err := r.Status().Update(ctx, buildReq); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to record builder logs in status")
+	}
+}
+
+// logTail trims logs to the whole lines that fit in maxLogTailBytes
+func logTail(logs []byte) string {
+	if len(logs) > maxLogTailBytes {
+		logs = logs[len(logs)-maxLogTailBytes:]
+		if i := bytes.IndexByte(logs, '\n'); i >= 0 {
+			logs = logs[i+1:]
+		}
+	}
+	return strings.ToValidUTF8(string(logs), "�")
+}
@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// fakeLogStore records the objects put into it
+type fakeLogStore map[string][]byte
+
+func (s fakeLogStore) Put(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	s[key] = data
+	return "s3://build-logs/" + key, nil
+}
+
+func TestCleanupCapturesBuildLogs(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseFailed)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default"}}
+	r, _ := newTestReconciler(t, buildReq, pod)
+
+	full := "copying path '/nix/store/abc-src'\nerror: builder for '/nix/store/abc-hello.drv' failed with exit code 1\n"
+	store := fakeLogStore{}
+	r.BuildLogs = &BuildLogs{
+		TailLines: 1,
+		Store:     store,
+		Read: func(ctx context.Context, namespace, name, container string, tailLines, limitBytes int64) ([]byte, error) {
+			if namespace != "default" || name != "nix-builder-abc" || container != builderContainerName {
+				return nil, fmt.Errorf("unexpected logs of %s/%s container %s", namespace, name, container)
+			}
+			if tailLines == 1 {
+				return []byte("error: builder for '/nix/store/abc-hello.drv' failed with exit code 1\n"), nil
+			}
+			if limitBytes != maxUploadedLogBytes {
+				return nil, fmt.Errorf("unexpected limit %d", limitBytes)
+			}
+			return []byte(full), nil
+		},
+	}
+
+	if err := r.cleanup(context.Background(), buildReq); err != nil {
+		t.Fatalf("cleanup returned error: %v", err)
+	}
+
+	var got nixv1alpha1.NixBuildRequest
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(buildReq), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got.Status.LogTail, "error: builder for") {
+		t.Errorf("logTail = %q", got.Status.LogTail)
+	}
+	if got.Status.LogURL != "s3://build-logs/default/build-abc/abc.log" {
+		t.Errorf("logURL = %q", got.Status.LogURL)
+	}
+	if string(store["default/build-abc/abc.log"]) != full {
+		t.Errorf("uploaded log = %q, want the full log", store["default/build-abc/abc.log"])
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(pod), pod); !apierrors.IsNotFound(err) {
+		t.Errorf("builder pod not deleted: %v", err)
+	}
+}
+
+func TestLogTailKeepsWholeLines(t *testing.T) {
+	logs := []byte(strings.Repeat("x", maxLogTailBytes) + "\nlast line\n")
+	if got := logTail(logs); got != "last line\n" {
+		t.Errorf("logTail = %q, want only the whole line that fits", got)
+	}
+}
+
+func TestCaptureBuildLogsRedactsBuildSecrets(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseFailed)
+	buildReq.Spec.BuildSecrets = []nixv1alpha1.BuildSecret{{Name: "netrc"}}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "netrc", Namespace: "default", Labels: map[string]string{BuildSecretLabel: "true"}},
+		Data:       map[string][]byte{"netrc": []byte("machine git.example.com login ci password s3cr3t-token\n")},
+	}
+	r, _ := newTestReconciler(t, buildReq, secret)
+	store := fakeLogStore{}
+	r.BuildLogs = &BuildLogs{
+		Store: store,
+		Read: func(ctx context.Context, namespace, name, container string, tailLines, limitBytes int64) ([]byte, error) {
+			return []byte("fetching with s3cr3t-token\nmachine git.example.com login ci password s3cr3t-token\n"), nil
+		},
+	}
+
+	r.captureBuildLogs(context.Background(), buildReq)
+
+	want := "fetching with [REDACTED]\n[REDACTED]\n"
+	if buildReq.Status.LogTail != want {
+		t.Errorf("logTail = %q, want %q", buildReq.Status.LogTail, want)
+	}
+	if got := string(store["default/build-abc/abc.log"]); got != want {
+		t.Errorf("uploaded log = %q, want %q", got, want)
+	}
+
+	// Without the secret the logs cannot be redacted, so none are kept
+	buildReq = newBuildRequest(nixv1alpha1.BuildPhaseFailed)
+	buildReq.Spec.BuildSecrets = []nixv1alpha1.BuildSecret{{Name: "missing"}}
+	r.captureBuildLogs(context.Background(), buildReq)
+	if buildReq.Status.LogTail != "" || buildReq.Status.LogURL != "" {
+		t.Errorf("logs kept without redaction: tail %q, url %q", buildReq.Status.LogTail, buildReq.Status.LogURL)
+	}
+}
@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+const (
+	// BuildSecretLabel marks Secrets that build requests may mount. Without
+	// it any Secret in the namespace could be read through a builder.
+	BuildSecretLabel = "nix.io/build-secret"
+
+	// buildSecretsMountPath is where builder pods find their build secrets,
+	// each in a directory named after its Secret
+	buildSecretsMountPath = "/run/nix-builder/secrets"
+
+	// buildSecretsRemovalPoll is how often deletion checks that a builder
+	// with build secrets has terminated
+	buildSecretsRemovalPoll = 2 * time.Second
+
+	// redactedSecret replaces secret values in captured builder logs
+	redactedSecret = "[REDACTED]"
+
+	// minRedactedLength keeps very short values, which would match all
+	// over an ordinary log, from being redacted
+	minRedactedLength = 4
+)
+
+// validateBuildSecrets checks that every build secret exists, may be mounted
+// and holds the keys asked for, so that the pod does not hang in
+// ContainerCreating or start without them
+func (r *NixBuildRequestReconciler) validateBuildSecrets(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) error {
+	seen := make(map[string]bool, len(buildReq.Spec.BuildSecrets))
+	for _, ref := range buildReq.Spec.BuildSecrets {
+		if ref.Name == "" {
+			return fmt.Errorf("build secret name must be set")
+		}
+		if seen[ref.Name] {
+			return fmt.Errorf("build secret %s listed more than once", ref.Name)
+		}
+		seen[ref.Name] = true
+
+		var secret corev1.Secret
+		if err := r.Get(ctx, client.ObjectKey{Namespace: buildReq.Namespace, Name: ref.Name}, &secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				return fmt.Errorf("secret %s not found", ref.Name)
+			}
+			return fmt.Errorf("failed to get secret %s: %w", ref.Name, err)
+		}
+		if secret.Labels[BuildSecretLabel] != "true" {
+			return fmt.Errorf("secret %s is not labelled %s=true", ref.Name, BuildSecretLabel)
+		}
+		for _, key := range ref.Keys {
+			if _, ok := secret.Data[key]; !ok {
+				return fmt.Errorf("secret %s missing key '%s'", ref.Name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// addBuildSecrets mounts the build request's secrets read-only under
+// buildSecretsMountPath. Secret volumes are tmpfs-backed, so the files never
+// reach the node's disk and disappear with the pod.
+func addBuildSecrets(pod *corev1.Pod, secrets []nixv1alpha1.BuildSecret) {
+	container := &pod.Spec.Containers[0]
+	for i, ref := range secrets {
+		name := fmt.Sprintf("build-secret-%d", i)
+		source := &corev1.SecretVolumeSource{
+			SecretName:  ref.Name,
+			DefaultMode: &[]int32{0400}[0],
+		}
+		for _, key := range ref.Keys {
+			source.Items = append(source.Items, corev1.KeyToPath{Key: key, Path: key})
+		}
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{Secret: source},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: buildSecretsMountPath + "/" + ref.Name,
+			ReadOnly:  true,
+		})
+	}
+}
+
+// buildSecretRedactor returns a replacer hiding the mounted build secrets'
+// values, or nil when the build request has none
+func (r *NixBuildRequestReconciler) buildSecretRedactor(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (*strings.Replacer, error) {
+	if len(buildReq.Spec.BuildSecrets) == 0 {
+		return nil, nil
+	}
+	var values []string
+	for _, ref := range buildReq.Spec.BuildSecrets {
+		var secret corev1.Secret
+		if err := r.Get(ctx, client.ObjectKey{Namespace: buildReq.Namespace, Name: ref.Name}, &secret); err != nil {
+			return nil, fmt.Errorf("failed to get build secret %s: %w", ref.Name, err)
+		}
+		for key, value := range secret.Data {
+			if len(ref.Keys) == 0 || slices.Contains(ref.Keys, key) {
+				values = append(values, secretValues(string(value))...)
+			}
+		}
+	}
+	return newRedactor(values), nil
+}
+
+// secretValues returns the strings of a secret worth redacting: the value
+// itself, each of its lines, and the passwords of netrc entries, which may
+// be printed on their own
+func secretValues(value string) []string {
+	values := []string{strings.TrimSpace(value)}
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		values = append(values, line)
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "password" {
+				values = append(values, fields[i+1])
+			}
+		}
+	}
+	return values
+}
+
+// newRedactor replaces each value with redactedSecret, longest first so a
+// value containing another is hidden whole
+func newRedactor(values []string) *strings.Replacer {
+	values = slices.DeleteFunc(values, func(v string) bool { return len(v) < minRedactedLength })
+	slices.SortFunc(values, func(a, b string) int {
+		if n := cmp.Compare(len(b), len(a)); n != 0 {
+			return n
+		}
+		return strings.Compare(a, b)
+	})
+	values = slices.Compact(values)
+
+	oldnew := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		oldnew = append(oldnew, value, redactedSecret)
+	}
+	return strings.NewReplacer(oldnew...)
+}
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingMountsBuildSecrets(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Spec.BuildSecrets = []nixv1alpha1.BuildSecret{{Name: "netrc", Keys: []string{"netrc"}}}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "netrc", Namespace: "default", Labels: map[string]string{BuildSecretLabel: "true"}},
+		Data:       map[string][]byte{"netrc": []byte("machine git.example.com password token"), "other": []byte("x")},
+	}
+	r, _ := newTestReconciler(t, buildReq, secret)
+
+	_, got := reconcileOnce(t, r)
+
+	if !hasCondition(got, nixv1alpha1.BuildConditionSecretsReady, corev1.ConditionTrue) {
+		t.Errorf("conditions = %+v, want SecretsReady", got.Status.Conditions)
+	}
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(pod.Spec.Volumes, func(v corev1.Volume) bool { return v.Secret != nil && v.Secret.SecretName == "netrc" })
+	if i < 0 {
+		t.Fatalf("volumes = %v, want the netrc secret", pod.Spec.Volumes)
+	}
+	volume := pod.Spec.Volumes[i].Secret
+	if *volume.DefaultMode != 0400 || len(volume.Items) != 1 || volume.Items[0].Key != "netrc" {
+		t.Errorf("secret volume = %+v, want only key netrc with mode 0400", volume)
+	}
+	mount := corev1.VolumeMount{Name: pod.Spec.Volumes[i].Name, MountPath: "/run/nix-builder/secrets/netrc", ReadOnly: true}
+	if !slices.Contains(pod.Spec.Containers[0].VolumeMounts, mount) {
+		t.Errorf("volume mounts = %v, want %v", pod.Spec.Containers[0].VolumeMounts, mount)
+	}
+
+	// Secrets not labelled for builds cannot be mounted
+	buildReq = newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Spec.BuildSecrets = []nixv1alpha1.BuildSecret{{Name: "netrc"}}
+	secret.Labels = nil
+	secret.ResourceVersion = ""
+	r, _ = newTestReconciler(t, buildReq, secret)
+	_, got = reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed || !strings.Contains(got.Status.Message, BuildSecretLabel) {
+		t.Errorf("phase = %q, message = %q, want Failed naming %s", got.Status.Phase, got.Status.Message, BuildSecretLabel)
+	}
+}
+
+func TestDeletionWaitsForBuildSecretsRemoval(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	buildReq.Spec.BuildSecrets = []nixv1alpha1.BuildSecret{{Name: "netrc"}}
+	buildReq.DeletionTimestamp = &metav1.Time{Time: testEpoch}
+	// A finalizer keeps the pod terminating after it is deleted
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default", Finalizers: []string{"test/terminating"}}}
+	r, _ := newTestReconciler(t, buildReq, pod)
+
+	result, got := reconcileOnce(t, r)
+	if result.RequeueAfter != buildSecretsRemovalPoll {
+		t.Errorf("RequeueAfter = %v, want %v while the pod terminates", result.RequeueAfter, buildSecretsRemovalPoll)
+	}
+	if !slices.Contains(got.Finalizers, "nix.io/cleanup") {
+		t.Fatal("finalizer removed while the pod holding build secrets exists")
+	}
+
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(pod), pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Finalizers = nil
+	if err := r.Update(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(buildReq)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(buildReq), got); !apierrors.IsNotFound(err) {
+		t.Errorf("build request not released once its pod is gone: %v", err)
+	}
+}
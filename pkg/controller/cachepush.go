@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// cachePushMountPath is where builder pods find the cache push credentials
+const cachePushMountPath = "/etc/nix-builder/cache-push"
+
+// Keys of the cache push Secret, each optional
+const (
+	// CachePushSigningKey is a Nix secret key the outputs are signed with
+	// before they are uploaded
+	CachePushSigningKey = "secret-key"
+	// CachePushNetrc is a netrc file for HTTP caches such as attic or
+	// harmonia
+	CachePushNetrc = "netrc"
+	// CachePushAWSCredentials is an AWS shared credentials file for s3://
+	// caches
+	CachePushAWSCredentials = "aws-credentials"
+)
+
+// CachePush uploads the outputs of every build a builder runs to a binary
+// cache, so they outlive the builder pod
+type CachePush struct {
+	// URL is the Nix store URL outputs are copied to, such as
+	// s3://nix-cache?region=eu-west-1
+	URL string
+	// SecretName names a Secret in the builder's namespace holding the
+	// credentials for URL
+	SecretName string
+	// Default pushes for build requests that do not set spec.cachePush
+	Default bool
+}
+
+// cachePushEnabled reports whether a build request's outputs are pushed
+func (r *NixBuildRequestReconciler) cachePushEnabled(buildReq *nixv1alpha1.NixBuildRequest) bool {
+	if r.CachePush == nil {
+		return false
+	}
+	if buildReq.Spec.CachePush != nil {
+		return *buildReq.Spec.CachePush
+	}
+	return r.CachePush.Default
+}
+
+// validateCachePush checks that a build request asking for its outputs to be
+// pushed can have them pushed
+func (r *NixBuildRequestReconciler) validateCachePush(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) error {
+	if r.CachePush == nil {
+		if buildReq.Spec.CachePush != nil && *buildReq.Spec.CachePush {
+			return fmt.Errorf("no binary cache is configured on this controller")
+		}
+		return nil
+	}
+	if !r.cachePushEnabled(buildReq) || r.CachePush.SecretName == "" {
+		return nil
+	}
+
+	var secret corev1.Secret
+	if err := r.Get(ctx, client.ObjectKey{Namespace: buildReq.Namespace, Name: r.CachePush.SecretName}, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("secret %s not found", r.CachePush.SecretName)
+		}
+		return fmt.Errorf("failed to get secret %s: %w", r.CachePush.SecretName, err)
+	}
+	return nil
+}
+
+// addCachePush has the builder's Nix daemon copy the outputs of each build to
+// the binary cache as it finishes, using a post-build hook the builder image
+// installs when CACHE_PUSH_URL is set
+func (r *NixBuildRequestReconciler) addCachePush(pod *corev1.Pod) {
+	mountCachePush(pod, r.CachePush)
+	if r.Signing != nil {
+		r.addSigning(pod)
+	}
+}
+
+// mountCachePush sets CACHE_PUSH_URL on the pod's first container and mounts
+// the cache's credentials at cachePushMountPath
+func mountCachePush(pod *corev1.Pod, cachePush *CachePush) {
+	container := &pod.Spec.Containers[0]
+	container.Env = append(container.Env, corev1.EnvVar{Name: "CACHE_PUSH_URL", Value: cachePush.URL})
+	if cachePush.SecretName == "" {
+		return
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: "cache-push",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  cachePush.SecretName,
+				DefaultMode: &[]int32{0400}[0],
+			},
+		},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "cache-push",
+		MountPath: cachePushMountPath,
+		ReadOnly:  true,
+	})
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingPushesToCache(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "cache-push", Namespace: "default"}}
+	r, _ := newTestReconciler(t, buildReq, secret)
+	r.CachePush = &CachePush{URL: "s3://nix-cache", SecretName: "cache-push", Default: true}
+
+	_, got := reconcileOnce(t, r)
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	container := pod.Spec.Containers[0]
+	if !slices.Contains(container.Env, corev1.EnvVar{Name: "CACHE_PUSH_URL", Value: "s3://nix-cache"}) {
+		t.Errorf("env = %v, want CACHE_PUSH_URL", container.Env)
+	}
+	if !slices.ContainsFunc(container.VolumeMounts, func(m corev1.VolumeMount) bool { return m.MountPath == cachePushMountPath }) {
+		t.Errorf("volume mounts = %v, want the cache push credentials", container.VolumeMounts)
+	}
+
+	// Opting out, or opting in without a configured cache
+	optOut := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	optOut.Spec.CachePush = &[]bool{false}[0]
+	if r.cachePushEnabled(optOut) {
+		t.Error("pushing for a request that opted out")
+	}
+	optIn := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	optIn.Spec.CachePush = &[]bool{true}[0]
+	r, _ = newTestReconciler(t, optIn)
+	_, got = reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Errorf("phase = %q, want Failed without a configured cache", got.Status.Phase)
+	}
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/status"
+)
+
+// DefaultPodCreateRetries is how many times creating a builder pod is
+// retried before its build request fails
+const DefaultPodCreateRetries int32 = 5
+
+// Delays between attempts to create a builder pod, doubling from
+// podCreateBackoffBase up to podCreateBackoffMax
+const (
+	podCreateBackoffBase = 2 * time.Second
+	podCreateBackoffMax  = 2 * time.Minute
+)
+
+// podCreateBackoff returns the delay after the given number of failed
+// attempts to create a builder pod
+func podCreateBackoff(attempts int32) time.Duration {
+	delay := podCreateBackoffBase
+	for i := int32(1); i < attempts && delay < podCreateBackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, podCreateBackoffMax)
+}
+
+// podCreateWait returns how long a build request must still wait before its
+// builder pod is created again, or zero once it may be
+func (r *NixBuildRequestReconciler) podCreateWait(buildReq *nixv1alpha1.NixBuildRequest) time.Duration {
+	if buildReq.Status.NextCreateTime == nil {
+		return 0
+	}
+	return max(buildReq.Status.NextCreateTime.Sub(r.now().Time), 0)
+}
+
+// podCreateFailureReason names the cause of a failure to create a builder
+// pod in the PodCreated condition
+func podCreateFailureReason(err error) string {
+	switch {
+	case isQuotaExceeded(err):
+		return "QuotaExceeded"
+	case apierrors.IsInvalid(err):
+		return "Invalid"
+	case apierrors.IsForbidden(err):
+		return "Forbidden"
+	case apierrors.IsAlreadyExists(err):
+		return "AlreadyExists"
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return "Timeout"
+	case apierrors.IsTooManyRequests(err):
+		return "Throttled"
+	case apierrors.IsServiceUnavailable(err):
+		return "ServiceUnavailable"
+	default:
+		return "CreateFailed"
+	}
+}
+
+// handlePodCreateFailure records a failed attempt to create a builder pod.
+// Pods the API server rejects as exceeding a quota or invalid fail the build
+// request at once, since creating them again cannot succeed. Other failures
+// are retried with exponential backoff until PodCreateRetries is used up.
+func (r *NixBuildRequestReconciler) handlePodCreateFailure(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest, createErr error) (ctrl.Result, error) {
+	buildReq.Status.CreateAttempts++
+	buildReq.Status.NextCreateTime = nil
+	reason := podCreateFailureReason(createErr)
+	r.setCondition(buildReq, nixv1alpha1.BuildConditionPodCreated, corev1.ConditionFalse, reason, createErr.Error())
+
+	switch {
+	case isQuotaExceeded(createErr):
+		log.Ctx(ctx).Warn().Err(createErr).Msg("Builder pod exceeds resource quota")
+		r.failBuild(buildReq, errcode.Quota, "Builder pod exceeds resource quota: %v", createErr)
+		return r.updateStatus(ctx, buildReq)
+	case apierrors.IsInvalid(createErr):
+		log.Ctx(ctx).Warn().Err(createErr).Msg("Builder pod rejected as invalid")
+		r.failBuild(buildReq, errcode.Invalid, "Builder pod rejected as invalid: %v", createErr)
+		return r.updateStatus(ctx, buildReq)
+	case buildReq.Status.CreateAttempts > r.PodCreateRetries:
+		log.Ctx(ctx).Error().Err(createErr).Int32("attempts", buildReq.Status.CreateAttempts).Msg("Giving up creating builder pod")
+		r.failBuild(buildReq, errcode.Builder, "Builder pod could not be created after %d attempts (%s): %v", buildReq.Status.CreateAttempts, reason, createErr)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	delay := podCreateBackoff(buildReq.Status.CreateAttempts)
+	status.MarkRetrying(&buildReq.Status, *r.now(), delay)
+	log.Ctx(ctx).Warn().Err(createErr).Int32("attempts", buildReq.Status.CreateAttempts).Dur("retry_in", delay).Msg("Failed to create builder pod")
+	r.warningEvent(buildReq, EventPodCreateFailed, "Failed to create builder pod (attempt %d of %d), retrying in %s: %v",
+		buildReq.Status.CreateAttempts, r.PodCreateRetries+1, delay, createErr)
+	if err := r.Status().Update(ctx, buildReq); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to update build request status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: delay}, nil
+}
@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+func TestReconcilePendingBacksOffPodCreation(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Status.PodName = ""
+	r, clk := newTestReconciler(t, buildReq)
+	r.PodCreateRetries = 2
+	creates := 0
+	r.Client = interceptor.NewClient(r.Client.(client.WithWatch), interceptor.Funcs{
+		Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			if _, ok := obj.(*corev1.Pod); ok {
+				creates++
+				return apierrors.NewServiceUnavailable("etcd is down")
+			}
+			return c.Create(ctx, obj, opts...)
+		},
+	})
+
+	result, got := reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhasePending || got.Status.CreateAttempts != 1 {
+		t.Fatalf("phase = %q, attempts = %d, want Pending after 1 attempt", got.Status.Phase, got.Status.CreateAttempts)
+	}
+	if result.RequeueAfter != 2*time.Second {
+		t.Errorf("RequeueAfter = %v, want 2s", result.RequeueAfter)
+	}
+	if !hasCondition(got, nixv1alpha1.BuildConditionPodCreated, corev1.ConditionFalse) {
+		t.Errorf("conditions = %+v, want PodCreated False", got.Status.Conditions)
+	}
+
+	// Reconciles during the backoff do not try again
+	clk.Step(time.Second)
+	if result, _ := reconcileOnce(t, r); creates != 1 || result.RequeueAfter != time.Second {
+		t.Errorf("creates = %d, RequeueAfter = %v during backoff, want 1 and 1s", creates, result.RequeueAfter)
+	}
+
+	clk.Step(time.Second)
+	result, got = reconcileOnce(t, r)
+	if creates != 2 || result.RequeueAfter != 4*time.Second {
+		t.Errorf("creates = %d, RequeueAfter = %v, want 2 and 4s", creates, result.RequeueAfter)
+	}
+
+	clk.Step(4 * time.Second)
+	_, got = reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q after the retries ran out, want Failed", got.Status.Phase)
+	}
+	if code, _ := errcode.Parse(got.Status.Message); code != errcode.Builder || !strings.Contains(got.Status.Message, "after 3 attempts") {
+		t.Errorf("message = %q, want E_BUILDER after 3 attempts", got.Status.Message)
+	}
+}
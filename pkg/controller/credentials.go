@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// cacheCredentialsMountPath is where builder pods find binary cache credentials
+const cacheCredentialsMountPath = "/etc/nix-builder/cache-credentials"
+
+// secretProviderClassGVK identifies the Secrets Store CSI driver's provider
+// configuration resource
+var secretProviderClassGVK = schema.GroupVersionKind{
+	Group:   "secrets-store.csi.x-k8s.io",
+	Version: "v1",
+	Kind:    "SecretProviderClass",
+}
+
+// validateCacheCredentials checks that the credentials referenced by a build
+// request exist before a pod is created that would otherwise hang in
+// ContainerCreating waiting for them
+func (r *NixBuildRequestReconciler) validateCacheCredentials(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) error {
+	creds := buildReq.Spec.CacheCredentials
+
+	switch {
+	case creds.SecretRef != nil && creds.CSI != nil:
+		return fmt.Errorf("only one of secretRef and csi may be set")
+
+	case creds.SecretRef != nil:
+		var secret corev1.Secret
+		if err := r.Get(ctx, client.ObjectKey{
+			Namespace: buildReq.Namespace,
+			Name:      creds.SecretRef.Name,
+		}, &secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				return fmt.Errorf("secret %s not found", creds.SecretRef.Name)
+			}
+			return fmt.Errorf("failed to get secret %s: %w", creds.SecretRef.Name, err)
+		}
+		for _, key := range creds.RequiredKeys {
+			if _, ok := secret.Data[key]; !ok {
+				return fmt.Errorf("secret %s missing required key '%s'", creds.SecretRef.Name, key)
+			}
+		}
+		return nil
+
+	case creds.CSI != nil:
+		className := creds.CSI.VolumeAttributes["secretProviderClass"]
+		if className == "" {
+			return fmt.Errorf("csi volume missing 'secretProviderClass' attribute")
+		}
+		providerClass := &unstructured.Unstructured{}
+		providerClass.SetGroupVersionKind(secretProviderClassGVK)
+		if err := r.Get(ctx, client.ObjectKey{
+			Namespace: buildReq.Namespace,
+			Name:      className,
+		}, providerClass); err != nil {
+			if apierrors.IsNotFound(err) {
+				return fmt.Errorf("SecretProviderClass %s not found", className)
+			}
+			return fmt.Errorf("failed to get SecretProviderClass %s: %w", className, err)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("one of secretRef or csi must be set")
+	}
+}
+
+// addCacheCredentials mounts the build request's cache credentials into the pod
+func addCacheCredentials(pod *corev1.Pod, creds *nixv1alpha1.CacheCredentials) {
+	volume := corev1.Volume{Name: "cache-credentials"}
+	if creds.CSI != nil {
+		volume.CSI = creds.CSI.DeepCopy()
+		volume.CSI.ReadOnly = &[]bool{true}[0]
+	} else {
+		volume.Secret = &corev1.SecretVolumeSource{
+			SecretName:  creds.SecretRef.Name,
+			DefaultMode: &[]int32{0400}[0],
+		}
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "cache-credentials",
+		MountPath: cacheCredentialsMountPath,
+		ReadOnly:  true,
+	})
+}
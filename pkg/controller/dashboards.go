@@ -0,0 +1,279 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"sigs.k8s.io/yaml"
+)
+
+// MetricInfo describes a registered metric family
+type MetricInfo struct {
+	Name   string
+	Help   string
+	Type   dto.MetricType
+	Labels []string
+}
+
+// DescribeMetrics gathers the nix_ metric families from the given gatherers.
+// Vector metrics only appear once they have a series, so gatherers should be
+// registries populated with RegisterExportMetrics.
+func DescribeMetrics(gatherers ...prometheus.Gatherer) ([]MetricInfo, error) {
+	families, err := prometheus.Gatherers(gatherers).Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	var metrics []MetricInfo
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "nix_") {
+			continue
+		}
+		info := MetricInfo{Name: family.GetName(), Help: family.GetHelp(), Type: family.GetType()}
+		if len(family.Metric) > 0 {
+			for _, label := range family.Metric[0].Label {
+				info.Labels = append(info.Labels, label.GetName())
+			}
+		}
+		metrics = append(metrics, info)
+	}
+	return metrics, nil
+}
+
+// dashboardSections group metrics into dashboard rows by name prefix
+var dashboardSections = []struct {
+	title  string
+	prefix string
+}{
+	{"Build requests", "nix_build_"},
+	{"Builders", "nix_builder_"},
+	{"Proxy", "nix_proxy_"},
+	{"Controller", "nix_controller_"},
+}
+
+// GrafanaDashboard returns a Grafana dashboard with a panel for each metric,
+// grouped into rows by component
+func GrafanaDashboard(metrics []MetricInfo) ([]byte, error) {
+	var panels []map[string]any
+	y := 0
+	for _, section := range dashboardSections {
+		var sectionMetrics []MetricInfo
+		for _, metric := range metrics {
+			if strings.HasPrefix(metric.Name, section.prefix) {
+				sectionMetrics = append(sectionMetrics, metric)
+			}
+		}
+		if len(sectionMetrics) == 0 {
+			continue
+		}
+
+		panels = append(panels, map[string]any{
+			"id":        len(panels) + 1,
+			"type":      "row",
+			"title":     section.title,
+			"collapsed": false,
+			"gridPos":   map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+			"panels":    []any{},
+		})
+		y++
+		for i, metric := range sectionMetrics {
+			panels = append(panels, map[string]any{
+				"id":          len(panels) + 1,
+				"type":        "timeseries",
+				"title":       metric.Name,
+				"description": metric.Help,
+				"datasource":  map[string]string{"type": "prometheus", "uid": "${datasource}"},
+				"gridPos":     map[string]int{"h": 8, "w": 12, "x": 12 * (i % 2), "y": y + 8*(i/2)},
+				"targets":     metricTargets(metric),
+				"fieldConfig": map[string]any{
+					"defaults":  map[string]any{"unit": metricUnit(metric)},
+					"overrides": []any{},
+				},
+			})
+		}
+		y += 8 * ((len(sectionMetrics) + 1) / 2)
+	}
+
+	dashboard := map[string]any{
+		"uid":           "nix-remote-build",
+		"title":         "Nix Remote Builders",
+		"tags":          []string{"nix"},
+		"schemaVersion": 39,
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"refresh":       "1m",
+		"templating": map[string]any{"list": []map[string]any{{
+			"name":  "datasource",
+			"type":  "datasource",
+			"query": "prometheus",
+			"label": "Data source",
+		}}},
+		"panels": panels,
+	}
+	return json.MarshalIndent(dashboard, "", "  ")
+}
+
+// snapshotHistograms describe the current state rather than accumulating
+// observations, so their buckets are plotted without rate()
+var snapshotHistograms = map[string]bool{
+	"nix_proxy_session_age_seconds": true,
+}
+
+// metricTargets returns the queries plotting a metric: rates for counters,
+// quantiles for histograms and current values for gauges
+func metricTargets(metric MetricInfo) []map[string]string {
+	switch metric.Type {
+	case dto.MetricType_COUNTER:
+		return []map[string]string{{
+			"refId":        "A",
+			"expr":         sumBy(metric.Labels, fmt.Sprintf("rate(%s[$__rate_interval])", metric.Name)),
+			"legendFormat": legendFormat(metric.Labels),
+		}}
+	case dto.MetricType_HISTOGRAM:
+		buckets := fmt.Sprintf("rate(%s_bucket[$__rate_interval])", metric.Name)
+		if snapshotHistograms[metric.Name] {
+			buckets = metric.Name + "_bucket"
+		}
+		var targets []map[string]string
+		for i, quantile := range []struct{ value, legend string }{{"0.5", "p50"}, {"0.95", "p95"}} {
+			targets = append(targets, map[string]string{
+				"refId":        string(rune('A' + i)),
+				"expr":         fmt.Sprintf("histogram_quantile(%s, %s)", quantile.value, sumBy(append([]string{"le"}, metric.Labels...), buckets)),
+				"legendFormat": quantile.legend + labelSuffix(metric.Labels),
+			})
+		}
+		return targets
+	default:
+		return []map[string]string{{
+			"refId":        "A",
+			"expr":         sumBy(metric.Labels, metric.Name),
+			"legendFormat": legendFormat(metric.Labels),
+		}}
+	}
+}
+
+// sumBy aggregates a PromQL expression over all but the given labels
+func sumBy(labels []string, expr string) string {
+	if len(labels) == 0 {
+		return fmt.Sprintf("sum(%s)", expr)
+	}
+	return fmt.Sprintf("sum by (%s) (%s)", strings.Join(labels, ", "), expr)
+}
+
+func legendFormat(labels []string) string {
+	if len(labels) == 0 {
+		return "total"
+	}
+	return strings.TrimSpace(labelSuffix(labels))
+}
+
+// labelSuffix returns a Grafana legend template naming each label value
+func labelSuffix(labels []string) string {
+	var suffix strings.Builder
+	for _, label := range labels {
+		fmt.Fprintf(&suffix, " {{%s}}", label)
+	}
+	return suffix.String()
+}
+
+func metricUnit(metric MetricInfo) string {
+	switch {
+	case strings.HasSuffix(metric.Name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(metric.Name, "_bytes"):
+		return "bytes"
+	case metric.Type == dto.MetricType_COUNTER:
+		return "ops"
+	default:
+		return "short"
+	}
+}
+
+// alertRule is a Prometheus alerting rule together with the metrics its
+// expression reads
+type alertRule struct {
+	Alert       string            `json:"alert"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	metrics []string
+}
+
+// alertRules are the alerts shipped for the registered metrics
+var alertRules = []alertRule{
+	{
+		Alert:       "NixBuildFailureRateHigh",
+		Expr:        "sum(rate(nix_build_request_failures_total[15m])) / sum(rate(nix_build_requests_completed_total[15m])) > 0.2",
+		For:         "15m",
+		Labels:      map[string]string{"severity": "warning"},
+		Annotations: map[string]string{"summary": "More than 20% of build requests are failing"},
+		metrics:     []string{"nix_build_request_failures_total", "nix_build_requests_completed_total"},
+	},
+	{
+		Alert:       "NixBuilderColdStartSlow",
+		Expr:        "histogram_quantile(0.95, sum by (le) (rate(nix_build_cold_start_seconds_bucket[15m]))) > 120",
+		For:         "15m",
+		Labels:      map[string]string{"severity": "warning"},
+		Annotations: map[string]string{"summary": "95th percentile builder cold start is over two minutes"},
+		metrics:     []string{"nix_build_cold_start_seconds"},
+	},
+	{
+		Alert:       "NixBuilderPoolExhausted",
+		Expr:        "sum(rate(nix_builder_pool_claims_total{result=\"miss\"}[15m])) / sum(rate(nix_builder_pool_claims_total[15m])) > 0.5",
+		For:         "30m",
+		Labels:      map[string]string{"severity": "info"},
+		Annotations: map[string]string{"summary": "Most build requests miss the warm pool; consider raising --warm-pool-size"},
+		metrics:     []string{"nix_builder_pool_claims_total"},
+	},
+	{
+		Alert:       "NixProxyCleanupFailing",
+		Expr:        "increase(nix_proxy_cleanup_failures_total[1h]) > 0",
+		Labels:      map[string]string{"severity": "warning"},
+		Annotations: map[string]string{"summary": "The proxy is handing build requests it could not delete to the controller"},
+		metrics:     []string{"nix_proxy_cleanup_failures_total"},
+	},
+	{
+		Alert:       "NixProxySessionsRejected",
+		Expr:        "increase(nix_proxy_sessions_rejected_total[15m]) > 0",
+		Labels:      map[string]string{"severity": "critical"},
+		Annotations: map[string]string{"summary": "The proxy is refusing connections because its session registry is full"},
+		metrics:     []string{"nix_proxy_sessions_rejected_total"},
+	},
+	{
+		Alert:       "NixKubeAPIThrottled",
+		Expr:        "sum(rate(nix_controller_api_throttled_total{source=\"server\"}[15m])) > 0 or sum(rate(nix_proxy_api_throttled_total{source=\"server\"}[15m])) > 0",
+		For:         "15m",
+		Labels:      map[string]string{"severity": "warning"},
+		Annotations: map[string]string{"summary": "The Kubernetes API server is rejecting the controller's or proxy's requests with 429 Too Many Requests"},
+		metrics:     []string{"nix_controller_api_throttled_total", "nix_proxy_api_throttled_total"},
+	},
+}
+
+// AlertRules returns a Prometheus rule file with the alerts whose metrics
+// are all registered. It fails if an alert reads a metric that no longer
+// exists, so alerts cannot silently stop firing when metrics are renamed.
+func AlertRules(metrics []MetricInfo) ([]byte, error) {
+	var missing []string
+	for _, rule := range alertRules {
+		for _, name := range rule.metrics {
+			if !slices.ContainsFunc(metrics, func(m MetricInfo) bool { return m.Name == name }) {
+				missing = append(missing, fmt.Sprintf("%s reads %s", rule.Alert, name))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("alerts read unregistered metrics: %s", strings.Join(missing, ", "))
+	}
+
+	return yaml.Marshal(map[string]any{
+		"groups": []map[string]any{{
+			"name":  "nix-remote-build",
+			"rules": alertRules,
+		}},
+	})
+}
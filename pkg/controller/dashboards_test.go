@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/proxy"
+)
+
+func TestExportedAlertsReadRegisteredMetrics(t *testing.T) {
+	controllerMetrics := prometheus.NewRegistry()
+	if err := RegisterExportMetrics(controllerMetrics); err != nil {
+		t.Fatal(err)
+	}
+	proxyMetrics := prometheus.NewRegistry()
+	if err := proxy.RegisterExportMetrics(proxyMetrics); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := DescribeMetrics(controllerMetrics, proxyMetrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AlertRules(metrics); err != nil {
+		t.Fatalf("AlertRules: %v", err)
+	}
+	dashboard, err := GrafanaDashboard(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"nix_build_requests_completed_total", "nix_builder_pool_claims_total", "nix_proxy_sessions"} {
+		if !strings.Contains(string(dashboard), `"title": "`+name+`"`) {
+			t.Errorf("dashboard has no panel for %s", name)
+		}
+	}
+}
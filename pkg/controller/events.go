@@ -0,0 +1,36 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// Reasons of the Events recorded on build requests
+const (
+	EventInvalidSessionID    = "InvalidSessionID"
+	EventQueued              = "Queued"
+	EventPodCreated          = "PodCreated"
+	EventPodCreateFailed     = "PodCreateFailed"
+	EventPodClaimed          = "PodClaimed"
+	EventPodReady            = "PodReady"
+	EventPodRetried          = "PodRetried"
+	EventBuilderRescheduled  = "BuilderRescheduled"
+	EventBuildFailed         = "BuildFailed"
+	EventCleanupFailed       = "CleanupFailed"
+	EventBuildSecretsRemoved = "BuildSecretsRemoved"
+	EventNotificationFailed  = "NotificationFailed"
+)
+
+// event records an Event on a build request when a Recorder is configured
+func (r *NixBuildRequestReconciler) event(buildReq *nixv1alpha1.NixBuildRequest, eventType, reason, format string, args ...any) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(buildReq, eventType, reason, format, args...)
+}
+
+// warningEvent records a Warning Event on a build request
+func (r *NixBuildRequestReconciler) warningEvent(buildReq *nixv1alpha1.NixBuildRequest, reason, format string, args ...any) {
+	r.event(buildReq, corev1.EventTypeWarning, reason, format, args...)
+}
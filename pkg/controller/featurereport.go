@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/features"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/notify"
+)
+
+// Features reports which of the reconciler's optional subsystems are
+// enabled, reading the current settings and provisioning switch so the
+// report follows config reloads and the kill switch
+func (r *NixBuildRequestReconciler) Features() []features.Feature {
+	settings := r.settings()
+
+	provisioning := features.On("provisioning", "builders are provisioned for new build requests")
+	if r.Provisioning != nil {
+		state, err := r.Provisioning.State(context.Background())
+		switch {
+		case err != nil:
+			provisioning = features.Off("provisioning", "unknown: "+err.Error())
+		case state.Disabled:
+			provisioning = features.Off("provisioning", "disabled: "+state.Reason)
+		}
+	}
+
+	var pool []string
+	for _, variant := range r.warmPoolVariants() {
+		pool = append(pool, fmt.Sprintf("%s: %d", variant.Name, variant.Min))
+	}
+
+	policyDetail := "build requests are checked by a policy before provisioning"
+	if r.PolicyFailOpen {
+		policyDetail += ", allowed when it cannot be reached"
+	}
+
+	cachePush := features.Off("cache-push", "--cache-push-url")
+	if r.CachePush != nil {
+		detail := redactURL(r.CachePush.URL)
+		if r.CachePush.Default {
+			detail += ", for every build request"
+		}
+		cachePush = features.On("cache-push", detail)
+	}
+
+	notifications := features.Off("notifications", "--notify-webhook or --notify-slack-webhook")
+	if r.Notifier != nil {
+		phases := "Completed, Failed"
+		if len(r.NotifyPhases) > 0 {
+			names := make([]string, len(r.NotifyPhases))
+			for i, phase := range r.NotifyPhases {
+				names[i] = string(phase)
+			}
+			phases = strings.Join(names, ", ")
+		}
+		detail := "on " + phases
+		if all, ok := r.Notifier.(notify.All); ok {
+			noun := "webhooks"
+			if len(all) == 1 {
+				noun = "webhook"
+			}
+			detail = fmt.Sprintf("%d %s, %s", len(all), noun, detail)
+		}
+		notifications = features.On("notifications", detail)
+	}
+
+	buildLogs := features.Off("build-logs", "--capture-builder-logs or --log-store")
+	if r.BuildLogs != nil {
+		detail := fmt.Sprintf("last %d lines in status.logTail", r.BuildLogs.TailLines)
+		if r.BuildLogs.Store != nil {
+			detail += ", full logs uploaded"
+		}
+		buildLogs = features.On("build-logs", detail)
+	}
+
+	storage := features.Off("store-volumes", "--store-volume-type")
+	if r.DefaultStorage.Type != "" {
+		storage = features.On("store-volumes", "default "+string(r.DefaultStorage.Type))
+	}
+
+	antiAffinity := features.Off("anti-affinity", "--builder-anti-affinity")
+	if r.AntiAffinity != nil {
+		mode := "preferred"
+		if r.AntiAffinity.Required {
+			mode = "required"
+		}
+		antiAffinity = features.On("anti-affinity", mode+" across "+r.AntiAffinity.TopologyKey)
+	}
+
+	spot := features.Off("spot", "--spot-preset, --spot-node-selector or --spot-tolerations")
+	if r.Spot != nil {
+		detail := fmt.Sprintf("lost builders replaced up to %d times", r.Spot.MaxReschedules)
+		if r.Spot.Default {
+			detail += ", for every build request"
+		}
+		spot = features.On("spot", detail)
+	}
+
+	kvm := features.Off("kvm", "--kvm-builders or a kvm entry in --system-features")
+	if feature, ok := r.SystemFeatures["kvm"]; ok {
+		var devices []string
+		for _, name := range slices.Sorted(maps.Keys(feature.Resources)) {
+			devices = append(devices, string(name))
+		}
+		detail := "no device resource"
+		if len(devices) > 0 {
+			detail = strings.Join(devices, ", ")
+		}
+		kvm = features.On("kvm", detail)
+	}
+
+	return []features.Feature{
+		provisioning,
+		features.Toggle("dry-run", r.DryRun, "no resources are created or deleted", "--dry-run"),
+		features.Toggle("warm-pool", len(pool) > 0, strings.Join(pool, ", ")+" idle pods in "+r.WarmPoolNamespace, "--warm-pool-size or --warm-pool-variants"),
+		features.Toggle("queueing", settings.MaxRunningBuilders > 0, fmt.Sprintf("at most %d running builders", settings.MaxRunningBuilders), "--max-running-builders"),
+		features.Toggle("user-quota", settings.UserQuota.enabled(), settings.UserQuota.String(), "--user-max-builders, --user-max-cpu or --user-max-memory"),
+		features.Toggle("policy", r.Policy != nil, policyDetail, "--policy-url or --policy-configmap"),
+		cachePush,
+		notifications,
+		buildLogs,
+		storage,
+		features.Toggle("builder-tls", r.BuilderTLSSecret != "", "CA in Secret "+r.BuilderTLSSecret, "--builder-tls-secret"),
+		features.Toggle("builder-agent", r.AgentPort != 0, fmt.Sprintf("port %d", r.AgentPort), "--agent-port"),
+		features.Toggle("builder-users", r.ManageBuilderUsers, "a Unix user per requester", "--manage-builder-users"),
+		features.Toggle("builder-jobs", r.BuilderJobs, fmt.Sprintf("backoff limit %d", r.BuilderJobBackoffLimit), "--builder-jobs"),
+		features.Toggle("network-policy", r.NetworkPolicy != nil, "a NetworkPolicy per builder", "--builder-network-policy"),
+		features.Toggle("isolated-namespaces", r.NamespaceIsolation != nil, "builders may run in a namespace of their own", "--isolated-namespaces"),
+		antiAffinity,
+		features.Toggle("best-effort", r.BestEffortPriorityClass != "", "PriorityClass "+r.BestEffortPriorityClass, "--best-effort-priority-class"),
+		spot,
+		kvm,
+		features.Toggle("image-validation", r.ValidateImages, "builder images are validated before their first build", "--validate-builder-images"),
+		features.Toggle("session-reaping", settings.SessionGracePeriod > 0, "after "+settings.SessionGracePeriod.String()+" without a heartbeat", "--session-grace-period"),
+		features.Toggle("vault", r.Vault != nil, "keys from "+r.VaultKeyPath, "--vault-addr"),
+		features.Toggle("nix-signing", r.Signing != nil, "pushed outputs signed with a key in Vault", "--vault-signing-key-path or --vault-transit-key"),
+		features.Toggle("status-configmap", r.StatusConfigMap.Name != "", r.StatusConfigMap.String(), "--status-configmap"),
+	}
+}
+
+// redactURL hides the password of a URL's user info, leaving URLs that do
+// not parse as they are
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// nixConfigKey is the key in the Nix configuration ConfigMap mounted as
+// /etc/nix/nix.conf
+const nixConfigKey = "nix.conf"
+
+// DefaultAllowedExperimentalFeatures are the experimental features build
+// requests may enable unless the controller is configured otherwise
+var DefaultAllowedExperimentalFeatures = []string{"ca-derivations", "flakes", "nix-command"}
+
+// knownExperimentalFeatures lists the experimental features Nix understands.
+// Unknown names are rejected up front because Nix only warns about them,
+// leaving clients to discover the mismatch halfway through a build.
+var knownExperimentalFeatures = []string{
+	"auto-allocate-uids",
+	"ca-derivations",
+	"cgroups",
+	"configurable-impure-env",
+	"daemon-trust-override",
+	"dynamic-derivations",
+	"fetch-closure",
+	"fetch-tree",
+	"flakes",
+	"git-hashing",
+	"impure-derivations",
+	"local-overlay-store",
+	"mounted-ssh-store",
+	"nix-command",
+	"no-url-literals",
+	"parse-toml-timestamps",
+	"pipe-operators",
+	"read-only-local-store",
+	"recursive-nix",
+	"verified-fetches",
+}
+
+// resolveExperimentalFeatures validates the features a build request asks
+// for and returns every feature that will be enabled on its builder: those
+// already enabled by the Nix configuration plus the requested ones
+func (r *NixBuildRequestReconciler) resolveExperimentalFeatures(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) ([]string, error) {
+	for _, feature := range buildReq.Spec.ExperimentalFeatures {
+		if !slices.Contains(knownExperimentalFeatures, feature) {
+			return nil, fmt.Errorf("unknown experimental feature %q", feature)
+		}
+		if r.AllowedExperimentalFeatures != nil && !slices.Contains(r.AllowedExperimentalFeatures, feature) {
+			return nil, fmt.Errorf("experimental feature %q is not allowed on this cluster", feature)
+		}
+	}
+
+	enabled, err := r.configuredExperimentalFeatures(ctx, buildReq.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	enabled = append(enabled, buildReq.Spec.ExperimentalFeatures...)
+	slices.Sort(enabled)
+	return slices.Compact(enabled), nil
+}
+
+// configuredExperimentalFeatures reads the experimental features enabled by
+// the --nix-config ConfigMap
+func (r *NixBuildRequestReconciler) configuredExperimentalFeatures(ctx context.Context, namespace string) ([]string, error) {
+	if r.NixConfigMap == "" {
+		return nil, nil
+	}
+
+	contents, err := r.nixConfig(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return parseExperimentalFeatures(contents), nil
+}
+
+// parseExperimentalFeatures extracts the experimental-features and
+// extra-experimental-features settings from nix.conf contents
+func parseExperimentalFeatures(nixConf string) []string {
+	var features []string
+	scanner := bufio.NewScanner(strings.NewReader(nixConf))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "experimental-features":
+			features = strings.Fields(value)
+		case "extra-experimental-features":
+			features = append(features, strings.Fields(value)...)
+		}
+	}
+	return features
+}
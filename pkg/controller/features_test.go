@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingExperimentalFeatures(t *testing.T) {
+	nixConfig := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "nix-config", Namespace: "default"},
+		Data:       map[string]string{"nix.conf": "experimental-features = nix-command flakes\n"},
+	}
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Spec.ExperimentalFeatures = []string{"ca-derivations", "flakes"}
+	r, _ := newTestReconciler(t, buildReq, nixConfig)
+	r.NixConfigMap = "nix-config"
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseCreating {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseCreating)
+	}
+	want := []string{"ca-derivations", "flakes", "nix-command"}
+	if !slices.Equal(got.Status.ExperimentalFeatures, want) {
+		t.Errorf("experimentalFeatures = %v, want %v", got.Status.ExperimentalFeatures, want)
+	}
+}
+
+func TestReconcilePendingUnknownExperimentalFeature(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Spec.ExperimentalFeatures = []string{"ca-derivation"}
+	r, _ := newTestReconciler(t, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if len(got.Status.Conditions) != 1 || got.Status.Conditions[0].Reason != "FeaturesUnavailable" {
+		t.Errorf("conditions = %+v, want a single FeaturesUnavailable condition", got.Status.Conditions)
+	}
+}
+
+func TestReconcilePendingDisallowedExperimentalFeature(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Spec.ExperimentalFeatures = []string{"impure-derivations"}
+	r, _ := newTestReconciler(t, buildReq)
+	r.AllowedExperimentalFeatures = DefaultAllowedExperimentalFeatures
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if len(got.Status.Conditions) != 1 || !strings.Contains(got.Status.Conditions[0].Message, "not allowed") {
+		t.Errorf("conditions = %+v, want a not allowed condition", got.Status.Conditions)
+	}
+}
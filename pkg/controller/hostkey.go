@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// HostKeyPrivateKey and HostKeyPublicKey are the keys in a builder's
+	// host key secret
+	HostKeyPrivateKey = "ssh_host_ed25519_key"
+	HostKeyPublicKey  = "ssh_host_ed25519_key.pub"
+
+	builderHostKeyMountPath = "/etc/nix-builder/host-key"
+)
+
+// hostKeySecretName returns the secret holding a builder's SSH host key
+func hostKeySecretName(podName string) string {
+	return podName + "-host-key"
+}
+
+// ensureBuilderHostKey generates the SSH host key a builder pod presents,
+// so the proxy can pin it instead of trusting whatever answers on the pod's
+// IP. It returns the public key in authorized_keys format.
+func (r *NixBuildRequestReconciler) ensureBuilderHostKey(ctx context.Context, owner builderOwner, podName string) (string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate builder host key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, podName)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode builder host key: %w", err)
+	}
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode builder host key: %w", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: owner.objectMeta(hostKeySecretName(podName)),
+		Data: map[string][]byte{
+			HostKeyPrivateKey: pem.EncodeToMemory(block),
+			HostKeyPublicKey:  ssh.MarshalAuthorizedKey(sshPublic),
+		},
+	}
+
+	if err := r.Create(ctx, secret); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return r.builderHostKey(ctx, owner.Namespace, podName)
+		}
+		return "", fmt.Errorf("failed to create builder host key secret: %w", err)
+	}
+	return strings.TrimSpace(string(secret.Data[HostKeyPublicKey])), nil
+}
+
+// builderHostKey returns the public host key recorded for a builder pod
+func (r *NixBuildRequestReconciler) builderHostKey(ctx context.Context, namespace, podName string) (string, error) {
+	var secret corev1.Secret
+	if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: hostKeySecretName(podName)}, &secret); err != nil {
+		return "", fmt.Errorf("failed to get builder host key secret: %w", err)
+	}
+	return strings.TrimSpace(string(secret.Data[HostKeyPublicKey])), nil
+}
+
+// addBuilderHostKey mounts the builder's host key secret into the pod
+func addBuilderHostKey(pod *corev1.Pod) {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: "host-key",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  hostKeySecretName(pod.Name),
+				DefaultMode: &[]int32{0400}[0],
+			},
+		},
+	})
+
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "host-key",
+		MountPath: builderHostKeyMountPath,
+		ReadOnly:  true,
+	})
+}
@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingPublishesHostKey(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	var secret corev1.Secret
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: hostKeySecretName(got.Status.PodName)}, &secret); err != nil {
+		t.Fatalf("host key secret not created: %v", err)
+	}
+	if want := strings.TrimSpace(string(secret.Data[HostKeyPublicKey])); got.Status.HostKey != want || want == "" {
+		t.Errorf("hostKey = %q, want %q", got.Status.HostKey, want)
+	}
+	if _, err := ssh.ParsePrivateKey(secret.Data[HostKeyPrivateKey]); err != nil {
+		t.Errorf("host private key does not parse: %v", err)
+	}
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(pod.Spec.Volumes, func(v corev1.Volume) bool {
+		return v.Secret != nil && v.Secret.SecretName == secret.Name
+	}) {
+		t.Error("builder pod does not mount its host key")
+	}
+}
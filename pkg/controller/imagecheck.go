@@ -0,0 +1,201 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/status"
+)
+
+const (
+	// ImageValidationLabel marks the pods that validate builder images
+	ImageValidationLabel = "nix.io/image-validation"
+	// ImageAnnotation records the image a validation pod checks
+	ImageAnnotation = "nix.io/image"
+
+	// imageValidationDeadline bounds a validation pod's run, including
+	// pulling the image
+	imageValidationDeadline int64 = 600
+	// imageValidationRequeueInterval is how often a build request waiting
+	// on image validation checks the validation pod
+	imageValidationRequeueInterval = 5 * time.Second
+)
+
+// imageValidationScript checks that a builder image has the tools the
+// entrypoint runs, the required store paths and a working serve protocol.
+// The handshake writes SERVE_MAGIC_1 and protocol version 2.7 as
+// little-endian uint64s and expects SERVE_MAGIC_2 back.
+const imageValidationScript = `set -e
+fail() { echo "$*"; exit 1; }
+for tool in sshd ssh-keygen nix-daemon nix-store; do
+  command -v "$tool" >/dev/null || fail "missing $tool"
+done
+for path in "$@"; do
+  nix-store --check-validity "$path" 2>/dev/null || fail "missing store path $path"
+done
+magic=$(printf '\353\235\014\071\000\000\000\000\007\002\000\000\000\000\000\000' | nix-store --serve | od -An -tx1 -N4 | tr -d ' \n')
+[ "$magic" = cbee5254 ] || fail "nix-store --serve did not answer the handshake"
+echo "builder image validated"
+`
+
+// imageValidation is the state of a builder image's validation
+type imageValidation int
+
+const (
+	imagePending imageValidation = iota
+	imageValidated
+	imageInvalid
+)
+
+// validationPodName returns the name of the pod validating an image against
+// the required seed paths, so changing either validates again
+func (r *NixBuildRequestReconciler) validationPodName(image string) string {
+	sum := sha256.Sum256([]byte(image + "\n" + strings.Join(r.ImageSeedPaths, "\n")))
+	return "nix-builder-validate-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// validateImage returns the validation state of a builder image, starting
+// its validation pod if there is none. The pod's outcome is the record of
+// the result; deleting a failed pod validates the image again.
+func (r *NixBuildRequestReconciler) validateImage(ctx context.Context, image string, nodeSelector map[string]string) (imageValidation, string, error) {
+	var pod corev1.Pod
+	key := client.ObjectKey{Namespace: r.ImageValidationNamespace, Name: r.validationPodName(image)}
+	err := r.Get(ctx, key, &pod)
+	if apierrors.IsNotFound(err) {
+		if r.DryRun {
+			return imageValidated, "", nil
+		}
+		log.Info().Str("image", image).Str("pod_name", key.Name).Msg("Validating builder image")
+		if err := r.Create(ctx, r.imageValidationPod(key, image, nodeSelector)); err != nil && !apierrors.IsAlreadyExists(err) {
+			return imagePending, "", fmt.Errorf("failed to create image validation pod: %w", err)
+		}
+		return imagePending, "", nil
+	}
+	if err != nil {
+		return imagePending, "", fmt.Errorf("failed to get image validation pod: %w", err)
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded:
+		return imageValidated, "", nil
+	case corev1.PodFailed:
+		return imageInvalid, podFailureMessage(&pod), nil
+	}
+	if reason, message, failed := imagePullFailure(&pod); failed {
+		return imageInvalid, fmt.Sprintf("%s: %s", reason, message), nil
+	}
+	return imagePending, "", nil
+}
+
+// podFailureMessage returns why a failed pod failed, preferring its
+// container's termination message, which holds the tail of its output
+func podFailureMessage(pod *corev1.Pod) string {
+	message := pod.Status.Message
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated != nil && status.State.Terminated.Message != "" {
+			message = strings.TrimSpace(status.State.Terminated.Message)
+		}
+	}
+	return message
+}
+
+// imageValidationPod runs the validation script in place of the image's
+// entrypoint
+func (r *NixBuildRequestReconciler) imageValidationPod(key client.ObjectKey, image string, nodeSelector map[string]string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.Name,
+			Namespace: key.Namespace,
+			Labels: map[string]string{
+				"app":                "nix-builder-validate",
+				ManagedByLabel:       ManagedByValue,
+				ImageValidationLabel: "true",
+			},
+			Annotations: map[string]string{ImageAnnotation: image},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:         corev1.RestartPolicyNever,
+			ActiveDeadlineSeconds: &[]int64{imageValidationDeadline}[0],
+			NodeSelector:          nodeSelector,
+			Containers: []corev1.Container{{
+				Name:                     "validate",
+				Image:                    image,
+				Command:                  append([]string{"/bin/sh", "-c", imageValidationScript, "validate"}, r.ImageSeedPaths...),
+				TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+			}},
+		},
+	}
+	if r.PodTemplate != nil {
+		applyPodPlacement(&pod.Spec, &r.PodTemplate.Spec)
+	}
+	return pod
+}
+
+// checkBuilderImage holds a pending build request until its builder image
+// is validated. It returns false while the request has to wait or after
+// failing it because the image is invalid.
+func (r *NixBuildRequestReconciler) checkBuilderImage(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (bool, error) {
+	system, _ := r.systemBuilder(buildReq)
+	image := r.getBuilderImage(buildReq, system)
+
+	state, message, err := r.validateImage(ctx, image, builderNodeSelector(system, buildReq))
+	if err != nil {
+		return false, err
+	}
+	switch state {
+	case imageValidated:
+		if !hasCondition(buildReq, nixv1alpha1.BuildConditionImageValidated, corev1.ConditionTrue) {
+			r.setCondition(buildReq, nixv1alpha1.BuildConditionImageValidated, corev1.ConditionTrue, "Validated", fmt.Sprintf("Builder image %s passed validation", image))
+		}
+		return true, nil
+	case imageInvalid:
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionImageValidated, corev1.ConditionFalse, "ValidationFailed", message)
+		r.failBuild(buildReq, errcode.Invalid, "Builder image %s failed validation: %s", image, message)
+		return false, nil
+	default:
+		status.MarkValidating(&buildReq.Status, *r.now(), image)
+		return false, nil
+	}
+}
+
+// ValidateConfiguredImages starts validating the default builder image and
+// the images of configured systems and pool variants, so the first builds
+// using them do not wait
+func (r *NixBuildRequestReconciler) ValidateConfiguredImages(ctx context.Context) error {
+	placeholders := []*nixv1alpha1.NixBuildRequest{{}}
+	for system := range r.settings().Systems {
+		placeholders = append(placeholders, &nixv1alpha1.NixBuildRequest{Spec: nixv1alpha1.NixBuildRequestSpec{System: system}})
+	}
+	for _, variant := range r.warmPoolVariants() {
+		placeholders = append(placeholders, r.variantPlaceholder(variant))
+	}
+
+	seen := make(map[string]bool)
+	for _, placeholder := range placeholders {
+		system, err := r.systemBuilder(placeholder)
+		if err != nil {
+			continue
+		}
+		image := r.getBuilderImage(placeholder, system)
+		if seen[image] {
+			continue
+		}
+		seen[image] = true
+		if _, _, err := r.validateImage(ctx, image, builderNodeSelector(system, placeholder)); err != nil {
+			log.Error().Err(err).Str("image", image).Msg("Failed to start builder image validation")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingWaitsForImageValidation(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, buildReq)
+	r.ValidateImages = true
+	r.ImageValidationNamespace = "default"
+
+	result, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != "" {
+		t.Fatalf("phase = %q, want empty while the image is validated", got.Status.Phase)
+	}
+	if !hasCondition(got, nixv1alpha1.BuildConditionImageValidated, corev1.ConditionFalse) {
+		t.Errorf("conditions = %+v, want ImageValidated False", got.Status.Conditions)
+	}
+	if result.RequeueAfter != imageValidationRequeueInterval {
+		t.Errorf("requeueAfter = %v, want %v", result.RequeueAfter, imageValidationRequeueInterval)
+	}
+
+	var validation corev1.Pod
+	key := client.ObjectKey{Namespace: "default", Name: r.validationPodName("builder:test")}
+	if err := r.Get(context.Background(), key, &validation); err != nil {
+		t.Fatalf("validation pod not created: %v", err)
+	}
+	if validation.Spec.Containers[0].Image != "builder:test" {
+		t.Errorf("validation image = %q, want builder:test", validation.Spec.Containers[0].Image)
+	}
+	validation.Status.Phase = corev1.PodSucceeded
+	if err := r.Status().Update(context.Background(), &validation); err != nil {
+		t.Fatalf("failed to mark validation pod succeeded: %v", err)
+	}
+
+	_, got = reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseCreating {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseCreating)
+	}
+	if !hasCondition(got, nixv1alpha1.BuildConditionImageValidated, corev1.ConditionTrue) {
+		t.Errorf("conditions = %+v, want ImageValidated True", got.Status.Conditions)
+	}
+}
+
+func TestReconcilePendingFailsInvalidImage(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t)
+	r.ValidateImages = true
+	r.ImageValidationNamespace = "default"
+	validation := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: r.validationPodName("builder:test"), Namespace: "default"},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodFailed,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "validate",
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Message: "missing nix-daemon\n"}},
+			}},
+		},
+	}
+	for _, obj := range []client.Object{buildReq, validation} {
+		if err := r.Create(context.Background(), obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if want := "Builder image builder:test failed validation: missing nix-daemon"; !strings.HasPrefix(got.Status.Message, "E_INVALID") || !strings.HasSuffix(got.Status.Message, want) {
+		t.Errorf("message = %q, want E_INVALID ending in %q", got.Status.Message, want)
+	}
+	if !hasCondition(got, nixv1alpha1.BuildConditionImageValidated, corev1.ConditionFalse) {
+		t.Errorf("conditions = %+v, want ImageValidated False", got.Status.Conditions)
+	}
+	var pods corev1.PodList
+	if err := r.List(context.Background(), &pods, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 1 {
+		t.Errorf("%d pods, want only the failed validation pod", len(pods.Items))
+	}
+}
@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+const (
+	// BuildRequestNamespaceLabel records on an isolated namespace the
+	// namespace of the build request it was created for
+	BuildRequestNamespaceLabel = "nix.io/build-request-namespace"
+
+	// isolatedNamespacePrefix starts the name of every isolated namespace
+	isolatedNamespacePrefix = "nix-build-"
+
+	// isolatedServiceAccount runs builders in isolated namespaces without
+	// an API token
+	isolatedServiceAccount = "nix-builder"
+
+	// isolatedQuotaName names the ResourceQuota of an isolated namespace
+	isolatedQuotaName = "nix-builder"
+)
+
+// NamespaceIsolation runs builders in an ephemeral namespace of their own,
+// holding only the builder, its secrets, a ResourceQuota and a NetworkPolicy.
+// Build requests opt in with spec.isolation; the controller also isolates
+// those of the listed size classes and requesters.
+type NamespaceIsolation struct {
+	// SizeClasses isolates build requests labelled with these size classes
+	SizeClasses []string
+	// Requesters isolates build requests opened by these users
+	Requesters []string
+	// Quota limits the resources of each isolated namespace, which may
+	// always hold a single pod
+	Quota corev1.ResourceList
+}
+
+// isolatedNamespaceName returns the namespace a build request's builder is
+// isolated in. It is derived from the request so a reconcile that failed
+// part way finds the namespace again.
+func isolatedNamespaceName(buildReq *nixv1alpha1.NixBuildRequest) string {
+	sum := sha256.Sum256([]byte(buildReq.Namespace + "/" + buildReq.Name + "/" + string(buildReq.UID)))
+	return isolatedNamespacePrefix + hex.EncodeToString(sum[:8])
+}
+
+// builderNamespace returns the namespace of a build request's builder pod
+func builderNamespace(buildReq *nixv1alpha1.NixBuildRequest) string {
+	if buildReq.Status.BuilderNamespace != "" {
+		return buildReq.Status.BuilderNamespace
+	}
+	return buildReq.Namespace
+}
+
+// isolateInNamespace reports whether a build request's builder runs in an
+// isolated namespace
+func (r *NixBuildRequestReconciler) isolateInNamespace(buildReq *nixv1alpha1.NixBuildRequest) bool {
+	if buildReq.Spec.Isolation == nixv1alpha1.IsolationNamespace {
+		return true
+	}
+	if r.NamespaceIsolation == nil {
+		return false
+	}
+	if class := buildReq.Labels[nixv1alpha1.SizeClassLabel]; class != "" && slices.Contains(r.NamespaceIsolation.SizeClasses, class) {
+		return true
+	}
+	requester := buildReq.Annotations[policy.RequesterAnnotation]
+	return requester != "" && slices.Contains(r.NamespaceIsolation.Requesters, requester)
+}
+
+// validateIsolation checks that a build request's builder can run in an
+// isolated namespace, which cannot reach objects in other namespaces and
+// takes everything in it along when it is deleted
+func (r *NixBuildRequestReconciler) validateIsolation(buildReq *nixv1alpha1.NixBuildRequest) error {
+	if r.NamespaceIsolation == nil {
+		return fmt.Errorf("isolated namespaces are not enabled on this controller")
+	}
+	if storage := r.storageFor(buildReq); storage != nil {
+		if storage.Type == nixv1alpha1.StorageShared {
+			return fmt.Errorf("shared store volumes cannot be mounted in an isolated namespace")
+		}
+		if storage.Retain {
+			return fmt.Errorf("store volumes cannot be retained after an isolated namespace is deleted")
+		}
+	}
+	if creds := buildReq.Spec.CacheCredentials; creds != nil && creds.CSI != nil {
+		return fmt.Errorf("CSI cache credentials cannot be used in an isolated namespace")
+	}
+	return nil
+}
+
+// ensureIsolatedNamespace creates a build request's isolated namespace with
+// its ResourceQuota and service account, and copies in the secrets and
+// ConfigMap the builder pod mounts from the request's namespace
+func (r *NixBuildRequestReconciler) ensureIsolatedNamespace(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) error {
+	owner := buildRequestOwner(buildReq)
+
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: owner.Namespace,
+			Labels: map[string]string{
+				ManagedByLabel:             ManagedByValue,
+				"nix.io/build-request":     buildReq.Name,
+				BuildRequestNamespaceLabel: buildReq.Namespace,
+				"nix.io/session-id":        buildReq.Spec.SessionID,
+			},
+		},
+	}
+	if err := r.Create(ctx, namespace); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create isolated namespace: %w", err)
+		}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(namespace), namespace); err != nil {
+			return fmt.Errorf("failed to get isolated namespace: %w", err)
+		}
+		if !namespace.DeletionTimestamp.IsZero() {
+			return fmt.Errorf("isolated namespace %s is still being deleted", namespace.Name)
+		}
+	}
+
+	hard := corev1.ResourceList{corev1.ResourcePods: resource.MustParse("1")}
+	for name, quantity := range r.NamespaceIsolation.Quota {
+		hard[name] = quantity
+	}
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: owner.objectMeta(isolatedQuotaName),
+		Spec:       corev1.ResourceQuotaSpec{Hard: hard},
+	}
+	if err := r.Create(ctx, quota); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create isolated namespace quota: %w", err)
+	}
+
+	serviceAccount := &corev1.ServiceAccount{
+		ObjectMeta:                   owner.objectMeta(isolatedServiceAccount),
+		AutomountServiceAccountToken: &[]bool{false}[0],
+	}
+	if err := r.Create(ctx, serviceAccount); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create isolated namespace service account: %w", err)
+	}
+
+	// Only the public key of the shared keypair is needed by the builder
+	if r.authorizedKeysSecretName(buildReq, "") == r.SSHKeySecret {
+		if err := r.copySecret(ctx, buildReq, owner, r.SSHKeySecret, authorizedKeysSecretKey); err != nil {
+			return err
+		}
+	}
+	if r.cachePushEnabled(buildReq) && r.CachePush.SecretName != "" {
+		if err := r.copySecret(ctx, buildReq, owner, r.CachePush.SecretName); err != nil {
+			return err
+		}
+	}
+	if creds := buildReq.Spec.CacheCredentials; creds != nil && creds.SecretRef != nil {
+		if err := r.copySecret(ctx, buildReq, owner, creds.SecretRef.Name); err != nil {
+			return err
+		}
+	}
+	for _, ref := range buildReq.Spec.BuildSecrets {
+		if err := r.copySecret(ctx, buildReq, owner, ref.Name, ref.Keys...); err != nil {
+			return err
+		}
+	}
+	if r.PodTemplate != nil {
+		for _, pullSecret := range r.PodTemplate.Spec.ImagePullSecrets {
+			if err := r.copySecret(ctx, buildReq, owner, pullSecret.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.NixConfigMap != "" {
+		var source corev1.ConfigMap
+		if err := r.Get(ctx, client.ObjectKey{Namespace: buildReq.Namespace, Name: r.NixConfigMap}, &source); err != nil {
+			return fmt.Errorf("failed to get nix config %s: %w", r.NixConfigMap, err)
+		}
+		configMap := &corev1.ConfigMap{ObjectMeta: owner.objectMeta(r.NixConfigMap), Data: source.Data}
+		if err := r.Create(ctx, configMap); err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to copy nix config into isolated namespace: %w", err)
+		}
+	}
+
+	log.Ctx(ctx).Debug().Str("namespace", owner.Namespace).Msg("Prepared isolated builder namespace")
+	return nil
+}
+
+// copySecret copies a secret from a build request's namespace into its
+// isolated namespace, limited to keys when any are given
+func (r *NixBuildRequestReconciler) copySecret(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest, owner builderOwner, name string, keys ...string) error {
+	var source corev1.Secret
+	if err := r.Get(ctx, client.ObjectKey{Namespace: buildReq.Namespace, Name: name}, &source); err != nil {
+		return fmt.Errorf("failed to get secret %s: %w", name, err)
+	}
+
+	secret := &corev1.Secret{ObjectMeta: owner.objectMeta(name), Type: source.Type, Data: source.Data}
+	if len(keys) > 0 {
+		secret.Data = make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			if value, ok := source.Data[key]; ok {
+				secret.Data[key] = value
+			}
+		}
+	}
+	if err := r.Create(ctx, secret); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to copy secret %s into isolated namespace: %w", name, err)
+	}
+	return nil
+}
+
+// deleteIsolatedNamespace deletes a build request's isolated namespace and
+// everything left in it
+func (r *NixBuildRequestReconciler) deleteIsolatedNamespace(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) error {
+	namespace := &corev1.Namespace{}
+	namespace.Name = buildReq.Status.BuilderNamespace
+	if err := r.Delete(ctx, namespace); client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to delete isolated namespace: %w", err)
+	}
+	log.Ctx(ctx).Info().Str("namespace", namespace.Name).Msg("Deleted isolated builder namespace")
+	return nil
+}
+
+// isolatePod moves a builder pod into its build request's isolated
+// namespace, running it under a service account without an API token
+func isolatePod(pod *corev1.Pod, buildReq *nixv1alpha1.NixBuildRequest) {
+	pod.Namespace = buildReq.Status.BuilderNamespace
+	pod.OwnerReferences = nil
+	pod.Spec.ServiceAccountName = isolatedServiceAccount
+	pod.Spec.AutomountServiceAccountToken = &[]bool{false}[0]
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingIsolatesInNamespace(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	buildReq.Labels = map[string]string{nixv1alpha1.SizeClassLabel: "untrusted"}
+	keys := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "keys", Namespace: "default"},
+		Data:       map[string][]byte{"public": []byte("ssh-ed25519 AAAA"), "private": []byte("secret")},
+	}
+	r, _ := newTestReconciler(t, buildReq, keys)
+	r.NamespaceIsolation = &NamespaceIsolation{
+		SizeClasses: []string{"untrusted"},
+		Quota:       corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("4")},
+	}
+
+	_, got := reconcileOnce(t, r)
+
+	ns := got.Status.BuilderNamespace
+	if !strings.HasPrefix(ns, "nix-build-") {
+		t.Fatalf("builderNamespace = %q, want an isolated namespace", ns)
+	}
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: ns, Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatalf("builder pod not created in isolated namespace: %v", err)
+	}
+	if len(pod.OwnerReferences) != 0 || pod.Spec.ServiceAccountName != isolatedServiceAccount {
+		t.Errorf("pod owners = %v, service account = %q, want none and %s", pod.OwnerReferences, pod.Spec.ServiceAccountName, isolatedServiceAccount)
+	}
+
+	var copied corev1.Secret
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: ns, Name: "keys"}, &copied); err != nil {
+		t.Fatalf("SSH keys not copied: %v", err)
+	}
+	if _, ok := copied.Data["private"]; ok || len(copied.Data["public"]) == 0 {
+		t.Errorf("copied keys = %v, want only the public key", slices.Collect(maps.Keys(copied.Data)))
+	}
+	var quota corev1.ResourceQuota
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: ns, Name: isolatedQuotaName}, &quota); err != nil {
+		t.Fatalf("quota not created: %v", err)
+	}
+	if pods, cpu := quota.Spec.Hard[corev1.ResourcePods], quota.Spec.Hard[corev1.ResourceLimitsCPU]; pods.Value() != 1 || cpu.Value() != 4 {
+		t.Errorf("quota = %v, want one pod and 4 CPUs", quota.Spec.Hard)
+	}
+	var netpol networkingv1.NetworkPolicy
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: ns, Name: "nix-builder-abc"}, &netpol); err != nil {
+		t.Fatalf("network policy not created: %v", err)
+	}
+	if peer := netpol.Spec.Ingress[0].From[0].NamespaceSelector; peer == nil || peer.MatchLabels[corev1.LabelMetadataName] != "default" {
+		t.Errorf("peer namespace selector = %v, want the build request's namespace", peer)
+	}
+
+	if err := r.Delete(context.Background(), got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(got)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(context.Background(), client.ObjectKey{Name: ns}, &corev1.Namespace{}); !apierrors.IsNotFound(err) {
+		t.Errorf("isolated namespace still present after cleanup: %v", err)
+	}
+}
+
+func TestReconcilePendingRejectsIsolationWhenDisabled(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	buildReq.Spec.Isolation = nixv1alpha1.IsolationNamespace
+	r, _ := newTestReconciler(t, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed || !strings.Contains(got.Status.Message, "not enabled") {
+		t.Errorf("phase = %q, message = %q, want failure for disabled isolation", got.Status.Phase, got.Status.Message)
+	}
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+// DefaultBuilderJobBackoffLimit is how many times a builder Job replaces a
+// failed pod before the build request fails
+const DefaultBuilderJobBackoffLimit int32 = 3
+
+// builderJob wraps a builder pod in a Job of the same name, so failed pods
+// are retried by the Job controller up to BuilderJobBackoffLimit times
+func (r *NixBuildRequestReconciler) builderJob(buildReq *nixv1alpha1.NixBuildRequest, pod *corev1.Pod) *batchv1.Job {
+	backoffLimit := r.BuilderJobBackoffLimit
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			Labels:          pod.Labels,
+			OwnerReferences: pod.OwnerReferences,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			// The session's deadline covers every attempt, not each pod
+			ActiveDeadlineSeconds: pod.Spec.ActiveDeadlineSeconds,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      pod.Labels,
+					Annotations: pod.Annotations,
+				},
+				Spec: pod.Spec,
+			},
+		},
+	}
+}
+
+// jobCondition returns the status of a builder Job's condition of condType
+func jobCondition(job *batchv1.Job, condType batchv1.JobConditionType) (*batchv1.JobCondition, bool) {
+	for i := range job.Status.Conditions {
+		cond := &job.Status.Conditions[i]
+		if cond.Type == condType && cond.Status == corev1.ConditionTrue {
+			return cond, true
+		}
+	}
+	return nil, false
+}
+
+// currentJobPod returns the newest pod a builder Job has not given up on,
+// or nil while the Job has none
+func (r *NixBuildRequestReconciler) currentJobPod(ctx context.Context, job *batchv1.Job) (*corev1.Pod, error) {
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(job.Namespace), client.MatchingLabels{batchv1.JobNameLabel: job.Name}); err != nil {
+		return nil, fmt.Errorf("failed to list builder job pods: %w", err)
+	}
+
+	var current *corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+			continue
+		}
+		if current == nil || current.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			current = pod
+		}
+	}
+	return current, nil
+}
+
+// syncBuilderJob follows a creating build request's Job to the pod it is
+// currently running, recording the pod's name in the status. It fails the
+// request once the Job has run out of retries.
+func (r *NixBuildRequestReconciler) syncBuilderJob(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (*corev1.Pod, error) {
+	var job batchv1.Job
+	if err := r.Get(ctx, client.ObjectKey{Namespace: builderNamespace(buildReq), Name: buildReq.Status.JobName}, &job); err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			r.failBuild(buildReq, errcode.Builder, "Builder job was deleted during creation")
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get builder job: %w", err)
+	}
+
+	if cond, failed := jobCondition(&job, batchv1.JobFailed); failed {
+		r.failBuild(buildReq, errcode.Builder, "Builder job failed after %d attempts: %s: %s", job.Status.Failed, cond.Reason, cond.Message)
+		return nil, nil
+	}
+
+	pod, err := r.currentJobPod(ctx, &job)
+	if err != nil || pod == nil {
+		return nil, err
+	}
+	if pod.Name != buildReq.Status.PodName {
+		if buildReq.Status.PodName != "" {
+			r.warningEvent(buildReq, EventPodRetried, "Builder job replaced pod %s with %s", buildReq.Status.PodName, pod.Name)
+		}
+		buildReq.Status.PodName = pod.Name
+		buildReq.Status.PodScheduledTime = nil
+		buildReq.Status.PodReadyTime = nil
+	}
+	return pod, nil
+}
+
+// builderJobEnded reports why a running build request's Job stopped
+// running its builder, if it has
+func (r *NixBuildRequestReconciler) builderJobEnded(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (string, bool, error) {
+	var job batchv1.Job
+	if err := r.Get(ctx, client.ObjectKey{Namespace: builderNamespace(buildReq), Name: buildReq.Status.JobName}, &job); err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			return "Builder job was deleted unexpectedly", true, nil
+		}
+		return "", false, err
+	}
+	if cond, failed := jobCondition(&job, batchv1.JobFailed); failed {
+		return fmt.Sprintf("Builder job failed: %s: %s", cond.Reason, cond.Message), true, nil
+	}
+	if _, complete := jobCondition(&job, batchv1.JobComplete); complete {
+		return "Builder job completed while the session was running", true, nil
+	}
+	return "", false, nil
+}
+
+// deleteBuilderJob deletes a build request's Job along with its pods
+func (r *NixBuildRequestReconciler) deleteBuilderJob(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) error {
+	job := &batchv1.Job{}
+	job.Namespace = builderNamespace(buildReq)
+	job.Name = buildReq.Status.JobName
+	if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to delete builder job: %w", err)
+	}
+	return nil
+}
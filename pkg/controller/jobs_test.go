@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestBuilderJobReplacesFailedPods(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, buildReq)
+	r.BuilderJobs = true
+	r.BuilderJobBackoffLimit = 2
+	ctx := context.Background()
+
+	_, got := reconcileOnce(t, r)
+	if got.Status.JobName != "nix-builder-abc" || got.Status.PodName != "" {
+		t.Fatalf("jobName = %q, podName = %q, want the job and no pod yet", got.Status.JobName, got.Status.PodName)
+	}
+	var job batchv1.Job
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "nix-builder-abc"}, &job); err != nil {
+		t.Fatalf("builder job not created: %v", err)
+	}
+	if *job.Spec.BackoffLimit != 2 || job.Spec.Template.Annotations[SessionIDAnnotation] != "abc" {
+		t.Errorf("job backoffLimit = %d, template annotations = %v", *job.Spec.BackoffLimit, job.Spec.Template.Annotations)
+	}
+
+	jobPod := func(name string, created time.Time, phase corev1.PodPhase) {
+		t.Helper()
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "default",
+				Labels:            map[string]string{batchv1.JobNameLabel: job.Name},
+				CreationTimestamp: metav1.NewTime(created),
+			},
+			Status: corev1.PodStatus{Phase: phase},
+		}
+		if err := r.Create(ctx, pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jobPod("nix-builder-abc-first", testEpoch, corev1.PodFailed)
+	jobPod("nix-builder-abc-second", testEpoch.Add(time.Minute), corev1.PodPending)
+
+	_, got = reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseCreating || got.Status.PodName != "nix-builder-abc-second" {
+		t.Fatalf("phase = %q, podName = %q, want Creating on the replacement pod", got.Status.Phase, got.Status.PodName)
+	}
+
+	job.Status.Failed = 3
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded", Message: "Job has reached the specified backoff limit"}}
+	if err := r.Status().Update(ctx, &job); err != nil {
+		t.Fatal(err)
+	}
+	_, got = reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed || !strings.Contains(got.Status.Message, "BackoffLimitExceeded") {
+		t.Errorf("phase = %q, message = %q, want Failed on the job's condition", got.Status.Phase, got.Status.Message)
+	}
+}
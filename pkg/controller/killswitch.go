@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// Keys of the ConfigMap holding the provisioning switch
+const (
+	ProvisioningDisabledKey = "disabled"
+	ProvisioningReasonKey   = "reason"
+	ProvisioningSinceKey    = "since"
+)
+
+// ProvisioningState is whether the controller provisions builders for new
+// build requests
+type ProvisioningState struct {
+	Disabled bool       `json:"disabled"`
+	Reason   string     `json:"reason,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+// ProvisioningSwitch is the controller-wide kill switch for provisioning
+// builders. While it is off, build requests that do not have a builder yet
+// fail instead of creating or claiming one; running builds are left alone.
+// The state lives in a ConfigMap read through the manager's cache, so every
+// replica follows it and it survives restarts and leader failover. A
+// missing ConfigMap means provisioning is on.
+type ProvisioningSwitch struct {
+	Client    client.Client
+	ConfigMap client.ObjectKey
+
+	// DryRun logs the state the switch would be set to without writing
+	// the ConfigMap
+	DryRun bool
+}
+
+// Disable stops provisioning builders, recording reason for the failures
+func (s *ProvisioningSwitch) Disable(ctx context.Context, reason string) error {
+	_, err := s.set(ctx, true, reason)
+	return err
+}
+
+// Enable resumes provisioning builders
+func (s *ProvisioningSwitch) Enable(ctx context.Context) error {
+	_, err := s.set(ctx, false, "")
+	return err
+}
+
+// State returns the switch's current state
+func (s *ProvisioningSwitch) State(ctx context.Context) (ProvisioningState, error) {
+	var configMap corev1.ConfigMap
+	err := s.Client.Get(ctx, s.ConfigMap, &configMap)
+	if apierrors.IsNotFound(err) {
+		return ProvisioningState{}, nil
+	}
+	if err != nil {
+		return ProvisioningState{}, fmt.Errorf("failed to get provisioning ConfigMap %s: %w", s.ConfigMap, err)
+	}
+	return provisioningState(&configMap), nil
+}
+
+// set writes the switch's ConfigMap, creating it if needed, and returns the
+// state written. Disabling an already disabled switch keeps when it was
+// first disabled. In dry-run mode nothing is written.
+func (s *ProvisioningSwitch) set(ctx context.Context, disabled bool, reason string) (ProvisioningState, error) {
+	var configMap corev1.ConfigMap
+	err := s.Client.Get(ctx, s.ConfigMap, &configMap)
+	exists := err == nil
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ProvisioningState{}, fmt.Errorf("failed to get provisioning ConfigMap %s: %w", s.ConfigMap, err)
+	}
+
+	since := configMap.Data[ProvisioningSinceKey]
+	if configMap.Data[ProvisioningDisabledKey] != "true" {
+		since = time.Now().UTC().Format(time.RFC3339)
+	}
+	configMap.Data = map[string]string{ProvisioningDisabledKey: "false"}
+	if disabled {
+		configMap.Data = map[string]string{
+			ProvisioningDisabledKey: "true",
+			ProvisioningReasonKey:   reason,
+			ProvisioningSinceKey:    since,
+		}
+	}
+
+	if s.DryRun {
+		log.Info().Str("configmap", s.ConfigMap.String()).Bool("disabled", disabled).Bool("dry_run", true).Msg("Would set provisioning switch")
+		return provisioningState(&configMap), nil
+	}
+	if exists {
+		if err := s.Client.Update(ctx, &configMap); err != nil {
+			return ProvisioningState{}, fmt.Errorf("failed to update provisioning ConfigMap %s: %w", s.ConfigMap, err)
+		}
+		return provisioningState(&configMap), nil
+	}
+	configMap.ObjectMeta = metav1.ObjectMeta{
+		Name:      s.ConfigMap.Name,
+		Namespace: s.ConfigMap.Namespace,
+		Labels:    map[string]string{ManagedByLabel: ManagedByValue},
+	}
+	if err := s.Client.Create(ctx, &configMap); err != nil {
+		return ProvisioningState{}, fmt.Errorf("failed to create provisioning ConfigMap %s: %w", s.ConfigMap, err)
+	}
+	return provisioningState(&configMap), nil
+}
+
+// provisioningState reads the switch's state from its ConfigMap
+func provisioningState(configMap *corev1.ConfigMap) ProvisioningState {
+	if configMap.Data[ProvisioningDisabledKey] != "true" {
+		return ProvisioningState{}
+	}
+	state := ProvisioningState{Disabled: true, Reason: configMap.Data[ProvisioningReasonKey]}
+	if since, err := time.Parse(time.RFC3339, configMap.Data[ProvisioningSinceKey]); err == nil {
+		state.Since = &since
+	}
+	return state
+}
+
+// ServeHTTP reports the switch's state on GET and sets it from a
+// ProvisioningState body on PUT. It is served on the admin listener.
+func (s *ProvisioningSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var state ProvisioningState
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		state, err = s.State(r.Context())
+	case http.MethodPut:
+		var body ProvisioningState
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("invalid provisioning state: %v", err), http.StatusBadRequest)
+			return
+		}
+		if state, err = s.set(r.Context(), body.Disabled, body.Reason); err == nil {
+			if state.Disabled {
+				log.Warn().Str("reason", state.Reason).Str("remote_addr", r.RemoteAddr).Msg("Builder provisioning disabled")
+			} else {
+				log.Info().Str("remote_addr", r.RemoteAddr).Msg("Builder provisioning enabled")
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		log.Error().Err(err).Msg("Failed to encode provisioning state")
+	}
+}
+
+// provisioningDisabled reports why builders may not be provisioned for a
+// build request: the controller's kill switch, or a BuilderQuota disabling
+// its namespace
+func (r *NixBuildRequestReconciler) provisioningDisabled(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (string, bool, error) {
+	if r.Provisioning != nil {
+		state, err := r.Provisioning.State(ctx)
+		if err != nil {
+			return "", false, err
+		}
+		if state.Disabled {
+			return disabledMessage("Builder provisioning is disabled", state.Reason), true, nil
+		}
+	}
+
+	var quotas nixv1alpha1.BuilderQuotaList
+	if err := r.List(ctx, &quotas, client.InNamespace(buildReq.Namespace)); err != nil {
+		if meta.IsNoMatchError(err) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to list builder quotas: %w", err)
+	}
+	for _, quota := range quotas.Items {
+		if quota.Spec.Disabled {
+			message := fmt.Sprintf("Builder provisioning is disabled in namespace %s by BuilderQuota %s", buildReq.Namespace, quota.Name)
+			return disabledMessage(message, quota.Spec.DisabledReason), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func disabledMessage(message, reason string) string {
+	if reason == "" {
+		return message
+	}
+	return message + ": " + reason
+}
@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestProvisioningSwitchFailsNewBuilds(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseQueued)
+	buildReq.Status.PodName = ""
+	quota := &nixv1alpha1.BuilderQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "ci", Namespace: "default"},
+		Spec:       nixv1alpha1.BuilderQuotaSpec{MaxRunning: 5, Disabled: true, DisabledReason: "flood"},
+	}
+	r, _ := newTestReconciler(t, buildReq, quota)
+	key := client.ObjectKey{Namespace: "nix-system", Name: "nix-builder-provisioning"}
+	r.Provisioning = &ProvisioningSwitch{Client: r.Client, ConfigMap: key}
+
+	req := httptest.NewRequest(http.MethodPut, "/provisioning", strings.NewReader(`{"disabled": true, "reason": "INC-1"}`))
+	rec := httptest.NewRecorder()
+	r.Provisioning.ServeHTTP(rec, req)
+	var state ProvisioningState
+	if err := json.NewDecoder(rec.Body).Decode(&state); err != nil || !state.Disabled || state.Since == nil {
+		t.Fatalf("PUT /provisioning = %d %+v (%v), want it disabled", rec.Code, state, err)
+	}
+
+	// The state is kept in the ConfigMap, so a restarted or newly elected
+	// controller follows it
+	restarted := &ProvisioningSwitch{Client: r.Client, ConfigMap: key}
+	if state, err := restarted.State(context.Background()); err != nil || !state.Disabled || state.Reason != "INC-1" {
+		t.Fatalf("state after restart = %+v (%v), want disabled for INC-1", state, err)
+	}
+
+	_, got := reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed || got.Status.Message != "E_DISABLED: Builder provisioning is disabled: INC-1" {
+		t.Fatalf("phase = %q, message = %q, want Failed by the kill switch", got.Status.Phase, got.Status.Message)
+	}
+
+	// The namespace's quota still disables it once the switch is back on
+	if err := r.Provisioning.Enable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got.Status.Phase = nixv1alpha1.BuildPhasePending
+	if err := r.Status().Update(context.Background(), got); err != nil {
+		t.Fatal(err)
+	}
+	_, got = reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed || !strings.Contains(got.Status.Message, "by BuilderQuota ci: flood") {
+		t.Errorf("phase = %q, message = %q, want Failed by the namespace's quota", got.Status.Phase, got.Status.Message)
+	}
+	var pods corev1.PodList
+	if err := r.List(context.Background(), &pods); err != nil || len(pods.Items) != 0 {
+		t.Errorf("created %d builder pods while provisioning was disabled (%v)", len(pods.Items), err)
+	}
+}
+
+func TestProvisioningSwitchBlocksNewBuilderPods(t *testing.T) {
+	blocked := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	blocked.Status.PodName = ""
+	r, _ := newTestReconciler(t, blocked)
+	r.Provisioning = &ProvisioningSwitch{Client: r.Client, ConfigMap: client.ObjectKey{Namespace: "nix-system", Name: "nix-builder-provisioning"}}
+	if err := r.Provisioning.Disable(context.Background(), "INC-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, got := reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want Failed while provisioning is disabled", got.Status.Phase)
+	}
+	var pods corev1.PodList
+	if err := r.List(context.Background(), &pods); err != nil || len(pods.Items) != 0 {
+		t.Fatalf("created %d builder pods while provisioning was disabled (%v)", len(pods.Items), err)
+	}
+
+	if err := r.Provisioning.Enable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	allowed := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	allowed.Name = "build-def"
+	allowed.Spec.SessionID = "def"
+	allowed.Status.PodName = ""
+	if err := r.Create(context.Background(), allowed); err != nil {
+		t.Fatal(err)
+	}
+	key := client.ObjectKeyFromObject(allowed)
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(context.Background(), key, allowed); err != nil {
+		t.Fatal(err)
+	}
+	if allowed.Status.Phase != nixv1alpha1.BuildPhaseCreating {
+		t.Fatalf("phase = %q, want Creating once provisioning is enabled", allowed.Status.Phase)
+	}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "nix-builder-def"}, &corev1.Pod{}); err != nil {
+		t.Errorf("builder pod after provisioning was enabled: %v", err)
+	}
+}
+
+func TestProvisioningSwitchDryRun(t *testing.T) {
+	r, _ := newTestReconciler(t)
+	key := client.ObjectKey{Namespace: "nix-system", Name: "nix-builder-provisioning"}
+	s := &ProvisioningSwitch{Client: r.Client, ConfigMap: key, DryRun: true}
+
+	if err := s.Disable(context.Background(), "INC-3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(context.Background(), key, &corev1.ConfigMap{}); !apierrors.IsNotFound(err) {
+		t.Errorf("provisioning ConfigMap after a dry run: %v, want none", err)
+	}
+}
@@ -0,0 +1,250 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+// leaseResyncInterval bounds how long a lease goes without being checked
+// for idleness, since activity is only recorded in an annotation
+const leaseResyncInterval = time.Minute
+
+// BuilderLeaseReconciler keeps a builder running for each active
+// BuilderLease by owning a NixBuildRequest that outlives individual sessions,
+// and reclaims it once the lease expires or sits idle
+type BuilderLeaseReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Clock is the time source for expiry checks. Defaults to the real
+	// clock; tests inject a fake one.
+	Clock clock.PassiveClock
+
+	// CleanupBakeInUntil keeps expired and idle leases' builders running
+	// until this time. The leases are flagged with WouldDeleteAnnotation
+	// instead and reclaimed once the bake-in ends.
+	CleanupBakeInUntil time.Time
+
+	// DryRun records in each lease's status the build request it would
+	// create or delete without creating or deleting it
+	DryRun bool
+}
+
+// Reconcile handles BuilderLease events
+func (r *BuilderLeaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var lease nixv1alpha1.BuilderLease
+	if err := r.Get(ctx, req.NamespacedName, &lease); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !lease.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	switch lease.Status.Phase {
+	case nixv1alpha1.LeasePhaseExpired, nixv1alpha1.LeasePhaseFailed:
+		return ctrl.Result{}, nil
+	}
+
+	now := r.now()
+	if lastActivity := leaseLastActivity(&lease); lastActivity != nil {
+		lease.Status.LastActivity = lastActivity
+	}
+
+	reclaimReason := ""
+	idleDeadline, hasIdleTimeout := leaseIdleDeadline(&lease)
+	if !now.Time.Before(lease.Spec.ExpiresAt.Time) {
+		reclaimReason = "Lease expired"
+	} else if hasIdleTimeout && !now.Time.Before(idleDeadline) {
+		reclaimReason = fmt.Sprintf("Lease idle for %ds", *lease.Spec.IdleTimeoutSeconds)
+	}
+	if reclaimReason != "" {
+		if !now.Time.Before(r.CleanupBakeInUntil) {
+			return r.reclaim(ctx, &lease, reclaimReason)
+		}
+		if err := holdDeletion(ctx, r.Client, &lease, reclaimReason, r.CleanupBakeInUntil); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	buildReq, err := r.ensureBuildRequest(ctx, &lease)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if buildReq == nil {
+		lease.Status.Phase = nixv1alpha1.LeasePhasePending
+		lease.Status.Message = fmt.Sprintf("Dry run: Would create build request %s", nixv1alpha1.LeaseBuildRequestName(lease.Name))
+		return ctrl.Result{RequeueAfter: leaseResyncInterval}, r.Status().Update(ctx, &lease)
+	}
+
+	lease.Status.BuildRequest = buildReq.Name
+	switch buildReq.Status.Phase {
+	case nixv1alpha1.BuildPhaseRunning:
+		lease.Status.Phase = nixv1alpha1.LeasePhaseActive
+		lease.Status.PodName = buildReq.Status.PodName
+		lease.Status.PodIP = buildReq.Status.PodIP
+		lease.Status.Message = fmt.Sprintf("Builder %s is ready", buildReq.Status.PodName)
+	case nixv1alpha1.BuildPhaseFailed, nixv1alpha1.BuildPhaseCompleted:
+		lease.Status.Phase = nixv1alpha1.LeasePhaseFailed
+		lease.Status.PodIP = ""
+		lease.Status.Message = fmt.Sprintf("Builder failed: %s", buildReq.Status.Message)
+	case nixv1alpha1.BuildPhaseQueued:
+		lease.Status.Phase = nixv1alpha1.LeasePhasePending
+		lease.Status.Message = fmt.Sprintf("Waiting for a builder slot, position %d in queue", buildReq.Status.QueuePosition)
+	default:
+		lease.Status.Phase = nixv1alpha1.LeasePhasePending
+		lease.Status.Message = "Waiting for builder"
+	}
+
+	if err := r.Status().Update(ctx, &lease); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if reclaimReason != "" {
+		return ctrl.Result{RequeueAfter: min(r.CleanupBakeInUntil.Sub(now.Time), leaseResyncInterval)}, nil
+	}
+	requeueAfter := min(lease.Spec.ExpiresAt.Sub(now.Time), leaseResyncInterval)
+	if hasIdleTimeout {
+		requeueAfter = min(requeueAfter, idleDeadline.Sub(now.Time))
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// ensureBuildRequest returns the lease's NixBuildRequest, creating it if it
+// does not exist yet. In dry-run mode a missing request is not created and
+// nil is returned.
+func (r *BuilderLeaseReconciler) ensureBuildRequest(ctx context.Context, lease *nixv1alpha1.BuilderLease) (*nixv1alpha1.NixBuildRequest, error) {
+	name := nixv1alpha1.LeaseBuildRequestName(lease.Name)
+
+	var buildReq nixv1alpha1.NixBuildRequest
+	err := r.Get(ctx, client.ObjectKey{Namespace: lease.Namespace, Name: name}, &buildReq)
+	if err == nil {
+		return &buildReq, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get lease build request: %w", err)
+	}
+
+	buildReq = nixv1alpha1.NixBuildRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: lease.Namespace,
+			Labels: map[string]string{
+				nixv1alpha1.ProxyLabel: nixv1alpha1.ProxyLabelShared,
+			},
+			Annotations: map[string]string{
+				policy.RequesterAnnotation: lease.Spec.Owner,
+			},
+			OwnerReferences: []metav1.OwnerReference{leaseOwnerReference(lease)},
+		},
+		Spec: nixv1alpha1.NixBuildRequestSpec{
+			SessionID:            name,
+			System:               lease.Spec.System,
+			Image:                lease.Spec.Image,
+			Resources:            lease.Spec.Resources,
+			NodeSelector:         lease.Spec.NodeSelector,
+			ExperimentalFeatures: lease.Spec.ExperimentalFeatures,
+			NixConfig:            lease.Spec.NixConfig,
+		},
+	}
+	if r.DryRun {
+		log.Info().Str("lease", lease.Name).Str("owner", lease.Spec.Owner).Bool("dry_run", true).Msg("Would provision builder for lease")
+		return nil, nil
+	}
+	if err := r.Create(ctx, &buildReq); err != nil {
+		return nil, fmt.Errorf("failed to create lease build request: %w", err)
+	}
+
+	log.Info().Str("lease", lease.Name).Str("owner", lease.Spec.Owner).Msg("Provisioning builder for lease")
+	return &buildReq, nil
+}
+
+// reclaim deletes the lease's builder and marks the lease expired. In
+// dry-run mode it only records the deletion in the lease's status.
+func (r *BuilderLeaseReconciler) reclaim(ctx context.Context, lease *nixv1alpha1.BuilderLease, reason string) (ctrl.Result, error) {
+	buildReq := &nixv1alpha1.NixBuildRequest{ObjectMeta: metav1.ObjectMeta{
+		Namespace: lease.Namespace,
+		Name:      nixv1alpha1.LeaseBuildRequestName(lease.Name),
+	}}
+	if r.DryRun {
+		log.Info().Str("lease", lease.Name).Str("reason", reason).Bool("dry_run", true).Msg("Would reclaim leased builder")
+		lease.Status.Message = fmt.Sprintf("Dry run: Would delete build request %s: %s", buildReq.Name, reason)
+		return ctrl.Result{RequeueAfter: leaseResyncInterval}, r.Status().Update(ctx, lease)
+	}
+	if err := r.Delete(ctx, buildReq); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to delete lease build request: %w", err)
+	}
+
+	log.Info().Str("lease", lease.Name).Str("reason", reason).Msg("Reclaimed leased builder")
+	lease.Status.Phase = nixv1alpha1.LeasePhaseExpired
+	lease.Status.PodIP = ""
+	lease.Status.Message = reason
+	return ctrl.Result{}, r.Status().Update(ctx, lease)
+}
+
+// leaseLastActivity returns the latest activity recorded by the proxy
+func leaseLastActivity(lease *nixv1alpha1.BuilderLease) *metav1.Time {
+	value, ok := lease.Annotations[nixv1alpha1.LeaseActivityAnnotation]
+	if !ok {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Warn().Err(err).Str("lease", lease.Name).Msg("Ignoring malformed lease activity annotation")
+		return nil
+	}
+	return &metav1.Time{Time: t}
+}
+
+// leaseIdleDeadline returns when an idle lease is reclaimed, counting from
+// its last activity or its creation
+func leaseIdleDeadline(lease *nixv1alpha1.BuilderLease) (time.Time, bool) {
+	if lease.Spec.IdleTimeoutSeconds == nil {
+		return time.Time{}, false
+	}
+	since := lease.CreationTimestamp.Time
+	if lease.Status.LastActivity != nil && lease.Status.LastActivity.After(since) {
+		since = lease.Status.LastActivity.Time
+	}
+	return since.Add(time.Duration(*lease.Spec.IdleTimeoutSeconds) * time.Second), true
+}
+
+// leaseOwnerReference makes a lease the controlling owner of its build
+// request so the builder is garbage collected with the lease
+func leaseOwnerReference(lease *nixv1alpha1.BuilderLease) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion:         nixv1alpha1.GroupVersion.String(),
+		Kind:               "BuilderLease",
+		Name:               lease.Name,
+		UID:                lease.UID,
+		Controller:         &[]bool{true}[0],
+		BlockOwnerDeletion: &[]bool{true}[0],
+	}
+}
+
+// now returns the current time from the reconciler's clock
+func (r *BuilderLeaseReconciler) now() *metav1.Time {
+	if r.Clock == nil {
+		return &metav1.Time{Time: time.Now()}
+	}
+	return &metav1.Time{Time: r.Clock.Now()}
+}
+
+// SetupWithManager sets up the lease controller with the Manager
+func (r *BuilderLeaseReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&nixv1alpha1.BuilderLease{}).
+		Owns(&nixv1alpha1.NixBuildRequest{}).
+		Complete(r)
+}
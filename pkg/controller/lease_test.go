@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+func newLease(expiresAt time.Time) *nixv1alpha1.BuilderLease {
+	return &nixv1alpha1.BuilderLease{
+		ObjectMeta: metav1.ObjectMeta{Name: "dev", Namespace: "default", UID: "lease-uid"},
+		Spec: nixv1alpha1.BuilderLeaseSpec{
+			Owner:     "alice",
+			ExpiresAt: metav1.NewTime(expiresAt),
+			System:    "aarch64-linux",
+		},
+	}
+}
+
+func reconcileLease(t *testing.T, r *BuilderLeaseReconciler) *nixv1alpha1.BuilderLease {
+	t.Helper()
+
+	key := client.ObjectKey{Namespace: "default", Name: "dev"}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Reconcile returned error: %v", err)
+	}
+
+	var lease nixv1alpha1.BuilderLease
+	if err := r.Get(context.Background(), key, &lease); err != nil {
+		t.Fatalf("failed to get lease: %v", err)
+	}
+	return &lease
+}
+
+func TestReconcileLeaseCreatesBuildRequest(t *testing.T) {
+	nr, clk := newTestReconciler(t, newLease(testEpoch.Add(time.Hour)))
+	r := &BuilderLeaseReconciler{Client: nr.Client, Scheme: nr.Scheme, Clock: clk}
+
+	lease := reconcileLease(t, r)
+
+	if lease.Status.Phase != nixv1alpha1.LeasePhasePending {
+		t.Fatalf("phase = %q, want %q", lease.Status.Phase, nixv1alpha1.LeasePhasePending)
+	}
+	var buildReq nixv1alpha1.NixBuildRequest
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "lease-dev"}, &buildReq); err != nil {
+		t.Fatal(err)
+	}
+	if buildReq.Annotations[policy.RequesterAnnotation] != "alice" {
+		t.Errorf("requester = %q, want %q", buildReq.Annotations[policy.RequesterAnnotation], "alice")
+	}
+	if buildReq.Spec.System != "aarch64-linux" {
+		t.Errorf("system = %q, want %q", buildReq.Spec.System, "aarch64-linux")
+	}
+	if len(buildReq.OwnerReferences) != 1 || buildReq.OwnerReferences[0].Kind != "BuilderLease" {
+		t.Errorf("ownerReferences = %+v, want the lease", buildReq.OwnerReferences)
+	}
+	if buildReq.Labels[nixv1alpha1.ProxyLabel] != nixv1alpha1.ProxyLabelShared {
+		t.Errorf("%s label = %q, want %q so every proxy serves it", nixv1alpha1.ProxyLabel, buildReq.Labels[nixv1alpha1.ProxyLabel], nixv1alpha1.ProxyLabelShared)
+	}
+}
+
+func TestReconcileLeaseReclaimsIdleBuilder(t *testing.T) {
+	lease := newLease(testEpoch.Add(8 * time.Hour))
+	lease.CreationTimestamp = metav1.NewTime(testEpoch)
+	idle := int64(3600)
+	lease.Spec.IdleTimeoutSeconds = &idle
+	lease.Annotations = map[string]string{nixv1alpha1.LeaseActivityAnnotation: testEpoch.Add(time.Hour).Format(time.RFC3339)}
+	buildReq := &nixv1alpha1.NixBuildRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "lease-dev", Namespace: "default"},
+		Spec:       nixv1alpha1.NixBuildRequestSpec{SessionID: "lease-dev"},
+		Status:     nixv1alpha1.NixBuildRequestStatus{Phase: nixv1alpha1.BuildPhaseRunning, PodName: "nix-builder-lease-dev"},
+	}
+	nr, clk := newTestReconciler(t, lease, buildReq)
+	r := &BuilderLeaseReconciler{Client: nr.Client, Scheme: nr.Scheme, Clock: clk}
+
+	clk.SetTime(testEpoch.Add(90 * time.Minute))
+	if got := reconcileLease(t, r); got.Status.Phase != nixv1alpha1.LeasePhaseActive {
+		t.Fatalf("phase = %q, want %q while recently used", got.Status.Phase, nixv1alpha1.LeasePhaseActive)
+	}
+
+	clk.SetTime(testEpoch.Add(2*time.Hour + time.Second))
+	if got := reconcileLease(t, r); got.Status.Phase != nixv1alpha1.LeasePhaseExpired {
+		t.Fatalf("phase = %q, want %q once idle", got.Status.Phase, nixv1alpha1.LeasePhaseExpired)
+	}
+	err := r.Get(context.Background(), client.ObjectKeyFromObject(buildReq), &nixv1alpha1.NixBuildRequest{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("lease build request still exists: %v", err)
+	}
+}
+
+func TestReconcileLeaseHoldsReclaimDuringBakeIn(t *testing.T) {
+	lease := newLease(testEpoch.Add(time.Hour))
+	buildReq := &nixv1alpha1.NixBuildRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "lease-dev", Namespace: "default"},
+		Spec:       nixv1alpha1.NixBuildRequestSpec{SessionID: "lease-dev"},
+		Status:     nixv1alpha1.NixBuildRequestStatus{Phase: nixv1alpha1.BuildPhaseRunning, PodName: "nix-builder-lease-dev"},
+	}
+	nr, clk := newTestReconciler(t, lease, buildReq)
+	r := &BuilderLeaseReconciler{Client: nr.Client, Scheme: nr.Scheme, Clock: clk, CleanupBakeInUntil: testEpoch.Add(3 * time.Hour)}
+
+	clk.SetTime(testEpoch.Add(2 * time.Hour))
+	got := reconcileLease(t, r)
+	if got.Status.Phase != nixv1alpha1.LeasePhaseActive {
+		t.Fatalf("phase = %q, want %q during the bake-in", got.Status.Phase, nixv1alpha1.LeasePhaseActive)
+	}
+	if reason := got.Annotations[WouldDeleteAnnotation]; reason != "Lease expired" {
+		t.Errorf("%s = %q, want %q", WouldDeleteAnnotation, reason, "Lease expired")
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(buildReq), &nixv1alpha1.NixBuildRequest{}); err != nil {
+		t.Fatalf("lease build request deleted during the bake-in: %v", err)
+	}
+
+	clk.SetTime(testEpoch.Add(3 * time.Hour))
+	if got := reconcileLease(t, r); got.Status.Phase != nixv1alpha1.LeasePhaseExpired {
+		t.Fatalf("phase = %q, want %q after the bake-in", got.Status.Phase, nixv1alpha1.LeasePhaseExpired)
+	}
+	err := r.Get(context.Background(), client.ObjectKeyFromObject(buildReq), &nixv1alpha1.NixBuildRequest{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("lease build request still exists: %v", err)
+	}
+}
+
+func TestReconcileLeaseDryRun(t *testing.T) {
+	nr, clk := newTestReconciler(t, newLease(testEpoch.Add(time.Hour)))
+	r := &BuilderLeaseReconciler{Client: nr.Client, Scheme: nr.Scheme, Clock: clk, DryRun: true}
+
+	lease := reconcileLease(t, r)
+
+	if lease.Status.Phase != nixv1alpha1.LeasePhasePending || lease.Status.Message != "Dry run: Would create build request lease-dev" {
+		t.Errorf("phase = %q, message = %q, want Pending with the build request it would create", lease.Status.Phase, lease.Status.Message)
+	}
+	key := client.ObjectKey{Namespace: "default", Name: "lease-dev"}
+	if err := r.Get(context.Background(), key, &nixv1alpha1.NixBuildRequest{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("build request after a dry run: %v, want none", err)
+	}
+
+	buildReq := &nixv1alpha1.NixBuildRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "lease-dev", Namespace: "default"},
+		Spec:       nixv1alpha1.NixBuildRequestSpec{SessionID: "lease-dev"},
+	}
+	if err := r.Create(context.Background(), buildReq); err != nil {
+		t.Fatal(err)
+	}
+	clk.Step(2 * time.Hour)
+	lease = reconcileLease(t, r)
+
+	if lease.Status.Phase == nixv1alpha1.LeasePhaseExpired || lease.Status.Message != "Dry run: Would delete build request lease-dev: Lease expired" {
+		t.Errorf("phase = %q, message = %q, want the deletion recorded without expiring the lease", lease.Status.Phase, lease.Status.Message)
+	}
+	if err := r.Get(context.Background(), key, &nixv1alpha1.NixBuildRequest{}); err != nil {
+		t.Errorf("build request after a dry-run reclaim: %v, want it kept", err)
+	}
+}
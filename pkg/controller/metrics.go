@@ -0,0 +1,270 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apimetrics"
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+// APIMetricsPrefix starts the names of the controller's Kubernetes API
+// metrics
+const APIMetricsPrefix = "nix_controller"
+
+// overflowLabelValue replaces label values once a label has reached its
+// cardinality limit
+const overflowLabelValue = "other"
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// BuildMetrics records Prometheus metrics for build requests. A configurable
+// set of build request labels, or annotations such as the CI context, is
+// propagated as metric label dimensions, with each dimension capped at a
+// maximum number of distinct values.
+type BuildMetrics struct {
+	labelKeys  []string
+	labelNames []string
+	maxValues  int
+
+	mu   sync.Mutex
+	seen []map[string]struct{}
+
+	completed *prometheus.CounterVec
+	failures  *prometheus.CounterVec
+	duration  *prometheus.HistogramVec
+	coldStart *prometheus.HistogramVec
+	poolClaim *prometheus.CounterVec
+
+	poolClaimConflicts *prometheus.CounterVec
+	poolClaimDuration  *prometheus.HistogramVec
+
+	storeAddedPaths *prometheus.HistogramVec
+	storeAddedBytes *prometheus.HistogramVec
+}
+
+// NewBuildMetrics creates build metrics that propagate the given build
+// request label keys. maxValues bounds the distinct values tracked per label,
+// with zero meaning unbounded.
+func NewBuildMetrics(labelKeys []string, maxValues int) (*BuildMetrics, error) {
+	m := &BuildMetrics{
+		labelKeys: labelKeys,
+		maxValues: maxValues,
+		seen:      make([]map[string]struct{}, len(labelKeys)),
+	}
+	names := map[string]bool{"phase": true}
+	for i, key := range labelKeys {
+		name := metricLabelName(key)
+		if name == "" || names[name] {
+			return nil, fmt.Errorf("label %q maps to invalid or duplicate metric label %q", key, name)
+		}
+		names[name] = true
+		m.labelNames = append(m.labelNames, name)
+		m.seen[i] = make(map[string]struct{})
+	}
+
+	m.completed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nix_build_requests_completed_total",
+		Help: "Number of build requests that finished, by final phase",
+	}, append([]string{"phase"}, m.labelNames...))
+	m.failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nix_build_request_failures_total",
+		Help: "Number of build requests that failed, by error code",
+	}, []string{"code"})
+	m.duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nix_build_request_duration_seconds",
+		Help:    "Time from build request start to completion, by final phase",
+		Buckets: prometheus.ExponentialBuckets(10, 2, 12),
+	}, append([]string{"phase"}, m.labelNames...))
+	m.coldStart = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nix_build_cold_start_seconds",
+		Help:    "Time from build request start until the builder accepted SSH connections",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, m.labelNames)
+	m.poolClaim = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nix_builder_pool_claims_total",
+		Help: "Attempts to assign a warm pooled builder pod, by pool variant and result (hit or miss)",
+	}, []string{"variant", "result"})
+
+	m.poolClaimConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nix_builder_pool_claim_conflicts_total",
+		Help: "Pooled builder pods lost to a concurrent claim, by pool variant",
+	}, []string{"variant"})
+	m.poolClaimDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nix_builder_pool_claim_duration_seconds",
+		Help:    "Time taken to claim a pooled builder pod, by pool variant and result",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 10),
+	}, []string{"variant", "result"})
+	m.storeAddedPaths = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nix_builder_store_added_paths",
+		Help:    "Store paths a session added to its builder's persistent store",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	}, m.labelNames)
+	m.storeAddedBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nix_builder_store_added_bytes",
+		Help:    "NAR size of the store paths a session added to its builder's persistent store",
+		Buckets: prometheus.ExponentialBuckets(1<<20, 4, 10),
+	}, m.labelNames)
+
+	return m, nil
+}
+
+// Register adds the build metrics to the given registerer
+func (m *BuildMetrics) Register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{m.completed, m.failures, m.duration, m.coldStart, m.poolClaim, m.poolClaimConflicts, m.poolClaimDuration, m.storeAddedPaths, m.storeAddedBytes} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterExportMetrics registers a set of build metrics holding one series
+// of each metric, so that their names, types and labels can be gathered to
+// generate dashboards and alerts
+func RegisterExportMetrics(reg prometheus.Registerer) error {
+	m, err := NewBuildMetrics(nil, 0)
+	if err != nil {
+		return err
+	}
+	if err := m.Register(reg); err != nil {
+		return err
+	}
+
+	start := metav1.Now()
+	buildReq := &nixv1alpha1.NixBuildRequest{Status: nixv1alpha1.NixBuildRequestStatus{
+		Phase:          nixv1alpha1.BuildPhaseFailed,
+		Message:        errcode.Message(errcode.Internal, "export"),
+		StartTime:      &start,
+		SSHReadyTime:   &start,
+		CompletionTime: &start,
+		StoreDiff:      &nixv1alpha1.StoreDiff{},
+	}}
+	m.ObserveReady(buildReq)
+	m.ObserveStoreDiff(buildReq)
+	m.ObserveCompletion(buildReq)
+	m.ObservePoolClaim(DefaultPoolVariant, true, 0)
+	m.ObservePoolClaimConflict(DefaultPoolVariant)
+
+	capacity := newCapacityCollector(func(context.Context) (*StatusSummary, error) {
+		return &StatusSummary{
+			Phases:   map[nixv1alpha1.BuildPhase]int{},
+			Pool:     []PoolSummary{{Variant: DefaultPoolVariant}},
+			Capacity: CapacitySummary{MaxRunning: 1},
+		}, nil
+	})
+	if err := reg.Register(capacity); err != nil {
+		return err
+	}
+	return apimetrics.New(APIMetricsPrefix).RegisterExport(reg)
+}
+
+// ObserveReady records the cold start latency of a build request that has
+// just become ready for connections
+func (m *BuildMetrics) ObserveReady(buildReq *nixv1alpha1.NixBuildRequest) {
+	if m == nil || buildReq.Status.StartTime == nil || buildReq.Status.SSHReadyTime == nil {
+		return
+	}
+	latency := buildReq.Status.SSHReadyTime.Sub(buildReq.Status.StartTime.Time)
+	m.coldStart.WithLabelValues(m.labelValues(buildReq)...).Observe(latency.Seconds())
+}
+
+// ObserveStoreDiff records what a session added to its builder's persistent
+// store
+func (m *BuildMetrics) ObserveStoreDiff(buildReq *nixv1alpha1.NixBuildRequest) {
+	if m == nil || buildReq.Status.StoreDiff == nil {
+		return
+	}
+	values := m.labelValues(buildReq)
+	m.storeAddedPaths.WithLabelValues(values...).Observe(float64(buildReq.Status.StoreDiff.AddedPaths))
+	m.storeAddedBytes.WithLabelValues(values...).Observe(float64(buildReq.Status.StoreDiff.AddedBytes))
+}
+
+// ObservePoolClaim records whether a build request was served from the warm
+// pool and how long the claim took
+func (m *BuildMetrics) ObservePoolClaim(variant string, hit bool, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.poolClaim.WithLabelValues(variant, result).Inc()
+	m.poolClaimDuration.WithLabelValues(variant, result).Observe(duration.Seconds())
+}
+
+// ObservePoolClaimConflict records a pooled pod lost to a concurrent claim
+func (m *BuildMetrics) ObservePoolClaimConflict(variant string) {
+	if m == nil {
+		return
+	}
+	m.poolClaimConflicts.WithLabelValues(variant).Inc()
+}
+
+// ObserveCompletion records the outcome and duration of a finished build
+// request
+func (m *BuildMetrics) ObserveCompletion(buildReq *nixv1alpha1.NixBuildRequest) {
+	if m == nil {
+		return
+	}
+	phase := string(buildReq.Status.Phase)
+	if phase == "" {
+		phase = string(nixv1alpha1.BuildPhasePending)
+	}
+	values := append([]string{phase}, m.labelValues(buildReq)...)
+
+	m.completed.WithLabelValues(values...).Inc()
+	if buildReq.Status.Phase == nixv1alpha1.BuildPhaseFailed {
+		code, _ := errcode.Parse(buildReq.Status.Message)
+		if code == "" {
+			code = errcode.Internal
+		}
+		m.failures.WithLabelValues(string(code)).Inc()
+	}
+	if buildReq.Status.StartTime != nil && buildReq.Status.CompletionTime != nil {
+		duration := buildReq.Status.CompletionTime.Sub(buildReq.Status.StartTime.Time)
+		m.duration.WithLabelValues(values...).Observe(duration.Seconds())
+	}
+}
+
+// labelValues returns the propagated label values for a build request,
+// folding values beyond the cardinality limit into overflowLabelValue
+func (m *BuildMetrics) labelValues(buildReq *nixv1alpha1.NixBuildRequest) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values := make([]string, len(m.labelKeys))
+	for i, key := range m.labelKeys {
+		value, ok := buildReq.Labels[key]
+		if !ok {
+			value = buildReq.Annotations[key]
+		}
+		if _, ok := m.seen[i][value]; !ok {
+			if m.maxValues > 0 && len(m.seen[i]) >= m.maxValues {
+				value = overflowLabelValue
+			} else {
+				m.seen[i][value] = struct{}{}
+			}
+		}
+		values[i] = value
+	}
+	return values
+}
+
+// metricLabelName turns a Kubernetes label key such as nix.io/team into a
+// valid Prometheus label name
+func metricLabelName(key string) string {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		key = key[i+1:]
+	}
+	return invalidLabelChars.ReplaceAllString(key, "_")
+}
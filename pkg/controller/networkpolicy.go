@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+const (
+	// ComponentLabel names the component of the proxy and controller pods,
+	// which are the only pods allowed to reach isolated builders
+	ComponentLabel = "component"
+
+	// warmPoolNetworkPolicyName isolates idle pooled builder pods until a
+	// build request claims them
+	warmPoolNetworkPolicyName = "nix-builder-warm-pool"
+)
+
+// BuilderNetworkPolicy restricts the traffic of builder pods. Ingress is
+// limited to the proxy and controller on the builder's ports, and egress to
+// DNS and EgressCIDRs on EgressPorts.
+type BuilderNetworkPolicy struct {
+	// PeerNamespace holds the proxy and controller pods. Empty is the
+	// builder's own namespace.
+	PeerNamespace string
+	// EgressCIDRs are the networks builders may reach, such as those of
+	// their substituters. Builders can still resolve names through DNS.
+	EgressCIDRs []string
+	// EgressPorts are the ports builders may reach in EgressCIDRs
+	EgressPorts []int32
+}
+
+// builderNetworkPolicyName names the NetworkPolicy isolating a session's
+// builder
+func builderNetworkPolicyName(buildReq *nixv1alpha1.NixBuildRequest) string {
+	return "nix-builder-" + buildReq.Spec.SessionID
+}
+
+// ensureBuilderNetworkPolicy creates the NetworkPolicy isolating the builder
+// pods matched by selector
+func (r *NixBuildRequestReconciler) ensureBuilderNetworkPolicy(ctx context.Context, owner builderOwner, name string, selector map[string]string) error {
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: owner.objectMeta(name),
+		Spec:       r.builderNetworkPolicySpec(owner, selector),
+	}
+	if err := r.Create(ctx, policy); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create builder network policy: %w", err)
+	}
+	return nil
+}
+
+// builderNetworkPolicySpec returns the rules of a builder NetworkPolicy.
+// Builders in an isolated namespace get one even when NetworkPolicy is unset,
+// admitting peers from their build request's namespace unless another is set.
+func (r *NixBuildRequestReconciler) builderNetworkPolicySpec(owner builderOwner, selector map[string]string) networkingv1.NetworkPolicySpec {
+	var settings BuilderNetworkPolicy
+	if r.NetworkPolicy != nil {
+		settings = *r.NetworkPolicy
+	}
+	if settings.PeerNamespace == "" {
+		settings.PeerNamespace = owner.RequestNamespace
+	}
+
+	peer := networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      ComponentLabel,
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   []string{"proxy", "controller"},
+			}},
+		},
+	}
+	if ns := settings.PeerNamespace; ns != "" {
+		peer.NamespaceSelector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{corev1.LabelMetadataName: ns},
+		}
+	}
+
+	ingressPorts := []int32{r.RemotePort}
+	if r.BuilderTLSSecret != "" {
+		ingressPorts = append(ingressPorts, r.BuilderTLSPort)
+	}
+	if r.AgentPort != 0 {
+		ingressPorts = append(ingressPorts, r.AgentPort)
+	}
+
+	tcp, udp := corev1.ProtocolTCP, corev1.ProtocolUDP
+	dns := intstr.FromInt32(53)
+	egress := []networkingv1.NetworkPolicyEgressRule{{
+		Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dns}, {Protocol: &tcp, Port: &dns}},
+	}}
+	if len(settings.EgressCIDRs) > 0 {
+		rule := networkingv1.NetworkPolicyEgressRule{Ports: tcpPorts(settings.EgressPorts)}
+		for _, cidr := range settings.EgressCIDRs {
+			rule.To = append(rule.To, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+		}
+		egress = append(egress, rule)
+	}
+
+	return networkingv1.NetworkPolicySpec{
+		PodSelector: metav1.LabelSelector{MatchLabels: selector},
+		PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		Ingress: []networkingv1.NetworkPolicyIngressRule{{
+			From:  []networkingv1.NetworkPolicyPeer{peer},
+			Ports: tcpPorts(ingressPorts),
+		}},
+		Egress: egress,
+	}
+}
+
+func tcpPorts(ports []int32) []networkingv1.NetworkPolicyPort {
+	tcp := corev1.ProtocolTCP
+	out := make([]networkingv1.NetworkPolicyPort, 0, len(ports))
+	for _, port := range ports {
+		p := intstr.FromInt32(port)
+		out = append(out, networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &p})
+	}
+	return out
+}
+
+// deleteBuilderNetworkPolicy removes the NetworkPolicy of a finished
+// session's builder
+func (r *NixBuildRequestReconciler) deleteBuilderNetworkPolicy(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) error {
+	policy := &networkingv1.NetworkPolicy{}
+	policy.Namespace = builderNamespace(buildReq)
+	policy.Name = builderNetworkPolicyName(buildReq)
+	if err := r.Delete(ctx, policy); client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to delete builder network policy: %w", err)
+	}
+	log.Ctx(ctx).Debug().Msg("Deleted builder network policy")
+	return nil
+}
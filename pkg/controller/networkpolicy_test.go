@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestBuilderNetworkPolicyFollowsBuildRequest(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, buildReq)
+	r.AgentPort = 8081
+	r.NetworkPolicy = &BuilderNetworkPolicy{EgressCIDRs: []string{"10.20.0.0/16"}, EgressPorts: []int32{443}}
+
+	_, got := reconcileOnce(t, r)
+
+	key := client.ObjectKey{Namespace: "default", Name: "nix-builder-abc"}
+	var netpol networkingv1.NetworkPolicy
+	if err := r.Get(context.Background(), key, &netpol); err != nil {
+		t.Fatalf("network policy not created: %v", err)
+	}
+	if sel := netpol.Spec.PodSelector.MatchLabels["nix.io/session-id"]; sel != "abc" {
+		t.Errorf("pod selector session = %q, want abc", sel)
+	}
+	var ports []int32
+	for _, port := range netpol.Spec.Ingress[0].Ports {
+		ports = append(ports, port.Port.IntVal)
+	}
+	if !slices.Equal(ports, []int32{22, 8081}) {
+		t.Errorf("ingress ports = %v, want SSH and agent ports", ports)
+	}
+	if egress := netpol.Spec.Egress; len(egress) != 2 || egress[1].To[0].IPBlock.CIDR != "10.20.0.0/16" {
+		t.Errorf("egress = %+v, want DNS and 10.20.0.0/16", egress)
+	}
+
+	if err := r.Delete(context.Background(), got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(got)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(context.Background(), key, &netpol); !apierrors.IsNotFound(err) {
+		t.Errorf("network policy still present after cleanup: %v", err)
+	}
+}
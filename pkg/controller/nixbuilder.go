@@ -3,18 +3,49 @@ package controller
 import (
 	"context"
 	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/logging"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/notify"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/status"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/tracing"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/vault"
+)
+
+const (
+	// ManagedByLabel marks every resource the controller creates so that
+	// uninstall can find them
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ManagedByValue is the ManagedByLabel value for controller resources
+	ManagedByValue = "nix-remote-build-controller"
+
+	// BuildClassLabel marks builder pods of a non-default build class
+	BuildClassLabel = "nix.io/build-class"
 )
 
 // NixBuildRequestReconciler reconciles NixBuildRequest objects
@@ -25,6 +56,189 @@ type NixBuildRequestReconciler struct {
 	RemotePort   int32
 	NixConfigMap string
 	SSHKeySecret string
+	Metrics      *BuildMetrics
+
+	// BuilderResources are given to builders whose build request sets no
+	// resources of its own
+	BuilderResources corev1.ResourceRequirements
+
+	// applied holds the Settings given to ApplySettings, replacing
+	// BuilderImage, BuilderResources, Systems, SessionGracePeriod,
+	// MaxRunningBuilders and UserQuota once set
+	applied atomic.Pointer[Settings]
+
+	// BuilderTLSSecret names a CA secret used to issue certificates for an
+	// mTLS tunnel in front of each builder's sshd. Empty disables the tunnel.
+	BuilderTLSSecret string
+	BuilderTLSPort   int32
+
+	// AgentPort, when non-zero, runs the builder agent on this port so that
+	// non-SSH clients can import and export store paths for the session
+	AgentPort int32
+
+	// AllowedExperimentalFeatures limits the experimental features build
+	// requests may enable. Nil allows every feature Nix knows about.
+	AllowedExperimentalFeatures []string
+
+	// Systems maps Nix systems to the image and node selector of their
+	// builders. Common Linux systems not listed here are placed on nodes of
+	// the matching architecture.
+	Systems map[string]SystemBuilder
+
+	// SystemFeatures maps the Nix system features build requests may
+	// require to the nodes, tolerations and device resources providing
+	// them. Nil offers DefaultSystemFeatures.
+	SystemFeatures map[string]SystemFeature
+
+	// ManageBuilderUsers logs each session in to its builder as a user
+	// derived from the requester and makes that user the only one the
+	// builder's Nix daemon trusts
+	ManageBuilderUsers bool
+
+	// WarmPoolSize idle builder pods are kept running in WarmPoolNamespace
+	// and assigned to build requests that use the default builder
+	// configuration, falling back to creating a pod when the pool is empty
+	WarmPoolSize      int
+	WarmPoolNamespace string
+
+	// WarmPoolVariants keeps further flavors of idle builder pods warm, such
+	// as other systems or sizes, each matched to the requests it can serve
+	WarmPoolVariants []PoolVariant
+
+	// Vault, when set, is the source of the builder public key instead of
+	// SSHKeySecret, read from VaultKeyPath in Vault's KV store
+	Vault        *vault.Client
+	VaultKeyPath string
+
+	// Policy, when set, is consulted before a builder pod is provisioned.
+	// PolicyFailOpen allows builds when the policy cannot be evaluated.
+	Policy         policy.Checker
+	PolicyFailOpen bool
+
+	// DefaultStorage is the /nix storage for build requests that do not set
+	// their own
+	DefaultStorage nixv1alpha1.StorageSpec
+
+	// BestEffortPriorityClass is the PriorityClass given to best-effort
+	// builder pods. Best-effort build requests fail when it is empty.
+	BestEffortPriorityClass string
+
+	// Spot, when set, places builders on spot or preemptible nodes and
+	// replaces those lost with their node. Build requests asking for spot
+	// builders fail when it is nil.
+	Spot *SpotScheduling
+
+	// MaxRunningBuilders caps the build requests holding a builder at once
+	// across the cluster; further requests are queued. Zero is unlimited.
+	// BuilderQuota objects set the same limit per namespace.
+	MaxRunningBuilders int
+
+	// UserQuota caps the builders each user may hold at once across the
+	// cluster. Build requests over it fail rather than queue.
+	UserQuota UserQuota
+
+	// CachePush, when set, copies the outputs of builds to a binary cache
+	// from the builder as each one finishes
+	CachePush *CachePush
+
+	// Signing, when set, signs the outputs builders push to CachePush with
+	// a key held in Vault
+	Signing *Signing
+
+	// PodTemplate is merged into every builder pod to add scheduling,
+	// security and sidecar settings the controller does not manage
+	PodTemplate *corev1.PodTemplateSpec
+
+	// ValidateImages runs a validation pod for each builder image before
+	// its first build, checking for sshd, Nix, ImageSeedPaths and a working
+	// nix-store --serve. Pods are created in ImageValidationNamespace.
+	ValidateImages           bool
+	ImageSeedPaths           []string
+	ImageValidationNamespace string
+
+	// CleanupBakeInUntil holds back orphaned pod deletions until this time.
+	// They are logged and flagged with WouldDeleteAnnotation instead, and
+	// carried out by a resync once the bake-in ends.
+	CleanupBakeInUntil time.Time
+
+	// SessionGracePeriod fails unfinished build requests whose proxy session
+	// has not sent a heartbeat for this long and deletes their builder
+	// pods. Zero disables reaping.
+	SessionGracePeriod time.Duration
+
+	// StatusConfigMap, when set, receives a summary of active build
+	// requests and the warm pool for consumers without access to the
+	// custom resources
+	StatusConfigMap types.NamespacedName
+
+	// NetworkPolicy, when set, isolates every builder pod with a
+	// NetworkPolicy of its own that is deleted with the build request
+	NetworkPolicy *BuilderNetworkPolicy
+
+	// AntiAffinity, when set, spreads builder pods across nodes or zones
+	AntiAffinity *BuilderAntiAffinity
+
+	// NamespaceIsolation, when set, runs selected builders in an ephemeral
+	// namespace of their own that is deleted with the build request
+	NamespaceIsolation *NamespaceIsolation
+
+	// BuilderJobs runs each builder pod under a Job, which replaces failed
+	// pods up to BuilderJobBackoffLimit times while the request is still
+	// Creating. Pooled pods are claimed as before.
+	BuilderJobs            bool
+	BuilderJobBackoffLimit int32
+
+	// CompletedPodTTL is how long the builder pod of a completed or failed
+	// build request is kept before it is deleted, and BuildRequestTTL how
+	// long the request itself is kept. Zero keeps them until the request is
+	// deleted. Build requests may set their own TTLs.
+	CompletedPodTTL time.Duration
+	BuildRequestTTL time.Duration
+
+	// BuilderSubdomain, when set, makes builder pods a subdomain of this
+	// headless Service, giving each a DNS name the proxy can dial
+	BuilderSubdomain string
+
+	// PodCreateRetries is how many times a builder pod the API server fails
+	// to create is retried, with exponential backoff, before its build
+	// request fails
+	PodCreateRetries int32
+
+	// Provisioning is the kill switch for provisioning builders. While it
+	// is off new build requests fail and the warm pool is not refilled.
+	Provisioning *ProvisioningSwitch
+
+	// DryRun records what the reconciler would do in each build request's
+	// status without creating or deleting any cluster resources
+	DryRun bool
+
+	// SSHProbe checks that a builder accepts SSH connections before its
+	// request is marked Running. Nil relies on the pod's readiness probe
+	// alone.
+	SSHProbe func(ctx context.Context, addr string) error
+
+	// BuildLogs captures builder logs into status and a log store before
+	// builder pods are deleted. Nil leaves logs with the pod.
+	BuildLogs *BuildLogs
+
+	// Notifier is told about build requests that finish in one of
+	// NotifyPhases, or either of Completed and Failed when it is empty.
+	// Nil sends no notifications.
+	Notifier     notify.Notifier
+	NotifyPhases []nixv1alpha1.BuildPhase
+
+	// Elected is closed once this instance holds the leader election
+	// lease. When set, GracefulShutdown leaves build requests alone on
+	// standby instances so they do not fail the active controller's work.
+	Elected <-chan struct{}
+
+	// Recorder, when set, records Events on build requests as they move
+	// through their phases
+	Recorder record.EventRecorder
+
+	// Clock is the time source for status timestamps. Defaults to the real
+	// clock; tests inject a fake one.
+	Clock clock.PassiveClock
 }
 
 // Reconcile handles NixBuildRequest events
@@ -41,6 +255,7 @@ func (r *NixBuildRequestReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 	if err := r.Get(ctx, req.NamespacedName, &buildReq); err != nil {
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	ctx = logging.WithSession(ctx, logging.ComponentReconciler, buildReq.Spec.SessionID)
 
 	// Add finalizer for new resources to ensure cleanup
 	if buildReq.DeletionTimestamp.IsZero() && !controllerutil.ContainsFinalizer(&buildReq, "nix.io/cleanup") {
@@ -53,47 +268,434 @@ func (r *NixBuildRequestReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 
 	// Handle deletion with finalizer
 	if !buildReq.DeletionTimestamp.IsZero() {
+		// Requests deleted as soon as they finish never reach
+		// handleCompletedBuild
+		r.notifyFinished(ctx, &buildReq)
 		if err := r.cleanup(ctx, &buildReq); err != nil {
-			log.Error().Err(err).Str("session_id", buildReq.Spec.SessionID).Msg("Failed to cleanup build request")
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to cleanup build request")
+			r.warningEvent(&buildReq, EventCleanupFailed, "Failed to clean up builder resources: %v", err)
 			return ctrl.Result{RequeueAfter: time.Second * 10}, err
 		}
+		// Build secrets are only gone once the pod that mounted them is
+		if len(buildReq.Spec.BuildSecrets) > 0 && !r.DryRun {
+			exists, err := r.builderExists(ctx, &buildReq)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if exists {
+				log.Ctx(ctx).Debug().Msg("Waiting for builder with build secrets to terminate")
+				return ctrl.Result{RequeueAfter: buildSecretsRemovalPoll}, nil
+			}
+			log.Ctx(ctx).Info().Int("secrets", len(buildReq.Spec.BuildSecrets)).Msg("Build secrets removed with builder pod")
+			r.event(&buildReq, corev1.EventTypeNormal, EventBuildSecretsRemoved, "Build secrets removed with builder pod %s", buildReq.Status.PodName)
+		}
 		controllerutil.RemoveFinalizer(&buildReq, "nix.io/cleanup")
-		return ctrl.Result{}, r.Update(ctx, &buildReq)
+		// A failed update is retried, so the build is only counted once
+		// its finalizer is gone
+		finished := buildReq.DeepCopy()
+		if err := r.Update(ctx, &buildReq); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.Metrics.ObserveCompletion(finished)
+		return ctrl.Result{}, nil
+	}
+
+	// The proxy hands over build requests it could not delete itself
+	if buildReq.Annotations[nixv1alpha1.GCRequestedAnnotation] == "true" {
+		if r.DryRun {
+			r.recordDryRun(ctx, &buildReq, "Would delete build request on behalf of the proxy")
+			return r.updateStatus(ctx, &buildReq)
+		}
+		log.Ctx(ctx).Info().Msg("Deleting build request on behalf of the proxy")
+		return ctrl.Result{}, client.IgnoreNotFound(r.Delete(ctx, &buildReq))
+	}
+
+	log.Ctx(ctx).Info().Str("phase", string(buildReq.Status.Phase)).Msg("Reconciling NixBuildRequest")
+
+	if !tracedPhase(buildReq.Status.Phase) {
+		return r.reconcilePhase(ctx, &buildReq)
 	}
+	ctx, span := tracing.Start(tracing.WithSession(ctx, buildReq.Spec.SessionID), tracer, "reconcile",
+		attribute.String("nix.phase", string(buildReq.Status.Phase)))
+	result, err := r.reconcilePhase(ctx, &buildReq)
+	span.SetAttributes(attribute.String("nix.phase_after", string(buildReq.Status.Phase)))
+	tracing.End(span, err)
+	return result, err
+}
 
-	log.Info().Str("session_id", buildReq.Spec.SessionID).Str("phase", string(buildReq.Status.Phase)).Msg("Reconciling NixBuildRequest")
+// reconcilePhase runs the handler for the build request's phase
+func (r *NixBuildRequestReconciler) reconcilePhase(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (ctrl.Result, error) {
+	if !status.Finished(&buildReq.Status) {
+		grace := r.settings().SessionGracePeriod
+		if silence, ok := r.sessionSilence(buildReq); ok && grace > 0 && silence > grace {
+			return r.reapSession(ctx, buildReq, silence)
+		}
+	}
 
 	switch buildReq.Status.Phase {
-	case "", nixv1alpha1.BuildPhasePending:
-		return r.handlePendingBuild(ctx, &buildReq)
+	case "", nixv1alpha1.BuildPhasePending, nixv1alpha1.BuildPhaseQueued:
+		return r.handlePendingBuild(ctx, buildReq)
 	case nixv1alpha1.BuildPhaseCreating:
-		return r.handleCreatingBuild(ctx, &buildReq)
+		return r.handleCreatingBuild(ctx, buildReq)
 	case nixv1alpha1.BuildPhaseRunning:
-		return r.handleRunningBuild(ctx, &buildReq)
+		return r.handleRunningBuild(ctx, buildReq)
 	case nixv1alpha1.BuildPhaseCompleted, nixv1alpha1.BuildPhaseFailed:
-		return r.handleCompletedBuild(ctx, &buildReq)
+		return r.handleCompletedBuild(ctx, buildReq)
 	default:
-		log.Info().Str("phase", string(buildReq.Status.Phase)).Msg("Unknown build phase")
+		log.Ctx(ctx).Info().Str("phase", string(buildReq.Status.Phase)).Msg("Unknown build phase")
 		return ctrl.Result{}, nil
 	}
 }
 
 func (r *NixBuildRequestReconciler) handlePendingBuild(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (ctrl.Result, error) {
-	log.Info().Str("session_id", buildReq.Spec.SessionID).Msg("Creating builder pod")
+	// Status updates requeue the request at once, so the backoff after a
+	// failed pod creation is enforced here rather than by RequeueAfter alone
+	if wait := r.podCreateWait(buildReq); wait > 0 {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	// A replacement builder pod has the name of the one that was lost
+	if remaining, err := r.lostPodRemaining(ctx, buildReq); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to get lost builder pod")
+		return ctrl.Result{}, err
+	} else if remaining {
+		return ctrl.Result{RequeueAfter: time.Second * 2}, nil
+	}
+
+	// The session ID labels the builder pod, so it must be a valid label value
+	if problems := validation.IsValidLabelValue(buildReq.Spec.SessionID); buildReq.Spec.SessionID == "" || len(problems) > 0 {
+		log.Ctx(ctx).Warn().Strs("problems", problems).Msg("Invalid session ID")
+		r.warningEvent(buildReq, EventInvalidSessionID, "Session ID %q is not a valid label value", buildReq.Spec.SessionID)
+		r.failBuild(buildReq, errcode.Invalid, "Invalid session ID %q", buildReq.Spec.SessionID)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	owner, err := r.sessionOwner(ctx, buildReq)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if owner != nil {
+		log.Ctx(ctx).Warn().Str("owner", owner.Namespace+"/"+owner.Name).Msg("Session ID already in use")
+		r.warningEvent(buildReq, EventInvalidSessionID, "Session ID %q is already used by build request %s/%s", buildReq.Spec.SessionID, owner.Namespace, owner.Name)
+		r.failBuild(buildReq, errcode.Invalid, "Session ID %q is already used by build request %s/%s", buildReq.Spec.SessionID, owner.Namespace, owner.Name)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if buildReq.Spec.CacheCredentials != nil {
+		if err := r.validateCacheCredentials(ctx, buildReq); err != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("Cache credentials unavailable")
+			r.setCondition(buildReq, nixv1alpha1.BuildConditionCredentialsReady, corev1.ConditionFalse, "CredentialsMissing", err.Error())
+			r.failBuild(buildReq, errcode.Invalid, "Cache credentials unavailable: %v", err)
+			return r.updateStatus(ctx, buildReq)
+		}
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionCredentialsReady, corev1.ConditionTrue, "CredentialsFound", "Cache credentials are available")
+	}
+
+	if len(buildReq.Spec.BuildSecrets) > 0 {
+		if err := r.validateBuildSecrets(ctx, buildReq); err != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("Build secrets unavailable")
+			r.setCondition(buildReq, nixv1alpha1.BuildConditionSecretsReady, corev1.ConditionFalse, "SecretsMissing", err.Error())
+			r.failBuild(buildReq, errcode.Invalid, "Build secrets unavailable: %v", err)
+			return r.updateStatus(ctx, buildReq)
+		}
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionSecretsReady, corev1.ConditionTrue, "SecretsFound", "Build secrets are available")
+	}
+
+	if err := r.validateCachePush(ctx, buildReq); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Cache push unavailable")
+		r.failBuild(buildReq, errcode.Invalid, "Cache push unavailable: %v", err)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if err := validateClientPublicKey(buildReq); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Invalid client public key")
+		r.failBuild(buildReq, errcode.Invalid, "Invalid client public key: %v", err)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if err := validateCredentials(buildReq); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Invalid credentials")
+		r.failBuild(buildReq, errcode.Invalid, "Invalid credentials: %v", err)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	problems, warnings, err := r.lintNixConfig(ctx, buildReq)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to read Nix configuration")
+		return ctrl.Result{}, err
+	}
+	if len(problems) > 0 {
+		log.Ctx(ctx).Warn().Strs("problems", problems).Msg("Invalid Nix configuration")
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionNixConfigValid, corev1.ConditionFalse, "InvalidNixConfig", strings.Join(problems, "; "))
+		r.failBuild(buildReq, errcode.Invalid, "Invalid Nix configuration: %s", problems[0])
+		return r.updateStatus(ctx, buildReq)
+	}
+	if len(warnings) > 0 {
+		log.Ctx(ctx).Warn().Strs("warnings", warnings).Msg("Nix configuration has warnings")
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionNixConfigValid, corev1.ConditionTrue, "NixConfigWarnings", strings.Join(warnings, "; "))
+	}
+
+	features, err := r.resolveExperimentalFeatures(ctx, buildReq)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Experimental features unavailable")
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionFeaturesReady, corev1.ConditionFalse, "FeaturesUnavailable", err.Error())
+		r.failBuild(buildReq, errcode.Invalid, "Experimental features unavailable: %v", err)
+		return r.updateStatus(ctx, buildReq)
+	}
+	buildReq.Status.ExperimentalFeatures = features
+	if len(buildReq.Spec.ExperimentalFeatures) > 0 {
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionFeaturesReady, corev1.ConditionTrue, "FeaturesEnabled",
+			fmt.Sprintf("Enabled experimental features: %s", strings.Join(buildReq.Spec.ExperimentalFeatures, ", ")))
+	}
+
+	if _, err := r.systemBuilder(buildReq); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Unsupported system")
+		r.failBuild(buildReq, errcode.Invalid, "Unsupported system: %v", err)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if _, err := r.requiredFeatures(buildReq); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Unsupported system feature")
+		r.failBuild(buildReq, errcode.Invalid, "Unsupported system feature: %v", err)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if err := validateDevices(buildReq.Spec.Devices); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Invalid devices")
+		r.failBuild(buildReq, errcode.Invalid, "Invalid devices: %v", err)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if err := validateStorage(r.storageFor(buildReq)); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Invalid storage")
+		r.failBuild(buildReq, errcode.Invalid, "Invalid storage: %v", err)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if buildReq.Spec.BuildClass == nixv1alpha1.BuildClassBestEffort && r.BestEffortPriorityClass == "" {
+		log.Ctx(ctx).Warn().Msg("Best-effort builds are not enabled")
+		r.failBuild(buildReq, errcode.Invalid, "Best-effort builds are not enabled on this controller")
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if buildReq.Spec.Spot != nil && *buildReq.Spec.Spot && r.Spot == nil {
+		log.Ctx(ctx).Warn().Msg("Spot builders are not enabled")
+		r.failBuild(buildReq, errcode.Invalid, "Spot builders are not enabled on this controller")
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if r.isolateInNamespace(buildReq) {
+		if err := r.validateIsolation(buildReq); err != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("Cannot isolate builder")
+			r.failBuild(buildReq, errcode.Invalid, "Cannot isolate builder: %v", err)
+			return r.updateStatus(ctx, buildReq)
+		}
+	}
+
+	if message, disabled, err := r.provisioningDisabled(ctx, buildReq); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to check whether provisioning is disabled")
+		return ctrl.Result{}, err
+	} else if disabled {
+		log.Ctx(ctx).Warn().Str("reason", message).Msg("Builder provisioning disabled")
+		r.failBuild(buildReq, errcode.Disabled, "%s", message)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if message, err := r.userQuotaExceeded(ctx, buildReq); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to check user quota")
+		return ctrl.Result{}, err
+	} else if message != "" {
+		log.Ctx(ctx).Warn().Str("requester", requester(buildReq)).Str("reason", message).Msg("User over quota")
+		r.failBuild(buildReq, errcode.Quota, "%s", message)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	if r.Policy != nil {
+		allowed, err := r.checkPolicy(ctx, buildReq)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to evaluate policy")
+			return ctrl.Result{}, err
+		}
+		if !allowed {
+			return r.updateStatus(ctx, buildReq)
+		}
+	}
+
+	if r.ValidateImages {
+		validated, err := r.checkBuilderImage(ctx, buildReq)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to validate builder image")
+			return ctrl.Result{}, err
+		}
+		if buildReq.Status.Phase == nixv1alpha1.BuildPhaseFailed {
+			return r.updateStatus(ctx, buildReq)
+		}
+		if !validated {
+			if err := r.Status().Update(ctx, buildReq); err != nil {
+				log.Ctx(ctx).Error().Err(err).Msg("Failed to update build request status")
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: imageValidationRequeueInterval}, nil
+		}
+	}
+
+	admitted, err := r.admitBuild(ctx, buildReq)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to check builder limits")
+		return ctrl.Result{}, err
+	}
+	if !admitted {
+		if err := r.Status().Update(ctx, buildReq); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to update build request status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: queueRequeueInterval}, nil
+	}
+
+	if r.ManageBuilderUsers {
+		buildReq.Status.BuilderUser = builderUsername(buildReq)
+	}
+
+	if r.isolateInNamespace(buildReq) {
+		buildReq.Status.BuilderNamespace = isolatedNamespaceName(buildReq)
+	}
+
+	log.Ctx(ctx).Info().Str("namespace", builderNamespace(buildReq)).Msg("Creating builder pod")
 
 	pod := r.createBuilderPod(buildReq)
-	if err := r.Create(ctx, pod); err != nil {
-		log.Error().Err(err).Str("session_id", buildReq.Spec.SessionID).Msg("Failed to create builder pod")
+	if r.DryRun {
+		r.recordDryRun(ctx, buildReq, fmt.Sprintf("Would create builder pod %s/%s with image %s", pod.Namespace, pod.Name, pod.Spec.Containers[0].Image))
+		return r.updateStatus(ctx, buildReq)
+	}
+	if variant := r.poolVariantFor(buildReq); variant != nil {
+		claimStart := time.Now()
+		pooled, err := r.claimPooledPod(ctx, buildReq, variant.Name)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("Failed to claim pooled builder pod, creating one")
+		}
+		r.Metrics.ObservePoolClaim(variant.Name, pooled != nil, time.Since(claimStart))
+		if pooled != nil {
+			log.Ctx(ctx).Info().Str("pod_name", pooled.Name).Str("variant", variant.Name).Msg("Assigned pooled builder pod")
+			r.event(buildReq, corev1.EventTypeNormal, EventPodClaimed, "Assigned pooled builder pod %s from pool variant %s", pooled.Name, variant.Name)
+			for _, feature := range variant.ExperimentalFeatures {
+				if !slices.Contains(buildReq.Status.ExperimentalFeatures, feature) {
+					buildReq.Status.ExperimentalFeatures = append(buildReq.Status.ExperimentalFeatures, feature)
+				}
+			}
+			slices.Sort(buildReq.Status.ExperimentalFeatures)
+			status.MarkCreating(&buildReq.Status, *r.now(), "Pooled builder pod assigned")
+			buildReq.Status.PodName = pooled.Name
+			if r.AgentPort != 0 {
+				buildReq.Status.AgentTokenSecret = agentTokenSecretName(pooled.Name)
+			}
+			hostKey, err := r.builderHostKey(ctx, pooled.Namespace, pooled.Name)
+			if err != nil {
+				log.Ctx(ctx).Error().Err(err).Msg("Failed to read pooled builder host key")
+				return ctrl.Result{}, err
+			}
+			buildReq.Status.HostKey = hostKey
+			if r.NetworkPolicy != nil {
+				if err := r.ensureBuilderNetworkPolicy(ctx, buildRequestOwner(buildReq), builderNetworkPolicyName(buildReq),
+					map[string]string{"nix.io/session-id": buildReq.Spec.SessionID}); err != nil {
+					log.Ctx(ctx).Error().Err(err).Msg("Failed to isolate pooled builder pod")
+					return ctrl.Result{}, err
+				}
+			}
+			if err := r.Status().Update(ctx, buildReq); err != nil {
+				log.Ctx(ctx).Error().Err(err).Msg("Failed to update build request status")
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: time.Second}, nil
+		}
+	}
+	if buildReq.Status.BuilderNamespace != "" {
+		if err := r.ensureIsolatedNamespace(ctx, buildReq); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to prepare isolated builder namespace")
+			return ctrl.Result{}, err
+		}
+	}
+	hostKey, err := r.ensureBuilderHostKey(ctx, buildRequestOwner(buildReq), pod.Name)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to generate builder host key")
 		return ctrl.Result{}, err
 	}
+	buildReq.Status.HostKey = hostKey
+	if buildReq.Spec.Credentials != nil {
+		if err := r.issueCredentials(ctx, buildReq, pod.Name, hostKey); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to issue builder credentials")
+			return ctrl.Result{}, err
+		}
+	} else if buildReq.Spec.ClientPublicKey != "" {
+		if err := r.ensureSessionAuthorizedKey(ctx, buildReq, pod.Name); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to authorize session key on builder")
+			return ctrl.Result{}, err
+		}
+	} else if r.Vault != nil {
+		if err := r.ensureAuthorizedKeysFromVault(ctx, buildRequestOwner(buildReq), pod.Name); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to load builder public key from Vault")
+			return ctrl.Result{}, err
+		}
+	}
+	if r.BuilderTLSSecret != "" {
+		if err := r.ensureBuilderTLS(ctx, buildRequestOwner(buildReq), pod.Name); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to issue builder TLS certificate")
+			return ctrl.Result{}, err
+		}
+	}
+	if r.AgentPort != 0 {
+		if err := r.ensureAgentToken(ctx, buildRequestOwner(buildReq), pod.Name); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to create builder agent token")
+			return ctrl.Result{}, err
+		}
+		buildReq.Status.AgentTokenSecret = agentTokenSecretName(pod.Name)
+	}
+	if r.signsOutputs(buildReq) {
+		if err := r.ensureSigningToken(ctx, buildRequestOwner(buildReq), pod.Name); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to create builder signing token")
+			return ctrl.Result{}, err
+		}
+	}
+	if r.NetworkPolicy != nil || buildReq.Status.BuilderNamespace != "" {
+		if err := r.ensureBuilderNetworkPolicy(ctx, buildRequestOwner(buildReq), builderNetworkPolicyName(buildReq),
+			map[string]string{"nix.io/session-id": buildReq.Spec.SessionID}); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to create builder network policy")
+			return ctrl.Result{}, err
+		}
+	}
+	if storage := r.storageFor(buildReq); storage != nil {
+		claimName := storeClaimName(storage, pod.Name)
+		if storage.Type == nixv1alpha1.StorageSession {
+			if err := r.ensureStoreClaim(ctx, buildReq, storage, claimName); err != nil {
+				log.Ctx(ctx).Error().Err(err).Msg("Failed to create store volume claim")
+				return ctrl.Result{}, err
+			}
+		}
+		addStoreVolume(pod, claimName)
+	}
+	var created client.Object = pod
+	if r.BuilderJobs {
+		created = r.builderJob(buildReq, pod)
+	}
+	if err := r.Create(ctx, created); err != nil {
+		return r.handlePodCreateFailure(ctx, buildReq, err)
+	}
 
-	buildReq.Status.Phase = nixv1alpha1.BuildPhaseCreating
-	buildReq.Status.PodName = pod.Name
-	buildReq.Status.StartTime = &metav1.Time{Time: time.Now()}
-	buildReq.Status.Message = "Builder pod created"
+	if hasCondition(buildReq, nixv1alpha1.BuildConditionPodCreated, corev1.ConditionFalse) {
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionPodCreated, corev1.ConditionTrue, "Created",
+			fmt.Sprintf("Builder pod created after %d failed attempts", buildReq.Status.CreateAttempts))
+	}
+	if r.BuilderJobs {
+		status.MarkCreating(&buildReq.Status, *r.now(), "Builder job created")
+		buildReq.Status.JobName = pod.Name
+		r.event(buildReq, corev1.EventTypeNormal, EventPodCreated, "Created builder job %s", pod.Name)
+	} else {
+		status.MarkCreating(&buildReq.Status, *r.now(), "Builder pod created")
+		buildReq.Status.PodName = pod.Name
+		r.event(buildReq, corev1.EventTypeNormal, EventPodCreated, "Created builder pod %s", pod.Name)
+	}
 
 	if err := r.Status().Update(ctx, buildReq); err != nil {
-		log.Error().Err(err).Str("session_id", buildReq.Spec.SessionID).Msg("Failed to update build request status")
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to update build request status")
 		return ctrl.Result{}, err
 	}
 
@@ -101,82 +703,187 @@ func (r *NixBuildRequestReconciler) handlePendingBuild(ctx context.Context, buil
 }
 
 func (r *NixBuildRequestReconciler) handleCreatingBuild(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (ctrl.Result, error) {
+	if buildReq.Status.JobName != "" {
+		return r.handleCreatingJob(ctx, buildReq)
+	}
+
 	var pod corev1.Pod
 	if err := r.Get(ctx, client.ObjectKey{
-		Namespace: buildReq.Namespace,
+		Namespace: builderNamespace(buildReq),
 		Name:      buildReq.Status.PodName,
 	}, &pod); err != nil {
 		if client.IgnoreNotFound(err) == nil {
-			buildReq.Status.Phase = nixv1alpha1.BuildPhaseFailed
-			buildReq.Status.CompletionTime = &metav1.Time{Time: time.Now()}
-			buildReq.Status.Message = "Builder pod was deleted during creation"
+			if r.runsOnSpot(buildReq) {
+				return r.builderLost(ctx, buildReq, nil, "Builder pod was deleted during creation")
+			}
+			r.failBuild(buildReq, errcode.Builder, "Builder pod was deleted during creation")
 			return r.updateStatus(ctx, buildReq)
 		}
-		log.Error().Err(err).Str("session_id", buildReq.Spec.SessionID).Msg("Failed to get builder pod")
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to get builder pod")
 		return ctrl.Result{}, err
 	}
 
+	if message, preempted := podPreempted(&pod); preempted {
+		log.Ctx(ctx).Info().Msg("Builder pod was preempted during creation")
+		return r.builderLost(ctx, buildReq, &pod, "Builder pod was preempted: "+message)
+	}
+
+	if message, reclaimed := podReclaimed(&pod); reclaimed {
+		log.Ctx(ctx).Info().Msg("Builder node was reclaimed during creation")
+		return r.builderLost(ctx, buildReq, &pod, "Builder node was reclaimed: "+message)
+	}
+
 	if pod.Status.Phase == corev1.PodFailed {
-		buildReq.Status.Phase = nixv1alpha1.BuildPhaseFailed
-		buildReq.Status.CompletionTime = &metav1.Time{Time: time.Now()}
-		buildReq.Status.Message = fmt.Sprintf("Builder pod failed during creation: %s", pod.Status.Message)
+		r.failBuild(buildReq, errcode.Builder, "Builder pod failed during creation: %s", pod.Status.Message)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	return r.waitForBuilderPod(ctx, buildReq, &pod, false)
+}
+
+// handleCreatingJob waits for the pod a builder Job is running. Pods that
+// fail or are preempted are left for the Job to replace.
+func (r *NixBuildRequestReconciler) handleCreatingJob(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (ctrl.Result, error) {
+	podName := buildReq.Status.PodName
+	pod, err := r.syncBuilderJob(ctx, buildReq)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to get builder job")
+		return ctrl.Result{}, err
+	}
+	if buildReq.Status.Phase == nixv1alpha1.BuildPhaseFailed {
 		return r.updateStatus(ctx, buildReq)
 	}
+	if pod == nil {
+		return ctrl.Result{RequeueAfter: time.Second * 2}, nil
+	}
+	return r.waitForBuilderPod(ctx, buildReq, pod, buildReq.Status.PodName != podName)
+}
+
+// waitForBuilderPod moves a creating build request to Running once its pod
+// accepts SSH connections, recording scheduling progress until then.
+// statusChanged forces a status update while the pod is not yet ready.
+func (r *NixBuildRequestReconciler) waitForBuilderPod(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest, pod *corev1.Pod, statusChanged bool) (ctrl.Result, error) {
+	if reason, message, ok := imagePullFailure(pod); ok {
+		log.Ctx(ctx).Warn().Str("reason", reason).Msg("Builder image could not be pulled")
+		r.failBuild(buildReq, errcode.ImagePull, "Builder image could not be pulled: %s: %s", reason, message)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	timingsChanged := recordPodTimings(buildReq, pod) || statusChanged
+
+	// Unschedulable pods are left waiting, since the cluster may scale up,
+	// but the condition lets the proxy explain a timeout
+	if message, unschedulable := podUnschedulable(pod); unschedulable {
+		if !hasCondition(buildReq, nixv1alpha1.BuildConditionPodScheduled, corev1.ConditionFalse) {
+			r.setCondition(buildReq, nixv1alpha1.BuildConditionPodScheduled, corev1.ConditionFalse, "Unschedulable", message)
+			timingsChanged = true
+		}
+	} else if hasCondition(buildReq, nixv1alpha1.BuildConditionPodScheduled, corev1.ConditionFalse) && buildReq.Status.PodScheduledTime != nil {
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionPodScheduled, corev1.ConditionTrue, "Scheduled", "Builder pod was scheduled")
+		timingsChanged = true
+	}
 
-	if pod.Status.Phase == corev1.PodRunning && pod.Status.PodIP != "" && isPodReady(&pod) {
-		buildReq.Status.Phase = nixv1alpha1.BuildPhaseRunning
-		buildReq.Status.PodIP = pod.Status.PodIP
-		buildReq.Status.Message = "Builder pod ready for connections"
+	ready := pod.Status.Phase == corev1.PodRunning && pod.Status.PodIP != "" && isPodReady(pod)
+	if ready && r.SSHProbe != nil {
+		addr := net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(r.RemotePort)))
+		if err := r.SSHProbe(ctx, addr); err != nil {
+			log.Ctx(ctx).Debug().Err(err).Str("addr", addr).Msg("Builder not accepting SSH yet")
+			ready = false
+			if !hasCondition(buildReq, nixv1alpha1.BuildConditionPodReady, corev1.ConditionFalse) {
+				r.setCondition(buildReq, nixv1alpha1.BuildConditionPodReady, corev1.ConditionFalse, "SSHNotReady", err.Error())
+				timingsChanged = true
+			}
+		}
+	}
+
+	if ready {
+		status.MarkReady(&buildReq.Status, *r.now(), pod.Status.PodIP)
+		if r.AgentPort != 0 {
+			buildReq.Status.AgentEndpoint = r.agentEndpoint(pod.Status.PodIP)
+		}
+		r.event(buildReq, corev1.EventTypeNormal, EventPodReady, "Builder pod %s is ready for connections at %s", pod.Name, pod.Status.PodIP)
 
 		if err := r.Status().Update(ctx, buildReq); err != nil {
-			log.Error().Err(err).Str("session_id", buildReq.Spec.SessionID).Msg("Failed to update build request status")
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to update build request status")
 			return ctrl.Result{}, err
 		}
 
-		log.Info().Str("session_id", buildReq.Spec.SessionID).Str("pod_ip", pod.Status.PodIP).Msg("Builder pod ready")
+		r.Metrics.ObserveReady(buildReq)
+		traceBuilderStartup(buildReq)
+		log.Ctx(ctx).Info().Str("pod_ip", pod.Status.PodIP).Msg("Builder pod ready")
 		return ctrl.Result{}, nil
 	}
 
+	if timingsChanged {
+		if err := r.Status().Update(ctx, buildReq); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to update build request status")
+			return ctrl.Result{}, err
+		}
+	}
+
 	return ctrl.Result{RequeueAfter: time.Second * 2}, nil
 }
 
 func (r *NixBuildRequestReconciler) handleRunningBuild(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (ctrl.Result, error) {
+	// A pod the Job replaces is a new builder the session was never
+	// connected to, so a running request fails with its first pod
+	if buildReq.Status.JobName != "" {
+		message, ended, err := r.builderJobEnded(ctx, buildReq)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if ended {
+			r.failBuild(buildReq, errcode.Builder, "%s", message)
+			return r.updateStatus(ctx, buildReq)
+		}
+	}
+
 	var pod corev1.Pod
 	err := r.Get(ctx, client.ObjectKey{
-		Namespace: buildReq.Namespace,
+		Namespace: builderNamespace(buildReq),
 		Name:      buildReq.Status.PodName,
 	}, &pod)
 
 	if err != nil {
 		if client.IgnoreNotFound(err) == nil {
-			buildReq.Status.Phase = nixv1alpha1.BuildPhaseFailed
-			buildReq.Status.CompletionTime = &metav1.Time{Time: time.Now()}
-			buildReq.Status.Message = "Builder pod was deleted unexpectedly"
+			if r.runsOnSpot(buildReq) {
+				return r.builderLost(ctx, buildReq, nil, "Builder pod was deleted unexpectedly")
+			}
+			r.failBuild(buildReq, errcode.Builder, "Builder pod was deleted unexpectedly")
 			return r.updateStatus(ctx, buildReq)
 		}
 		return ctrl.Result{}, err
 	}
 
+	if message, preempted := podPreempted(&pod); preempted {
+		log.Ctx(ctx).Info().Msg("Builder pod was preempted")
+		return r.builderLost(ctx, buildReq, &pod, "Builder pod was preempted: "+message)
+	}
+
+	if message, reclaimed := podReclaimed(&pod); reclaimed {
+		log.Ctx(ctx).Info().Msg("Builder node was reclaimed")
+		return r.builderLost(ctx, buildReq, &pod, "Builder node was reclaimed: "+message)
+	}
+
 	if pod.Status.Phase == corev1.PodFailed {
-		buildReq.Status.Phase = nixv1alpha1.BuildPhaseFailed
-		buildReq.Status.CompletionTime = &metav1.Time{Time: time.Now()}
-		buildReq.Status.Message = fmt.Sprintf("Builder pod failed unexpectedly: %s", pod.Status.Message)
+		r.failBuild(buildReq, errcode.Builder, "Builder pod failed unexpectedly: %s", pod.Status.Message)
 		return r.updateStatus(ctx, buildReq)
 	}
 
 	return ctrl.Result{RequeueAfter: time.Second * 30}, nil
 }
 
-func (r *NixBuildRequestReconciler) handleCompletedBuild(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (ctrl.Result, error) {
-	log.Debug().
-		Str("session_id", buildReq.Spec.SessionID).
-		Str("phase", string(buildReq.Status.Phase)).
-		Msg("Build completed, awaiting cleanup via deletion")
-	return ctrl.Result{}, nil
+// builderPodName names the builder pod the controller creates for a build
+// request
+func builderPodName(buildReq *nixv1alpha1.NixBuildRequest) string {
+	return fmt.Sprintf("nix-builder-%s", buildReq.Spec.SessionID)
 }
 
 func (r *NixBuildRequestReconciler) createBuilderPod(buildReq *nixv1alpha1.NixBuildRequest) *corev1.Pod {
-	podName := fmt.Sprintf("nix-builder-%s", buildReq.Spec.SessionID)
+	podName := builderPodName(buildReq)
+	// The system and features were validated before the pod was created
+	system, _ := r.systemBuilder(buildReq)
+	features, _ := r.requiredFeatures(buildReq)
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -184,30 +891,28 @@ func (r *NixBuildRequestReconciler) createBuilderPod(buildReq *nixv1alpha1.NixBu
 			Namespace: buildReq.Namespace,
 			Labels: map[string]string{
 				"app":                  "nix-builder",
+				ManagedByLabel:         ManagedByValue,
 				"nix.io/session-id":    buildReq.Spec.SessionID,
 				"nix.io/build-request": buildReq.Name,
 			},
-			OwnerReferences: []metav1.OwnerReference{{
-				APIVersion:         nixv1alpha1.GroupVersion.String(),
-				Kind:               "NixBuildRequest",
-				Name:               buildReq.Name,
-				UID:                buildReq.UID,
-				Controller:         &[]bool{true}[0],
-				BlockOwnerDeletion: &[]bool{true}[0],
-			}},
+			Annotations: map[string]string{
+				SafeToEvictAnnotation: "false",
+			},
+			OwnerReferences: []metav1.OwnerReference{buildRequestOwnerReference(buildReq)},
 		},
 		Spec: corev1.PodSpec{
 			RestartPolicy:         corev1.RestartPolicyNever,
 			ActiveDeadlineSeconds: buildReq.Spec.TimeoutSeconds,
-			NodeSelector:          buildReq.Spec.NodeSelector,
+			NodeSelector:          builderNodeSelector(system, buildReq),
+			Subdomain:             r.BuilderSubdomain,
 			Containers: []corev1.Container{{
-				Name:  "nix-builder",
-				Image: r.getBuilderImage(buildReq),
+				Name:  builderContainerName,
+				Image: r.getBuilderImage(buildReq, system),
 				Ports: []corev1.ContainerPort{{
 					ContainerPort: r.RemotePort,
 					Protocol:      corev1.ProtocolTCP,
 				}},
-				Resources: buildReq.Spec.Resources,
+				Resources: r.builderResources(buildReq),
 				ReadinessProbe: &corev1.Probe{
 					ProbeHandler: corev1.ProbeHandler{
 						TCPSocket: &corev1.TCPSocketAction{
@@ -221,7 +926,7 @@ func (r *NixBuildRequestReconciler) createBuilderPod(buildReq *nixv1alpha1.NixBu
 				VolumeMounts: []corev1.VolumeMount{{
 					Name:      "ssh-keys",
 					MountPath: "/home/nixbld/.ssh/authorized_keys",
-					SubPath:   "public",
+					SubPath:   authorizedKeysSecretKey,
 					ReadOnly:  true,
 				}},
 			}},
@@ -229,7 +934,7 @@ func (r *NixBuildRequestReconciler) createBuilderPod(buildReq *nixv1alpha1.NixBu
 				Name: "ssh-keys",
 				VolumeSource: corev1.VolumeSource{
 					Secret: &corev1.SecretVolumeSource{
-						SecretName:  r.SSHKeySecret,
+						SecretName:  r.authorizedKeysSecretName(buildReq, podName),
 						DefaultMode: &[]int32{0644}[0],
 					},
 				},
@@ -256,14 +961,135 @@ func (r *NixBuildRequestReconciler) createBuilderPod(buildReq *nixv1alpha1.NixBu
 		})
 	}
 
+	addSystemFeatures(pod, features)
+	addDevices(&pod.Spec.Containers[0], buildReq.Spec.Devices)
+	addBuilderHostKey(pod)
+	setSessionAnnotations(pod, buildReq)
+	setRequesterLabel(pod, buildReq)
+	addSessionInfo(pod)
+	if buildReq.Spec.BuildClass == nixv1alpha1.BuildClassBestEffort {
+		pod.Labels[BuildClassLabel] = string(buildReq.Spec.BuildClass)
+		pod.Spec.PriorityClassName = r.BestEffortPriorityClass
+	}
+	if r.runsOnSpot(buildReq) {
+		r.addSpotPlacement(pod)
+	}
+
+	if r.BuilderTLSSecret != "" {
+		r.addBuilderTLS(pod)
+	}
+
+	if r.AgentPort != 0 {
+		r.addAgent(pod)
+	}
+
+	if buildReq.Spec.CacheCredentials != nil {
+		addCacheCredentials(pod, buildReq.Spec.CacheCredentials)
+	}
+
+	if len(buildReq.Spec.BuildSecrets) > 0 {
+		addBuildSecrets(pod, buildReq.Spec.BuildSecrets)
+	}
+
+	if r.cachePushEnabled(buildReq) {
+		r.addCachePush(pod)
+	}
+
+	var controllerConfig []string
+	if buildReq.Status.BuilderUser != "" {
+		container := &pod.Spec.Containers[0]
+		container.Env = append(container.Env, corev1.EnvVar{Name: "BUILDER_USER", Value: buildReq.Status.BuilderUser})
+		controllerConfig = builderUserConfig(buildReq.Status.BuilderUser)
+	}
+	addNixConfig(pod, buildReq.Spec, controllerConfig)
+	if buildReq.Status.BuilderNamespace != "" {
+		isolatePod(pod, buildReq)
+	}
+	applyPodTemplate(pod, r.PodTemplate)
+	r.addAntiAffinity(pod)
+
 	return pod
 }
 
-func (r *NixBuildRequestReconciler) getBuilderImage(buildReq *nixv1alpha1.NixBuildRequest) string {
+// buildRequestOwnerReference makes a build request the controlling owner of
+// a resource so it is garbage collected with the request
+func buildRequestOwnerReference(buildReq *nixv1alpha1.NixBuildRequest) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion:         nixv1alpha1.GroupVersion.String(),
+		Kind:               "NixBuildRequest",
+		Name:               buildReq.Name,
+		UID:                buildReq.UID,
+		Controller:         &[]bool{true}[0],
+		BlockOwnerDeletion: &[]bool{true}[0],
+	}
+}
+
+// builderOwner describes what owns a builder pod's supporting secrets: the
+// build request for pods created on demand, or the pod itself for pooled
+// pods that have no request yet
+type builderOwner struct {
+	Namespace       string
+	Labels          map[string]string
+	OwnerReferences []metav1.OwnerReference
+	// RequestNamespace is the build request's namespace when the builder
+	// runs in an isolated namespace of its own. Owner references cannot
+	// cross namespaces, so the namespace's deletion cleans up instead.
+	RequestNamespace string
+}
+
+func buildRequestOwner(buildReq *nixv1alpha1.NixBuildRequest) builderOwner {
+	owner := builderOwner{
+		Namespace: buildReq.Namespace,
+		Labels: map[string]string{
+			"app":                  "nix-builder",
+			ManagedByLabel:         ManagedByValue,
+			"nix.io/build-request": buildReq.Name,
+		},
+		OwnerReferences: []metav1.OwnerReference{buildRequestOwnerReference(buildReq)},
+	}
+	if ns := buildReq.Status.BuilderNamespace; ns != "" {
+		owner.Namespace = ns
+		owner.OwnerReferences = nil
+		owner.RequestNamespace = buildReq.Namespace
+	}
+	return owner
+}
+
+// home returns the namespace holding the controller's configuration for the
+// owner's builder, such as the TLS CA
+func (o builderOwner) home() string {
+	if o.RequestNamespace != "" {
+		return o.RequestNamespace
+	}
+	return o.Namespace
+}
+
+// objectMeta returns metadata for a secret named name belonging to the owner
+func (o builderOwner) objectMeta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:            name,
+		Namespace:       o.Namespace,
+		Labels:          o.Labels,
+		OwnerReferences: o.OwnerReferences,
+	}
+}
+
+func (r *NixBuildRequestReconciler) getBuilderImage(buildReq *nixv1alpha1.NixBuildRequest, system SystemBuilder) string {
 	if buildReq.Spec.Image != "" {
 		return buildReq.Spec.Image
 	}
-	return r.BuilderImage
+	if system.Image != "" {
+		return system.Image
+	}
+	return r.settings().BuilderImage
+}
+
+// now returns the current time from the reconciler's clock
+func (r *NixBuildRequestReconciler) now() *metav1.Time {
+	if r.Clock == nil {
+		return &metav1.Time{Time: time.Now()}
+	}
+	return &metav1.Time{Time: r.Clock.Now()}
 }
 
 func (r *NixBuildRequestReconciler) updateStatus(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (ctrl.Result, error) {
@@ -274,30 +1100,70 @@ func (r *NixBuildRequestReconciler) updateStatus(ctx context.Context, buildReq *
 }
 
 func (r *NixBuildRequestReconciler) cleanup(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) error {
-	log.Info().Str("session_id", buildReq.Spec.SessionID).Msg("Cleaning up build request")
+	log.Ctx(ctx).Info().Msg("Cleaning up build request")
+
+	if err := r.revokeCredentials(ctx, buildReq); err != nil {
+		return err
+	}
 
 	// Delete associated pod if it exists
 	if buildReq.Status.PodName != "" {
 		var pod corev1.Pod
 		if err := r.Get(ctx, client.ObjectKey{
-			Namespace: buildReq.Namespace,
+			Namespace: builderNamespace(buildReq),
 			Name:      buildReq.Status.PodName,
 		}, &pod); err == nil {
+			if r.DryRun {
+				log.Ctx(ctx).Info().Str("pod_name", buildReq.Status.PodName).Bool("dry_run", true).Msg("Would delete pod during cleanup")
+				return nil
+			}
+			r.captureBuildLogs(ctx, buildReq)
+			r.recordStoreDiff(ctx, buildReq)
+			// Deleting the Job first keeps it from replacing the pod
+			if buildReq.Status.JobName != "" {
+				if err := r.deleteBuilderJob(ctx, buildReq); err != nil {
+					return err
+				}
+			}
 			if err := r.Delete(ctx, &pod); err != nil {
-				log.Error().Err(err).Str("pod_name", buildReq.Status.PodName).Msg("Failed to delete pod during cleanup")
+				log.Ctx(ctx).Error().Err(err).Str("pod_name", buildReq.Status.PodName).Msg("Failed to delete pod during cleanup")
 				return err
 			}
-			log.Info().Str("pod_name", buildReq.Status.PodName).Msg("Deleted pod during cleanup")
+			log.Ctx(ctx).Info().Str("pod_name", buildReq.Status.PodName).Msg("Deleted pod during cleanup")
+		}
+	}
+
+	if buildReq.Status.JobName != "" && !r.DryRun {
+		if err := r.deleteBuilderJob(ctx, buildReq); err != nil {
+			return err
+		}
+	}
+
+	if r.NetworkPolicy != nil && !r.DryRun {
+		if err := r.deleteBuilderNetworkPolicy(ctx, buildReq); err != nil {
+			return err
 		}
 	}
 
+	if buildReq.Status.BuilderNamespace != "" && !r.DryRun {
+		return r.deleteIsolatedNamespace(ctx, buildReq)
+	}
 	return nil
 }
 
 func (r *NixBuildRequestReconciler) GracefulShutdown(ctx context.Context) error {
+	if r.Elected != nil {
+		select {
+		case <-r.Elected:
+		default:
+			log.Info().Msg("Not the leader, leaving build requests to the active controller")
+			return nil
+		}
+	}
+
 	log.Info().Msg("Starting graceful controller shutdown")
 
-	// List all pending/creating build requests
+	// List all pending/queued/creating build requests
 	var buildReqs nixv1alpha1.NixBuildRequestList
 	if err := r.List(ctx, &buildReqs); err != nil {
 		log.Error().Err(err).Msg("Failed to list build requests during shutdown")
@@ -307,11 +1173,10 @@ func (r *NixBuildRequestReconciler) GracefulShutdown(ctx context.Context) error
 	updatedCount := 0
 	for _, buildReq := range buildReqs.Items {
 		if buildReq.Status.Phase == nixv1alpha1.BuildPhasePending ||
+			buildReq.Status.Phase == nixv1alpha1.BuildPhaseQueued ||
 			buildReq.Status.Phase == nixv1alpha1.BuildPhaseCreating {
 
-			buildReq.Status.Phase = nixv1alpha1.BuildPhaseFailed
-			buildReq.Status.Message = "Controller shutdown during processing"
-			buildReq.Status.CompletionTime = &metav1.Time{Time: time.Now()}
+			r.failBuild(&buildReq, errcode.Internal, "Controller shutdown during processing")
 
 			if err := r.Status().Update(ctx, &buildReq); err != nil {
 				log.Error().Err(err).Str("build_request", buildReq.Name).Msg("Failed to update build request status during shutdown")
@@ -325,6 +1190,98 @@ func (r *NixBuildRequestReconciler) GracefulShutdown(ctx context.Context) error
 	return nil
 }
 
+// recordPodTimings copies the scheduling and readiness transition times from
+// the pod's conditions into the build request status, returning true if any
+// timestamp was newly recorded
+func recordPodTimings(buildReq *nixv1alpha1.NixBuildRequest, pod *corev1.Pod) bool {
+	changed := false
+	for _, cond := range pod.Status.Conditions {
+		if cond.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch cond.Type {
+		case corev1.PodScheduled:
+			if buildReq.Status.PodScheduledTime == nil {
+				buildReq.Status.PodScheduledTime = cond.LastTransitionTime.DeepCopy()
+				changed = true
+			}
+		case corev1.PodReady:
+			if buildReq.Status.PodReadyTime == nil {
+				buildReq.Status.PodReadyTime = cond.LastTransitionTime.DeepCopy()
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// recordDryRun logs an action skipped in dry-run mode and records it in the
+// build request's DryRun condition
+func (r *NixBuildRequestReconciler) recordDryRun(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest, action string) {
+	log.Ctx(ctx).Info().Bool("dry_run", true).Msg(action)
+	status.MarkDryRun(&buildReq.Status, *r.now(), action)
+}
+
+// failBuild moves a build request to Failed with a message carrying code
+func (r *NixBuildRequestReconciler) failBuild(buildReq *nixv1alpha1.NixBuildRequest, code errcode.Code, format string, args ...any) {
+	status.MarkFailed(&buildReq.Status, *r.now(), code, fmt.Sprintf(format, args...))
+	r.warningEvent(buildReq, EventBuildFailed, "%s", buildReq.Status.Message)
+}
+
+// hasCondition reports whether a build request has a condition with the
+// given status
+func hasCondition(buildReq *nixv1alpha1.NixBuildRequest, condType nixv1alpha1.BuildConditionType, condStatus corev1.ConditionStatus) bool {
+	return status.HasCondition(&buildReq.Status, condType, condStatus)
+}
+
+// setCondition adds or updates a condition on the build request status at
+// the reconciler's clock
+func (r *NixBuildRequestReconciler) setCondition(buildReq *nixv1alpha1.NixBuildRequest, condType nixv1alpha1.BuildConditionType, condStatus corev1.ConditionStatus, reason, message string) {
+	status.SetCondition(&buildReq.Status, *r.now(), condType, condStatus, reason, message)
+}
+
+// imagePullFailure reports whether the builder container is stuck because
+// its image cannot be pulled. ErrImagePull alone is left to the kubelet's
+// retries.
+func imagePullFailure(pod *corev1.Pod) (reason, message string, failed bool) {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting == nil {
+			continue
+		}
+		switch status.State.Waiting.Reason {
+		case "ImagePullBackOff", "InvalidImageName", "ErrImageNeverPull":
+			return status.State.Waiting.Reason, status.State.Waiting.Message, true
+		}
+	}
+	return "", "", false
+}
+
+// podUnschedulable reports whether the scheduler could not place a pod
+func podUnschedulable(pod *corev1.Pod) (string, bool) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse && cond.Reason == corev1.PodReasonUnschedulable {
+			return cond.Message, true
+		}
+	}
+	return "", false
+}
+
+// podPreempted reports whether the scheduler is evicting a pod to make room
+// for higher priority work
+func podPreempted(pod *corev1.Pod) (string, bool) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.DisruptionTarget && cond.Status == corev1.ConditionTrue && cond.Reason == corev1.PodReasonPreemptionByScheduler {
+			return cond.Message, true
+		}
+	}
+	return "", false
+}
+
+// isQuotaExceeded reports whether a create was refused by a ResourceQuota
+func isQuotaExceeded(err error) bool {
+	return apierrors.IsForbidden(err) && strings.Contains(err.Error(), "exceeded quota")
+}
+
 // isPodReady checks if all containers in the pod are ready
 func isPodReady(pod *corev1.Pod) bool {
 	for _, cond := range pod.Status.Conditions {
@@ -337,8 +1294,51 @@ func isPodReady(pod *corev1.Pod) bool {
 
 // SetupWithManager sets up the controller with the Manager
 func (r *NixBuildRequestReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	// Resync runs once the caches have started so that drift from a period
+	// of controller downtime is repaired before regular reconciles settle
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		if err := r.Resync(ctx); err != nil {
+			log.Error().Err(err).Msg("Startup resync failed")
+		}
+		if wait := time.Until(r.CleanupBakeInUntil); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait):
+			}
+			log.Info().Msg("Cleanup bake-in ended, deleting flagged resources")
+			if err := r.Resync(ctx); err != nil {
+				log.Error().Err(err).Msg("Post bake-in resync failed")
+			}
+		}
+		return nil
+	})); err != nil {
+		return err
+	}
+
+	if r.ValidateImages {
+		if err := mgr.Add(manager.RunnableFunc(r.ValidateConfiguredImages)); err != nil {
+			return err
+		}
+	}
+
+	if len(r.warmPoolVariants()) > 0 {
+		if err := mgr.Add(manager.RunnableFunc(r.MaintainWarmPool)); err != nil {
+			return err
+		}
+	}
+
+	if r.StatusConfigMap.Name != "" {
+		if err := mgr.Add(manager.RunnableFunc(r.MirrorStatus)); err != nil {
+			return err
+		}
+	}
+
+	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&nixv1alpha1.NixBuildRequest{}).
-		Owns(&corev1.Pod{}).
-		Complete(r)
+		Owns(&corev1.Pod{})
+	if r.BuilderJobs {
+		builder = builder.Owns(&batchv1.Job{})
+	}
+	return builder.Complete(r)
 }
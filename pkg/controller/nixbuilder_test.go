@@ -0,0 +1,400 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	clocktesting "k8s.io/utils/clock/testing"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+var testEpoch = time.Date(2026, 1, 15, 10, 30, 0, 0, time.UTC)
+
+func newTestReconciler(t *testing.T, objs ...client.Object) (*NixBuildRequestReconciler, *clocktesting.FakeClock) {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := nixv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		WithStatusSubresource(&nixv1alpha1.NixBuildRequest{}, &nixv1alpha1.BuilderLease{}, &nixv1alpha1.FlakePrefetch{}).
+		Build()
+
+	clk := clocktesting.NewFakeClock(testEpoch)
+	return &NixBuildRequestReconciler{
+		Client:       c,
+		Scheme:       scheme,
+		BuilderImage: "builder:test",
+		RemotePort:   22,
+		SSHKeySecret: "keys",
+		Clock:        clk,
+	}, clk
+}
+
+func newBuildRequest(phase nixv1alpha1.BuildPhase) *nixv1alpha1.NixBuildRequest {
+	return &nixv1alpha1.NixBuildRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "build-abc",
+			Namespace:  "default",
+			Finalizers: []string{"nix.io/cleanup"},
+		},
+		Spec: nixv1alpha1.NixBuildRequestSpec{SessionID: "abc"},
+		Status: nixv1alpha1.NixBuildRequestStatus{
+			Phase:   phase,
+			PodName: "nix-builder-abc",
+		},
+	}
+}
+
+func reconcileOnce(t *testing.T, r *NixBuildRequestReconciler) (ctrl.Result, *nixv1alpha1.NixBuildRequest) {
+	t.Helper()
+
+	key := client.ObjectKey{Namespace: "default", Name: "build-abc"}
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatalf("Reconcile returned error: %v", err)
+	}
+
+	var buildReq nixv1alpha1.NixBuildRequest
+	if err := r.Get(context.Background(), key, &buildReq); err != nil {
+		t.Fatalf("failed to get build request: %v", err)
+	}
+	return result, &buildReq
+}
+
+func TestReconcilePendingCreatesPod(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, buildReq)
+
+	result, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseCreating {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseCreating)
+	}
+	if !got.Status.StartTime.Time.Equal(testEpoch) {
+		t.Errorf("startTime = %v, want %v", got.Status.StartTime, testEpoch)
+	}
+	if result.RequeueAfter != 5*time.Second {
+		t.Errorf("requeueAfter = %v, want 5s", result.RequeueAfter)
+	}
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatalf("builder pod not created: %v", err)
+	}
+	if image := pod.Spec.Containers[0].Image; image != "builder:test" {
+		t.Errorf("image = %q, want builder:test", image)
+	}
+	if id := pod.Annotations[SessionIDAnnotation]; id != "abc" {
+		t.Errorf("session ID annotation = %q, want abc", id)
+	}
+	if motd := pod.Annotations[MOTDAnnotation]; !strings.Contains(motd, "session abc") {
+		t.Errorf("motd = %q, want it to name session abc", motd)
+	}
+}
+
+func TestReconcilePendingRejectsInvalidSessionID(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Spec.SessionID = "not a label/value"
+	r, _ := newTestReconciler(t, buildReq)
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if code, _ := errcode.Parse(got.Status.Message); code != errcode.Invalid {
+		t.Errorf("message = %q, want code %s", got.Status.Message, errcode.Invalid)
+	}
+
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	for _, want := range []string{"Warning " + EventInvalidSessionID, "Warning " + EventBuildFailed} {
+		if !slices.ContainsFunc(events, func(e string) bool { return strings.HasPrefix(e, want+" ") }) {
+			t.Errorf("events = %q, want one starting with %q", events, want)
+		}
+	}
+}
+
+func TestReconcileCreatingRecordsTimings(t *testing.T) {
+	scheduled := metav1.NewTime(testEpoch.Add(-10 * time.Second))
+	ready := metav1.NewTime(testEpoch.Add(-2 * time.Second))
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default"},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			PodIP: "10.0.0.42",
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodScheduled, Status: corev1.ConditionTrue, LastTransitionTime: scheduled},
+				{Type: corev1.PodReady, Status: corev1.ConditionTrue, LastTransitionTime: ready},
+				{Type: corev1.ContainersReady, Status: corev1.ConditionTrue, LastTransitionTime: ready},
+			},
+		},
+	}
+	r, clk := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhaseCreating), pod)
+	clk.Step(time.Second)
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseRunning {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseRunning)
+	}
+	if got.Status.PodIP != "10.0.0.42" {
+		t.Errorf("podIP = %q, want 10.0.0.42", got.Status.PodIP)
+	}
+	if !got.Status.PodScheduledTime.Time.Equal(scheduled.Time) {
+		t.Errorf("podScheduledTime = %v, want %v", got.Status.PodScheduledTime, scheduled)
+	}
+	if !got.Status.PodReadyTime.Time.Equal(ready.Time) {
+		t.Errorf("podReadyTime = %v, want %v", got.Status.PodReadyTime, ready)
+	}
+	if want := testEpoch.Add(time.Second); !got.Status.SSHReadyTime.Time.Equal(want) {
+		t.Errorf("sshReadyTime = %v, want %v", got.Status.SSHReadyTime, want)
+	}
+}
+
+func TestReconcileCreatingPodMissingFails(t *testing.T) {
+	r, clk := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhaseCreating))
+	clk.Step(time.Minute)
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if want := testEpoch.Add(time.Minute); !got.Status.CompletionTime.Time.Equal(want) {
+		t.Errorf("completionTime = %v, want %v", got.Status.CompletionTime, want)
+	}
+}
+
+func TestReconcileCreatingImagePullFails(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default"},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodPending,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "nix-builder",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+					Reason:  "ImagePullBackOff",
+					Message: "Back-off pulling image",
+				}},
+			}},
+		},
+	}
+	r, _ := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhaseCreating), pod)
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if code, _ := errcode.Parse(got.Status.Message); code != errcode.ImagePull {
+		t.Errorf("message = %q, want an %s message", got.Status.Message, errcode.ImagePull)
+	}
+}
+
+func TestReconcileBestEffortBuild(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	buildReq.Spec.BuildClass = nixv1alpha1.BuildClassBestEffort
+	r, _ := newTestReconciler(t, buildReq)
+	r.BestEffortPriorityClass = "nix-builder-best-effort"
+
+	_, got := reconcileOnce(t, r)
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatalf("builder pod not created: %v", err)
+	}
+	if pod.Spec.PriorityClassName != "nix-builder-best-effort" {
+		t.Errorf("priorityClassName = %q, want nix-builder-best-effort", pod.Spec.PriorityClassName)
+	}
+
+	pod.Status = corev1.PodStatus{
+		Phase: corev1.PodRunning,
+		Conditions: []corev1.PodCondition{{
+			Type:   corev1.DisruptionTarget,
+			Status: corev1.ConditionTrue,
+			Reason: corev1.PodReasonPreemptionByScheduler,
+		}},
+	}
+	if err := r.Status().Update(context.Background(), &pod); err != nil {
+		t.Fatal(err)
+	}
+
+	_, got = reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if code, _ := errcode.Parse(got.Status.Message); code != errcode.Preempted {
+		t.Errorf("message = %q, want an %s message", got.Status.Message, errcode.Preempted)
+	}
+}
+
+func TestDeletionObservesCompletionOnce(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseCompleted)
+	buildReq.DeletionTimestamp = &metav1.Time{Time: testEpoch}
+	r, _ := newTestReconciler(t, buildReq)
+	metrics, err := NewBuildMetrics(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Metrics = metrics
+	updates := 0
+	r.Client = interceptor.NewClient(r.Client.(client.WithWatch), interceptor.Funcs{
+		Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+			if updates++; updates == 1 {
+				return apierrors.NewConflict(nixv1alpha1.GroupVersion.WithResource("nixbuildrequests").GroupResource(), obj.GetName(), errors.New("stale"))
+			}
+			return c.Update(ctx, obj, opts...)
+		},
+	})
+
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(buildReq)}
+	if _, err := r.Reconcile(context.Background(), req); err == nil {
+		t.Fatal("Reconcile succeeded although removing the finalizer failed")
+	}
+	completed := metrics.completed.WithLabelValues(string(nixv1alpha1.BuildPhaseCompleted))
+	if got := testutil.ToFloat64(completed); got != 0 {
+		t.Errorf("completions = %v after the finalizer update failed, want 0", got)
+	}
+
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(completed); got != 1 {
+		t.Errorf("completions = %v once the finalizer is removed, want 1", got)
+	}
+}
+
+func TestReconcilePendingRejectsReusedSessionID(t *testing.T) {
+	owner := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	owner.Name = "build-aaa"
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, owner, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if code, text := errcode.Parse(got.Status.Message); code != errcode.Invalid || !strings.Contains(text, "default/build-aaa") {
+		t.Errorf("message = %q, want %s naming the request holding the ID", got.Status.Message, errcode.Invalid)
+	}
+}
+
+func TestReconcilePendingDryRun(t *testing.T) {
+	r, _ := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhasePending))
+	r.DryRun = true
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhasePending {
+		t.Errorf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhasePending)
+	}
+	var pods corev1.PodList
+	if err := r.List(context.Background(), &pods); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 0 {
+		t.Errorf("dry run created %d pods", len(pods.Items))
+	}
+}
+
+func TestGCRequestedDryRunKeepsBuildRequest(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseCompleted)
+	buildReq.Annotations = map[string]string{nixv1alpha1.GCRequestedAnnotation: "true"}
+	r, _ := newTestReconciler(t, buildReq)
+	r.DryRun = true
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Message != "Dry run: Would delete build request on behalf of the proxy" {
+		t.Errorf("message = %q, want the deletion recorded as a dry run", got.Status.Message)
+	}
+	if !got.DeletionTimestamp.IsZero() {
+		t.Error("build request was deleted in dry-run mode")
+	}
+}
+
+func TestGracefulShutdownOnlyOnLeader(t *testing.T) {
+	r, _ := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhasePending))
+	elected := make(chan struct{})
+	r.Elected = elected
+	key := client.ObjectKey{Namespace: "default", Name: "build-abc"}
+
+	if err := r.GracefulShutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got nixv1alpha1.NixBuildRequest
+	if err := r.Get(context.Background(), key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != nixv1alpha1.BuildPhasePending {
+		t.Fatalf("standby shutdown changed phase to %q", got.Status.Phase)
+	}
+
+	close(elected)
+	if err := r.GracefulShutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(context.Background(), key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Errorf("leader shutdown left phase %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+}
+
+func TestSetConditionTransitionTime(t *testing.T) {
+	r, clk := newTestReconciler(t)
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+
+	r.setCondition(buildReq, nixv1alpha1.BuildConditionPodReady, corev1.ConditionFalse, "Waiting", "")
+	clk.Step(time.Minute)
+	r.setCondition(buildReq, nixv1alpha1.BuildConditionPodReady, corev1.ConditionFalse, "StillWaiting", "")
+
+	cond := buildReq.Status.Conditions[0]
+	if !cond.LastTransitionTime.Time.Equal(testEpoch) {
+		t.Errorf("unchanged status moved lastTransitionTime to %v", cond.LastTransitionTime)
+	}
+	if cond.Reason != "StillWaiting" {
+		t.Errorf("reason = %q, want StillWaiting", cond.Reason)
+	}
+
+	r.setCondition(buildReq, nixv1alpha1.BuildConditionPodReady, corev1.ConditionTrue, "Ready", "")
+	if cond := buildReq.Status.Conditions[0]; !cond.LastTransitionTime.Time.Equal(testEpoch.Add(time.Minute)) {
+		t.Errorf("lastTransitionTime = %v, want %v", cond.LastTransitionTime, testEpoch.Add(time.Minute))
+	}
+}
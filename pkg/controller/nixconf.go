@@ -0,0 +1,246 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// knownNixSettings lists the nix.conf settings Nix understands, including
+// deprecated aliases. Nix ignores unknown settings with a warning that ends
+// up in the builder's log, where nobody reads it.
+var knownNixSettings = []string{
+	"accept-flake-config", "access-tokens", "allow-dirty", "allow-import-from-derivation",
+	"allow-new-privileges", "allow-symlinked-store", "allow-unsafe-native-code-during-evaluation",
+	"allowed-impure-host-deps", "allowed-uris", "allowed-users", "always-allow-substitutes",
+	"auto-allocate-uids", "auto-optimise-store", "bash-prompt", "bash-prompt-prefix",
+	"bash-prompt-suffix", "binary-cache-public-keys", "binary-caches", "build-cores",
+	"build-dir", "build-fallback", "build-hook", "build-max-jobs", "build-max-log-size",
+	"build-max-silent-time", "build-poll-interval", "build-timeout", "build-use-sandbox",
+	"build-use-substitutes", "build-users-group", "builders", "builders-use-substitutes",
+	"commit-lockfile-summary", "compress-build-log", "connect-timeout", "cores",
+	"debugger-on-trace", "diff-hook", "download-attempts", "download-buffer-size",
+	"download-speed", "env-keep-derivations", "eval-cache", "eval-system",
+	"experimental-features", "extra-platforms", "fallback", "filter-syscalls",
+	"flake-registry", "fsync-metadata", "gc-keep-derivations", "gc-keep-outputs",
+	"gc-reserved-space", "hashed-mirrors", "http-connections", "http2", "id-count",
+	"ignore-try", "impersonate-linux-26", "impure-env", "keep-build-log",
+	"keep-derivations", "keep-env-derivations", "keep-failed", "keep-going",
+	"keep-outputs", "log-lines", "max-build-log-size", "max-call-depth", "max-free",
+	"max-jobs", "max-silent-time", "max-substitution-jobs", "min-free",
+	"min-free-check-interval", "nar-buffer-size", "narinfo-cache-negative-ttl",
+	"narinfo-cache-positive-ttl", "netrc-file", "nix-path", "plugin-files",
+	"post-build-hook", "pre-build-hook", "preallocate-contents", "print-missing",
+	"pure-eval", "require-drop-supplementary-groups", "require-sigs", "restrict-eval",
+	"run-diff-hook", "sandbox", "sandbox-build-dir", "sandbox-dev-shm-size",
+	"sandbox-fallback", "sandbox-paths", "secret-key-files", "show-trace",
+	"ssl-cert-file", "stalled-download-timeout", "start-id", "store", "substitute",
+	"substituters", "sync-before-registering", "system", "system-features",
+	"tarball-ttl", "timeout", "trace-function-calls", "trace-verbose",
+	"trusted-binary-caches", "trusted-public-keys", "trusted-substituters",
+	"trusted-users", "upgrade-nix-store-path-url", "use-case-hack", "use-cgroups",
+	"use-registries", "use-sqlite-wal", "use-xdg-base-directories",
+	"user-agent-suffix", "warn-dirty",
+}
+
+// nixSettingAliases maps deprecated setting names to their current names
+var nixSettingAliases = map[string]string{
+	"binary-caches":            "substituters",
+	"binary-cache-public-keys": "trusted-public-keys",
+	"trusted-binary-caches":    "trusted-substituters",
+}
+
+// nixConfSetting is a single assignment in a nix.conf
+type nixConfSetting struct {
+	source string
+	line   int
+	name   string
+	value  string
+	// extra is set for extra-* settings, which append to the value instead
+	// of replacing it
+	extra bool
+}
+
+func (s nixConfSetting) String() string {
+	return fmt.Sprintf("%s line %d", s.source, s.line)
+}
+
+// parseNixConf parses nix.conf contents, returning its settings and the
+// problems that make it invalid
+func parseNixConf(source, contents string, allowInclude bool) ([]nixConfSetting, []string) {
+	var settings []nixConfSetting
+	var problems []string
+
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if fields := strings.Fields(line); fields[0] == "include" || fields[0] == "!include" {
+			if !allowInclude {
+				problems = append(problems, fmt.Sprintf("%s line %d: include directives are not supported", source, lineNo))
+			}
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s line %d: expected 'name = value'", source, lineNo))
+			continue
+		}
+
+		setting := nixConfSetting{source: source, line: lineNo, name: strings.TrimSpace(name), value: strings.TrimSpace(value)}
+		if base, ok := strings.CutPrefix(setting.name, "extra-"); ok {
+			setting.name, setting.extra = base, true
+		}
+		if !slices.Contains(knownNixSettings, setting.name) {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting %q", setting, strings.TrimSpace(name)))
+			continue
+		}
+		if alias, ok := nixSettingAliases[setting.name]; ok {
+			setting.name = alias
+		}
+		settings = append(settings, setting)
+	}
+	return settings, problems
+}
+
+// lintNixConf checks settings, in the order Nix applies them, for mistakes
+// that leave a valid but probably unintended configuration. It returns
+// problems that make the configuration invalid and warnings about it.
+func lintNixConf(settings []nixConfSetting) ([]string, []string) {
+	var problems, warnings []string
+
+	var substituters, keys []string
+	var substitutersSetAt *nixConfSetting
+	requireSigs := true
+	for _, setting := range settings {
+		switch setting.name {
+		case "substituters":
+			if !setting.extra {
+				if substitutersSetAt != nil && setting.value != strings.Join(substituters, " ") {
+					warnings = append(warnings, fmt.Sprintf("%s: substituters overrides the value set at %s", setting, substitutersSetAt))
+				}
+				substitutersSetAt = &setting
+				substituters = nil
+			}
+			for _, substituter := range strings.Fields(setting.value) {
+				if _, err := url.Parse(substituter); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: invalid substituter %q", setting, substituter))
+					continue
+				}
+				substituters = append(substituters, substituter)
+			}
+		case "trusted-public-keys":
+			if !setting.extra {
+				keys = nil
+			}
+			for _, key := range strings.Fields(setting.value) {
+				if name, _, ok := strings.Cut(key, ":"); !ok || name == "" {
+					problems = append(problems, fmt.Sprintf("%s: trusted public key %q is not of the form name:key", setting, key))
+					continue
+				}
+				keys = append(keys, key)
+			}
+		case "require-sigs":
+			requireSigs = setting.value != "false"
+		}
+	}
+
+	if requireSigs {
+		for _, substituter := range substituters {
+			if host, ok := substituterHost(substituter); ok && !hasKeyFor(keys, host) {
+				warnings = append(warnings, fmt.Sprintf("no trusted public key configured for substituter %s", substituter))
+			}
+		}
+	}
+	return problems, warnings
+}
+
+// substituterHost returns the host of a remote binary cache
+func substituterHost(substituter string) (string, bool) {
+	u, err := url.Parse(substituter)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	return u.Hostname(), true
+}
+
+// hasKeyFor reports whether any key is named after host, following the
+// usual <host>-<n>:<key> naming of binary cache signing keys
+func hasKeyFor(keys []string, host string) bool {
+	for _, key := range keys {
+		if name, _, _ := strings.Cut(key, ":"); strings.HasPrefix(name, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// lintNixConfig validates the --nix-config ConfigMap and the build request's
+// own settings together, as the builder will apply them
+func (r *NixBuildRequestReconciler) lintNixConfig(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) ([]string, []string, error) {
+	var settings []nixConfSetting
+	var problems []string
+
+	if r.NixConfigMap != "" {
+		contents, err := r.nixConfig(ctx, buildReq.Namespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		settings, problems = parseNixConf("--nix-config", contents, true)
+	}
+
+	specSettings, specProblems := parseNixConf("spec.nixConfig", buildReq.Spec.NixConfig, false)
+	settings = append(settings, specSettings...)
+	problems = append(problems, specProblems...)
+
+	lintProblems, warnings := lintNixConf(settings)
+	return append(problems, lintProblems...), warnings, nil
+}
+
+// nixConfig reads the nix.conf from the --nix-config ConfigMap
+func (r *NixBuildRequestReconciler) nixConfig(ctx context.Context, namespace string) (string, error) {
+	var configMap corev1.ConfigMap
+	if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: r.NixConfigMap}, &configMap); err != nil {
+		return "", fmt.Errorf("failed to get nix config %s: %w", r.NixConfigMap, err)
+	}
+	return configMap.Data[nixConfigKey], nil
+}
+
+// addNixConfig applies the build request's experimental features and extra
+// settings, followed by the controller's own settings, to the builder's Nix
+// daemon on top of whatever nix.conf sets
+func addNixConfig(pod *corev1.Pod, spec nixv1alpha1.NixBuildRequestSpec, controllerConfig []string) {
+	var lines []string
+	if len(spec.ExperimentalFeatures) > 0 {
+		lines = append(lines, "extra-experimental-features = "+strings.Join(spec.ExperimentalFeatures, " "))
+	}
+	if len(spec.RequiredFeatures) > 0 {
+		lines = append(lines, "extra-system-features = "+strings.Join(spec.RequiredFeatures, " "))
+	}
+	if spec.NixConfig != "" {
+		lines = append(lines, strings.TrimSpace(spec.NixConfig))
+	}
+	lines = append(lines, controllerConfig...)
+	if len(lines) == 0 {
+		return
+	}
+
+	container := &pod.Spec.Containers[0]
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "NIX_CONFIG",
+		Value: strings.Join(lines, "\n"),
+	})
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingInvalidNixConfig(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Spec.NixConfig = "max-job = 4\n"
+	r, _ := newTestReconciler(t, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if len(got.Status.Conditions) != 1 || got.Status.Conditions[0].Reason != "InvalidNixConfig" {
+		t.Errorf("conditions = %+v, want a single InvalidNixConfig condition", got.Status.Conditions)
+	}
+}
+
+func TestReconcilePendingNixConfigWarnings(t *testing.T) {
+	nixConfig := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "nix-config", Namespace: "default"},
+		Data: map[string]string{"nix.conf": "substituters = https://cache.nixos.org\n" +
+			"trusted-public-keys = cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY=\n"},
+	}
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Spec.NixConfig = "extra-substituters = https://example.cachix.org\n"
+	r, _ := newTestReconciler(t, buildReq, nixConfig)
+	r.NixConfigMap = "nix-config"
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseCreating {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseCreating)
+	}
+	if len(got.Status.Conditions) != 1 || got.Status.Conditions[0].Reason != "NixConfigWarnings" ||
+		!strings.Contains(got.Status.Conditions[0].Message, "https://example.cachix.org") {
+		t.Errorf("conditions = %+v, want a NixConfigWarnings condition for the cachix substituter", got.Status.Conditions)
+	}
+}
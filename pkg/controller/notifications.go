@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"context"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/notify"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/status"
+)
+
+// notifyFinished tells the notifier a build request finished, once. The
+// Notified condition records the attempt, so a failed delivery is reported
+// with a Warning event rather than retried on every reconcile.
+func (r *NixBuildRequestReconciler) notifyFinished(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) {
+	if r.Notifier == nil || !status.Finished(&buildReq.Status) || !r.notifiesOn(buildReq.Status.Phase) {
+		return
+	}
+	for _, condition := range buildReq.Status.Conditions {
+		if condition.Type == nixv1alpha1.BuildConditionNotified {
+			return
+		}
+	}
+
+	event := notificationFor(buildReq)
+	if err := r.Notifier.Notify(ctx, event); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to send build notification")
+		r.warningEvent(buildReq, EventNotificationFailed, "Failed to send build notification: %v", err)
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionNotified, corev1.ConditionFalse, "DeliveryFailed", err.Error())
+	} else {
+		log.Ctx(ctx).Info().Str("phase", event.Phase).Msg("Sent build notification")
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionNotified, corev1.ConditionTrue, "Sent", "Build notification sent")
+	}
+	if err := r.Status().Update(ctx, buildReq); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to record build notification")
+	}
+}
+
+// notifiesOn reports whether finishing in phase is notified
+func (r *NixBuildRequestReconciler) notifiesOn(phase nixv1alpha1.BuildPhase) bool {
+	if len(r.NotifyPhases) == 0 {
+		return true
+	}
+	return slices.Contains(r.NotifyPhases, phase)
+}
+
+// notificationFor describes a finished build request
+func notificationFor(buildReq *nixv1alpha1.NixBuildRequest) notify.Event {
+	finished := finishedAt(buildReq)
+	started := buildReq.CreationTimestamp.Time
+	if buildReq.Status.StartTime != nil {
+		started = buildReq.Status.StartTime.Time
+	}
+
+	event := notify.Event{
+		Name:           buildReq.Name,
+		Namespace:      buildReq.Namespace,
+		SessionID:      buildReq.Spec.SessionID,
+		Phase:          string(buildReq.Status.Phase),
+		Pod:            buildReq.Status.PodName,
+		Requester:      buildReq.Annotations[policy.RequesterAnnotation],
+		CompletionTime: finished,
+	}
+	if !started.IsZero() && finished.After(started) {
+		event.DurationSeconds = finished.Sub(started).Seconds()
+	}
+	code, message := errcode.Parse(buildReq.Status.Message)
+	event.Code, event.Message = string(code), message
+	return event
+}
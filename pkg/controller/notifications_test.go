@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/notify"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+// recordingNotifier records the notifications it is sent
+type recordingNotifier struct {
+	events []notify.Event
+	err    error
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, event notify.Event) error {
+	n.events = append(n.events, event)
+	return n.err
+}
+
+func TestReconcileFailedNotifiesOnce(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseFailed)
+	buildReq.Annotations = map[string]string{policy.RequesterAnnotation: "alice"}
+	buildReq.Status.StartTime = &metav1.Time{Time: testEpoch.Add(-3 * time.Minute)}
+	buildReq.Status.CompletionTime = &metav1.Time{Time: testEpoch.Add(-time.Minute)}
+	buildReq.Status.Message = errcode.Message(errcode.Timeout, "Builder not ready in time")
+	r, _ := newTestReconciler(t, buildReq)
+	notifier := &recordingNotifier{}
+	r.Notifier = notifier
+
+	reconcileOnce(t, r)
+	_, got := reconcileOnce(t, r)
+
+	if len(notifier.events) != 1 {
+		t.Fatalf("sent %d notifications, want 1", len(notifier.events))
+	}
+	event := notifier.events[0]
+	if event.Phase != "Failed" || event.Requester != "alice" || event.DurationSeconds != 120 {
+		t.Errorf("notification = %+v, want a 2m failed build requested by alice", event)
+	}
+	if event.Code != string(errcode.Timeout) || event.Message != "Builder not ready in time" {
+		t.Errorf("notification code, message = %q, %q", event.Code, event.Message)
+	}
+	if !hasCondition(got, nixv1alpha1.BuildConditionNotified, corev1.ConditionTrue) {
+		t.Errorf("conditions = %+v, want Notified", got.Status.Conditions)
+	}
+}
+
+func TestReconcileNotificationFailureIsReported(t *testing.T) {
+	r, _ := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhaseCompleted))
+	r.Notifier = &recordingNotifier{err: errors.New("webhook returned 500 Internal Server Error")}
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+
+	_, got := reconcileOnce(t, r)
+	if !hasCondition(got, nixv1alpha1.BuildConditionNotified, corev1.ConditionFalse) {
+		t.Errorf("conditions = %+v, want Notified False", got.Status.Conditions)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, EventNotificationFailed) {
+			t.Errorf("event = %q, want %s", event, EventNotificationFailed)
+		}
+	default:
+		t.Error("no event recorded for the failed notification")
+	}
+}
+
+func TestReconcileSkipsUnnotifiedPhases(t *testing.T) {
+	r, _ := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhaseCompleted))
+	notifier := &recordingNotifier{}
+	r.Notifier = notifier
+	r.NotifyPhases = []nixv1alpha1.BuildPhase{nixv1alpha1.BuildPhaseFailed}
+
+	reconcileOnce(t, r)
+	if len(notifier.events) != 0 {
+		t.Errorf("sent %+v for a phase that is not notified", notifier.events)
+	}
+}
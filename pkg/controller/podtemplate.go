@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// builderContainerName is the name of the container running sshd and the
+// Nix daemon in builder pods
+const builderContainerName = "nix-builder"
+
+// LoadPodTemplate reads a PodTemplateSpec that builder pods are merged with
+// from a YAML or JSON file, such as a mounted ConfigMap key
+func LoadPodTemplate(path string) (*corev1.PodTemplateSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read builder pod template: %w", err)
+	}
+
+	var template corev1.PodTemplateSpec
+	if err := yaml.UnmarshalStrict(data, &template); err != nil {
+		return nil, fmt.Errorf("failed to parse builder pod template: %w", err)
+	}
+	names := make(map[string]bool)
+	for _, container := range slices.Concat(template.Spec.InitContainers, template.Spec.Containers) {
+		if container.Name == "" {
+			return nil, fmt.Errorf("builder pod template containers must be named")
+		}
+		if names[container.Name] {
+			return nil, fmt.Errorf("builder pod template has two containers named %q", container.Name)
+		}
+		names[container.Name] = true
+	}
+	for _, container := range template.Spec.Containers {
+		if container.Name == builderContainerName && container.Image != "" {
+			return nil, fmt.Errorf("the %s container's image is set by the controller", builderContainerName)
+		}
+	}
+	return &template, nil
+}
+
+// applyPodTemplate merges the builder pod template into a pod the controller
+// built. The controller's own labels, annotations, volumes and container
+// settings take precedence. A template container named nix-builder adds to
+// the builder container; other containers run as sidecars.
+func applyPodTemplate(pod *corev1.Pod, template *corev1.PodTemplateSpec) {
+	if template == nil {
+		return
+	}
+	pod.Labels = mergeMissing(pod.Labels, template.Labels)
+	pod.Annotations = mergeMissing(pod.Annotations, template.Annotations)
+
+	spec := &pod.Spec
+	applyPodPlacement(spec, &template.Spec)
+	spec.InitContainers = append(spec.InitContainers, template.Spec.InitContainers...)
+	for _, container := range template.Spec.Containers {
+		if container.Name != builderContainerName {
+			spec.Containers = append(spec.Containers, container)
+			continue
+		}
+		builder := &spec.Containers[0]
+		builder.Env = append(builder.Env, container.Env...)
+		builder.EnvFrom = append(builder.EnvFrom, container.EnvFrom...)
+		builder.VolumeMounts = append(builder.VolumeMounts, container.VolumeMounts...)
+		if builder.SecurityContext == nil {
+			builder.SecurityContext = container.SecurityContext
+		}
+		if len(builder.Resources.Requests) == 0 && len(builder.Resources.Limits) == 0 {
+			builder.Resources = container.Resources
+		}
+		if builder.ImagePullPolicy == "" {
+			builder.ImagePullPolicy = container.ImagePullPolicy
+		}
+	}
+	for _, volume := range template.Spec.Volumes {
+		if !hasVolume(pod, volume.Name) {
+			spec.Volumes = append(spec.Volumes, volume)
+		}
+	}
+	if spec.ServiceAccountName == "" {
+		spec.ServiceAccountName = template.Spec.ServiceAccountName
+	}
+	if spec.AutomountServiceAccountToken == nil {
+		spec.AutomountServiceAccountToken = template.Spec.AutomountServiceAccountToken
+	}
+	if spec.PriorityClassName == "" {
+		spec.PriorityClassName = template.Spec.PriorityClassName
+	}
+	if spec.TerminationGracePeriodSeconds == nil {
+		spec.TerminationGracePeriodSeconds = template.Spec.TerminationGracePeriodSeconds
+	}
+	spec.TopologySpreadConstraints = append(spec.TopologySpreadConstraints, template.Spec.TopologySpreadConstraints...)
+	spec.HostAliases = append(spec.HostAliases, template.Spec.HostAliases...)
+	if spec.DNSConfig == nil {
+		spec.DNSConfig = template.Spec.DNSConfig
+	}
+}
+
+// applyPodPlacement merges the template settings that decide where and how a
+// pod can run, which image validation pods share with builder pods
+func applyPodPlacement(spec *corev1.PodSpec, template *corev1.PodSpec) {
+	spec.NodeSelector = mergeMissing(spec.NodeSelector, template.NodeSelector)
+	spec.Tolerations = append(spec.Tolerations, template.Tolerations...)
+	if spec.Affinity == nil {
+		spec.Affinity = template.Affinity
+	}
+	spec.ImagePullSecrets = append(spec.ImagePullSecrets, template.ImagePullSecrets...)
+	if spec.RuntimeClassName == nil {
+		spec.RuntimeClassName = template.RuntimeClassName
+	}
+	if spec.SecurityContext == nil {
+		spec.SecurityContext = template.SecurityContext
+	}
+}
+
+// hasVolume reports whether a pod already has a volume with the given name
+func hasVolume(pod *corev1.Pod, name string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeMissing adds the entries of extra that are not already in m
+func mergeMissing(m, extra map[string]string) map[string]string {
+	if len(extra) == 0 {
+		return m
+	}
+	merged := maps.Clone(extra)
+	maps.Copy(merged, m)
+	return merged
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestReconcilePendingAppliesPodTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "template.yaml")
+	template := `
+metadata:
+  labels:
+    app: overridden
+    team: build-infra
+spec:
+  runtimeClassName: gvisor
+  tolerations:
+    - key: dedicated
+      value: nix-builders
+      effect: NoSchedule
+  containers:
+    - name: nix-builder
+      env:
+        - name: EXTRA
+          value: "1"
+    - name: log-shipper
+      image: log-shipper:test
+`
+	if err := os.WriteFile(path, []byte(template), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	podTemplate, err := LoadPodTemplate(path)
+	if err != nil {
+		t.Fatalf("LoadPodTemplate: %v", err)
+	}
+
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, buildReq)
+	r.PodTemplate = podTemplate
+
+	_, got := reconcileOnce(t, r)
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatalf("builder pod not created: %v", err)
+	}
+	if pod.Labels["app"] != "nix-builder" || pod.Labels["team"] != "build-infra" {
+		t.Errorf("labels = %v, want app=nix-builder and team=build-infra", pod.Labels)
+	}
+	if pod.Spec.RuntimeClassName == nil || *pod.Spec.RuntimeClassName != "gvisor" {
+		t.Errorf("runtimeClassName = %v, want gvisor", pod.Spec.RuntimeClassName)
+	}
+	if len(pod.Spec.Tolerations) != 1 {
+		t.Errorf("tolerations = %v, want the template's", pod.Spec.Tolerations)
+	}
+	if len(pod.Spec.Containers) != 2 || pod.Spec.Containers[0].Image != "builder:test" || pod.Spec.Containers[1].Name != "log-shipper" {
+		t.Fatalf("containers = %+v, want the builder followed by the log-shipper sidecar", pod.Spec.Containers)
+	}
+	if !slices.Contains(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "EXTRA", Value: "1"}) {
+		t.Errorf("builder env = %v, want EXTRA=1", pod.Spec.Containers[0].Env)
+	}
+}
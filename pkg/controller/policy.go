@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+// checkPolicy evaluates the configured policy for a pending build request.
+// It returns false after marking the request failed if the policy denied it.
+// Errors reaching the policy are returned unless PolicyFailOpen is set.
+func (r *NixBuildRequestReconciler) checkPolicy(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (bool, error) {
+	decision, err := r.Policy.Check(ctx, policy.InputFor(buildReq))
+	if err != nil {
+		if !r.PolicyFailOpen {
+			return false, fmt.Errorf("policy check failed: %w", err)
+		}
+		log.Ctx(ctx).Warn().Err(err).Msg("Policy check failed, allowing build request")
+		decision = policy.Decision{Allowed: true, Message: fmt.Sprintf("Policy check failed open: %v", err)}
+	}
+
+	if !decision.Allowed {
+		message := decision.Message
+		if message == "" {
+			message = "build request denied by policy"
+		}
+		log.Ctx(ctx).Info().Str("reason", message).Msg("Build request denied by policy")
+
+		r.setCondition(buildReq, nixv1alpha1.BuildConditionPolicyAllowed, corev1.ConditionFalse, "PolicyDenied", message)
+		r.failBuild(buildReq, errcode.Auth, "Denied by policy: %s", message)
+		return false, nil
+	}
+
+	r.setCondition(buildReq, nixv1alpha1.BuildConditionPolicyAllowed, corev1.ConditionTrue, "PolicyAllowed", decision.Message)
+	return true, nil
+}
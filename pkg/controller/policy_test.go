@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+type staticChecker policy.Decision
+
+func (c staticChecker) Check(ctx context.Context, input policy.Input) (policy.Decision, error) {
+	return policy.Decision(c), nil
+}
+
+type failingChecker struct{}
+
+func (failingChecker) Check(ctx context.Context, input policy.Input) (policy.Decision, error) {
+	return policy.Decision{}, errors.New("opa unreachable")
+}
+
+func TestPolicyWebhook(t *testing.T) {
+	ctx := context.Background()
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+
+	deny := &PolicyWebhook{Policy: policy.All{staticChecker{Allowed: true}, staticChecker{Message: "image not allowed"}}}
+	if _, err := deny.ValidateCreate(ctx, buildReq); err == nil || err.Error() != "denied by policy: image not allowed" {
+		t.Errorf("ValidateCreate = %v, want denied by policy", err)
+	}
+	allow := &PolicyWebhook{Policy: policy.All{staticChecker{Allowed: true}}}
+	if _, err := allow.ValidateCreate(ctx, buildReq); err != nil {
+		t.Errorf("ValidateCreate = %v, want allowed", err)
+	}
+
+	// Status updates of an admitted request are not checked again, spec
+	// changes are
+	updated := buildReq.DeepCopy()
+	updated.Status.Phase = nixv1alpha1.BuildPhaseRunning
+	if _, err := deny.ValidateUpdate(ctx, buildReq, updated); err != nil {
+		t.Errorf("ValidateUpdate of the status = %v, want allowed", err)
+	}
+	updated.Spec.System = "aarch64-linux"
+	if _, err := deny.ValidateUpdate(ctx, buildReq, updated); err == nil {
+		t.Error("ValidateUpdate of the spec was allowed")
+	}
+
+	unreachable := &PolicyWebhook{Policy: failingChecker{}}
+	if _, err := unreachable.ValidateCreate(ctx, buildReq); err == nil {
+		t.Error("ValidateCreate allowed a request the policy could not evaluate")
+	}
+	unreachable.FailOpen = true
+	if warnings, err := unreachable.ValidateCreate(ctx, buildReq); err != nil || len(warnings) != 1 {
+		t.Errorf("ValidateCreate failing open = %v, %v, want a warning", warnings, err)
+	}
+}
+
+func TestReconcilePendingPolicyDenied(t *testing.T) {
+	r, _ := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhasePending))
+	r.Policy = staticChecker{Allowed: false, Message: "image not allowed"}
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if len(got.Status.Conditions) != 1 || got.Status.Conditions[0].Reason != "PolicyDenied" {
+		t.Errorf("conditions = %+v, want a single PolicyDenied condition", got.Status.Conditions)
+	}
+}
@@ -0,0 +1,452 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/logging"
+)
+
+const (
+	// PoolLabel marks idle builder pods in the warm pool. It is removed when
+	// a pod is assigned to a build request.
+	PoolLabel = "nix.io/pool"
+	// PoolLabelWarm is the PoolLabel value for idle pooled pods
+	PoolLabelWarm = "warm"
+	// PoolVariantLabel names the pool variant a pooled pod was created for.
+	// Idle pods without it belong to DefaultPoolVariant.
+	PoolVariantLabel = "nix.io/pool-variant"
+	// DefaultPoolVariant is the variant of WarmPoolSize pods with the
+	// controller's default builder configuration
+	DefaultPoolVariant = "default"
+
+	// poolRefreshInterval is how often the warm pool is topped up
+	poolRefreshInterval = 10 * time.Second
+	// poolPodMaxAge recycles idle pooled pods well before their builder
+	// certificate expires
+	poolPodMaxAge = 12 * time.Hour
+)
+
+// PoolVariant is one flavor of warm builder pod. A build request is served
+// by the first variant whose builders satisfy its system, image,
+// experimental features and resources.
+type PoolVariant struct {
+	// Name identifies the variant in the PoolVariantLabel of its pods
+	Name string `json:"name"`
+	// System is the Nix system of the variant's builders
+	System string `json:"system,omitempty"`
+	// Image replaces the builder image for the system
+	Image string `json:"image,omitempty"`
+	// ExperimentalFeatures are enabled on the variant's builders
+	ExperimentalFeatures []string `json:"experimentalFeatures,omitempty"`
+	// Resources of the variant's builders. Requests asking for no more than
+	// these are served by the variant.
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Min idle pods of the variant are kept warm
+	Min int `json:"min"`
+	// Max bounds the variant's pods, idle or assigned, so the pool stops
+	// warming more while that many are in use. Zero is unbounded.
+	Max int `json:"max,omitempty"`
+}
+
+// LoadPoolVariants reads a list of warm pool variants from a YAML or JSON
+// file
+func LoadPoolVariants(path string) ([]PoolVariant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pool variants: %w", err)
+	}
+
+	var variants []PoolVariant
+	if err := yaml.UnmarshalStrict(data, &variants); err != nil {
+		return nil, fmt.Errorf("failed to parse pool variants: %w", err)
+	}
+	names := make(map[string]bool, len(variants))
+	for _, variant := range variants {
+		switch {
+		case variant.Name == DefaultPoolVariant:
+			return nil, fmt.Errorf("pool variant name %q is reserved for --warm-pool-size", DefaultPoolVariant)
+		case len(validation.IsValidLabelValue(variant.Name)) > 0 || variant.Name == "":
+			return nil, fmt.Errorf("pool variant name %q is not a valid label value", variant.Name)
+		case names[variant.Name]:
+			return nil, fmt.Errorf("duplicate pool variant %q", variant.Name)
+		case variant.Min < 0 || (variant.Max != 0 && variant.Max < variant.Min):
+			return nil, fmt.Errorf("pool variant %q: max must be zero or at least min", variant.Name)
+		}
+		names[variant.Name] = true
+	}
+	return variants, nil
+}
+
+// warmPoolVariants returns the configured variants, led by the default
+// variant when WarmPoolSize is set
+func (r *NixBuildRequestReconciler) warmPoolVariants() []PoolVariant {
+	if r.WarmPoolSize <= 0 {
+		return r.WarmPoolVariants
+	}
+	return append([]PoolVariant{{Name: DefaultPoolVariant, Min: r.WarmPoolSize}}, r.WarmPoolVariants...)
+}
+
+// poolVariantFor returns the first pool variant that can serve a build
+// request, or nil if the request needs a builder of its own
+func (r *NixBuildRequestReconciler) poolVariantFor(buildReq *nixv1alpha1.NixBuildRequest) *PoolVariant {
+	spec := buildReq.Spec
+	if r.ManageBuilderUsers ||
+		buildReq.Namespace != r.WarmPoolNamespace ||
+		len(spec.NodeSelector) != 0 ||
+		len(spec.RequiredFeatures) != 0 ||
+		len(spec.Devices) != 0 ||
+		spec.TimeoutSeconds != nil ||
+		spec.CacheCredentials != nil ||
+		spec.CachePush != nil ||
+		len(spec.BuildSecrets) != 0 ||
+		spec.NixConfig != "" ||
+		spec.ClientPublicKey != "" ||
+		spec.Credentials != nil ||
+		spec.BuildClass != "" ||
+		r.isolateInNamespace(buildReq) ||
+		spec.Storage != nil || r.DefaultStorage.Type == nixv1alpha1.StorageSession {
+		return nil
+	}
+
+	for _, variant := range r.warmPoolVariants() {
+		if spec.System != variant.System {
+			continue
+		}
+		if spec.Image != "" && spec.Image != r.variantImage(variant) {
+			continue
+		}
+		if !slices.ContainsFunc(spec.ExperimentalFeatures, func(feature string) bool {
+			return !slices.Contains(variant.ExperimentalFeatures, feature)
+		}) &&
+			resourcesWithin(spec.Resources.Requests, variant.Resources.Requests) &&
+			resourcesWithin(spec.Resources.Limits, variant.Resources.Limits) {
+			return &variant
+		}
+	}
+	return nil
+}
+
+// resourcesWithin reports whether every quantity in want is at most the
+// one in have
+func resourcesWithin(want, have corev1.ResourceList) bool {
+	for name, quantity := range want {
+		limit, ok := have[name]
+		if !ok || quantity.Cmp(limit) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// variantPlaceholder is the build request a pool variant's pods are created
+// from
+func (r *NixBuildRequestReconciler) variantPlaceholder(variant PoolVariant) *nixv1alpha1.NixBuildRequest {
+	return &nixv1alpha1.NixBuildRequest{
+		ObjectMeta: metav1.ObjectMeta{Namespace: r.WarmPoolNamespace},
+		Spec: nixv1alpha1.NixBuildRequestSpec{
+			SessionID:            "pool-" + uuid.New().String()[:8],
+			System:               variant.System,
+			Image:                variant.Image,
+			ExperimentalFeatures: variant.ExperimentalFeatures,
+			Resources:            variant.Resources,
+		},
+	}
+}
+
+// variantImage returns the builder image of a pool variant's pods
+func (r *NixBuildRequestReconciler) variantImage(variant PoolVariant) string {
+	placeholder := r.variantPlaceholder(variant)
+	system, _ := r.systemBuilder(placeholder)
+	return r.getBuilderImage(placeholder, system)
+}
+
+// poolPodVariant returns the pool variant of a pooled pod
+func poolPodVariant(pod *corev1.Pod) string {
+	if variant, ok := pod.Labels[PoolVariantLabel]; ok {
+		return variant
+	}
+	if pod.Labels[PoolLabel] == PoolLabelWarm {
+		return DefaultPoolVariant
+	}
+	return ""
+}
+
+// claimPooledPod assigns an idle pooled pod of the variant to a build
+// request, returning nil if the variant has none. Ready pods are preferred,
+// oldest first.
+//
+// A claim is a single update of the pod that removes PoolLabel and makes the
+// build request its owner. The update carries the resourceVersion the pod was
+// listed with, so of two claims racing for a pod exactly one succeeds and the
+// other moves on to the next candidate. Recycling idle pods deletes them with
+// the same precondition, so a pod is never deleted after it was claimed.
+func (r *NixBuildRequestReconciler) claimPooledPod(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest, variant string) (*corev1.Pod, error) {
+	// A claim whose status update failed is picked up again instead of
+	// taking a second pod
+	var claimed corev1.PodList
+	if err := r.List(ctx, &claimed, client.InNamespace(r.WarmPoolNamespace), client.MatchingLabels{"nix.io/build-request": buildReq.Name}); err != nil {
+		return nil, fmt.Errorf("failed to list claimed pods: %w", err)
+	}
+	for i := range claimed.Items {
+		pod := &claimed.Items[i]
+		if pod.Labels[PoolVariantLabel] == variant && metav1.IsControlledBy(pod, buildReq) && pod.DeletionTimestamp.IsZero() {
+			return pod, nil
+		}
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(r.WarmPoolNamespace), client.MatchingLabels{PoolLabel: PoolLabelWarm}); err != nil {
+		return nil, fmt.Errorf("failed to list pooled pods: %w", err)
+	}
+
+	candidates := make([]*corev1.Pod, 0, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if poolPodVariant(pod) == variant && pod.DeletionTimestamp.IsZero() && pod.Status.Phase != corev1.PodFailed && pod.Status.Phase != corev1.PodSucceeded {
+			candidates = append(candidates, pod)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b *corev1.Pod) int {
+		if ra, rb := isPodReady(a), isPodReady(b); ra != rb {
+			if ra {
+				return -1
+			}
+			return 1
+		}
+		return a.CreationTimestamp.Compare(b.CreationTimestamp.Time)
+	})
+
+	for _, pod := range candidates {
+		delete(pod.Labels, PoolLabel)
+		pod.Labels[PoolVariantLabel] = variant
+		pod.Labels["nix.io/session-id"] = buildReq.Spec.SessionID
+		pod.Labels["nix.io/build-request"] = buildReq.Name
+		setSessionAnnotations(pod, buildReq)
+		setRequesterLabel(pod, buildReq)
+		pod.Annotations[SafeToEvictAnnotation] = "false"
+		pod.OwnerReferences = []metav1.OwnerReference{buildRequestOwnerReference(buildReq)}
+
+		if err := r.Update(ctx, pod); err != nil {
+			if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+				log.Ctx(ctx).Debug().Str("pod_name", pod.Name).Str("variant", variant).Msg("Lost pooled builder pod to another claim")
+				r.Metrics.ObservePoolClaimConflict(variant)
+				continue
+			}
+			return nil, fmt.Errorf("failed to claim pooled pod %s: %w", pod.Name, err)
+		}
+		return pod, nil
+	}
+	return nil, nil
+}
+
+// MaintainWarmPool keeps the idle builder pods of every pool variant running
+// until ctx is cancelled
+func (r *NixBuildRequestReconciler) MaintainWarmPool(ctx context.Context) error {
+	logging.Component(logging.ComponentPool).Info().Int("variants", len(r.warmPoolVariants())).Str("namespace", r.WarmPoolNamespace).Msg("Maintaining warm builder pool")
+
+	ticker := time.NewTicker(poolRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if r.NetworkPolicy != nil && !r.DryRun {
+			owner := builderOwner{
+				Namespace: r.WarmPoolNamespace,
+				Labels:    map[string]string{"app": "nix-builder", ManagedByLabel: ManagedByValue},
+			}
+			if err := r.ensureBuilderNetworkPolicy(ctx, owner, warmPoolNetworkPolicyName, map[string]string{PoolLabel: PoolLabelWarm}); err != nil {
+				logging.Component(logging.ComponentPool).Error().Err(err).Msg("Failed to isolate warm builder pool")
+			}
+		}
+		if disabled, err := r.warmPoolDisabled(ctx); err != nil {
+			logging.Component(logging.ComponentPool).Error().Err(err).Msg("Failed to check whether provisioning is disabled")
+		} else if !disabled {
+			if err := r.refillWarmPool(ctx); err != nil {
+				logging.Component(logging.ComponentPool).Error().Err(err).Msg("Failed to refill warm builder pool")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// warmPoolDisabled reports whether the kill switch stops refilling the pool
+func (r *NixBuildRequestReconciler) warmPoolDisabled(ctx context.Context) (bool, error) {
+	if r.Provisioning == nil {
+		return false, nil
+	}
+	state, err := r.Provisioning.State(ctx)
+	return state.Disabled, err
+}
+
+// refillWarmPool removes failed, stale, outdated or unconfigured pooled pods
+// and creates new ones until every variant is back at its minimum
+func (r *NixBuildRequestReconciler) refillWarmPool(ctx context.Context) error {
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(r.WarmPoolNamespace), client.MatchingLabels{"app": "nix-builder"}); err != nil {
+		return fmt.Errorf("failed to list pooled pods: %w", err)
+	}
+
+	variants := r.warmPoolVariants()
+	idle := make(map[string]int, len(variants))
+	total := make(map[string]int, len(variants))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		variant := poolPodVariant(pod)
+		if variant == "" || !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		finished := pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded
+		if pod.Labels[PoolLabel] != PoolLabelWarm {
+			// Assigned pods still count toward their variant's maximum
+			if !finished {
+				total[variant]++
+			}
+			continue
+		}
+
+		stale := r.now().Sub(pod.CreationTimestamp.Time) > poolPodMaxAge
+		i := slices.IndexFunc(variants, func(v PoolVariant) bool { return v.Name == variant })
+		unknown := i < 0
+		// The builder image may have changed since the pod was created
+		outdated := !unknown && pod.Spec.Containers[0].Image != r.variantImage(variants[i])
+		if finished || stale || unknown || outdated {
+			logging.Component(logging.ComponentPool).Info().Str("pod_name", pod.Name).Str("variant", variant).Str("phase", string(pod.Status.Phase)).Bool("stale", stale).Bool("unknown_variant", unknown).Bool("outdated", outdated).Bool("dry_run", r.DryRun).Msg("Recycling pooled builder pod")
+			if !r.DryRun {
+				err := r.Delete(ctx, pod, client.Preconditions{UID: &pod.UID, ResourceVersion: &pod.ResourceVersion})
+				if apierrors.IsConflict(err) {
+					logging.Component(logging.ComponentPool).Info().Str("pod_name", pod.Name).Msg("Pooled builder pod was claimed before it could be recycled")
+				} else if client.IgnoreNotFound(err) != nil {
+					logging.Component(logging.ComponentPool).Error().Err(err).Str("pod_name", pod.Name).Msg("Failed to delete pooled builder pod")
+				}
+			}
+			continue
+		}
+		idle[variant]++
+		total[variant]++
+	}
+
+	for _, variant := range variants {
+		if r.ValidateImages {
+			placeholder := r.variantPlaceholder(variant)
+			system, err := r.systemBuilder(placeholder)
+			if err != nil {
+				return fmt.Errorf("pool variant %s: %w", variant.Name, err)
+			}
+			state, _, err := r.validateImage(ctx, r.getBuilderImage(placeholder, system), builderNodeSelector(system, placeholder))
+			if err != nil {
+				return err
+			}
+			if state != imageValidated {
+				continue
+			}
+		}
+		for ; idle[variant.Name] < variant.Min && (variant.Max == 0 || total[variant.Name] < variant.Max); idle[variant.Name]++ {
+			if err := r.createPooledPod(ctx, variant); err != nil {
+				return err
+			}
+			total[variant.Name]++
+		}
+	}
+	return nil
+}
+
+// createPooledPod starts an idle builder pod of a pool variant. Its secrets
+// are owned by the pod, which is in turn owned by the build request that
+// later claims it.
+func (r *NixBuildRequestReconciler) createPooledPod(ctx context.Context, variant PoolVariant) error {
+	placeholder := r.variantPlaceholder(variant)
+	if _, err := r.systemBuilder(placeholder); err != nil {
+		return fmt.Errorf("pool variant %s: %w", variant.Name, err)
+	}
+	if _, err := r.resolveExperimentalFeatures(ctx, placeholder); err != nil {
+		return fmt.Errorf("pool variant %s: %w", variant.Name, err)
+	}
+
+	pod := r.createBuilderPod(placeholder)
+	pod.Labels = map[string]string{
+		"app":            "nix-builder",
+		ManagedByLabel:   ManagedByValue,
+		PoolLabel:        PoolLabelWarm,
+		PoolVariantLabel: variant.Name,
+	}
+	pod.Annotations = map[string]string{
+		MOTDAnnotation:        fmt.Sprintf("Idle pooled Nix builder (%s), not yet assigned to a session\n", variant.Name),
+		SafeToEvictAnnotation: "true",
+	}
+	if r.PodTemplate != nil {
+		pod.Labels = mergeMissing(pod.Labels, r.PodTemplate.Labels)
+		pod.Annotations = mergeMissing(pod.Annotations, r.PodTemplate.Annotations)
+	}
+	pod.OwnerReferences = nil
+	if storage := r.storageFor(placeholder); storage != nil && storage.Type == nixv1alpha1.StorageShared {
+		addStoreVolume(pod, storeClaimName(storage, pod.Name))
+	}
+
+	if r.DryRun {
+		logging.Component(logging.ComponentPool).Info().Str("pod_name", pod.Name).Str("variant", variant.Name).Bool("dry_run", true).Msg("Would create pooled builder pod")
+		return nil
+	}
+
+	if err := r.Create(ctx, pod); err != nil {
+		return fmt.Errorf("failed to create pooled builder pod: %w", err)
+	}
+
+	owner := builderOwner{
+		Namespace: pod.Namespace,
+		Labels: map[string]string{
+			"app":          "nix-builder",
+			ManagedByLabel: ManagedByValue,
+		},
+		OwnerReferences: []metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       pod.Name,
+			UID:        pod.UID,
+			Controller: &[]bool{true}[0],
+		}},
+	}
+	if _, err := r.ensureBuilderHostKey(ctx, owner, pod.Name); err != nil {
+		return err
+	}
+	if r.Vault != nil {
+		if err := r.ensureAuthorizedKeysFromVault(ctx, owner, pod.Name); err != nil {
+			return err
+		}
+	}
+	if r.BuilderTLSSecret != "" {
+		if err := r.ensureBuilderTLS(ctx, owner, pod.Name); err != nil {
+			return err
+		}
+	}
+	if r.AgentPort != 0 {
+		if err := r.ensureAgentToken(ctx, owner, pod.Name); err != nil {
+			return err
+		}
+	}
+	if r.signsOutputs(placeholder) {
+		if err := r.ensureSigningToken(ctx, owner, pod.Name); err != nil {
+			return err
+		}
+	}
+
+	logging.Component(logging.ComponentPool).Info().Str("pod_name", pod.Name).Str("variant", variant.Name).Msg("Created pooled builder pod")
+	return nil
+}
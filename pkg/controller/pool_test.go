@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingClaimsPooledPod(t *testing.T) {
+	pooled := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "nix-builder-pool-1",
+			Namespace:   "default",
+			Labels:      map[string]string{"app": "nix-builder", PoolLabel: PoolLabelWarm},
+			Annotations: map[string]string{SafeToEvictAnnotation: "true"},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	hostKey := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: hostKeySecretName(pooled.Name), Namespace: "default"},
+		Data:       map[string][]byte{HostKeyPublicKey: []byte("ssh-ed25519 AAAA pool\n")},
+	}
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, buildReq, pooled, hostKey)
+	r.WarmPoolSize = 1
+	r.WarmPoolNamespace = "default"
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.PodName != pooled.Name {
+		t.Fatalf("podName = %q, want %q", got.Status.PodName, pooled.Name)
+	}
+	if got.Status.HostKey != "ssh-ed25519 AAAA pool" {
+		t.Errorf("hostKey = %q, want the pooled pod's key", got.Status.HostKey)
+	}
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(pooled), &pod); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pod.Labels[PoolLabel]; ok {
+		t.Errorf("claimed pod still has the %s label", PoolLabel)
+	}
+	if pod.Labels["nix.io/build-request"] != got.Name {
+		t.Errorf("build-request label = %q, want %q", pod.Labels["nix.io/build-request"], got.Name)
+	}
+	if pod.Annotations[SafeToEvictAnnotation] != "false" {
+		t.Errorf("claimed pod %s = %q, want false", SafeToEvictAnnotation, pod.Annotations[SafeToEvictAnnotation])
+	}
+
+	var pods corev1.PodList
+	if err := r.List(context.Background(), &pods); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 1 {
+		t.Errorf("found %d pods, want only the pooled pod", len(pods.Items))
+	}
+}
+
+func TestReconcilePendingReusesEarlierPoolClaim(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.UID = "uid-abc"
+	buildReq.Status.PodName = ""
+	claimed := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nix-builder-pool-1",
+			Namespace: "default",
+			Labels: map[string]string{
+				"app":                  "nix-builder",
+				PoolVariantLabel:       DefaultPoolVariant,
+				"nix.io/build-request": buildReq.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{buildRequestOwnerReference(buildReq)},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	idle := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nix-builder-pool-2",
+			Namespace: "default",
+			Labels:    map[string]string{"app": "nix-builder", PoolLabel: PoolLabelWarm},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	hostKey := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: hostKeySecretName(claimed.Name), Namespace: "default"},
+		Data:       map[string][]byte{HostKeyPublicKey: []byte("ssh-ed25519 AAAA pool\n")},
+	}
+	r, _ := newTestReconciler(t, buildReq, claimed, idle, hostKey)
+	r.WarmPoolSize = 1
+	r.WarmPoolNamespace = "default"
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.PodName != claimed.Name {
+		t.Fatalf("podName = %q, want the previously claimed pod %q", got.Status.PodName, claimed.Name)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(idle), idle); err != nil {
+		t.Fatal(err)
+	}
+	if idle.Labels[PoolLabel] != PoolLabelWarm {
+		t.Error("idle pooled pod was claimed as well")
+	}
+}
+
+func TestReconcilePendingClaimsMatchingPoolVariant(t *testing.T) {
+	pooledPod := func(name string, labels map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+	}
+	defaultPod := pooledPod("nix-builder-pool-1", map[string]string{"app": "nix-builder", PoolLabel: PoolLabelWarm})
+	armPod := pooledPod("nix-builder-pool-2", map[string]string{"app": "nix-builder", PoolLabel: PoolLabelWarm, PoolVariantLabel: "arm-ca"})
+	hostKey := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: hostKeySecretName(armPod.Name), Namespace: "default"},
+		Data:       map[string][]byte{HostKeyPublicKey: []byte("ssh-ed25519 AAAA arm\n")},
+	}
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Status.PodName = ""
+	buildReq.Spec.System = "aarch64-linux"
+	buildReq.Spec.ExperimentalFeatures = []string{"ca-derivations"}
+	r, _ := newTestReconciler(t, buildReq, defaultPod, armPod, hostKey)
+	r.WarmPoolSize = 1
+	r.WarmPoolNamespace = "default"
+	r.WarmPoolVariants = []PoolVariant{
+		{Name: "arm", System: "aarch64-linux", Min: 1},
+		{Name: "arm-ca", System: "aarch64-linux", ExperimentalFeatures: []string{"ca-derivations", "flakes"}, Min: 1},
+	}
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.PodName != armPod.Name {
+		t.Fatalf("podName = %q, want the arm-ca variant's pod %q", got.Status.PodName, armPod.Name)
+	}
+	if want := []string{"ca-derivations", "flakes"}; !slices.Equal(got.Status.ExperimentalFeatures, want) {
+		t.Errorf("experimentalFeatures = %v, want %v", got.Status.ExperimentalFeatures, want)
+	}
+}
@@ -0,0 +1,433 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+const (
+	// prefetchDeadline bounds a prefetch pod's run, including pulling the
+	// image
+	prefetchDeadline int64 = 3600
+	// prefetchPollInterval is how often a running prefetch's pod is checked
+	prefetchPollInterval = 15 * time.Second
+)
+
+// prefetchScript fetches each flake reference it is given into the store,
+// then copies them to the binary cache when CACHE_PUSH_URL is set, with the
+// credentials the cache push hook of the builder image uses
+const prefetchScript = `set -eu
+nix() { command nix --extra-experimental-features 'nix-command flakes' "$@"; }
+paths=""
+for ref in "$@"; do
+  path=$(nix flake prefetch --json "$ref" | sed -n 's/.*"storePath": *"\([^"]*\)".*/\1/p')
+  if [ -z "$path" ]; then echo "failed to fetch $ref"; exit 1; fi
+  paths="$paths $path"
+done
+if [ -n "${CACHE_PUSH_URL:-}" ]; then
+  creds=/etc/nix-builder/cache-push
+  opts=""
+  if [ -f $creds/aws-credentials ]; then export AWS_SHARED_CREDENTIALS_FILE=$creds/aws-credentials; fi
+  if [ -f $creds/netrc ]; then opts="--option netrc-file $creds/netrc"; fi
+  if [ -f $creds/secret-key ]; then nix store sign --key-file $creds/secret-key $paths; fi
+  nix copy $opts --to "$CACHE_PUSH_URL" $paths
+fi
+echo "prefetched $# inputs"
+`
+
+// FlakePrefetchReconciler runs each FlakePrefetch on its schedule in a pod
+// that fetches the inputs into the binary cache or a shared store
+type FlakePrefetchReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Clock is the time source for schedules. Defaults to the real clock;
+	// tests inject a fake one.
+	Clock clock.PassiveClock
+
+	// BuilderImage runs prefetches that do not set spec.image
+	BuilderImage string
+
+	// CachePush is the binary cache the Cache target copies inputs to
+	CachePush *CachePush
+
+	// PodTemplate places prefetch pods where builders run
+	PodTemplate *corev1.PodTemplateSpec
+
+	// DryRun records the pod each run would create in the prefetch's
+	// status without creating or deleting any pods
+	DryRun bool
+}
+
+// Reconcile handles FlakePrefetch events
+func (r *FlakePrefetchReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var prefetch nixv1alpha1.FlakePrefetch
+	if err := r.Get(ctx, req.NamespacedName, &prefetch); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !prefetch.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	now := r.now()
+	refs, schedule, err := r.validate(&prefetch.Spec)
+	if err != nil {
+		log.Warn().Err(err).Str("prefetch", prefetch.Name).Msg("Invalid flake prefetch")
+		prefetch.Status.Phase = nixv1alpha1.PrefetchPhaseFailed
+		prefetch.Status.NextScheduleTime = nil
+		prefetch.Status.Message = err.Error()
+		return ctrl.Result{}, r.Status().Update(ctx, &prefetch)
+	}
+	prefetch.Status.Inputs = int32(len(refs))
+
+	running, err := r.followRun(ctx, &prefetch, now)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// A run is due once the schedule fires after the previous run, or
+	// right away for a prefetch without a schedule that never ran
+	var next time.Time
+	due := prefetch.Status.LastScheduleTime == nil
+	if schedule != nil {
+		since := prefetch.CreationTimestamp.Time
+		if last := prefetch.Status.LastScheduleTime; last != nil && last.After(since) {
+			since = last.Time
+		}
+		if since.IsZero() {
+			since = now.Time
+		}
+		next = schedule.next(since)
+		due = !next.IsZero() && !now.Time.Before(next)
+	}
+
+	if due && !running && !prefetch.Spec.Suspend {
+		started, err := r.startRun(ctx, &prefetch, refs, now)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		running = started
+		if schedule != nil {
+			next = schedule.next(now.Time)
+		}
+	}
+
+	prefetch.Status.NextScheduleTime = nil
+	if !next.IsZero() {
+		prefetch.Status.NextScheduleTime = &metav1.Time{Time: next}
+	}
+	if prefetch.Status.Phase == "" {
+		prefetch.Status.Phase = nixv1alpha1.PrefetchPhaseScheduled
+		prefetch.Status.Message = fmt.Sprintf("Prefetching %d inputs on schedule %q", len(refs), prefetch.Spec.Schedule)
+	}
+	if err := r.Status().Update(ctx, &prefetch); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	switch {
+	case running:
+		return ctrl.Result{RequeueAfter: prefetchPollInterval}, nil
+	case !next.IsZero():
+		return ctrl.Result{RequeueAfter: max(next.Sub(now.Time), time.Second)}, nil
+	default:
+		return ctrl.Result{}, nil
+	}
+}
+
+// validate returns the flake references a prefetch fetches and its parsed
+// schedule, or why it cannot run
+func (r *FlakePrefetchReconciler) validate(spec *nixv1alpha1.FlakePrefetchSpec) ([]string, *cronSchedule, error) {
+	refs, err := prefetchRefs(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch spec.Target {
+	case "", nixv1alpha1.PrefetchTargetCache:
+		if r.CachePush == nil {
+			return nil, nil, fmt.Errorf("no binary cache is configured on this controller")
+		}
+	case nixv1alpha1.PrefetchTargetStore:
+		if spec.ClaimName == "" {
+			return nil, nil, fmt.Errorf("the Store target needs a claim name")
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown target %q", spec.Target)
+	}
+
+	if spec.Schedule == "" {
+		return refs, nil, nil
+	}
+	schedule, err := parseSchedule(spec.Schedule)
+	if err != nil {
+		return nil, nil, err
+	}
+	return refs, schedule, nil
+}
+
+// followRun records the outcome of the latest run once its pod finishes,
+// reporting whether it is still running
+func (r *FlakePrefetchReconciler) followRun(ctx context.Context, prefetch *nixv1alpha1.FlakePrefetch, now *metav1.Time) (bool, error) {
+	if prefetch.Status.Phase != nixv1alpha1.PrefetchPhaseRunning || prefetch.Status.PodName == "" {
+		return false, nil
+	}
+
+	var pod corev1.Pod
+	err := r.Get(ctx, client.ObjectKey{Namespace: prefetch.Namespace, Name: prefetch.Status.PodName}, &pod)
+	switch {
+	case apierrors.IsNotFound(err):
+		prefetch.Status.Phase = nixv1alpha1.PrefetchPhaseFailed
+		prefetch.Status.Message = fmt.Sprintf("Prefetch pod %s was deleted", prefetch.Status.PodName)
+	case err != nil:
+		return false, fmt.Errorf("failed to get prefetch pod: %w", err)
+	case pod.Status.Phase == corev1.PodSucceeded:
+		prefetch.Status.Phase = nixv1alpha1.PrefetchPhaseSucceeded
+		prefetch.Status.Message = fmt.Sprintf("Prefetched %d inputs", prefetch.Status.Inputs)
+		log.Info().Str("prefetch", prefetch.Name).Int32("inputs", prefetch.Status.Inputs).Msg("Prefetched flake inputs")
+	case pod.Status.Phase == corev1.PodFailed:
+		prefetch.Status.Phase = nixv1alpha1.PrefetchPhaseFailed
+		prefetch.Status.Message = fmt.Sprintf("Prefetch failed: %s", podFailureMessage(&pod))
+		log.Warn().Str("prefetch", prefetch.Name).Str("pod_name", pod.Name).Msg("Flake prefetch failed")
+	default:
+		return true, nil
+	}
+	prefetch.Status.LastCompletionTime = now
+	return false, nil
+}
+
+// startRun replaces the previous run's pod with a new one. In dry-run mode
+// it only records the pod it would create, and the run is not started.
+func (r *FlakePrefetchReconciler) startRun(ctx context.Context, prefetch *nixv1alpha1.FlakePrefetch, refs []string, now *metav1.Time) (bool, error) {
+	pod := r.prefetchPod(prefetch, refs, now)
+	if r.DryRun {
+		action := fmt.Sprintf("Would create prefetch pod %s for %d inputs", pod.Name, len(refs))
+		log.Info().Str("prefetch", prefetch.Name).Bool("dry_run", true).Msg(action)
+		if prefetch.Status.Phase == "" {
+			prefetch.Status.Phase = nixv1alpha1.PrefetchPhaseScheduled
+		}
+		prefetch.Status.LastScheduleTime = now
+		prefetch.Status.Message = fmt.Sprintf("Dry run: %s", action)
+		return false, nil
+	}
+
+	if previous := prefetch.Status.PodName; previous != "" {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: prefetch.Namespace, Name: previous}}
+		if err := r.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+			return false, fmt.Errorf("failed to delete previous prefetch pod: %w", err)
+		}
+	}
+
+	if err := r.Create(ctx, pod); err != nil && !apierrors.IsAlreadyExists(err) {
+		return false, fmt.Errorf("failed to create prefetch pod: %w", err)
+	}
+	log.Info().Str("prefetch", prefetch.Name).Str("pod_name", pod.Name).Int("inputs", len(refs)).Msg("Prefetching flake inputs")
+
+	prefetch.Status.Phase = nixv1alpha1.PrefetchPhaseRunning
+	prefetch.Status.PodName = pod.Name
+	prefetch.Status.LastScheduleTime = now
+	prefetch.Status.LastCompletionTime = nil
+	prefetch.Status.Message = fmt.Sprintf("Prefetching %d inputs", len(refs))
+	return true, nil
+}
+
+// prefetchPod runs the prefetch script over refs in the builder image, with
+// the binary cache's credentials or the shared store mounted
+func (r *FlakePrefetchReconciler) prefetchPod(prefetch *nixv1alpha1.FlakePrefetch, refs []string, now *metav1.Time) *corev1.Pod {
+	image := prefetch.Spec.Image
+	if image == "" {
+		image = r.BuilderImage
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("prefetch-%s-%d", prefetch.Name, now.Unix()),
+			Namespace: prefetch.Namespace,
+			Labels: map[string]string{
+				"app":                     "nix-prefetch",
+				ManagedByLabel:            ManagedByValue,
+				nixv1alpha1.PrefetchLabel: prefetch.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{prefetchOwnerReference(prefetch)},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:         corev1.RestartPolicyNever,
+			ActiveDeadlineSeconds: &[]int64{prefetchDeadline}[0],
+			Containers: []corev1.Container{{
+				Name:                     "prefetch",
+				Image:                    image,
+				Command:                  append([]string{"/bin/sh", "-c", prefetchScript, "prefetch"}, refs...),
+				TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+			}},
+		},
+	}
+	if r.PodTemplate != nil {
+		applyPodPlacement(&pod.Spec, &r.PodTemplate.Spec)
+	}
+
+	if prefetch.Spec.Target == nixv1alpha1.PrefetchTargetStore {
+		addStoreVolume(pod, prefetch.Spec.ClaimName)
+	} else {
+		mountCachePush(pod, r.CachePush)
+	}
+	return pod
+}
+
+// prefetchRefs returns the flake references of a prefetch's lock file and
+// inputs, without duplicates
+func prefetchRefs(spec *nixv1alpha1.FlakePrefetchSpec) ([]string, error) {
+	var refs []string
+	if spec.FlakeLock != "" {
+		lockRefs, err := flakeLockRefs([]byte(spec.FlakeLock))
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, lockRefs...)
+	}
+	for _, input := range spec.Inputs {
+		if input = strings.TrimSpace(input); input != "" && !slices.Contains(refs, input) {
+			refs = append(refs, input)
+		}
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("no inputs to prefetch: set flakeLock or inputs")
+	}
+	return refs, nil
+}
+
+// flakeLock is the part of a flake.lock naming the locked inputs
+type flakeLock struct {
+	Nodes map[string]struct {
+		Locked map[string]any `json:"locked"`
+	} `json:"nodes"`
+}
+
+// flakeLockRefs returns a locked flake reference for each input of a
+// flake.lock, pinned to its revision and NAR hash, in node name order.
+// Inputs of type path only exist on the client and are skipped.
+func flakeLockRefs(data []byte) ([]string, error) {
+	var lock flakeLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("invalid flake.lock: %w", err)
+	}
+
+	names := make([]string, 0, len(lock.Nodes))
+	for name := range lock.Nodes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var refs []string
+	for _, name := range names {
+		locked := lock.Nodes[name].Locked
+		if locked == nil {
+			continue
+		}
+		ref, err := lockedFlakeRef(locked)
+		if err != nil {
+			return nil, fmt.Errorf("flake.lock input %s: %w", name, err)
+		}
+		if ref != "" && !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// lockedFlakeRef turns the locked attributes of a flake.lock node into a
+// flake reference, or "" for inputs that cannot be fetched remotely
+func lockedFlakeRef(locked map[string]any) (string, error) {
+	attr := func(name string) string {
+		value, _ := locked[name].(string)
+		return value
+	}
+	query := url.Values{}
+	if narHash := attr("narHash"); narHash != "" {
+		query.Set("narHash", narHash)
+	}
+
+	var ref string
+	switch kind := attr("type"); kind {
+	case "github", "gitlab", "sourcehut":
+		if attr("owner") == "" || attr("repo") == "" || attr("rev") == "" {
+			return "", fmt.Errorf("%s input needs owner, repo and rev", kind)
+		}
+		ref = fmt.Sprintf("%s:%s/%s/%s", kind, attr("owner"), attr("repo"), attr("rev"))
+		if host := attr("host"); host != "" {
+			query.Set("host", host)
+		}
+	case "git", "hg":
+		if attr("url") == "" || attr("rev") == "" {
+			return "", fmt.Errorf("%s input needs url and rev", kind)
+		}
+		ref = kind + "+" + attr("url")
+		query.Set("rev", attr("rev"))
+		if r := attr("ref"); r != "" {
+			query.Set("ref", r)
+		}
+		if submodules, _ := locked["submodules"].(bool); submodules {
+			query.Set("submodules", "1")
+		}
+	case "tarball", "file":
+		if attr("url") == "" {
+			return "", fmt.Errorf("%s input needs url", kind)
+		}
+		ref = kind + "+" + attr("url")
+	case "path":
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported input type %q", kind)
+	}
+
+	if len(query) == 0 {
+		return ref, nil
+	}
+	separator := "?"
+	if strings.Contains(ref, "?") {
+		separator = "&"
+	}
+	return ref + separator + query.Encode(), nil
+}
+
+// prefetchOwnerReference makes a prefetch the owner of its pods so they are
+// garbage collected with it
+func prefetchOwnerReference(prefetch *nixv1alpha1.FlakePrefetch) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion:         nixv1alpha1.GroupVersion.String(),
+		Kind:               "FlakePrefetch",
+		Name:               prefetch.Name,
+		UID:                prefetch.UID,
+		Controller:         &[]bool{true}[0],
+		BlockOwnerDeletion: &[]bool{true}[0],
+	}
+}
+
+// now returns the current time from the reconciler's clock
+func (r *FlakePrefetchReconciler) now() *metav1.Time {
+	if r.Clock == nil {
+		return &metav1.Time{Time: time.Now()}
+	}
+	return &metav1.Time{Time: r.Clock.Now()}
+}
+
+// SetupWithManager sets up the prefetch controller with the Manager
+func (r *FlakePrefetchReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&nixv1alpha1.FlakePrefetch{}).
+		Owns(&corev1.Pod{}).
+		Complete(r)
+}
@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func reconcilePrefetch(t *testing.T, r *FlakePrefetchReconciler) (ctrl.Result, *nixv1alpha1.FlakePrefetch) {
+	t.Helper()
+
+	key := client.ObjectKey{Namespace: "default", Name: "nixpkgs"}
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatalf("Reconcile returned error: %v", err)
+	}
+
+	var prefetch nixv1alpha1.FlakePrefetch
+	if err := r.Get(context.Background(), key, &prefetch); err != nil {
+		t.Fatalf("failed to get prefetch: %v", err)
+	}
+	return result, &prefetch
+}
+
+func TestReconcilePrefetchRunsOnSchedule(t *testing.T) {
+	// testEpoch is a Thursday at 10:30
+	prefetch := &nixv1alpha1.FlakePrefetch{
+		ObjectMeta: metav1.ObjectMeta{Name: "nixpkgs", Namespace: "default", UID: "prefetch-uid", CreationTimestamp: metav1.NewTime(testEpoch)},
+		Spec: nixv1alpha1.FlakePrefetchSpec{
+			Inputs:   []string{"github:NixOS/nixpkgs/88d3861acdd3d2f0e361767018218e51810df8a1"},
+			Schedule: "30 7 * * 1-5",
+		},
+	}
+	nr, clk := newTestReconciler(t, prefetch)
+	r := &FlakePrefetchReconciler{
+		Client:       nr.Client,
+		Scheme:       nr.Scheme,
+		Clock:        clk,
+		BuilderImage: "builder:test",
+		CachePush:    &CachePush{URL: "s3://nix-cache", SecretName: "cache-push"},
+	}
+
+	friday := time.Date(2026, 1, 16, 7, 30, 0, 0, time.UTC)
+	result, got := reconcilePrefetch(t, r)
+	if got.Status.Phase != nixv1alpha1.PrefetchPhaseScheduled || !got.Status.NextScheduleTime.Time.Equal(friday) {
+		t.Fatalf("phase = %q, next = %v, want Scheduled for %v", got.Status.Phase, got.Status.NextScheduleTime, friday)
+	}
+	if result.RequeueAfter != friday.Sub(testEpoch) {
+		t.Errorf("RequeueAfter = %v, want %v", result.RequeueAfter, friday.Sub(testEpoch))
+	}
+
+	clk.SetTime(friday)
+	_, got = reconcilePrefetch(t, r)
+	if got.Status.Phase != nixv1alpha1.PrefetchPhaseRunning || got.Status.Inputs != 1 {
+		t.Fatalf("phase = %q, inputs = %d, want a running prefetch of 1 input", got.Status.Phase, got.Status.Inputs)
+	}
+	monday := time.Date(2026, 1, 19, 7, 30, 0, 0, time.UTC)
+	if !got.Status.NextScheduleTime.Time.Equal(monday) {
+		t.Errorf("next = %v, want %v after the weekend", got.Status.NextScheduleTime, monday)
+	}
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	container := pod.Spec.Containers[0]
+	if !slices.Contains(container.Command, prefetch.Spec.Inputs[0]) {
+		t.Errorf("command = %v, want the input", container.Command)
+	}
+	if !slices.Contains(container.Env, corev1.EnvVar{Name: "CACHE_PUSH_URL", Value: "s3://nix-cache"}) {
+		t.Errorf("env = %v, want CACHE_PUSH_URL", container.Env)
+	}
+	if len(pod.OwnerReferences) != 1 || pod.OwnerReferences[0].Kind != "FlakePrefetch" {
+		t.Errorf("owner references = %v, want the prefetch", pod.OwnerReferences)
+	}
+
+	pod.Status.Phase = corev1.PodSucceeded
+	if err := r.Status().Update(context.Background(), &pod); err != nil {
+		t.Fatal(err)
+	}
+	clk.Step(time.Minute)
+	_, got = reconcilePrefetch(t, r)
+	if got.Status.Phase != nixv1alpha1.PrefetchPhaseSucceeded || got.Status.LastCompletionTime == nil {
+		t.Errorf("phase = %q, completion = %v, want Succeeded", got.Status.Phase, got.Status.LastCompletionTime)
+	}
+}
+
+func TestReconcilePrefetchRejectsMissingCache(t *testing.T) {
+	prefetch := &nixv1alpha1.FlakePrefetch{
+		ObjectMeta: metav1.ObjectMeta{Name: "nixpkgs", Namespace: "default"},
+		Spec:       nixv1alpha1.FlakePrefetchSpec{Inputs: []string{"github:NixOS/nixpkgs/nixos-unstable"}},
+	}
+	nr, clk := newTestReconciler(t, prefetch)
+	r := &FlakePrefetchReconciler{Client: nr.Client, Scheme: nr.Scheme, Clock: clk}
+
+	_, got := reconcilePrefetch(t, r)
+	if got.Status.Phase != nixv1alpha1.PrefetchPhaseFailed || !strings.Contains(got.Status.Message, "binary cache") {
+		t.Errorf("phase = %q, message = %q, want Failed for the missing cache", got.Status.Phase, got.Status.Message)
+	}
+}
+
+func TestReconcilePrefetchDryRun(t *testing.T) {
+	prefetch := &nixv1alpha1.FlakePrefetch{
+		ObjectMeta: metav1.ObjectMeta{Name: "nixpkgs", Namespace: "default"},
+		Spec:       nixv1alpha1.FlakePrefetchSpec{Inputs: []string{"github:NixOS/nixpkgs/nixos-unstable"}},
+	}
+	nr, clk := newTestReconciler(t, prefetch)
+	r := &FlakePrefetchReconciler{
+		Client:       nr.Client,
+		Scheme:       nr.Scheme,
+		Clock:        clk,
+		BuilderImage: "builder:test",
+		CachePush:    &CachePush{URL: "s3://nix-cache", SecretName: "cache-push"},
+		DryRun:       true,
+	}
+
+	result, got := reconcilePrefetch(t, r)
+	if got.Status.Phase != nixv1alpha1.PrefetchPhaseScheduled || got.Status.PodName != "" {
+		t.Errorf("phase = %q, pod = %q, want Scheduled without a pod", got.Status.Phase, got.Status.PodName)
+	}
+	if !strings.HasPrefix(got.Status.Message, "Dry run: Would create prefetch pod prefetch-nixpkgs-") {
+		t.Errorf("message = %q, want the pod it would create", got.Status.Message)
+	}
+	if result.RequeueAfter != 0 {
+		t.Errorf("RequeueAfter = %v, want no requeue for a run that did not start", result.RequeueAfter)
+	}
+	var pods corev1.PodList
+	if err := r.List(context.Background(), &pods, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 0 {
+		t.Errorf("%d pods after a dry run, want none", len(pods.Items))
+	}
+}
+
+func TestFlakeLockRefs(t *testing.T) {
+	lock := `{
+  "nodes": {
+    "nixpkgs": {"locked": {"narHash": "sha256-abc=", "owner": "nixos", "repo": "nixpkgs", "rev": "88d3861a", "type": "github"}},
+    "private": {"locked": {"rev": "0123abcd", "ref": "main", "type": "git", "url": "https://git.example.com/lib.git"}},
+    "local": {"locked": {"path": "/home/alice/src", "type": "path"}},
+    "src": {"flake": false, "locked": {"narHash": "sha256-def=", "type": "tarball", "url": "https://example.com/src.tar.gz?v=1"}},
+    "root": {"inputs": {"nixpkgs": "nixpkgs", "private": "private", "local": "local", "src": "src"}}
+  },
+  "root": "root",
+  "version": 7
+}`
+	refs, err := flakeLockRefs([]byte(lock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"github:nixos/nixpkgs/88d3861a?narHash=sha256-abc%3D",
+		"git+https://git.example.com/lib.git?ref=main&rev=0123abcd",
+		"tarball+https://example.com/src.tar.gz?v=1&narHash=sha256-def%3D",
+	}
+	if !slices.Equal(refs, want) {
+		t.Errorf("refs = %q\nwant %q", refs, want)
+	}
+
+	if _, err := flakeLockRefs([]byte(`{"nodes": {"x": {"locked": {"type": "indirect", "id": "nixpkgs"}}}}`)); err == nil {
+		t.Error("accepted an unlocked indirect input")
+	}
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+// DefaultPurgePhases are the phases Purge selects when none are given. Only
+// finished requests are purged unless active phases are asked for.
+var DefaultPurgePhases = []nixv1alpha1.BuildPhase{nixv1alpha1.BuildPhaseCompleted, nixv1alpha1.BuildPhaseFailed}
+
+// PurgeOptions selects the build requests Purge deletes
+type PurgeOptions struct {
+	// Phases selects requests in these phases. Defaults to
+	// DefaultPurgePhases.
+	Phases []nixv1alpha1.BuildPhase
+	// OlderThan selects requests that finished, or were created if they
+	// never finished, at least this long ago
+	OlderThan time.Duration
+	// Requester selects requests made by this identity. Orphaned pods have
+	// no requester and are left alone when it is set.
+	Requester string
+	// DryRun logs what would be deleted without deleting anything
+	DryRun bool
+	// Now is the time ages are measured from. Defaults to the current time.
+	Now time.Time
+}
+
+// Purge deletes the build requests in a namespace matching opts, along with
+// builder pods older than OlderThan whose build request no longer exists.
+// Unlike Uninstall it leaves finalizers in place so the running controller
+// cleans up each request as usual.
+func Purge(ctx context.Context, c client.Client, namespace string, opts PurgeOptions) error {
+	phases := opts.Phases
+	if len(phases) == 0 {
+		phases = DefaultPurgePhases
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var buildReqs nixv1alpha1.NixBuildRequestList
+	if err := c.List(ctx, &buildReqs, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("failed to list build requests: %w", err)
+	}
+
+	remaining := make(map[string]bool, len(buildReqs.Items))
+	for i := range buildReqs.Items {
+		buildReq := &buildReqs.Items[i]
+		if !purgeMatches(buildReq, phases, opts, now) {
+			remaining[buildReq.Name] = true
+			continue
+		}
+		if err := deleteObject(ctx, c, "build request", buildReq, opts.DryRun); err != nil {
+			return err
+		}
+	}
+
+	if opts.Requester != "" {
+		return nil
+	}
+
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods, client.InNamespace(namespace), client.MatchingLabels{"app": "nix-builder"}); err != nil {
+		return fmt.Errorf("failed to list builder pods: %w", err)
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		owner, ok := pod.Labels["nix.io/build-request"]
+		if !ok || remaining[owner] || !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if now.Sub(pod.CreationTimestamp.Time) < opts.OlderThan {
+			continue
+		}
+		if err := deleteObject(ctx, c, "pod", pod, opts.DryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeMatches reports whether Purge should delete a build request
+func purgeMatches(buildReq *nixv1alpha1.NixBuildRequest, phases []nixv1alpha1.BuildPhase, opts PurgeOptions, now time.Time) bool {
+	if !buildReq.DeletionTimestamp.IsZero() || !slices.Contains(phases, buildReq.Status.Phase) {
+		return false
+	}
+	if opts.Requester != "" && buildReq.Annotations[policy.RequesterAnnotation] != opts.Requester {
+		return false
+	}
+
+	since := buildReq.CreationTimestamp.Time
+	if buildReq.Status.CompletionTime != nil {
+		since = buildReq.Status.CompletionTime.Time
+	}
+	return now.Sub(since) >= opts.OlderThan
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestPurgeDeletesOldFinishedRequests(t *testing.T) {
+	buildReq := func(name string, phase nixv1alpha1.BuildPhase, finished time.Time) *nixv1alpha1.NixBuildRequest {
+		return &nixv1alpha1.NixBuildRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", CreationTimestamp: metav1.NewTime(testEpoch.Add(-72 * time.Hour))},
+			Status:     nixv1alpha1.NixBuildRequestStatus{Phase: phase, CompletionTime: &metav1.Time{Time: finished}},
+		}
+	}
+	builderPod := func(name, buildReq string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(testEpoch.Add(-72 * time.Hour)),
+			Labels:            map[string]string{"app": "nix-builder", "nix.io/build-request": buildReq},
+		}}
+	}
+	oldFailed := buildReq("build-old", nixv1alpha1.BuildPhaseFailed, testEpoch.Add(-48*time.Hour))
+	recentFailed := buildReq("build-recent", nixv1alpha1.BuildPhaseFailed, testEpoch.Add(-time.Hour))
+	running := buildReq("build-running", nixv1alpha1.BuildPhaseRunning, testEpoch.Add(-48*time.Hour))
+	orphan := builderPod("nix-builder-gone", "build-gone")
+	runningPod := builderPod("nix-builder-running", "build-running")
+	r, _ := newTestReconciler(t, oldFailed, recentFailed, running, orphan, runningPod)
+
+	if err := Purge(context.Background(), r.Client, "default", PurgeOptions{OlderThan: 24 * time.Hour, Now: testEpoch}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, obj := range []client.Object{oldFailed, orphan} {
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(obj), obj); !apierrors.IsNotFound(err) {
+			t.Errorf("%s was not purged: %v", obj.GetName(), err)
+		}
+	}
+	for _, obj := range []client.Object{recentFailed, running, runningPod} {
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(obj), obj); err != nil {
+			t.Errorf("%s was purged: %v", obj.GetName(), err)
+		}
+	}
+}
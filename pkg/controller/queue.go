@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/status"
+)
+
+// queueRequeueInterval is how often a queued build request checks for a free
+// builder slot
+const queueRequeueInterval = 5 * time.Second
+
+// admitBuild decides whether a build request may provision a builder under
+// MaxRunningBuilders and its namespace's BuilderQuota. A request that has to
+// wait is marked Queued with its position; older queued requests go first.
+func (r *NixBuildRequestReconciler) admitBuild(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (bool, error) {
+	limits, err := r.namespaceBuilderLimits(ctx)
+	if err != nil {
+		return false, err
+	}
+	nsLimit, hasQuota := limits[buildReq.Namespace]
+	maxRunning := r.settings().MaxRunningBuilders
+	if maxRunning <= 0 && !hasQuota {
+		return true, nil
+	}
+
+	var buildReqs nixv1alpha1.NixBuildRequestList
+	if err := r.List(ctx, &buildReqs); err != nil {
+		return false, fmt.Errorf("failed to list build requests: %w", err)
+	}
+
+	running := 0
+	nsRunning := make(map[string]int)
+	var older []*nixv1alpha1.NixBuildRequest
+	for i := range buildReqs.Items {
+		other := &buildReqs.Items[i]
+		switch other.Status.Phase {
+		case nixv1alpha1.BuildPhaseCreating, nixv1alpha1.BuildPhaseRunning:
+			running++
+			nsRunning[other.Namespace]++
+		case nixv1alpha1.BuildPhaseQueued:
+			if other.UID != buildReq.UID && queuedBefore(other, buildReq) {
+				older = append(older, other)
+			}
+		}
+	}
+
+	ahead, nsAhead := 0, 0
+	for _, other := range older {
+		if other.Namespace == buildReq.Namespace {
+			ahead++
+			nsAhead++
+			continue
+		}
+		// Requests held back by their own namespace's quota do not take
+		// cluster-wide slots ahead of this one
+		if limit, ok := limits[other.Namespace]; ok && nsRunning[other.Namespace] >= limit {
+			continue
+		}
+		ahead++
+	}
+
+	position := 0
+	if maxRunning > 0 {
+		position = max(position, running+ahead-maxRunning+1)
+	}
+	if hasQuota {
+		position = max(position, nsRunning[buildReq.Namespace]+nsAhead-nsLimit+1)
+	}
+	if position <= 0 {
+		buildReq.Status.QueuePosition = 0
+		return true, nil
+	}
+
+	if buildReq.Status.Phase != nixv1alpha1.BuildPhaseQueued {
+		log.Ctx(ctx).Info().Int("position", position).Msg("Queueing build request")
+		r.event(buildReq, corev1.EventTypeNormal, EventQueued, "Waiting for a builder slot at position %d", position)
+	}
+	status.MarkQueued(&buildReq.Status, int32(position))
+	return false, nil
+}
+
+// namespaceBuilderLimits returns the lowest BuilderQuota in each namespace
+// that has one
+func (r *NixBuildRequestReconciler) namespaceBuilderLimits(ctx context.Context) (map[string]int, error) {
+	var quotas nixv1alpha1.BuilderQuotaList
+	if err := r.List(ctx, &quotas); err != nil {
+		// Quotas are optional, so a cluster without the CRD has none
+		if meta.IsNoMatchError(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list builder quotas: %w", err)
+	}
+
+	limits := make(map[string]int)
+	for _, quota := range quotas.Items {
+		limit := int(quota.Spec.MaxRunning)
+		if current, ok := limits[quota.Namespace]; !ok || limit < current {
+			limits[quota.Namespace] = limit
+		}
+	}
+	return limits, nil
+}
+
+// queuedBefore orders queued build requests by age, breaking ties by name
+func queuedBefore(a, b *nixv1alpha1.NixBuildRequest) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
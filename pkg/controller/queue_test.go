@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingQueuesAtBuilderLimit(t *testing.T) {
+	running := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	running.Name = "build-running"
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, running, buildReq)
+	r.MaxRunningBuilders = 1
+
+	result, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseQueued {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseQueued)
+	}
+	if got.Status.QueuePosition != 1 {
+		t.Errorf("queuePosition = %d, want 1", got.Status.QueuePosition)
+	}
+	if result.RequeueAfter != queueRequeueInterval {
+		t.Errorf("requeueAfter = %v, want %v", result.RequeueAfter, queueRequeueInterval)
+	}
+
+	running.Status.Phase = nixv1alpha1.BuildPhaseCompleted
+	if err := r.Status().Update(context.Background(), running); err != nil {
+		t.Fatalf("failed to complete running build request: %v", err)
+	}
+
+	_, got = reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseCreating {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseCreating)
+	}
+	if got.Status.QueuePosition != 0 {
+		t.Errorf("queuePosition = %d, want 0", got.Status.QueuePosition)
+	}
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+// sessionSilence returns how long ago the proxy last reported a build
+// request's session alive. Requests without a heartbeat, such as those
+// backing leases, are never considered silent.
+func (r *NixBuildRequestReconciler) sessionSilence(buildReq *nixv1alpha1.NixBuildRequest) (time.Duration, bool) {
+	value, ok := buildReq.Annotations[nixv1alpha1.SessionHeartbeatAnnotation]
+	if !ok {
+		return 0, false
+	}
+	heartbeat, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Warn().Err(err).Str("session_id", buildReq.Spec.SessionID).Msg("Ignoring malformed session heartbeat")
+		return 0, false
+	}
+	return r.now().Sub(heartbeat), true
+}
+
+// reapSession fails an unfinished build request whose proxy session stopped
+// sending heartbeats, as when the proxy crashed before it could delete the
+// request, and deletes its builder pod if it has one. The request is left Failed for
+// inspection and removed by the usual purge.
+func (r *NixBuildRequestReconciler) reapSession(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest, silence time.Duration) (ctrl.Result, error) {
+	reason := fmt.Sprintf("no proxy heartbeat for %s", silence.Round(time.Second))
+	if now := r.now().Time; now.Before(r.CleanupBakeInUntil) {
+		if err := holdDeletion(ctx, r.Client, buildReq, reason, r.CleanupBakeInUntil); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: min(r.CleanupBakeInUntil.Sub(now), 30*time.Second)}, nil
+	}
+
+	if r.DryRun {
+		r.recordDryRun(ctx, buildReq, fmt.Sprintf("Would fail build request and delete builder pod %s: %s", buildReq.Status.PodName, reason))
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	log.Ctx(ctx).Warn().
+		Str("pod_name", buildReq.Status.PodName).
+		Dur("silence", silence).
+		Msg("Reaping build request without a live proxy session")
+	r.failBuild(buildReq, errcode.Canceled, "Proxy session lost: %s", reason)
+	if err := r.Status().Update(ctx, buildReq); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if buildReq.Status.JobName != "" {
+		if err := r.deleteBuilderJob(ctx, buildReq); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if buildReq.Status.PodName == "" {
+		return ctrl.Result{}, nil
+	}
+	r.captureBuildLogs(ctx, buildReq)
+	pod := &corev1.Pod{}
+	pod.Namespace = builderNamespace(buildReq)
+	pod.Name = buildReq.Status.PodName
+	if err := r.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to delete builder pod of lost session: %w", err)
+	}
+	return ctrl.Result{}, nil
+}
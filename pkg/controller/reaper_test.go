@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+func TestReconcileRunningReapsLostSession(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	buildReq.Annotations = map[string]string{nixv1alpha1.SessionHeartbeatAnnotation: testEpoch.Format(time.RFC3339)}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default"}}
+	r, clk := newTestReconciler(t, buildReq, pod)
+	r.SessionGracePeriod = 5 * time.Minute
+
+	clk.Step(time.Minute)
+	_, got := reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseRunning {
+		t.Fatalf("phase with a recent heartbeat = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseRunning)
+	}
+
+	clk.Step(10 * time.Minute)
+	_, got = reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if code, _ := errcode.Parse(got.Status.Message); code != errcode.Canceled {
+		t.Errorf("message = %q, want code %s", got.Status.Message, errcode.Canceled)
+	}
+	err := r.Get(context.Background(), client.ObjectKeyFromObject(pod), &corev1.Pod{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("builder pod of lost session still exists: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/logging"
+)
+
+// Resync compares every NixBuildRequest against the builder pods in the
+// cluster and repairs drift that accumulated while the controller was not
+// running. Requests whose pod has vanished are marked failed, or have their
+// builder replaced when they run on spot nodes, and builder pods without a
+// matching request are deleted, or flagged while the cleanup bake-in lasts.
+func (r *NixBuildRequestReconciler) Resync(ctx context.Context) error {
+	log.Ctx(ctx).Info().Msg("Starting startup resync of build requests")
+
+	var buildReqs nixv1alpha1.NixBuildRequestList
+	if err := r.List(ctx, &buildReqs); err != nil {
+		return fmt.Errorf("failed to list build requests: %w", err)
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.MatchingLabels{"app": "nix-builder"}); err != nil {
+		return fmt.Errorf("failed to list builder pods: %w", err)
+	}
+
+	podsByName := make(map[types.NamespacedName]*corev1.Pod, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		podsByName[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = pod
+	}
+
+	requests := make(map[types.NamespacedName]bool, len(buildReqs.Items))
+	failedCount, rescheduledCount := 0, 0
+	for i := range buildReqs.Items {
+		buildReq := &buildReqs.Items[i]
+		requests[types.NamespacedName{Namespace: buildReq.Namespace, Name: buildReq.Name}] = true
+		// Isolated builder pods carry their request's name in another namespace
+		requests[types.NamespacedName{Namespace: builderNamespace(buildReq), Name: buildReq.Name}] = true
+
+		if !buildReq.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if buildReq.Status.Phase != nixv1alpha1.BuildPhaseCreating && buildReq.Status.Phase != nixv1alpha1.BuildPhaseRunning {
+			continue
+		}
+		// A creating Job may be between pods; its reconcile follows it
+		if buildReq.Status.JobName != "" && buildReq.Status.Phase == nixv1alpha1.BuildPhaseCreating {
+			continue
+		}
+		if _, ok := podsByName[types.NamespacedName{Namespace: builderNamespace(buildReq), Name: buildReq.Status.PodName}]; ok {
+			continue
+		}
+
+		reqCtx := logging.WithSession(ctx, logging.ComponentReconciler, buildReq.Spec.SessionID)
+		log.Ctx(reqCtx).Warn().
+			Str("build_request", buildReq.Name).
+			Str("phase", string(buildReq.Status.Phase)).
+			Str("pod_name", buildReq.Status.PodName).
+			Msg("Build request references a missing builder pod")
+
+		const message = "Builder pod disappeared while the controller was offline"
+		if r.runsOnSpot(buildReq) {
+			if _, err := r.builderLost(reqCtx, buildReq, nil, message); err != nil {
+				log.Ctx(reqCtx).Error().Err(err).Str("build_request", buildReq.Name).Msg("Failed to update build request status during resync")
+				continue
+			}
+			if buildReq.Status.Phase == nixv1alpha1.BuildPhaseFailed {
+				failedCount++
+			} else {
+				rescheduledCount++
+			}
+			continue
+		}
+		r.failBuild(buildReq, errcode.Builder, "%s", message)
+		if err := r.Status().Update(ctx, buildReq); err != nil {
+			log.Ctx(reqCtx).Error().Err(err).Str("build_request", buildReq.Name).Msg("Failed to update build request status during resync")
+			continue
+		}
+		failedCount++
+	}
+
+	orphanCount := 0
+	for _, pod := range podsByName {
+		if pod.Labels[PoolLabel] == PoolLabelWarm {
+			continue
+		}
+		owner := pod.Labels["nix.io/build-request"]
+		if owner != "" && requests[types.NamespacedName{Namespace: pod.Namespace, Name: owner}] {
+			continue
+		}
+
+		if r.now().Time.Before(r.CleanupBakeInUntil) {
+			if err := holdDeletion(ctx, r.Client, pod, "builder pod without a build request", r.CleanupBakeInUntil); err != nil {
+				log.Ctx(ctx).Error().Err(err).Str("pod_name", pod.Name).Msg("Failed to flag orphaned builder pod")
+			}
+			continue
+		}
+		log.Ctx(ctx).Warn().Str("pod_name", pod.Name).Str("build_request", owner).Bool("dry_run", r.DryRun).Msg("Deleting builder pod without a build request")
+		if r.DryRun {
+			continue
+		}
+		if err := r.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+			log.Ctx(ctx).Error().Err(err).Str("pod_name", pod.Name).Msg("Failed to delete orphaned builder pod")
+			continue
+		}
+		orphanCount++
+	}
+
+	orphanedNamespaces := 0
+	if r.NamespaceIsolation != nil {
+		var err error
+		if orphanedNamespaces, err = r.deleteOrphanedNamespaces(ctx, buildReqs.Items); err != nil {
+			return err
+		}
+	}
+
+	log.Ctx(ctx).Info().
+		Int("build_requests", len(buildReqs.Items)).
+		Int("marked_failed", failedCount).
+		Int("rescheduled", rescheduledCount).
+		Int("orphaned_pods", orphanCount).
+		Int("orphaned_namespaces", orphanedNamespaces).
+		Msg("Completed startup resync")
+	return nil
+}
+
+// deleteOrphanedNamespaces deletes isolated namespaces no build request
+// refers to, such as one created just before its request was deleted
+func (r *NixBuildRequestReconciler) deleteOrphanedNamespaces(ctx context.Context, buildReqs []nixv1alpha1.NixBuildRequest) (int, error) {
+	var namespaces corev1.NamespaceList
+	if err := r.List(ctx, &namespaces, client.MatchingLabels{ManagedByLabel: ManagedByValue}, client.HasLabels{BuildRequestNamespaceLabel}); err != nil {
+		return 0, fmt.Errorf("failed to list isolated namespaces: %w", err)
+	}
+
+	inUse := make(map[string]bool, len(buildReqs))
+	for i := range buildReqs {
+		inUse[isolatedNamespaceName(&buildReqs[i])] = true
+		inUse[buildReqs[i].Status.BuilderNamespace] = true
+	}
+
+	deleted := 0
+	for i := range namespaces.Items {
+		namespace := &namespaces.Items[i]
+		if inUse[namespace.Name] || !namespace.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if r.now().Time.Before(r.CleanupBakeInUntil) {
+			if err := holdDeletion(ctx, r.Client, namespace, "isolated namespace without a build request", r.CleanupBakeInUntil); err != nil {
+				log.Ctx(ctx).Error().Err(err).Str("namespace", namespace.Name).Msg("Failed to flag orphaned isolated namespace")
+			}
+			continue
+		}
+		log.Ctx(ctx).Warn().Str("namespace", namespace.Name).Bool("dry_run", r.DryRun).Msg("Deleting isolated namespace without a build request")
+		if r.DryRun {
+			continue
+		}
+		if err := r.Delete(ctx, namespace); client.IgnoreNotFound(err) != nil {
+			log.Ctx(ctx).Error().Err(err).Str("namespace", namespace.Name).Msg("Failed to delete orphaned isolated namespace")
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
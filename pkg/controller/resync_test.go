@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+// newResyncPod returns a builder pod as Resync lists them
+func newResyncPod(name string, labels map[string]string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:      name,
+		Namespace: "default",
+		Labels:    map[string]string{"app": "nix-builder"},
+	}}
+	maps.Copy(pod.Labels, labels)
+	return pod
+}
+
+func getBuildRequest(t *testing.T, r *NixBuildRequestReconciler) *nixv1alpha1.NixBuildRequest {
+	t.Helper()
+
+	var got nixv1alpha1.NixBuildRequest
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "build-abc"}, &got); err != nil {
+		t.Fatal(err)
+	}
+	return &got
+}
+
+func TestResyncFailsRequestWithMissingPod(t *testing.T) {
+	r, _ := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhaseRunning))
+
+	if err := r.Resync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := getBuildRequest(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if code, _ := errcode.Parse(got.Status.Message); code != errcode.Builder {
+		t.Errorf("message = %q, want an %s message", got.Status.Message, errcode.Builder)
+	}
+}
+
+func TestResyncReplacesMissingSpotBuilder(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	buildReq.Spec.Spot = &[]bool{true}[0]
+	r, _ := newTestReconciler(t, buildReq)
+	spot := SpotPresets["gke"]
+	spot.MaxReschedules = 1
+	r.Spot = &spot
+
+	if err := r.Resync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := getBuildRequest(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhasePending || got.Status.Reschedules != 1 || got.Status.PodName != "" {
+		t.Errorf("got phase %q, %d reschedules and pod %q, want Pending, 1 and no pod", got.Status.Phase, got.Status.Reschedules, got.Status.PodName)
+	}
+}
+
+func TestResyncDeletesOrphanedPods(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	owned := newResyncPod("nix-builder-abc", map[string]string{"nix.io/build-request": "build-abc"})
+	orphan := newResyncPod("nix-builder-gone", map[string]string{"nix.io/build-request": "build-gone"})
+	warm := newResyncPod("nix-builder-pool-x7k2p", map[string]string{PoolLabel: PoolLabelWarm})
+	r, _ := newTestReconciler(t, buildReq, owned, orphan, warm)
+
+	if err := r.Resync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(orphan), &corev1.Pod{}); !apierrors.IsNotFound(err) {
+		t.Errorf("orphaned pod after resync: %v, want it deleted", err)
+	}
+	for _, pod := range []*corev1.Pod{owned, warm} {
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(pod), &corev1.Pod{}); err != nil {
+			t.Errorf("pod %s after resync: %v, want it kept", pod.Name, err)
+		}
+	}
+	if got := getBuildRequest(t, r); got.Status.Phase != nixv1alpha1.BuildPhaseRunning {
+		t.Errorf("phase = %q, want the request with its pod left Running", got.Status.Phase)
+	}
+}
+
+func TestResyncDryRunKeepsOrphanedPods(t *testing.T) {
+	orphan := newResyncPod("nix-builder-gone", map[string]string{"nix.io/build-request": "build-gone"})
+	r, _ := newTestReconciler(t, orphan)
+	r.DryRun = true
+
+	if err := r.Resync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(orphan), &corev1.Pod{}); err != nil {
+		t.Errorf("orphaned pod after a dry-run resync: %v, want it kept", err)
+	}
+}
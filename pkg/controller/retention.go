@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// DefaultCompletedPodTTL is how long the builder pod of a finished build
+// request is kept, so its logs can still be read
+const DefaultCompletedPodTTL = 5 * time.Minute
+
+// finishedAt is when a build request completed or failed, or its creation
+// for requests that never recorded a completion time
+func finishedAt(buildReq *nixv1alpha1.NixBuildRequest) time.Time {
+	if buildReq.Status.CompletionTime != nil {
+		return buildReq.Status.CompletionTime.Time
+	}
+	return buildReq.CreationTimestamp.Time
+}
+
+// ttlFor returns a build request's own TTL when it sets one, or the
+// controller's, and whether there is one at all. A request's TTL of zero
+// expires at once, while the controller's disables expiry.
+func ttlFor(seconds *int32, def time.Duration) (time.Duration, bool) {
+	if seconds != nil {
+		return time.Duration(*seconds) * time.Second, true
+	}
+	return def, def > 0
+}
+
+// podTTL is how long a finished build request's builder pod is kept. Pods
+// serving issued credentials go at once, as only that revokes their key.
+func (r *NixBuildRequestReconciler) podTTL(buildReq *nixv1alpha1.NixBuildRequest) (time.Duration, bool) {
+	if buildReq.Spec.Credentials != nil {
+		return 0, true
+	}
+	return ttlFor(buildReq.Spec.PodTTLSecondsAfterFinished, r.CompletedPodTTL)
+}
+
+// requestTTL is how long a finished build request is kept
+func (r *NixBuildRequestReconciler) requestTTL(buildReq *nixv1alpha1.NixBuildRequest) (time.Duration, bool) {
+	return ttlFor(buildReq.Spec.TTLSecondsAfterFinished, r.BuildRequestTTL)
+}
+
+// builderExists reports whether a finished build request still has its
+// builder pod or Job
+func (r *NixBuildRequestReconciler) builderExists(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (bool, error) {
+	if buildReq.Status.PodName != "" {
+		err := r.Get(ctx, client.ObjectKey{Namespace: builderNamespace(buildReq), Name: buildReq.Status.PodName}, &corev1.Pod{})
+		if err == nil {
+			return true, nil
+		}
+		if !apierrors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	if buildReq.Status.JobName != "" {
+		err := r.Get(ctx, client.ObjectKey{Namespace: builderNamespace(buildReq), Name: buildReq.Status.JobName}, &batchv1.Job{})
+		if err == nil {
+			return true, nil
+		}
+		if !apierrors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// handleCompletedBuild deletes a finished build request's builder once the
+// pod TTL has passed and the request itself once the request TTL has,
+// requeueing until the next of them is due
+func (r *NixBuildRequestReconciler) handleCompletedBuild(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (ctrl.Result, error) {
+	r.notifyFinished(ctx, buildReq)
+	if err := r.revokeCredentials(ctx, buildReq); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to revoke builder credentials")
+		return ctrl.Result{}, err
+	}
+
+	now := r.now().Time
+	finished := finishedAt(buildReq)
+	var requeue time.Duration
+
+	if ttl, ok := r.requestTTL(buildReq); ok {
+		if remaining := finished.Add(ttl).Sub(now); remaining > 0 {
+			requeue = remaining
+		} else {
+			log.Ctx(ctx).Info().Str("phase", string(buildReq.Status.Phase)).Dur("ttl", ttl).Msg("Deleting expired build request")
+			if r.DryRun {
+				return ctrl.Result{}, nil
+			}
+			// The finalizer cleans up the builder along with the request
+			return ctrl.Result{}, client.IgnoreNotFound(r.Delete(ctx, buildReq))
+		}
+	}
+
+	if ttl, ok := r.podTTL(buildReq); ok {
+		exists, err := r.builderExists(ctx, buildReq)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to get builder of finished build request")
+			return ctrl.Result{}, err
+		}
+		if exists {
+			if remaining := finished.Add(ttl).Sub(now); remaining > 0 {
+				if requeue == 0 || remaining < requeue {
+					requeue = remaining
+				}
+			} else {
+				log.Ctx(ctx).Info().Str("phase", string(buildReq.Status.Phase)).Dur("ttl", ttl).Msg("Deleting builder of finished build request")
+				if err := r.cleanup(ctx, buildReq); err != nil {
+					r.warningEvent(buildReq, EventCleanupFailed, "Failed to clean up builder resources: %v", err)
+					return ctrl.Result{}, err
+				}
+				// cleanup may have recorded the store diff
+				if err := r.Status().Update(ctx, buildReq); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+		}
+	}
+
+	log.Ctx(ctx).Debug().
+		Str("phase", string(buildReq.Status.Phase)).
+		Dur("requeue_after", requeue).
+		Msg("Build finished, waiting for retention to expire")
+	return ctrl.Result{RequeueAfter: requeue}, nil
+}
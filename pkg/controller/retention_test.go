@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcileCompletedExpiresPodAndRequest(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseCompleted)
+	buildReq.Status.CompletionTime = &metav1.Time{Time: testEpoch.Add(-time.Minute)}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default"}}
+	r, clk := newTestReconciler(t, buildReq, pod)
+	r.CompletedPodTTL = 5 * time.Minute
+	r.BuildRequestTTL = time.Hour
+
+	result, _ := reconcileOnce(t, r)
+	if result.RequeueAfter != 4*time.Minute {
+		t.Errorf("RequeueAfter = %v, want 4m until the pod expires", result.RequeueAfter)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(pod), pod); err != nil {
+		t.Fatalf("builder pod deleted before its TTL: %v", err)
+	}
+
+	clk.Step(4 * time.Minute)
+	result, _ = reconcileOnce(t, r)
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(pod), pod); !apierrors.IsNotFound(err) {
+		t.Errorf("builder pod not deleted after its TTL: %v", err)
+	}
+	if result.RequeueAfter != 55*time.Minute {
+		t.Errorf("RequeueAfter = %v, want 55m until the request expires", result.RequeueAfter)
+	}
+
+	clk.Step(55 * time.Minute)
+	_, got := reconcileOnce(t, r)
+	if got.DeletionTimestamp.IsZero() {
+		t.Error("build request not deleted after its TTL")
+	}
+}
@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	tests := []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"30 7 * * 1-5", time.Date(2026, 1, 16, 7, 30, 0, 0, time.UTC), time.Date(2026, 1, 19, 7, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 1, 15, 10, 31, 0, 0, time.UTC), time.Date(2026, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 6 1,15 * *", time.Date(2026, 1, 15, 7, 0, 0, 0, time.UTC), time.Date(2026, 2, 1, 6, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		schedule, err := parseSchedule(tt.expr)
+		if err != nil {
+			t.Fatalf("parseSchedule(%q): %v", tt.expr, err)
+		}
+		if got := schedule.next(tt.after); !got.Equal(tt.want) {
+			t.Errorf("%q after %v = %v, want %v", tt.expr, tt.after, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "5-1 * * * *", "*/0 * * * *", "@daily"} {
+		if _, err := parseSchedule(expr); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded", expr)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	corev1 "k8s.io/api/core/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/status"
+)
+
+const (
+	// SessionIDAnnotation records the session a builder pod serves
+	SessionIDAnnotation = "nix.io/session-id"
+	// MOTDAnnotation holds the message of the day shown by the builder
+	MOTDAnnotation = "nix.io/motd"
+
+	builderSessionInfoMountPath = "/etc/nix-builder/session"
+)
+
+// sessionOwner returns another unfinished build request using buildReq's
+// session ID, if any. Session IDs may come from outside the proxy, and a
+// reused one would share builder pod names and muddle logs and traces.
+func (r *NixBuildRequestReconciler) sessionOwner(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (*nixv1alpha1.NixBuildRequest, error) {
+	var buildReqs nixv1alpha1.NixBuildRequestList
+	if err := r.List(ctx, &buildReqs); err != nil {
+		return nil, fmt.Errorf("failed to list build requests: %w", err)
+	}
+	for i := range buildReqs.Items {
+		other := &buildReqs.Items[i]
+		if other.Namespace == buildReq.Namespace && other.Name == buildReq.Name || other.Spec.SessionID != buildReq.Spec.SessionID {
+			continue
+		}
+		if status.Finished(&other.Status) {
+			continue
+		}
+		// The earlier request keeps the ID, or the first by name if they
+		// were created in the same second
+		if other.CreationTimestamp.After(buildReq.CreationTimestamp.Time) ||
+			other.CreationTimestamp.Equal(&buildReq.CreationTimestamp) && other.Name > buildReq.Name {
+			continue
+		}
+		return other, nil
+	}
+	return nil, nil
+}
+
+// sessionAnnotations describes who a builder pod is serving, so anyone
+// reading its metadata or logging in to it can tell
+func sessionAnnotations(buildReq *nixv1alpha1.NixBuildRequest) map[string]string {
+	requester := requester(buildReq)
+	motd := fmt.Sprintf("Nix builder for session %s\nBuild request: %s/%s\n", buildReq.Spec.SessionID, buildReq.Namespace, buildReq.Name)
+	if requester != "" {
+		motd += fmt.Sprintf("Requested by: %s\n", requester)
+	}
+	annotations := map[string]string{
+		SessionIDAnnotation:        buildReq.Spec.SessionID,
+		policy.RequesterAnnotation: requester,
+	}
+	for _, key := range nixv1alpha1.CIContextAnnotations {
+		if value := buildReq.Annotations[key]; value != "" {
+			annotations[key] = value
+		}
+	}
+	if repo := buildReq.Annotations[nixv1alpha1.RepositoryAnnotation]; repo != "" {
+		motd += fmt.Sprintf("Repository: %s\n", repo)
+	}
+	if commit := buildReq.Annotations[nixv1alpha1.CommitSHAAnnotation]; commit != "" {
+		motd += fmt.Sprintf("Commit: %s\n", commit)
+	}
+	if pipeline := buildReq.Annotations[nixv1alpha1.PipelineIDAnnotation]; pipeline != "" {
+		motd += fmt.Sprintf("Pipeline: %s\n", pipeline)
+	}
+	annotations[MOTDAnnotation] = motd
+	return annotations
+}
+
+// setSessionAnnotations records the session a builder pod serves on it
+func setSessionAnnotations(pod *corev1.Pod, buildReq *nixv1alpha1.NixBuildRequest) {
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	maps.Copy(pod.Annotations, sessionAnnotations(buildReq))
+}
+
+// addSessionInfo projects the session annotations into the builder. A
+// downward API volume is used rather than environment variables so that
+// pooled pods pick up the session they are assigned to after starting.
+func addSessionInfo(pod *corev1.Pod) {
+	item := func(path, annotation string) corev1.DownwardAPIVolumeFile {
+		return corev1.DownwardAPIVolumeFile{
+			Path:     path,
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: fmt.Sprintf("metadata.annotations['%s']", annotation)},
+		}
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: "session-info",
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					item("session-id", SessionIDAnnotation),
+					item("requester", policy.RequesterAnnotation),
+					item("motd", MOTDAnnotation),
+				},
+			},
+		},
+	})
+
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "session-info",
+		MountPath: builderSessionInfoMountPath,
+		ReadOnly:  true,
+	})
+}
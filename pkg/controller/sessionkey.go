@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// authorizedKeysSecretKey is the key in an SSH keys secret that builder pods
+// mount as authorized_keys
+const authorizedKeysSecretKey = "public"
+
+// authorizedKeysSecretName returns the secret mounted as authorized_keys in a
+// builder pod. Pods serving a session key or keys from Vault get their own
+// copy, deleted with the build. So do pods serving issued credentials.
+func (r *NixBuildRequestReconciler) authorizedKeysSecretName(buildReq *nixv1alpha1.NixBuildRequest, podName string) string {
+	if r.Vault != nil || buildReq.Spec.ClientPublicKey != "" || buildReq.Spec.Credentials != nil {
+		return podAuthorizedKeysSecretName(podName)
+	}
+	return r.SSHKeySecret
+}
+
+// podAuthorizedKeysSecretName returns the name of a pod's own
+// authorized_keys secret
+func podAuthorizedKeysSecretName(podName string) string {
+	return podName + "-ssh"
+}
+
+// validateClientPublicKey checks that a session's public key parses, so a
+// malformed key fails the build instead of leaving sshd with no usable key
+func validateClientPublicKey(buildReq *nixv1alpha1.NixBuildRequest) error {
+	if buildReq.Spec.ClientPublicKey == "" {
+		return nil
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(buildReq.Spec.ClientPublicKey)); err != nil {
+		return fmt.Errorf("failed to parse client public key: %w", err)
+	}
+	return nil
+}
+
+// ensureSessionAuthorizedKey authorizes only the session's own key on its
+// builder, so a leaked proxy key cannot open other builders
+func (r *NixBuildRequestReconciler) ensureSessionAuthorizedKey(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest, podName string) error {
+	return r.createAuthorizedKeysSecret(ctx, buildRequestOwner(buildReq), podName, buildReq.Spec.ClientPublicKey+"\n")
+}
+
+// createAuthorizedKeysSecret writes a pod's own authorized_keys secret
+func (r *NixBuildRequestReconciler) createAuthorizedKeysSecret(ctx context.Context, owner builderOwner, podName, authorizedKeys string) error {
+	secret := &corev1.Secret{
+		ObjectMeta: owner.objectMeta(podAuthorizedKeysSecretName(podName)),
+		Data: map[string][]byte{
+			authorizedKeysSecretKey: []byte(authorizedKeys),
+		},
+	}
+
+	if err := r.Create(ctx, secret); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create authorized keys secret: %w", err)
+	}
+	return nil
+}
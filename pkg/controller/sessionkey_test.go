@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingAuthorizesOnlySessionKey(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Status.PodName = ""
+	buildReq.Spec.ClientPublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	r, _ := newTestReconciler(t, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	var secret corev1.Secret
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: podAuthorizedKeysSecretName(got.Status.PodName)}, &secret); err != nil {
+		t.Fatalf("session authorized keys secret not created: %v", err)
+	}
+	if keys := strings.TrimSpace(string(secret.Data[authorizedKeysSecretKey])); keys != buildReq.Spec.ClientPublicKey {
+		t.Errorf("authorized keys = %q, want only the session key", keys)
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].Name != buildReq.Name {
+		t.Errorf("ownerReferences = %+v, want the build request", secret.OwnerReferences)
+	}
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if name := pod.Spec.Volumes[0].Secret.SecretName; name != secret.Name {
+		t.Errorf("authorized_keys volume uses secret %q, want %q", name, secret.Name)
+	}
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// Settings are the reconciler settings that can change while the controller
+// runs. They are replaced as a whole, so reconciles in flight during a
+// reload carry on without being restarted and never see half of a change.
+type Settings struct {
+	// BuilderImage is the image of builders whose request and system do
+	// not name one
+	BuilderImage string
+	// BuilderResources are given to builders whose request sets no
+	// resources
+	BuilderResources corev1.ResourceRequirements
+	// Systems maps Nix systems to the image and node selector of their
+	// builders
+	Systems map[string]SystemBuilder
+	// SessionGracePeriod is how long a session may go without a heartbeat
+	// before its build request is failed. Zero disables reaping.
+	SessionGracePeriod time.Duration
+	// MaxRunningBuilders caps the build requests holding a builder at once
+	// across the cluster. Zero is unlimited.
+	MaxRunningBuilders int
+	// UserQuota caps the builders of each user across the cluster
+	UserQuota UserQuota
+}
+
+// settings returns the reconciler's current settings: the last ones applied,
+// or those it was created with
+func (r *NixBuildRequestReconciler) settings() *Settings {
+	if s := r.applied.Load(); s != nil {
+		return s
+	}
+	return &Settings{
+		BuilderImage:       r.BuilderImage,
+		BuilderResources:   r.BuilderResources,
+		Systems:            r.Systems,
+		SessionGracePeriod: r.SessionGracePeriod,
+		MaxRunningBuilders: r.MaxRunningBuilders,
+		UserQuota:          r.UserQuota,
+	}
+}
+
+// builderResources returns the resources of a build request's builder
+func (r *NixBuildRequestReconciler) builderResources(buildReq *nixv1alpha1.NixBuildRequest) corev1.ResourceRequirements {
+	if len(buildReq.Spec.Resources.Requests) > 0 || len(buildReq.Spec.Resources.Limits) > 0 {
+		return buildReq.Spec.Resources
+	}
+	return r.settings().BuilderResources
+}
+
+// ApplySettings replaces the reconciler's settings while it runs. Builders
+// that already exist keep their image and resources; idle warm pool pods
+// whose image changed are recycled at the pool's next refill.
+func (r *NixBuildRequestReconciler) ApplySettings(s Settings) {
+	old := r.settings()
+	r.applied.Store(&s)
+	log.Info().
+		Str("builder_image", s.BuilderImage).
+		Str("previous_builder_image", old.BuilderImage).
+		Int("systems", len(s.Systems)).
+		Dur("session_grace_period", s.SessionGracePeriod).
+		Int("max_running_builders", s.MaxRunningBuilders).
+		Int("user_max_builders", s.UserQuota.MaxBuilders).
+		Msg("Applied reloaded controller settings")
+}
@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestApplySettingsChangesNewBuilders(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	r, _ := newTestReconciler(t, buildReq)
+	memory := resource.MustParse("4Gi")
+	r.ApplySettings(Settings{
+		BuilderImage:     "builder:reloaded",
+		BuilderResources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceMemory: memory}},
+	})
+
+	_, got := reconcileOnce(t, r)
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	container := pod.Spec.Containers[0]
+	if container.Image != "builder:reloaded" {
+		t.Errorf("image = %q, want the reloaded default", container.Image)
+	}
+	if q := container.Resources.Requests[corev1.ResourceMemory]; q.Cmp(memory) != 0 {
+		t.Errorf("requests = %v, want the default memory", container.Resources.Requests)
+	}
+}
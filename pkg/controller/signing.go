@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/agent"
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/vault"
+)
+
+const (
+	// SigningTokenKey is the key in the signing token secret holding the
+	// bearer token a builder presents to the signing endpoint
+	SigningTokenKey = "token"
+
+	signingTokenMountPath = "/etc/nix-builder/signing"
+
+	// maxSignRequestBytes bounds the body of a signing request
+	maxSignRequestBytes = 4 << 20
+)
+
+// Signing has builders sign the outputs they push to the binary cache with
+// a key only the controller can use, instead of a secret-key in the cache
+// push Secret
+type Signing struct {
+	Signer vault.NixSigner
+	// URL is the signing endpoint as builders reach it
+	URL string
+}
+
+// signingTokenSecretName returns the secret holding a builder's signing token
+func signingTokenSecretName(podName string) string {
+	return podName + "-signing"
+}
+
+// signsOutputs reports whether a build request's builder gets its pushed
+// outputs signed by the controller
+func (r *NixBuildRequestReconciler) signsOutputs(buildReq *nixv1alpha1.NixBuildRequest) bool {
+	return r.Signing != nil && r.cachePushEnabled(buildReq)
+}
+
+// ensureSigningToken creates the token a builder presents to the signing
+// endpoint in a secret tied to the builder's lifetime, so the builder can
+// only have paths signed while its build runs
+func (r *NixBuildRequestReconciler) ensureSigningToken(ctx context.Context, owner builderOwner, podName string) error {
+	if err := r.createTokenSecret(ctx, owner, signingTokenSecretName(podName), SigningTokenKey); err != nil {
+		return fmt.Errorf("failed to create signing token secret: %w", err)
+	}
+	return nil
+}
+
+// addSigning wires the signing endpoint and the builder's token into the
+// pod, which the cache push hook uses instead of a secret-key
+func (r *NixBuildRequestReconciler) addSigning(pod *corev1.Pod) {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: "signing-token",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  signingTokenSecretName(pod.Name),
+				DefaultMode: &[]int32{0400}[0],
+			},
+		},
+	})
+
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "signing-token",
+		MountPath: signingTokenMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env,
+		corev1.EnvVar{Name: "SIGNING_URL", Value: r.Signing.URL},
+		corev1.EnvVar{Name: "SIGNING_POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+		}},
+		corev1.EnvVar{Name: "SIGNING_POD_NAME", ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+		}},
+	)
+}
+
+// SigningServer signs store paths for running builders. Each request names
+// its builder pod and presents the pod's signing token, which is deleted
+// with the build.
+type SigningServer struct {
+	// Reader reads builder pods and their token secrets, uncached so
+	// isolated builder namespaces need no informer
+	Reader client.Reader
+	Signer vault.NixSigner
+}
+
+func (s *SigningServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	namespace, name, ok := strings.Cut(r.Header.Get(agent.BuilderPodHeader), "/")
+	token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !bearer || token == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := s.authenticate(ctx, client.ObjectKey{Namespace: namespace, Name: name}, token); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("pod", namespace+"/"+name).Msg("Refused signing request")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req agent.SignRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSignRequestBytes)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid signing request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp := agent.SignResponse{Signatures: make(map[string]string, len(req.Paths))}
+	for _, info := range req.Paths {
+		fingerprint, err := vault.Fingerprint(info.Path, info.NarHash, info.NarSize, info.References)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		signature, err := s.Signer.Sign(ctx, fingerprint)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Str("path", info.Path).Msg("Failed to sign store path")
+			http.Error(w, "signing failed", http.StatusBadGateway)
+			return
+		}
+		resp.Signatures[info.Path] = signature
+	}
+
+	log.Ctx(ctx).Info().Str("pod", namespace+"/"+name).Int("paths", len(req.Paths)).Msg("Signed builder outputs")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// authenticate checks that pod is a running builder and token its signing
+// token
+func (s *SigningServer) authenticate(ctx context.Context, key client.ObjectKey, token string) error {
+	var pod corev1.Pod
+	if err := s.Reader.Get(ctx, key, &pod); err != nil {
+		return fmt.Errorf("failed to get builder pod: %w", err)
+	}
+	if pod.Labels[ManagedByLabel] != ManagedByValue || pod.DeletionTimestamp != nil {
+		return fmt.Errorf("pod is not a running builder")
+	}
+
+	var secret corev1.Secret
+	err := s.Reader.Get(ctx, client.ObjectKey{Namespace: key.Namespace, Name: signingTokenSecretName(key.Name)}, &secret)
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("builder has no signing token")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get signing token: %w", err)
+	}
+	if subtle.ConstantTimeCompare(secret.Data[SigningTokenKey], []byte(token)) != 1 {
+		return fmt.Errorf("wrong signing token")
+	}
+	return nil
+}
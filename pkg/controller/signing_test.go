@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/agent"
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// localSigner signs fingerprints with an in-memory Nix key
+type localSigner struct{ key ed25519.PrivateKey }
+
+func (s localSigner) Sign(ctx context.Context, fingerprint []byte) (string, error) {
+	return "cache-1:" + base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, fingerprint)), nil
+}
+
+func (s localSigner) PublicKey(ctx context.Context) (string, error) {
+	return "cache-1:" + base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey)), nil
+}
+
+func TestReconcilePendingSignsPushedOutputs(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	r, _ := newTestReconciler(t, buildReq)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.CachePush = &CachePush{URL: "s3://nix-cache", Default: true}
+	r.Signing = &Signing{Signer: localSigner{private}, URL: "http://controller:8083/v1/sign"}
+
+	_, got := reconcileOnce(t, r)
+
+	ctx := context.Background()
+	var pod corev1.Pod
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	container := pod.Spec.Containers[0]
+	if !slices.Contains(container.Env, corev1.EnvVar{Name: "SIGNING_URL", Value: "http://controller:8083/v1/sign"}) {
+		t.Errorf("env = %v, want SIGNING_URL", container.Env)
+	}
+	if !slices.ContainsFunc(container.VolumeMounts, func(m corev1.VolumeMount) bool { return m.MountPath == signingTokenMountPath }) {
+		t.Errorf("volume mounts = %v, want the signing token", container.VolumeMounts)
+	}
+	var secret corev1.Secret
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: signingTokenSecretName(pod.Name)}, &secret); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(&SigningServer{Reader: r.Client, Signer: localSigner{private}})
+	defer server.Close()
+	sign := func(token string) *http.Response {
+		t.Helper()
+		body := `{"paths":[{"path":"/nix/store/aaaa-hello","narHash":"sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s","narSize":1024,"references":["/nix/store/aaaa-hello"]}]}`
+		req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(agent.BuilderPodHeader, "default/"+pod.Name)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := sign(string(secret.Data[SigningTokenKey]))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s, want 200", resp.Status)
+	}
+	var signed agent.SignResponse
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	_, encoded, _ := strings.Cut(signed.Signatures["/nix/store/aaaa-hello"], ":")
+	signature, _ := base64.StdEncoding.DecodeString(encoded)
+	fingerprint := "1;/nix/store/aaaa-hello;sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s;1024;/nix/store/aaaa-hello"
+	if !ed25519.Verify(public, []byte(fingerprint), signature) {
+		t.Errorf("signature %q does not verify", signed.Signatures["/nix/store/aaaa-hello"])
+	}
+
+	if resp := sign("wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status with the wrong token = %s, want 401", resp.Status)
+	}
+	if err := r.Delete(ctx, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if resp := sign(string(secret.Data[SigningTokenKey])); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status after the build's token was deleted = %s, want 401", resp.Status)
+	}
+}
@@ -0,0 +1,187 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/status"
+)
+
+// CapacityTypeLabel marks builder pods running on spot nodes
+const CapacityTypeLabel = "nix.io/capacity-type"
+
+// DefaultMaxReschedules is how many times a spot build request's builder
+// is replaced before the request fails
+const DefaultMaxReschedules int32 = 3
+
+// Reasons of the DisruptionTarget condition for pods whose node is going
+// away, which the core API does not name
+const (
+	reasonDeletionByTaintManager = "DeletionByTaintManager"
+	reasonEvictionByEvictionAPI  = "EvictionByEvictionAPI"
+	reasonDeletionByPodGC        = "DeletionByPodGC"
+)
+
+// SpotScheduling places builders on spot or preemptible nodes
+type SpotScheduling struct {
+	// NodeSelector selects the spot node pool
+	NodeSelector map[string]string
+	// Tolerations let builders onto spot nodes, which are usually tainted
+	Tolerations []corev1.Toleration
+	// Default runs the builders of build requests that do not set
+	// spec.spot on spot nodes
+	Default bool
+	// MaxReschedules bounds how often a build request's builder is replaced
+	// after its node was reclaimed
+	MaxReschedules int32
+}
+
+// SpotPresets select the spot node pools of common providers
+var SpotPresets = map[string]SpotScheduling{
+	"gke": {
+		NodeSelector: map[string]string{"cloud.google.com/gke-spot": "true"},
+		Tolerations: []corev1.Toleration{{
+			Key: "cloud.google.com/gke-spot", Operator: corev1.TolerationOpEqual, Value: "true", Effect: corev1.TaintEffectNoSchedule,
+		}},
+	},
+	"eks": {
+		NodeSelector: map[string]string{"eks.amazonaws.com/capacityType": "SPOT"},
+	},
+	"karpenter": {
+		NodeSelector: map[string]string{"karpenter.sh/capacity-type": "spot"},
+	},
+	"aks": {
+		NodeSelector: map[string]string{"kubernetes.azure.com/scalesetpriority": "spot"},
+		Tolerations: []corev1.Toleration{{
+			Key: "kubernetes.azure.com/scalesetpriority", Operator: corev1.TolerationOpEqual, Value: "spot", Effect: corev1.TaintEffectNoSchedule,
+		}},
+	},
+}
+
+// ParseToleration reads a toleration written like a taint, as key=value:Effect
+// to match a value or key:Effect to match any value. An empty effect
+// tolerates every effect.
+func ParseToleration(s string) (corev1.Toleration, error) {
+	keyValue, effect, _ := strings.Cut(s, ":")
+	key, value, hasValue := strings.Cut(keyValue, "=")
+	if key == "" {
+		return corev1.Toleration{}, fmt.Errorf("toleration %q has no key", s)
+	}
+	switch corev1.TaintEffect(effect) {
+	case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		return corev1.Toleration{}, fmt.Errorf("toleration %q has unknown effect %q", s, effect)
+	}
+
+	toleration := corev1.Toleration{Key: key, Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffect(effect)}
+	if hasValue {
+		toleration.Operator = corev1.TolerationOpEqual
+		toleration.Value = value
+	}
+	return toleration, nil
+}
+
+// runsOnSpot reports whether a build request's builder runs on spot nodes
+func (r *NixBuildRequestReconciler) runsOnSpot(buildReq *nixv1alpha1.NixBuildRequest) bool {
+	if r.Spot == nil {
+		return false
+	}
+	if buildReq.Spec.Spot != nil {
+		return *buildReq.Spec.Spot
+	}
+	return r.Spot.Default
+}
+
+// addSpotPlacement places a builder pod on spot nodes. The node selector
+// the pod already has takes precedence.
+func (r *NixBuildRequestReconciler) addSpotPlacement(pod *corev1.Pod) {
+	pod.Labels[CapacityTypeLabel] = "spot"
+	if len(r.Spot.NodeSelector) > 0 {
+		selector := maps.Clone(r.Spot.NodeSelector)
+		maps.Copy(selector, pod.Spec.NodeSelector)
+		pod.Spec.NodeSelector = selector
+	}
+	for _, toleration := range r.Spot.Tolerations {
+		if !slices.Contains(pod.Spec.Tolerations, toleration) {
+			pod.Spec.Tolerations = append(pod.Spec.Tolerations, toleration)
+		}
+	}
+}
+
+// podReclaimed reports whether a pod is being removed because its node is
+// going away, such as a spot node the provider reclaimed, a node that shut
+// down or one being drained
+func podReclaimed(pod *corev1.Pod) (string, bool) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type != corev1.DisruptionTarget || cond.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch cond.Reason {
+		case corev1.PodReasonTerminationByKubelet, reasonDeletionByTaintManager, reasonEvictionByEvictionAPI, reasonDeletionByPodGC:
+			return cond.Message, true
+		}
+	}
+	// Kubelets that predate the DisruptionTarget condition only set the
+	// pod's reason
+	if pod.Status.Phase == corev1.PodFailed && (pod.Status.Reason == "Evicted" || pod.Status.Reason == "Terminated" || pod.Status.Reason == "NodeShutdown") {
+		return pod.Status.Message, true
+	}
+	return "", false
+}
+
+// builderLost handles a builder pod that was preempted, reclaimed with its
+// node or removed. The builders of spot build requests are replaced;
+// others fail, as preempted when their node went away.
+func (r *NixBuildRequestReconciler) builderLost(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest, pod *corev1.Pod, message string) (ctrl.Result, error) {
+	if !r.runsOnSpot(buildReq) {
+		r.failBuild(buildReq, errcode.Preempted, "%s", message)
+		return r.updateStatus(ctx, buildReq)
+	}
+	if buildReq.Status.Reschedules >= r.Spot.MaxReschedules {
+		log.Ctx(ctx).Warn().Int32("reschedules", buildReq.Status.Reschedules).Msg("Builder lost too often, giving up")
+		r.failBuild(buildReq, errcode.Preempted, "%s, after replacing the builder %d times", message, buildReq.Status.Reschedules)
+		return r.updateStatus(ctx, buildReq)
+	}
+
+	// The node may never confirm the pod stopped, so it is not waited for
+	if pod != nil {
+		if r.DryRun {
+			r.recordDryRun(ctx, buildReq, fmt.Sprintf("Would delete lost builder pod %s and replace it: %s", pod.Name, message))
+			return r.updateStatus(ctx, buildReq)
+		}
+		if err := r.Delete(ctx, pod, client.GracePeriodSeconds(0)); client.IgnoreNotFound(err) != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to delete lost builder pod")
+			return ctrl.Result{}, err
+		}
+	}
+
+	log.Ctx(ctx).Info().Str("reason", message).Msg("Builder lost, replacing it")
+	r.warningEvent(buildReq, EventBuilderRescheduled, "%s, replacing the builder (%d of %d)", message, buildReq.Status.Reschedules+1, r.Spot.MaxReschedules)
+	status.MarkRescheduled(&buildReq.Status, *r.now(), message+", replacing the builder")
+	return r.updateStatus(ctx, buildReq)
+}
+
+// lostPodRemaining reports whether the pod a rescheduled build request
+// lost still exists, so that its replacement, which has the same name, has
+// to wait
+func (r *NixBuildRequestReconciler) lostPodRemaining(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (bool, error) {
+	if buildReq.Status.Reschedules == 0 {
+		return false, nil
+	}
+	err := r.Get(ctx, client.ObjectKey{Namespace: builderNamespace(buildReq), Name: builderPodName(buildReq)}, &corev1.Pod{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
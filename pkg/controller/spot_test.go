@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+func TestReconcileSpotBuilderIsReplaced(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	r, _ := newTestReconciler(t, buildReq)
+	spot := SpotPresets["gke"]
+	spot.Default = true
+	spot.MaxReschedules = 1
+	r.Spot = &spot
+
+	reclaim := func() {
+		t.Helper()
+		var pod corev1.Pod
+		if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "nix-builder-abc"}, &pod); err != nil {
+			t.Fatalf("builder pod not created: %v", err)
+		}
+		pod.Status = corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{
+				Type:    corev1.DisruptionTarget,
+				Status:  corev1.ConditionTrue,
+				Reason:  "DeletionByTaintManager",
+				Message: "Taint manager: deleting due to NoExecute taint",
+			}},
+		}
+		if err := r.Status().Update(context.Background(), &pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, got := reconcileOnce(t, r)
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatalf("builder pod not created: %v", err)
+	}
+	if pod.Spec.NodeSelector["cloud.google.com/gke-spot"] != "true" || len(pod.Spec.Tolerations) != 1 || pod.Labels[CapacityTypeLabel] != "spot" {
+		t.Errorf("pod not placed on spot nodes: selector %v, tolerations %v, labels %v", pod.Spec.NodeSelector, pod.Spec.Tolerations, pod.Labels)
+	}
+
+	reclaim()
+	_, got = reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhasePending || got.Status.Reschedules != 1 || got.Status.PodName != "" {
+		t.Fatalf("got phase %q, %d reschedules and pod %q, want Pending, 1 and no pod", got.Status.Phase, got.Status.Reschedules, got.Status.PodName)
+	}
+	if !hasCondition(got, nixv1alpha1.BuildConditionPodReady, corev1.ConditionFalse) {
+		t.Error("PodReady is not False while the builder is replaced")
+	}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "nix-builder-abc"}, &corev1.Pod{}); !apierrors.IsNotFound(err) {
+		t.Errorf("lost builder pod was not deleted: %v", err)
+	}
+
+	_, got = reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseCreating || got.Status.PodName != "nix-builder-abc" {
+		t.Fatalf("got phase %q and pod %q, want a replacement pod Creating", got.Status.Phase, got.Status.PodName)
+	}
+
+	reclaim()
+	_, got = reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q after the last reschedule, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+	if code, _ := errcode.Parse(got.Status.Message); code != errcode.Preempted {
+		t.Errorf("message = %q, want an %s message", got.Status.Message, errcode.Preempted)
+	}
+}
+
+func TestReconcileSpotDryRunKeepsLostBuilder(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	buildReq.Spec.Spot = &[]bool{true}[0]
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default"},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{
+				Type:    corev1.DisruptionTarget,
+				Status:  corev1.ConditionTrue,
+				Reason:  "DeletionByTaintManager",
+				Message: "Taint manager: deleting due to NoExecute taint",
+			}},
+		},
+	}
+	r, _ := newTestReconciler(t, buildReq, pod)
+	spot := SpotPresets["gke"]
+	spot.MaxReschedules = 1
+	r.Spot = &spot
+	r.DryRun = true
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseRunning || got.Status.Reschedules != 0 {
+		t.Errorf("got phase %q and %d reschedules, want the build left Running", got.Status.Phase, got.Status.Reschedules)
+	}
+	if !hasCondition(got, nixv1alpha1.BuildConditionDryRun, corev1.ConditionTrue) || !strings.HasPrefix(got.Status.Message, "Dry run: Would delete lost builder pod nix-builder-abc") {
+		t.Errorf("message = %q, want the deletion recorded as a dry run", got.Status.Message)
+	}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "nix-builder-abc"}, &corev1.Pod{}); err != nil {
+		t.Errorf("lost builder pod after a dry run: %v, want it kept", err)
+	}
+}
+
+func TestReconcileSpotNeedsSpotScheduling(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	buildReq.Spec.Spot = &[]bool{true}[0]
+	r, _ := newTestReconciler(t, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	if code, _ := errcode.Parse(got.Status.Message); got.Status.Phase != nixv1alpha1.BuildPhaseFailed || code != errcode.Invalid {
+		t.Errorf("got phase %q and message %q, want an %s failure", got.Status.Phase, got.Status.Message, errcode.Invalid)
+	}
+}
+
+func TestParseToleration(t *testing.T) {
+	tests := map[string]corev1.Toleration{
+		"spot=true:NoSchedule": {Key: "spot", Operator: corev1.TolerationOpEqual, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+		"spot:NoExecute":       {Key: "spot", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute},
+		"spot":                 {Key: "spot", Operator: corev1.TolerationOpExists},
+	}
+	for value, want := range tests {
+		got, err := ParseToleration(value)
+		if err != nil || got != want {
+			t.Errorf("ParseToleration(%q) = %+v, %v, want %+v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"=true:NoSchedule", "spot=true:Sometimes"} {
+		if _, err := ParseToleration(value); err == nil {
+			t.Errorf("ParseToleration(%q) accepted an invalid toleration", value)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// sshProbeTimeout bounds connecting to a builder and reading its banner
+	sshProbeTimeout = 2 * time.Second
+	// sshProbeMaxLines is how many lines a server may send before its
+	// identification string, which RFC 4253 allows
+	sshProbeMaxLines = 10
+)
+
+// ProbeSSHBanner dials addr and succeeds once the server sends an SSH
+// identification string. A listening socket alone is not enough: sshd may
+// accept connections before it can serve them.
+func ProbeSSHBanner(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, sshProbeTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set read deadline: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	for range sshProbeMaxLines {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read SSH banner: %w", err)
+		}
+		if strings.HasPrefix(line, "SSH-2.0-") || strings.HasPrefix(line, "SSH-1.99-") {
+			return nil
+		}
+	}
+	return fmt.Errorf("no SSH identification string from %s", addr)
+}
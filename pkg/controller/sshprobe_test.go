@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcileCreatingWaitsForSSH(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default"},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			PodIP:      "10.0.0.42",
+			Conditions: []corev1.PodCondition{{Type: corev1.ContainersReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	r, _ := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhaseCreating), pod)
+	probeErr := errors.New("connection reset")
+	var probed string
+	r.SSHProbe = func(ctx context.Context, addr string) error {
+		probed = addr
+		return probeErr
+	}
+
+	_, got := reconcileOnce(t, r)
+
+	if probed != "10.0.0.42:22" {
+		t.Errorf("probed %q, want 10.0.0.42:22", probed)
+	}
+	if got.Status.Phase != nixv1alpha1.BuildPhaseCreating {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseCreating)
+	}
+	if len(got.Status.Conditions) != 1 || got.Status.Conditions[0].Reason != "SSHNotReady" {
+		t.Fatalf("conditions = %+v, want a single SSHNotReady condition", got.Status.Conditions)
+	}
+
+	probeErr = nil
+	_, got = reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseRunning {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseRunning)
+	}
+	if len(got.Status.Conditions) != 1 || got.Status.Conditions[0].Status != corev1.ConditionTrue {
+		t.Errorf("conditions = %+v, want a single true PodReady condition", got.Status.Conditions)
+	}
+}
@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+const (
+	// StatusMirrorKey is the key of the status ConfigMap holding the summary
+	StatusMirrorKey = "status.json"
+
+	// statusMirrorInterval is how often the status ConfigMap is refreshed
+	statusMirrorInterval = 15 * time.Second
+)
+
+// StatusSummary is the compact view of the controller's state mirrored into
+// the status ConfigMap for tools that cannot read the custom resources
+type StatusSummary struct {
+	// Phases counts build requests in each phase
+	Phases map[nixv1alpha1.BuildPhase]int `json:"phases"`
+	// Builds lists the build requests that have not finished
+	Builds []BuildSummary `json:"builds"`
+	// Pool reports the idle pods of each warm pool variant
+	Pool []PoolSummary `json:"pool,omitempty"`
+	// Capacity compares the builds waiting for a builder with the builders
+	// the controller may run
+	Capacity CapacitySummary `json:"capacity"`
+}
+
+// BuildSummary describes one unfinished build request
+type BuildSummary struct {
+	Namespace     string                 `json:"namespace"`
+	Name          string                 `json:"name"`
+	Phase         nixv1alpha1.BuildPhase `json:"phase"`
+	Requester     string                 `json:"requester,omitempty"`
+	System        string                 `json:"system,omitempty"`
+	Pod           string                 `json:"pod,omitempty"`
+	QueuePosition int32                  `json:"queuePosition,omitempty"`
+	StartTime     *metav1.Time           `json:"startTime,omitempty"`
+	Repository    string                 `json:"repository,omitempty"`
+	Commit        string                 `json:"commit,omitempty"`
+	Pipeline      string                 `json:"pipeline,omitempty"`
+}
+
+// PoolSummary describes the idle pods of a warm pool variant
+type PoolSummary struct {
+	Variant string `json:"variant"`
+	Idle    int    `json:"idle"`
+	Ready   int    `json:"ready"`
+	Min     int    `json:"min"`
+}
+
+// MirrorStatus writes a StatusSummary to StatusConfigMap until ctx is
+// cancelled
+func (r *NixBuildRequestReconciler) MirrorStatus(ctx context.Context) error {
+	log.Info().Str("configmap", r.StatusConfigMap.String()).Msg("Mirroring status to ConfigMap")
+
+	ticker := time.NewTicker(statusMirrorInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.mirrorStatus(ctx); err != nil {
+			log.Error().Err(err).Msg("Failed to mirror status")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// mirrorStatus refreshes the status ConfigMap, leaving it alone when the
+// summary has not changed. In dry-run mode the change is only logged.
+func (r *NixBuildRequestReconciler) mirrorStatus(ctx context.Context) error {
+	summary, err := r.statusSummary(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode status summary: %w", err)
+	}
+
+	var configMap corev1.ConfigMap
+	err = r.Get(ctx, r.StatusConfigMap, &configMap)
+	if apierrors.IsNotFound(err) {
+		configMap = corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      r.StatusConfigMap.Name,
+				Namespace: r.StatusConfigMap.Namespace,
+				Labels:    map[string]string{ManagedByLabel: ManagedByValue},
+			},
+			Data: map[string]string{StatusMirrorKey: string(data)},
+		}
+		if r.DryRun {
+			log.Debug().Str("configmap", r.StatusConfigMap.String()).Bool("dry_run", true).Msg("Would create status ConfigMap")
+			return nil
+		}
+		if err := r.Create(ctx, &configMap); err != nil {
+			return fmt.Errorf("failed to create status ConfigMap: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get status ConfigMap: %w", err)
+	}
+
+	if configMap.Data[StatusMirrorKey] == string(data) {
+		return nil
+	}
+	if r.DryRun {
+		log.Debug().Str("configmap", r.StatusConfigMap.String()).Bool("dry_run", true).Msg("Would update status ConfigMap")
+		return nil
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[StatusMirrorKey] = string(data)
+	if err := r.Update(ctx, &configMap); err != nil {
+		return fmt.Errorf("failed to update status ConfigMap: %w", err)
+	}
+	return nil
+}
+
+// statusSummary summarizes the build requests, warm pool and capacity
+func (r *NixBuildRequestReconciler) statusSummary(ctx context.Context) (*StatusSummary, error) {
+	var buildReqs nixv1alpha1.NixBuildRequestList
+	if err := r.List(ctx, &buildReqs); err != nil {
+		return nil, fmt.Errorf("failed to list build requests: %w", err)
+	}
+
+	summary := &StatusSummary{
+		Phases: make(map[nixv1alpha1.BuildPhase]int),
+		Builds: []BuildSummary{},
+	}
+	for _, buildReq := range buildReqs.Items {
+		phase := buildReq.Status.Phase
+		if phase == "" {
+			phase = nixv1alpha1.BuildPhasePending
+		}
+		summary.Phases[phase]++
+		if phase == nixv1alpha1.BuildPhaseCompleted || phase == nixv1alpha1.BuildPhaseFailed {
+			continue
+		}
+		summary.Builds = append(summary.Builds, BuildSummary{
+			Namespace:     buildReq.Namespace,
+			Name:          buildReq.Name,
+			Phase:         phase,
+			Requester:     buildReq.Annotations[policy.RequesterAnnotation],
+			System:        buildReq.Spec.System,
+			Pod:           buildReq.Status.PodName,
+			QueuePosition: buildReq.Status.QueuePosition,
+			StartTime:     buildReq.Status.StartTime,
+			Repository:    buildReq.Annotations[nixv1alpha1.RepositoryAnnotation],
+			Commit:        buildReq.Annotations[nixv1alpha1.CommitSHAAnnotation],
+			Pipeline:      buildReq.Annotations[nixv1alpha1.PipelineIDAnnotation],
+		})
+	}
+	slices.SortFunc(summary.Builds, func(a, b BuildSummary) int {
+		return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+	})
+
+	variants := r.warmPoolVariants()
+	if len(variants) == 0 {
+		summary.Capacity = r.capacitySummary(summary)
+		return summary, nil
+	}
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(r.WarmPoolNamespace), client.MatchingLabels{PoolLabel: PoolLabelWarm}); err != nil {
+		return nil, fmt.Errorf("failed to list pooled pods: %w", err)
+	}
+	for _, variant := range variants {
+		pool := PoolSummary{Variant: variant.Name, Min: variant.Min}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if poolPodVariant(pod) != variant.Name || !pod.DeletionTimestamp.IsZero() {
+				continue
+			}
+			pool.Idle++
+			if isPodReady(pod) {
+				pool.Ready++
+			}
+		}
+		summary.Pool = append(summary.Pool, pool)
+	}
+	summary.Capacity = r.capacitySummary(summary)
+	return summary, nil
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+func TestMirrorStatusSummarizesActiveBuilds(t *testing.T) {
+	running := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	running.Annotations = map[string]string{policy.RequesterAnnotation: "alice"}
+	done := newBuildRequest(nixv1alpha1.BuildPhaseCompleted)
+	done.Name = "build-done"
+	pooledPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-pool-1", Namespace: "default", Labels: map[string]string{"app": "nix-builder", PoolLabel: PoolLabelWarm}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	r, _ := newTestReconciler(t, running, done, pooledPod)
+	r.WarmPoolSize = 2
+	r.WarmPoolNamespace = "default"
+	r.StatusConfigMap = client.ObjectKey{Namespace: "nix-system", Name: "nix-build-status"}
+
+	if err := r.mirrorStatus(context.Background()); err != nil {
+		t.Fatalf("mirrorStatus: %v", err)
+	}
+
+	var configMap corev1.ConfigMap
+	if err := r.Get(context.Background(), r.StatusConfigMap, &configMap); err != nil {
+		t.Fatal(err)
+	}
+	var summary StatusSummary
+	if err := json.Unmarshal([]byte(configMap.Data[StatusMirrorKey]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Phases[nixv1alpha1.BuildPhaseRunning] != 1 || summary.Phases[nixv1alpha1.BuildPhaseCompleted] != 1 {
+		t.Errorf("phases = %v, want one running and one completed", summary.Phases)
+	}
+	if len(summary.Builds) != 1 || summary.Builds[0].Name != running.Name || summary.Builds[0].Requester != "alice" {
+		t.Errorf("builds = %+v, want only %s requested by alice", summary.Builds, running.Name)
+	}
+	if len(summary.Pool) != 1 || summary.Pool[0].Idle != 1 || summary.Pool[0].Min != 2 {
+		t.Errorf("pool = %+v, want one idle pod of two", summary.Pool)
+	}
+
+	version := configMap.ResourceVersion
+	if err := r.mirrorStatus(context.Background()); err != nil {
+		t.Fatalf("mirrorStatus: %v", err)
+	}
+	if err := r.Get(context.Background(), r.StatusConfigMap, &configMap); err != nil {
+		t.Fatal(err)
+	}
+	if configMap.ResourceVersion != version {
+		t.Errorf("unchanged summary rewrote the ConfigMap")
+	}
+}
+
+func TestMirrorStatusDryRun(t *testing.T) {
+	r, _ := newTestReconciler(t, newBuildRequest(nixv1alpha1.BuildPhaseRunning))
+	r.StatusConfigMap = client.ObjectKey{Namespace: "nix-system", Name: "nix-build-status"}
+	r.DryRun = true
+
+	if err := r.mirrorStatus(context.Background()); err != nil {
+		t.Fatalf("mirrorStatus: %v", err)
+	}
+	if err := r.Get(context.Background(), r.StatusConfigMap, &corev1.ConfigMap{}); !apierrors.IsNotFound(err) {
+		t.Errorf("status ConfigMap after a dry run: %v, want none", err)
+	}
+}
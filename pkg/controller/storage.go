@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+const (
+	storeVolumeName = "nix-store"
+	// storeSeedMountPath is where the seeding init container mounts the
+	// store volume, so the image's own /nix stays visible to copy from
+	storeSeedMountPath = "/mnt/nix"
+)
+
+// defaultStoreSize is the size of Session claims that do not set one
+var defaultStoreSize = resource.MustParse("20Gi")
+
+// storageFor returns the persistent storage a build request's builder gets,
+// or nil when its store is ephemeral
+func (r *NixBuildRequestReconciler) storageFor(buildReq *nixv1alpha1.NixBuildRequest) *nixv1alpha1.StorageSpec {
+	storage := buildReq.Spec.Storage
+	if storage == nil {
+		storage = &r.DefaultStorage
+	}
+	if storage.Type == "" || storage.Type == nixv1alpha1.StorageEphemeral {
+		return nil
+	}
+	return storage
+}
+
+// validateStorage checks that a build request's storage can be provided
+func validateStorage(storage *nixv1alpha1.StorageSpec) error {
+	if storage != nil && storage.Type == nixv1alpha1.StorageShared && storage.ClaimName == "" {
+		return fmt.Errorf("shared storage needs a claim name")
+	}
+	return nil
+}
+
+// storeClaimName returns the claim holding a builder's /nix
+func storeClaimName(storage *nixv1alpha1.StorageSpec, podName string) string {
+	if storage.ClaimName != "" {
+		return storage.ClaimName
+	}
+	return podName + "-store"
+}
+
+// ensureStoreClaim creates a builder's Session claim, reusing it if it
+// already exists. Unless the storage is retained the claim is owned by the
+// build request and deleted with it.
+func (r *NixBuildRequestReconciler) ensureStoreClaim(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest, storage *nixv1alpha1.StorageSpec, claimName string) error {
+	size := storage.Size
+	if size == nil {
+		size = r.DefaultStorage.Size
+	}
+	if size == nil {
+		size = &defaultStoreSize
+	}
+	storageClass := storage.StorageClassName
+	if storageClass == nil {
+		storageClass = r.DefaultStorage.StorageClassName
+	}
+
+	owner := buildRequestOwner(buildReq)
+	if storage.Retain {
+		owner.OwnerReferences = nil
+		owner.Labels = map[string]string{"app": "nix-builder", ManagedByLabel: ManagedByValue}
+	}
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: owner.objectMeta(claimName),
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: storageClass,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: *size},
+			},
+		},
+	}
+	if err := r.Create(ctx, claim); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create store claim: %w", err)
+	}
+	return nil
+}
+
+// addStoreVolume mounts a claim at the builder's /nix. Mounting it hides the
+// image's own store, which holds Nix and sshd, so an init container first
+// copies the image's store paths into the volume. Existing paths are kept,
+// since store paths never change once written.
+func addStoreVolume(pod *corev1.Pod, claimName string) {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: storeVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+		},
+	})
+
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      storeVolumeName,
+		MountPath: "/nix",
+	})
+
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+		Name:    "seed-store",
+		Image:   container.Image,
+		Command: []string{"/bin/bash", "-c", "cp -an /nix/. " + storeSeedMountPath + "/"},
+		VolumeMounts: []corev1.VolumeMount{{
+			Name:      storeVolumeName,
+			MountPath: storeSeedMountPath,
+		}},
+	})
+}
@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingCreatesStoreClaim(t *testing.T) {
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	buildReq.Spec.Storage = &nixv1alpha1.StorageSpec{Type: nixv1alpha1.StorageSession}
+	r, _ := newTestReconciler(t, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	var claim corev1.PersistentVolumeClaim
+	claimName := got.Status.PodName + "-store"
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: claimName}, &claim); err != nil {
+		t.Fatalf("store claim not created: %v", err)
+	}
+	if size := claim.Spec.Resources.Requests[corev1.ResourceStorage]; size.Cmp(defaultStoreSize) != 0 {
+		t.Errorf("claim size = %s, want %s", size.String(), defaultStoreSize.String())
+	}
+	if len(claim.OwnerReferences) != 1 || claim.OwnerReferences[0].Name != "build-abc" {
+		t.Errorf("claim owners = %+v, want the build request", claim.OwnerReferences)
+	}
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatalf("builder pod not created: %v", err)
+	}
+	if len(pod.Spec.InitContainers) != 1 || pod.Spec.InitContainers[0].Name != "seed-store" {
+		t.Errorf("init containers = %+v, want seed-store", pod.Spec.InitContainers)
+	}
+	if !slices.ContainsFunc(pod.Spec.Containers[0].VolumeMounts, func(m corev1.VolumeMount) bool {
+		return m.Name == storeVolumeName && m.MountPath == "/nix"
+	}) {
+		t.Errorf("builder does not mount the store volume at /nix")
+	}
+}
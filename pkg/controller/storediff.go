@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/agent"
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// storeDiffTimeout bounds the request to a builder's agent for its store diff
+const storeDiffTimeout = 10 * time.Second
+
+// recordStoreDiff asks the agent of a builder with a persistent store what
+// the session added to it and records the totals in status and metrics.
+// Failures are only logged so that they never hold up cleanup.
+func (r *NixBuildRequestReconciler) recordStoreDiff(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) {
+	if buildReq.Status.AgentEndpoint == "" || buildReq.Status.StoreDiff != nil || r.storageFor(buildReq) == nil {
+		return
+	}
+
+	diff, err := r.fetchStoreDiff(ctx, buildReq)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to read builder store diff")
+		return
+	}
+
+	buildReq.Status.StoreDiff = &nixv1alpha1.StoreDiff{
+		AddedPaths:   int32(diff.AddedPaths),
+		AddedBytes:   diff.AddedBytes,
+		ObservedTime: *r.now(),
+	}
+	r.Metrics.ObserveStoreDiff(buildReq)
+	log.Ctx(ctx).Info().
+		Int("added_paths", diff.AddedPaths).
+		Int64("added_bytes", diff.AddedBytes).
+		Msg("Recorded builder store diff")
+
+	if err := r.Status().Update(ctx, buildReq); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to record builder store diff in status")
+	}
+}
+
+// fetchStoreDiff calls the builder agent's store diff endpoint with the
+// build request's agent token
+func (r *NixBuildRequestReconciler) fetchStoreDiff(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (*agent.StoreDiff, error) {
+	var secret corev1.Secret
+	if err := r.Get(ctx, client.ObjectKey{Namespace: builderNamespace(buildReq), Name: buildReq.Status.AgentTokenSecret}, &secret); err != nil {
+		return nil, fmt.Errorf("failed to read agent token: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, storeDiffTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildReq.Status.AgentEndpoint+"/v1/store-diff", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+string(secret.Data[AgentTokenKey]))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach builder agent: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("builder agent returned %s", resp.Status)
+	}
+
+	var diff agent.StoreDiff
+	if err := json.NewDecoder(resp.Body).Decode(&diff); err != nil {
+		return nil, fmt.Errorf("failed to decode store diff: %w", err)
+	}
+	return &diff, nil
+}
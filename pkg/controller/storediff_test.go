@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/agent"
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestCleanupRecordsStoreDiff(t *testing.T) {
+	builderAgent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/store-diff" || req.Header.Get("Authorization") != "Bearer secret-token" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(agent.StoreDiff{AddedPaths: 3, AddedBytes: 4096})
+	}))
+	defer builderAgent.Close()
+
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseCompleted)
+	buildReq.Spec.Storage = &nixv1alpha1.StorageSpec{Type: nixv1alpha1.StorageSession}
+	buildReq.Status.AgentEndpoint = builderAgent.URL
+	buildReq.Status.AgentTokenSecret = "nix-builder-abc-agent"
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default"}}
+	token := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc-agent", Namespace: "default"},
+		Data:       map[string][]byte{AgentTokenKey: []byte("secret-token")},
+	}
+	r, _ := newTestReconciler(t, buildReq, pod, token)
+
+	if err := r.cleanup(context.Background(), buildReq); err != nil {
+		t.Fatalf("cleanup returned error: %v", err)
+	}
+
+	diff := buildReq.Status.StoreDiff
+	if diff == nil || diff.AddedPaths != 3 || diff.AddedBytes != 4096 {
+		t.Fatalf("storeDiff = %+v, want 3 paths and 4096 bytes", diff)
+	}
+	if !diff.ObservedTime.Time.Equal(testEpoch) {
+		t.Errorf("observedTime = %v, want %v", diff.ObservedTime, testEpoch)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(pod), pod); !apierrors.IsNotFound(err) {
+		t.Errorf("builder pod not deleted: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// DefaultSystemFeatures are the Nix system features every builder offers
+// without special placement. Features that need hardware, such as kvm, have
+// to be mapped to the nodes providing it.
+var DefaultSystemFeatures = map[string]SystemFeature{
+	"benchmark":    {},
+	"big-parallel": {},
+}
+
+// SystemFeature places builders for requests needing a Nix system feature
+type SystemFeature struct {
+	// NodeSelector selects nodes that provide the feature
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations let builders onto nodes reserved for the feature
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Resources are requested from device plugins, such as
+	// devices.kubevirt.io/kvm for /dev/kvm, as both requests and limits
+	Resources corev1.ResourceList `json:"resources,omitempty"`
+}
+
+// LoadSystemFeatures reads a map of Nix system features to builder placement
+// from a YAML or JSON file. The entries are added to DefaultSystemFeatures,
+// replacing defaults of the same name.
+func LoadSystemFeatures(path string) (map[string]SystemFeature, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system features: %w", err)
+	}
+
+	var features map[string]SystemFeature
+	if err := yaml.UnmarshalStrict(data, &features); err != nil {
+		return nil, fmt.Errorf("failed to parse system features: %w", err)
+	}
+	merged := maps.Clone(DefaultSystemFeatures)
+	maps.Copy(merged, features)
+	return merged, nil
+}
+
+// requiredFeatures returns the placement of each system feature a build
+// request needs, failing for features no builder is configured to offer
+func (r *NixBuildRequestReconciler) requiredFeatures(buildReq *nixv1alpha1.NixBuildRequest) ([]SystemFeature, error) {
+	known := r.SystemFeatures
+	if known == nil {
+		known = DefaultSystemFeatures
+	}
+
+	var features []SystemFeature
+	for _, name := range buildReq.Spec.RequiredFeatures {
+		feature, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("no builders configured for system feature %q", name)
+		}
+		features = append(features, feature)
+	}
+	return features, nil
+}
+
+// addSystemFeatures places a builder pod where the features it needs are
+// available. The node selector the pod already has takes precedence.
+func addSystemFeatures(pod *corev1.Pod, features []SystemFeature) {
+	container := &pod.Spec.Containers[0]
+	// The resources may still be the build request's own
+	container.Resources = *container.Resources.DeepCopy()
+	for _, feature := range features {
+		if len(feature.NodeSelector) > 0 {
+			selector := maps.Clone(feature.NodeSelector)
+			maps.Copy(selector, pod.Spec.NodeSelector)
+			pod.Spec.NodeSelector = selector
+		}
+		for _, toleration := range feature.Tolerations {
+			if !slices.Contains(pod.Spec.Tolerations, toleration) {
+				pod.Spec.Tolerations = append(pod.Spec.Tolerations, toleration)
+			}
+		}
+		addDevices(container, feature.Resources)
+	}
+}
+
+// addDevices adds extended resources to a builder container as both
+// requests and limits, as device plugins require
+func addDevices(container *corev1.Container, devices corev1.ResourceList) {
+	for name, quantity := range devices {
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = corev1.ResourceList{}
+		}
+		if container.Resources.Limits == nil {
+			container.Resources.Limits = corev1.ResourceList{}
+		}
+		container.Resources.Requests[name] = quantity
+		container.Resources.Limits[name] = quantity
+	}
+}
+
+// validateDevices checks that a build request's devices are extended
+// resources in whole, positive numbers, which is all device plugins hand out
+func validateDevices(devices corev1.ResourceList) error {
+	for _, name := range slices.Sorted(maps.Keys(devices)) {
+		domain, _, qualified := strings.Cut(string(name), "/")
+		if !qualified || domain == "kubernetes.io" || strings.HasSuffix(domain, ".kubernetes.io") {
+			return fmt.Errorf("%s is not an extended resource", name)
+		}
+		if errs := validation.IsQualifiedName(string(name)); len(errs) > 0 {
+			return fmt.Errorf("invalid device %s: %s", name, strings.Join(errs, ", "))
+		}
+		quantity := devices[name]
+		if quantity.Sign() <= 0 || quantity.MilliValue()%1000 != 0 {
+			return fmt.Errorf("device %s needs a whole, positive quantity, not %s", name, quantity.String())
+		}
+	}
+	return nil
+}
+
+// KVMFeatures are the Nix system features a KVM profile offers. NixOS VM
+// tests need both.
+var KVMFeatures = []string{"kvm", "nixos-test"}
+
+// DefaultKVMResource is the extended resource the KubeVirt device plugin
+// hands out /dev/kvm as
+const DefaultKVMResource corev1.ResourceName = "devices.kubevirt.io/kvm"
+
+// WithKVMProfile returns features with KVMFeatures placed as kvm describes,
+// such as on nodes with the KubeVirt device plugin. Features that already
+// have a placement, such as from a system features file, keep it.
+func WithKVMProfile(features map[string]SystemFeature, kvm SystemFeature) map[string]SystemFeature {
+	if features == nil {
+		features = DefaultSystemFeatures
+	}
+	merged := maps.Clone(features)
+	for _, name := range KVMFeatures {
+		if _, ok := merged[name]; !ok {
+			merged[name] = kvm
+		}
+	}
+	return merged
+}
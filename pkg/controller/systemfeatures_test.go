@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingPlacesRequiredFeatures(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Spec.RequiredFeatures = []string{"kvm", "big-parallel"}
+	r, _ := newTestReconciler(t, buildReq)
+	kvm := resource.MustParse("1")
+	r.SystemFeatures = map[string]SystemFeature{
+		"big-parallel": {},
+		"kvm": {
+			NodeSelector: map[string]string{"kvm": "true"},
+			Tolerations:  []corev1.Toleration{{Key: "kvm", Operator: corev1.TolerationOpExists}},
+			Resources:    corev1.ResourceList{"devices.kubevirt.io/kvm": kvm},
+		},
+	}
+
+	_, got := reconcileOnce(t, r)
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if pod.Spec.NodeSelector["kvm"] != "true" || len(pod.Spec.Tolerations) != 1 {
+		t.Errorf("nodeSelector = %v, tolerations = %v, want kvm nodes", pod.Spec.NodeSelector, pod.Spec.Tolerations)
+	}
+	container := pod.Spec.Containers[0]
+	if q := container.Resources.Limits["devices.kubevirt.io/kvm"]; q.Cmp(kvm) != 0 {
+		t.Errorf("limits = %v, want the kvm device", container.Resources.Limits)
+	}
+	var nixConfig string
+	for _, env := range container.Env {
+		if env.Name == "NIX_CONFIG" {
+			nixConfig = env.Value
+		}
+	}
+	if !strings.Contains(nixConfig, "extra-system-features = kvm big-parallel") {
+		t.Errorf("NIX_CONFIG = %q, want the required features", nixConfig)
+	}
+
+	unknown := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	unknown.Spec.RequiredFeatures = []string{"gpu"}
+	r, _ = newTestReconciler(t, unknown)
+	_, got = reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed || !strings.HasPrefix(got.Status.Message, "E_INVALID") {
+		t.Errorf("phase = %q, message = %q, want an unmapped feature to fail", got.Status.Phase, got.Status.Message)
+	}
+}
+
+func TestReconcilePendingRequestsDevices(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	gpu := resource.MustParse("2")
+	buildReq.Spec.Devices = corev1.ResourceList{"nvidia.com/gpu": gpu}
+	r, _ := newTestReconciler(t, buildReq)
+	r.BuilderResources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+
+	_, got := reconcileOnce(t, r)
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	resources := pod.Spec.Containers[0].Resources
+	if q := resources.Requests["nvidia.com/gpu"]; q.Cmp(gpu) != 0 {
+		t.Errorf("requests = %v, want the GPUs", resources.Requests)
+	}
+	if q := resources.Limits["nvidia.com/gpu"]; q.Cmp(gpu) != 0 {
+		t.Errorf("limits = %v, want the GPUs", resources.Limits)
+	}
+	if _, ok := r.BuilderResources.Requests["nvidia.com/gpu"]; ok {
+		t.Error("devices were added to the default builder resources")
+	}
+
+	for _, devices := range []corev1.ResourceList{
+		{corev1.ResourceMemory: resource.MustParse("1Gi")},
+		{"example.kubernetes.io/kvm": resource.MustParse("1")},
+		{"devices.kubevirt.io/kvm": resource.MustParse("500m")},
+		{"devices.kubevirt.io/kvm": resource.MustParse("0")},
+	} {
+		invalid := newBuildRequest(nixv1alpha1.BuildPhasePending)
+		invalid.Spec.Devices = devices
+		r, _ = newTestReconciler(t, invalid)
+		_, got = reconcileOnce(t, r)
+		if got.Status.Phase != nixv1alpha1.BuildPhaseFailed || !strings.HasPrefix(got.Status.Message, "E_INVALID") {
+			t.Errorf("devices %v: phase = %q, message = %q, want them refused", devices, got.Status.Phase, got.Status.Message)
+		}
+	}
+}
+
+func TestWithKVMProfile(t *testing.T) {
+	kvm := SystemFeature{
+		NodeSelector: map[string]string{"kvm": "true"},
+		Resources:    corev1.ResourceList{DefaultKVMResource: resource.MustParse("1")},
+	}
+
+	features := WithKVMProfile(nil, kvm)
+	for _, name := range append([]string{"benchmark", "big-parallel"}, KVMFeatures...) {
+		if _, ok := features[name]; !ok {
+			t.Errorf("features lack %s", name)
+		}
+	}
+	if _, ok := features["nixos-test"].Resources[DefaultKVMResource]; !ok {
+		t.Error("nixos-test builders are not given /dev/kvm")
+	}
+	if _, ok := DefaultSystemFeatures["kvm"]; ok {
+		t.Error("the KVM profile changed the default system features")
+	}
+
+	configured := map[string]SystemFeature{"kvm": {NodeSelector: map[string]string{"metal": "true"}}}
+	features = WithKVMProfile(configured, kvm)
+	if features["kvm"].NodeSelector["metal"] != "true" || features["nixos-test"].NodeSelector["kvm"] != "true" {
+		t.Errorf("features = %v, want the configured kvm placement kept", features)
+	}
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"fmt"
+	"maps"
+	"os"
+
+	"sigs.k8s.io/yaml"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// archLabel is the well-known node label holding a node's CPU architecture
+const archLabel = "kubernetes.io/arch"
+
+// systemArchitectures maps Nix systems to the Kubernetes architecture of the
+// nodes that can build them natively
+var systemArchitectures = map[string]string{
+	"x86_64-linux":  "amd64",
+	"aarch64-linux": "arm64",
+	"armv7l-linux":  "arm",
+	"riscv64-linux": "riscv64",
+}
+
+// SystemBuilder configures the builders used for one Nix system
+type SystemBuilder struct {
+	// Image replaces the default builder image
+	Image string `json:"image,omitempty"`
+	// NodeSelector places builders on nodes that can build the system
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// LoadSystemBuilders reads a map of Nix systems to builder settings from a
+// YAML or JSON file
+func LoadSystemBuilders(path string) (map[string]SystemBuilder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system builders: %w", err)
+	}
+
+	var systems map[string]SystemBuilder
+	if err := yaml.UnmarshalStrict(data, &systems); err != nil {
+		return nil, fmt.Errorf("failed to parse system builders: %w", err)
+	}
+	return systems, nil
+}
+
+// systemBuilder returns the builder settings for a build request's system.
+// Systems that are not configured are placed on nodes of the matching
+// architecture using the default image.
+func (r *NixBuildRequestReconciler) systemBuilder(buildReq *nixv1alpha1.NixBuildRequest) (SystemBuilder, error) {
+	system := buildReq.Spec.System
+	if system == "" {
+		return SystemBuilder{}, nil
+	}
+	if builder, ok := r.settings().Systems[system]; ok {
+		return builder, nil
+	}
+	if arch, ok := systemArchitectures[system]; ok {
+		return SystemBuilder{NodeSelector: map[string]string{archLabel: arch}}, nil
+	}
+	return SystemBuilder{}, fmt.Errorf("no builders configured for system %q", system)
+}
+
+// builderNodeSelector merges the system's node selector with the build
+// request's own, which takes precedence
+func builderNodeSelector(system SystemBuilder, buildReq *nixv1alpha1.NixBuildRequest) map[string]string {
+	if len(system.NodeSelector) == 0 {
+		return buildReq.Spec.NodeSelector
+	}
+	selector := maps.Clone(system.NodeSelector)
+	maps.Copy(selector, buildReq.Spec.NodeSelector)
+	return selector
+}
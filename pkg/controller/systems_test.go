@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingPlacesSystemBuilder(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Spec.System = "aarch64-linux"
+	buildReq.Spec.NodeSelector = map[string]string{"node-pool": "builders"}
+	r, _ := newTestReconciler(t, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"kubernetes.io/arch": "arm64", "node-pool": "builders"}
+	if !maps.Equal(pod.Spec.NodeSelector, want) {
+		t.Errorf("nodeSelector = %v, want %v", pod.Spec.NodeSelector, want)
+	}
+}
+
+func TestReconcilePendingUnsupportedSystem(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Spec.System = "x86_64-darwin"
+	r, _ := newTestReconciler(t, buildReq)
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, nixv1alpha1.BuildPhaseFailed)
+	}
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/certs"
+)
+
+const (
+	// builderTLSMountPath is where builder pods find their TLS material
+	builderTLSMountPath = "/etc/nix-builder/tls"
+	// builderCertValidity bounds how long a builder's server certificate is valid
+	builderCertValidity = 24 * time.Hour
+	// proxyCertValidity is how long the proxy's client certificate is valid
+	proxyCertValidity = 90 * 24 * time.Hour
+	// proxyCertRenewBefore is how early the proxy certificate is reissued
+	proxyCertRenewBefore = 30 * 24 * time.Hour
+)
+
+// ensureBuilderTLS issues the server certificate for a builder pod and makes
+// sure the proxy has a current client certificate in the CA's namespace
+func (r *NixBuildRequestReconciler) ensureBuilderTLS(ctx context.Context, owner builderOwner, podName string) error {
+	var caSecret corev1.Secret
+	if err := r.Get(ctx, client.ObjectKey{
+		Namespace: owner.home(),
+		Name:      r.BuilderTLSSecret,
+	}, &caSecret); err != nil {
+		return fmt.Errorf("failed to get builder TLS CA secret: %w", err)
+	}
+
+	ca, err := certs.LoadCAFromSecret(&caSecret)
+	if err != nil {
+		return err
+	}
+
+	if err := r.ensureProxyTLSSecret(ctx, ca, owner.home()); err != nil {
+		return err
+	}
+
+	certPEM, keyPEM, err := ca.IssueServer(podName, []string{podName}, builderCertValidity)
+	if err != nil {
+		return fmt.Errorf("failed to issue builder certificate: %w", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: owner.objectMeta(certs.BuilderSecretName(podName)),
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			certs.SecretCAKey:         ca.CertPEM(),
+			certs.SecretCertKey:       certPEM,
+			certs.SecretPrivateKeyKey: keyPEM,
+		},
+	}
+
+	if err := r.Create(ctx, secret); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create builder TLS secret: %w", err)
+	}
+	return nil
+}
+
+// ensureProxyTLSSecret issues or renews the client certificate the proxy
+// presents when dialing builder pods
+func (r *NixBuildRequestReconciler) ensureProxyTLSSecret(ctx context.Context, ca *certs.CA, namespace string) error {
+	name := certs.ProxySecretName(r.BuilderTLSSecret)
+
+	var existing corev1.Secret
+	err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, &existing)
+	if err == nil && !certs.ExpiresWithin(existing.Data[certs.SecretCertKey], proxyCertRenewBefore) {
+		return nil
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get proxy TLS secret: %w", err)
+	}
+
+	certPEM, keyPEM, issueErr := ca.IssueClient("nix-remote-build-proxy", proxyCertValidity)
+	if issueErr != nil {
+		return fmt.Errorf("failed to issue proxy certificate: %w", issueErr)
+	}
+	data := map[string][]byte{
+		certs.SecretCAKey:         ca.CertPEM(),
+		certs.SecretCertKey:       certPEM,
+		certs.SecretPrivateKeyKey: keyPEM,
+	}
+
+	if apierrors.IsNotFound(err) {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels: map[string]string{
+					"app.kubernetes.io/name":      "nix-remote-build-controller",
+					"app.kubernetes.io/component": "proxy-tls",
+					ManagedByLabel:                ManagedByValue,
+				},
+			},
+			Type: corev1.SecretTypeTLS,
+			Data: data,
+		}
+		if err := r.Create(ctx, secret); err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create proxy TLS secret: %w", err)
+		}
+	} else {
+		existing.Data = data
+		if err := r.Update(ctx, &existing); err != nil {
+			return fmt.Errorf("failed to renew proxy TLS secret: %w", err)
+		}
+	}
+
+	log.Info().Str("namespace", namespace).Str("secret", name).Msg("Issued proxy client certificate")
+	return nil
+}
+
+// addBuilderTLS wires the builder's TLS secret and listener port into the pod
+func (r *NixBuildRequestReconciler) addBuilderTLS(pod *corev1.Pod) {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: "builder-tls",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  certs.BuilderSecretName(pod.Name),
+				DefaultMode: &[]int32{0400}[0],
+			},
+		},
+	})
+
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "builder-tls",
+		MountPath: builderTLSMountPath,
+		ReadOnly:  true,
+	})
+	container.Ports = append(container.Ports, corev1.ContainerPort{
+		Name:          "ssh-tls",
+		ContainerPort: r.BuilderTLSPort,
+		Protocol:      corev1.ProtocolTCP,
+	})
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "BUILDER_TLS_PORT",
+		Value: fmt.Sprintf("%d", r.BuilderTLSPort),
+	})
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/tracing"
+)
+
+// tracer records the controller's spans of each session
+var tracer = tracing.Tracer("github.com/omarjatoi/nix-remote-build-controller/pkg/controller")
+
+// tracedPhase reports whether reconciles of a phase get a span. Running and
+// finished build requests are reconciled periodically without progressing,
+// so only provisioning is traced.
+func tracedPhase(phase nixv1alpha1.BuildPhase) bool {
+	switch phase {
+	case nixv1alpha1.BuildPhaseRunning, nixv1alpha1.BuildPhaseCompleted, nixv1alpha1.BuildPhaseFailed:
+		return false
+	default:
+		return true
+	}
+}
+
+// traceBuilderStartup records the stages of bringing up a build request's
+// builder as spans in its session's trace, timed from the timestamps in its
+// status
+func traceBuilderStartup(buildReq *nixv1alpha1.NixBuildRequest) {
+	status := buildReq.Status
+	if status.StartTime == nil || status.SSHReadyTime == nil {
+		return
+	}
+
+	ctx := tracing.WithSession(context.Background(), buildReq.Spec.SessionID)
+	attrs := trace.WithAttributes(
+		tracing.SessionIDKey.String(buildReq.Spec.SessionID),
+		attribute.String("nix.builder_pod", status.PodName),
+	)
+	ctx, startup := tracer.Start(ctx, "builder.startup", attrs, trace.WithTimestamp(status.StartTime.Time))
+	for _, stage := range []struct {
+		name     string
+		from, to *metav1.Time
+	}{
+		{"builder.schedule", status.StartTime, status.PodScheduledTime},
+		{"builder.start", status.PodScheduledTime, status.PodReadyTime},
+		{"builder.ssh_ready", status.PodReadyTime, status.SSHReadyTime},
+	} {
+		if stage.from == nil || stage.to == nil {
+			continue
+		}
+		_, span := tracer.Start(ctx, stage.name, attrs, trace.WithTimestamp(stage.from.Time))
+		span.End(trace.WithTimestamp(stage.to.Time))
+	}
+	startup.End(trace.WithTimestamp(status.SSHReadyTime.Time))
+}
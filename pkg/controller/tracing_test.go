@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"maps"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/tracing"
+)
+
+func TestBuilderStartupJoinsSessionTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := tracing.NewProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	buildReq.Spec.SessionID = "0199a6b2-7c4e-7d1a-9f3b-2a5c8e1d4f60"
+	buildReq.Status.StartTime = &metav1.Time{Time: testEpoch}
+	buildReq.Status.PodScheduledTime = &metav1.Time{Time: testEpoch.Add(2 * time.Second)}
+	buildReq.Status.PodReadyTime = &metav1.Time{Time: testEpoch.Add(20 * time.Second)}
+	buildReq.Status.SSHReadyTime = &metav1.Time{Time: testEpoch.Add(21 * time.Second)}
+
+	traceBuilderStartup(buildReq)
+
+	wantTrace, _ := tracing.TraceID(buildReq.Spec.SessionID)
+	durations := make(map[string]time.Duration)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() != wantTrace {
+			t.Errorf("span %s trace ID = %s, want %s", span.Name(), span.SpanContext().TraceID(), wantTrace)
+		}
+		durations[span.Name()] = span.EndTime().Sub(span.StartTime())
+	}
+	want := map[string]time.Duration{
+		"builder.startup":   21 * time.Second,
+		"builder.schedule":  2 * time.Second,
+		"builder.start":     18 * time.Second,
+		"builder.ssh_ready": time.Second,
+	}
+	if !maps.Equal(durations, want) {
+		t.Errorf("span durations = %v, want %v", durations, want)
+	}
+}
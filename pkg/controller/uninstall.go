@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// UninstallOptions controls what Uninstall removes from a namespace
+type UninstallOptions struct {
+	// SSHKeySecret is the shared SSH keypair secret to delete, if any. It is
+	// created by the operator rather than the controller, so it is only
+	// removed when named explicitly.
+	SSHKeySecret string
+	// DryRun logs what would be deleted without deleting anything
+	DryRun bool
+}
+
+// Uninstall removes every NixBuildRequest and every resource created by the
+// controller or proxy in a namespace, so that no credentials are left behind
+// once the system is removed. Finalizers are stripped from build requests
+// because the controller that would process them may already be gone.
+func Uninstall(ctx context.Context, c client.Client, namespace string, opts UninstallOptions) error {
+	var buildReqs nixv1alpha1.NixBuildRequestList
+	if err := c.List(ctx, &buildReqs, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("failed to list build requests: %w", err)
+	}
+
+	for i := range buildReqs.Items {
+		buildReq := &buildReqs.Items[i]
+		log.Info().Str("build_request", buildReq.Name).Bool("dry_run", opts.DryRun).Msg("Deleting build request")
+		if opts.DryRun {
+			continue
+		}
+
+		if controllerutil.RemoveFinalizer(buildReq, "nix.io/cleanup") {
+			if err := c.Update(ctx, buildReq); client.IgnoreNotFound(err) != nil {
+				return fmt.Errorf("failed to remove finalizer from %s: %w", buildReq.Name, err)
+			}
+		}
+		if err := c.Delete(ctx, buildReq); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to delete build request %s: %w", buildReq.Name, err)
+		}
+	}
+
+	// Owner references normally take these with the build requests, but
+	// anything orphaned or not owned by a request is removed explicitly.
+	// Jobs go before their pods, which they would otherwise replace.
+	// Isolated namespaces are cluster-scoped and hold copies of the
+	// namespace's keys and credentials, so they are found by the namespace
+	// they serve.
+	managed := []client.ListOption{client.InNamespace(namespace), client.MatchingLabels{ManagedByLabel: ManagedByValue}}
+	lists := []struct {
+		kind string
+		list client.ObjectList
+		opts []client.ListOption
+	}{
+		{"job", &batchv1.JobList{}, managed},
+		{"pod", &corev1.PodList{}, managed},
+		{"pod", &corev1.PodList{}, []client.ListOption{client.InNamespace(namespace), client.MatchingLabels{"app": "nix-builder"}}},
+		{"secret", &corev1.SecretList{}, managed},
+		{"persistentvolumeclaim", &corev1.PersistentVolumeClaimList{}, managed},
+		{"service", &corev1.ServiceList{}, managed},
+		{"networkpolicy", &networkingv1.NetworkPolicyList{}, managed},
+		{"configmap", &corev1.ConfigMapList{}, managed},
+		{"namespace", &corev1.NamespaceList{}, []client.ListOption{client.MatchingLabels{
+			ManagedByLabel:             ManagedByValue,
+			BuildRequestNamespaceLabel: namespace,
+		}}},
+	}
+
+	for _, l := range lists {
+		if err := c.List(ctx, l.list, l.opts...); err != nil {
+			return fmt.Errorf("failed to list %ss: %w", l.kind, err)
+		}
+		objects, err := listObjects(l.list)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			if err := deleteObject(ctx, c, l.kind, obj, opts.DryRun); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.SSHKeySecret != "" {
+		secret := &corev1.Secret{}
+		secret.Name = opts.SSHKeySecret
+		secret.Namespace = namespace
+		if err := deleteObject(ctx, c, "secret", secret, opts.DryRun); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listObjects(list client.ObjectList) ([]client.Object, error) {
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]client.Object, 0, len(items))
+	for _, item := range items {
+		obj, ok := item.(client.Object)
+		if !ok {
+			return nil, fmt.Errorf("unexpected list item type %T", item)
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+func deleteObject(ctx context.Context, c client.Client, kind string, obj client.Object, dryRun bool) error {
+	log.Info().Str("kind", kind).Str("name", obj.GetName()).Bool("dry_run", dryRun).Msg("Deleting resource")
+	if dryRun {
+		return nil
+	}
+	if err := c.Delete(ctx, obj, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to delete %s %s: %w", kind, obj.GetName(), err)
+	}
+	return nil
+}
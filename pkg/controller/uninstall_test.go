@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestUninstallDeletesManagedResources(t *testing.T) {
+	managed := map[string]string{ManagedByLabel: ManagedByValue}
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	isolated := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "nix-build-0123", Labels: map[string]string{
+		ManagedByLabel: ManagedByValue, BuildRequestNamespaceLabel: "default",
+	}}}
+	otherTenant := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "nix-build-4567", Labels: map[string]string{
+		ManagedByLabel: ManagedByValue, BuildRequestNamespaceLabel: "team-b",
+	}}}
+	statusMirror := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "nix-build-status", Namespace: "default", Labels: managed}}
+	orphanJob := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-gone", Namespace: "default", Labels: managed}}
+	unmanaged := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "nix-config", Namespace: "default"}}
+	r, _ := newTestReconciler(t, buildReq, isolated, otherTenant, statusMirror, orphanJob, unmanaged)
+
+	if err := Uninstall(context.Background(), r.Client, "default", UninstallOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, obj := range []client.Object{buildReq, isolated, statusMirror, orphanJob} {
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(obj), obj); !apierrors.IsNotFound(err) {
+			t.Errorf("%s after uninstall: %v, want it deleted", obj.GetName(), err)
+		}
+	}
+	for _, obj := range []client.Object{otherTenant, unmanaged} {
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(obj), obj); err != nil {
+			t.Errorf("%s was deleted: %v", obj.GetName(), err)
+		}
+	}
+}
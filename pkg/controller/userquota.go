@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+// UserQuota caps what the builders of one user may hold at once across the
+// cluster. Zero values are unlimited.
+type UserQuota struct {
+	// MaxBuilders is how many build requests of one user may hold a
+	// builder at once
+	MaxBuilders int
+	// CPU and Memory cap the summed resource requests of one user's
+	// builders
+	CPU    resource.Quantity
+	Memory resource.Quantity
+}
+
+// enabled reports whether the quota limits anything
+func (q UserQuota) enabled() bool {
+	return q.MaxBuilders > 0 || !q.CPU.IsZero() || !q.Memory.IsZero()
+}
+
+// String describes the quota, such as "2 builders, 16 CPU per user"
+func (q UserQuota) String() string {
+	var limits []string
+	if q.MaxBuilders > 0 {
+		limits = append(limits, fmt.Sprintf("%d builders", q.MaxBuilders))
+	}
+	if !q.CPU.IsZero() {
+		limits = append(limits, q.CPU.String()+" CPU")
+	}
+	if !q.Memory.IsZero() {
+		limits = append(limits, q.Memory.String()+" memory")
+	}
+	return strings.Join(limits, ", ") + " per user"
+}
+
+// requester returns the user a build request is charged to: its
+// RequestedBy user, or the requester annotation of requests created by
+// other clients
+func requester(buildReq *nixv1alpha1.NixBuildRequest) string {
+	if buildReq.Spec.RequestedBy != nil && buildReq.Spec.RequestedBy.User != "" {
+		return buildReq.Spec.RequestedBy.User
+	}
+	return buildReq.Annotations[policy.RequesterAnnotation]
+}
+
+// setRequesterLabel labels a builder pod with the user it serves
+func setRequesterLabel(pod *corev1.Pod, buildReq *nixv1alpha1.NixBuildRequest) {
+	value := nixv1alpha1.RequesterLabelValue(requester(buildReq))
+	if value == "" {
+		delete(pod.Labels, nixv1alpha1.RequestedByLabel)
+		return
+	}
+	pod.Labels[nixv1alpha1.RequestedByLabel] = value
+}
+
+// userQuotaExceeded explains why a build request would take its user over
+// the UserQuota, or returns an empty string when it fits. The user's other
+// builders are charged the resources they would get now, which differ from
+// those they were created with only after a settings reload.
+func (r *NixBuildRequestReconciler) userQuotaExceeded(ctx context.Context, buildReq *nixv1alpha1.NixBuildRequest) (string, error) {
+	quota := r.settings().UserQuota
+	user := requester(buildReq)
+	if user == "" || !quota.enabled() {
+		return "", nil
+	}
+
+	var buildReqs nixv1alpha1.NixBuildRequestList
+	if err := r.List(ctx, &buildReqs); err != nil {
+		return "", fmt.Errorf("failed to list build requests: %w", err)
+	}
+
+	builders := 0
+	requests := r.builderResources(buildReq).Requests
+	cpu, memory := requests.Cpu().DeepCopy(), requests.Memory().DeepCopy()
+	for i := range buildReqs.Items {
+		other := &buildReqs.Items[i]
+		if other.Namespace == buildReq.Namespace && other.Name == buildReq.Name || requester(other) != user {
+			continue
+		}
+		if other.Status.Phase != nixv1alpha1.BuildPhaseCreating && other.Status.Phase != nixv1alpha1.BuildPhaseRunning {
+			continue
+		}
+		builders++
+		otherRequests := r.builderResources(other).Requests
+		cpu.Add(*otherRequests.Cpu())
+		memory.Add(*otherRequests.Memory())
+	}
+
+	switch {
+	case quota.MaxBuilders > 0 && builders >= quota.MaxBuilders:
+		return fmt.Sprintf("User %s already holds %d of the %d builders allowed per user", user, builders, quota.MaxBuilders), nil
+	case !quota.CPU.IsZero() && cpu.Cmp(quota.CPU) > 0:
+		return fmt.Sprintf("User %s would hold %s CPU with this builder, over the %s allowed per user", user, cpu.String(), quota.CPU.String()), nil
+	case !quota.Memory.IsZero() && memory.Cmp(quota.Memory) > 0:
+		return fmt.Sprintf("User %s would hold %s memory with this builder, over the %s allowed per user", user, memory.String(), quota.Memory.String()), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestReconcilePendingEnforcesUserQuota(t *testing.T) {
+	alice := &nixv1alpha1.Requester{User: "alice@example.com", KeyFingerprint: "SHA256:abc"}
+	running := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	running.Name = "build-running"
+	running.Spec.RequestedBy = alice
+	other := newBuildRequest(nixv1alpha1.BuildPhaseRunning)
+	other.Name = "build-other"
+	other.Spec.RequestedBy = &nixv1alpha1.Requester{User: "bob@example.com"}
+	buildReq := newBuildRequest("")
+	buildReq.Status.PodName = ""
+	buildReq.Spec.RequestedBy = alice
+	r, _ := newTestReconciler(t, running, other, buildReq)
+	r.BuilderResources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")}
+	r.UserQuota = UserQuota{MaxBuilders: 1}
+
+	_, got := reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed || got.Status.Message != "E_QUOTA: User alice@example.com already holds 1 of the 1 builders allowed per user" {
+		t.Fatalf("phase = %q, message = %q, want Failed over the builder limit", got.Status.Phase, got.Status.Message)
+	}
+
+	r.UserQuota = UserQuota{CPU: resource.MustParse("6")}
+	got.Status.Phase = nixv1alpha1.BuildPhasePending
+	if err := r.Status().Update(context.Background(), got); err != nil {
+		t.Fatal(err)
+	}
+	_, got = reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseFailed || got.Status.Message != "E_QUOTA: User alice@example.com would hold 8 CPU with this builder, over the 6 allowed per user" {
+		t.Fatalf("phase = %q, message = %q, want Failed over the CPU limit", got.Status.Phase, got.Status.Message)
+	}
+
+	// Bob's builder is not charged to Alice
+	r.UserQuota = UserQuota{MaxBuilders: 2, CPU: resource.MustParse("8")}
+	got.Status.Phase = nixv1alpha1.BuildPhasePending
+	if err := r.Status().Update(context.Background(), got); err != nil {
+		t.Fatal(err)
+	}
+	_, got = reconcileOnce(t, r)
+	if got.Status.Phase != nixv1alpha1.BuildPhaseCreating {
+		t.Fatalf("phase = %q, message = %q, want Creating within the quota", got.Status.Phase, got.Status.Message)
+	}
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if label := pod.Labels[nixv1alpha1.RequestedByLabel]; label != "alice_example.com" {
+		t.Errorf("pod %s label = %q, want alice_example.com", nixv1alpha1.RequestedByLabel, label)
+	}
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+const (
+	// defaultBuilderUser is the builder image's login user, used for
+	// requests without a requester
+	defaultBuilderUser = "nixbld"
+	// maxUsernameLength is the longest user name the builder accepts
+	maxUsernameLength = 32
+)
+
+// reservedUsernames are accounts that already exist in the builder image
+var reservedUsernames = []string{"root", "sshd", defaultBuilderUser}
+
+// builderUsername derives the Unix account a session logs in to its builder
+// as from the requester's identity, which may be an email address or an
+// OIDC subject rather than a valid user name
+func builderUsername(buildReq *nixv1alpha1.NixBuildRequest) string {
+	requester := strings.ToLower(buildReq.Annotations[policy.RequesterAnnotation])
+	if requester == "" {
+		return defaultBuilderUser
+	}
+
+	var b strings.Builder
+	for _, c := range requester {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '_', c == '-':
+			b.WriteRune(c)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	name := strings.Trim(b.String(), "-")
+	if name == "" {
+		return defaultBuilderUser
+	}
+
+	if name[0] < 'a' || name[0] > 'z' || slices.Contains(reservedUsernames, name) {
+		name = "u-" + name
+	}
+	if len(name) > maxUsernameLength {
+		name = strings.TrimRight(name[:maxUsernameLength], "-")
+	}
+	return name
+}
+
+// builderUserConfig restricts the builder's Nix daemon to the session's user.
+// It is applied after any other settings so requests cannot widen it.
+func builderUserConfig(user string) []string {
+	return []string{
+		fmt.Sprintf("trusted-users = root %s", user),
+		fmt.Sprintf("allowed-users = root %s", user),
+	}
+}
@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+)
+
+func TestReconcilePendingManagesBuilderUser(t *testing.T) {
+	buildReq := newBuildRequest(nixv1alpha1.BuildPhasePending)
+	buildReq.Annotations = map[string]string{policy.RequesterAnnotation: "Alice@Example.com"}
+	r, _ := newTestReconciler(t, buildReq)
+	r.ManageBuilderUsers = true
+
+	_, got := reconcileOnce(t, r)
+
+	if got.Status.BuilderUser != "alice-example-com" {
+		t.Fatalf("builderUser = %q, want %q", got.Status.BuilderUser, "alice-example-com")
+	}
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: got.Status.PodName}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	var nixConfig string
+	for _, env := range pod.Spec.Containers[0].Env {
+		if env.Name == "NIX_CONFIG" {
+			nixConfig = env.Value
+		}
+	}
+	if !strings.Contains(nixConfig, "trusted-users = root alice-example-com") {
+		t.Errorf("NIX_CONFIG = %q, want trusted-users limited to alice-example-com", nixConfig)
+	}
+}
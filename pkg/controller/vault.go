@@ -0,0 +1,25 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+)
+
+// vaultPublicKey is the key in the Vault KV entry holding the authorized_keys
+// contents for builder pods, mirroring the SSH keys secret layout
+const vaultPublicKey = "public"
+
+// ensureAuthorizedKeysFromVault copies the builder public key from Vault into
+// a secret tied to the builder's lifetime, so it is removed with the build
+func (r *NixBuildRequestReconciler) ensureAuthorizedKeysFromVault(ctx context.Context, owner builderOwner, podName string) error {
+	data, err := r.Vault.ReadKV(ctx, r.VaultKeyPath)
+	if err != nil {
+		return err
+	}
+
+	publicKey, ok := data[vaultPublicKey]
+	if !ok {
+		return fmt.Errorf("vault path %s missing required key '%s'", r.VaultKeyPath, vaultPublicKey)
+	}
+	return r.createAuthorizedKeysSecret(ctx, owner, podName, publicKey)
+}
@@ -0,0 +1,104 @@
+// Package errcode defines the user-facing codes the proxy and controller use
+// to report failures, so that a build request's status, the message a client
+// sees and metric labels all name a failure the same way.
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Code identifies a class of failure
+type Code string
+
+const (
+	// Quota means a resource quota or a proxy limit was reached
+	Quota Code = "E_QUOTA"
+	// Timeout means the builder was not ready in time
+	Timeout Code = "E_TIMEOUT"
+	// ImagePull means the builder image could not be pulled
+	ImagePull Code = "E_IMAGE_PULL"
+	// Unschedulable means no node could run the builder pod
+	Unschedulable Code = "E_UNSCHEDULABLE"
+	// Auth means authentication, authorization or policy refused the request
+	Auth Code = "E_AUTH"
+	// Invalid means the request asked for something that cannot be provided
+	Invalid Code = "E_INVALID"
+	// Builder means the builder pod failed or went away
+	Builder Code = "E_BUILDER"
+	// Preempted means a best-effort builder was evicted for higher priority
+	// work
+	Preempted Code = "E_PREEMPTED"
+	// Disabled means an administrator stopped provisioning builders,
+	// cluster-wide or for the namespace
+	Disabled Code = "E_DISABLED"
+	// Canceled means the client disconnected or the proxy shut down
+	Canceled Code = "E_CANCELED"
+	// Internal is any other failure
+	Internal Code = "E_INTERNAL"
+)
+
+var codes = []Code{Quota, Timeout, ImagePull, Unschedulable, Auth, Invalid, Builder, Preempted, Disabled, Canceled, Internal}
+
+// Error is a failure carrying a Code
+type Error struct {
+	Code Code
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return Message(e.Code, e.Err.Error())
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errorf returns an error with the given code and formatted message
+func Errorf(code Code, format string, args ...any) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// Of returns the code of err, or Internal if it has none. A nil error has no
+// code.
+func Of(err error) Code {
+	if err == nil {
+		return ""
+	}
+	var coded *Error
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	return Internal
+}
+
+// Text returns the message of err without its code
+func Text(err error) string {
+	var coded *Error
+	if errors.As(err, &coded) {
+		return coded.Err.Error()
+	}
+	return err.Error()
+}
+
+// Message formats a user-facing message for code, e.g. "E_QUOTA: ..."
+func Message(code Code, text string) string {
+	return string(code) + ": " + text
+}
+
+// Parse splits a message formatted by Message into its code and text.
+// Messages without a known code return an empty code and the message
+// unchanged.
+func Parse(message string) (Code, string) {
+	prefix, text, ok := strings.Cut(message, ": ")
+	if !ok {
+		return "", message
+	}
+	for _, code := range codes {
+		if Code(prefix) == code {
+			return code, text
+		}
+	}
+	return "", message
+}
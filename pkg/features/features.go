@@ -0,0 +1,92 @@
+// Package features reports which optional subsystems a controller or proxy
+// has enabled, so users and support can tell why a documented behavior is
+// not active in a deployment
+package features
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Path is where the controller and proxy serve their Report on their health
+// port
+const Path = "/features"
+
+// Feature is one optional subsystem
+type Feature struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Detail summarizes the feature's configuration when it is enabled, or
+	// names the flag enabling it when it is not
+	Detail string `json:"detail,omitempty"`
+}
+
+// On describes an enabled feature
+func On(name, detail string) Feature {
+	return Feature{Name: name, Enabled: true, Detail: detail}
+}
+
+// Off describes a disabled feature, with a hint on how to enable it
+func Off(name, hint string) Feature {
+	return Feature{Name: name, Detail: hint}
+}
+
+// Toggle describes a feature that is on or off, with the detail for its
+// current state
+func Toggle(name string, enabled bool, on, off string) Feature {
+	if enabled {
+		return On(name, on)
+	}
+	return Off(name, off)
+}
+
+// Report lists the features of one component
+type Report struct {
+	// Component is "controller" or "proxy"
+	Component string    `json:"component"`
+	Version   string    `json:"version"`
+	Features  []Feature `json:"features"`
+}
+
+// Handler serves the report built by report on GET
+func Handler(report func() Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report()); err != nil {
+			log.Error().Err(err).Msg("Failed to encode feature report")
+		}
+	})
+}
+
+// Fetch reads the report a controller or proxy serves at baseURL, such as
+// http://localhost:8080 with a port-forward to its health port
+func Fetch(ctx context.Context, httpClient *http.Client, baseURL string) (*Report, error) {
+	u := strings.TrimSuffix(baseURL, "/") + Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %w", baseURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	var report Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, fmt.Errorf("failed to decode feature report from %s: %w", u, err)
+	}
+	return &report, nil
+}
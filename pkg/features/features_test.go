@@ -0,0 +1,54 @@
+package features
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestFetchReadsServedReport(t *testing.T) {
+	want := Report{
+		Component: "controller",
+		Version:   "1.2.3",
+		Features: []Feature{
+			On("cache-push", "s3://nix-cache"),
+			Off("warm-pool", "--warm-pool-size"),
+			Toggle("dry-run", false, "no resources are created", "--dry-run"),
+		},
+	}
+	mux := http.NewServeMux()
+	mux.Handle(Path, Handler(func() Report { return want }))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	got, err := Fetch(context.Background(), server.Client(), server.URL+"/")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if got.Component != want.Component || got.Version != want.Version || !slices.Equal(got.Features, want.Features) {
+		t.Errorf("report = %+v, want %+v", got, want)
+	}
+	if got.Features[2].Enabled || got.Features[2].Detail != "--dry-run" {
+		t.Errorf("disabled toggle = %+v, want the flag enabling it", got.Features[2])
+	}
+
+	resp, err := server.Client().Post(server.URL+Path, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestFetchReportsMissingEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	if _, err := Fetch(context.Background(), server.Client(), server.URL); err == nil {
+		t.Error("Fetch succeeded against a server without the endpoint")
+	}
+}
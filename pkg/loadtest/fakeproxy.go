@@ -0,0 +1,163 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/proxy"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/status"
+)
+
+const (
+	fakeNamespace    = "nix-builds"
+	fakeSSHKeySecret = "nix-builder-ssh-key"
+)
+
+// StartFakeProxy starts the SSH proxy on a loopback port against a fake
+// Kubernetes API, with an echo backend standing in for every builder pod.
+// A fake controller marks each build request the proxy creates as running
+// on the backend, so sessions take the proxy's full path: authentication,
+// build request creation, waiting for the builder, host key pinning and
+// forwarding. It returns the proxy's address and a function to stop it.
+func StartFakeProxy(ctx context.Context) (string, func(), error) {
+	backend, hostKey, stopBackend, err := StartEchoBackend()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start fake builder: %w", err)
+	}
+	_, port, err := net.SplitHostPort(backend)
+	if err != nil {
+		stopBackend()
+		return "", nil, err
+	}
+	remotePort, err := strconv.ParseInt(port, 10, 32)
+	if err != nil {
+		stopBackend()
+		return "", nil, err
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		stopBackend()
+		return "", nil, err
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		stopBackend()
+		return "", nil, err
+	}
+	k8sClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithStatusSubresource(&v1alpha1.NixBuildRequest{}).
+		Build()
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := func() {
+		cancel()
+		stopBackend()
+	}
+
+	// The controller's watch must be running before the proxy creates
+	// build requests, or it would miss them
+	events, err := k8sClient.Watch(ctx, &v1alpha1.NixBuildRequestList{}, client.InNamespace(fakeNamespace))
+	if err != nil {
+		stop()
+		return "", nil, fmt.Errorf("failed to watch build requests: %w", err)
+	}
+	go runFakeController(ctx, k8sClient, events, hostKey)
+
+	p, err := proxy.NewSSHProxy(ctx, proxy.Config{
+		Addr:            "127.0.0.1:0",
+		Namespace:       fakeNamespace,
+		RemoteUser:      "nixbld",
+		RemotePort:      int32(remotePort),
+		SSHKeySecret:    fakeSSHKeySecret,
+		ShutdownTimeout: 5 * time.Second,
+		Client:          k8sClient,
+	})
+	if err != nil {
+		stop()
+		return "", nil, fmt.Errorf("failed to start proxy: %w", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := p.Start(ctx); err != nil && err != context.Canceled {
+			log.Error().Err(err).Msg("Fake proxy stopped")
+		}
+	}()
+
+	return p.Addr().String(), func() {
+		stop()
+		<-done
+	}, nil
+}
+
+// runFakeController gives every new build request a builder pod at the echo
+// backend, the way the controller would once the pod is ready
+func runFakeController(ctx context.Context, k8sClient client.Client, events watch.Interface, hostKey ssh.PublicKey) {
+	defer events.Stop()
+	for {
+		var event watch.Event
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events.ResultChan():
+			if !ok {
+				return
+			}
+			event = e
+		}
+
+		buildReq, ok := event.Object.(*v1alpha1.NixBuildRequest)
+		if !ok || event.Type != watch.Added {
+			continue
+		}
+		if err := provisionFakeBuilder(ctx, k8sClient, buildReq, hostKey); err != nil {
+			log.Error().Err(err).Str("build_request", buildReq.Name).Msg("Failed to provision fake builder")
+		}
+	}
+}
+
+func provisionFakeBuilder(ctx context.Context, k8sClient client.Client, buildReq *v1alpha1.NixBuildRequest, hostKey ssh.PublicKey) error {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nix-builder-" + buildReq.Spec.SessionID,
+			Namespace: buildReq.Namespace,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "builder",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+				},
+			}},
+		},
+	}
+	if err := k8sClient.Create(ctx, pod); err != nil {
+		return fmt.Errorf("failed to create builder pod: %w", err)
+	}
+
+	patch := client.MergeFrom(buildReq.DeepCopy())
+	buildReq.Status.PodName = pod.Name
+	buildReq.Status.HostKey = string(ssh.MarshalAuthorizedKey(hostKey))
+	status.MarkReady(&buildReq.Status, metav1.Now(), "127.0.0.1")
+	if err := k8sClient.Status().Patch(ctx, buildReq, patch); err != nil {
+		return fmt.Errorf("failed to mark build request running: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package loadtest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// Config describes a load test run
+type Config struct {
+	// Target is the SSH address to load, typically the proxy. When empty an
+	// in-process proxy is started in front of a fake builder and targeted
+	// instead; see StartFakeProxy.
+	Target string
+	// User is the SSH user to connect as
+	User string
+	// Signer authenticates to the target. May be nil for the fake proxy.
+	Signer ssh.Signer
+	// Command is executed on each session. It must echo stdin to stdout.
+	Command string
+	// Sessions is the total number of sessions to run
+	Sessions int
+	// Concurrency is the number of sessions in flight at once
+	Concurrency int
+	// ClosureSize is the number of bytes sent through each session
+	ClosureSize int64
+	// Timeout bounds each individual session
+	Timeout time.Duration
+}
+
+// Result summarizes a load test run
+type Result struct {
+	Sessions  int
+	Failures  int
+	Elapsed   time.Duration
+	Bytes     int64
+	Connect   Percentiles
+	FirstByte Percentiles
+	Total     Percentiles
+}
+
+// Percentiles of a latency distribution
+type Percentiles struct {
+	P50, P90, P99, Max time.Duration
+}
+
+// Throughput returns the aggregate bytes per second echoed through the target
+func (r Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Elapsed.Seconds()
+}
+
+type sessionTiming struct {
+	connect, firstByte, total time.Duration
+	bytes                     int64
+	err                       error
+}
+
+// Run executes the load test and returns its summary
+func Run(ctx context.Context, cfg Config) (Result, error) {
+	if cfg.Target == "" {
+		addr, stop, err := StartFakeProxy(ctx)
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to start fake proxy: %w", err)
+		}
+		defer stop()
+		cfg.Target = addr
+		log.Info().Str("address", addr).Msg("Started proxy in front of a fake builder")
+	}
+
+	auth := []ssh.AuthMethod{}
+	if cfg.Signer != nil {
+		auth = append(auth, ssh.PublicKeys(cfg.Signer))
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         cfg.Timeout,
+	}
+
+	payload := make([]byte, 32*1024)
+	if _, err := rand.Read(payload); err != nil {
+		return Result{}, err
+	}
+
+	jobs := make(chan struct{})
+	timings := make(chan sessionTiming, cfg.Sessions)
+
+	var wg sync.WaitGroup
+	for range max(cfg.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				sessionCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+				timings <- runSession(sessionCtx, cfg, clientConfig, payload)
+				cancel()
+			}
+		}()
+	}
+
+	start := time.Now()
+feed:
+	for range cfg.Sessions {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- struct{}{}:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(timings)
+	elapsed := time.Since(start)
+
+	result := Result{Elapsed: elapsed}
+	var connect, firstByte, total []time.Duration
+	for t := range timings {
+		result.Sessions++
+		if t.err != nil {
+			result.Failures++
+			log.Debug().Err(t.err).Msg("Load test session failed")
+			continue
+		}
+		result.Bytes += t.bytes
+		connect = append(connect, t.connect)
+		firstByte = append(firstByte, t.firstByte)
+		total = append(total, t.total)
+	}
+	result.Connect = percentiles(connect)
+	result.FirstByte = percentiles(firstByte)
+	result.Total = percentiles(total)
+	return result, ctx.Err()
+}
+
+func runSession(ctx context.Context, cfg Config, clientConfig *ssh.ClientConfig, payload []byte) sessionTiming {
+	var timing sessionTiming
+	start := time.Now()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.Target)
+	if err != nil {
+		timing.err = err
+		return timing
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, cfg.Target, clientConfig)
+	if err != nil {
+		timing.err = err
+		return timing
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	defer sshClient.Close()
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		timing.err = err
+		return timing
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		timing.err = err
+		return timing
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		timing.err = err
+		return timing
+	}
+	if err := session.Start(cfg.Command); err != nil {
+		timing.err = err
+		return timing
+	}
+	timing.connect = time.Since(start)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		remaining := cfg.ClosureSize
+		for remaining > 0 {
+			chunk := payload[:min(int64(len(payload)), remaining)]
+			if _, err := stdin.Write(chunk); err != nil {
+				writeErr <- err
+				return
+			}
+			remaining -= int64(len(chunk))
+		}
+		writeErr <- stdin.Close()
+	}()
+
+	buf := make([]byte, 32*1024)
+	for timing.bytes < cfg.ClosureSize {
+		n, err := stdout.Read(buf)
+		if n > 0 && timing.bytes == 0 {
+			timing.firstByte = time.Since(start)
+		}
+		timing.bytes += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			timing.err = err
+			return timing
+		}
+	}
+	if err := <-writeErr; err != nil {
+		timing.err = err
+		return timing
+	}
+	if timing.bytes < cfg.ClosureSize {
+		timing.err = fmt.Errorf("short echo: got %d of %d bytes", timing.bytes, cfg.ClosureSize)
+		return timing
+	}
+
+	timing.total = time.Since(start)
+	return timing
+}
+
+func percentiles(samples []time.Duration) Percentiles {
+	if len(samples) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	at := func(q float64) time.Duration {
+		return samples[min(int(q*float64(len(samples))), len(samples)-1)]
+	}
+	return Percentiles{P50: at(0.50), P90: at(0.90), P99: at(0.99), Max: samples[len(samples)-1]}
+}
+
+// StartEchoBackend starts an SSH server on a loopback port that accepts any
+// client and echoes each session's stdin back on stdout, standing in for a
+// builder pod. It returns the server address, its host key and a function
+// to stop it.
+func StartEchoBackend() (string, ssh.PublicKey, func(), error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveEcho(conn, config)
+		}
+	}()
+
+	return listener.Addr().String(), signer.PublicKey(), func() { listener.Close() }, nil
+}
+
+func serveEcho(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				if req.WantReply {
+					req.Reply(req.Type == "exec", nil)
+				}
+			}
+		}()
+		go func() {
+			defer channel.Close()
+			io.Copy(channel, channel)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		}()
+	}
+}
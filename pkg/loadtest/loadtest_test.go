@@ -0,0 +1,30 @@
+package loadtest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunThroughFakeProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	result, err := Run(ctx, Config{
+		User:        "nixbld",
+		Command:     "cat",
+		Sessions:    6,
+		Concurrency: 3,
+		ClosureSize: 256 << 10,
+		Timeout:     30 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sessions != 6 || result.Failures != 0 {
+		t.Fatalf("ran %d sessions with %d failures, want 6 without failures", result.Sessions, result.Failures)
+	}
+	if result.Bytes != 6*256<<10 {
+		t.Errorf("echoed %d bytes, want %d", result.Bytes, 6*256<<10)
+	}
+}
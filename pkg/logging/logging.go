@@ -0,0 +1,148 @@
+// Package logging configures the zerolog loggers of the proxy and the
+// controller. Log lines about a session carry its ID in the session_id field
+// whichever binary writes them, so a build can be followed across both in a
+// log store such as Loki or Elasticsearch by that one field.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Log formats
+const (
+	// FormatJSON writes one JSON object per line, for log collectors
+	FormatJSON = "json"
+	// FormatConsole writes colored, human-readable lines
+	FormatConsole = "console"
+)
+
+// SessionIDField is the field carrying a session's ID
+const SessionIDField = "session_id"
+
+// Components whose level can be set apart from the rest of a binary's logs
+const (
+	// ComponentSession is the proxy's handling of client sessions
+	ComponentSession = "session"
+	// ComponentAuth is the proxy's authentication and authorization of
+	// clients
+	ComponentAuth = "auth"
+	// ComponentReconciler is the controller's reconciling of build requests
+	ComponentReconciler = "reconciler"
+	// ComponentPool is the controller's warm builder pool
+	ComponentPool = "pool"
+	// ComponentControllerRuntime is the controller-runtime library the
+	// controller and the proxy's Kubernetes client are built on
+	ComponentControllerRuntime = "controller-runtime"
+)
+
+// Components lists the components known to --log-levels
+var Components = []string{ComponentSession, ComponentAuth, ComponentReconciler, ComponentPool, ComponentControllerRuntime}
+
+// Config selects how a binary logs
+type Config struct {
+	// Level is the least severe level logged, such as "info" or "debug".
+	// Empty means info.
+	Level string
+	// Format is FormatJSON, the default, or FormatConsole
+	Format string
+	// ComponentLevels override Level for the named components
+	ComponentLevels map[string]string
+}
+
+var (
+	mu         sync.Mutex
+	levels     map[string]zerolog.Level
+	components map[string]*zerolog.Logger
+)
+
+// Contexts without a logger of their own log with the global logger
+func init() {
+	zerolog.DefaultContextLogger = &log.Logger
+}
+
+// Setup replaces the global logger with one writing to out as cfg selects
+func Setup(cfg Config, out io.Writer) error {
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+	overrides := make(map[string]zerolog.Level, len(cfg.ComponentLevels))
+	minLevel := level
+	for _, name := range slices.Sorted(maps.Keys(cfg.ComponentLevels)) {
+		if !slices.Contains(Components, name) {
+			return fmt.Errorf("unknown log component %q, expected one of %s", name, strings.Join(Components, ", "))
+		}
+		componentLevel, err := parseLevel(cfg.ComponentLevels[name])
+		if err != nil {
+			return fmt.Errorf("invalid log level for %s: %w", name, err)
+		}
+		overrides[name] = componentLevel
+		minLevel = min(minLevel, componentLevel)
+	}
+
+	switch cfg.Format {
+	case "", FormatJSON:
+	case FormatConsole:
+		out = zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339}
+	default:
+		return fmt.Errorf("unknown log format %q, expected %s or %s", cfg.Format, FormatJSON, FormatConsole)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The global level is the floor for every logger, so it must let the
+	// most verbose component through; each logger then applies its own
+	zerolog.SetGlobalLevel(minLevel)
+	log.Logger = zerolog.New(out).Level(level).With().Timestamp().Logger()
+	levels = overrides
+	components = nil
+	return nil
+}
+
+// parseLevel reads a zerolog level name, defaulting to info
+func parseLevel(s string) (zerolog.Level, error) {
+	if s == "" {
+		return zerolog.InfoLevel, nil
+	}
+	level, err := zerolog.ParseLevel(strings.ToLower(s))
+	if err != nil {
+		return zerolog.NoLevel, fmt.Errorf("unknown level %q, expected trace, debug, info, warn, error, fatal, panic or disabled", s)
+	}
+	return level, nil
+}
+
+// Component returns the logger of a component, whose lines carry a
+// component field and which logs at the component's level
+func Component(name string) *zerolog.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if logger, ok := components[name]; ok {
+		return logger
+	}
+	logger := log.Logger.With().Str("component", name).Logger()
+	if level, ok := levels[name]; ok {
+		logger = logger.Level(level)
+	}
+	if components == nil {
+		components = make(map[string]*zerolog.Logger)
+	}
+	components[name] = &logger
+	return &logger
+}
+
+// WithSession returns a context whose logger, as returned by log.Ctx, is the
+// component's logger with the session's ID on every line
+func WithSession(ctx context.Context, component, sessionID string) context.Context {
+	return Component(component).With().Str(SessionIDField, sessionID).Logger().WithContext(ctx)
+}
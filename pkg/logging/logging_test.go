@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestSetupComponentLevels(t *testing.T) {
+	t.Cleanup(func() {
+		zerolog.SetGlobalLevel(zerolog.TraceLevel)
+		log.Logger = zerolog.New(zerolog.NewConsoleWriter())
+	})
+
+	var out bytes.Buffer
+	if err := Setup(Config{Level: "warn", ComponentLevels: map[string]string{ComponentSession: "debug"}}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	log.Info().Msg("global info")
+	Component(ComponentAuth).Info().Msg("auth info")
+	ctx := WithSession(context.Background(), ComponentSession, "abc123")
+	log.Ctx(ctx).Debug().Msg("session debug")
+	log.Ctx(context.Background()).Warn().Msg("default warn")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2:\n%s", len(lines), out.String())
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["message"] != "session debug" || entry[SessionIDField] != "abc123" || entry["component"] != ComponentSession {
+		t.Errorf("session line = %v", entry)
+	}
+	if !strings.Contains(lines[1], "default warn") {
+		t.Errorf("context without a logger did not log with the global logger: %s", lines[1])
+	}
+}
+
+func TestSetupRejectsInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{Level: "loud"},
+		{Format: "xml"},
+		{ComponentLevels: map[string]string{"scheduler": "debug"}},
+		{ComponentLevels: map[string]string{ComponentPool: "verbose"}},
+	} {
+		if err := Setup(cfg, &bytes.Buffer{}); err == nil {
+			t.Errorf("Setup(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"github.com/go-logr/logr"
+	"github.com/rs/zerolog"
+)
+
+// Logr returns a logr logger writing to the component's logger, for
+// libraries such as controller-runtime that log through logr. Verbosity 0
+// is info, 1 debug and anything higher trace.
+func Logr(component string) logr.Logger {
+	return logr.New(&logrSink{logger: *Component(component)})
+}
+
+type logrSink struct {
+	logger zerolog.Logger
+	name   string
+}
+
+func (s *logrSink) Init(logr.RuntimeInfo) {}
+
+func (s *logrSink) Enabled(verbosity int) bool {
+	level := logrLevel(verbosity)
+	return level >= s.logger.GetLevel() && level >= zerolog.GlobalLevel()
+}
+
+func (s *logrSink) Info(verbosity int, msg string, keysAndValues ...any) {
+	s.event(s.logger.WithLevel(logrLevel(verbosity))).Fields(keysAndValues).Msg(msg)
+}
+
+func (s *logrSink) Error(err error, msg string, keysAndValues ...any) {
+	s.event(s.logger.Error().Err(err)).Fields(keysAndValues).Msg(msg)
+}
+
+func (s *logrSink) event(e *zerolog.Event) *zerolog.Event {
+	if s.name != "" {
+		e = e.Str("logger", s.name)
+	}
+	return e
+}
+
+func (s *logrSink) WithValues(keysAndValues ...any) logr.LogSink {
+	return &logrSink{logger: s.logger.With().Fields(keysAndValues).Logger(), name: s.name}
+}
+
+func (s *logrSink) WithName(name string) logr.LogSink {
+	if s.name != "" {
+		name = s.name + "." + name
+	}
+	return &logrSink{logger: s.logger, name: name}
+}
+
+// logrLevel maps a logr verbosity to a zerolog level
+func logrLevel(verbosity int) zerolog.Level {
+	switch {
+	case verbosity <= 0:
+		return zerolog.InfoLevel
+	case verbosity == 1:
+		return zerolog.DebugLevel
+	default:
+		return zerolog.TraceLevel
+	}
+}
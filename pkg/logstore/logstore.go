@@ -0,0 +1,241 @@
+// Package logstore uploads build logs to an object store. It speaks the S3
+// API with AWS Signature Version 4, which Amazon S3, Google Cloud Storage's
+// XML API with HMAC keys, MinIO and most other stores accept.
+package logstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// amzDateFormat is the timestamp format of x-amz-date
+	amzDateFormat = "20060102T150405Z"
+
+	// uploadTimeout bounds a single upload
+	uploadTimeout = 30 * time.Second
+)
+
+// Config locates the bucket logs are written to
+type Config struct {
+	// URL is the bucket and key prefix, as s3://bucket/prefix or
+	// gs://bucket/prefix
+	URL string
+	// Endpoint overrides the store's API endpoint, e.g. for MinIO. It
+	// defaults to AWS's regional endpoint for s3:// and to
+	// https://storage.googleapis.com for gs://.
+	Endpoint string
+	// Region signs requests; GCS ignores it. Defaults to us-east-1.
+	Region string
+	// AccessKeyID, SecretAccessKey and SessionToken authenticate uploads,
+	// defaulting to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN environment variables
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Store writes objects to one bucket under a key prefix
+type Store struct {
+	scheme     string
+	bucket     string
+	prefix     string
+	endpoint   *url.URL
+	region     string
+	accessKey  string
+	secretKey  string
+	token      string
+	httpClient *http.Client
+}
+
+// New returns a Store for cfg
+func New(cfg Config) (*Store, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log store URL %q: %w", cfg.URL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("log store URL %q names no bucket", cfg.URL)
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := cfg.Endpoint
+	switch u.Scheme {
+	case "s3":
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+		}
+	case "gs":
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+	default:
+		return nil, fmt.Errorf("log store URL %q must start with s3:// or gs://", cfg.URL)
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Host == "" {
+		return nil, fmt.Errorf("invalid log store endpoint %q", endpoint)
+	}
+
+	s := &Store{
+		scheme:     u.Scheme,
+		bucket:     u.Host,
+		prefix:     strings.Trim(u.Path, "/"),
+		endpoint:   endpointURL,
+		region:     region,
+		accessKey:  valueOrEnv(cfg.AccessKeyID, "AWS_ACCESS_KEY_ID"),
+		secretKey:  valueOrEnv(cfg.SecretAccessKey, "AWS_SECRET_ACCESS_KEY"),
+		token:      valueOrEnv(cfg.SessionToken, "AWS_SESSION_TOKEN"),
+		httpClient: &http.Client{Timeout: uploadTimeout},
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("log store credentials missing: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+// Put writes data under key below the store's prefix and returns the
+// object's location as an s3:// or gs:// URL
+func (s *Store) Put(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+
+	// Objects are addressed path-style, which every S3-compatible store
+	// accepts, and the path is escaped exactly as it is signed
+	target := *s.endpoint
+	target.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + uriEncode(s.bucket+"/"+key, false)
+	target.Path, _ = url.PathUnescape(target.RawPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target.String(), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	sum := sha256.Sum256(data)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("log store returned %s for %s: %s", resp.Status, key, strings.TrimSpace(string(body)))
+	}
+	return fmt.Sprintf("%s://%s/%s", s.scheme, s.bucket, key), nil
+}
+
+// sign adds AWS Signature Version 4 headers to req, signing its host and
+// every header already set
+func (s *Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), s.region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query parameters sorted by name, as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var parts []string
+	for _, name := range names {
+		values := slices.Clone(query[name])
+		slices.Sort(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, leaving
+// slashes alone unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func valueOrEnv(value, env string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
@@ -0,0 +1,165 @@
+// Package notify tells teams about finished builds by posting to HTTP
+// webhooks, either as a JSON document or as a Slack-compatible message
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Format selects the body posted to a webhook
+type Format string
+
+const (
+	// FormatJSON posts the Event as JSON
+	FormatJSON Format = "json"
+	// FormatSlack posts {"text": ...}, which Slack, Mattermost and other
+	// incoming webhooks accept
+	FormatSlack Format = "slack"
+)
+
+const (
+	// attempts is how often a notification is tried before giving up
+	attempts = 3
+	// retryDelay is the wait before the second attempt, doubling after
+	retryDelay = time.Second
+)
+
+// Event describes a build request that finished
+type Event struct {
+	Name            string    `json:"name"`
+	Namespace       string    `json:"namespace"`
+	SessionID       string    `json:"sessionId"`
+	Phase           string    `json:"phase"`
+	Pod             string    `json:"pod,omitempty"`
+	Requester       string    `json:"requester,omitempty"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Code            string    `json:"code,omitempty"`
+	Message         string    `json:"message,omitempty"`
+	CompletionTime  time.Time `json:"completionTime"`
+}
+
+// Failed reports whether the event is about a failed build
+func (e Event) Failed() bool {
+	return e.Phase == "Failed"
+}
+
+// Notifier delivers notifications about finished builds
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// All delivers each notification to every notifier, attempting all of them
+// even when one fails
+type All []Notifier
+
+// Notify notifies each notifier in order
+func (all All) Notify(ctx context.Context, event Event) error {
+	var errs []error
+	for _, notifier := range all {
+		if err := notifier.Notify(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Webhook posts notifications to an HTTP endpoint
+type Webhook struct {
+	URL        string
+	Format     Format
+	HTTPClient *http.Client
+}
+
+// NewWebhook creates a Webhook posting format to url with the given request
+// timeout
+func NewWebhook(url string, format Format, timeout time.Duration) (*Webhook, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("webhook URL %q must be http:// or https://", url)
+	}
+	switch format {
+	case FormatJSON, FormatSlack:
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q", format)
+	}
+	return &Webhook{URL: url, Format: format, HTTPClient: &http.Client{Timeout: timeout}}, nil
+}
+
+// Notify posts the event, retrying failed deliveries a few times
+func (w *Webhook) Notify(ctx context.Context, event Event) error {
+	var payload any = event
+	if w.Format == FormatSlack {
+		payload = map[string]string{"text": SlackText(event)}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil || attempt == attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (w *Webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// SlackText renders an event as a one-line summary, followed by the failure
+// message as a quote
+func SlackText(event Event) string {
+	icon, outcome := ":white_check_mark:", "completed"
+	if event.Failed() {
+		icon, outcome = ":x:", "failed"
+	}
+	text := fmt.Sprintf("%s Build %s/%s %s after %s (session `%s`", icon, event.Namespace, event.Name, outcome,
+		(time.Duration(event.DurationSeconds) * time.Second).String(), event.SessionID)
+	if event.Pod != "" {
+		text += fmt.Sprintf(", pod `%s`", event.Pod)
+	}
+	if event.Requester != "" {
+		text += fmt.Sprintf(", requested by %s", event.Requester)
+	}
+	text += ")"
+
+	if event.Failed() && event.Message != "" {
+		message := event.Message
+		if event.Code != "" {
+			message = event.Code + ": " + message
+		}
+		text += "\n> " + strings.ReplaceAll(message, "\n", "\n> ")
+	}
+	return text
+}
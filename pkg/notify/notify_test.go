@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var failed = Event{
+	Name:            "build-abc",
+	Namespace:       "ci",
+	SessionID:       "abc",
+	Phase:           "Failed",
+	Pod:             "nix-builder-abc",
+	Requester:       "alice",
+	DurationSeconds: 192,
+	Code:            "E_TIMEOUT",
+	Message:         "Build timed out",
+	CompletionTime:  time.Date(2026, 1, 15, 10, 33, 12, 0, time.UTC),
+}
+
+func TestWebhookPostsEvent(t *testing.T) {
+	var got Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	webhook, err := NewWebhook(server.URL, FormatJSON, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := webhook.Notify(context.Background(), failed); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got != failed {
+		t.Errorf("posted %+v, want %+v", got, failed)
+	}
+}
+
+func TestWebhookPostsSlackText(t *testing.T) {
+	var got map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("decoding webhook body %s: %v", body, err)
+		}
+	}))
+	defer server.Close()
+
+	webhook, err := NewWebhook(server.URL, FormatSlack, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := webhook.Notify(context.Background(), failed); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	want := ":x: Build ci/build-abc failed after 3m12s (session `abc`, pod `nix-builder-abc`, requested by alice)\n> E_TIMEOUT: Build timed out"
+	if got["text"] != want {
+		t.Errorf("text = %q\nwant %q", got["text"], want)
+	}
+}
+
+func TestWebhookRetriesFailedDeliveries(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	webhook, err := NewWebhook(server.URL, FormatJSON, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := webhook.Notify(context.Background(), failed); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("webhook called %d times, want 2", calls)
+	}
+
+	// Every attempt failing reports the last error
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := webhook.Notify(ctx, failed); err == nil || !strings.Contains(err.Error(), "webhook request failed") {
+		t.Errorf("Notify error = %v, want the cancelled request", err)
+	}
+}
+
+func TestNewWebhookRejectsBadConfig(t *testing.T) {
+	if _, err := NewWebhook("hooks.slack.com/services/x", FormatSlack, time.Second); err == nil {
+		t.Error("accepted a URL without a scheme")
+	}
+	if _, err := NewWebhook("https://example.com", "teams", time.Second); err == nil {
+		t.Error("accepted an unknown format")
+	}
+}
@@ -0,0 +1,148 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	nixv1alpha1 "github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+const (
+	// RequesterAnnotation records the SSH user that opened the build session
+	RequesterAnnotation = "nix.io/requester"
+	// ClientAddressAnnotation records the remote address of the SSH client
+	ClientAddressAnnotation = "nix.io/client-address"
+	// KeyFingerprintAnnotation records the SHA256 fingerprint of the public
+	// key the SSH client authenticated with
+	KeyFingerprintAnnotation = "nix.io/key-fingerprint"
+)
+
+// Input is the document a policy is evaluated against
+type Input struct {
+	Name           string                          `json:"name"`
+	Namespace      string                          `json:"namespace"`
+	Labels         map[string]string               `json:"labels,omitempty"`
+	Requester      string                          `json:"requester,omitempty"`
+	ClientAddress  string                          `json:"clientAddress,omitempty"`
+	KeyFingerprint string                          `json:"keyFingerprint,omitempty"`
+	Spec           nixv1alpha1.NixBuildRequestSpec `json:"spec"`
+}
+
+// Decision is the outcome of a policy evaluation
+type Decision struct {
+	Allowed bool
+	Message string
+}
+
+// Checker decides whether a build request may be provisioned
+type Checker interface {
+	Check(ctx context.Context, input Input) (Decision, error)
+}
+
+// InputFor builds the policy input for a build request
+func InputFor(buildReq *nixv1alpha1.NixBuildRequest) Input {
+	return Input{
+		Name:           buildReq.Name,
+		Namespace:      buildReq.Namespace,
+		Labels:         buildReq.Labels,
+		Requester:      buildReq.Annotations[RequesterAnnotation],
+		ClientAddress:  buildReq.Annotations[ClientAddressAnnotation],
+		KeyFingerprint: buildReq.Annotations[KeyFingerprintAnnotation],
+		Spec:           buildReq.Spec,
+	}
+}
+
+// HTTPChecker asks an external HTTP endpoint for a decision. The request body
+// is {"input": ...}, matching OPA's data API, so an OPA server can be used
+// directly with a URL such as http://opa:8181/v1/data/nix/build.
+//
+// The response may be OPA-style, {"result": true} or
+// {"result": {"allow": true, "message": "..."}}, or a plain
+// {"allowed": true, "message": "..."} document.
+type HTTPChecker struct {
+	URL        string
+	HTTPClient *http.Client
+}
+
+// NewHTTPChecker creates an HTTPChecker for url with the given request timeout
+func NewHTTPChecker(url string, timeout time.Duration) *HTTPChecker {
+	return &HTTPChecker{
+		URL:        url,
+		HTTPClient: &http.Client{Timeout: timeout},
+	}
+}
+
+type decisionDocument struct {
+	Allow   *bool  `json:"allow"`
+	Allowed *bool  `json:"allowed"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+func (d decisionDocument) decision() (Decision, error) {
+	message := d.Message
+	if message == "" {
+		message = d.Reason
+	}
+	switch {
+	case d.Allowed != nil:
+		return Decision{Allowed: *d.Allowed, Message: message}, nil
+	case d.Allow != nil:
+		return Decision{Allowed: *d.Allow, Message: message}, nil
+	default:
+		return Decision{}, fmt.Errorf("policy response has no allow or allowed field")
+	}
+}
+
+// Check posts the input to the policy endpoint and parses its decision
+func (c *HTTPChecker) Check(ctx context.Context, input Input) (Decision, error) {
+	body, err := json.Marshal(map[string]any{"input": input})
+	if err != nil {
+		return Decision{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return Decision{}, fmt.Errorf("policy request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return Decision{}, fmt.Errorf("policy endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var doc struct {
+		Result json.RawMessage `json:"result"`
+		decisionDocument
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return Decision{}, fmt.Errorf("failed to decode policy response: %w", err)
+	}
+
+	if doc.Result == nil {
+		return doc.decision()
+	}
+
+	var allowed bool
+	if err := json.Unmarshal(doc.Result, &allowed); err == nil {
+		return Decision{Allowed: allowed}, nil
+	}
+	var result decisionDocument
+	if err := json.Unmarshal(doc.Result, &result); err != nil {
+		return Decision{}, fmt.Errorf("failed to decode policy result: %w", err)
+	}
+	return result.decision()
+}
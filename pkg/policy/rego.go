@@ -0,0 +1,145 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/opa/v1/rego"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultRegoQuery is the query evaluated against policies loaded from a
+// ConfigMap when no other query is configured
+const DefaultRegoQuery = "data.nix.build"
+
+// RegoChecker evaluates Rego policies stored in a ConfigMap with an embedded
+// OPA evaluator. Every key ending in .rego is loaded as a module, and the
+// policies are recompiled whenever the ConfigMap changes.
+//
+// The query result may be a boolean or an object with an allow (or allowed)
+// field and an optional message, like the HTTPChecker's OPA responses.
+type RegoChecker struct {
+	Client    client.Reader
+	ConfigMap client.ObjectKey
+	Query     string
+
+	mu              sync.Mutex
+	resourceVersion string
+	prepared        rego.PreparedEvalQuery
+}
+
+// NewRegoChecker creates a RegoChecker for the policies in the given ConfigMap
+func NewRegoChecker(reader client.Reader, configMap client.ObjectKey, query string) *RegoChecker {
+	if query == "" {
+		query = DefaultRegoQuery
+	}
+	return &RegoChecker{Client: reader, ConfigMap: configMap, Query: query}
+}
+
+// Check evaluates the policies against the input
+func (c *RegoChecker) Check(ctx context.Context, input Input) (Decision, error) {
+	prepared, err := c.load(ctx)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	// Round-trip through JSON so the input uses the same field names as the
+	// HTTPChecker sends
+	encoded, err := json.Marshal(input)
+	if err != nil {
+		return Decision{}, err
+	}
+	var doc any
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return Decision{}, err
+	}
+
+	results, err := prepared.Eval(ctx, rego.EvalInput(doc))
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to evaluate policy: %w", err)
+	}
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return Decision{}, fmt.Errorf("policy query %s is undefined", c.Query)
+	}
+
+	switch value := results[0].Expressions[0].Value.(type) {
+	case bool:
+		return Decision{Allowed: value}, nil
+	case map[string]any:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return Decision{}, err
+		}
+		var result decisionDocument
+		if err := json.Unmarshal(encoded, &result); err != nil {
+			return Decision{}, fmt.Errorf("failed to decode policy result: %w", err)
+		}
+		return result.decision()
+	default:
+		return Decision{}, fmt.Errorf("policy query %s returned unsupported type %T", c.Query, value)
+	}
+}
+
+// load returns the prepared query, recompiling it if the ConfigMap changed
+func (c *RegoChecker) load(ctx context.Context) (rego.PreparedEvalQuery, error) {
+	var configMap corev1.ConfigMap
+	if err := c.Client.Get(ctx, c.ConfigMap, &configMap); err != nil {
+		return rego.PreparedEvalQuery{}, fmt.Errorf("failed to get policy ConfigMap %s: %w", c.ConfigMap, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if configMap.ResourceVersion == c.resourceVersion {
+		return c.prepared, nil
+	}
+
+	names := make([]string, 0, len(configMap.Data))
+	for name := range configMap.Data {
+		if strings.HasSuffix(name, ".rego") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return rego.PreparedEvalQuery{}, fmt.Errorf("policy ConfigMap %s contains no .rego keys", c.ConfigMap)
+	}
+	sort.Strings(names)
+
+	options := []func(*rego.Rego){rego.Query(c.Query)}
+	for _, name := range names {
+		options = append(options, rego.Module(name, configMap.Data[name]))
+	}
+
+	prepared, err := rego.New(options...).PrepareForEval(ctx)
+	if err != nil {
+		return rego.PreparedEvalQuery{}, fmt.Errorf("failed to compile policies from %s: %w", c.ConfigMap, err)
+	}
+
+	c.prepared = prepared
+	c.resourceVersion = configMap.ResourceVersion
+	return prepared, nil
+}
+
+// All is a Checker that allows a build request only if every checker allows
+// it, returning the first denial
+type All []Checker
+
+// Check runs each checker in order
+func (all All) Check(ctx context.Context, input Input) (Decision, error) {
+	var messages []string
+	for _, checker := range all {
+		decision, err := checker.Check(ctx, input)
+		if err != nil || !decision.Allowed {
+			return decision, err
+		}
+		if decision.Message != "" {
+			messages = append(messages, decision.Message)
+		}
+	}
+	return Decision{Allowed: true, Message: strings.Join(messages, "; ")}, nil
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/adminapi"
+)
+
+// startAdminServer serves the admin API, which reveals who is building and
+// disconnects clients, on a listener of its own behind token
+func (p *SSHProxy) startAdminServer(address string, token []byte, tlsConfig *tls.Config) error {
+	if err := adminapi.CheckAddress(address, token); err != nil {
+		return err
+	}
+
+	p.adminServer = &http.Server{
+		Addr:      address,
+		Handler:   adminapi.Authenticated(token, p.adminHandler()),
+		TLSConfig: tlsConfig,
+	}
+
+	go func() {
+		log.Info().Str("address", address).Bool("tls", tlsConfig != nil).Bool("token", len(token) > 0).Msg("Admin server starting")
+		if err := serve(p.adminServer); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Admin server failed")
+		}
+	}()
+	return nil
+}
+
+// adminHandler serves the admin API - inspect sessions, force cleanup of
+// leaked ones and report usage
+func (p *SSHProxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		sessions := p.sessions.list()
+		for i := range sessions {
+			sessions[i].Proxy = p.identity()
+		}
+		if err := json.NewEncoder(w).Encode(sessions); err != nil {
+			log.Error().Err(err).Msg("Failed to encode sessions")
+		}
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !p.sessions.evict(r.PathValue("id"), "admin") {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /usage", func(w http.ResponseWriter, r *http.Request) {
+		window := 24 * time.Hour
+		if v := r.URL.Query().Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > UsageRetention {
+				http.Error(w, fmt.Sprintf("window must be a duration up to %s", UsageRetention), http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.usage.report(time.Now(), window)); err != nil {
+			log.Error().Err(err).Msg("Failed to encode usage report")
+		}
+	})
+
+	return mux
+}
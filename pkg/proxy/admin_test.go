@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/adminapi"
+)
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	p := &SSHProxy{sessions: newSessionRegistry(1, 0), usage: newUsageLedger()}
+	handler := adminapi.Authenticated([]byte("s3cret"), p.adminHandler())
+
+	for _, tc := range []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodDelete, "/sessions/abc", "", http.StatusUnauthorized},
+		{http.MethodDelete, "/sessions/abc", "wrong", http.StatusUnauthorized},
+		{http.MethodDelete, "/sessions/abc", "s3cret", http.StatusNotFound},
+		{http.MethodGet, "/sessions", "", http.StatusUnauthorized},
+		{http.MethodGet, "/sessions", "s3cret", http.StatusOK},
+		{http.MethodGet, "/usage", "", http.StatusUnauthorized},
+		{http.MethodGet, "/usage", "s3cret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s %s with token %q = %d, want %d", tc.method, tc.path, tc.token, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestAdminServerRefusesOpenAddressWithoutToken(t *testing.T) {
+	p := &SSHProxy{sessions: newSessionRegistry(1, 0), usage: newUsageLedger()}
+	if err := p.startAdminServer(":8082", nil, nil); err == nil {
+		t.Error("admin server listened on every interface without a token")
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultConnectionBurst is the default number of connections a source
+	// address may open at once before --connection-rate applies
+	DefaultConnectionBurst = 20
+
+	// refusalTimeout bounds the handshake that tells a refused client why,
+	// so refused clients cannot hold connections open
+	refusalTimeout = 10 * time.Second
+	// limiterIdleTimeout is how long a source address's rate limit is
+	// remembered after its last connection
+	limiterIdleTimeout = 10 * time.Minute
+)
+
+var connectionsRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "nix_proxy_connections_rate_limited_total",
+	Help: "Connections refused because their source address exceeded --connection-rate",
+})
+
+// connectionLimiter rate limits new connections per source address with a
+// token bucket each
+type connectionLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	now       func() time.Time
+	sources   map[string]*sourceLimiter
+	lastPrune time.Time
+}
+
+type sourceLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newConnectionLimiter allows each source address perSecond connections a
+// second after an initial burst, or returns nil when perSecond disables it
+func newConnectionLimiter(perSecond float64, burst int) *connectionLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &connectionLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		now:     time.Now,
+		sources: make(map[string]*sourceLimiter),
+	}
+}
+
+// allow takes a connection from the bucket of addr's host
+func (l *connectionLimiter) allow(addr net.Addr) bool {
+	host := sourceHost(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastPrune) > limiterIdleTimeout {
+		for h, source := range l.sources {
+			if now.Sub(source.lastSeen) > limiterIdleTimeout {
+				delete(l.sources, h)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	source, ok := l.sources[host]
+	if !ok {
+		source = &sourceLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.sources[host] = source
+	}
+	source.lastSeen = now
+	return source.limiter.AllowN(now, 1)
+}
+
+// sourceHost returns the host of a connection's remote address, so that a
+// client's connections share a limit whatever their source ports
+func sourceHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admit decides whether a new connection is served. Connections are
+// refused when their source address exceeds the connection rate or when
+// the session registry is full of live sessions.
+func (p *SSHProxy) admit(addr net.Addr) error {
+	if p.connLimiter != nil && !p.connLimiter.allow(addr) {
+		connectionsRateLimited.Inc()
+		return errcode.Errorf(errcode.Quota, "too many connections from %s, retry later", sourceHost(addr))
+	}
+	if p.sessions.full() {
+		p.sessions.rejected.Inc()
+		return errcode.Errorf(errcode.Quota, "proxy is serving its maximum of %d sessions", p.sessions.max)
+	}
+	return nil
+}
+
+// refuse tells a client why its connection is refused and closes it. The
+// reason is sent as an SSH authentication banner, which clients print
+// before authenticating, and authentication then fails, so the client
+// gives up at once rather than waiting on a builder that never comes.
+func (p *SSHProxy) refuse(netConn net.Conn, sessionID string, reason error) {
+	log.Warn().Err(reason).Str("session_id", sessionID).Str("client_addr", netConn.RemoteAddr().String()).Msg("Refusing SSH connection")
+
+	code := errcode.Of(reason)
+	banner := fmt.Sprintf("nix-remote-build-proxy: %s\r\n", errcode.Message(code, errcode.Text(reason))) +
+		localFallbackAdvice(code, sessionID)
+	config := &ssh.ServerConfig{
+		BannerCallback: func(ssh.ConnMetadata) string { return banner },
+		NoClientAuth:   true,
+		NoClientAuthCallback: func(ssh.ConnMetadata) (*ssh.Permissions, error) {
+			return nil, reason
+		},
+	}
+	config.AddHostKey(p.currentHostKey())
+
+	netConn.SetDeadline(time.Now().Add(refusalTimeout))
+	if conn, _, _, err := ssh.NewServerConn(netConn, config); err == nil {
+		conn.Close()
+	}
+}
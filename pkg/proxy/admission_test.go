@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnectionLimiterPerSourceHost(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newConnectionLimiter(1, 2)
+	l.now = func() time.Time { return now }
+
+	ci := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	ciOtherPort := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40001}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+
+	if !l.allow(ci) || !l.allow(ciOtherPort) {
+		t.Fatal("connections within the burst were refused")
+	}
+	if l.allow(ci) {
+		t.Error("connection beyond the burst was allowed")
+	}
+	if !l.allow(other) {
+		t.Error("another source host shared the exhausted limit")
+	}
+
+	now = now.Add(time.Second)
+	if !l.allow(ci) {
+		t.Error("connection refused after the rate refilled the bucket")
+	}
+
+	now = now.Add(limiterIdleTimeout + time.Second)
+	l.allow(other)
+	if len(l.sources) != 1 {
+		t.Errorf("remembered %d source hosts after they went idle, want 1", len(l.sources))
+	}
+
+	if newConnectionLimiter(0, DefaultConnectionBurst) != nil {
+		t.Error("zero rate did not disable the limiter")
+	}
+}
+
+func TestAdmitRefusesWhenRegistryFull(t *testing.T) {
+	p := &SSHProxy{sessions: newSessionRegistry(1, 0)}
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+	if err := p.admit(addr); err != nil {
+		t.Fatalf("empty registry refused a connection: %v", err)
+	}
+	live := &ProxySession{ID: "live", limits: newSessionLimits(0, 0)}
+	if err := p.sessions.add(live); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.admit(addr); errcode.Of(err) != errcode.Quota {
+		t.Errorf("full registry gave %v, want an %s error", err, errcode.Quota)
+	}
+
+	// A leaked session would be evicted to make room
+	live.closed.Store(true)
+	if err := p.admit(addr); err != nil {
+		t.Errorf("registry holding a leaked session refused a connection: %v", err)
+	}
+}
+
+func TestRefuseSendsReasonAsBanner(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &SSHProxy{hostKey: hostKey}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		p.refuse(conn, "abc", errcode.Errorf(errcode.Quota, "too many connections from 10.0.0.1, retry later"))
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	var banner string
+	_, _, _, err = ssh.NewClientConn(clientConn, "proxy", &ssh.ClientConfig{
+		User:            "nix",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+	})
+	if err == nil {
+		t.Fatal("refused connection authenticated")
+	}
+	for _, want := range []string{
+		"nix-remote-build-proxy: E_QUOTA: too many connections from 10.0.0.1, retry later",
+		FallbackMarker + " local code=E_QUOTA session=abc",
+	} {
+		if !strings.Contains(banner, want) {
+			t.Errorf("banner %q does not contain %q", banner, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// auditTimeout bounds delivering one audit record to an HTTP sink
+const auditTimeout = 10 * time.Second
+
+// AuditRecord describes one proxied SSH connection: who made it, what it
+// ran and on which builder
+type AuditRecord struct {
+	SessionID      string    `json:"sessionId"`
+	Principal      string    `json:"principal"`
+	AuthProvider   string    `json:"authProvider,omitempty"`
+	KeyFingerprint string    `json:"keyFingerprint,omitempty"`
+	User           string    `json:"user"`
+	ClientAddr     string    `json:"clientAddr"`
+	BuilderPod     string    `json:"builderPod,omitempty"`
+	StartTime      time.Time `json:"startTime"`
+	EndTime        time.Time `json:"endTime"`
+	// BytesIn and BytesOut count tunnel data from and to the client
+	BytesIn  int64          `json:"bytesIn"`
+	BytesOut int64          `json:"bytesOut"`
+	Commands []AuditCommand `json:"commands,omitempty"`
+}
+
+// AuditCommand is a command, shell or subsystem request a session made
+type AuditCommand struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Command string    `json:"command,omitempty"`
+	// Refused is set when the proxy did not forward the request
+	Refused bool `json:"refused,omitempty"`
+}
+
+// AuditSink receives an AuditRecord for every connection when it closes
+type AuditSink interface {
+	WriteAudit(ctx context.Context, record AuditRecord) error
+}
+
+// NewAuditSink returns the sink named by target: "stdout", an http:// or
+// https:// URL records are POSTed to, or a file path records are appended
+// to. Records are written as JSON, one per line.
+func NewAuditSink(target string) (AuditSink, error) {
+	switch {
+	case target == "stdout" || target == "-":
+		return &writerAuditSink{w: os.Stdout}, nil
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		return &httpAuditSink{url: target, client: &http.Client{Timeout: auditTimeout}}, nil
+	default:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		return &writerAuditSink{w: f}, nil
+	}
+}
+
+type writerAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerAuditSink) WriteAudit(ctx context.Context, record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpAuditSink) WriteAudit(ctx context.Context, record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("audit endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// auditRequest records command-starting requests the client sends on a
+// session channel
+func (s *ProxySession) auditRequest(req *ssh.Request, refused bool) {
+	command := AuditCommand{Time: time.Now(), Type: req.Type, Refused: refused}
+	switch req.Type {
+	case "exec":
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		command.Command = payload.Command
+	case "subsystem":
+		var payload struct{ Name string }
+		ssh.Unmarshal(req.Payload, &payload)
+		command.Command = payload.Name
+	case "shell":
+	default:
+		return
+	}
+
+	s.auditMu.Lock()
+	s.commands = append(s.commands, command)
+	s.auditMu.Unlock()
+}
+
+// writeAudit sends the session's audit record once it has closed. Failures
+// are logged and counted rather than affecting the client, who is gone.
+func (p *SSHProxy) writeAudit(session *ProxySession) {
+	if p.audit == nil {
+		return
+	}
+
+	session.auditMu.Lock()
+	record := AuditRecord{
+		SessionID:      session.ID,
+		Principal:      session.Principal,
+		KeyFingerprint: session.KeyFingerprint,
+		User:           session.SSHConn.User(),
+		ClientAddr:     session.SSHConn.RemoteAddr().String(),
+		BuilderPod:     session.BuilderPod,
+		StartTime:      session.CreatedAt,
+		EndTime:        time.Now(),
+		BytesIn:        session.bytesIn.Load(),
+		BytesOut:       session.bytesOut.Load(),
+		Commands:       session.commands,
+	}
+	session.auditMu.Unlock()
+	if conn, ok := session.SSHConn.(*ssh.ServerConn); ok && conn.Permissions != nil {
+		record.AuthProvider = conn.Permissions.Extensions[AuthProviderExtension]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	if err := p.audit.WriteAudit(ctx, record); err != nil {
+		auditFailures.Inc()
+		log.Error().Err(err).Str("session_id", session.ID).Msg("Failed to write audit record")
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuditRecordsCommandsAndPostsJSON(t *testing.T) {
+	received := make(chan AuditRecord, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var record AuditRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			t.Errorf("failed to decode audit record: %v", err)
+		}
+		received <- record
+	}))
+	defer server.Close()
+
+	sink, err := NewAuditSink(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := &ProxySession{ID: "abc"}
+	session.auditRequest(&ssh.Request{Type: "env", Payload: ssh.Marshal(struct{ Name, Value string }{"LANG", "C"})}, false)
+	session.auditRequest(&ssh.Request{Type: "exec", Payload: ssh.Marshal(struct{ Command string }{"nix-daemon --stdio"})}, false)
+	session.auditRequest(&ssh.Request{Type: "shell"}, true)
+	if len(session.commands) != 2 {
+		t.Fatalf("recorded %d commands, want exec and shell only: %+v", len(session.commands), session.commands)
+	}
+
+	if err := sink.WriteAudit(context.Background(), AuditRecord{SessionID: session.ID, Commands: session.commands}); err != nil {
+		t.Fatal(err)
+	}
+	record := <-received
+	if record.SessionID != "abc" || record.Commands[0].Command != "nix-daemon --stdio" || !record.Commands[1].Refused {
+		t.Errorf("received record %+v, want the session's exec and refused shell", record)
+	}
+}
@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/logging"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// AuthNone accepts every client without credentials
+	AuthNone = "none"
+	// AuthFile accepts public keys listed in an authorized_keys file
+	AuthFile = "file"
+	// AuthSecret accepts public keys listed in a Kubernetes Secret
+	AuthSecret = "secret"
+	// AuthConfigMap accepts public keys listed in a Kubernetes ConfigMap
+	AuthConfigMap = "configmap"
+	// AuthCA accepts OpenSSH user certificates signed by a trusted CA
+	AuthCA = "ca"
+	// AuthOIDC accepts OIDC ID tokens presented as the SSH password
+	AuthOIDC = "oidc"
+
+	// AuthorizedKeysSecretKey is the key in the authorized keys secret or
+	// ConfigMap holding the authorized_keys file
+	AuthorizedKeysSecretKey = "authorized_keys"
+
+	// PrincipalExtension is the permissions extension carrying the identity
+	// the client authenticated as
+	PrincipalExtension = "nix.io/principal"
+	// AuthProviderExtension is the permissions extension naming the provider
+	// that authenticated the client
+	AuthProviderExtension = "nix.io/auth-provider"
+	// KeyFingerprintExtension is the permissions extension carrying the
+	// SHA256 fingerprint of the key the client authenticated with
+	KeyFingerprintExtension = "nix.io/key-fingerprint"
+
+	// authorizedKeysReloadInterval is how long authorized keys are cached
+	authorizedKeysReloadInterval = time.Minute
+	// authTimeout bounds a single authentication attempt
+	authTimeout = 10 * time.Second
+)
+
+// ErrAuthUnsupported is returned by providers for credentials they do not
+// handle, letting the next provider try
+var ErrAuthUnsupported = errors.New("credential not supported by provider")
+
+// CredentialKind is the kind of credential a client offered
+type CredentialKind int
+
+const (
+	// CredentialNone means the client offered no credential
+	CredentialNone CredentialKind = iota
+	// CredentialPublicKey is a plain SSH public key
+	CredentialPublicKey
+	// CredentialCertificate is an OpenSSH user certificate
+	CredentialCertificate
+	// CredentialToken is a bearer token sent as the SSH password
+	CredentialToken
+)
+
+// Credential is what a client offered during SSH authentication
+type Credential struct {
+	Kind        CredentialKind
+	PublicKey   ssh.PublicKey
+	Certificate *ssh.Certificate
+	Token       string
+}
+
+// AuthProvider authenticates clients connecting to the proxy. Providers only
+// see credentials, so new schemes can be added without touching the
+// connection handling.
+type AuthProvider interface {
+	// Name identifies the provider in logs and permissions
+	Name() string
+	// Authenticate checks a credential and returns the principal the client
+	// is acting as, or ErrAuthUnsupported for credentials it does not handle
+	Authenticate(ctx context.Context, conn ssh.ConnMetadata, cred Credential) (string, error)
+}
+
+// AuthConfig selects and configures the proxy's authentication providers
+type AuthConfig struct {
+	// Providers lists the providers to try in order. An empty list accepts
+	// every client, like AuthNone.
+	Providers []string
+
+	AuthorizedKeysPath      string
+	AuthorizedKeysSecret    string
+	AuthorizedKeysConfigMap string
+	UserCAPath              string
+
+	OIDCIssuer        string
+	OIDCAudience      string
+	OIDCUsernameClaim string
+}
+
+// newAuthProviders builds the providers named in cfg
+func newAuthProviders(cfg AuthConfig, k8sClient client.Client, namespace string) ([]AuthProvider, error) {
+	if len(cfg.Providers) == 0 {
+		return []AuthProvider{noneAuth{}}, nil
+	}
+
+	providers := make([]AuthProvider, 0, len(cfg.Providers))
+	for _, name := range cfg.Providers {
+		switch name {
+		case AuthNone:
+			providers = append(providers, noneAuth{})
+		case AuthFile:
+			if cfg.AuthorizedKeysPath == "" {
+				return nil, fmt.Errorf("auth provider %q requires an authorized keys path", name)
+			}
+			providers = append(providers, newAuthorizedKeysAuth(AuthFile, func(ctx context.Context) ([]byte, error) {
+				return os.ReadFile(cfg.AuthorizedKeysPath)
+			}))
+		case AuthSecret:
+			if cfg.AuthorizedKeysSecret == "" {
+				return nil, fmt.Errorf("auth provider %q requires an authorized keys secret", name)
+			}
+			providers = append(providers, newAuthorizedKeysAuth(AuthSecret, secretAuthorizedKeys(k8sClient, namespace, cfg.AuthorizedKeysSecret)))
+		case AuthConfigMap:
+			if cfg.AuthorizedKeysConfigMap == "" {
+				return nil, fmt.Errorf("auth provider %q requires an authorized keys ConfigMap", name)
+			}
+			providers = append(providers, newAuthorizedKeysAuth(AuthConfigMap, configMapAuthorizedKeys(k8sClient, namespace, cfg.AuthorizedKeysConfigMap)))
+		case AuthCA:
+			if cfg.UserCAPath == "" {
+				return nil, fmt.Errorf("auth provider %q requires a user CA path", name)
+			}
+			provider, err := newUserCAAuth(cfg.UserCAPath)
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, provider)
+		case AuthOIDC:
+			if cfg.OIDCIssuer == "" || cfg.OIDCAudience == "" {
+				return nil, fmt.Errorf("auth provider %q requires an issuer and audience", name)
+			}
+			providers = append(providers, newOIDCAuth(cfg.OIDCIssuer, cfg.OIDCAudience, cfg.OIDCUsernameClaim))
+		default:
+			return nil, fmt.Errorf("unknown auth provider %q", name)
+		}
+	}
+	return providers, nil
+}
+
+// configureAuth installs callbacks on config that hand every credential a
+// client offers to the providers in order
+func configureAuth(config *ssh.ServerConfig, providers []AuthProvider) {
+	authenticate := func(conn ssh.ConnMetadata, cred Credential) (*ssh.Permissions, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+		defer cancel()
+
+		for _, provider := range providers {
+			principal, err := provider.Authenticate(ctx, conn, cred)
+			if errors.Is(err, ErrAuthUnsupported) {
+				continue
+			}
+			if err != nil {
+				logging.Component(logging.ComponentAuth).Debug().Err(err).Str("provider", provider.Name()).Str("user", conn.User()).Msg("Authentication attempt rejected")
+				continue
+			}
+			extensions := map[string]string{
+				PrincipalExtension:    principal,
+				AuthProviderExtension: provider.Name(),
+			}
+			if cred.PublicKey != nil {
+				extensions[KeyFingerprintExtension] = ssh.FingerprintSHA256(cred.PublicKey)
+			}
+			return &ssh.Permissions{Extensions: extensions}, nil
+		}
+		return nil, fmt.Errorf("no auth provider accepted the credential for %q", conn.User())
+	}
+
+	config.NoClientAuth = true
+	config.NoClientAuthCallback = func(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+		return authenticate(conn, Credential{Kind: CredentialNone})
+	}
+	config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if cert, ok := key.(*ssh.Certificate); ok {
+			return authenticate(conn, Credential{Kind: CredentialCertificate, PublicKey: key, Certificate: cert})
+		}
+		return authenticate(conn, Credential{Kind: CredentialPublicKey, PublicKey: key})
+	}
+	config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		return authenticate(conn, Credential{Kind: CredentialToken, Token: string(password)})
+	}
+}
+
+// sessionPrincipal returns the identity a connection authenticated as,
+// falling back to the SSH user name
+func sessionPrincipal(conn *ssh.ServerConn) string {
+	if conn.Permissions != nil {
+		if principal := conn.Permissions.Extensions[PrincipalExtension]; principal != "" {
+			return principal
+		}
+	}
+	return conn.User()
+}
+
+// sessionKeyFingerprint returns the fingerprint of the key a connection
+// authenticated with, or an empty string if it did not use a key
+func sessionKeyFingerprint(conn *ssh.ServerConn) string {
+	if conn.Permissions == nil {
+		return ""
+	}
+	return conn.Permissions.Extensions[KeyFingerprintExtension]
+}
+
+// noneAuth accepts clients that offer no credential
+type noneAuth struct{}
+
+func (noneAuth) Name() string { return AuthNone }
+
+func (noneAuth) Authenticate(ctx context.Context, conn ssh.ConnMetadata, cred Credential) (string, error) {
+	if cred.Kind != CredentialNone {
+		return "", ErrAuthUnsupported
+	}
+	return conn.User(), nil
+}
+
+// authorizedKeysAuth accepts public keys listed in an authorized_keys file
+// read from a reloadable source
+type authorizedKeysAuth struct {
+	name string
+	load func(ctx context.Context) ([]byte, error)
+
+	mu       sync.Mutex
+	keys     map[string]string
+	loadedAt time.Time
+}
+
+func newAuthorizedKeysAuth(name string, load func(ctx context.Context) ([]byte, error)) *authorizedKeysAuth {
+	return &authorizedKeysAuth{name: name, load: load}
+}
+
+func secretAuthorizedKeys(k8sClient client.Client, namespace, secretName string) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		var secret corev1.Secret
+		if err := k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: namespace,
+			Name:      secretName,
+		}, &secret); err != nil {
+			return nil, fmt.Errorf("failed to get secret: %w", err)
+		}
+
+		data, ok := secret.Data[AuthorizedKeysSecretKey]
+		if !ok {
+			return nil, fmt.Errorf("secret %s missing key '%s'", secretName, AuthorizedKeysSecretKey)
+		}
+		return data, nil
+	}
+}
+
+func configMapAuthorizedKeys(k8sClient client.Client, namespace, configMapName string) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		var configMap corev1.ConfigMap
+		if err := k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: namespace,
+			Name:      configMapName,
+		}, &configMap); err != nil {
+			return nil, fmt.Errorf("failed to get configmap: %w", err)
+		}
+
+		data, ok := configMap.Data[AuthorizedKeysSecretKey]
+		if !ok {
+			return nil, fmt.Errorf("configmap %s missing key '%s'", configMapName, AuthorizedKeysSecretKey)
+		}
+		return []byte(data), nil
+	}
+}
+
+func (a *authorizedKeysAuth) Name() string { return a.name }
+
+func (a *authorizedKeysAuth) Authenticate(ctx context.Context, conn ssh.ConnMetadata, cred Credential) (string, error) {
+	if cred.Kind != CredentialPublicKey {
+		return "", ErrAuthUnsupported
+	}
+
+	keys, err := a.authorizedKeys(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	comment, ok := keys[string(cred.PublicKey.Marshal())]
+	if !ok {
+		return "", fmt.Errorf("public key is not authorized")
+	}
+	if comment != "" {
+		return comment, nil
+	}
+	// The SSH user name is chosen by the client, so a key without a comment
+	// is identified by its fingerprint rather than letting it claim any
+	// principal
+	return ssh.FingerprintSHA256(cred.PublicKey), nil
+}
+
+// authorizedKeys returns the cached keys, mapping each key to its comment,
+// reloading them once the cache expires
+func (a *authorizedKeysAuth) authorizedKeys(ctx context.Context) (map[string]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.keys != nil && time.Since(a.loadedAt) < authorizedKeysReloadInterval {
+		return a.keys, nil
+	}
+
+	data, err := a.load(ctx)
+	if err != nil {
+		if a.keys != nil {
+			logging.Component(logging.ComponentAuth).Warn().Err(err).Str("provider", a.name).Msg("Failed to reload authorized keys, using cached keys")
+			return a.keys, nil
+		}
+		return nil, fmt.Errorf("failed to load authorized keys: %w", err)
+	}
+
+	keys, err := parseAuthorizedKeys(data)
+	if err != nil {
+		return nil, err
+	}
+	a.keys = keys
+	a.loadedAt = time.Now()
+	return keys, nil
+}
+
+func parseAuthorizedKeys(data []byte) (map[string]string, error) {
+	keys := make(map[string]string)
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse authorized keys: %w", err)
+		}
+		keys[string(key.Marshal())] = comment
+		data = rest
+	}
+	return keys, nil
+}
+
+// userCAAuth accepts OpenSSH user certificates signed by a trusted CA whose
+// principals include the SSH user name
+type userCAAuth struct {
+	checker *ssh.CertChecker
+}
+
+func newUserCAAuth(path string) (*userCAAuth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user CA: %w", err)
+	}
+	authorities, err := parseAuthorizedKeys(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &userCAAuth{checker: &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			_, ok := authorities[string(auth.Marshal())]
+			return ok
+		},
+	}}, nil
+}
+
+func (a *userCAAuth) Name() string { return AuthCA }
+
+func (a *userCAAuth) Authenticate(ctx context.Context, conn ssh.ConnMetadata, cred Credential) (string, error) {
+	if cred.Kind != CredentialCertificate {
+		return "", ErrAuthUnsupported
+	}
+	if _, err := a.checker.Authenticate(conn, cred.Certificate); err != nil {
+		return "", err
+	}
+	if cred.Certificate.KeyId != "" {
+		return cred.Certificate.KeyId, nil
+	}
+	return conn.User(), nil
+}
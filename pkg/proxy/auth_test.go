@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testConnMetadata is a connection whose client asked to log in as user
+type testConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c testConnMetadata) User() string { return c.user }
+
+func TestAuthorizedKeysPrincipal(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		public, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	named, anonymous, stranger := newKey(), newKey(), newKey()
+	authorized := string(ssh.MarshalAuthorizedKey(named))
+	authorized = strings.TrimSpace(authorized) + " alice@example.com\n" + string(ssh.MarshalAuthorizedKey(anonymous))
+	auth := newAuthorizedKeysAuth(AuthFile, func(ctx context.Context) ([]byte, error) {
+		return []byte(authorized), nil
+	})
+
+	for _, tc := range []struct {
+		name string
+		key  ssh.PublicKey
+		want string
+	}{
+		{"comment", named, "alice@example.com"},
+		// A client logging in as another user must not become them
+		{"no comment", anonymous, ssh.FingerprintSHA256(anonymous)},
+	} {
+		principal, err := auth.Authenticate(context.Background(), testConnMetadata{user: "ci-nightly"}, Credential{Kind: CredentialPublicKey, PublicKey: tc.key})
+		if err != nil || principal != tc.want {
+			t.Errorf("%s: principal = %q, %v, want %q", tc.name, principal, err, tc.want)
+		}
+	}
+
+	if _, err := auth.Authenticate(context.Background(), testConnMetadata{user: "alice@example.com"}, Credential{Kind: CredentialPublicKey, PublicKey: stranger}); err == nil {
+		t.Error("unauthorized key was accepted")
+	}
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/logging"
+	"golang.org/x/crypto/ssh"
+	"sigs.k8s.io/yaml"
+)
+
+// SizeClassLabel selects a builder size class on a build request
+const SizeClassLabel = v1alpha1.SizeClassLabel
+
+// Action is something a session asks the proxy to do
+type Action string
+
+const (
+	// ActionCreateBuild creates a build request for a session channel
+	ActionCreateBuild Action = "create-build"
+	// ActionSelectNamespace places the build request in a namespace
+	ActionSelectNamespace Action = "select-namespace"
+	// ActionSelectImage runs the build with a specific builder image
+	ActionSelectImage Action = "select-image"
+	// ActionSelectSizeClass runs the build with a specific size class
+	ActionSelectSizeClass Action = "select-size-class"
+	// ActionDirectTCPIP opens a direct-tcpip (port forwarding) channel
+	ActionDirectTCPIP Action = "direct-tcpip"
+	// ActionTCPIPForward asks the builder to forward a port back to the
+	// client
+	ActionTCPIPForward Action = "tcpip-forward"
+	// ActionUseLease connects to the session's leased builder
+	ActionUseLease Action = "use-lease"
+)
+
+// AuthzRequest describes an action a session wants to take
+type AuthzRequest struct {
+	Action        Action `json:"action"`
+	Principal     string `json:"principal"`
+	AuthProvider  string `json:"authProvider,omitempty"`
+	ClientAddress string `json:"clientAddress,omitempty"`
+	Namespace     string `json:"namespace,omitempty"`
+	Image         string `json:"image,omitempty"`
+	SizeClass     string `json:"sizeClass,omitempty"`
+	TargetHost    string `json:"targetHost,omitempty"`
+	TargetPort    uint32 `json:"targetPort,omitempty"`
+}
+
+// Denial is the structured reason an action was refused. It is shown to the
+// client, so it must not leak anything the client may not see.
+type Denial struct {
+	Action Action
+	Code   string
+	Reason string
+}
+
+func (d *Denial) Error() string {
+	return fmt.Sprintf("%s denied (%s): %s", d.Action, d.Code, d.Reason)
+}
+
+// Authorizer decides whether a session may take an action. It returns nil
+// to allow the action or a *Denial to refuse it. Other errors are treated as
+// a denial without exposing the error to the client.
+type Authorizer interface {
+	Authorize(ctx context.Context, req AuthzRequest) error
+}
+
+// AllowAll is an Authorizer that permits every action
+type AllowAll struct{}
+
+// Authorize implements Authorizer
+func (AllowAll) Authorize(ctx context.Context, req AuthzRequest) error {
+	return nil
+}
+
+// RuleAuthorizer evaluates an ordered list of rules; the first matching rule
+// decides. Actions matching no rule get the default effect.
+type RuleAuthorizer struct {
+	Rules []AuthzRule `json:"rules"`
+	// Default is "allow" or "deny"; it defaults to "deny"
+	Default string `json:"default,omitempty"`
+}
+
+// AuthzRule matches requests by glob patterns in which '*' matches any
+// characters. An empty list matches anything.
+type AuthzRule struct {
+	Principals  []string `json:"principals,omitempty"`
+	Actions     []Action `json:"actions,omitempty"`
+	Namespaces  []string `json:"namespaces,omitempty"`
+	Images      []string `json:"images,omitempty"`
+	SizeClasses []string `json:"sizeClasses,omitempty"`
+	Targets     []string `json:"targets,omitempty"`
+	// Effect is "allow" or "deny"
+	Effect string `json:"effect"`
+	// Reason is shown to clients denied by this rule
+	Reason string `json:"reason,omitempty"`
+}
+
+// LoadRuleAuthorizer reads a RuleAuthorizer from a YAML or JSON file
+func LoadRuleAuthorizer(path string) (*RuleAuthorizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorization rules: %w", err)
+	}
+
+	var authz RuleAuthorizer
+	if err := yaml.UnmarshalStrict(data, &authz); err != nil {
+		return nil, fmt.Errorf("failed to parse authorization rules: %w", err)
+	}
+	for i, rule := range authz.Rules {
+		if rule.Effect != "allow" && rule.Effect != "deny" {
+			return nil, fmt.Errorf("rule %d: effect must be allow or deny, got %q", i, rule.Effect)
+		}
+	}
+	if authz.Default != "" && authz.Default != "allow" && authz.Default != "deny" {
+		return nil, fmt.Errorf("default must be allow or deny, got %q", authz.Default)
+	}
+	return &authz, nil
+}
+
+// Authorize implements Authorizer
+func (a *RuleAuthorizer) Authorize(ctx context.Context, req AuthzRequest) error {
+	target := ""
+	if req.TargetHost != "" {
+		target = fmt.Sprintf("%s:%d", req.TargetHost, req.TargetPort)
+	}
+
+	for i, rule := range a.Rules {
+		if !matchAny(rule.Principals, req.Principal) ||
+			!matchAny(actionStrings(rule.Actions), string(req.Action)) ||
+			!matchAny(rule.Namespaces, req.Namespace) ||
+			!matchAny(rule.Images, req.Image) ||
+			!matchAny(rule.SizeClasses, req.SizeClass) ||
+			!matchAny(rule.Targets, target) {
+			continue
+		}
+		if rule.Effect == "allow" {
+			return nil
+		}
+		reason := rule.Reason
+		if reason == "" {
+			reason = fmt.Sprintf("denied by rule %d", i)
+		}
+		return &Denial{Action: req.Action, Code: "rule", Reason: reason}
+	}
+
+	if a.Default == "allow" {
+		return nil
+	}
+	return &Denial{Action: req.Action, Code: "default", Reason: "no rule allows this action"}
+}
+
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if globMatch(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches value against a pattern in which '*' matches any run of
+// characters, including '/' so that image references can be matched
+func globMatch(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+func actionStrings(actions []Action) []string {
+	s := make([]string, len(actions))
+	for i, a := range actions {
+		s[i] = string(a)
+	}
+	return s
+}
+
+// authzRequest returns the request for action with the session's identity
+func authzRequest(session *ProxySession, action Action) AuthzRequest {
+	req := AuthzRequest{
+		Action:        action,
+		Principal:     session.Principal,
+		ClientAddress: session.SSHConn.RemoteAddr().String(),
+	}
+	if conn, ok := session.SSHConn.(*ssh.ServerConn); ok && conn.Permissions != nil {
+		req.AuthProvider = conn.Permissions.Extensions[AuthProviderExtension]
+	}
+	return req
+}
+
+// authorizeBuild checks every choice a build request makes: creating it, its
+// namespace and, when set, its image and size class
+func (p *SSHProxy) authorizeBuild(ctx context.Context, session *ProxySession, buildReq *v1alpha1.NixBuildRequest) error {
+	actions := []Action{ActionCreateBuild, ActionSelectNamespace}
+	if buildReq.Spec.Image != "" {
+		actions = append(actions, ActionSelectImage)
+	}
+	if buildReq.Labels[SizeClassLabel] != "" {
+		actions = append(actions, ActionSelectSizeClass)
+	}
+
+	for _, action := range actions {
+		req := authzRequest(session, action)
+		req.Namespace = buildReq.Namespace
+		req.Image = buildReq.Spec.Image
+		req.SizeClass = buildReq.Labels[SizeClassLabel]
+		if err := p.authz.Authorize(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// denialMessage logs an authorization failure and returns the message shown
+// to the client, which only includes the reason for structured denials
+func (p *SSHProxy) denialMessage(session *ProxySession, err error) string {
+	var denial *Denial
+	if errors.As(err, &denial) {
+		logging.Component(logging.ComponentAuth).Info().
+			Str("session_id", session.ID).
+			Str("principal", session.Principal).
+			Str("action", string(denial.Action)).
+			Str("code", denial.Code).
+			Str("reason", denial.Reason).
+			Msg("Session action denied")
+		return errcode.Message(errcode.Auth, denial.Error())
+	}
+
+	logging.Component(logging.ComponentAuth).Error().Err(err).Str("session_id", session.ID).Msg("Authorization check failed")
+	return errcode.Message(errcode.Internal, "authorization check failed")
+}
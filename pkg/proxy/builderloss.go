@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// builderExitWait bounds how long the proxy waits for a builder pod
+	// that dropped a session to record why, before telling the client
+	builderExitWait = 5 * time.Second
+	// builderExitPoll is how often the pod is checked meanwhile
+	builderExitPoll = 500 * time.Millisecond
+)
+
+// watchBuilder ends a tunnel once its build request shows the builder it
+// is connected to is gone, such as when its spot node was reclaimed. A
+// builder on a node that vanished never closes the connection, so without
+// this the client would wait on it until its own timeouts fire.
+func (p *SSHProxy) watchBuilder(ctx context.Context, session *ProxySession, buildReqName string, channel ssh.Channel, lost chan<- error, cancel context.CancelFunc) {
+	events, stop := p.builds.watch(buildReqName)
+	defer stop()
+
+	var buildReq v1alpha1.NixBuildRequest
+	if err := p.builds.get(ctx, client.ObjectKey{Namespace: p.sessionNamespace(session), Name: buildReqName}, &buildReq); err != nil {
+		log.Ctx(ctx).Debug().Err(err).Msg("Not watching builder of unknown build request")
+		return
+	}
+	podName := buildReq.Status.PodName
+	if podName == "" {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			err := builderLost(event.BuildRequest, podName)
+			if err == nil {
+				continue
+			}
+			log.Ctx(ctx).Warn().Err(err).Str("pod_name", podName).Msg("Builder lost during session")
+			fmt.Fprintf(channel.Stderr(), "nix-remote-build-proxy: %s\r\n", errcode.Message(errcode.Of(err), errcode.Text(err)))
+			fmt.Fprintf(channel.Stderr(), "nix-remote-build-proxy: the build can be retried on a new builder\r\n")
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+			lost <- err
+			cancel()
+			return
+		}
+	}
+}
+
+// builderLost returns why the builder pod podName no longer serves a build
+// request, or nil while it still does. Deleted build requests are left to
+// the tunnel, since the proxy deletes them itself as sessions end.
+func builderLost(buildReq *v1alpha1.NixBuildRequest, podName string) error {
+	switch {
+	case buildReq == nil:
+		return nil
+	case buildReq.Status.Phase == v1alpha1.BuildPhaseFailed:
+		code, text := errcode.Parse(buildReq.Status.Message)
+		if code == "" {
+			code = errcode.Builder
+		}
+		return errcode.Errorf(code, "builder failed: %s", text)
+	case buildReq.Status.Phase == v1alpha1.BuildPhaseCompleted:
+		return nil
+	case buildReq.Status.PodName != podName:
+		return errcode.Errorf(errcode.Preempted, "builder %s was lost: %s", podName, buildReq.Status.Message)
+	}
+	return nil
+}
+
+// exitChannel is a client's session channel that records whether the client
+// was sent an exit status or signal, by the builder or by the proxy
+type exitChannel struct {
+	ssh.Channel
+	exited atomic.Bool
+}
+
+func (c *exitChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	ok, err := c.Channel.SendRequest(name, wantReply, payload)
+	if err == nil && (name == "exit-status" || name == "exit-signal") {
+		c.exited.Store(true)
+	}
+	return ok, err
+}
+
+// builderExit is how a builder ended a session it dropped
+type builderExit struct {
+	reason string
+	// signal names the signal that killed the builder, as in an SSH
+	// exit-signal request, when one did
+	signal string
+}
+
+// reportBuilderExit tells the client why its builder ended the session
+// without an exit status. A builder pod that dies mid-build just closes its
+// connection, which the client would otherwise see as an unexplained EOF.
+func (p *SSHProxy) reportBuilderExit(ctx context.Context, session *ProxySession, channel ssh.Channel, builderAddr string) {
+	exit := builderExit{reason: fmt.Sprintf("builder %s closed the session without an exit status", builderAddr)}
+	if session.StaticBuilder == "" && session.BuilderPod != "" {
+		exit = p.builderPodExit(ctx, session)
+	}
+	log.Ctx(ctx).Warn().Str("builder_addr", builderAddr).Str("reason", exit.reason).Str("signal", exit.signal).Msg("Builder ended session without an exit status")
+
+	fmt.Fprintf(channel.Stderr(), "nix-remote-build-proxy: %s\r\n", errcode.Message(errcode.Builder, exit.reason))
+	if exit.signal != "" {
+		channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{Signal: exit.signal, Error: exit.reason}))
+		return
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+}
+
+// builderPodExit waits briefly for the session's builder pod to record why
+// it ended, since its connection may drop before its status is updated
+func (p *SSHProxy) builderPodExit(ctx context.Context, session *ProxySession) builderExit {
+	ctx, cancel := context.WithTimeout(ctx, builderExitWait)
+	defer cancel()
+
+	key := client.ObjectKey{Namespace: p.builderNamespace(session), Name: session.BuilderPod}
+	exit := builderExit{reason: fmt.Sprintf("builder pod %s closed the session without an exit status", key.Name)}
+	for {
+		var pod corev1.Pod
+		err := p.k8sClient.Get(ctx, key, &pod)
+		if apierrors.IsNotFound(err) {
+			return builderExit{reason: fmt.Sprintf("builder pod %s was deleted", key.Name)}
+		}
+		if err == nil {
+			if podExit, ok := podExit(&pod); ok {
+				return podExit
+			}
+			if pod.DeletionTimestamp != nil {
+				exit.reason = fmt.Sprintf("builder pod %s was deleted", key.Name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return exit
+		case <-time.After(builderExitPoll):
+		}
+	}
+}
+
+// podExit describes why a builder pod stopped serving sessions, or reports
+// false while its status does not say
+func podExit(pod *corev1.Pod) (builderExit, bool) {
+	if pod.Status.Reason == "Evicted" {
+		return builderExit{reason: fmt.Sprintf("builder pod %s evicted: %s", pod.Name, pod.Status.Message)}, true
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.DisruptionTarget && condition.Status == corev1.ConditionTrue {
+			reason := condition.Message
+			if reason == "" {
+				reason = condition.Reason
+			}
+			return builderExit{reason: fmt.Sprintf("builder pod %s evicted: %s", pod.Name, reason)}, true
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		terminated := status.State.Terminated
+		if status.Name != builderContainer || terminated == nil {
+			continue
+		}
+		exit := builderExit{reason: fmt.Sprintf("builder pod %s failed: %s, exit code %d", pod.Name, terminated.Reason, terminated.ExitCode)}
+		if terminated.Message != "" {
+			exit.reason += ": " + terminated.Message
+		}
+		switch {
+		case terminated.Signal != 0:
+			exit.signal = signalNames[terminated.Signal]
+		case terminated.ExitCode > 128:
+			exit.signal = signalNames[terminated.ExitCode-128]
+		}
+		return exit, true
+	}
+	if pod.Status.Phase == corev1.PodFailed {
+		return builderExit{reason: fmt.Sprintf("builder pod %s failed: %s", pod.Name, pod.Status.Message)}, true
+	}
+	return builderExit{}, false
+}
+
+// signalNames are the signals SSH exit-signal requests name, by number
+var signalNames = map[int32]string{
+	1: "HUP", 2: "INT", 3: "QUIT", 4: "ILL", 6: "ABRT", 8: "FPE", 9: "KILL",
+	10: "USR1", 11: "SEGV", 12: "USR2", 13: "PIPE", 14: "ALRM", 15: "TERM",
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestBuilderLost(t *testing.T) {
+	tests := []struct {
+		name   string
+		status v1alpha1.NixBuildRequestStatus
+		want   errcode.Code
+	}{
+		{"running", v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhaseRunning, PodName: "nix-builder-abc"}, ""},
+		{"completed", v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhaseCompleted, PodName: "nix-builder-abc"}, ""},
+		{"rescheduled", v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhasePending, Reschedules: 1, Message: "Builder node was reclaimed"}, errcode.Preempted},
+		{"replaced", v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhaseRunning, PodName: "nix-builder-abc-2"}, errcode.Preempted},
+		{"failed", v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhaseFailed, PodName: "nix-builder-abc", Message: errcode.Message(errcode.Timeout, "Session expired")}, errcode.Timeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := builderLost(&v1alpha1.NixBuildRequest{Status: tt.status}, "nix-builder-abc")
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("builderLost = %v, want nil", err)
+				}
+				return
+			}
+			if code := errcode.Of(err); code != tt.want {
+				t.Errorf("builderLost = %v, want an %s error", err, tt.want)
+			}
+		})
+	}
+
+	if err := builderLost(nil, "nix-builder-abc"); err != nil {
+		t.Errorf("deleted build request reported as lost builder: %v", err)
+	}
+}
+
+func TestBuildWatcherDeliversToEveryWatcher(t *testing.T) {
+	w := &buildWatcher{waiters: make(map[string]map[chan buildEvent]struct{})}
+	first, stopFirst := w.watch("build-abc")
+	second, stopSecond := w.watch("build-abc")
+	defer stopSecond()
+
+	buildReq := &v1alpha1.NixBuildRequest{}
+	buildReq.Name = "build-abc"
+	w.notify(buildReq)
+
+	for i, ch := range []<-chan buildEvent{first, second} {
+		select {
+		case event := <-ch:
+			if event.BuildRequest != buildReq {
+				t.Errorf("watcher %d got %+v", i, event)
+			}
+		default:
+			t.Errorf("watcher %d got no event", i)
+		}
+	}
+
+	stopFirst()
+	w.notify(buildReq)
+	select {
+	case <-first:
+		t.Error("stopped watcher got an event")
+	default:
+	}
+	if len(w.waiters["build-abc"]) != 1 {
+		t.Errorf("got %d watchers after one stopped, want 1", len(w.waiters["build-abc"]))
+	}
+}
+
+func TestPodExit(t *testing.T) {
+	pod := func(status corev1.PodStatus) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc"}, Status: status}
+	}
+	terminated := func(state corev1.ContainerStateTerminated) corev1.PodStatus {
+		return corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "sidecar", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Completed"}}},
+			{Name: builderContainer, State: corev1.ContainerState{Terminated: &state}},
+		}}
+	}
+	tests := []struct {
+		name   string
+		pod    *corev1.Pod
+		reason string
+		signal string
+	}{
+		{"running", pod(corev1.PodStatus{Phase: corev1.PodRunning}), "", ""},
+		{"evicted", pod(corev1.PodStatus{Phase: corev1.PodFailed, Reason: "Evicted", Message: "The node was low on resource: memory."}),
+			"builder pod nix-builder-abc evicted: The node was low on resource: memory.", ""},
+		{"preempted", pod(corev1.PodStatus{Phase: corev1.PodRunning, Conditions: []corev1.PodCondition{
+			{Type: corev1.DisruptionTarget, Status: corev1.ConditionTrue, Reason: "PreemptionByScheduler"},
+		}}), "builder pod nix-builder-abc evicted: PreemptionByScheduler", ""},
+		{"oom killed", pod(terminated(corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137})),
+			"builder pod nix-builder-abc failed: OOMKilled, exit code 137", "KILL"},
+		{"error", pod(terminated(corev1.ContainerStateTerminated{Reason: "Error", ExitCode: 1, Message: "nix-daemon crashed"})),
+			"builder pod nix-builder-abc failed: Error, exit code 1: nix-daemon crashed", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exit, ok := podExit(tt.pod)
+			if ok != (tt.reason != "") || exit.reason != tt.reason || exit.signal != tt.signal {
+				t.Errorf("podExit = %+v, %t, want reason %q and signal %q", exit, ok, tt.reason, tt.signal)
+			}
+		})
+	}
+}
+
+// recordingChannel is a client channel that records what the proxy sends it
+type recordingChannel struct {
+	ssh.Channel
+	stderr   bytes.Buffer
+	requests []*ssh.Request
+}
+
+func (c *recordingChannel) Stderr() io.ReadWriter {
+	return &c.stderr
+}
+
+func (c *recordingChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	c.requests = append(c.requests, &ssh.Request{Type: name, Payload: payload})
+	return true, nil
+}
+
+func TestReportBuilderExitSendsSignal(t *testing.T) {
+	builderPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default"},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodFailed,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  builderContainer,
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137}},
+			}},
+		},
+	}
+	p := &SSHProxy{
+		namespace: "default",
+		k8sClient: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(builderPod).Build(),
+	}
+	session := &ProxySession{ID: "abc", BuilderPod: "nix-builder-abc"}
+
+	tracked := &exitChannel{Channel: &recordingChannel{}}
+	p.reportBuilderExit(context.Background(), session, tracked, "10.0.0.5:22")
+	channel := tracked.Channel.(*recordingChannel)
+
+	if want := "nix-remote-build-proxy: E_BUILDER: builder pod nix-builder-abc failed: OOMKilled, exit code 137"; !strings.Contains(channel.stderr.String(), want) {
+		t.Errorf("stderr %q does not contain %q", channel.stderr.String(), want)
+	}
+	if len(channel.requests) != 1 || channel.requests[0].Type != "exit-signal" {
+		t.Fatalf("client was sent %v, want one exit-signal", channel.requests)
+	}
+	var signal struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}
+	if err := ssh.Unmarshal(channel.requests[0].Payload, &signal); err != nil || signal.Signal != "KILL" {
+		t.Errorf("exit-signal = %+v (%v), want KILL", signal, err)
+	}
+	if !tracked.exited.Load() {
+		t.Error("exit-signal was not recorded")
+	}
+
+	tracked = &exitChannel{Channel: &recordingChannel{}}
+	p.reportBuilderExit(context.Background(), &ProxySession{ID: "def", BuilderPod: "nix-builder-def"}, tracked, "10.0.0.6:22")
+	channel = tracked.Channel.(*recordingChannel)
+	if !strings.Contains(channel.stderr.String(), "builder pod nix-builder-def was deleted") || len(channel.requests) != 1 || channel.requests[0].Type != "exit-status" {
+		t.Errorf("deleted builder pod reported %q and %v", channel.stderr.String(), channel.requests)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// ciContextWait bounds how long a new session channel's requests are
+	// read for CI context before its builder is provisioned anyway
+	ciContextWait = 5 * time.Second
+	// maxCIContextValue bounds the length of a CI context value
+	maxCIContextValue = 256
+)
+
+// DefaultCIEnv maps the environment variables of common CI systems, and the
+// proxy's own NIX_BUILD_ variables, to CI context annotations
+var DefaultCIEnv = map[string]string{
+	"NIX_BUILD_PIPELINE_ID": v1alpha1.PipelineIDAnnotation,
+	"NIX_BUILD_COMMIT_SHA":  v1alpha1.CommitSHAAnnotation,
+	"NIX_BUILD_REPOSITORY":  v1alpha1.RepositoryAnnotation,
+	"GITHUB_RUN_ID":         v1alpha1.PipelineIDAnnotation,
+	"GITHUB_SHA":            v1alpha1.CommitSHAAnnotation,
+	"GITHUB_REPOSITORY":     v1alpha1.RepositoryAnnotation,
+	"CI_PIPELINE_ID":        v1alpha1.PipelineIDAnnotation,
+	"CI_COMMIT_SHA":         v1alpha1.CommitSHAAnnotation,
+	"CI_PROJECT_PATH":       v1alpha1.RepositoryAnnotation,
+}
+
+// collectCIContext reads the requests a client sends on a new session
+// channel until it starts a command, returning the allowlisted environment
+// variables among them as annotations. The returned channel replays the
+// requests that were read, followed by the rest.
+func (p *SSHProxy) collectCIContext(ctx context.Context, session *ProxySession, requests <-chan *ssh.Request) (map[string]string, <-chan *ssh.Request) {
+	annotations := map[string]string{}
+	var buffered []*ssh.Request
+	timeout := time.NewTimer(ciContextWait)
+	defer timeout.Stop()
+
+read:
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				break read
+			}
+			buffered = append(buffered, req)
+			switch req.Type {
+			case "env":
+				var env struct{ Name, Value string }
+				if err := ssh.Unmarshal(req.Payload, &env); err != nil {
+					continue
+				}
+				if key, ok := p.ciEnv[env.Name]; ok {
+					if value := ciContextValue(env.Value); value != "" {
+						annotations[key] = value
+					}
+				}
+			case "exec", "shell", "subsystem":
+				break read
+			}
+		case <-timeout.C:
+			log.Ctx(ctx).Debug().Msg("No command started before CI context wait ended")
+			break read
+		case <-ctx.Done():
+			break read
+		}
+	}
+
+	// The goroutine ends with the channel, or with the connection if
+	// nothing is left to forward the requests
+	replay := make(chan *ssh.Request)
+	go func() {
+		defer close(replay)
+		for _, req := range buffered {
+			select {
+			case replay <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for req := range requests {
+			select {
+			case replay <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return annotations, replay
+}
+
+// ciContextValue drops control characters from a CI context value and
+// bounds its length
+func ciContextValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(value))
+	if len(value) > maxCIContextValue {
+		value = strings.ToValidUTF8(value[:maxCIContextValue], "")
+	}
+	return value
+}
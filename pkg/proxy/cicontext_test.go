@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCollectCIContextReplaysRequests(t *testing.T) {
+	env := func(name, value string) *ssh.Request {
+		return &ssh.Request{Type: "env", Payload: ssh.Marshal(struct{ Name, Value string }{name, value})}
+	}
+	requests := make(chan *ssh.Request, 4)
+	requests <- env("GITHUB_SHA", "0123abcd\n")
+	requests <- env("LANG", "C")
+	requests <- &ssh.Request{Type: "exec", Payload: ssh.Marshal(struct{ Command string }{"nix-daemon --stdio"})}
+	requests <- &ssh.Request{Type: "window-change"}
+	close(requests)
+
+	p := &SSHProxy{ciEnv: DefaultCIEnv}
+	annotations, replay := p.collectCIContext(context.Background(), &ProxySession{ID: "abc"}, requests)
+
+	if len(annotations) != 1 || annotations[v1alpha1.CommitSHAAnnotation] != "0123abcd" {
+		t.Errorf("annotations = %v, want only the commit", annotations)
+	}
+	var types []string
+	for req := range replay {
+		types = append(types, req.Type)
+	}
+	if want := []string{"env", "env", "exec", "window-change"}; !slices.Equal(types, want) {
+		t.Errorf("replayed %v, want %v", types, want)
+	}
+}
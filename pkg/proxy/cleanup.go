@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/status"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/tracing"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// cleanupTimeout bounds all attempts to complete a build request
+	cleanupTimeout = 30 * time.Second
+	// gcRequestTimeout bounds the final attempt to hand a build request to
+	// the controller for garbage collection
+	gcRequestTimeout = 10 * time.Second
+	// sessionHeartbeatInterval is how often build requests of live sessions
+	// have their heartbeat refreshed
+	sessionHeartbeatInterval = time.Minute
+)
+
+// cleanupBackoff spaces out retries when the API server is under pressure
+var cleanupBackoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    6,
+}
+
+// completeBuildRequest records the session outcome on the session's build
+// request, namespace/name, and deletes it, retrying with backoff. If the request still cannot be deleted it
+// is annotated for the controller to garbage collect so its pod does not leak.
+func (p *SSHProxy) completeBuildRequest(sessionID, namespace, name string, succeeded bool, buildErr error) {
+	ctx, cancel := context.WithTimeout(tracing.WithSession(context.Background(), sessionID), cleanupTimeout)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, tracer, "build_request.complete", attribute.Bool("nix.succeeded", succeeded))
+	defer span.End()
+
+	key := client.ObjectKey{
+		Namespace: namespace,
+		Name:      name,
+	}
+
+	attempt := 0
+	err := wait.ExponentialBackoffWithContext(ctx, cleanupBackoff, func(ctx context.Context) (bool, error) {
+		attempt++
+		if err := p.finishBuildRequest(ctx, key, succeeded, buildErr); err != nil {
+			log.Warn().Err(err).Str("session_id", sessionID).Int("attempt", attempt).Msg("Failed to complete build request, retrying")
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == nil {
+		log.Info().
+			Str("session_id", sessionID).
+			Bool("succeeded", succeeded).
+			Msg("Build request completed and marked for deletion")
+		return
+	}
+
+	cleanupFailures.Inc()
+	tracing.Fail(span, err)
+	log.Error().Err(err).Str("session_id", sessionID).Int("attempts", attempt).Msg("Giving up on build request cleanup, requesting controller garbage collection")
+	p.requestGarbageCollection(key)
+}
+
+// finishBuildRequest sets the terminal phase on the build request, unless it
+// already has one, and deletes it. A missing build request counts as done.
+func (p *SSHProxy) finishBuildRequest(ctx context.Context, key types.NamespacedName, succeeded bool, buildErr error) error {
+	var buildReq v1alpha1.NixBuildRequest
+	if err := p.k8sClient.Get(ctx, key, &buildReq); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	if !status.Finished(&buildReq.Status) {
+		now := metav1.Now()
+		switch {
+		case succeeded:
+			status.MarkCompleted(&buildReq.Status, now, "Build completed successfully")
+		case buildErr != nil:
+			status.MarkFailed(&buildReq.Status, now, errcode.Of(buildErr), fmt.Sprintf("Build failed: %s", errcode.Text(buildErr)))
+		default:
+			status.MarkFailed(&buildReq.Status, now, errcode.Internal, "Build failed")
+		}
+
+		if err := p.k8sClient.Status().Update(ctx, &buildReq); err != nil {
+			return client.IgnoreNotFound(fmt.Errorf("failed to update build request status: %w", err))
+		}
+	}
+
+	if err := p.k8sClient.Delete(ctx, &buildReq); client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to delete build request: %w", err)
+	}
+	return nil
+}
+
+// requestGarbageCollection annotates the build request so that the controller
+// deletes it on the proxy's behalf
+func (p *SSHProxy) requestGarbageCollection(key types.NamespacedName) {
+	ctx, cancel := context.WithTimeout(context.Background(), gcRequestTimeout)
+	defer cancel()
+
+	buildReq := &v1alpha1.NixBuildRequest{}
+	buildReq.Namespace = key.Namespace
+	buildReq.Name = key.Name
+
+	patch := client.RawPatch(types.MergePatchType, fmt.Appendf(nil, `{"metadata":{"annotations":{%q:"true"}}}`, v1alpha1.GCRequestedAnnotation))
+	if err := p.k8sClient.Patch(ctx, buildReq, patch); client.IgnoreNotFound(err) != nil {
+		log.Error().Err(err).Str("build_request", key.Name).Msg("Failed to request garbage collection for build request")
+	}
+}
+
+// releaseOrphanedBuildRequests fails and deletes the build requests whose
+// proxy is gone: those an earlier process with this proxy's ID left behind,
+// and those of proxy pods that no longer run. Their sessions died with that
+// process, so nothing else would release their builders before the
+// controller noticed the missing heartbeats.
+func (p *SSHProxy) releaseOrphanedBuildRequests(ctx context.Context) {
+	if p.proxyID == "" && p.proxyPod == "" {
+		return
+	}
+
+	var buildReqs []v1alpha1.NixBuildRequest
+	for _, namespace := range servedNamespaces(p.namespace, p.namespaceRules) {
+		var list v1alpha1.NixBuildRequestList
+		if err := p.k8sClient.List(ctx, &list, client.InNamespace(namespace)); err != nil {
+			log.Warn().Err(err).Str("namespace", namespace).Msg("Failed to list build requests left by other proxy instances")
+			continue
+		}
+		buildReqs = append(buildReqs, list.Items...)
+	}
+
+	alive := make(map[string]bool)
+	for _, buildReq := range buildReqs {
+		reason, orphaned := p.orphanReason(ctx, &buildReq, alive)
+		if !orphaned {
+			continue
+		}
+		if err := p.finishBuildRequest(ctx, client.ObjectKeyFromObject(&buildReq), false, errcode.Errorf(errcode.Canceled, "%s", reason)); err != nil {
+			log.Warn().Err(err).Str("session_id", buildReq.Spec.SessionID).Msg("Failed to release orphaned build request")
+			continue
+		}
+		log.Info().Str("session_id", buildReq.Spec.SessionID).Str("reason", reason).Msg("Released orphaned build request")
+	}
+}
+
+// orphanReason reports why a build request's proxy session is known to be
+// gone. Requests naming their proxy pod are orphaned once that pod no longer
+// runs, or runs a restarted process; others when they carry this proxy's ID
+// but not this process's instance. alive caches pod lookups by UID.
+func (p *SSHProxy) orphanReason(ctx context.Context, buildReq *v1alpha1.NixBuildRequest, alive map[string]bool) (string, bool) {
+	if buildReq.Annotations[v1alpha1.ProxyInstanceAnnotation] == p.instanceID {
+		return "", false
+	}
+
+	pod, uid := buildReq.Annotations[v1alpha1.ProxyPodAnnotation], buildReq.Annotations[v1alpha1.ProxyPodUIDAnnotation]
+	if pod == "" || uid == "" {
+		if p.proxyID != "" && buildReq.Labels[v1alpha1.ProxyLabel] == p.proxyID {
+			return fmt.Sprintf("proxy %s restarted", p.proxyID), true
+		}
+		return "", false
+	}
+	if uid == p.proxyPodUID {
+		return fmt.Sprintf("proxy %s restarted", pod), true
+	}
+
+	running, ok := alive[uid]
+	if !ok {
+		var err error
+		if running, err = p.proxyPodRunning(ctx, pod, uid); err != nil {
+			log.Warn().Err(err).Str("proxy_pod", pod).Msg("Failed to check whether a proxy pod still runs")
+			return "", false
+		}
+		alive[uid] = running
+	}
+	if running {
+		return "", false
+	}
+	return fmt.Sprintf("proxy pod %s is gone", pod), true
+}
+
+// proxyPodRunning reports whether the proxy pod named namespace/name with the
+// given UID still exists. A terminating pod may still be draining sessions.
+func (p *SSHProxy) proxyPodRunning(ctx context.Context, pod, uid string) (bool, error) {
+	namespace, name, ok := strings.Cut(pod, "/")
+	if !ok {
+		return false, fmt.Errorf("malformed proxy pod %q", pod)
+	}
+	var current corev1.Pod
+	if err := p.k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, &current); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(current.UID) == uid, nil
+}
+
+// sendHeartbeats refreshes the build request's heartbeat annotation until the
+// session ends, so the controller can tell its session is still alive
+func (p *SSHProxy) sendHeartbeats(ctx context.Context, session *ProxySession, name string) {
+	ticker := time.NewTicker(sessionHeartbeatInterval)
+	defer ticker.Stop()
+
+	buildReq := &v1alpha1.NixBuildRequest{}
+	buildReq.Namespace = p.sessionNamespace(session)
+	buildReq.Name = name
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			patch := client.RawPatch(types.MergePatchType, fmt.Appendf(nil, `{"metadata":{"annotations":{%q:%q}}}`, v1alpha1.SessionHeartbeatAnnotation, time.Now().UTC().Format(time.RFC3339)))
+			if err := p.k8sClient.Patch(ctx, buildReq, patch); client.IgnoreNotFound(err) != nil && ctx.Err() == nil {
+				log.Ctx(ctx).Warn().Err(err).Msg("Failed to send session heartbeat")
+			}
+		}
+	}
+}
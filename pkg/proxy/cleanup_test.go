@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// TestReleaseOrphanedBuildRequests starts a replica next to a live peer and
+// checks that it only releases the build requests of proxy processes that
+// are gone
+func TestReleaseOrphanedBuildRequests(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "proxy-b", Namespace: "nix", UID: "uid-b"}}
+	buildReq := func(name, proxyID, instance, pod, uid string) *v1alpha1.NixBuildRequest {
+		req := &v1alpha1.NixBuildRequest{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Labels:      map[string]string{v1alpha1.ProxyLabel: proxyID},
+				Annotations: map[string]string{v1alpha1.ProxyInstanceAnnotation: instance},
+			},
+			Spec: v1alpha1.NixBuildRequestSpec{SessionID: name},
+		}
+		if pod != "" {
+			req.Annotations[v1alpha1.ProxyPodAnnotation] = pod
+			req.Annotations[v1alpha1.ProxyPodUIDAnnotation] = uid
+		}
+		return req
+	}
+
+	k8sClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithStatusSubresource(&v1alpha1.NixBuildRequest{}).
+		WithObjects(
+			peer,
+			buildReq("own", "proxy-a", "current", "nix/proxy-a", "uid-a"),
+			buildReq("restarted", "proxy-a", "earlier", "nix/proxy-a", "uid-a"),
+			buildReq("live-peer", "proxy-b", "peer", "nix/proxy-b", "uid-b"),
+			buildReq("replaced-peer", "proxy-b", "peer", "nix/proxy-b", "uid-old"),
+			buildReq("deleted-peer", "proxy-c", "gone", "nix/proxy-c", "uid-c"),
+			buildReq("unannotated", "proxy-a", "earlier", "", ""),
+			buildReq("unannotated-peer", "proxy-b", "peer", "", ""),
+		).
+		Build()
+
+	p := &SSHProxy{
+		k8sClient:   k8sClient,
+		namespace:   "default",
+		proxyID:     "proxy-a",
+		instanceID:  "current",
+		proxyPod:    "nix/proxy-a",
+		proxyPodUID: "uid-a",
+	}
+	p.releaseOrphanedBuildRequests(context.Background())
+
+	want := map[string]bool{
+		"own":              true,
+		"restarted":        false,
+		"live-peer":        true,
+		"replaced-peer":    false,
+		"deleted-peer":     false,
+		"unannotated":      false,
+		"unannotated-peer": true,
+	}
+	for name, kept := range want {
+		err := k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: name}, &v1alpha1.NixBuildRequest{})
+		switch {
+		case kept && err != nil:
+			t.Errorf("%s was released: %v", name, err)
+		case !kept && !apierrors.IsNotFound(err):
+			t.Errorf("%s was kept (err %v), want it released", name, err)
+		}
+	}
+
+	var remaining v1alpha1.NixBuildRequestList
+	if err := k8sClient.List(context.Background(), &remaining, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining.Items) != 3 {
+		t.Errorf("%d build requests remain, want 3", len(remaining.Items))
+	}
+}
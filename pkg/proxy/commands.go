@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"golang.org/x/crypto/ssh"
+)
+
+// shellMetacharacters could make the builder's shell run more than the
+// matched command
+const shellMetacharacters = ";&|`$<>(){}[]*?~#!\\'\"\n\r"
+
+// DefaultAllowedCommands are the commands Nix runs on a remote builder: the
+// legacy ssh:// store protocol, read-only and writable, and the ssh-ng://
+// daemon protocol. They take no further arguments, since the builder user is
+// trusted and options such as --option post-build-hook would run outside the
+// sandbox.
+var DefaultAllowedCommands = []string{"nix-store --serve", "nix-store --serve --write", "nix-daemon --stdio"}
+
+// CommandPolicy restricts the commands a session may run on its builder.
+// Each pattern is a command line whose words must match the command's. A
+// program name without a slash only matches that bare name, looked up in the
+// builder user's PATH, and one with a slash only that exact path, so a
+// program of the same name the client copied into the store never matches.
+// A final "*" matches any remaining arguments. Commands containing shell
+// syntax never match, since sshd runs them through the builder user's shell.
+type CommandPolicy struct {
+	patterns [][]string
+	// subsystems are the subsystems, such as sftp, sessions may start
+	subsystems []string
+}
+
+// NewCommandPolicy returns a policy allowing only commands matching one of
+// patterns and the named subsystems
+func NewCommandPolicy(patterns, subsystems []string) (*CommandPolicy, error) {
+	policy := &CommandPolicy{subsystems: subsystems}
+	for _, pattern := range patterns {
+		words := strings.Fields(pattern)
+		if len(words) == 0 || words[0] == "*" {
+			return nil, fmt.Errorf("invalid command pattern %q: must start with a program", pattern)
+		}
+		policy.patterns = append(policy.patterns, words)
+	}
+	return policy, nil
+}
+
+// Allows reports whether command matches one of the policy's patterns
+func (c *CommandPolicy) Allows(command string) bool {
+	if strings.ContainsAny(command, shellMetacharacters) {
+		return false
+	}
+	words := strings.Fields(command)
+	for _, pattern := range c.patterns {
+		if matchCommand(pattern, words) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCommand(pattern, words []string) bool {
+	if len(words) == 0 {
+		return false
+	}
+	if words[0] != pattern[0] {
+		return false
+	}
+	for i, want := range pattern[1:] {
+		if want == "*" && i == len(pattern)-2 {
+			return true
+		}
+		if i+1 >= len(words) || words[i+1] != want {
+			return false
+		}
+	}
+	return len(words) == len(pattern)
+}
+
+// check refuses channel requests that would start anything other than an
+// allowed command or subsystem on the builder. Other requests, such as env
+// and window-change, pass through.
+func (c *CommandPolicy) check(req *ssh.Request) error {
+	switch req.Type {
+	case "exec":
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			return errcode.Errorf(errcode.Invalid, "malformed exec request")
+		}
+		if !c.Allows(payload.Command) {
+			return errcode.Errorf(errcode.Auth, "command %q is not allowed on this builder", payload.Command)
+		}
+		return nil
+	case "shell":
+		return errcode.Errorf(errcode.Auth, "interactive shells are not allowed on this builder")
+	case "subsystem":
+		var payload struct{ Name string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			return errcode.Errorf(errcode.Invalid, "malformed subsystem request")
+		}
+		if !slices.Contains(c.subsystems, payload.Name) {
+			return errcode.Errorf(errcode.Auth, "subsystem %q is not allowed on this builder", payload.Name)
+		}
+		return nil
+	default:
+		return nil
+	}
+}
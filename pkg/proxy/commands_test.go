@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCommandPolicyAllowsOnlyNix(t *testing.T) {
+	policy, err := NewCommandPolicy(DefaultAllowedCommands, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for command, want := range map[string]bool{
+		"nix-store --serve":                                              true,
+		"nix-store --serve --write":                                      true,
+		"nix-daemon --stdio":                                             true,
+		"/nix/var/nix/profiles/default/bin/nix-daemon --stdio":           false,
+		"/nix/store/abc-x/bin/nix-daemon --stdio":                        false,
+		"./nix-daemon --stdio":                                           false,
+		"nix-store --serve --write --option sandbox false":               false,
+		"nix-store --serve --option post-build-hook /nix/store/abc-hook": false,
+		"nix-daemon --stdio --option sandbox false":                      false,
+		"nix-daemon --stdio; rm -rf /":                                   false,
+		"nix-store --serve --write; rm -rf /":                            false,
+		"nix-store --serve $(id)":                                        false,
+		"nix-daemon":                                                     false,
+		"nix-store --gc":                                                 false,
+		"bash -c 'nix-daemon --stdio'":                                   false,
+		"":                                                               false,
+	} {
+		if got := policy.Allows(command); got != want {
+			t.Errorf("Allows(%q) = %v, want %v", command, got, want)
+		}
+	}
+
+	shell := &ssh.Request{Type: "shell"}
+	if code := errcode.Of(policy.check(shell)); code != errcode.Auth {
+		t.Errorf("shell request code = %q, want %s", code, errcode.Auth)
+	}
+	sftp := &ssh.Request{Type: "subsystem", Payload: ssh.Marshal(struct{ Name string }{"sftp"})}
+	if code := errcode.Of(policy.check(sftp)); code != errcode.Auth {
+		t.Errorf("sftp request code = %q, want %s", code, errcode.Auth)
+	}
+	env := &ssh.Request{Type: "env", Payload: ssh.Marshal(struct{ Name, Value string }{"LANG", "C"})}
+	if err := policy.check(env); err != nil {
+		t.Errorf("env request refused: %v", err)
+	}
+}
+
+func TestCommandPolicyMatchesAbsolutePaths(t *testing.T) {
+	policy, err := NewCommandPolicy([]string{"/run/current-system/sw/bin/nix-daemon --stdio"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for command, want := range map[string]bool{
+		"/run/current-system/sw/bin/nix-daemon --stdio": true,
+		"nix-daemon --stdio":                            false,
+		"/nix/store/abc-x/bin/nix-daemon --stdio":       false,
+	} {
+		if got := policy.Allows(command); got != want {
+			t.Errorf("Allows(%q) = %v, want %v", command, got, want)
+		}
+	}
+}
+
+func TestCommandPolicyAllowsSubsystems(t *testing.T) {
+	policy, err := NewCommandPolicy(append(DefaultAllowedCommands, "scp -f *"), []string{"sftp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sftp := &ssh.Request{Type: "subsystem", Payload: ssh.Marshal(struct{ Name string }{"sftp"})}
+	if err := policy.check(sftp); err != nil {
+		t.Errorf("allowed sftp subsystem refused: %v", err)
+	}
+	other := &ssh.Request{Type: "subsystem", Payload: ssh.Marshal(struct{ Name string }{"netconf"})}
+	if code := errcode.Of(policy.check(other)); code != errcode.Auth {
+		t.Errorf("netconf subsystem code = %q, want %s", code, errcode.Auth)
+	}
+	if !policy.Allows("scp -f /nix/store/abc-hello/bin/hello") || policy.Allows("scp -t /etc") {
+		t.Error("scp downloads should be allowed and uploads refused")
+	}
+}
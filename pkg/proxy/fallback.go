@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+// FallbackMarker starts the line the proxy writes to a client's stderr when
+// no builder could be provisioned for it, so that wrapper scripts can build
+// locally instead of failing. The line reads
+//
+//	nix-remote-build-fallback: local code=E_TIMEOUT session=<session ID>
+const FallbackMarker = "nix-remote-build-fallback:"
+
+// capacityCodes are the failures that mean no builder was available rather
+// than that the build request itself cannot succeed
+var capacityCodes = map[errcode.Code]bool{
+	errcode.Quota:         true,
+	errcode.Timeout:       true,
+	errcode.Unschedulable: true,
+	errcode.Preempted:     true,
+	errcode.Disabled:      true,
+}
+
+// localFallbackAdvice returns the advisory sent to a client whose session
+// failed with code, or an empty string when building locally would not help
+func localFallbackAdvice(code errcode.Code, sessionID string) string {
+	if !capacityCodes[code] {
+		return ""
+	}
+	return "nix-remote-build-proxy: no remote builder is available, consider building locally with --max-jobs auto\r\n" +
+		fmt.Sprintf("%s local code=%s session=%s\r\n", FallbackMarker, code, sessionID)
+}
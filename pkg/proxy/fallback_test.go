@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+func TestLocalFallbackAdviceOnlyForCapacity(t *testing.T) {
+	advice := localFallbackAdvice(errcode.Timeout, "abc")
+	if !strings.Contains(advice, "\r\nnix-remote-build-fallback: local code=E_TIMEOUT session=abc\r\n") {
+		t.Errorf("advice = %q, want the fallback marker on its own line", advice)
+	}
+	for _, code := range []errcode.Code{errcode.Auth, errcode.Invalid, errcode.ImagePull, errcode.Builder, errcode.Canceled} {
+		if advice := localFallbackAdvice(code, "abc"); advice != "" {
+			t.Errorf("advice for %s = %q, want none", code, advice)
+		}
+	}
+}
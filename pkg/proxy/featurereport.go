@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/features"
+)
+
+// configFeatures describes the optional subsystems cfg enables. Settings
+// that can be reloaded are added by featureReport.
+func configFeatures(cfg Config, resolver string) []features.Feature {
+	authentication := features.Off("authentication", "every client is accepted; --auth")
+	if providers := slices.DeleteFunc(slices.Clone(cfg.Auth.Providers), func(p string) bool { return p == AuthNone }); len(providers) > 0 {
+		detail := strings.Join(providers, ", ")
+		if slices.Contains(cfg.Auth.Providers, AuthNone) {
+			detail += ", falling back to accepting every client"
+		}
+		authentication = features.On("authentication", detail)
+	}
+
+	sessionLimit := features.Off("session-limit", "--max-sessions")
+	if cfg.MaxSessions > 0 {
+		sessionLimit = features.On("session-limit", fmt.Sprintf("at most %d sessions", cfg.MaxSessions))
+	}
+
+	commandRestrictions := fmt.Sprintf("%d allowed commands", len(cfg.AllowedCommands))
+	if len(cfg.AllowedSubsystems) > 0 {
+		commandRestrictions += ", subsystems " + strings.Join(cfg.AllowedSubsystems, ", ")
+	}
+
+	namespaces := features.Off("principal-namespaces", "--principal-namespaces")
+	if len(cfg.NamespaceRules) > 0 {
+		namespaces = features.On("principal-namespaces", "build requests in "+strings.Join(servedNamespaces(cfg.Namespace, cfg.NamespaceRules), ", "))
+	}
+
+	connectionRate := features.Off("connection-rate-limit", "--connection-rate")
+	if cfg.ConnectionRate > 0 {
+		connectionRate = features.On("connection-rate-limit", fmt.Sprintf("%g connections a second per source address, bursts of %d", cfg.ConnectionRate, max(cfg.ConnectionBurst, 1)))
+	}
+
+	return []features.Feature{
+		authentication,
+		features.Toggle("authorization", cfg.Authorizer != nil, "session actions are checked against rules", "--authz-rules"),
+		features.On("builder-resolver", resolver),
+		features.Toggle("builder-tls", cfg.BuilderTLSSecret != "", fmt.Sprintf("mutual TLS on port %d", cfg.BuilderTLSPort), "--builder-tls-secret"),
+		features.Toggle("builder-host-keys", !cfg.InsecureIgnoreBuilderHostKeys, "builder host keys are verified", "disabled by --insecure-ignore-builder-host-keys"),
+		features.Toggle("session-client-keys", cfg.SessionClientKeys, "a client key per build request", "--session-client-keys"),
+		features.Toggle("builder-reuse", cfg.BuilderReuseWindow > 0, "for "+cfg.BuilderReuseWindow.String()+" after a connection closes", "--builder-reuse-window"),
+		features.Toggle("static-builders", len(cfg.StaticBuilders) > 0, fmt.Sprintf("%d builders outside the cluster", len(cfg.StaticBuilders)), "--static-builders or --external-builders"),
+		features.Toggle("queue-timeout", cfg.QueueTimeout > 0, "queued sessions fail after "+cfg.QueueTimeout.String(), "--queue-timeout"),
+		features.Toggle("command-restrictions", cfg.AllowedCommands != nil, commandRestrictions, "--restrict-commands"),
+		features.Toggle("ci-context", cfg.CIEnv != nil, fmt.Sprintf("%d environment variables", len(cfg.CIEnv)), "--ci-env"),
+		features.Toggle("audit-log", cfg.Audit != nil, "a record of every connection", "--audit-log"),
+		namespaces,
+		sessionLimit,
+		connectionRate,
+		features.Toggle("admin-api", cfg.AdminAddress != "", "sessions and usage on "+cfg.AdminAddress, "--admin-address"),
+		features.Toggle("admin-tls", cfg.AdminTLSCertPath != "", "health port and admin API served over HTTPS", "--admin-tls-cert"),
+		features.Toggle("vault", cfg.Vault != nil, "keys from "+cfg.VaultKeyPath, "--vault-addr"),
+	}
+}
+
+// featureReport describes the proxy's features, including its current
+// settings
+func (p *SSHProxy) featureReport() features.Report {
+	settings := p.currentSettings()
+	return features.Report{
+		Component: "proxy",
+		Version:   p.version,
+		Features: append(slices.Clone(p.configFeatures),
+			features.Toggle("idle-timeout", settings.IdleTimeout > 0, "sessions end after "+settings.IdleTimeout.String()+" without data", "--idle-timeout"),
+			features.Toggle("keepalives", settings.KeepAliveInterval > 0, "every "+settings.KeepAliveInterval.String(), "--keepalive-interval"),
+		),
+	}
+}
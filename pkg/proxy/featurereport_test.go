@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/features"
+)
+
+func TestConfigFeaturesDescribeAuthentication(t *testing.T) {
+	find := func(list []features.Feature, name string) features.Feature {
+		t.Helper()
+		for _, feature := range list {
+			if feature.Name == name {
+				return feature
+			}
+		}
+		t.Fatalf("no %s feature in %+v", name, list)
+		return features.Feature{}
+	}
+
+	open := configFeatures(Config{}, ResolverPodIP)
+	if auth := find(open, "authentication"); auth.Enabled {
+		t.Errorf("authentication = %+v, want disabled without --auth", auth)
+	}
+	if hostKeys := find(open, "builder-host-keys"); !hostKeys.Enabled {
+		t.Errorf("builder-host-keys = %+v, want verification on by default", hostKeys)
+	}
+
+	cfg := Config{
+		Auth:               AuthConfig{Providers: []string{AuthFile, AuthOIDC, AuthNone}},
+		BuilderReuseWindow: time.Minute,
+		MaxSessions:        100,
+	}
+	configured := configFeatures(cfg, ResolverPodIP)
+	if auth := find(configured, "authentication"); !auth.Enabled || auth.Detail != "file, oidc, falling back to accepting every client" {
+		t.Errorf("authentication = %+v", auth)
+	}
+	if reuse := find(configured, "builder-reuse"); !reuse.Enabled {
+		t.Errorf("builder-reuse = %+v, want enabled", reuse)
+	}
+	if limit := find(configured, "session-limit"); limit.Detail != "at most 100 sessions" {
+		t.Errorf("session-limit = %+v", limit)
+	}
+}
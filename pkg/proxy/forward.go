@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// forwardGoroutines is the number of goroutines copying data for one
+// forwarded connection
+const forwardGoroutines = 2
+
+// loopbackHosts are the targets a local forward may name. Forwards are
+// dialled from inside the builder, so anything else would reach the cluster
+// network.
+var loopbackHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// forwardAllowed reports whether a lease lets its owner forward port
+func forwardAllowed(lease *v1alpha1.BuilderLease, port uint32) bool {
+	return port <= 65535 && slices.Contains(lease.Spec.ForwardPorts, int32(port))
+}
+
+// forwardTarget resolves the builder a forwarding request is for and the key
+// to log in to it with. Leased builders are checked against the lease's port
+// allowlist. Other connections forward to the builder of their session
+// channel, which only that connection uses.
+func (p *SSHProxy) forwardTarget(ctx context.Context, session *ProxySession, req AuthzRequest) (string, ssh.Signer, error) {
+	if leaseName := leaseFromUser(session.SSHConn.User()); leaseName != "" {
+		podIP, err := p.leaseForward(ctx, session, leaseName, req)
+		return podIP, p.clientKey, err
+	}
+
+	if err := p.authz.Authorize(ctx, req); err != nil {
+		return "", nil, err
+	}
+	var podIP string
+	var clientKey ssh.Signer
+	p.sessions.update(session, func() {
+		podIP = session.builderIP
+		clientKey = session.builderKey
+	})
+	if podIP == "" {
+		return "", nil, &builderUnavailableError{reason: "no builder is ready for this connection yet, open a session first"}
+	}
+	return podIP, clientKey, nil
+}
+
+// leaseForward resolves the leased builder a forwarding request is for,
+// checking the lease, its port allowlist and the forwarding action
+func (p *SSHProxy) leaseForward(ctx context.Context, session *ProxySession, leaseName string, req AuthzRequest) (string, error) {
+	lease, err := p.authorizeLease(ctx, session, leaseName)
+	if err != nil {
+		return "", err
+	}
+	if !forwardAllowed(lease, req.TargetPort) {
+		return "", &Denial{Action: req.Action, Code: "port", Reason: fmt.Sprintf("port %d is not forwardable on lease %s", req.TargetPort, leaseName)}
+	}
+	if err := p.authz.Authorize(ctx, req); err != nil {
+		return "", err
+	}
+	return p.waitForBuilderPod(ctx, session, v1alpha1.LeaseBuildRequestName(leaseName), nil)
+}
+
+// handleDirectTCPIP forwards a connection from the client to a port on its
+// builder
+func (p *SSHProxy) handleDirectTCPIP(ctx context.Context, session *ProxySession, newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+	if !slices.Contains(loopbackHosts, payload.Host) {
+		err := &Denial{Action: ActionDirectTCPIP, Code: "target", Reason: "only ports on the builder's loopback interface can be forwarded"}
+		newChannel.Reject(ssh.Prohibited, p.denialMessage(session, err))
+		return
+	}
+
+	req := authzRequest(session, ActionDirectTCPIP)
+	req.Namespace = p.sessionNamespace(session)
+	req.TargetHost = payload.Host
+	req.TargetPort = payload.Port
+	podIP, clientKey, err := p.forwardTarget(ctx, session, req)
+	if err != nil {
+		newChannel.Reject(p.channelRejection(session, err))
+		return
+	}
+
+	if !session.limits.acquireGoroutines(forwardGoroutines) {
+		newChannel.Reject(ssh.ResourceShortage, errcode.Message(errcode.Quota, "too many concurrent forwards"))
+		return
+	}
+	defer session.limits.releaseGoroutines(forwardGoroutines)
+
+	builderConn, _, err := p.dialBuilder(ctx, session, podIP, clientKey)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to dial builder for forward")
+		newChannel.Reject(ssh.ConnectionFailed, "failed to connect to builder")
+		return
+	}
+	defer builderConn.Close()
+
+	builderChannel, builderRequests, err := builderConn.OpenChannel("direct-tcpip", newChannel.ExtraData())
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, fmt.Sprintf("builder refused forward: %v", err))
+		return
+	}
+	defer builderChannel.Close()
+	go ssh.DiscardRequests(builderRequests)
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to accept channel")
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	log.Ctx(ctx).Info().Uint32("port", payload.Port).Msg("Forwarding port to builder")
+	pipeChannels(channel, builderChannel)
+}
+
+// handleGlobalRequests serves a connection's global requests. tcpip-forward
+// asks the connection's builder to listen on a port and relays its
+// connections back to the client; every other request is refused.
+func (p *SSHProxy) handleGlobalRequests(ctx context.Context, session *ProxySession, reqs <-chan *ssh.Request) {
+	// All remote forwards of a session share one builder connection, which
+	// holds the builder's listeners open until the client goes away
+	var builderConn *ssh.Client
+	defer func() {
+		if builderConn != nil {
+			builderConn.Close()
+		}
+	}()
+
+	for req := range reqs {
+		switch {
+		case req.Type == "tcpip-forward":
+			conn, ok, payload := p.handleRemoteForward(ctx, session, builderConn, req.Payload)
+			builderConn = conn
+			if req.WantReply {
+				req.Reply(ok, payload)
+			}
+		case req.Type == "cancel-tcpip-forward" && builderConn != nil:
+			ok, payload, err := builderConn.SendRequest(req.Type, true, req.Payload)
+			if req.WantReply {
+				req.Reply(ok && err == nil, payload)
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// handleRemoteForward checks a tcpip-forward request and passes it on to
+// the connection's builder, dialling it first if needed. It returns the builder
+// connection to use for later requests.
+func (p *SSHProxy) handleRemoteForward(ctx context.Context, session *ProxySession, builderConn *ssh.Client, payload []byte) (*ssh.Client, bool, []byte) {
+	var forward struct {
+		BindAddr string
+		BindPort uint32
+	}
+	if err := ssh.Unmarshal(payload, &forward); err != nil {
+		return builderConn, false, nil
+	}
+
+	req := authzRequest(session, ActionTCPIPForward)
+	req.Namespace = p.sessionNamespace(session)
+	req.TargetHost = forward.BindAddr
+	req.TargetPort = forward.BindPort
+	podIP, clientKey, err := p.forwardTarget(ctx, session, req)
+	if err != nil {
+		_, message := p.channelRejection(session, err)
+		log.Ctx(ctx).Info().Str("reason", message).Msg("Refused remote forward")
+		return builderConn, false, nil
+	}
+
+	if builderConn == nil {
+		builderConn, _, err = p.dialBuilder(ctx, session, podIP, clientKey)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to dial builder for forward")
+			return nil, false, nil
+		}
+		go p.relayForwardedChannels(session, builderConn.HandleChannelOpen("forwarded-tcpip"))
+	}
+
+	ok, reply, err := builderConn.SendRequest("tcpip-forward", true, payload)
+	if err != nil || !ok {
+		log.Ctx(ctx).Info().Err(err).Uint32("port", forward.BindPort).Msg("Builder refused remote forward")
+		return builderConn, false, nil
+	}
+	log.Ctx(ctx).Info().Uint32("port", forward.BindPort).Msg("Forwarding port from builder")
+	return builderConn, true, reply
+}
+
+// relayForwardedChannels opens a channel to the client for each connection
+// the builder accepts on a remote forward
+func (p *SSHProxy) relayForwardedChannels(session *ProxySession, chans <-chan ssh.NewChannel) {
+	for newChannel := range chans {
+		if !session.limits.acquireGoroutines(forwardGoroutines) {
+			newChannel.Reject(ssh.ResourceShortage, errcode.Message(errcode.Quota, "too many concurrent forwards"))
+			continue
+		}
+		go func() {
+			defer session.limits.releaseGoroutines(forwardGoroutines)
+
+			channel, requests, err := session.SSHConn.OpenChannel("forwarded-tcpip", newChannel.ExtraData())
+			if err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, fmt.Sprintf("client refused forward: %v", err))
+				return
+			}
+			defer channel.Close()
+			go ssh.DiscardRequests(requests)
+
+			builderChannel, builderRequests, err := newChannel.Accept()
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to accept channel")
+				return
+			}
+			defer builderChannel.Close()
+			go ssh.DiscardRequests(builderRequests)
+
+			pipeChannels(builderChannel, channel)
+		}()
+	}
+}
+
+// pipeChannels copies data both ways between two channels until both
+// directions have finished
+func pipeChannels(a, b ssh.Channel) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src ssh.Channel) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		dst.CloseWrite()
+	}
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
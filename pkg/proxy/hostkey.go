@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/vault"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// hostKeyReloadInterval is how often the host key source is checked for
+// rotated key material
+const hostKeyReloadInterval = time.Minute
+
+// hostKeyLoader reads the proxy's current host key, wrapped in its OpenSSH
+// host certificate when one is configured
+type hostKeyLoader func(ctx context.Context) (ssh.Signer, error)
+
+func fileHostKeyLoader(keyPath, certPath string) hostKeyLoader {
+	return func(ctx context.Context) (ssh.Signer, error) {
+		keyBytes, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		var certBytes []byte
+		if certPath != "" {
+			certBytes, err = os.ReadFile(certPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return parseHostKey(keyBytes, certBytes)
+	}
+}
+
+func secretHostKeyLoader(k8sClient client.Client, namespace, secretName string) hostKeyLoader {
+	return func(ctx context.Context) (ssh.Signer, error) {
+		var secret corev1.Secret
+		if err := k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: namespace,
+			Name:      secretName,
+		}, &secret); err != nil {
+			return nil, fmt.Errorf("failed to get secret: %w", err)
+		}
+
+		hostKeyBytes, ok := secret.Data[SSHKeySecretHostKey]
+		if !ok {
+			return nil, fmt.Errorf("secret %s missing key '%s'", secretName, SSHKeySecretHostKey)
+		}
+
+		return parseHostKey(hostKeyBytes, secret.Data[SSHKeySecretHostCert])
+	}
+}
+
+func vaultHostKeyLoader(vaultClient *vault.Client, path string) hostKeyLoader {
+	return func(ctx context.Context) (ssh.Signer, error) {
+		data, err := vaultClient.ReadKV(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+
+		hostKey, ok := data[SSHKeySecretHostKey]
+		if !ok {
+			return nil, fmt.Errorf("vault path %s missing key '%s'", path, SSHKeySecretHostKey)
+		}
+
+		return parseHostKey([]byte(hostKey), []byte(data[SSHKeySecretHostCert]))
+	}
+}
+
+// parseHostKey parses a private host key and, if certBytes is not empty,
+// pairs it with the OpenSSH host certificate signed by an internal CA
+func parseHostKey(keyBytes, certBytes []byte) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key: %w", err)
+	}
+	if len(certBytes) == 0 {
+		return signer, nil
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host certificate: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("host certificate is not an OpenSSH host certificate")
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("host certificate does not match host key: %w", err)
+	}
+	return certSigner, nil
+}
+
+func (p *SSHProxy) currentHostKey() ssh.Signer {
+	p.hostKeyMux.RLock()
+	defer p.hostKeyMux.RUnlock()
+	return p.hostKey
+}
+
+// watchHostKey periodically reloads the host key so that rotations by
+// cert-manager or an operator take effect for new connections without a
+// restart
+func (p *SSHProxy) watchHostKey(ctx context.Context) {
+	ticker := time.NewTicker(hostKeyReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			signer, err := p.hostKeyLoader(ctx)
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to reload SSH host key, keeping current key")
+				continue
+			}
+
+			if bytes.Equal(signer.PublicKey().Marshal(), p.currentHostKey().PublicKey().Marshal()) {
+				continue
+			}
+
+			p.hostKeyMux.Lock()
+			p.hostKey = signer
+			p.hostKeyMux.Unlock()
+			log.Info().Str("type", signer.PublicKey().Type()).Msg("Reloaded rotated SSH host key")
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultKeepAliveInterval is the default interval between SSH keepalives
+// sent to clients
+const DefaultKeepAliveInterval = 30 * time.Second
+
+// errIdleTimeout is recorded on build requests whose session carried no
+// data for longer than the idle timeout
+var errIdleTimeout = errcode.Errorf(errcode.Timeout, "session idle timeout")
+
+// activityReader records data read through it as session activity and adds
+// its length to count
+type activityReader struct {
+	io.Reader
+	session *ProxySession
+	count   *atomic.Int64
+}
+
+func (r activityReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.session.touch()
+		r.count.Add(int64(n))
+	}
+	return n, err
+}
+
+// touch records that the session's tunnels carried data
+func (s *ProxySession) touch() {
+	s.lastData.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the session's tunnels have carried no data
+func (s *ProxySession) idleFor() time.Duration {
+	return time.Since(time.Unix(0, s.lastData.Load()))
+}
+
+// watchIdle ends a tunnel once its session has been idle for the idle
+// timeout, telling the client why before the channel is closed
+func (p *SSHProxy) watchIdle(ctx context.Context, session *ProxySession, channel ssh.Channel, idle chan<- error, cancel context.CancelFunc) {
+	timeout := p.currentSettings().IdleTimeout
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(min(timeout/4, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if session.idleFor() < timeout {
+				continue
+			}
+			log.Ctx(ctx).Info().Dur("idle_timeout", timeout).Msg("Closing idle session")
+			fmt.Fprintf(channel.Stderr(), "nix-remote-build-proxy: session idle for %s, disconnecting\r\n", timeout)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+			idle <- errIdleTimeout
+			cancel()
+			return
+		}
+	}
+}
+
+// keepClientAlive sends SSH keepalives to the client and closes the
+// connection when one goes unanswered for a full interval, so clients that
+// vanished behind a NAT or load balancer do not hold builders
+func (p *SSHProxy) keepClientAlive(ctx context.Context, session *ProxySession) {
+	interval := p.currentSettings().KeepAliveInterval
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deadline := time.AfterFunc(interval, func() {
+				log.Ctx(ctx).Warn().Msg("Client did not answer keepalive, closing connection")
+				session.SSHConn.Close()
+			})
+			_, _, err := session.SSHConn.SendRequest("keepalive@openssh.com", true, nil)
+			deadline.Stop()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// leaseActivityInterval is how often an open session marks its lease as
+	// in use, so idle reclamation never takes a builder that is in use
+	leaseActivityInterval = time.Minute
+)
+
+// leaseFromUser returns the lease a client asked for through its SSH user
+// name, or an empty string for ordinary sessions
+func leaseFromUser(user string) string {
+	name, _ := strings.CutPrefix(user, v1alpha1.LeaseUserPrefix)
+	if name == user {
+		return ""
+	}
+	return name
+}
+
+// handleLeaseChannel routes a session channel to the caller's leased
+// builder. Unlike ordinary sessions the builder outlives the channel, so no
+// build request is created or cleaned up.
+func (p *SSHProxy) handleLeaseChannel(ctx context.Context, session *ProxySession, newChannel ssh.NewChannel, leaseName string) {
+	if _, err := p.authorizeLease(ctx, session, leaseName); err != nil {
+		newChannel.Reject(p.channelRejection(session, err))
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to accept channel")
+		return
+	}
+	defer channel.Close()
+
+	log.Ctx(ctx).Info().Str("lease", leaseName).Msg("Handling leased builder session")
+
+	activityCtx, stopActivity := context.WithCancel(ctx)
+	defer stopActivity()
+	go p.markLeaseActive(activityCtx, p.sessionNamespace(session), leaseName)
+
+	buildReqName := v1alpha1.LeaseBuildRequestName(leaseName)
+	podIP, err := p.waitForBuilderPod(ctx, session, buildReqName, channel.Stderr())
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("lease", leaseName).Msg("Failed to get leased builder pod")
+		return
+	}
+
+	if err := p.routeToBuilder(ctx, session, channel, requests, buildReqName, podIP, p.clientKey, nil); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("lease", leaseName).Msg("Failed to route to leased builder")
+	}
+}
+
+// builderUnavailableError is returned when there is no builder to connect
+// to, such as for leases that do not exist or have ended. Its message is
+// shown to the client.
+type builderUnavailableError struct {
+	reason string
+}
+
+func (e *builderUnavailableError) Error() string {
+	return e.reason
+}
+
+// authorizeLease returns the named lease if the session's principal owns it,
+// may use it and it has not ended
+func (p *SSHProxy) authorizeLease(ctx context.Context, session *ProxySession, leaseName string) (*v1alpha1.BuilderLease, error) {
+	var lease v1alpha1.BuilderLease
+	if err := p.k8sClient.Get(ctx, client.ObjectKey{Namespace: p.sessionNamespace(session), Name: leaseName}, &lease); err != nil {
+		log.Ctx(ctx).Info().Err(err).Str("lease", leaseName).Msg("Lease not found")
+		return nil, &builderUnavailableError{reason: fmt.Sprintf("lease %s not found", leaseName)}
+	}
+	if lease.Spec.Owner != session.Principal {
+		return nil, &Denial{Action: ActionUseLease, Code: "owner", Reason: "lease belongs to another user"}
+	}
+	req := authzRequest(session, ActionUseLease)
+	req.Namespace = p.sessionNamespace(session)
+	if err := p.authz.Authorize(ctx, req); err != nil {
+		return nil, err
+	}
+	if lease.Status.Phase == v1alpha1.LeasePhaseExpired || lease.Status.Phase == v1alpha1.LeasePhaseFailed {
+		return nil, &builderUnavailableError{reason: fmt.Sprintf("lease %s is %s", leaseName, strings.ToLower(string(lease.Status.Phase)))}
+	}
+	return &lease, nil
+}
+
+// channelRejection returns how to reject a channel refused by authorizeLease
+// or forwardTarget
+func (p *SSHProxy) channelRejection(session *ProxySession, err error) (ssh.RejectionReason, string) {
+	var unavailable *builderUnavailableError
+	if errors.As(err, &unavailable) {
+		return ssh.ConnectionFailed, errcode.Message(errcode.Builder, unavailable.reason)
+	}
+	return ssh.Prohibited, p.denialMessage(session, err)
+}
+
+// markLeaseActive records activity on a lease now and then periodically
+// until ctx ends
+func (p *SSHProxy) markLeaseActive(ctx context.Context, namespace, leaseName string) {
+	ticker := time.NewTicker(leaseActivityInterval)
+	defer ticker.Stop()
+
+	for {
+		lease := &v1alpha1.BuilderLease{}
+		lease.Namespace = namespace
+		lease.Name = leaseName
+		patch := fmt.Appendf(nil, `{"metadata":{"annotations":{%q:%q}}}`,
+			v1alpha1.LeaseActivityAnnotation, time.Now().UTC().Format(time.RFC3339))
+		if err := p.k8sClient.Patch(ctx, lease, client.RawPatch(types.MergePatchType, patch)); err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Str("lease", leaseName).Msg("Failed to record lease activity")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import "sync"
+
+const (
+	// DefaultMaxChannelsPerConn is the default limit on concurrently handled
+	// channels on a single client connection
+	DefaultMaxChannelsPerConn = 8
+	// DefaultMaxSessionGoroutines is the default limit on goroutines working
+	// on behalf of a single client connection
+	DefaultMaxSessionGoroutines = 64
+
+	// channelGoroutines is the number of goroutines handling a channel
+	// before it is routed to a builder
+	channelGoroutines = 1
+	// tunnelGoroutines is the number of goroutines a channel adds while it is
+	// tunnelled to a builder
+	tunnelGoroutines = 7
+)
+
+// sessionLimits bounds the channels and goroutines used by one client
+// connection. A limit of zero or less disables that bound.
+type sessionLimits struct {
+	mu            sync.Mutex
+	maxChannels   int
+	maxGoroutines int
+	channels      int
+	goroutines    int
+}
+
+func newSessionLimits(maxChannels, maxGoroutines int) *sessionLimits {
+	return &sessionLimits{maxChannels: maxChannels, maxGoroutines: maxGoroutines}
+}
+
+// acquireChannel reserves a channel slot and the goroutine that handles it
+func (l *sessionLimits) acquireChannel() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxChannels > 0 && l.channels >= l.maxChannels {
+		return false
+	}
+	if l.maxGoroutines > 0 && l.goroutines+channelGoroutines > l.maxGoroutines {
+		return false
+	}
+	l.channels++
+	l.goroutines += channelGoroutines
+	return true
+}
+
+func (l *sessionLimits) releaseChannel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.channels--
+	l.goroutines -= channelGoroutines
+}
+
+// acquireGoroutines reserves n goroutines, all or nothing
+func (l *sessionLimits) acquireGoroutines(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxGoroutines > 0 && l.goroutines+n > l.maxGoroutines {
+		return false
+	}
+	l.goroutines += n
+	return true
+}
+
+func (l *sessionLimits) releaseGoroutines(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.goroutines -= n
+}
+
+// openChannels returns the number of channels currently being handled
+func (l *sessionLimits) openChannels() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.channels
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apimetrics"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// metricsRegistry holds the proxy's metrics, served on the health server's
+// /metrics endpoint
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	cleanupFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nix_proxy_cleanup_failures_total",
+		Help: "Build requests the proxy could not delete after retries and handed to the controller for garbage collection",
+	})
+	sessionFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nix_proxy_session_failures_total",
+		Help: "Sessions that failed before reaching a builder, by error code",
+	}, []string{"code"})
+	auditFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nix_proxy_audit_failures_total",
+		Help: "Session audit records that could not be written to the audit sink",
+	})
+
+	// apiMetrics records the proxy's Kubernetes API usage
+	apiMetrics = apimetrics.New("nix_proxy")
+)
+
+// RegisterExportMetrics registers the proxy's metrics with one series of
+// each, so that their names, types and labels can be gathered to generate
+// dashboards and alerts
+func RegisterExportMetrics(reg prometheus.Registerer) error {
+	sessionFailures.WithLabelValues(string(errcode.Internal))
+	sessions := newSessionRegistry(0, 0)
+	sessions.evictions.WithLabelValues("capacity")
+	staticBuilderSessions.WithLabelValues("builder.example.com:22", staticReasonCapacity)
+	for _, c := range []prometheus.Collector{cleanupFailures, sessionFailures, auditFailures, connectionsRateLimited, staticBuilderSessions, sessions} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return apimetrics.New("nix_proxy").RegisterExport(reg)
+}
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		cleanupFailures,
+		sessionFailures,
+		auditFailures,
+		connectionsRateLimited,
+		staticBuilderSessions,
+		apiMetrics,
+	)
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// connBuilder is the builder shared by the session channels of one client
+// connection. OpenSSH clients multiplexing with ControlMaster run each nix
+// invocation as another channel on a long-lived connection, so the first
+// channel provisions the connection's build request and later ones reuse its
+// builder. The build request is completed once the connection and its last
+// channel have closed.
+type connBuilder struct {
+	mu sync.Mutex
+	// channels counts the session channels using the builder
+	channels  int
+	started   bool
+	connDone  bool
+	completed bool
+	// idle closes a connection left without channels for the idle timeout
+	idle *time.Timer
+
+	// ready is closed once provisioning has set podIP, clientKey or err
+	ready     chan struct{}
+	podIP     string
+	clientKey ssh.Signer
+	err       error
+
+	// succeeded and buildErr are the outcome of the last channel to finish,
+	// recorded on the build request when it is completed
+	succeeded bool
+	buildErr  error
+}
+
+// acquire adds a channel to the builder and reports whether the channel is
+// the first and must provision it
+func (b *connBuilder) acquire() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.channels++
+	if b.idle != nil {
+		b.idle.Stop()
+		b.idle = nil
+	}
+	if b.started {
+		return false
+	}
+	b.started = true
+	b.ready = make(chan struct{})
+	return true
+}
+
+// provisioned records the result of provisioning and wakes waiting channels
+func (b *connBuilder) provisioned(podIP string, clientKey ssh.Signer, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.podIP, b.clientKey, b.err = podIP, clientKey, err
+	close(b.ready)
+}
+
+// wait returns the builder once it has been provisioned
+func (b *connBuilder) wait(ctx context.Context) (string, ssh.Signer, error) {
+	b.mu.Lock()
+	ready := b.ready
+	b.mu.Unlock()
+
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return "", nil, context.Cause(ctx)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.podIP, b.clientKey, b.err
+}
+
+// release removes a channel from the builder, recording how it ended. It
+// reports whether the build request should now be completed and whether the
+// connection has no channels left.
+func (b *connBuilder) release(succeeded bool, buildErr error) (complete, unused bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.channels--
+	b.succeeded, b.buildErr = succeeded, buildErr
+	return b.completeLocked(), b.channels == 0
+}
+
+// closeConn marks the connection closed and reports whether the build
+// request should now be completed
+func (b *connBuilder) closeConn() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connDone = true
+	if b.idle != nil {
+		b.idle.Stop()
+	}
+	return b.completeLocked()
+}
+
+func (b *connBuilder) completeLocked() bool {
+	if !b.started || !b.connDone || b.channels > 0 || b.completed {
+		return false
+	}
+	b.completed = true
+	return true
+}
+
+// failed reports whether provisioning the builder failed
+func (b *connBuilder) failed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err != nil
+}
+
+// closeWhenIdle closes conn once the builder has gone without channels for
+// timeout, so a multiplexing client left idle does not hold its builder
+func (b *connBuilder) closeWhenIdle(conn ssh.Conn, sessionID string, timeout time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.channels > 0 || b.connDone {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		b.mu.Lock()
+		idle := b.idle == timer && b.channels == 0
+		b.mu.Unlock()
+		if idle {
+			log.Info().Str("session_id", sessionID).Dur("idle_timeout", timeout).Msg("Closing connection with no open channels")
+			conn.Close()
+		}
+	})
+	b.idle = timer
+}
+
+// releaseBuilder removes a finished channel from its connection's builder.
+// A connection whose builder could not be provisioned is closed once its
+// channels are gone, so the client's next attempt starts afresh.
+func (p *SSHProxy) releaseBuilder(session *ProxySession, succeeded bool, buildErr error) {
+	complete, unused := session.builder.release(succeeded, buildErr)
+	if complete {
+		p.completeConnBuilder(session)
+		return
+	}
+	if !unused {
+		return
+	}
+	if session.builder.failed() {
+		session.SSHConn.Close()
+	} else if timeout := p.currentSettings().IdleTimeout; timeout > 0 {
+		session.builder.closeWhenIdle(session.SSHConn, session.ID, timeout)
+	}
+}
+
+// completeConnBuilder completes the connection's build request with the
+// outcome of its last channel. With builder reuse on, the builder of a
+// connection that succeeded is kept for the client's next one instead.
+func (p *SSHProxy) completeConnBuilder(session *ProxySession) {
+	b := &session.builder
+	b.mu.Lock()
+	succeeded, buildErr := b.succeeded, b.buildErr
+	b.mu.Unlock()
+
+	var buildReq, podIP string
+	var clientKey ssh.Signer
+	p.sessions.update(session, func() {
+		buildReq, podIP, clientKey = session.buildRequest, session.builderIP, session.builderKey
+		session.builderIP = ""
+		session.builderKey = nil
+	})
+	if buildReq == "" {
+		buildReq = fmt.Sprintf("build-%s", session.ID)
+	}
+	if succeeded && p.parkBuilder(session, buildReq, podIP, clientKey) {
+		return
+	}
+	p.completeBuildRequest(session.ID, p.sessionNamespace(session), buildReq, succeeded, buildErr)
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// TestConnBuilderControlPersist follows an OpenSSH ControlMaster connection
+// as nix uses it with ControlPersist: overlapping channels, a gap with no
+// channels, and a later invocation, all on one builder
+func TestConnBuilderControlPersist(t *testing.T) {
+	var b connBuilder
+	ctx := context.Background()
+
+	if !b.acquire() {
+		t.Fatal("first channel did not provision the builder")
+	}
+	if b.acquire() {
+		t.Fatal("second channel provisioned another builder")
+	}
+	b.provisioned("10.0.0.7", nil, nil)
+	for range 2 {
+		if podIP, _, err := b.wait(ctx); err != nil || podIP != "10.0.0.7" {
+			t.Fatalf("wait() = %q, %v; want the shared builder", podIP, err)
+		}
+	}
+
+	if complete, unused := b.release(true, nil); complete || unused {
+		t.Fatalf("release() with a channel still open = %v, %v", complete, unused)
+	}
+	if complete, unused := b.release(true, nil); complete || !unused {
+		t.Fatalf("release() of the last channel = %v, %v; want the builder kept for the connection", complete, unused)
+	}
+
+	if b.acquire() {
+		t.Fatal("channel after a gap provisioned another builder")
+	}
+	if podIP, _, _ := b.wait(ctx); podIP != "10.0.0.7" {
+		t.Fatalf("wait() after a gap = %q, want the shared builder", podIP)
+	}
+	if b.closeConn() {
+		t.Fatal("build request completed while a channel was still open")
+	}
+	if complete, _ := b.release(false, errClientDisconnected); !complete {
+		t.Fatal("build request not completed after the connection and its last channel closed")
+	}
+	if !errors.Is(b.buildErr, errClientDisconnected) {
+		t.Fatalf("recorded outcome %v, want the last channel's", b.buildErr)
+	}
+	if b.closeConn() {
+		t.Fatal("build request completed twice")
+	}
+}
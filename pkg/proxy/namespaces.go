@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// NamespaceRule places the build requests of principals matching Principal,
+// a pattern in which '*' matches any characters, in Namespace
+type NamespaceRule struct {
+	Principal string
+	Namespace string
+}
+
+// ParseNamespaceRule reads a rule written as principal=namespace, such as
+// *@team-a.example.com=team-a
+func ParseNamespaceRule(s string) (NamespaceRule, error) {
+	principal, namespace, ok := strings.Cut(s, "=")
+	if !ok || principal == "" {
+		return NamespaceRule{}, fmt.Errorf("namespace rule %q must be principal=namespace", s)
+	}
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return NamespaceRule{}, fmt.Errorf("namespace rule %q names an invalid namespace: %s", s, strings.Join(errs, ", "))
+	}
+	return NamespaceRule{Principal: principal, Namespace: namespace}, nil
+}
+
+// namespaceFor returns the namespace of a principal's build requests, that
+// of the first rule matching it or else the proxy's own
+func (p *SSHProxy) namespaceFor(principal string) string {
+	for _, rule := range p.namespaceRules {
+		if globMatch(rule.Principal, principal) {
+			return rule.Namespace
+		}
+	}
+	return p.namespace
+}
+
+// sessionNamespace returns the namespace of a session's build requests
+func (p *SSHProxy) sessionNamespace(session *ProxySession) string {
+	if session.Namespace != "" {
+		return session.Namespace
+	}
+	return p.namespace
+}
+
+// servedNamespaces returns every namespace the proxy creates build requests
+// in: its own and those its rules name
+func servedNamespaces(namespace string, rules []NamespaceRule) []string {
+	namespaces := []string{namespace}
+	for _, rule := range rules {
+		if !slices.Contains(namespaces, rule.Namespace) {
+			namespaces = append(namespaces, rule.Namespace)
+		}
+	}
+	return namespaces
+}
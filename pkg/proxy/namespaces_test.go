@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNamespaceFor(t *testing.T) {
+	var rules []NamespaceRule
+	for _, s := range []string{"ci-*=ci", "*@team-a.example.com=team-a", "*@example.com=shared"} {
+		rule, err := ParseNamespaceRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	p := &SSHProxy{namespace: "nix-builds", namespaceRules: rules}
+
+	for principal, want := range map[string]string{
+		"ci-runner-1":              "ci",
+		"alice@team-a.example.com": "team-a",
+		"bob@example.com":          "shared",
+		"carol@elsewhere.org":      "nix-builds",
+	} {
+		if got := p.namespaceFor(principal); got != want {
+			t.Errorf("namespaceFor(%q) = %q, want %q", principal, got, want)
+		}
+	}
+
+	if got := servedNamespaces(p.namespace, rules); !slices.Equal(got, []string{"nix-builds", "ci", "team-a", "shared"}) {
+		t.Errorf("servedNamespaces = %v", got)
+	}
+	if got := p.sessionNamespace(&ProxySession{}); got != "nix-builds" {
+		t.Errorf("session without a namespace is in %q, want the proxy's", got)
+	}
+}
+
+func TestParseNamespaceRuleRejectsInvalid(t *testing.T) {
+	for _, s := range []string{"team-a", "=team-a", "ci-*=Team_A", "ci-*="} {
+		if _, err := ParseNamespaceRule(s); err == nil {
+			t.Errorf("ParseNamespaceRule(%q) succeeded", s)
+		}
+	}
+}
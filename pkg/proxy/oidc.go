@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultOIDCUsernameClaim is the ID token claim used as the principal
+	DefaultOIDCUsernameClaim = "sub"
+
+	// jwksRefreshInterval is the minimum time between JWKS fetches, which
+	// also happen when a token is signed by an unknown key
+	jwksRefreshInterval = 5 * time.Minute
+	// oidcClockSkew is tolerated when checking token lifetimes
+	oidcClockSkew = time.Minute
+)
+
+// oidcAuth exchanges an OIDC ID token, sent as the SSH password, for the
+// identity in its username claim
+type oidcAuth struct {
+	issuer        string
+	audience      string
+	usernameClaim string
+	httpClient    *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// fetches lets concurrent logins signed by an unknown key share one
+	// JWKS fetch
+	fetches singleflight.Group
+}
+
+func newOIDCAuth(issuer, audience, usernameClaim string) *oidcAuth {
+	if usernameClaim == "" {
+		usernameClaim = DefaultOIDCUsernameClaim
+	}
+	return &oidcAuth{
+		issuer:        strings.TrimSuffix(issuer, "/"),
+		audience:      audience,
+		usernameClaim: usernameClaim,
+		httpClient:    &http.Client{Timeout: authTimeout},
+	}
+}
+
+func (a *oidcAuth) Name() string { return AuthOIDC }
+
+func (a *oidcAuth) Authenticate(ctx context.Context, conn ssh.ConnMetadata, cred Credential) (string, error) {
+	if cred.Kind != CredentialToken {
+		return "", ErrAuthUnsupported
+	}
+
+	claims, err := a.verify(ctx, cred.Token)
+	if err != nil {
+		return "", err
+	}
+
+	username, ok := claims[a.usernameClaim].(string)
+	if !ok || username == "" {
+		return "", fmt.Errorf("token missing claim %q", a.usernameClaim)
+	}
+	return username, nil
+}
+
+// verify checks the token's signature, issuer, audience and lifetime and
+// returns its claims
+func (a *oidcAuth) verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("failed to decode token header: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token signature: %w", err)
+	}
+
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, digest[:], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("failed to decode token claims: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != a.issuer {
+		return nil, fmt.Errorf("unexpected token issuer %q", iss)
+	}
+	if !audienceContains(claims["aud"], a.audience) {
+		return nil, fmt.Errorf("token not issued for audience %q", a.audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func audienceContains(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key crypto.PublicKey, digest, signature []byte) error {
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type does not match algorithm %s", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature); err != nil {
+			return fmt.Errorf("invalid token signature: %w", err)
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return fmt.Errorf("key type does not match algorithm %s", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	return nil
+}
+
+// key returns the issuer's signing key with the given ID, refetching the
+// JWKS when the key is unknown. The fetch runs without holding the lock, so
+// logins signed by known keys carry on while the issuer is slow.
+func (a *oidcAuth) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	key, ok := a.keys[kid]
+	fresh := a.keys != nil && time.Since(a.fetchedAt) < jwksRefreshInterval
+	a.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if fresh {
+		return nil, fmt.Errorf("unknown token signing key %q", kid)
+	}
+
+	// The shared fetch outlives a login that gives up on it, bounded by
+	// the HTTP client's timeout
+	result, err, _ := a.fetches.Do("jwks", func() (any, error) {
+		keys, err := a.fetchKeys(context.WithoutCancel(ctx))
+		if err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		a.keys = keys
+		a.fetchedAt = time.Now()
+		a.mu.Unlock()
+		return keys, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok = result.(map[string]crypto.PublicKey)[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown token signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys discovers the issuer's JWKS endpoint and reads its keys
+func (a *oidcAuth) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := a.getJSON(ctx, a.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC configuration: %w", err)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := a.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func (a *oidcAuth) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
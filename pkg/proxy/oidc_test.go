@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIssuer serves an OIDC discovery document and a JWKS holding one RSA
+// key, and signs tokens with it
+type testIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// jwks is closed to let JWKS requests through
+	jwks chan struct{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key, jwks: make(chan struct{})}
+	close(issuer.jwks)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.server.URL, "jwks_uri": issuer.server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		<-issuer.jwks
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// claims returns valid claims for the test audience
+func (i *testIssuer) claims() map[string]any {
+	return map[string]any{
+		"iss": i.server.URL,
+		"aud": "nix-builders",
+		"sub": "alice",
+		"exp": float64(time.Now().Add(time.Hour).Unix()),
+	}
+}
+
+// sign encodes a token with the given header and claims, signed with the
+// issuer's key for RS256, the JWKS modulus as an HMAC secret for HS256 and
+// nothing otherwise
+func (i *testIssuer) sign(t *testing.T, header, claims map[string]any) string {
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch header["alg"] {
+	case "RS256":
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "HS256":
+		mac := hmac.New(sha256.New, i.key.N.Bytes())
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCAuthVerify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	rs256 := map[string]any{"alg": "RS256", "kid": "key-1"}
+
+	for _, tc := range []struct {
+		name   string
+		token  func() string
+		errMsg string
+	}{
+		{
+			name:  "valid",
+			token: func() string { return issuer.sign(t, rs256, issuer.claims()) },
+		},
+		{
+			name: "bad signature",
+			token: func() string {
+				token := issuer.sign(t, rs256, issuer.claims())
+				other := issuer.claims()
+				other["sub"] = "mallory"
+				forged := issuer.sign(t, rs256, other)
+				parts, forgedParts := strings.Split(token, "."), strings.Split(forged, ".")
+				return parts[0] + "." + forgedParts[1] + "." + parts[2]
+			},
+			errMsg: "invalid token signature",
+		},
+		{
+			name:   "alg none",
+			token:  func() string { return issuer.sign(t, map[string]any{"alg": "none", "kid": "key-1"}, issuer.claims()) },
+			errMsg: `unsupported token algorithm "none"`,
+		},
+		{
+			name:   "HS256 keyed with the public key",
+			token:  func() string { return issuer.sign(t, map[string]any{"alg": "HS256", "kid": "key-1"}, issuer.claims()) },
+			errMsg: `unsupported token algorithm "HS256"`,
+		},
+		{
+			name: "wrong issuer",
+			token: func() string {
+				claims := issuer.claims()
+				claims["iss"] = "https://evil.example.com"
+				return issuer.sign(t, rs256, claims)
+			},
+			errMsg: "unexpected token issuer",
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				claims := issuer.claims()
+				claims["aud"] = []any{"other-app"}
+				return issuer.sign(t, rs256, claims)
+			},
+			errMsg: "not issued for audience",
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := issuer.claims()
+				claims["exp"] = float64(time.Now().Add(-2 * oidcClockSkew).Unix())
+				return issuer.sign(t, rs256, claims)
+			},
+			errMsg: "token expired",
+		},
+		{
+			name:   "unknown key",
+			token:  func() string { return issuer.sign(t, map[string]any{"alg": "RS256", "kid": "key-2"}, issuer.claims()) },
+			errMsg: `unknown token signing key "key-2"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			auth := newOIDCAuth(issuer.server.URL, "nix-builders", "")
+			principal, err := auth.Authenticate(context.Background(), nil, Credential{Kind: CredentialToken, Token: tc.token()})
+			if tc.errMsg == "" {
+				if err != nil || principal != "alice" {
+					t.Fatalf("Authenticate = %q, %v, want alice", principal, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Fatalf("Authenticate = %q, %v, want an error containing %q", principal, err, tc.errMsg)
+			}
+		})
+	}
+}
+
+func TestOIDCAuthFetchesKeysWithoutBlockingLogins(t *testing.T) {
+	issuer := newTestIssuer(t)
+	auth := newOIDCAuth(issuer.server.URL, "nix-builders", "")
+	valid := issuer.sign(t, map[string]any{"alg": "RS256", "kid": "key-1"}, issuer.claims())
+	if _, err := auth.Authenticate(context.Background(), nil, Credential{Kind: CredentialToken, Token: valid}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A token signed by an unknown key refetches the JWKS once the refresh
+	// interval passed, and the issuer hangs
+	auth.mu.Lock()
+	auth.fetchedAt = time.Now().Add(-2 * jwksRefreshInterval)
+	auth.mu.Unlock()
+	issuer.jwks = make(chan struct{})
+	unknown := issuer.sign(t, map[string]any{"alg": "RS256", "kid": "key-2"}, issuer.claims())
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := auth.Authenticate(context.Background(), nil, Credential{Kind: CredentialToken, Token: unknown})
+		fetched <- err
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := auth.Authenticate(context.Background(), nil, Credential{Kind: CredentialToken, Token: valid})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("login with a known key failed during the fetch: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("login with a known key waited for the JWKS fetch")
+	}
+
+	close(issuer.jwks)
+	if err := <-fetched; err == nil || !strings.Contains(err.Error(), "key-2") {
+		t.Errorf("token with an unknown key = %v", err)
+	}
+}
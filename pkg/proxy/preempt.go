@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// reprovisionTimeout bounds waiting for the controller to clean up a
+// preempted build request before it is replaced
+const reprovisionTimeout = time.Minute
+
+// reprovisionBuildRequest replaces a session's build request after its
+// best-effort builder was preempted. The old request is deleted and, once
+// the controller has cleaned up its pod, created again under the same name.
+func (p *SSHProxy) reprovisionBuildRequest(ctx context.Context, session *ProxySession, buildReq *v1alpha1.NixBuildRequest) error {
+	ctx, cancel := context.WithTimeoutCause(ctx, reprovisionTimeout, errcode.Errorf(errcode.Timeout, "timeout waiting for preempted build request to be cleaned up"))
+	defer cancel()
+
+	events, stop := p.builds.watch(buildReq.Name)
+	defer stop()
+
+	if err := p.k8sClient.Delete(ctx, buildReq); client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to delete preempted build request: %w", err)
+	}
+
+	var existing v1alpha1.NixBuildRequest
+	gone := p.builds.get(ctx, client.ObjectKeyFromObject(buildReq), &existing) != nil
+	for !gone {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case event := <-events:
+			gone = event.BuildRequest == nil
+		}
+	}
+
+	replacement := &v1alpha1.NixBuildRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        buildReq.Name,
+			Namespace:   buildReq.Namespace,
+			Labels:      buildReq.Labels,
+			Annotations: buildReq.Annotations,
+		},
+		Spec: buildReq.Spec,
+	}
+	if err := p.createBuildRequest(ctx, session, replacement); err != nil {
+		return err
+	}
+	log.Ctx(ctx).Info().Msg("Replaced build request of preempted builder")
+	*buildReq = *replacement
+	return nil
+}
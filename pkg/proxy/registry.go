@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultMaxSessions is the default number of sessions the registry holds
+	DefaultMaxSessions = 1000
+	// DefaultSessionMaxAge is the default age after which a session is
+	// considered leaked and may be evicted
+	DefaultSessionMaxAge = 24 * time.Hour
+
+	// sessionSweepInterval is how often leaked sessions are evicted
+	sessionSweepInterval = time.Minute
+
+	// sessionBaseBytes approximates the memory held by an idle connection:
+	// the SSH transport, its buffers and the session bookkeeping
+	sessionBaseBytes = 64 << 10
+	// channelBytes approximates the memory held by each open channel, which
+	// is dominated by the channel's receive window
+	channelBytes = 2 << 20
+)
+
+// errRegistryFull is returned when no more sessions can be registered
+var errRegistryFull = errors.New("session registry is full")
+
+// errSessionEvicted is the cause recorded on sessions that were forcibly
+// removed from the registry
+var errSessionEvicted = errors.New("session evicted")
+
+// sessionAgeBuckets covers sessions from a few seconds up to a day
+var sessionAgeBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600, 24 * 3600}
+
+// sessionRegistry tracks live sessions. It holds at most max sessions and
+// evicts the least recently active leaked session to make room for new ones.
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*ProxySession
+	max      int
+	maxAge   time.Duration
+	now      func() time.Time
+
+	evictions *prometheus.CounterVec
+	rejected  prometheus.Counter
+
+	countDesc  *prometheus.Desc
+	ageDesc    *prometheus.Desc
+	memoryDesc *prometheus.Desc
+}
+
+func newSessionRegistry(max int, maxAge time.Duration) *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]*ProxySession),
+		max:      max,
+		maxAge:   maxAge,
+		now:      time.Now,
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nix_proxy_session_evictions_total",
+			Help: "Sessions forcibly removed from the registry by reason",
+		}, []string{"reason"}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nix_proxy_sessions_rejected_total",
+			Help: "Connections refused because the session registry was full",
+		}),
+		countDesc: prometheus.NewDesc("nix_proxy_sessions",
+			"Sessions currently in the registry by status", []string{"status"}, nil),
+		ageDesc: prometheus.NewDesc("nix_proxy_session_age_seconds",
+			"Age of the sessions currently in the registry", nil, nil),
+		memoryDesc: prometheus.NewDesc("nix_proxy_session_memory_estimate_bytes",
+			"Estimated memory held by the sessions currently in the registry", nil, nil),
+	}
+}
+
+// add registers a session, evicting a leaked session if the registry is full
+func (r *sessionRegistry) add(session *ProxySession) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	session.CreatedAt = now
+	session.LastActive = now
+
+	if r.max > 0 && len(r.sessions) >= r.max {
+		victim := r.leastRecentlyActiveLocked(func(s *ProxySession) bool { return r.leakedLocked(s, now) })
+		if victim == nil {
+			r.rejected.Inc()
+			return errRegistryFull
+		}
+		r.evictLocked(victim, "capacity")
+	}
+
+	r.sessions[session.ID] = session
+	return nil
+}
+
+// full reports whether add would refuse a session, because the registry
+// holds its maximum and none of its sessions is leaked
+func (r *sessionRegistry) full() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.max <= 0 || len(r.sessions) < r.max {
+		return false
+	}
+	now := r.now()
+	return r.leastRecentlyActiveLocked(func(s *ProxySession) bool { return r.leakedLocked(s, now) }) == nil
+}
+
+// remove unregisters a session if it is still registered
+func (r *sessionRegistry) remove(session *ProxySession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[session.ID] == session {
+		delete(r.sessions, session.ID)
+	}
+}
+
+func (r *sessionRegistry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+// list returns a snapshot of the registered sessions, oldest first
+func (r *sessionRegistry) list() []SessionInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := r.now()
+	infos := make([]SessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		infos = append(infos, SessionInfo{
+			ID:             s.ID,
+			Status:         s.Status.String(),
+			Namespace:      s.Namespace,
+			BuilderPod:     s.BuilderPod,
+			StaticBuilder:  s.StaticBuilder,
+			ClientAddr:     s.SSHConn.RemoteAddr().String(),
+			CreatedAt:      s.CreatedAt,
+			LastActive:     lastActive(s),
+			AgeSeconds:     now.Sub(s.CreatedAt).Seconds(),
+			Channels:       s.limits.openChannels(),
+			MemoryEstimate: estimateSessionMemory(s),
+		})
+	}
+	slices.SortFunc(infos, func(a, b SessionInfo) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return infos
+}
+
+// forEach calls fn for every registered session while holding the lock
+func (r *sessionRegistry) forEach(fn func(*ProxySession)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		fn(s)
+	}
+}
+
+// update runs fn on a session under the registry lock and marks it active
+func (r *sessionRegistry) update(session *ProxySession, fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn()
+	session.LastActive = r.now()
+}
+
+// evict forcibly removes a session by ID, returning false if it is unknown
+func (r *sessionRegistry) evict(id, reason string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session, ok := r.sessions[id]
+	if !ok {
+		return false
+	}
+	r.evictLocked(session, reason)
+	return true
+}
+
+// sweep evicts every leaked session and returns how many were removed
+func (r *sessionRegistry) sweep() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	count := 0
+	for _, s := range r.sessions {
+		if r.leakedLocked(s, now) {
+			r.evictLocked(s, "leaked")
+			count++
+		}
+	}
+	return count
+}
+
+// leakedLocked reports whether a session outlived its connection or the
+// registry's maximum age
+func (r *sessionRegistry) leakedLocked(s *ProxySession, now time.Time) bool {
+	if s.closed.Load() {
+		return true
+	}
+	return r.maxAge > 0 && now.Sub(s.CreatedAt) > r.maxAge
+}
+
+func (r *sessionRegistry) leastRecentlyActiveLocked(match func(*ProxySession) bool) *ProxySession {
+	var victim *ProxySession
+	for _, s := range r.sessions {
+		if !match(s) {
+			continue
+		}
+		if victim == nil || s.LastActive.Before(victim.LastActive) {
+			victim = s
+		}
+	}
+	return victim
+}
+
+func (r *sessionRegistry) evictLocked(session *ProxySession, reason string) {
+	delete(r.sessions, session.ID)
+	r.evictions.WithLabelValues(reason).Inc()
+	session.cancel(errSessionEvicted)
+	session.SSHConn.Close()
+	log.Warn().Str("session_id", session.ID).Str("reason", reason).Msg("Evicted session from registry")
+}
+
+// lastActive returns when a session last changed state or carried data
+func lastActive(s *ProxySession) time.Time {
+	if data := s.lastData.Load(); data != 0 && time.Unix(0, data).After(s.LastActive) {
+		return time.Unix(0, data)
+	}
+	return s.LastActive
+}
+
+// estimateSessionMemory approximates the memory a session holds
+func estimateSessionMemory(s *ProxySession) int64 {
+	return sessionBaseBytes + int64(s.limits.openChannels())*channelBytes
+}
+
+// Describe implements prometheus.Collector
+func (r *sessionRegistry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.countDesc
+	ch <- r.ageDesc
+	ch <- r.memoryDesc
+	r.evictions.Describe(ch)
+	r.rejected.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (r *sessionRegistry) Collect(ch chan<- prometheus.Metric) {
+	r.mu.RLock()
+	now := r.now()
+	counts := make(map[SessionStatus]int)
+	buckets := make(map[float64]uint64, len(sessionAgeBuckets))
+	var ageSum float64
+	var memory int64
+	for _, s := range r.sessions {
+		counts[s.Status]++
+		age := now.Sub(s.CreatedAt).Seconds()
+		ageSum += age
+		for _, b := range sessionAgeBuckets {
+			if age <= b {
+				buckets[b]++
+			}
+		}
+		memory += estimateSessionMemory(s)
+	}
+	total := uint64(len(r.sessions))
+	r.mu.RUnlock()
+
+	for _, status := range []SessionStatus{SessionPending, SessionConnected, SessionClosed} {
+		ch <- prometheus.MustNewConstMetric(r.countDesc, prometheus.GaugeValue, float64(counts[status]), status.String())
+	}
+	ch <- prometheus.MustNewConstHistogram(r.ageDesc, total, ageSum, buckets)
+	ch <- prometheus.MustNewConstMetric(r.memoryDesc, prometheus.GaugeValue, float64(memory))
+	r.evictions.Collect(ch)
+	r.rejected.Collect(ch)
+}
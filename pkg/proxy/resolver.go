@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+const (
+	// ResolverPodIP dials builders at their pod IP, which needs a route from
+	// the proxy to the pod network
+	ResolverPodIP = "pod-ip"
+	// ResolverServiceDNS dials builders by their DNS name under a headless
+	// Service, <pod>.<service>.<namespace>.svc.<cluster domain>
+	ResolverServiceDNS = "service-dns"
+	// ResolverExternal dials builders at a host built from a template, such
+	// as a per-builder DNS name on a load balancer or gateway
+	ResolverExternal = "external"
+	// ResolverPortForward tunnels to builders through the API server's
+	// pods/portforward subresource, for proxies outside the pod network
+	ResolverPortForward = "port-forward"
+
+	// DefaultClusterDomain is the DNS domain of Service names in most
+	// clusters
+	DefaultClusterDomain = "cluster.local"
+
+	// builderContainer is the container of a builder pod running sshd
+	builderContainer = "nix-builder"
+)
+
+// BuilderTarget identifies the builder pod a connection is for
+type BuilderTarget struct {
+	Pod       string
+	Namespace string
+	IP        string
+}
+
+// Resolver connects the proxy to builder pods. Deployments pick the one
+// matching how the proxy can reach builders, so routing does not depend on
+// raw pod IPs being reachable.
+type Resolver interface {
+	// Name identifies the resolver in logs
+	Name() string
+	// Address describes where port on a builder is reached, for logs and
+	// traces
+	Address(builder BuilderTarget, port int32) string
+	// Dial opens a connection to port on a builder
+	Dial(ctx context.Context, builder BuilderTarget, port int32) (net.Conn, error)
+}
+
+// ResolverConfig selects and configures the proxy's Resolver
+type ResolverConfig struct {
+	// Mode is one of the Resolver* constants; empty is ResolverPodIP
+	Mode string
+
+	// Service is the headless Service builder pods are a subdomain of, and
+	// ClusterDomain the cluster's DNS domain, for ResolverServiceDNS
+	Service       string
+	ClusterDomain string
+
+	// ExternalHost is the host template for ResolverExternal, in which
+	// {pod}, {namespace} and {ip} are replaced by the builder's. A non-zero
+	// ExternalPort replaces the builder's port.
+	ExternalHost string
+	ExternalPort int32
+}
+
+// newResolver builds the Resolver cfg selects. restConfig reaches the API
+// server for ResolverPortForward.
+func newResolver(cfg ResolverConfig, restConfig *rest.Config) (Resolver, error) {
+	switch cfg.Mode {
+	case "", ResolverPodIP:
+		return podIPResolver{}, nil
+	case ResolverServiceDNS:
+		if cfg.Service == "" {
+			return nil, fmt.Errorf("resolver %q requires a builder service", cfg.Mode)
+		}
+		domain := cfg.ClusterDomain
+		if domain == "" {
+			domain = DefaultClusterDomain
+		}
+		return serviceDNSResolver{service: cfg.Service, domain: domain}, nil
+	case ResolverExternal:
+		if cfg.ExternalHost == "" {
+			return nil, fmt.Errorf("resolver %q requires an external host", cfg.Mode)
+		}
+		return externalResolver{host: cfg.ExternalHost, port: cfg.ExternalPort}, nil
+	case ResolverPortForward:
+		return newPortForwardResolver(restConfig)
+	default:
+		return nil, fmt.Errorf("unknown builder resolver %q", cfg.Mode)
+	}
+}
+
+// dialTCP opens a TCP connection to addr
+func dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+type podIPResolver struct{}
+
+func (podIPResolver) Name() string { return ResolverPodIP }
+
+func (podIPResolver) Address(builder BuilderTarget, port int32) string {
+	return net.JoinHostPort(builder.IP, strconv.Itoa(int(port)))
+}
+
+func (r podIPResolver) Dial(ctx context.Context, builder BuilderTarget, port int32) (net.Conn, error) {
+	return dialTCP(ctx, r.Address(builder, port))
+}
+
+type serviceDNSResolver struct {
+	service string
+	domain  string
+}
+
+func (serviceDNSResolver) Name() string { return ResolverServiceDNS }
+
+func (r serviceDNSResolver) Address(builder BuilderTarget, port int32) string {
+	host := fmt.Sprintf("%s.%s.%s.svc.%s", builder.Pod, r.service, builder.Namespace, r.domain)
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+func (r serviceDNSResolver) Dial(ctx context.Context, builder BuilderTarget, port int32) (net.Conn, error) {
+	return dialTCP(ctx, r.Address(builder, port))
+}
+
+type externalResolver struct {
+	host string
+	port int32
+}
+
+func (externalResolver) Name() string { return ResolverExternal }
+
+func (r externalResolver) Address(builder BuilderTarget, port int32) string {
+	host := strings.NewReplacer("{pod}", builder.Pod, "{namespace}", builder.Namespace, "{ip}", builder.IP).Replace(r.host)
+	if r.port != 0 {
+		port = r.port
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+func (r externalResolver) Dial(ctx context.Context, builder BuilderTarget, port int32) (net.Conn, error) {
+	return dialTCP(ctx, r.Address(builder, port))
+}
+
+// portForwardResolver opens one port forward through the API server for
+// each connection, as kubectl port-forward does for each local connection.
+// Forwards are tunneled over WebSockets, which load balancers and proxies in
+// front of the API server pass more reliably, falling back to SPDY for API
+// servers that do not support it.
+type portForwardResolver struct {
+	config    *rest.Config
+	host      *url.URL
+	transport http.RoundTripper
+	upgrader  spdy.Upgrader
+}
+
+func newPortForwardResolver(restConfig *rest.Config) (*portForwardResolver, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create port forward transport: %w", err)
+	}
+	host, err := url.Parse(restConfig.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse API server URL: %w", err)
+	}
+	return &portForwardResolver{config: restConfig, host: host, transport: transport, upgrader: upgrader}, nil
+}
+
+func (*portForwardResolver) Name() string { return ResolverPortForward }
+
+func (*portForwardResolver) Address(builder BuilderTarget, port int32) string {
+	return fmt.Sprintf("portforward://%s/%s:%d", builder.Namespace, builder.Pod, port)
+}
+
+func (r *portForwardResolver) Dial(ctx context.Context, builder BuilderTarget, port int32) (net.Conn, error) {
+	forwardURL := *r.host
+	forwardURL.Path = path.Join(forwardURL.Path, "/api/v1/namespaces", builder.Namespace, "pods", builder.Pod, "portforward")
+	spdyDialer := spdy.NewDialer(r.upgrader, &http.Client{Transport: r.transport}, http.MethodPost, &forwardURL)
+	websocketDialer, err := portforward.NewSPDYOverWebsocketDialer(&forwardURL, r.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create port forward dialer: %w", err)
+	}
+	dialer := portforward.NewFallbackDialer(websocketDialer, spdyDialer, func(err error) bool {
+		return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+	})
+
+	type result struct {
+		conn httpstream.Connection
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+		done <- result{conn, err}
+	}()
+	var streamConn httpstream.Connection
+	select {
+	case <-ctx.Done():
+		// The upgrade has no context, so a late connection is closed once
+		// it arrives
+		go func() {
+			if res := <-done; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			return nil, fmt.Errorf("failed to open port forward to %s/%s: %w", builder.Namespace, builder.Pod, res.err)
+		}
+		streamConn = res.conn
+	}
+
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.Itoa(int(port)))
+	headers.Set(corev1.PortForwardRequestIDHeader, "0")
+	errorStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		streamConn.Close()
+		return nil, fmt.Errorf("failed to create port forward error stream: %w", err)
+	}
+	// Only the kubelet writes to the error stream
+	errorStream.Close()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		streamConn.Close()
+		return nil, fmt.Errorf("failed to create port forward data stream: %w", err)
+	}
+
+	conn := &portForwardConn{
+		conn:   streamConn,
+		stream: dataStream,
+		local:  portForwardAddr("proxy"),
+		remote: portForwardAddr(r.Address(builder, port)),
+	}
+	go conn.watchErrors(errorStream)
+	return conn, nil
+}
+
+// portForwardAddr is the net.Addr of either end of a port forward
+type portForwardAddr string
+
+func (a portForwardAddr) Network() string { return "portforward" }
+func (a portForwardAddr) String() string  { return string(a) }
+
+// portForwardConn is a net.Conn over the data stream of a port forward.
+// Deadlines are not supported; the SSH layer above bounds its waits itself.
+type portForwardConn struct {
+	conn   httpstream.Connection
+	stream httpstream.Stream
+	local  net.Addr
+	remote net.Addr
+
+	mu sync.Mutex
+	// err is the error the kubelet reported for the forward, if any
+	err error
+}
+
+// watchErrors records an error the kubelet reports, such as nothing
+// listening on the port, and closes the connection
+func (c *portForwardConn) watchErrors(errorStream httpstream.Stream) {
+	message, err := io.ReadAll(errorStream)
+	if err != nil || len(message) == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.err = fmt.Errorf("port forward to %s failed: %s", c.remote, message)
+	c.mu.Unlock()
+	c.Close()
+}
+
+// forwardErr returns the kubelet's error in place of err, when there is one
+func (c *portForwardConn) forwardErr(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil && err != nil && !errors.Is(err, io.EOF) {
+		return c.err
+	}
+	return err
+}
+
+func (c *portForwardConn) Read(b []byte) (int, error) {
+	n, err := c.stream.Read(b)
+	return n, c.forwardErr(err)
+}
+
+func (c *portForwardConn) Write(b []byte) (int, error) {
+	n, err := c.stream.Write(b)
+	return n, c.forwardErr(err)
+}
+
+func (c *portForwardConn) Close() error {
+	c.stream.Reset()
+	return c.conn.Close()
+}
+
+func (c *portForwardConn) LocalAddr() net.Addr              { return c.local }
+func (c *portForwardConn) RemoteAddr() net.Addr             { return c.remote }
+func (c *portForwardConn) SetDeadline(time.Time) error      { return nil }
+func (c *portForwardConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *portForwardConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+)
+
+func TestResolverAddresses(t *testing.T) {
+	builder := BuilderTarget{Pod: "nix-builder-abc", Namespace: "builds", IP: "10.0.0.7"}
+	tests := []struct {
+		cfg  ResolverConfig
+		want string
+	}{
+		{ResolverConfig{}, "10.0.0.7:22"},
+		{ResolverConfig{Mode: ResolverServiceDNS, Service: "nix-builders"}, "nix-builder-abc.nix-builders.builds.svc.cluster.local:22"},
+		{ResolverConfig{Mode: ResolverExternal, ExternalHost: "{pod}.{namespace}.builders.example.com", ExternalPort: 2222}, "nix-builder-abc.builds.builders.example.com:2222"},
+	}
+	for _, tt := range tests {
+		resolver, err := newResolver(tt.cfg, nil)
+		if err != nil {
+			t.Fatalf("newResolver(%+v): %v", tt.cfg, err)
+		}
+		if got := resolver.Address(builder, 22); got != tt.want {
+			t.Errorf("%s address = %q, want %q", resolver.Name(), got, tt.want)
+		}
+	}
+
+	if _, err := newResolver(ResolverConfig{Mode: ResolverServiceDNS}, nil); err == nil {
+		t.Error("service-dns resolver without a service was accepted")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	conn, err := podIPResolver{}.Dial(context.Background(), BuilderTarget{IP: "127.0.0.1"}, int32(port))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+	if got := conn.RemoteAddr().String(); got != net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) {
+		t.Errorf("dialed %s, want the listener", got)
+	}
+}
+
+func TestPortForwardResolverFallsBackToSPDY(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// WebSocket upgrades are GETs, which this API server refuses
+		if req.Method != http.MethodPost {
+			http.Error(w, "websockets not supported", http.StatusBadRequest)
+			return
+		}
+		if req.URL.Path != "/api/v1/namespaces/builds/pods/nix-builder-abc/portforward" {
+			http.NotFound(w, req)
+			return
+		}
+		if _, err := httpstream.Handshake(req, w, []string{portforward.PortForwardProtocolV1Name}); err != nil {
+			return
+		}
+		streams := make(chan httpstream.Stream, 2)
+		conn := spdy.NewResponseUpgrader().UpgradeResponse(w, req, func(stream httpstream.Stream, _ <-chan struct{}) error {
+			streams <- stream
+			return nil
+		})
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		for stream := range streams {
+			if stream.Headers().Get(corev1.StreamType) == corev1.StreamTypeData {
+				io.Copy(stream, stream)
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	resolver, err := newResolver(ResolverConfig{Mode: ResolverPortForward}, &rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := resolver.Dial(context.Background(), BuilderTarget{Pod: "nix-builder-abc", Namespace: "builds"}, 22)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("SSH-2.0-test\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("SSH-2.0-test\r\n"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("reading through the forward: %v", err)
+	}
+	if string(buf) != "SSH-2.0-test\r\n" {
+		t.Errorf("read %q through the forward, want the echo", buf)
+	}
+}
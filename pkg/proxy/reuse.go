@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/logging"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// idleBuilder is the running builder of a closed connection, kept for the
+// same client's next connection
+type idleBuilder struct {
+	// key is the reuseKey of the connections that may take the builder
+	key string
+	// sessionID is the last session to use the builder of buildReq
+	sessionID         string
+	buildReq          string
+	buildReqNamespace string
+	podIP             string
+	clientKey         ssh.Signer
+	pod               string
+	namespace         string
+	user              string
+	hostKey           string
+
+	// stop ends the heartbeats keeping the build request alive while idle
+	stop  context.CancelFunc
+	timer *time.Timer
+}
+
+// builderPool holds idle builders for the reuse window, after which expire
+// releases them. Whoever removes a builder from the pool owns it.
+type builderPool struct {
+	window time.Duration
+	expire func(*idleBuilder)
+
+	mu   sync.Mutex
+	idle map[string][]*idleBuilder
+}
+
+func newBuilderPool(window time.Duration, expire func(*idleBuilder)) *builderPool {
+	return &builderPool{window: window, expire: expire, idle: make(map[string][]*idleBuilder)}
+}
+
+// park adds an idle builder to the pool until the reuse window passes
+func (p *builderPool) park(b *idleBuilder) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle[b.key] = append(p.idle[b.key], b)
+	b.timer = time.AfterFunc(p.window, func() {
+		if p.remove(b) {
+			p.expire(b)
+		}
+	})
+}
+
+// take removes and returns the most recently parked builder for key, or nil
+// when there is none
+func (p *builderPool) take(key string) *idleBuilder {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	builders := p.idle[key]
+	if len(builders) == 0 {
+		return nil
+	}
+	b := builders[len(builders)-1]
+	p.removeLocked(b)
+	return b
+}
+
+// remove takes b out of the pool and reports whether it was still there
+func (p *builderPool) remove(b *idleBuilder) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.removeLocked(b)
+}
+
+func (p *builderPool) removeLocked(b *idleBuilder) bool {
+	builders := p.idle[b.key]
+	for i, idle := range builders {
+		if idle != b {
+			continue
+		}
+		if len(builders) == 1 {
+			delete(p.idle, b.key)
+		} else {
+			p.idle[b.key] = append(builders[:i:i], builders[i+1:]...)
+		}
+		b.timer.Stop()
+		return true
+	}
+	return false
+}
+
+// drain removes and returns every idle builder
+func (p *builderPool) drain() []*idleBuilder {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var all []*idleBuilder
+	for key, builders := range p.idle {
+		for _, b := range builders {
+			b.timer.Stop()
+		}
+		all = append(all, builders...)
+		delete(p.idle, key)
+	}
+	return all
+}
+
+// reuseKey identifies the connections that may share idle builders: those
+// authenticated with the same key asking for the same kind of builder by
+// their user name, in the same namespace. It is empty when the session's builder is not reusable.
+func (p *SSHProxy) reuseKey(session *ProxySession) string {
+	if p.builders == nil || session.KeyFingerprint == "" {
+		return ""
+	}
+	return session.KeyFingerprint + " " + session.SSHConn.User() + " " + p.sessionNamespace(session)
+}
+
+// parkBuilder keeps a connection's builder for the reuse window instead of
+// completing its build request, and reports whether it did
+func (p *SSHProxy) parkBuilder(session *ProxySession, buildReq, podIP string, clientKey ssh.Signer) bool {
+	key := p.reuseKey(session)
+	if key == "" || podIP == "" || p.shuttingDown.Load() {
+		return false
+	}
+
+	ctx, stop := context.WithCancel(logging.WithSession(p.connCtx, logging.ComponentSession, session.ID))
+	b := &idleBuilder{
+		key:               key,
+		sessionID:         session.ID,
+		buildReq:          buildReq,
+		buildReqNamespace: p.sessionNamespace(session),
+		podIP:             podIP,
+		clientKey:         clientKey,
+		stop:              stop,
+	}
+	p.sessions.update(session, func() {
+		b.pod, b.namespace, b.user, b.hostKey = session.BuilderPod, session.BuilderNamespace, session.BuilderUser, session.BuilderHostKey
+	})
+	go p.sendHeartbeats(ctx, session, buildReq)
+	p.builders.park(b)
+	log.Info().Str("session_id", session.ID).Str("build_request", buildReq).Dur("reuse_window", p.builders.window).Msg("Keeping builder for the client's next connection")
+	return true
+}
+
+// expireBuilder completes the build request of a builder that went unused
+// for the reuse window
+func (p *SSHProxy) expireBuilder(b *idleBuilder) {
+	b.stop()
+	log.Info().Str("session_id", b.sessionID).Str("build_request", b.buildReq).Msg("Releasing builder unused for the reuse window")
+	p.completeBuildRequest(b.sessionID, b.buildReqNamespace, b.buildReq, true, nil)
+}
+
+// releaseIdleBuilders completes the build requests of every idle builder,
+// so none outlive the proxy
+func (p *SSHProxy) releaseIdleBuilders() {
+	if p.builders == nil {
+		return
+	}
+	for _, b := range p.builders.drain() {
+		p.expireBuilder(b)
+	}
+}
+
+// claimBuilder hands the session an idle builder of the same client, or
+// returns nil when there is none that is still running
+func (p *SSHProxy) claimBuilder(ctx context.Context, session *ProxySession) *idleBuilder {
+	key := p.reuseKey(session)
+	if key == "" {
+		return nil
+	}
+	for {
+		b := p.builders.take(key)
+		if b == nil {
+			return nil
+		}
+		b.stop()
+
+		var buildReq v1alpha1.NixBuildRequest
+		err := p.builds.get(ctx, client.ObjectKey{Namespace: b.buildReqNamespace, Name: b.buildReq}, &buildReq)
+		if err == nil && buildReq.Status.Phase == v1alpha1.BuildPhaseRunning && buildReq.Status.PodIP == b.podIP {
+			log.Ctx(ctx).Info().Str("build_request", b.buildReq).Str("previous_session_id", b.sessionID).Msg("Reusing the client's idle builder")
+			return b
+		}
+		log.Ctx(ctx).Info().Str("build_request", b.buildReq).Msg("Idle builder is no longer running, not reusing it")
+		go p.completeBuildRequest(b.sessionID, b.buildReqNamespace, b.buildReq, false, errcode.Errorf(errcode.Builder, "builder stopped while idle"))
+	}
+}
+
+// resumeBuilder makes a claimed idle builder the session's, keeping its
+// build request alive for as long as the session lasts
+func (p *SSHProxy) resumeBuilder(ctx context.Context, session *ProxySession, b *idleBuilder) {
+	p.sessions.update(session, func() {
+		session.buildRequest = b.buildReq
+		session.BuilderPod = b.pod
+		session.BuilderNamespace = b.namespace
+		session.BuilderUser = b.user
+		session.BuilderHostKey = b.hostKey
+	})
+	go p.sendHeartbeats(ctx, session, b.buildReq)
+	p.recordBuilderCPU(ctx, session, b.pod)
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuilderPoolReusesAndExpires(t *testing.T) {
+	expired := make(chan *idleBuilder, 1)
+	pool := newBuilderPool(50*time.Millisecond, func(b *idleBuilder) { expired <- b })
+
+	first := &idleBuilder{key: "SHA256:abc nixbld", buildReq: "build-1"}
+	second := &idleBuilder{key: "SHA256:abc nixbld", buildReq: "build-2"}
+	pool.park(first)
+	pool.park(second)
+
+	if b := pool.take("SHA256:abc nix-aarch64"); b != nil {
+		t.Fatalf("take() for another kind of builder = %s", b.buildReq)
+	}
+	if b := pool.take("SHA256:abc nixbld"); b != second {
+		t.Fatalf("take() = %v, want the most recently parked builder", b)
+	}
+
+	select {
+	case b := <-expired:
+		if b != first {
+			t.Fatalf("expired %s, want build-1", b.buildReq)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle builder did not expire after the reuse window")
+	}
+	if b := pool.take("SHA256:abc nixbld"); b != nil {
+		t.Fatalf("take() after expiry = %s", b.buildReq)
+	}
+	if pool.remove(second) {
+		t.Fatal("a taken builder was still in the pool")
+	}
+}
@@ -1,28 +1,43 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
-	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/certs"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/features"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/logging"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/policy"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/readiness"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/tracing"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/vault"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/ssh"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 )
@@ -34,30 +49,359 @@ const (
 	SSHKeySecretPublicKey = "public"
 	// SSHKeySecretHostKey is the key in the secret containing the proxy's SSH host key
 	SSHKeySecretHostKey = "host-key"
+	// SSHKeySecretHostCert is the optional key in the secret containing an
+	// OpenSSH certificate for the proxy's host key
+	SSHKeySecretHostCert = "host-cert"
 )
 
+// errProxyShuttingDown is recorded on build requests for sessions that were
+// handed off during shutdown before any traffic reached a builder
+var errProxyShuttingDown = errcode.Errorf(errcode.Canceled, "proxy shutting down before builder was ready")
+
+// errClientDisconnected is recorded on build requests whose client went away
+// before the session finished
+var errClientDisconnected = errcode.Errorf(errcode.Canceled, "client disconnected")
+
+// errSessionLimit is returned when a connection has no goroutines left to
+// tunnel another channel
+var errSessionLimit = errcode.Errorf(errcode.Quota, "session goroutine limit reached")
+
+// tracer records the proxy's spans of each session
+var tracer = tracing.Tracer("github.com/omarjatoi/nix-remote-build-controller/pkg/proxy")
+
+// clientKeepAlive probes idle client connections so that peers which vanish
+// without closing the connection are noticed within about half a minute
+var clientKeepAlive = net.KeepAliveConfig{
+	Enable:   true,
+	Idle:     15 * time.Second,
+	Interval: 5 * time.Second,
+	Count:    3,
+}
+
+const (
+	// builderReadyTimeout bounds the wait for a builder once its build
+	// request holds a builder slot; time spent queued does not count
+	builderReadyTimeout = 2 * time.Minute
+	// queueKeepAliveInterval is how often clients of queued build requests
+	// get an SSH keepalive, so idle timeouts between them and the proxy do
+	// not drop the connection
+	queueKeepAliveInterval = 30 * time.Second
+)
+
+// Config holds the settings used to construct an SSHProxy
+type Config struct {
+	// Version is reported by the /features endpoint
+	Version string
+
+	Addr         string
+	HostKeyPath  string
+	HostCertPath string
+	Namespace    string
+	RemoteUser   string
+	RemotePort   int32
+	// HealthPort serves the health endpoints and metrics; zero disables
+	// them
+	HealthPort      int
+	SSHKeySecret    string
+	ShutdownTimeout time.Duration
+
+	// Kubeconfig and KubeContext select the cluster the proxy works with.
+	// An empty Kubeconfig uses the in-cluster config or KUBECONFIG.
+	Kubeconfig  string
+	KubeContext string
+
+	// Client, when set, is used instead of connecting to a cluster, such as
+	// the fake client the load test runs the proxy against. Only the pod IP
+	// resolver works without a cluster.
+	Client client.WithWatch
+
+	// KubeAPIQPS and KubeAPIBurst limit the proxy's Kubernetes API requests.
+	// Zero keeps client-go's defaults.
+	KubeAPIQPS   float32
+	KubeAPIBurst int
+
+	// ProxyID identifies this proxy replica. Build requests it creates are
+	// labelled with it and it only watches those and shared ones. Empty
+	// watches every build request in Namespace.
+	ProxyID string
+
+	// PodName, PodNamespace and PodUID identify the proxy's own pod, from
+	// the downward API. Build requests are annotated with them so replicas
+	// can tell which requests belong to a proxy pod that is gone.
+	PodName      string
+	PodNamespace string
+	PodUID       string
+
+	// Auth selects how clients authenticate to the proxy
+	Auth AuthConfig
+	// Authorizer is consulted before each session action; nil allows all
+	Authorizer Authorizer
+
+	// MaxChannelsPerConn and MaxSessionGoroutines bound the channels handled
+	// concurrently on one client connection and the goroutines serving them.
+	// Zero or less disables the limit.
+	MaxChannelsPerConn   int
+	MaxSessionGoroutines int
+
+	// MaxSessions bounds the session registry. When it is full, sessions
+	// older than SessionMaxAge or whose connection is gone are evicted to
+	// make room; otherwise new connections are refused.
+	MaxSessions   int
+	SessionMaxAge time.Duration
+
+	// NamespaceRules place the build requests of matching principals in
+	// other namespaces than Namespace; the first matching rule applies
+	NamespaceRules []NamespaceRule
+
+	// ConnectionRate limits the new connections each source address may
+	// open, per second, after ConnectionBurst at once. Zero disables it.
+	ConnectionRate  float64
+	ConnectionBurst int
+
+	// IdleTimeout ends sessions whose tunnels carry no data for this long,
+	// deleting their build requests. Zero disables it.
+	IdleTimeout time.Duration
+	// KeepAliveInterval is how often clients are sent an SSH keepalive; a
+	// client that does not answer within one interval is disconnected.
+	// Zero disables keepalives.
+	KeepAliveInterval time.Duration
+
+	// BuilderTLSSecret is the controller's builder CA secret name. When set,
+	// the proxy dials builders over mutual TLS on BuilderTLSPort.
+	BuilderTLSSecret string
+	BuilderTLSPort   int32
+
+	// Resolver selects how the proxy reaches builder pods; the default dials
+	// their pod IPs
+	Resolver ResolverConfig
+
+	// SessionClientKeys gives each build request its own client key instead
+	// of the shared key from SSHKeySecret or Vault. Leased builders still
+	// use the shared key.
+	SessionClientKeys bool
+
+	// BuilderReuseWindow keeps the builder of a connection that succeeded
+	// for this long after it closes, handing it to the next connection
+	// authenticated with the same key that asks for the same kind of
+	// builder instead of creating another build request. Zero disables
+	// reuse.
+	BuilderReuseWindow time.Duration
+
+	// PreemptionRetries is how many times a session gets a new builder
+	// after its builder is preempted or loses its node before becoming ready
+	PreemptionRetries int
+
+	// QueueTimeout fails sessions whose build request stays queued for
+	// longer, so their clients can fall back to building locally. Zero
+	// waits in the queue indefinitely.
+	QueueTimeout time.Duration
+
+	// StaticBuilders take sessions for systems that cannot run in the
+	// cluster, and sessions that failed to get an in-cluster builder for
+	// lack of capacity, without a build request
+	StaticBuilders []StaticBuilder
+
+	// ExternalBuilders adds the NixExternalBuilder objects in Namespace to
+	// StaticBuilders when the proxy starts
+	ExternalBuilders bool
+
+	// InsecureIgnoreBuilderHostKeys connects to builders without checking
+	// the host key the controller recorded for them
+	InsecureIgnoreBuilderHostKeys bool
+
+	// SessionIDFormat is SessionIDFormatUUID (the default) or
+	// SessionIDFormatULID. SessionIDPrefix, when set, is prepended to every
+	// ID with a dash, to carry site conventions such as a region into logs.
+	// A non-zero SessionIDSeed makes the random part of IDs reproducible.
+	SessionIDFormat string
+	SessionIDPrefix string
+	SessionIDSeed   uint64
+
+	// CIEnv maps SSH environment variables to the CI context annotations
+	// they set on build requests, such as DefaultCIEnv. Nil ignores the
+	// client's environment.
+	CIEnv map[string]string
+
+	// Audit, when set, receives a record of every connection when it
+	// closes
+	Audit AuditSink
+
+	// AllowedCommands, when set, are the only commands build sessions may
+	// exec on their builder, in the pattern syntax of CommandPolicy.
+	// Shells and subsystems other than AllowedSubsystems are refused.
+	// Leased builders are not restricted.
+	AllowedCommands   []string
+	AllowedSubsystems []string
+
+	// AdminTLSCertPath and AdminTLSKeyPath serve the health endpoints and
+	// admin API over HTTPS, reloading the certificate when the files are
+	// rotated
+	AdminTLSCertPath string
+	AdminTLSKeyPath  string
+
+	// AdminAddress is where the admin API listing and evicting sessions and
+	// reporting usage listens. Without AdminToken it must be a loopback
+	// address. Empty disables the admin API.
+	AdminAddress string
+	AdminToken   []byte
+
+	// Vault, when set, replaces SSHKeySecret as the source of the client key
+	// and host key, which are read from VaultKeyPath in Vault's KV store
+	Vault        *vault.Client
+	VaultKeyPath string
+}
+
 type SSHProxy struct {
-	listener     net.Listener
-	hostKey      ssh.Signer
-	clientKey    ssh.Signer
-	sessions     map[string]*ProxySession
-	sessionsMux  sync.RWMutex
-	activeConns  sync.WaitGroup
-	shutdownChan chan struct{}
-	shutdownOnce sync.Once
-	k8sClient    client.Client
-	namespace    string
-	remoteUser   string
-	remotePort   int32
+	listener        net.Listener
+	hostKey         ssh.Signer
+	hostKeyMux      sync.RWMutex
+	hostKeyLoader   hostKeyLoader
+	clientKey       ssh.Signer
+	sessions        *sessionRegistry
+	auth            []AuthProvider
+	authz           Authorizer
+	activeConns     sync.WaitGroup
+	shutdownChan    chan struct{}
+	shutdownOnce    sync.Once
+	shutdownTimeout time.Duration
+	maxChannels     int
+	maxGoroutines   int
+	connCtx         context.Context
+	connCancel      context.CancelFunc
+	k8sClient       client.Client
+	// builds watches NixBuildRequests so sessions are woken when their
+	// builder becomes ready instead of polling the API server
+	builds    *buildWatcher
+	namespace string
+	// namespaceRules choose the namespace of each principal's build
+	// requests, defaulting to namespace
+	namespaceRules []NamespaceRule
+	proxyID        string
+	// instanceID distinguishes this process from earlier ones with the
+	// same proxyID
+	instanceID string
+	// proxyPod and proxyPodUID identify the pod running this process, as
+	// namespace/name, when known
+	proxyPod       string
+	proxyPodUID    string
+	remoteUser     string
+	remotePort     int32
+	builderTLS     string
+	builderTLSPort int32
+	// resolver reaches builder pods
+	resolver Resolver
+	// builders holds idle builders for reuse, when enabled
+	builders *builderPool
+	// static routes sessions to builders outside the cluster, when
+	// configured
+	static *staticBuilders
+	// connLimiter rate limits connections per source address, when set
+	connLimiter *connectionLimiter
+	// sessionClientKeys generates a client key per build request
+	sessionClientKeys bool
+	// insecureHostKeys skips builder host key verification
+	insecureHostKeys bool
+	// commands restricts what build sessions may run, when set
+	commands *CommandPolicy
+	// sessionIDs names new sessions
+	sessionIDs *sessionIDGenerator
+	// audit receives a record of every connection, when set
+	audit AuditSink
+	// usage aggregates finished sessions for usage reports
+	usage *usageLedger
+	// ciEnv maps the SSH environment variables recorded as CI context to
+	// their annotations. Nil ignores the client's environment.
+	ciEnv map[string]string
+	// preemptionRetries bounds reprovisioning preempted builders
+	preemptionRetries int
+	// queueTimeout bounds the wait of a queued session, when positive
+	queueTimeout time.Duration
+	// version and configFeatures describe the proxy on /features
+	version        string
+	configFeatures []features.Feature
+	// settings hold the idle timeout and keepalive interval that end
+	// sessions that stopped moving data or whose client stopped answering
+	settings     atomic.Pointer[Settings]
 	healthServer *http.Server
+	adminServer  *http.Server
 	shuttingDown atomic.Bool
+	// accepting is set while the listener accepts SSH connections
+	accepting atomic.Bool
 }
 
 type ProxySession struct {
-	ID         string
-	SSHConn    ssh.Conn
+	ID      string
+	SSHConn ssh.Conn
+	// Namespace holds the connection's build requests, chosen by the
+	// client's identity
+	Namespace  string
 	BuilderPod string
-	Status     SessionStatus
+	// BuilderNamespace is the namespace of the builder pod when the
+	// controller isolated it outside the proxy's namespace
+	BuilderNamespace string
+	// BuilderUser is the user to log in to the builder as, when the
+	// controller chose one
+	BuilderUser string
+	// BuilderHostKey is the host key the builder must present
+	BuilderHostKey string
+	// StaticBuilder is the address of the static builder serving the
+	// session instead of a builder pod
+	StaticBuilder string
+	Status        SessionStatus
+	// Principal is the identity the client authenticated as
+	Principal string
+	// KeyFingerprint is the fingerprint of the key the client authenticated
+	// with, if any
+	KeyFingerprint string
+	CreatedAt      time.Time
+	LastActive     time.Time
+
+	// cancel aborts the session while it is still waiting for a builder
+	cancel context.CancelCauseFunc
+	// limits bounds the channels and goroutines this connection may use
+	limits *sessionLimits
+	// builder is shared by the connection's session channels
+	builder connBuilder
+	// buildRequest names the build request of the connection's builder
+	buildRequest string
+	// builderIP and builderKey reach the connection's builder, for port
+	// forwards
+	builderIP  string
+	builderKey ssh.Signer
+	// handedOff is set when shutdown asked the client to retry elsewhere
+	handedOff atomic.Bool
+	// closed is set once the client connection has gone away
+	closed atomic.Bool
+	// lastData is when the session's tunnels last carried data, in Unix
+	// nanoseconds
+	lastData atomic.Int64
+	// bytesIn and bytesOut count tunnel data from and to the client
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// commands are the commands the session asked builders to run, for
+	// its audit record
+	auditMu  sync.Mutex
+	commands []AuditCommand
+	// builderCPU is the CPU its builder requested, charged to the session's
+	// usage from builderSince
+	builderCPU   float64
+	builderSince time.Time
+}
+
+// SessionInfo is the admin API's view of a session
+type SessionInfo struct {
+	ID             string    `json:"id"`
+	Status         string    `json:"status"`
+	Proxy          string    `json:"proxy,omitempty"`
+	Namespace      string    `json:"namespace,omitempty"`
+	BuilderPod     string    `json:"builderPod,omitempty"`
+	StaticBuilder  string    `json:"staticBuilder,omitempty"`
+	ClientAddr     string    `json:"clientAddr"`
+	CreatedAt      time.Time `json:"createdAt"`
+	LastActive     time.Time `json:"lastActive"`
+	AgeSeconds     float64   `json:"ageSeconds"`
+	Channels       int       `json:"channels"`
+	MemoryEstimate int64     `json:"memoryEstimateBytes"`
 }
 
 type SessionStatus int
@@ -68,10 +412,35 @@ const (
 	SessionClosed
 )
 
-func NewSSHProxy(ctx context.Context, addr, hostKeyPath, namespace, remoteUser string, remotePort int32, healthPort int, sshKeySecret string) (*SSHProxy, error) {
-	listener, err := net.Listen("tcp", addr)
+func (s SessionStatus) String() string {
+	switch s {
+	case SessionPending:
+		return "pending"
+	case SessionConnected:
+		return "connected"
+	case SessionClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// kubeConfig returns the API server configuration from the kubeconfig file
+// at path, or from controller-runtime's usual sources when path is empty.
+// kubeContext, when set, replaces the file's current context.
+func kubeConfig(path, kubeContext string) (*rest.Config, error) {
+	if path == "" {
+		return config.GetConfigWithContext(kubeContext)
+	}
+	rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: path}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+func NewSSHProxy(ctx context.Context, cfg Config) (*SSHProxy, error) {
+	listener, err := net.Listen("tcp", cfg.Addr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		return nil, fmt.Errorf("failed to listen on %s: %w", cfg.Addr, err)
 	}
 
 	scheme := runtime.NewScheme()
@@ -82,64 +451,204 @@ func NewSSHProxy(ctx context.Context, addr, hostKeyPath, namespace, remoteUser s
 		return nil, fmt.Errorf("failed to add NixBuilder scheme: %w", err)
 	}
 
-	k8sConfig, err := config.GetConfig()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get Kubernetes config: %w", err)
+	var k8sConfig *rest.Config
+	var k8sClient client.Client
+	if cfg.Client != nil {
+		k8sClient = cfg.Client
+	} else {
+		apiMetrics.Install()
+		k8sConfig, err = kubeConfig(cfg.Kubeconfig, cfg.KubeContext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Kubernetes config: %w", err)
+		}
+		if cfg.KubeAPIQPS > 0 {
+			k8sConfig.QPS = cfg.KubeAPIQPS
+		}
+		if cfg.KubeAPIBurst > 0 {
+			k8sConfig.Burst = cfg.KubeAPIBurst
+		}
+
+		k8sClient, err = client.New(k8sConfig, client.Options{
+			Scheme: scheme,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+		}
 	}
 
-	k8sClient, err := client.New(k8sConfig, client.Options{
-		Scheme: scheme,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	if cfg.ExternalBuilders {
+		external, err := LoadExternalBuilders(ctx, k8sClient, cfg.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load external builders: %w", err)
+		}
+		log.Info().Int("count", len(external)).Msg("Loaded NixExternalBuilders")
+		cfg.StaticBuilders = append(cfg.StaticBuilders[:len(cfg.StaticBuilders):len(cfg.StaticBuilders)], external...)
 	}
 
-	// Load client key from user-provided secret
-	clientKey, err := loadClientKeyFromSecret(ctx, k8sClient, namespace, sshKeySecret)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load client key from secret %s: %w", sshKeySecret, err)
+	// Load client key from Vault or the user-provided secret
+	var clientKey ssh.Signer
+	if cfg.Vault != nil {
+		clientKey, err = loadClientKeyFromVault(ctx, cfg.Vault, cfg.VaultKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client key from Vault path %s: %w", cfg.VaultKeyPath, err)
+		}
+		log.Info().Str("vault_path", cfg.VaultKeyPath).Msg("Loaded SSH client key from Vault")
+	} else {
+		// Every replica must present the same host key and log in to
+		// builders with the same client key, so keys missing from the
+		// secret are generated once and stored there
+		if err := ensureSharedKeys(ctx, k8sClient, cfg.Namespace, cfg.SSHKeySecret); err != nil {
+			return nil, fmt.Errorf("failed to initialize shared keys in secret %s: %w", cfg.SSHKeySecret, err)
+		}
+		clientKey, err = loadClientKeyFromSecret(ctx, k8sClient, cfg.Namespace, cfg.SSHKeySecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client key from secret %s: %w", cfg.SSHKeySecret, err)
+		}
+		log.Info().Str("secret", cfg.SSHKeySecret).Msg("Loaded SSH client key from secret")
 	}
-	log.Info().Str("secret", sshKeySecret).Msg("Loaded SSH client key from secret")
 
 	// Load host key
 	var hostKey ssh.Signer
-	if hostKeyPath != "" {
-		hostKey, err = loadHostKey(hostKeyPath)
+	var loader hostKeyLoader
+	if cfg.HostKeyPath != "" {
+		loader = fileHostKeyLoader(cfg.HostKeyPath, cfg.HostCertPath)
+		hostKey, err = loader(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load host key from %s: %w", cfg.HostKeyPath, err)
+		}
+		log.Info().Str("path", cfg.HostKeyPath).Str("cert_path", cfg.HostCertPath).Msg("Loaded SSH host key from file")
+	} else if cfg.Vault != nil {
+		loader = vaultHostKeyLoader(cfg.Vault, cfg.VaultKeyPath)
+		hostKey, err = loader(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load host key from %s: %w", hostKeyPath, err)
+			return nil, fmt.Errorf("failed to load host key from Vault path %s: %w", cfg.VaultKeyPath, err)
 		}
-		log.Info().Str("path", hostKeyPath).Msg("Loaded SSH host key from file")
+		log.Info().Str("vault_path", cfg.VaultKeyPath).Msg("Loaded SSH host key from Vault")
 	} else {
-		// Try to load host key from secret
-		hostKey, err = loadHostKeyFromSecret(ctx, k8sClient, namespace, sshKeySecret)
+		loader = secretHostKeyLoader(k8sClient, cfg.Namespace, cfg.SSHKeySecret)
+		hostKey, err = loader(ctx)
 		if err != nil {
-			log.Warn().Err(err).Msg("No host key in secret, generating temporary key (host key will change on restart)")
-			hostKey, err = generateHostKey()
-			if err != nil {
-				return nil, fmt.Errorf("failed to generate host key: %w", err)
-			}
-		} else {
-			log.Info().Str("secret", sshKeySecret).Msg("Loaded SSH host key from secret")
+			return nil, fmt.Errorf("failed to load host key from secret %s: %w", cfg.SSHKeySecret, err)
 		}
+		log.Info().Str("secret", cfg.SSHKeySecret).Msg("Loaded SSH host key from secret")
+	}
+
+	authProviders, err := newAuthProviders(cfg.Auth, k8sClient, cfg.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure authentication: %w", err)
+	}
+
+	resolver, err := newResolver(cfg.Resolver, k8sConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure builder resolver: %w", err)
+	}
+	log.Info().Str("resolver", resolver.Name()).Msg("Configured builder resolver")
+
+	var builds *buildWatcher
+	if cfg.Client != nil {
+		builds, err = newClientBuildWatcher(cfg.Client, cfg.ProxyID)
+	} else {
+		builds, err = newBuildWatcher(ctx, k8sConfig, scheme, servedNamespaces(cfg.Namespace, cfg.NamespaceRules), cfg.ProxyID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Sessions run on their own context so that a shutdown signal does not
+	// tear them down before the graceful shutdown deadline
+	connCtx, connCancel := context.WithCancel(context.Background())
+	if err := builds.start(connCtx); err != nil {
+		connCancel()
+		return nil, err
 	}
 
 	proxy := &SSHProxy{
-		listener:     listener,
-		hostKey:      hostKey,
-		clientKey:    clientKey,
-		sessions:     make(map[string]*ProxySession),
-		shutdownChan: make(chan struct{}),
-		k8sClient:    k8sClient,
-		namespace:    namespace,
-		remoteUser:   remoteUser,
-		remotePort:   remotePort,
+		listener:          listener,
+		hostKey:           hostKey,
+		hostKeyLoader:     loader,
+		clientKey:         clientKey,
+		sessions:          newSessionRegistry(cfg.MaxSessions, cfg.SessionMaxAge),
+		connLimiter:       newConnectionLimiter(cfg.ConnectionRate, cfg.ConnectionBurst),
+		auth:              authProviders,
+		authz:             cfg.Authorizer,
+		shutdownChan:      make(chan struct{}),
+		shutdownTimeout:   cfg.ShutdownTimeout,
+		maxChannels:       cfg.MaxChannelsPerConn,
+		maxGoroutines:     cfg.MaxSessionGoroutines,
+		connCtx:           connCtx,
+		connCancel:        connCancel,
+		k8sClient:         k8sClient,
+		builds:            builds,
+		namespace:         cfg.Namespace,
+		namespaceRules:    cfg.NamespaceRules,
+		proxyID:           cfg.ProxyID,
+		instanceID:        uuid.NewString(),
+		proxyPodUID:       cfg.PodUID,
+		remoteUser:        cfg.RemoteUser,
+		remotePort:        cfg.RemotePort,
+		resolver:          resolver,
+		builderTLS:        cfg.BuilderTLSSecret,
+		builderTLSPort:    cfg.BuilderTLSPort,
+		insecureHostKeys:  cfg.InsecureIgnoreBuilderHostKeys,
+		sessionClientKeys: cfg.SessionClientKeys,
+		preemptionRetries: cfg.PreemptionRetries,
+		queueTimeout:      cfg.QueueTimeout,
+		audit:             cfg.Audit,
+		usage:             newUsageLedger(),
+		ciEnv:             cfg.CIEnv,
+		version:           cfg.Version,
+		configFeatures:    configFeatures(cfg, resolver.Name()),
+	}
+
+	proxy.static, err = newStaticBuilders(cfg.StaticBuilders, cfg.RemoteUser, clientKey, cfg.InsecureIgnoreBuilderHostKeys)
+	if err != nil {
+		connCancel()
+		return nil, err
+	}
+	if cfg.BuilderReuseWindow > 0 {
+		proxy.builders = newBuilderPool(cfg.BuilderReuseWindow, proxy.expireBuilder)
+	}
+	if cfg.PodName != "" && cfg.PodNamespace != "" && cfg.PodUID != "" {
+		proxy.proxyPod = cfg.PodNamespace + "/" + cfg.PodName
 	}
 
-	if err := proxy.startHealthServer(healthPort); err != nil {
-		return nil, fmt.Errorf("failed to start health server: %w", err)
+	proxy.settings.Store(&Settings{IdleTimeout: cfg.IdleTimeout, KeepAliveInterval: cfg.KeepAliveInterval})
+	if proxy.authz == nil {
+		proxy.authz = AllowAll{}
 	}
 
-	log.Info().Str("address", addr).Msg("SSH proxy listening")
+	proxy.sessionIDs, err = newSessionIDGenerator(cfg.SessionIDFormat, cfg.SessionIDPrefix, cfg.SessionIDSeed)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.AllowedCommands != nil {
+		proxy.commands, err = NewCommandPolicy(cfg.AllowedCommands, cfg.AllowedSubsystems)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	proxy.releaseOrphanedBuildRequests(ctx)
+
+	if err := metricsRegistry.Register(proxy.sessions); err != nil {
+		return nil, fmt.Errorf("failed to register session metrics: %w", err)
+	}
+
+	tlsConfig, err := proxy.adminTLSConfig(cfg.AdminTLSCertPath, cfg.AdminTLSKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HealthPort > 0 {
+		proxy.startHealthServer(cfg.HealthPort, tlsConfig)
+	}
+	if cfg.AdminAddress != "" {
+		if err := proxy.startAdminServer(cfg.AdminAddress, cfg.AdminToken, tlsConfig); err != nil {
+			return nil, fmt.Errorf("failed to start admin server: %w", err)
+		}
+	}
+
+	log.Info().Str("address", cfg.Addr).Msg("SSH proxy listening")
 	return proxy, nil
 }
 
@@ -165,35 +674,44 @@ func loadClientKeyFromSecret(ctx context.Context, k8sClient client.Client, names
 	return signer, nil
 }
 
-func loadHostKeyFromSecret(ctx context.Context, k8sClient client.Client, namespace, secretName string) (ssh.Signer, error) {
-	var secret corev1.Secret
-	if err := k8sClient.Get(ctx, client.ObjectKey{
-		Namespace: namespace,
-		Name:      secretName,
-	}, &secret); err != nil {
-		return nil, fmt.Errorf("failed to get secret: %w", err)
+func loadClientKeyFromVault(ctx context.Context, vaultClient *vault.Client, path string) (ssh.Signer, error) {
+	data, err := vaultClient.ReadKV(ctx, path)
+	if err != nil {
+		return nil, err
 	}
 
-	hostKeyBytes, ok := secret.Data[SSHKeySecretHostKey]
+	privateKey, ok := data[SSHKeySecretPrivateKey]
 	if !ok {
-		return nil, fmt.Errorf("secret %s missing key '%s'", secretName, SSHKeySecretHostKey)
+		return nil, fmt.Errorf("vault path %s missing required key '%s'", path, SSHKeySecretPrivateKey)
 	}
 
-	signer, err := ssh.ParsePrivateKey(hostKeyBytes)
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse host key: %w", err)
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
 	}
 
 	return signer, nil
 }
 
+// Addr returns the address the proxy accepts SSH connections on
+func (p *SSHProxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
 func (p *SSHProxy) Start(ctx context.Context) error {
 	defer p.listener.Close()
 
+	if p.hostKeyLoader != nil {
+		go p.watchHostKey(ctx)
+	}
+	go p.sweepSessions(ctx)
+
 	connChan := make(chan net.Conn)
 	errChan := make(chan error)
 
 	go func() {
+		p.accepting.Store(true)
+		defer p.accepting.Store(false)
 		for {
 			select {
 			case <-p.shutdownChan:
@@ -231,7 +749,7 @@ func (p *SSHProxy) Start(ctx context.Context) error {
 			p.activeConns.Add(1)
 			go func() {
 				defer p.activeConns.Done()
-				p.handleConnection(ctx, conn)
+				p.handleConnection(p.connCtx, conn)
 			}()
 		}
 	}
@@ -244,9 +762,23 @@ func (p *SSHProxy) gracefulShutdown(ctx context.Context) error {
 
 	p.shutdownOnce.Do(func() {
 		close(p.shutdownChan)
+		p.listener.Close()
 	})
 
-	log.Info().Int("active_connections", p.getActiveSessionCount()).Msg("Gracefully terminating, waiting for active connections to complete")
+	deadlineCtx, deadlineCancel := context.WithTimeout(context.Background(), p.shutdownTimeout)
+	defer deadlineCancel()
+
+	// Sessions that are still waiting for a builder have not exchanged any
+	// build traffic yet, so ask those clients to retry instead of holding
+	// them (and their half-created pods) until the deadline
+	handedOff := p.handOffPendingSessions()
+	p.releaseIdleBuilders()
+
+	log.Info().
+		Int("active_connections", p.getActiveSessionCount()).
+		Int("handed_off", handedOff).
+		Dur("timeout", p.shutdownTimeout).
+		Msg("Gracefully terminating, waiting for active connections to complete")
 
 	done := make(chan struct{})
 	go func() {
@@ -257,8 +789,17 @@ func (p *SSHProxy) gracefulShutdown(ctx context.Context) error {
 	select {
 	case <-done:
 		log.Info().Msg("All connections completed, terminating the proxy")
-	case <-ctx.Done():
+	case <-deadlineCtx.Done():
 		log.Warn().Msg("Shutdown timeout reached, the proxy will be forcefully terminated")
+		p.connCancel()
+	}
+
+	if p.adminServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := p.adminServer.Shutdown(shutdownCtx); err != nil {
+			log.Warn().Err(err).Msg("Admin server shutdown failed")
+		}
 	}
 
 	// Shutdown health server last
@@ -276,67 +817,201 @@ func (p *SSHProxy) gracefulShutdown(ctx context.Context) error {
 }
 
 func (p *SSHProxy) getActiveSessionCount() int {
-	p.sessionsMux.RLock()
-	defer p.sessionsMux.RUnlock()
-	return len(p.sessions)
+	return p.sessions.len()
+}
+
+// sweepSessions periodically evicts leaked sessions from the registry
+func (p *SSHProxy) sweepSessions(ctx context.Context) {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := p.sessions.sweep(); n > 0 {
+				log.Warn().Int("evicted", n).Msg("Evicted leaked sessions")
+			}
+		}
+	}
+}
+
+// handOffPendingSessions cancels every session that has not yet been routed
+// to a builder and returns how many were handed off
+func (p *SSHProxy) handOffPendingSessions() int {
+	count := 0
+	p.sessions.forEach(func(session *ProxySession) {
+		if session.Status != SessionPending {
+			return
+		}
+		session.handedOff.Store(true)
+		session.cancel(errProxyShuttingDown)
+		count++
+	})
+	return count
+}
+
+// markSessionConnected moves a session out of the pending state, returning
+// false if shutdown already handed the session off
+func (p *SSHProxy) markSessionConnected(session *ProxySession) bool {
+	connected := false
+	p.sessions.update(session, func() {
+		if session.handedOff.Load() {
+			return
+		}
+		session.Status = SessionConnected
+		connected = true
+	})
+	return connected
+}
+
+// notifyRetry tells the client on the other end of channel that its session
+// was dropped by a shutting down proxy and should be retried
+func notifyRetry(channel ssh.Channel) {
+	fmt.Fprintf(channel.Stderr(), "nix-remote-build-proxy: proxy is shutting down, please retry\r\n")
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+}
+
+// reportFailure records why a session could not reach a builder and tells
+// the client on the other end of channel
+func (p *SSHProxy) reportFailure(ctx context.Context, session *ProxySession, channel ssh.Channel, err error) {
+	code := errcode.Of(err)
+	sessionFailures.WithLabelValues(string(code)).Inc()
+	log.Ctx(ctx).Error().Err(err).Str("error_code", string(code)).Msg("Session failed before reaching a builder")
+
+	fmt.Fprintf(channel.Stderr(), "nix-remote-build-proxy: %s\r\n", errcode.Message(code, errcode.Text(err)))
+	io.WriteString(channel.Stderr(), localFallbackAdvice(code, session.ID))
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
 }
 
 func (p *SSHProxy) handleConnection(ctx context.Context, netConn net.Conn) {
 	defer netConn.Close()
 
-	config := &ssh.ServerConfig{
-		NoClientAuth: true, // TODO: adding ssh auth eventually might be a good idea
+	if tcpConn, ok := netConn.(*net.TCPConn); ok {
+		if err := tcpConn.SetKeepAliveConfig(clientKeepAlive); err != nil {
+			log.Warn().Err(err).Msg("Failed to enable TCP keepalive on client connection")
+		}
+	}
+
+	// The session spans from accept to close in the trace named by its ID
+	sessionID := p.sessionIDs.next()
+	ctx = logging.WithSession(ctx, logging.ComponentSession, sessionID)
+	ctx, span := tracing.Start(tracing.WithSession(ctx, sessionID), tracer, "ssh.session",
+		attribute.String("client.address", netConn.RemoteAddr().String()))
+	defer span.End()
+
+	if err := p.admit(netConn.RemoteAddr()); err != nil {
+		tracing.Fail(span, err)
+		p.refuse(netConn, sessionID, err)
+		return
 	}
-	config.AddHostKey(p.hostKey)
+
+	config := &ssh.ServerConfig{}
+	configureAuth(config, p.auth)
+	config.AddHostKey(p.currentHostKey())
 
 	sshConn, chans, reqs, err := ssh.NewServerConn(netConn, config)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to create SSH connection")
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to create SSH connection")
+		tracing.Fail(span, err)
 		return
 	}
 	defer sshConn.Close()
+	span.SetAttributes(attribute.String("ssh.user", sshConn.User()), attribute.String("nix.principal", sessionPrincipal(sshConn)))
+
+	// Force the connection closed once the shutdown deadline cancels ctx
+	stop := context.AfterFunc(ctx, func() { sshConn.Close() })
+	defer stop()
 
-	sessionID := generateSessionID()
+	// The session context ends as soon as the client goes away so that pod
+	// waits are abandoned and the build request is cleaned up immediately
+	sessionCtx, sessionCancel := context.WithCancelCause(ctx)
+	defer sessionCancel(errClientDisconnected)
 	session := &ProxySession{
-		ID:      sessionID,
-		SSHConn: sshConn,
-		Status:  SessionPending,
+		ID:             sessionID,
+		SSHConn:        sshConn,
+		Status:         SessionPending,
+		Principal:      sessionPrincipal(sshConn),
+		KeyFingerprint: sessionKeyFingerprint(sshConn),
+		Namespace:      p.namespaceFor(sessionPrincipal(sshConn)),
+		cancel:         sessionCancel,
+		limits:         newSessionLimits(p.maxChannels, p.maxGoroutines),
 	}
+	go func() {
+		sshConn.Wait()
+		session.closed.Store(true)
+		sessionCancel(errClientDisconnected)
+	}()
 
-	p.sessionsMux.Lock()
-	p.sessions[sessionID] = session
-	p.sessionsMux.Unlock()
+	if err := p.sessions.add(session); err != nil {
+		log.Warn().Err(err).Str("client_addr", sshConn.RemoteAddr().String()).Msg("Refusing SSH connection")
+		return
+	}
+	// The audit record and usage are written last, once every channel has
+	// finished and counted its data
+	var channels sync.WaitGroup
+	defer func() {
+		channels.Wait()
+		p.writeAudit(session)
+		p.recordUsage(session)
+	}()
+	defer p.sessions.remove(session)
 	defer func() {
-		p.sessionsMux.Lock()
-		delete(p.sessions, sessionID)
-		p.sessionsMux.Unlock()
+		if session.builder.closeConn() {
+			p.completeConnBuilder(session)
+		}
 	}()
 
-	log.Info().Str("session_id", sessionID).Str("client_addr", sshConn.RemoteAddr().String()).Msg("New SSH connection")
+	log.Ctx(ctx).Info().
+		Str("client_addr", sshConn.RemoteAddr().String()).
+		Str("principal", session.Principal).
+		Str("auth_provider", sshConn.Permissions.Extensions[AuthProviderExtension]).
+		Str("key_fingerprint", session.KeyFingerprint).
+		Msg("New SSH connection")
 
-	go ssh.DiscardRequests(reqs)
+	go p.handleGlobalRequests(sessionCtx, session, reqs)
+	go p.keepClientAlive(sessionCtx, session)
 	for newChannel := range chans {
-		go p.handleChannel(ctx, session, newChannel)
+		if !session.limits.acquireChannel() {
+			log.Ctx(ctx).Warn().Msg("Rejecting channel, connection is at its channel limit")
+			newChannel.Reject(ssh.ResourceShortage, errcode.Message(errcode.Quota, "too many concurrent channels"))
+			continue
+		}
+		channels.Add(1)
+		go func() {
+			defer channels.Done()
+			defer session.limits.releaseChannel()
+			p.handleChannel(sessionCtx, session, newChannel)
+		}()
 	}
 }
 
 func (p *SSHProxy) handleChannel(ctx context.Context, session *ProxySession, newChannel ssh.NewChannel) {
-	if newChannel.ChannelType() != "session" {
+	switch newChannel.ChannelType() {
+	case "session":
+	case "direct-tcpip":
+		p.handleDirectTCPIP(ctx, session, newChannel)
+		return
+	default:
 		newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 		return
 	}
 
-	channel, requests, err := newChannel.Accept()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to accept channel")
+	if leaseName := leaseFromUser(session.SSHConn.User()); leaseName != "" {
+		p.handleLeaseChannel(ctx, session, newChannel, leaseName)
 		return
 	}
-	defer channel.Close()
 
-	log.Info().Str("session_id", session.ID).Msg("Handling SSH session channel")
+	buildReq := p.newBuildRequest(session)
+	if err := p.authorizeBuild(ctx, session, buildReq); err != nil {
+		newChannel.Reject(ssh.Prohibited, p.denialMessage(session, err))
+		return
+	}
 
-	if err := p.createBuildRequest(ctx, session); err != nil {
-		log.Error().Err(err).Str("session_id", session.ID).Msg("Failed to create build request")
+	// Systems the cluster cannot run go straight to a static builder
+	if system := buildReq.Spec.System; system != "" && !isLinuxSystem(system) && p.static.serves(system, buildReq.Spec.RequiredFeatures) {
+		p.handleStaticChannel(ctx, session, newChannel, buildReq)
 		return
 	}
 
@@ -344,131 +1019,383 @@ func (p *SSHProxy) handleChannel(ctx context.Context, session *ProxySession, new
 	var buildSucceeded bool
 	var buildError error
 
+	// Every session channel on the connection uses the same builder; the
+	// first one provisions it
+	first := session.builder.acquire()
 	defer func() {
-		// Update status and delete the build request when the session ends
-		p.completeBuildRequest(session.ID, buildSucceeded, buildError)
+		p.releaseBuilder(session, buildSucceeded, buildError)
 	}()
 
-	podIP, err := p.waitForBuilderPod(ctx, session)
+	clientKey := p.clientKey
+	if first && p.sessionClientKeys {
+		key, err := newSessionClientKey(buildReq)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Failed to generate session client key")
+			session.builder.provisioned("", nil, err)
+			newChannel.Reject(ssh.ConnectionFailed, "failed to prepare builder credentials")
+			return
+		}
+		clientKey = key
+	}
+
+	channel, requests, err := newChannel.Accept()
 	if err != nil {
-		log.Error().Err(err).Str("session_id", session.ID).Msg("Failed to get builder pod")
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to accept channel")
+		if first {
+			session.builder.provisioned("", nil, err)
+		}
+		return
+	}
+	defer channel.Close()
+
+	if first {
+		log.Ctx(ctx).Info().Msg("Handling SSH session channel")
+		if p.ciEnv != nil {
+			var ciContext map[string]string
+			ciContext, requests = p.collectCIContext(ctx, session, requests)
+			maps.Copy(buildReq.Annotations, ciContext)
+		}
+		if idle := p.claimBuilder(ctx, session); idle != nil {
+			p.resumeBuilder(ctx, session, idle)
+			session.builder.provisioned(idle.podIP, idle.clientKey, nil)
+		} else {
+			p.sessions.update(session, func() {
+				session.buildRequest = buildReq.Name
+			})
+			podIP, err := p.provisionBuilder(ctx, session, buildReq, channel)
+			session.builder.provisioned(podIP, clientKey, err)
+		}
+	} else {
+		log.Ctx(ctx).Info().Msg("Handling multiplexed SSH session channel on the connection's builder")
+	}
+
+	podIP, clientKey, err := session.builder.wait(ctx)
+	if err != nil {
+		if session.handedOff.Load() {
+			log.Ctx(ctx).Info().Msg("Session handed off during shutdown, asking client to retry")
+			notifyRetry(channel)
+			buildError = errProxyShuttingDown
+			return
+		}
+		if errors.Is(context.Cause(ctx), errClientDisconnected) {
+			log.Ctx(ctx).Info().Msg("Client disconnected while waiting for builder pod")
+			buildError = errClientDisconnected
+			return
+		}
 		buildError = err
+		if capacityCodes[errcode.Of(err)] && p.static.serves(buildReq.Spec.System, buildReq.Spec.RequiredFeatures) {
+			log.Ctx(ctx).Info().Err(err).Msg("No in-cluster builder available, falling back to a static builder")
+			fmt.Fprintf(channel.Stderr(), "nix-remote-build-proxy: %s, trying a static builder\r\n", errcode.Message(errcode.Of(err), errcode.Text(err)))
+			p.tunnelEnded(ctx, session, channel, p.routeToStaticBuilder(ctx, session, channel, requests, buildReq, staticReasonCapacity))
+			return
+		}
+		p.reportFailure(ctx, session, channel, err)
 		return
 	}
 
-	buildError = p.routeToBuilder(ctx, session, channel, requests, podIP)
-	if buildError != nil {
-		log.Error().Err(buildError).Str("session_id", session.ID).Msg("Failed to route to builder")
+	var buildReqName string
+	p.sessions.update(session, func() {
+		session.builderIP = podIP
+		session.builderKey = clientKey
+		buildReqName = session.buildRequest
+	})
+	buildError = p.routeToBuilder(ctx, session, channel, requests, buildReqName, podIP, clientKey, p.commands)
+	buildSucceeded = p.tunnelEnded(ctx, session, channel, buildError)
+}
+
+// tunnelEnded tells the client how its session's tunnel ended when the
+// proxy ended it, and reports whether the session succeeded
+func (p *SSHProxy) tunnelEnded(ctx context.Context, session *ProxySession, channel ssh.Channel, err error) bool {
+	if errors.Is(err, errProxyShuttingDown) {
+		log.Ctx(ctx).Info().Msg("Session handed off during shutdown, asking client to retry")
+		notifyRetry(channel)
+	} else if errors.Is(err, errSessionLimit) {
+		p.reportFailure(ctx, session, channel, err)
+	} else if errors.Is(err, errIdleTimeout) {
+		log.Ctx(ctx).Info().Msg("Idle session closed, deleting its build request")
+	} else if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to route to builder")
 	} else {
-		buildSucceeded = true
+		return true
+	}
+	return false
+}
+
+// provisionBuilder creates the connection's build request and waits for its
+// builder, reporting progress to the channel that asked for it
+func (p *SSHProxy) provisionBuilder(ctx context.Context, session *ProxySession, buildReq *v1alpha1.NixBuildRequest, channel ssh.Channel) (string, error) {
+	if err := p.createBuildRequest(ctx, session, buildReq); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Failed to create build request")
+		return "", err
+	}
+	go p.sendHeartbeats(ctx, session, buildReq.Name)
+
+	podIP, err := p.waitForBuilderPod(ctx, session, buildReq.Name, channel.Stderr())
+	for attempt := 1; errcode.Of(err) == errcode.Preempted && attempt <= p.preemptionRetries; attempt++ {
+		log.Ctx(ctx).Info().Int("attempt", attempt).Msg("Builder preempted, provisioning another")
+		fmt.Fprintf(channel.Stderr(), "nix-remote-build-proxy: builder was preempted, provisioning another (attempt %d of %d)\r\n", attempt, p.preemptionRetries)
+		if err = p.reprovisionBuildRequest(ctx, session, buildReq); err == nil {
+			podIP, err = p.waitForBuilderPod(ctx, session, buildReq.Name, channel.Stderr())
+		}
 	}
+	return podIP, err
 }
 
-func (p *SSHProxy) createBuildRequest(ctx context.Context, session *ProxySession) error {
+// newBuildRequest returns the build request a session channel will create
+func (p *SSHProxy) newBuildRequest(session *ProxySession) *v1alpha1.NixBuildRequest {
 	buildReq := &v1alpha1.NixBuildRequest{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      fmt.Sprintf("build-%s", session.ID),
-			Namespace: p.namespace,
+			Namespace: p.sessionNamespace(session),
+			Annotations: map[string]string{
+				policy.RequesterAnnotation:          session.Principal,
+				policy.ClientAddressAnnotation:      session.SSHConn.RemoteAddr().String(),
+				v1alpha1.SessionHeartbeatAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
 		},
 		Spec: v1alpha1.NixBuildRequestSpec{
-			SessionID: session.ID,
+			SessionID:        session.ID,
+			System:           systemFromUser(session.SSHConn.User()),
+			BuildClass:       buildClassFromUser(session.SSHConn.User()),
+			RequiredFeatures: featuresFromUser(session.SSHConn.User()),
+			RequestedBy: &v1alpha1.Requester{
+				User:           session.Principal,
+				KeyFingerprint: session.KeyFingerprint,
+			},
 		},
 	}
-
-	if err := p.k8sClient.Create(ctx, buildReq); err != nil {
-		return fmt.Errorf("failed to create NixBuildRequest: %w", err)
+	if requester := v1alpha1.RequesterLabelValue(session.Principal); requester != "" {
+		buildReq.Labels = map[string]string{v1alpha1.RequestedByLabel: requester}
 	}
-
-	log.Info().Str("session_id", session.ID).Msg("Created NixBuildRequest")
-	return nil
+	if session.KeyFingerprint != "" {
+		buildReq.Annotations[policy.KeyFingerprintAnnotation] = session.KeyFingerprint
+		if p.builders != nil {
+			buildReq.Spec.ClientID = session.KeyFingerprint
+		}
+	}
+	if p.proxyID != "" {
+		if buildReq.Labels == nil {
+			buildReq.Labels = make(map[string]string)
+		}
+		buildReq.Labels[v1alpha1.ProxyLabel] = p.proxyID
+		buildReq.Annotations[v1alpha1.ProxyInstanceAnnotation] = p.instanceID
+	}
+	if p.proxyPod != "" {
+		buildReq.Annotations[v1alpha1.ProxyInstanceAnnotation] = p.instanceID
+		buildReq.Annotations[v1alpha1.ProxyPodAnnotation] = p.proxyPod
+		buildReq.Annotations[v1alpha1.ProxyPodUIDAnnotation] = p.proxyPodUID
+	}
+	return buildReq
 }
 
-func (p *SSHProxy) completeBuildRequest(sessionID string, succeeded bool, buildErr error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	buildReqName := fmt.Sprintf("build-%s", sessionID)
-	var buildReq v1alpha1.NixBuildRequest
+// identity names this proxy in the admin API: its pod when known, otherwise
+// its proxy ID
+func (p *SSHProxy) identity() string {
+	if p.proxyPod != "" {
+		return p.proxyPod
+	}
+	return p.proxyID
+}
 
-	if err := p.k8sClient.Get(ctx, client.ObjectKey{
-		Namespace: p.namespace,
-		Name:      buildReqName,
-	}, &buildReq); err != nil {
-		log.Error().Err(err).Str("session_id", sessionID).Msg("Failed to get build request for completion")
-		return
+// systemFromUser infers the Nix system a client wants from its SSH user name.
+// "nix-aarch64" selects aarch64-linux and "nix-x86_64-linux" selects
+// x86_64-linux; other user names leave the system unset.
+func systemFromUser(user string) string {
+	user, _, _ = strings.Cut(user, "+")
+	system, ok := strings.CutPrefix(user, "nix-")
+	if !ok || system == "" {
+		return ""
 	}
+	if !strings.Contains(system, "-") {
+		system += "-linux"
+	}
+	return system
+}
 
-	now := metav1.Now()
-	if succeeded {
-		buildReq.Status.Phase = v1alpha1.BuildPhaseCompleted
-		buildReq.Status.Message = "Build completed successfully"
-	} else {
-		buildReq.Status.Phase = v1alpha1.BuildPhaseFailed
-		if buildErr != nil {
-			buildReq.Status.Message = fmt.Sprintf("Build failed: %v", buildErr)
-		} else {
-			buildReq.Status.Message = "Build failed"
+// buildClassFromUser reads the build class a client asked for by appending
+// it to its SSH user name, as in "nixbld+best-effort"
+func buildClassFromUser(user string) v1alpha1.BuildClass {
+	_, options, _ := strings.Cut(user, "+")
+	for option := range strings.SplitSeq(options, "+") {
+		if option == string(v1alpha1.BuildClassBestEffort) {
+			return v1alpha1.BuildClassBestEffort
 		}
 	}
-	buildReq.Status.CompletionTime = &now
+	return ""
+}
 
-	if err := p.k8sClient.Status().Update(ctx, &buildReq); err != nil {
-		log.Error().Err(err).Str("session_id", sessionID).Msg("Failed to update build request status")
+// featuresFromUser reads the Nix system features a client needs from the
+// options appended to its SSH user name, as in "nix-x86_64-linux+kvm".
+// Options naming a build class are not features.
+func featuresFromUser(user string) []string {
+	_, options, _ := strings.Cut(user, "+")
+	var features []string
+	for option := range strings.SplitSeq(options, "+") {
+		if option != "" && option != string(v1alpha1.BuildClassBestEffort) {
+			features = append(features, option)
+		}
 	}
+	return features
+}
+
+func (p *SSHProxy) createBuildRequest(ctx context.Context, session *ProxySession, buildReq *v1alpha1.NixBuildRequest) error {
+	ctx, span := tracing.Start(ctx, tracer, "build_request.create", attribute.String("nix.build_request", buildReq.Name))
+	defer span.End()
 
-	if err := p.k8sClient.Delete(ctx, &buildReq); err != nil {
-		log.Error().Err(err).Str("session_id", sessionID).Msg("Failed to delete build request")
+	if err := p.k8sClient.Create(ctx, buildReq); err != nil {
+		// An admission webhook refusing the request, such as the
+		// controller's policy webhook, tells the client why
+		if apierrors.IsForbidden(err) {
+			err = errcode.Errorf(errcode.Auth, "build request refused: %w", err)
+		} else {
+			err = fmt.Errorf("failed to create NixBuildRequest: %w", err)
+		}
+		tracing.Fail(span, err)
+		return err
 	}
 
-	log.Info().
-		Str("session_id", sessionID).
-		Bool("succeeded", succeeded).
-		Msg("Build request completed and marked for deletion")
+	log.Ctx(ctx).Info().Msg("Created NixBuildRequest")
+	return nil
 }
 
-func (p *SSHProxy) waitForBuilderPod(ctx context.Context, session *ProxySession) (string, error) {
-	buildReqName := fmt.Sprintf("build-%s", session.ID)
+// waitForBuilderPod waits for a build request's builder and returns its IP.
+// While the request is queued the wait is bounded by the queue timeout
+// alone; the client is kept alive and, when progress is set, told its queue
+// position.
+func (p *SSHProxy) waitForBuilderPod(ctx context.Context, session *ProxySession, buildReqName string, progress io.Writer) (podIP string, err error) {
+	ctx, span := tracing.Start(ctx, tracer, "builder.wait", attribute.String("nix.build_request", buildReqName))
+	defer func() { tracing.End(span, err) }()
+
+	events, stop := p.builds.watch(buildReqName)
+	defer stop()
+
+	timeout := time.NewTimer(builderReadyTimeout)
+	defer timeout.Stop()
+	keepAlive := time.NewTicker(queueKeepAliveInterval)
+	defer keepAlive.Stop()
+	queued := false
+	var position int32
+	// queueDeadline fires the queue timeout after the request was first
+	// queued and fails the wait if it is still queued then
+	var queueDeadline <-chan time.Time
 
-	timeout := time.After(time.Minute * 2)
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+	var buildReq v1alpha1.NixBuildRequest
+	current := &buildReq
+	if err := p.builds.get(ctx, client.ObjectKey{Namespace: p.sessionNamespace(session), Name: buildReqName}, &buildReq); err != nil {
+		current = nil
+	}
+	var reschedules int32
+	if current != nil {
+		reschedules = current.Status.Reschedules
+	}
 
 	for {
+		if current != nil {
+			// A builder lost with its spot node is replaced, which gets as
+			// long to become ready as the first one did
+			if current.Status.Reschedules > reschedules {
+				reschedules = current.Status.Reschedules
+				if !queued {
+					timeout.Reset(builderReadyTimeout)
+				}
+				if progress != nil {
+					fmt.Fprintf(progress, "nix-remote-build-proxy: builder was lost, waiting for its replacement\r\n")
+				}
+			}
+			switch {
+			case current.Status.Phase == v1alpha1.BuildPhaseRunning && current.Status.PodIP != "":
+				p.sessions.update(session, func() {
+					session.BuilderPod = current.Status.PodName
+					session.BuilderNamespace = current.Status.BuilderNamespace
+					session.BuilderUser = current.Status.BuilderUser
+					session.BuilderHostKey = current.Status.HostKey
+				})
+				p.recordBuilderCPU(ctx, session, current.Status.PodName)
+				log.Ctx(ctx).Info().Str("pod_ip", current.Status.PodIP).Msg("Builder pod ready")
+				return current.Status.PodIP, nil
+			case current.Status.Phase == v1alpha1.BuildPhaseFailed:
+				code, text := errcode.Parse(current.Status.Message)
+				if code == "" {
+					code = errcode.Builder
+				}
+				return "", errcode.Errorf(code, "build request failed: %s", text)
+			case current.Status.Phase == v1alpha1.BuildPhaseQueued:
+				if !queued {
+					queued = true
+					timeout.Stop()
+					if p.queueTimeout > 0 && queueDeadline == nil {
+						queueTimer := time.NewTimer(p.queueTimeout)
+						defer queueTimer.Stop()
+						queueDeadline = queueTimer.C
+					}
+				}
+				if progress != nil && current.Status.QueuePosition != position {
+					fmt.Fprintf(progress, "nix-remote-build-proxy: waiting for a builder, position %d in queue\r\n", current.Status.QueuePosition)
+				}
+				position = current.Status.QueuePosition
+			case queued:
+				queued = false
+				timeout.Reset(builderReadyTimeout)
+			}
+		}
+
 		select {
 		case <-ctx.Done():
-			return "", ctx.Err()
-		case <-timeout:
-			return "", fmt.Errorf("timeout waiting for builder pod")
-		case <-ticker.C:
-			var buildReq v1alpha1.NixBuildRequest
-			if err := p.k8sClient.Get(ctx, client.ObjectKey{
-				Namespace: p.namespace,
-				Name:      buildReqName,
-			}, &buildReq); err != nil {
+			return "", context.Cause(ctx)
+		case <-timeout.C:
+			return "", builderTimeout(current)
+		case <-queueDeadline:
+			if queued {
+				return "", errcode.Errorf(errcode.Quota, "no builder became available after %s in the queue", p.queueTimeout)
+			}
+		case <-keepAlive.C:
+			if !queued {
 				continue
 			}
+			if _, _, err := session.SSHConn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				return "", errClientDisconnected
+			}
+		case event := <-events:
+			if event.BuildRequest == nil {
+				return "", errcode.Errorf(errcode.Builder, "build request %s was deleted", buildReqName)
+			}
+			current = event.BuildRequest
+		}
+	}
+}
 
-			if buildReq.Status.Phase == v1alpha1.BuildPhaseRunning && buildReq.Status.PodIP != "" {
-				log.Info().Str("session_id", session.ID).Str("pod_ip", buildReq.Status.PodIP).Msg("Builder pod ready")
-				return buildReq.Status.PodIP, nil
+// builderTimeout explains why a build request was not ready in time
+func builderTimeout(buildReq *v1alpha1.NixBuildRequest) error {
+	if buildReq != nil {
+		for _, cond := range buildReq.Status.Conditions {
+			if cond.Type == v1alpha1.BuildConditionPodScheduled && cond.Status == corev1.ConditionFalse {
+				return errcode.Errorf(errcode.Unschedulable, "builder pod could not be scheduled: %s", cond.Message)
 			}
 		}
 	}
+	return errcode.Errorf(errcode.Timeout, "timeout waiting for builder pod")
 }
 
-func (p *SSHProxy) routeToBuilder(ctx context.Context, session *ProxySession, channel ssh.Channel, requests <-chan *ssh.Request, podIP string) error {
-	builderAddr := fmt.Sprintf("%s:%d", podIP, p.remotePort)
+func (p *SSHProxy) routeToBuilder(ctx context.Context, session *ProxySession, channel ssh.Channel, requests <-chan *ssh.Request, buildReqName, podIP string, clientKey ssh.Signer, commands *CommandPolicy) error {
+	if !session.limits.acquireGoroutines(tunnelGoroutines) {
+		return errSessionLimit
+	}
+	defer session.limits.releaseGoroutines(tunnelGoroutines)
 
-	builderConn, err := ssh.Dial("tcp", builderAddr, &ssh.ClientConfig{
-		User:            p.remoteUser,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(p.clientKey)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         time.Second * 10,
-	})
+	builderConn, builderAddr, err := p.dialBuilder(ctx, session, podIP, clientKey)
 	if err != nil {
-		return fmt.Errorf("failed to connect to builder pod: %w", err)
+		return err
 	}
 	defer builderConn.Close()
+	return p.tunnel(ctx, session, channel, requests, buildReqName, builderConn, builderAddr, commands)
+}
+
+// tunnel relays a client's session channel to a new session channel on
+// builderConn until either side ends it. buildReqName, when set, names the
+// build request whose builder is watched for loss.
+func (p *SSHProxy) tunnel(ctx context.Context, session *ProxySession, channel ssh.Channel, requests <-chan *ssh.Request, buildReqName string, builderConn *ssh.Client, builderAddr string, commands *CommandPolicy) error {
+	tracked := &exitChannel{Channel: channel}
+	channel = tracked
 
 	builderChannel, builderRequests, err := builderConn.OpenChannel("session", nil)
 	if err != nil {
@@ -476,14 +1403,21 @@ func (p *SSHProxy) routeToBuilder(ctx context.Context, session *ProxySession, ch
 	}
 	defer builderChannel.Close()
 
-	log.Info().Str("session_id", session.ID).Str("builder_addr", builderAddr).Msg("Connected to builder pod")
+	if !p.markSessionConnected(session) {
+		return errProxyShuttingDown
+	}
+
+	log.Ctx(ctx).Info().Str("builder_addr", builderAddr).Msg("Connected to builder")
+
+	ctx, span := tracing.Start(ctx, tracer, "builder.tunnel", attribute.String("nix.builder_addr", builderAddr))
+	defer span.End()
 
 	tunnelCtx, tunnelCancel := context.WithCancel(ctx)
 	defer tunnelCancel()
 
 	var wg sync.WaitGroup
 
-	errChan := make(chan error, 4)
+	errChan := make(chan error, 5)
 
 	go func() {
 		<-tunnelCtx.Done()
@@ -491,26 +1425,62 @@ func (p *SSHProxy) routeToBuilder(ctx context.Context, session *ProxySession, ch
 		builderChannel.Close()
 	}()
 
+	session.touch()
+	go p.watchIdle(tunnelCtx, session, channel, errChan, tunnelCancel)
+	if buildReqName != "" {
+		go p.watchBuilder(tunnelCtx, session, buildReqName, channel, errChan, tunnelCancel)
+	}
+
 	// Forward requests: client -> builder
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		p.forwardRequests(tunnelCtx, requests, builderChannel, session.ID, "client->builder")
+		check := func(req *ssh.Request) error {
+			var err error
+			if commands != nil {
+				err = commands.check(req)
+			}
+			session.auditRequest(req, err != nil)
+			return err
+		}
+		if err := p.forwardRequests(tunnelCtx, requests, builderChannel, "client->builder", check); err != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("Refused session request")
+			fmt.Fprintf(channel.Stderr(), "nix-remote-build-proxy: %s\r\n", err)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+			errChan <- err
+			tunnelCancel()
+		}
 	}()
 
+	// The client is sent EOF once both of the builder's output streams
+	// ended, since no stderr data may follow it, and once the builder's
+	// channel closed, so that a builder that went away without an exit
+	// status can be explained first
+	var openOutputs atomic.Int32
+	openOutputs.Store(3)
+	outputDone := func() {
+		if openOutputs.Add(-1) == 0 {
+			if !tracked.exited.Load() && tunnelCtx.Err() == nil {
+				p.reportBuilderExit(tunnelCtx, session, channel, builderAddr)
+			}
+			channel.CloseWrite()
+		}
+	}
+
 	// Forward requests: builder -> client
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		p.forwardRequests(tunnelCtx, builderRequests, channel, session.ID, "builder->client")
+		defer outputDone()
+		p.forwardRequests(tunnelCtx, builderRequests, channel, "builder->client", nil)
 	}()
 
 	// Forward data: client -> builder
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		n, err := io.Copy(builderChannel, channel)
-		log.Debug().Str("session_id", session.ID).Int64("bytes", n).Err(err).Msg("client->builder copy finished")
+		n, err := io.Copy(builderChannel, activityReader{channel, session, &session.bytesIn})
+		log.Ctx(ctx).Debug().Int64("bytes", n).Err(err).Msg("client->builder copy finished")
 		if err != nil && err != io.EOF && tunnelCtx.Err() == nil {
 			errChan <- fmt.Errorf("client->builder copy: %w", err)
 		}
@@ -523,28 +1493,28 @@ func (p *SSHProxy) routeToBuilder(ctx context.Context, session *ProxySession, ch
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		n, err := io.Copy(channel, builderChannel)
-		log.Debug().Str("session_id", session.ID).Int64("bytes", n).Err(err).Msg("builder->client stdout copy finished")
+		defer outputDone()
+		n, err := io.Copy(channel, activityReader{builderChannel, session, &session.bytesOut})
+		log.Ctx(ctx).Debug().Int64("bytes", n).Err(err).Msg("builder->client stdout copy finished")
 		if err != nil && err != io.EOF && tunnelCtx.Err() == nil {
 			errChan <- fmt.Errorf("builder->client copy: %w", err)
 		}
-		if cw, ok := channel.(interface{ CloseWrite() error }); ok {
-			cw.CloseWrite()
-		}
 	}()
 
-	// Forward stderr: builder -> client
-	// TODO: log only for debugging
+	// Forward stderr: builder -> client. Programs such as scp and sftp
+	// report errors on it; the start is kept for the proxy's log.
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		stderrData, err := io.ReadAll(builderChannel.Stderr())
-		log.Debug().Str("session_id", session.ID).Int("bytes", len(stderrData)).Err(err).Msg("builder->client stderr copy finished")
+		defer outputDone()
+		head := &headBuffer{max: stderrLogBytes}
+		n, err := io.Copy(io.MultiWriter(channel.Stderr(), head), activityReader{builderChannel.Stderr(), session, &session.bytesOut})
+		log.Ctx(ctx).Debug().Int64("bytes", n).Err(err).Msg("builder->client stderr copy finished")
 		if err != nil && err != io.EOF && tunnelCtx.Err() == nil {
 			errChan <- fmt.Errorf("builder->client stderr: %w", err)
 		}
-		if len(stderrData) > 0 {
-			log.Warn().Str("session_id", session.ID).Str("stderr", string(stderrData)).Msg("Builder stderr output")
+		if head.Len() > 0 {
+			log.Ctx(ctx).Warn().Str("stderr", head.String()).Int64("bytes", n).Msg("Builder stderr output")
 		}
 	}()
 
@@ -553,26 +1523,156 @@ func (p *SSHProxy) routeToBuilder(ctx context.Context, session *ProxySession, ch
 
 	select {
 	case err := <-errChan:
-		log.Debug().Str("session_id", session.ID).Err(err).Msg("Build session ended with error")
+		log.Ctx(ctx).Debug().Err(err).Msg("Build session ended with error")
+		tracing.Fail(span, err)
 		return err
 	default:
-		log.Info().Str("session_id", session.ID).Str("builder_addr", builderAddr).Msg("Build session completed successfully")
+		log.Ctx(ctx).Info().Str("builder_addr", builderAddr).Msg("Build session completed successfully")
 		return nil
 	}
 }
 
-func (p *SSHProxy) forwardRequests(ctx context.Context, src <-chan *ssh.Request, dst ssh.Channel, sessionID, direction string) {
+// stderrLogBytes is how much of a builder's stderr the proxy logs
+const stderrLogBytes = 4 << 10
+
+// headBuffer keeps the first max bytes written to it and discards the rest
+type headBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *headBuffer) Write(data []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		b.Buffer.Write(data[:min(len(data), room)])
+	}
+	return len(data), nil
+}
+
+// dialBuilder opens an SSH connection to a builder pod as the session's
+// builder user, authenticating with clientKey
+func (p *SSHProxy) dialBuilder(ctx context.Context, session *ProxySession, podIP string, clientKey ssh.Signer) (_ *ssh.Client, _ string, err error) {
+	ctx, span := tracing.Start(ctx, tracer, "builder.dial", attribute.String("nix.builder_pod", session.BuilderPod), attribute.Bool("nix.builder_tls", p.builderTLS != ""))
+	defer func() { tracing.End(span, err) }()
+
+	user := p.remoteUser
+	if session.BuilderUser != "" {
+		user = session.BuilderUser
+	}
+	hostKeyCallback, err := p.builderHostKeyCallback(session)
+	if err != nil {
+		return nil, "", err
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         time.Second * 10,
+	}
+
+	target := BuilderTarget{Pod: session.BuilderPod, Namespace: p.builderNamespace(session), IP: podIP}
+	port := p.remotePort
+	if p.builderTLS != "" {
+		port = p.builderTLSPort
+	}
+	builderAddr := p.resolver.Address(target, port)
+	dialCtx, cancel := context.WithTimeout(ctx, clientConfig.Timeout)
+	defer cancel()
+	conn, err := p.resolver.Dial(dialCtx, target, port)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to connect to builder pod at %s: %w", builderAddr, err)
+	}
+	if p.builderTLS != "" {
+		conn, err = p.builderTLSConn(dialCtx, session, conn)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to connect to builder pod at %s: TLS handshake failed: %w", builderAddr, err)
+		}
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, builderAddr, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("failed to connect to builder pod at %s: %w", builderAddr, err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), builderAddr, nil
+}
+
+// builderNamespace returns the namespace of a session's builder pod
+func (p *SSHProxy) builderNamespace(session *ProxySession) string {
+	if session.BuilderNamespace != "" {
+		return session.BuilderNamespace
+	}
+	return p.sessionNamespace(session)
+}
+
+// builderHostKeyCallback pins the host key the controller generated for the
+// session's builder, so nothing else answering on the pod's IP can read the
+// session's traffic
+func (p *SSHProxy) builderHostKeyCallback(session *ProxySession) (ssh.HostKeyCallback, error) {
+	if p.insecureHostKeys {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	if session.BuilderHostKey == "" {
+		return nil, fmt.Errorf("no host key recorded for builder %s", session.BuilderPod)
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(session.BuilderHostKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key of builder %s: %w", session.BuilderPod, err)
+	}
+	return ssh.FixedHostKey(hostKey), nil
+}
+
+// builderTLSConn wraps a connection to a builder's mutual TLS listener,
+// verifying the builder's certificate against its pod name
+func (p *SSHProxy) builderTLSConn(ctx context.Context, session *ProxySession, conn net.Conn) (net.Conn, error) {
+	// The client certificate is read on every dial so renewals by the
+	// controller are picked up without restarting the proxy
+	var secret corev1.Secret
+	if err := p.k8sClient.Get(ctx, client.ObjectKey{
+		Namespace: p.sessionNamespace(session),
+		Name:      certs.ProxySecretName(p.builderTLS),
+	}, &secret); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to get proxy TLS secret: %w", err)
+	}
+
+	tlsConfig, err := certs.ClientTLSConfig(&secret)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConfig.ServerName = session.BuilderPod
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// forwardRequests relays channel requests from src to dst until src closes.
+// A request check refuses is answered with a failure and ends forwarding with
+// check's error.
+func (p *SSHProxy) forwardRequests(ctx context.Context, src <-chan *ssh.Request, dst ssh.Channel, direction string, check func(*ssh.Request) error) error {
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		case req, ok := <-src:
 			if !ok {
-				return
+				return nil
 			}
 
-			log.Debug().
-				Str("session_id", sessionID).
+			if check != nil {
+				if err := check(req); err != nil {
+					if req.WantReply {
+						req.Reply(false, nil)
+					}
+					return err
+				}
+			}
+
+			log.Ctx(ctx).Debug().
 				Str("request_type", req.Type).
 				Str("direction", direction).
 				Bool("want_reply", req.WantReply).
@@ -580,9 +1680,8 @@ func (p *SSHProxy) forwardRequests(ctx context.Context, src <-chan *ssh.Request,
 
 			accepted, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
 			if err != nil {
-				log.Debug().
+				log.Ctx(ctx).Debug().
 					Err(err).
-					Str("session_id", sessionID).
 					Str("request_type", req.Type).
 					Str("direction", direction).
 					Msg("Request forward failed")
@@ -598,41 +1697,30 @@ func (p *SSHProxy) forwardRequests(ctx context.Context, src <-chan *ssh.Request,
 	}
 }
 
-func generateHostKey() (ssh.Signer, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, err
+// checkKubernetes asks the API server whether the proxy may create build
+// requests, which fails both when the API server cannot be reached and when
+// the proxy's credentials stopped working
+func (p *SSHProxy) checkKubernetes(ctx context.Context) error {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: p.namespace,
+				Verb:      "create",
+				Group:     v1alpha1.GroupVersion.Group,
+				Resource:  "nixbuildrequests",
+			},
+		},
 	}
-
-	privateKeyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	if err := p.k8sClient.Create(ctx, review); err != nil {
+		return err
 	}
-
-	privateKeyBytes := pem.EncodeToMemory(privateKeyPEM)
-	return ssh.ParsePrivateKey(privateKeyBytes)
-}
-
-func loadHostKey(path string) (ssh.Signer, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	if !review.Status.Allowed {
+		return fmt.Errorf("not allowed to create build requests in %s: %s", p.namespace, review.Status.Reason)
 	}
-	defer file.Close()
-
-	keyBytes, err := io.ReadAll(file)
-	if err != nil {
-		return nil, err
-	}
-
-	return ssh.ParsePrivateKey(keyBytes)
-}
-
-func generateSessionID() string {
-	return uuid.Must(uuid.NewV7()).String()
+	return nil
 }
 
-func (p *SSHProxy) startHealthServer(port int) error {
+func (p *SSHProxy) startHealthServer(port int, tlsConfig *tls.Config) {
 	mux := http.NewServeMux()
 
 	// Liveness probe - "is the process running?"
@@ -642,28 +1730,55 @@ func (p *SSHProxy) startHealthServer(port int) error {
 	})
 
 	// Readiness probe - "can you handle new requests?"
-	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-		if p.shuttingDown.Load() {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("shutting down"))
-			return
-		}
+	mux.Handle(readiness.Path, readiness.Handler(
+		readiness.WhileUnset("shutdown", &p.shuttingDown, "shutting down"),
+		readiness.WhileSet("ssh-listener", &p.accepting, "not accepting SSH connections"),
+		readiness.Check{Name: "kubernetes", Run: p.checkKubernetes},
+	))
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ready"))
-	})
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	mux.Handle("GET "+features.Path, features.Handler(p.featureReport))
 
 	p.healthServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   mux,
+		TLSConfig: tlsConfig,
 	}
 
 	go func() {
-		log.Info().Int("port", port).Msg("Health server starting")
-		if err := p.healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Info().Int("port", port).Bool("tls", tlsConfig != nil).Msg("Health server starting")
+		if err := serve(p.healthServer); err != nil && err != http.ErrServerClosed {
 			log.Error().Err(err).Msg("Health server failed")
 		}
 	}()
+}
 
-	return nil
+// adminTLSConfig loads the certificate the health and admin servers are
+// served with, or returns nil to serve them over plain HTTP
+func (p *SSHProxy) adminTLSConfig(certPath, keyPath string) (*tls.Config, error) {
+	if certPath == "" {
+		return nil, nil
+	}
+	watcher, err := certwatcher.New(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin TLS certificate: %w", err)
+	}
+	go func() {
+		if err := watcher.Start(p.connCtx); err != nil {
+			log.Error().Err(err).Msg("Admin TLS certificate watcher failed")
+		}
+	}()
+	return &tls.Config{
+		GetCertificate: watcher.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// serve runs server over HTTPS when it has a TLS config
+func serve(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
 }
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session ID formats
+const (
+	// SessionIDFormatUUID names sessions with time-ordered UUIDv7s, as in
+	// 01890a5d-ac96-774b-bcce-b302099a8057
+	SessionIDFormatUUID = "uuid"
+	// SessionIDFormatULID names sessions with lowercase ULIDs, which are
+	// shorter and still sort by creation time, as in
+	// 01h455vb4pex5vsknk084sn02q
+	SessionIDFormatULID = "ulid"
+)
+
+// maxSessionIDLength keeps session IDs usable as label values
+const maxSessionIDLength = 63
+
+var sessionIDPrefixPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// sessionIDGenerator names new sessions in the configured format, after an
+// optional prefix such as a region or team
+type sessionIDGenerator struct {
+	format string
+	prefix string
+
+	mu      sync.Mutex
+	entropy io.Reader
+}
+
+// newSessionIDGenerator returns a generator for format. A non-zero seed
+// makes the random part of the IDs repeat from run to run, for replaying
+// load tests; the time part still differs.
+func newSessionIDGenerator(format, prefix string, seed uint64) (*sessionIDGenerator, error) {
+	length := 0
+	switch format {
+	case "", SessionIDFormatUUID:
+		format, length = SessionIDFormatUUID, 36
+	case SessionIDFormatULID:
+		length = 26
+	default:
+		return nil, fmt.Errorf("unknown session ID format %q", format)
+	}
+	if prefix != "" {
+		if !sessionIDPrefixPattern.MatchString(prefix) {
+			return nil, fmt.Errorf("session ID prefix %q must be lowercase letters, digits and dashes", prefix)
+		}
+		if len(prefix)+1+length > maxSessionIDLength {
+			return nil, fmt.Errorf("session ID prefix %q is too long for %s IDs, at most %d characters", prefix, format, maxSessionIDLength-1-length)
+		}
+	}
+
+	g := &sessionIDGenerator{format: format, prefix: prefix, entropy: rand.Reader}
+	if seed != 0 {
+		g.entropy = mathrand.NewChaCha8(seedBytes(seed))
+	}
+	return g, nil
+}
+
+func seedBytes(seed uint64) [32]byte {
+	var b [32]byte
+	binary.BigEndian.PutUint64(b[:], seed)
+	return b
+}
+
+// next returns a new session ID
+func (g *sessionIDGenerator) next() string {
+	g.mu.Lock()
+	var id string
+	if g.format == SessionIDFormatULID {
+		id = newULID(time.Now(), g.entropy)
+	} else {
+		id = uuid.Must(uuid.NewV7FromReader(g.entropy)).String()
+	}
+	g.mu.Unlock()
+
+	if g.prefix != "" {
+		return g.prefix + "-" + id
+	}
+	return id
+}
+
+// crockford is the lowercase Crockford base32 alphabet used by ULIDs
+const crockford = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// newULID encodes a 48-bit millisecond timestamp followed by 80 random bits
+func newULID(now time.Time, entropy io.Reader) string {
+	var b [16]byte
+	ms := uint64(now.UnixMilli())
+	for i := range 6 {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	if _, err := io.ReadFull(entropy, b[6:]); err != nil {
+		panic(fmt.Sprintf("failed to read session ID entropy: %v", err))
+	}
+
+	// 128 bits in 26 characters of 5 bits, the first holding only 3
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestSessionIDGeneratorFormats(t *testing.T) {
+	ulids, err := newSessionIDGenerator(SessionIDFormatULID, "eu1-ci", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := ulids.next(), ulids.next()
+	if !regexp.MustCompile(`^eu1-ci-[0-9a-hjkmnp-tv-z]{26}$`).MatchString(first) {
+		t.Errorf("ULID session ID = %q, want the prefix and a lowercase ULID", first)
+	}
+	if first == second {
+		t.Errorf("generated the same session ID twice: %q", first)
+	}
+	if problems := validation.IsValidLabelValue(first); len(problems) > 0 {
+		t.Errorf("session ID %q is not a valid label value: %v", first, problems)
+	}
+
+	// A seed repeats the random part; the time part may differ
+	a, err := newSessionIDGenerator(SessionIDFormatUUID, "", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newSessionIDGenerator(SessionIDFormatUUID, "", 42)
+	if idA, idB := a.next(), b.next(); idA[len(idA)-12:] != idB[len(idB)-12:] {
+		t.Errorf("seeded IDs %q and %q do not share their random part", idA, idB)
+	}
+
+	if _, err := newSessionIDGenerator(SessionIDFormatUUID, "EU1", 0); err == nil {
+		t.Error("accepted an uppercase prefix")
+	}
+	if _, err := newSessionIDGenerator(SessionIDFormatUUID, strings.Repeat("a", 27), 0); err == nil {
+		t.Error("accepted a prefix too long for a label value")
+	}
+}
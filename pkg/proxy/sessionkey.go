@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSessionClientKey generates the key the proxy uses to log in to one
+// build request's builder and records its public half on the request. The
+// private key never leaves the proxy's memory and is dropped with the
+// session.
+func newSessionClientKey(buildReq *v1alpha1.NixBuildRequest) (ssh.Signer, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session key: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session key signer: %w", err)
+	}
+	buildReq.Spec.ClientPublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	return signer, nil
+}
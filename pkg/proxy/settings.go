@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Settings are the proxy settings that can change while it runs. They apply
+// to sessions and tunnels started after the change.
+type Settings struct {
+	// IdleTimeout ends sessions whose tunnels carry no data for this long.
+	// Zero disables it.
+	IdleTimeout time.Duration
+	// KeepAliveInterval is how often clients are sent an SSH keepalive.
+	// Zero disables keepalives.
+	KeepAliveInterval time.Duration
+}
+
+// currentSettings returns the proxy's settings as last applied
+func (p *SSHProxy) currentSettings() Settings {
+	if s := p.settings.Load(); s != nil {
+		return *s
+	}
+	return Settings{}
+}
+
+// ApplySettings replaces the proxy's settings while it runs
+func (p *SSHProxy) ApplySettings(s Settings) {
+	p.settings.Store(&s)
+	log.Info().Dur("idle_timeout", s.IdleTimeout).Dur("keepalive_interval", s.KeepAliveInterval).Msg("Applied reloaded proxy settings")
+}
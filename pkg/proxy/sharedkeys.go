@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ensureSharedKeys fills in whatever the shared key secret is missing: the
+// client keypair builders trust and the proxy's host key, creating the
+// secret if it does not exist. Writes are conditional on the version read,
+// so replicas starting together all end up with whichever keys were stored
+// first rather than each overwriting the others.
+func ensureSharedKeys(ctx context.Context, k8sClient client.Client, namespace, secretName string) error {
+	return retry.OnError(retry.DefaultBackoff, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		var secret corev1.Secret
+		err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, &secret)
+		exists := err == nil
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get secret: %w", err)
+		}
+
+		generated, err := fillSharedKeys(&secret)
+		if err != nil {
+			return err
+		}
+		if len(generated) == 0 {
+			return nil
+		}
+
+		if exists {
+			err = k8sClient.Update(ctx, &secret)
+		} else {
+			secret.ObjectMeta = metav1.ObjectMeta{Name: secretName, Namespace: namespace}
+			err = k8sClient.Create(ctx, &secret)
+		}
+		if err != nil {
+			return err
+		}
+		log.Info().Str("secret", secretName).Strs("keys", generated).Msg("Stored generated SSH keys in shared secret")
+		return nil
+	})
+}
+
+// fillSharedKeys generates the keys missing from secret and returns the
+// names of those it set
+func fillSharedKeys(secret *corev1.Secret) ([]string, error) {
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+
+	var generated []string
+	if _, ok := secret.Data[SSHKeySecretPrivateKey]; !ok {
+		private, err := generateKeyPEM("nix-builder")
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate client key: %w", err)
+		}
+		secret.Data[SSHKeySecretPrivateKey] = private
+		delete(secret.Data, SSHKeySecretPublicKey)
+		generated = append(generated, SSHKeySecretPrivateKey)
+	}
+	if _, ok := secret.Data[SSHKeySecretPublicKey]; !ok {
+		signer, err := ssh.ParsePrivateKey(secret.Data[SSHKeySecretPrivateKey])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		secret.Data[SSHKeySecretPublicKey] = ssh.MarshalAuthorizedKey(signer.PublicKey())
+		generated = append(generated, SSHKeySecretPublicKey)
+	}
+	if _, ok := secret.Data[SSHKeySecretHostKey]; !ok {
+		hostKey, err := generateKeyPEM("nix-remote-build-proxy")
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate host key: %w", err)
+		}
+		secret.Data[SSHKeySecretHostKey] = hostKey
+		generated = append(generated, SSHKeySecretHostKey)
+	}
+	return generated, nil
+}
+
+// generateKeyPEM returns a new ed25519 private key in OpenSSH format
+func generateKeyPEM(comment string) ([]byte, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(private, comment)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
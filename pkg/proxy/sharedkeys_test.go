@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// TestEnsureSharedKeysAdoptsConcurrentWrite starts a replica that finds no
+// host key while another replica stores one first, and checks that it
+// adopts the other replica's key instead of overwriting it
+func TestEnsureSharedKeysAdoptsConcurrentWrite(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := generateKeyPEM("nix-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHostKey, err := generateKeyPEM("other-replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-ssh-keys", Namespace: "default"},
+		Data:       map[string][]byte{SSHKeySecretPrivateKey: clientKey},
+	}
+
+	raced := false
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).WithInterceptorFuncs(interceptor.Funcs{
+		Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+			if !raced {
+				raced = true
+				var current corev1.Secret
+				if err := c.Get(ctx, client.ObjectKeyFromObject(obj), &current); err != nil {
+					return err
+				}
+				current.Data[SSHKeySecretPublicKey] = []byte("ssh-ed25519 AAAA other\n")
+				current.Data[SSHKeySecretHostKey] = otherHostKey
+				if err := c.Update(ctx, &current); err != nil {
+					return err
+				}
+			}
+			return c.Update(ctx, obj, opts...)
+		},
+	}).Build()
+
+	if err := ensureSharedKeys(context.Background(), k8sClient, "default", secret.Name); err != nil {
+		t.Fatalf("ensureSharedKeys: %v", err)
+	}
+
+	var got corev1.Secret
+	if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(secret), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data[SSHKeySecretHostKey], otherHostKey) {
+		t.Errorf("host key was replaced instead of adopting the other replica's")
+	}
+	if !bytes.Equal(got.Data[SSHKeySecretPrivateKey], clientKey) {
+		t.Errorf("existing client key was replaced")
+	}
+	if _, err := loadClientKeyFromSecret(context.Background(), k8sClient, "default", secret.Name); err != nil {
+		t.Errorf("client key unusable: %v", err)
+	}
+}
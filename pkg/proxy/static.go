@@ -0,0 +1,440 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Reasons a session is routed to a static builder
+const (
+	// staticReasonSystem is for systems no in-cluster builder can run
+	staticReasonSystem = "system"
+	// staticReasonCapacity is for sessions the cluster had no room for
+	staticReasonCapacity = "capacity"
+)
+
+var staticBuilderSessions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "nix_proxy_static_builder_sessions_total",
+	Help: "Sessions routed to a static builder instead of an in-cluster one, by builder and reason",
+}, []string{"builder", "reason"})
+
+// StaticBuilder is a builder outside the cluster, described by one entry of
+// a Nix machines file
+type StaticBuilder struct {
+	// User is the user to log in as; empty uses the proxy's remote user
+	User string
+	Host string
+	Port int
+	// Systems are the Nix systems the builder builds for
+	Systems []string
+	// KeyFile is the private key to log in with; empty uses the proxy's
+	// client key
+	KeyFile string
+	// Key is the private key to log in with, taking precedence over KeyFile
+	Key ssh.Signer
+	// MaxJobs is how many sessions the proxy routes to the builder at once
+	MaxJobs int
+	// SupportedFeatures and MandatoryFeatures are the builder's Nix system
+	// features; only builds requiring every mandatory feature run on it
+	SupportedFeatures []string
+	MandatoryFeatures []string
+	// HostKey is the public host key the builder must present
+	HostKey ssh.PublicKey
+}
+
+// Address returns the builder's host:port
+func (b StaticBuilder) Address() string {
+	return net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+}
+
+// LoadStaticBuilders reads the static builders of a Nix machines file
+func LoadStaticBuilders(path string) ([]StaticBuilder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	builders, err := ParseStaticBuilders(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return builders, nil
+}
+
+// ParseStaticBuilders reads builders in the format of a Nix machines file:
+// one builder per line or ';'-separated entry, with the whitespace-separated
+// fields
+//
+//	ssh://[user@]host[:port] systems key max-jobs speed-factor supported-features mandatory-features host-key
+//
+// where systems and features are comma-separated, host-key is the
+// base64-encoded public host key and '-' leaves a field at its default.
+// Speed factors are ignored.
+func ParseStaticBuilders(machines string) ([]StaticBuilder, error) {
+	var builders []StaticBuilder
+	for i, line := range strings.Split(machines, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		for entry := range strings.SplitSeq(line, ";") {
+			fields := strings.Fields(entry)
+			if len(fields) == 0 {
+				continue
+			}
+			builder, err := parseStaticBuilder(fields)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			builders = append(builders, builder)
+		}
+	}
+	return builders, nil
+}
+
+func parseStaticBuilder(fields []string) (StaticBuilder, error) {
+	field := func(i int) string {
+		if i < len(fields) && fields[i] != "-" {
+			return fields[i]
+		}
+		return ""
+	}
+	list := func(i int) []string {
+		if s := field(i); s != "" {
+			return strings.Split(s, ",")
+		}
+		return nil
+	}
+
+	builder, err := staticBuilderAt(fields[0])
+	if err != nil {
+		return StaticBuilder{}, err
+	}
+	builder.Systems = list(1)
+	builder.KeyFile = field(2)
+	builder.SupportedFeatures = list(5)
+	builder.MandatoryFeatures = list(6)
+	if len(builder.Systems) == 0 {
+		return StaticBuilder{}, fmt.Errorf("builder %q lists no systems", fields[0])
+	}
+	if s := field(3); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return StaticBuilder{}, fmt.Errorf("builder %q has an invalid max-jobs %q", fields[0], s)
+		}
+		builder.MaxJobs = n
+	}
+	if builder.HostKey, err = parseBuilderHostKey(fields[0], field(7)); err != nil {
+		return StaticBuilder{}, err
+	}
+	return builder, nil
+}
+
+// LoadExternalBuilders reads the NixExternalBuilder objects in namespace as
+// static builders, with the private key of those naming a key secret
+func LoadExternalBuilders(ctx context.Context, k8sClient client.Reader, namespace string) ([]StaticBuilder, error) {
+	var list v1alpha1.NixExternalBuilderList
+	if err := k8sClient.List(ctx, &list, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("failed to list NixExternalBuilders: %w", err)
+	}
+	builders := make([]StaticBuilder, 0, len(list.Items))
+	for i := range list.Items {
+		builder, err := externalBuilder(ctx, k8sClient, &list.Items[i])
+		if err != nil {
+			return nil, fmt.Errorf("NixExternalBuilder %s: %w", list.Items[i].Name, err)
+		}
+		builders = append(builders, builder)
+	}
+	return builders, nil
+}
+
+// externalBuilder converts a NixExternalBuilder to a static builder
+func externalBuilder(ctx context.Context, k8sClient client.Reader, external *v1alpha1.NixExternalBuilder) (StaticBuilder, error) {
+	spec := external.Spec
+	builder, err := staticBuilderAt(spec.URI)
+	if err != nil {
+		return StaticBuilder{}, err
+	}
+	if len(spec.Systems) == 0 {
+		return StaticBuilder{}, fmt.Errorf("builder %q lists no systems", spec.URI)
+	}
+	builder.Systems = spec.Systems
+	builder.SupportedFeatures = spec.SupportedFeatures
+	builder.MandatoryFeatures = spec.MandatoryFeatures
+	if spec.MaxJobs > 0 {
+		builder.MaxJobs = int(spec.MaxJobs)
+	}
+	if builder.HostKey, err = parseBuilderHostKey(spec.URI, spec.PublicHostKey); err != nil {
+		return StaticBuilder{}, err
+	}
+
+	if spec.SSHKeySecret != "" {
+		var secret corev1.Secret
+		if err := k8sClient.Get(ctx, client.ObjectKey{Namespace: external.Namespace, Name: spec.SSHKeySecret}, &secret); err != nil {
+			return StaticBuilder{}, fmt.Errorf("failed to get key secret %s: %w", spec.SSHKeySecret, err)
+		}
+		if builder.Key, err = ssh.ParsePrivateKey(secret.Data[corev1.SSHAuthPrivateKey]); err != nil {
+			return StaticBuilder{}, fmt.Errorf("failed to parse %s of key secret %s: %w", corev1.SSHAuthPrivateKey, spec.SSHKeySecret, err)
+		}
+	}
+	return builder, nil
+}
+
+// staticBuilderAt returns a builder logging in at an ssh:// or ssh-ng://
+// URI, taking one job at a time
+func staticBuilderAt(uri string) (StaticBuilder, error) {
+	address, ok := strings.CutPrefix(uri, "ssh://")
+	if !ok {
+		address, ok = strings.CutPrefix(uri, "ssh-ng://")
+	}
+	if !ok && strings.Contains(uri, "://") {
+		return StaticBuilder{}, fmt.Errorf("builder %q is not an ssh:// or ssh-ng:// URI", uri)
+	}
+
+	builder := StaticBuilder{
+		Host:    address,
+		Port:    22,
+		MaxJobs: 1,
+	}
+	if user, host, ok := strings.Cut(address, "@"); ok {
+		builder.User, builder.Host = user, host
+	}
+	if host, port, err := net.SplitHostPort(builder.Host); err == nil {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return StaticBuilder{}, fmt.Errorf("builder %q has an invalid port", uri)
+		}
+		builder.Host, builder.Port = host, n
+	}
+	if builder.Host == "" {
+		return StaticBuilder{}, fmt.Errorf("builder %q has no host", uri)
+	}
+	return builder, nil
+}
+
+// parseBuilderHostKey decodes a builder's base64-encoded public host key, returning
+// nil for none
+func parseBuilderHostKey(uri, encoded string) (ssh.PublicKey, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("builder %q has an invalid host key: %w", uri, err)
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("builder %q has an invalid host key: %w", uri, err)
+	}
+	return hostKey, nil
+}
+
+// serves reports whether the builder can run a build for system needing
+// features. An empty system is the controller's default, a Linux one.
+func (b StaticBuilder) serves(system string, features []string) bool {
+	if system == "" {
+		if !slices.ContainsFunc(b.Systems, isLinuxSystem) {
+			return false
+		}
+	} else if !slices.Contains(b.Systems, system) {
+		return false
+	}
+	for _, feature := range features {
+		if !slices.Contains(b.SupportedFeatures, feature) && !slices.Contains(b.MandatoryFeatures, feature) {
+			return false
+		}
+	}
+	for _, feature := range b.MandatoryFeatures {
+		if !slices.Contains(features, feature) {
+			return false
+		}
+	}
+	return true
+}
+
+// isLinuxSystem reports whether a Nix system can run in the cluster
+func isLinuxSystem(system string) bool {
+	return strings.HasSuffix(system, "-linux")
+}
+
+// staticBuilder is a static builder with the credentials the proxy logs in
+// with and the sessions it is serving
+type staticBuilder struct {
+	StaticBuilder
+	user   string
+	key    ssh.Signer
+	active int
+}
+
+// staticBuilders routes sessions to static builders, each serving at most
+// its MaxJobs sessions at once
+type staticBuilders struct {
+	mu       sync.Mutex
+	builders []*staticBuilder
+}
+
+// newStaticBuilders prepares builders to be logged in to as user with key,
+// unless they name their own. Builders must have a host key unless insecure
+// skips host key verification.
+func newStaticBuilders(builders []StaticBuilder, user string, key ssh.Signer, insecure bool) (*staticBuilders, error) {
+	if len(builders) == 0 {
+		return nil, nil
+	}
+	s := &staticBuilders{}
+	for _, b := range builders {
+		if b.HostKey == nil && !insecure {
+			return nil, fmt.Errorf("static builder %s has no host key", b.Address())
+		}
+		builder := &staticBuilder{StaticBuilder: b, user: user, key: key}
+		if b.User != "" {
+			builder.user = b.User
+		}
+		if b.Key != nil {
+			builder.key = b.Key
+		} else if b.KeyFile != "" {
+			data, err := os.ReadFile(b.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read key of static builder %s: %w", b.Address(), err)
+			}
+			builder.key, err = ssh.ParsePrivateKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse key of static builder %s: %w", b.Address(), err)
+			}
+		}
+		s.builders = append(s.builders, builder)
+	}
+	return s, nil
+}
+
+// serves reports whether any static builder can run a build for system
+// needing features
+func (s *staticBuilders) serves(system string, features []string) bool {
+	if s == nil {
+		return false
+	}
+	return slices.ContainsFunc(s.builders, func(b *staticBuilder) bool { return b.serves(system, features) })
+}
+
+// acquire reserves the least busy static builder that can run a build for
+// system needing features, or returns nil when all of them are busy
+func (s *staticBuilders) acquire(system string, features []string) *staticBuilder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var best *staticBuilder
+	for _, b := range s.builders {
+		if !b.serves(system, features) || b.active >= b.MaxJobs {
+			continue
+		}
+		if best == nil || b.active*best.MaxJobs < best.active*b.MaxJobs {
+			best = b
+		}
+	}
+	if best != nil {
+		best.active++
+	}
+	return best
+}
+
+// release returns a builder reserved by acquire
+func (s *staticBuilders) release(b *staticBuilder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b.active--
+}
+
+// dial opens an SSH connection to the builder
+func (s *staticBuilders) dial(ctx context.Context, b *staticBuilder) (*ssh.Client, error) {
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if b.HostKey != nil {
+		hostKeyCallback = ssh.FixedHostKey(b.HostKey)
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:            b.user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(b.key)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         time.Second * 10,
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, clientConfig.Timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dialCtx, "tcp", b.Address())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to static builder %s: %w", b.Address(), err)
+	}
+	if deadline, ok := dialCtx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, b.Address(), clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to static builder %s: %w", b.Address(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// handleStaticChannel serves a session channel whose build only a static
+// builder can run, without creating a build request
+func (p *SSHProxy) handleStaticChannel(ctx context.Context, session *ProxySession, newChannel ssh.NewChannel, buildReq *v1alpha1.NixBuildRequest) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to accept channel")
+		return
+	}
+	defer channel.Close()
+
+	log.Ctx(ctx).Info().Str("system", buildReq.Spec.System).Msg("Handling SSH session channel for a system only static builders run")
+	p.tunnelEnded(ctx, session, channel, p.routeToStaticBuilder(ctx, session, channel, requests, buildReq, staticReasonSystem))
+}
+
+// routeToStaticBuilder relays a session channel to the least busy static
+// builder that can run its build, failing the session when all of them are
+// busy or unreachable
+func (p *SSHProxy) routeToStaticBuilder(ctx context.Context, session *ProxySession, channel ssh.Channel, requests <-chan *ssh.Request, buildReq *v1alpha1.NixBuildRequest, reason string) error {
+	system := buildReq.Spec.System
+	if system == "" {
+		system = "the default system"
+	}
+	builder := p.static.acquire(buildReq.Spec.System, buildReq.Spec.RequiredFeatures)
+	if builder == nil {
+		err := errcode.Errorf(errcode.Quota, "every static builder for %s is busy", system)
+		p.reportFailure(ctx, session, channel, err)
+		return err
+	}
+	defer p.static.release(builder)
+
+	if !session.limits.acquireGoroutines(tunnelGoroutines) {
+		return errSessionLimit
+	}
+	defer session.limits.releaseGoroutines(tunnelGoroutines)
+
+	builderAddr := builder.Address()
+	log.Ctx(ctx).Info().Str("builder_addr", builderAddr).Str("reason", reason).Msg("Routing session to static builder")
+	staticBuilderSessions.WithLabelValues(builderAddr, reason).Inc()
+	p.sessions.update(session, func() {
+		session.StaticBuilder = builderAddr
+	})
+
+	builderConn, err := p.static.dial(ctx, builder)
+	if err != nil {
+		err = errcode.Errorf(errcode.Builder, "%v", err)
+		p.reportFailure(ctx, session, channel, err)
+		return err
+	}
+	defer builderConn.Close()
+	return p.tunnel(ctx, session, channel, requests, "", builderConn, builderAddr, p.commands)
+}
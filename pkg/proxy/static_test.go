@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestParseStaticBuilders(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedHostKey := base64.StdEncoding.EncodeToString(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))
+
+	builders, err := ParseStaticBuilders(`
+# macOS builders
+ssh-ng://builder@mac-1.example.com aarch64-darwin,x86_64-darwin /etc/nix/mac.key 4 2 big-parallel - ` + encodedHostKey + `
+ssh://arm.example.com:2222 aarch64-linux - - - kvm kvm ` + encodedHostKey + ` ; ssh://x86.example.com x86_64-linux
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builders) != 3 {
+		t.Fatalf("parsed %d builders, want 3", len(builders))
+	}
+
+	mac := builders[0]
+	if mac.User != "builder" || mac.Address() != "mac-1.example.com:22" || mac.KeyFile != "/etc/nix/mac.key" || mac.MaxJobs != 4 {
+		t.Errorf("mac builder = %+v", mac)
+	}
+	if !slices.Equal(mac.Systems, []string{"aarch64-darwin", "x86_64-darwin"}) || !slices.Equal(mac.SupportedFeatures, []string{"big-parallel"}) {
+		t.Errorf("mac builder systems %v, features %v", mac.Systems, mac.SupportedFeatures)
+	}
+	if mac.HostKey == nil || string(mac.HostKey.Marshal()) != string(hostKey.PublicKey().Marshal()) {
+		t.Error("mac builder host key was not parsed")
+	}
+
+	arm := builders[1]
+	if arm.User != "" || arm.Address() != "arm.example.com:2222" || arm.KeyFile != "" || arm.MaxJobs != 1 {
+		t.Errorf("arm builder = %+v", arm)
+	}
+	if builders[2].Address() != "x86.example.com:22" || builders[2].HostKey != nil {
+		t.Errorf("x86 builder = %+v", builders[2])
+	}
+
+	for _, machines := range []string{
+		"https://mac.example.com aarch64-darwin",
+		"ssh://mac.example.com",
+		"ssh://mac.example.com aarch64-darwin - many",
+		"ssh://mac.example.com:ssh aarch64-darwin",
+		"ssh://mac.example.com aarch64-darwin - 1 1 - - not-a-key",
+	} {
+		if _, err := ParseStaticBuilders(machines); err == nil {
+			t.Errorf("ParseStaticBuilders(%q) succeeded", machines)
+		}
+	}
+}
+
+func TestStaticBuildersAcquireLeastBusy(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	machines := []StaticBuilder{
+		{Host: "mac-1", Port: 22, Systems: []string{"aarch64-darwin"}, MaxJobs: 1},
+		{Host: "mac-2", Port: 22, Systems: []string{"aarch64-darwin"}, MaxJobs: 2},
+		{Host: "kvm", Port: 22, Systems: []string{"x86_64-linux"}, MaxJobs: 1, SupportedFeatures: []string{"big-parallel"}, MandatoryFeatures: []string{"kvm"}},
+	}
+	if _, err := newStaticBuilders(machines, "nix", clientKey, false); err == nil {
+		t.Error("static builders without host keys were accepted")
+	}
+	s, err := newStaticBuilders(machines, "nix", clientKey, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.serves("aarch64-darwin", nil) || s.serves("x86_64-darwin", nil) {
+		t.Error("static builders serve the wrong systems")
+	}
+	if s.serves("", nil) || !s.serves("", []string{"kvm", "big-parallel"}) || s.serves("x86_64-linux", []string{"nixos-test"}) {
+		t.Error("static builders ignored system features")
+	}
+	var none *staticBuilders
+	if none.serves("aarch64-darwin", nil) {
+		t.Error("no static builders served a system")
+	}
+
+	var got []string
+	var acquired []*staticBuilder
+	for range 3 {
+		b := s.acquire("aarch64-darwin", nil)
+		if b == nil {
+			t.Fatalf("no builder after %v", got)
+		}
+		got = append(got, b.Host)
+		acquired = append(acquired, b)
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"mac-1", "mac-2", "mac-2"}) {
+		t.Errorf("acquired %v, want every job slot once", got)
+	}
+	if s.acquire("aarch64-darwin", nil) != nil {
+		t.Error("acquired a builder beyond their max jobs")
+	}
+	if acquired[0].user != "nix" || acquired[0].key != clientKey {
+		t.Error("builder did not default to the proxy's user and client key")
+	}
+
+	s.release(acquired[0])
+	if b := s.acquire("aarch64-darwin", nil); b != acquired[0] {
+		t.Error("released builder was not acquired again")
+	}
+}
+
+func TestLoadExternalBuilders(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedHostKey := base64.StdEncoding.EncodeToString(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+
+	mac := &v1alpha1.NixExternalBuilder{
+		ObjectMeta: metav1.ObjectMeta{Name: "mac-1", Namespace: "nix"},
+		Spec: v1alpha1.NixExternalBuilderSpec{
+			URI:               "ssh-ng://builder@mac-1.example.com:2222",
+			Systems:           []string{"aarch64-darwin"},
+			SSHKeySecret:      "mac-key",
+			MaxJobs:           4,
+			SupportedFeatures: []string{"big-parallel"},
+			PublicHostKey:     encodedHostKey,
+		},
+	}
+	other := &v1alpha1.NixExternalBuilder{
+		ObjectMeta: metav1.ObjectMeta{Name: "elsewhere", Namespace: "default"},
+		Spec:       v1alpha1.NixExternalBuilderSpec{URI: "ssh://x86.example.com", Systems: []string{"x86_64-linux"}},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "mac-key", Namespace: "nix"},
+		Data:       map[string][]byte{corev1.SSHAuthPrivateKey: pem.EncodeToMemory(block)},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(mac, other, secret).Build()
+
+	builders, err := LoadExternalBuilders(context.Background(), k8sClient, "nix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builders) != 1 {
+		t.Fatalf("loaded %d builders, want only the one in the namespace", len(builders))
+	}
+	b := builders[0]
+	if b.User != "builder" || b.Address() != "mac-1.example.com:2222" || b.MaxJobs != 4 || !slices.Equal(b.SupportedFeatures, []string{"big-parallel"}) {
+		t.Errorf("builder = %+v", b)
+	}
+	if b.Key == nil || string(b.Key.PublicKey().Marshal()) != string(signer.PublicKey().Marshal()) {
+		t.Error("builder key was not read from its secret")
+	}
+	if b.HostKey == nil || string(b.HostKey.Marshal()) != string(signer.PublicKey().Marshal()) {
+		t.Error("builder host key was not parsed")
+	}
+
+	mac.Spec.SSHKeySecret = "missing"
+	k8sClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(mac).Build()
+	if _, err := LoadExternalBuilders(context.Background(), k8sClient, "nix"); err == nil {
+		t.Error("loaded a builder whose key secret is missing")
+	}
+}
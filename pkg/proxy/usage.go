@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// UsageRetention is how far back usage reports reach. Usage is kept in
+// hourly buckets, so reports cover whole hours.
+const UsageRetention = 7 * 24 * time.Hour
+
+// Usage totals the builds one requester ran in one namespace
+type Usage struct {
+	Requester string `json:"requester"`
+	Namespace string `json:"namespace"`
+	// Builds counts sessions that reached a builder
+	Builds int64 `json:"builds"`
+	// CPUHours is the builders' CPU requests times how long their sessions
+	// held them
+	CPUHours float64 `json:"cpuHours"`
+	// BytesTransferred counts tunnel data in both directions
+	BytesTransferred int64 `json:"bytesTransferred"`
+}
+
+// UsageReport is the admin API's usage summary for the window ending at
+// its generation time
+type UsageReport struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	Usage []Usage   `json:"usage"`
+}
+
+type usageKey struct {
+	requester string
+	namespace string
+}
+
+// usageLedger aggregates finished sessions into hourly buckets
+type usageLedger struct {
+	mu    sync.Mutex
+	hours map[int64]map[usageKey]*Usage
+}
+
+func newUsageLedger() *usageLedger {
+	return &usageLedger{hours: map[int64]map[usageKey]*Usage{}}
+}
+
+// add counts usage in the hour containing now and drops hours older than
+// UsageRetention
+func (l *usageLedger) add(now time.Time, usage Usage) {
+	hour := now.Truncate(time.Hour).Unix()
+	oldest := now.Add(-UsageRetention).Truncate(time.Hour).Unix()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for h := range l.hours {
+		if h < oldest {
+			delete(l.hours, h)
+		}
+	}
+	bucket, ok := l.hours[hour]
+	if !ok {
+		bucket = map[usageKey]*Usage{}
+		l.hours[hour] = bucket
+	}
+	key := usageKey{usage.Requester, usage.Namespace}
+	total, ok := bucket[key]
+	if !ok {
+		total = &Usage{Requester: usage.Requester, Namespace: usage.Namespace}
+		bucket[key] = total
+	}
+	total.Builds += usage.Builds
+	total.CPUHours += usage.CPUHours
+	total.BytesTransferred += usage.BytesTransferred
+}
+
+// report sums the hours overlapping the window ending at now
+func (l *usageLedger) report(now time.Time, window time.Duration) UsageReport {
+	since := now.Add(-window).Truncate(time.Hour)
+
+	l.mu.Lock()
+	var usage []Usage
+	for h, bucket := range l.hours {
+		if h < since.Unix() {
+			continue
+		}
+		for _, u := range bucket {
+			usage = append(usage, *u)
+		}
+	}
+	l.mu.Unlock()
+
+	return UsageReport{Since: since, Until: now, Usage: MergeUsage(usage)}
+}
+
+// MergeUsage totals usage by requester and namespace, such as the reports
+// of several proxy replicas, ordering the largest CPU consumers first
+func MergeUsage(usage []Usage) []Usage {
+	totals := map[usageKey]int{}
+	merged := []Usage{}
+	for _, u := range usage {
+		key := usageKey{u.Requester, u.Namespace}
+		if i, ok := totals[key]; ok {
+			total := &merged[i]
+			total.Builds += u.Builds
+			total.CPUHours += u.CPUHours
+			total.BytesTransferred += u.BytesTransferred
+			continue
+		}
+		totals[key] = len(merged)
+		merged = append(merged, u)
+	}
+	slices.SortFunc(merged, func(a, b Usage) int {
+		if c := cmp.Compare(b.CPUHours, a.CPUHours); c != 0 {
+			return c
+		}
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Requester, b.Requester))
+	})
+	return merged
+}
+
+// recordBuilderCPU looks up the CPU requested by a session's builder pod,
+// which its usage is charged for from the first builder it reached
+func (p *SSHProxy) recordBuilderCPU(ctx context.Context, session *ProxySession, podName string) {
+	var pod corev1.Pod
+	if err := p.k8sClient.Get(ctx, client.ObjectKey{Namespace: p.builderNamespace(session), Name: podName}, &pod); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to read builder CPU request for usage reporting")
+		return
+	}
+	var cores float64
+	for _, container := range pod.Spec.Containers {
+		cores += container.Resources.Requests.Cpu().AsApproximateFloat64()
+	}
+	p.sessions.update(session, func() {
+		session.builderCPU = cores
+		if session.builderSince.IsZero() {
+			session.builderSince = time.Now()
+		}
+	})
+}
+
+// recordUsage charges a finished session to its requester
+func (p *SSHProxy) recordUsage(session *ProxySession) {
+	var builderPod string
+	var cpu float64
+	var since time.Time
+	p.sessions.update(session, func() {
+		builderPod, cpu, since = session.BuilderPod, session.builderCPU, session.builderSince
+	})
+	if builderPod == "" {
+		return
+	}
+
+	now := time.Now()
+	usage := Usage{
+		Requester:        session.Principal,
+		Namespace:        p.sessionNamespace(session),
+		Builds:           1,
+		BytesTransferred: session.bytesIn.Load() + session.bytesOut.Load(),
+	}
+	if !since.IsZero() {
+		usage.CPUHours = cpu * now.Sub(since).Hours()
+	}
+	p.usage.add(now, usage)
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUsageLedgerReportsWindow(t *testing.T) {
+	ledger := newUsageLedger()
+	now := time.Date(2025, 3, 14, 12, 30, 0, 0, time.UTC)
+
+	ledger.add(now.Add(-8*24*time.Hour), Usage{Requester: "alice", Namespace: "default", Builds: 1, CPUHours: 100})
+	ledger.add(now.Add(-48*time.Hour), Usage{Requester: "alice", Namespace: "default", Builds: 1, CPUHours: 4})
+	ledger.add(now.Add(-time.Hour), Usage{Requester: "alice", Namespace: "default", Builds: 1, CPUHours: 1, BytesTransferred: 10})
+	ledger.add(now, Usage{Requester: "alice", Namespace: "default", Builds: 1, CPUHours: 1, BytesTransferred: 5})
+	ledger.add(now, Usage{Requester: "ci", Namespace: "default", Builds: 3, CPUHours: 6})
+
+	day := ledger.report(now, 24*time.Hour)
+	if len(day.Usage) != 2 || day.Usage[0].Requester != "ci" {
+		t.Fatalf("24h usage = %+v, want ci then alice", day.Usage)
+	}
+	if alice := day.Usage[1]; alice.Builds != 2 || alice.CPUHours != 2 || alice.BytesTransferred != 15 {
+		t.Errorf("alice's 24h usage = %+v, want 2 builds, 2 CPU-hours and 15 bytes", alice)
+	}
+
+	// Usage older than the retention period is dropped
+	week := ledger.report(now, UsageRetention)
+	for _, u := range week.Usage {
+		if u.Requester == "alice" && u.Builds != 3 {
+			t.Errorf("alice's 7d usage = %+v, want 3 builds", u)
+		}
+	}
+}
+
+func TestMergeUsageRepeatedKeyAfterGrowth(t *testing.T) {
+	// Enough distinct requesters to reallocate the merged slice several
+	// times before the first one repeats
+	var usage []Usage
+	for i := range 20 {
+		usage = append(usage, Usage{Requester: fmt.Sprintf("user-%02d", i), Namespace: "default", Builds: 1, CPUHours: 1})
+	}
+	usage = append(usage,
+		Usage{Requester: "user-00", Namespace: "default", Builds: 2, CPUHours: 5, BytesTransferred: 7},
+		Usage{Requester: "user-00", Namespace: "other", Builds: 1, CPUHours: 0.5},
+	)
+
+	merged := MergeUsage(usage)
+	if len(merged) != 21 {
+		t.Fatalf("merged %d entries, want 21", len(merged))
+	}
+	if first := merged[0]; first.Requester != "user-00" || first.Namespace != "default" ||
+		first.Builds != 3 || first.CPUHours != 6 || first.BytesTransferred != 7 {
+		t.Errorf("largest consumer = %+v, want user-00 in default with 3 builds, 6 CPU-hours and 7 bytes", first)
+	}
+	for _, u := range merged[1:] {
+		if u.Requester == "user-00" && u.Namespace == "default" {
+			t.Errorf("user-00 in default merged twice: %+v", u)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/rs/zerolog/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// buildEvent is delivered to a session waiting on its build request. A nil
+// BuildRequest means the request was deleted.
+type buildEvent struct {
+	BuildRequest *v1alpha1.NixBuildRequest
+}
+
+// buildWatcher keeps an informer-backed view of the NixBuildRequests this
+// proxy serves and delivers their changes to the sessions waiting on them. A
+// single watch serves every session, so API server load does not grow with
+// the session count.
+type buildWatcher struct {
+	// run starts the watch and waits for its initial sync
+	run func(ctx context.Context) error
+	// read reads a build request from the watch's local copy
+	read func(ctx context.Context, key client.ObjectKey, buildReq *v1alpha1.NixBuildRequest) error
+
+	mu      sync.Mutex
+	waiters map[string]map[chan buildEvent]struct{}
+}
+
+// newBuildWatcher watches the build requests in namespaces labelled for
+// proxyID or shared between proxies, or every build request there when
+// proxyID is empty
+func newBuildWatcher(ctx context.Context, k8sConfig *rest.Config, scheme *runtime.Scheme, namespaces []string, proxyID string) (*buildWatcher, error) {
+	opts := cache.Options{
+		Scheme:            scheme,
+		DefaultNamespaces: make(map[string]cache.Config),
+	}
+	for _, namespace := range namespaces {
+		opts.DefaultNamespaces[namespace] = cache.Config{}
+	}
+	served, err := servedSelector(proxyID)
+	if err != nil {
+		return nil, err
+	}
+	if served != nil {
+		opts.ByObject = map[client.Object]cache.ByObject{
+			&v1alpha1.NixBuildRequest{}: {Label: served},
+		}
+	}
+	c, err := cache.New(k8sConfig, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache: %w", err)
+	}
+
+	w := &buildWatcher{
+		run: func(ctx context.Context) error {
+			go func() {
+				if err := c.Start(ctx); err != nil {
+					log.Error().Err(err).Msg("NixBuildRequest watch stopped")
+				}
+			}()
+			return apiMetrics.WaitForCacheSync(ctx, c, &v1alpha1.NixBuildRequest{})
+		},
+		read: func(ctx context.Context, key client.ObjectKey, buildReq *v1alpha1.NixBuildRequest) error {
+			return c.Get(ctx, key, buildReq)
+		},
+		waiters: make(map[string]map[chan buildEvent]struct{}),
+	}
+
+	informer, err := c.GetInformer(ctx, &v1alpha1.NixBuildRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get NixBuildRequest informer: %w", err)
+	}
+	if err := w.handle(informer); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// newClientBuildWatcher watches build requests through c, such as a fake
+// client, instead of a cache connected to an API server. It sees the build
+// requests of every namespace c serves.
+func newClientBuildWatcher(c client.WithWatch, proxyID string) (*buildWatcher, error) {
+	var opts []client.ListOption
+	served, err := servedSelector(proxyID)
+	if err != nil {
+		return nil, err
+	}
+	if served != nil {
+		opts = append(opts, client.MatchingLabelsSelector{Selector: served})
+	}
+
+	informer := toolscache.NewSharedIndexInformer(&toolscache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, _ metav1.ListOptions) (runtime.Object, error) {
+			var list v1alpha1.NixBuildRequestList
+			err := c.List(ctx, &list, opts...)
+			return &list, err
+		},
+		WatchFuncWithContext: func(ctx context.Context, _ metav1.ListOptions) (watch.Interface, error) {
+			return c.Watch(ctx, &v1alpha1.NixBuildRequestList{}, opts...)
+		},
+	}, &v1alpha1.NixBuildRequest{}, 0, toolscache.Indexers{})
+
+	w := &buildWatcher{
+		run: func(ctx context.Context) error {
+			go informer.RunWithContext(ctx)
+			if !toolscache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+				return fmt.Errorf("failed to sync NixBuildRequest watch")
+			}
+			return nil
+		},
+		read: func(ctx context.Context, key client.ObjectKey, buildReq *v1alpha1.NixBuildRequest) error {
+			obj, exists, err := informer.GetStore().GetByKey(key.String())
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return apierrors.NewNotFound(v1alpha1.GroupVersion.WithResource("nixbuildrequests").GroupResource(), key.Name)
+			}
+			obj.(*v1alpha1.NixBuildRequest).DeepCopyInto(buildReq)
+			return nil
+		},
+		waiters: make(map[string]map[chan buildEvent]struct{}),
+	}
+	if err := w.handle(informer); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// servedSelector selects the build requests labelled for proxyID or shared
+// between proxies, or returns nil to select every build request when
+// proxyID is empty
+func servedSelector(proxyID string) (labels.Selector, error) {
+	if proxyID == "" {
+		return nil, nil
+	}
+	served, err := labels.NewRequirement(v1alpha1.ProxyLabel, selection.In, []string{proxyID, v1alpha1.ProxyLabelShared})
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy ID %q: %w", proxyID, err)
+	}
+	return labels.NewSelector().Add(*served), nil
+}
+
+// handle delivers the changes informer sees to the waiters
+func (w *buildWatcher) handle(informer cache.Informer) error {
+	if _, err := informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    w.notify,
+		UpdateFunc: func(_, obj any) { w.notify(obj) },
+		DeleteFunc: w.notifyDeleted,
+	}); err != nil {
+		return fmt.Errorf("failed to watch NixBuildRequests: %w", err)
+	}
+	return nil
+}
+
+// start runs the watch until ctx ends and waits for its initial sync
+func (w *buildWatcher) start(ctx context.Context) error {
+	return w.run(ctx)
+}
+
+// watch returns a channel that receives the latest state of the named build
+// request whenever it changes, and a function to stop watching it. Only the
+// newest event is kept for a slow receiver. A build request may have several
+// watchers, such as a session waiting for its builder and the tunnels of
+// the connection's other channels.
+func (w *buildWatcher) watch(name string) (<-chan buildEvent, func()) {
+	ch := make(chan buildEvent, 1)
+
+	w.mu.Lock()
+	if w.waiters[name] == nil {
+		w.waiters[name] = make(map[chan buildEvent]struct{})
+	}
+	w.waiters[name][ch] = struct{}{}
+	w.mu.Unlock()
+
+	return ch, func() {
+		w.mu.Lock()
+		delete(w.waiters[name], ch)
+		if len(w.waiters[name]) == 0 {
+			delete(w.waiters, name)
+		}
+		w.mu.Unlock()
+	}
+}
+
+func (w *buildWatcher) notify(obj any) {
+	buildReq, ok := obj.(*v1alpha1.NixBuildRequest)
+	if !ok {
+		return
+	}
+	w.deliver(buildReq.Name, buildEvent{BuildRequest: buildReq})
+}
+
+func (w *buildWatcher) notifyDeleted(obj any) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	buildReq, ok := obj.(*v1alpha1.NixBuildRequest)
+	if !ok {
+		return
+	}
+	w.deliver(buildReq.Name, buildEvent{})
+}
+
+// deliver hands an event to the named request's waiters, replacing any
+// event they have not received yet
+func (w *buildWatcher) deliver(name string, event buildEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.waiters[name] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- event
+	}
+}
+
+// get reads a build request from the cache
+func (w *buildWatcher) get(ctx context.Context, key client.ObjectKey, buildReq *v1alpha1.NixBuildRequest) error {
+	return w.read(ctx, key, buildReq)
+}
@@ -0,0 +1,119 @@
+// Package readiness serves the /readyz endpoints of the controller and the
+// proxy from checks of the dependencies they need to serve requests, so
+// Kubernetes only routes work to replicas that can do it
+package readiness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Path is where the controller and proxy serve readiness on their health
+// port
+const Path = "/readyz"
+
+// checkTimeout bounds each check, within the readiness probe timeout of the
+// bundled deployments
+const checkTimeout = 3 * time.Second
+
+// Check is one dependency a component needs to serve requests
+type Check struct {
+	Name string
+	// Run returns nil while the dependency is usable
+	Run func(ctx context.Context) error
+}
+
+// WhileSet passes while flag is set, such as once caches have synced, and
+// otherwise fails with reason
+func WhileSet(name string, flag *atomic.Bool, reason string) Check {
+	return Check{Name: name, Run: func(context.Context) error {
+		if !flag.Load() {
+			return errors.New(reason)
+		}
+		return nil
+	}}
+}
+
+// WhileUnset passes until flag is set, such as a shutdown flag, and then
+// fails with reason
+func WhileUnset(name string, flag *atomic.Bool, reason string) Check {
+	return Check{Name: name, Run: func(context.Context) error {
+		if flag.Load() {
+			return errors.New(reason)
+		}
+		return nil
+	}}
+}
+
+// Handler runs the checks on each request. It answers 200 when every check
+// passes and 503 otherwise, with a body listing each check like the API
+// server's verbose /readyz:
+//
+//	[+]shutdown ok
+//	[-]api-server failed: connection refused
+func Handler(checks ...Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errs := run(r.Context(), checks)
+
+		var body strings.Builder
+		ready := true
+		for i, check := range checks {
+			if errs[i] != nil {
+				ready = false
+				fmt.Fprintf(&body, "[-]%s failed: %v\n", check.Name, errs[i])
+				log.Debug().Err(errs[i]).Str("check", check.Name).Msg("Readiness check failed")
+				continue
+			}
+			fmt.Fprintf(&body, "[+]%s ok\n", check.Name)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(body.String()))
+	})
+}
+
+// run runs the checks concurrently, returning their errors in order. Checks
+// still running at the timeout fail with it.
+func run(ctx context.Context, checks []Check) []error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	type result struct {
+		index int
+		err   error
+	}
+	results := make(chan result, len(checks))
+	for i, check := range checks {
+		go func() {
+			results <- result{i, check.Run(ctx)}
+		}()
+	}
+
+	errs := make([]error, len(checks))
+	done := make([]bool, len(checks))
+	for range checks {
+		select {
+		case res := <-results:
+			errs[res.index] = res.err
+			done[res.index] = true
+		case <-ctx.Done():
+			for i := range errs {
+				if !done[i] {
+					errs[i] = fmt.Errorf("no answer within %s", checkTimeout)
+				}
+			}
+			return errs
+		}
+	}
+	return errs
+}
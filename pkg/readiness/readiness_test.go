@@ -0,0 +1,78 @@
+package readiness
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHandlerReportsEachCheck(t *testing.T) {
+	var shuttingDown atomic.Bool
+	apiErr := errors.New("connection refused")
+	var apiDown atomic.Bool
+	handler := Handler(
+		WhileUnset("shutdown", &shuttingDown, "shutting down"),
+		Check{Name: "api-server", Run: func(context.Context) error {
+			if apiDown.Load() {
+				return apiErr
+			}
+			return nil
+		}},
+	)
+
+	get := func() (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, Path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, body := get(); code != http.StatusOK || body != "[+]shutdown ok\n[+]api-server ok\n" {
+		t.Errorf("healthy checks answered %d %q", code, body)
+	}
+
+	apiDown.Store(true)
+	code, body := get()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d with a failing check, want 503", code)
+	}
+	if !strings.Contains(body, "[-]api-server failed: connection refused") || !strings.Contains(body, "[+]shutdown ok") {
+		t.Errorf("body = %q, want the failing and passing checks listed", body)
+	}
+
+	apiDown.Store(false)
+	shuttingDown.Store(true)
+	if code, body := get(); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]shutdown failed: shutting down") {
+		t.Errorf("shutting down answered %d %q", code, body)
+	}
+}
+
+func TestWhileSet(t *testing.T) {
+	var synced atomic.Bool
+	check := WhileSet("informers", &synced, "caches have not synced")
+	if err := check.Run(context.Background()); err == nil || err.Error() != "caches have not synced" {
+		t.Errorf("unset flag gave %v", err)
+	}
+	synced.Store(true)
+	if err := check.Run(context.Background()); err != nil {
+		t.Errorf("set flag gave %v", err)
+	}
+}
+
+func TestRunFailsChecksThatDoNotAnswer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	release := make(chan struct{})
+	defer close(release)
+
+	errs := run(ctx, []Check{
+		{Name: "fast", Run: func(context.Context) error { return nil }},
+		{Name: "stuck", Run: func(context.Context) error { <-release; return nil }},
+	})
+	if errs[1] == nil {
+		t.Error("a check that never answered passed")
+	}
+}
@@ -0,0 +1,154 @@
+// Package status changes the status of build requests for the controller and
+// the proxy alike, so the phase, timestamps, message and conditions that
+// clients read always move together.
+package status
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+// Reasons of the conditions the helpers set
+const (
+	// ReasonSSHReady is the PodReady reason once the builder accepts SSH
+	// connections
+	ReasonSSHReady = "SSHReady"
+	// ReasonRescheduled is the PodReady reason while a lost builder pod is
+	// being replaced
+	ReasonRescheduled = "Rescheduled"
+	// ReasonValidating is the ImageValidated reason while the builder image
+	// is checked
+	ReasonValidating = "Validating"
+	// ReasonDryRun is the DryRun reason for an action a dry-run controller
+	// skipped
+	ReasonDryRun = "DryRun"
+)
+
+// SetCondition adds or updates a condition, only moving its
+// LastTransitionTime when the condition's status changes
+func SetCondition(s *v1alpha1.NixBuildRequestStatus, now metav1.Time, condType v1alpha1.BuildConditionType, condStatus corev1.ConditionStatus, reason, message string) {
+	for i := range s.Conditions {
+		cond := &s.Conditions[i]
+		if cond.Type != condType {
+			continue
+		}
+		if cond.Status != condStatus {
+			cond.LastTransitionTime = now
+		}
+		cond.Status = condStatus
+		cond.Reason = reason
+		cond.Message = message
+		return
+	}
+
+	s.Conditions = append(s.Conditions, v1alpha1.BuildCondition{
+		Type:               condType,
+		Status:             condStatus,
+		LastTransitionTime: now,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// HasCondition reports whether the status has a condition with the given
+// status
+func HasCondition(s *v1alpha1.NixBuildRequestStatus, condType v1alpha1.BuildConditionType, condStatus corev1.ConditionStatus) bool {
+	return slices.ContainsFunc(s.Conditions, func(c v1alpha1.BuildCondition) bool {
+		return c.Type == condType && c.Status == condStatus
+	})
+}
+
+// Finished reports whether the build request has reached a terminal phase
+func Finished(s *v1alpha1.NixBuildRequestStatus) bool {
+	return s.Phase == v1alpha1.BuildPhaseCompleted || s.Phase == v1alpha1.BuildPhaseFailed
+}
+
+// MarkFailed moves a build request to Failed with a message carrying the
+// failure's code, which clients recover with errcode.Parse
+func MarkFailed(s *v1alpha1.NixBuildRequestStatus, now metav1.Time, code errcode.Code, message string) {
+	s.Phase = v1alpha1.BuildPhaseFailed
+	s.CompletionTime = &now
+	s.Message = errcode.Message(code, message)
+}
+
+// MarkCompleted moves a build request to Completed
+func MarkCompleted(s *v1alpha1.NixBuildRequestStatus, now metav1.Time, message string) {
+	s.Phase = v1alpha1.BuildPhaseCompleted
+	s.CompletionTime = &now
+	s.Message = message
+}
+
+// MarkQueued moves a build request to Queued while it waits at position for
+// a builder slot
+func MarkQueued(s *v1alpha1.NixBuildRequestStatus, position int32) {
+	s.Phase = v1alpha1.BuildPhaseQueued
+	s.QueuePosition = position
+	s.Message = fmt.Sprintf("Waiting for a builder slot, position %d in queue", position)
+}
+
+// MarkValidating holds a build request while its builder image is
+// validated
+func MarkValidating(s *v1alpha1.NixBuildRequestStatus, now metav1.Time, image string) {
+	message := fmt.Sprintf("Validating builder image %s", image)
+	SetCondition(s, now, v1alpha1.BuildConditionImageValidated, corev1.ConditionFalse, ReasonValidating, message)
+	s.Message = message
+}
+
+// MarkRetrying schedules another attempt at creating a build request's
+// builder pod after delay
+func MarkRetrying(s *v1alpha1.NixBuildRequestStatus, now metav1.Time, delay time.Duration) {
+	s.NextCreateTime = &metav1.Time{Time: now.Add(delay)}
+	s.Message = "Failed to create builder pod, retrying in " + delay.String()
+}
+
+// MarkCreating moves a build request to Creating once its builder pod, or
+// the job running it, exists
+func MarkCreating(s *v1alpha1.NixBuildRequestStatus, now metav1.Time, message string) {
+	s.Phase = v1alpha1.BuildPhaseCreating
+	s.QueuePosition = 0
+	s.StartTime = &now
+	s.NextCreateTime = nil
+	s.Message = message
+}
+
+// MarkReady moves a build request to Running once its builder at podIP
+// accepts SSH connections
+func MarkReady(s *v1alpha1.NixBuildRequestStatus, now metav1.Time, podIP string) {
+	SetCondition(s, now, v1alpha1.BuildConditionPodReady, corev1.ConditionTrue, ReasonSSHReady, "Builder accepts SSH connections")
+	s.Phase = v1alpha1.BuildPhaseRunning
+	s.PodIP = podIP
+	s.SSHReadyTime = &now
+	s.Message = "Builder pod ready for connections"
+}
+
+// MarkDryRun records an action a dry-run controller skipped instead of
+// taking it
+func MarkDryRun(s *v1alpha1.NixBuildRequestStatus, now metav1.Time, action string) {
+	SetCondition(s, now, v1alpha1.BuildConditionDryRun, corev1.ConditionTrue, ReasonDryRun, action)
+	s.Message = fmt.Sprintf("Dry run: %s", action)
+}
+
+// MarkRescheduled moves a build request back to Pending after its builder
+// pod was lost, clearing what described that pod so clients wait for the
+// replacement instead of connecting to it
+func MarkRescheduled(s *v1alpha1.NixBuildRequestStatus, now metav1.Time, message string) {
+	SetCondition(s, now, v1alpha1.BuildConditionPodReady, corev1.ConditionFalse, ReasonRescheduled, message)
+	s.Phase = v1alpha1.BuildPhasePending
+	s.Reschedules++
+	s.PodName = ""
+	s.PodIP = ""
+	s.AgentEndpoint = ""
+	s.PodScheduledTime = nil
+	s.PodReadyTime = nil
+	s.SSHReadyTime = nil
+	s.CreateAttempts = 0
+	s.NextCreateTime = nil
+	s.Message = message
+}
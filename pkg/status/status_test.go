@@ -0,0 +1,257 @@
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/errcode"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var testEpoch = metav1.NewTime(time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC))
+
+func at(d time.Duration) metav1.Time {
+	return metav1.NewTime(testEpoch.Add(d))
+}
+
+// fullStatus returns a status with every field set
+func fullStatus() v1alpha1.NixBuildRequestStatus {
+	s := v1alpha1.NixBuildRequestStatus{
+		PodName:               "nix-builder-abc123",
+		BuilderNamespace:      "nix-build-0123456789abcdef",
+		JobName:               "nix-builder-abc123",
+		StartTime:             &[]metav1.Time{at(0)}[0],
+		PodScheduledTime:      &[]metav1.Time{at(time.Second)}[0],
+		PodReadyTime:          &[]metav1.Time{at(5 * time.Second)}[0],
+		ExperimentalFeatures:  []string{"flakes", "nix-command"},
+		AgentEndpoint:         "http://10.0.0.7:8080",
+		AgentTokenSecret:      "nix-builder-abc123-agent",
+		CredentialsSecret:     "nix-builder-abc123-credentials",
+		CredentialsExpireTime: &[]metav1.Time{at(15 * time.Minute)}[0],
+		BuilderUser:           "alice",
+		HostKey:               "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHostKey",
+		StoreDiff:             &v1alpha1.StoreDiff{AddedPaths: 12, AddedBytes: 4096, ObservedTime: at(time.Minute)},
+		QueuePosition:         3,
+		CreateAttempts:        2,
+		Reschedules:           1,
+		NextCreateTime:        &[]metav1.Time{at(2 * time.Second)}[0],
+		LogTail:               "error: builder for '/nix/store/abc-hello.drv' failed with exit code 1\n",
+		LogURL:                "s3://build-logs/default/abc123.log",
+	}
+	SetCondition(&s, at(time.Second), v1alpha1.BuildConditionPodScheduled, corev1.ConditionTrue, "Scheduled", "Builder pod bound to node")
+	MarkReady(&s, at(6*time.Second), "10.0.0.7")
+	MarkFailed(&s, at(time.Minute), errcode.Builder, "Builder pod disappeared")
+	return s
+}
+
+// TestStatusSchema pins the serialized status of build requests, which the
+// proxy, clients and dashboards read. Run with -update after deliberately
+// changing the schema.
+func TestStatusSchema(t *testing.T) {
+	s := fullStatus()
+
+	value := reflect.ValueOf(s)
+	for i := range value.NumField() {
+		if value.Field(i).IsZero() {
+			t.Errorf("fullStatus leaves %s unset, so the golden file does not cover it", value.Type().Field(i).Name)
+		}
+	}
+
+	got, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		t.Fatalf("failed to marshal status: %v", err)
+	}
+	got = append(got, '\n')
+
+	golden := filepath.Join("testdata", "status.golden.json")
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", golden, err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", golden, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("serialized status changed; run go test ./pkg/status -update if intended\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	var roundTrip v1alpha1.NixBuildRequestStatus
+	if err := json.Unmarshal(want, &roundTrip); err != nil {
+		t.Fatalf("failed to unmarshal %s: %v", golden, err)
+	}
+	if !apiequality.Semantic.DeepEqual(roundTrip, s) {
+		t.Errorf("golden status does not round-trip:\ngot  %+v\nwant %+v", roundTrip, s)
+	}
+}
+
+func TestEmptyStatusSchema(t *testing.T) {
+	got, err := json.Marshal(v1alpha1.NixBuildRequestStatus{})
+	if err != nil {
+		t.Fatalf("failed to marshal status: %v", err)
+	}
+	if string(got) != "{}" {
+		t.Errorf("empty status serialized as %s, want {}", got)
+	}
+}
+
+func TestSetCondition(t *testing.T) {
+	var s v1alpha1.NixBuildRequestStatus
+	SetCondition(&s, at(0), v1alpha1.BuildConditionPodReady, corev1.ConditionFalse, "SSHNotReady", "connection refused")
+	SetCondition(&s, at(time.Second), v1alpha1.BuildConditionPodReady, corev1.ConditionFalse, "SSHNotReady", "timeout")
+
+	if len(s.Conditions) != 1 {
+		t.Fatalf("got %d conditions, want 1", len(s.Conditions))
+	}
+	cond := s.Conditions[0]
+	if !cond.LastTransitionTime.Equal(&testEpoch) {
+		t.Errorf("unchanged status moved lastTransitionTime to %v", cond.LastTransitionTime)
+	}
+	if cond.Message != "timeout" {
+		t.Errorf("message = %q, want timeout", cond.Message)
+	}
+
+	SetCondition(&s, at(2*time.Second), v1alpha1.BuildConditionPodReady, corev1.ConditionTrue, ReasonSSHReady, "ready")
+	if want := at(2 * time.Second); !s.Conditions[0].LastTransitionTime.Equal(&want) {
+		t.Errorf("lastTransitionTime = %v, want %v", s.Conditions[0].LastTransitionTime, want)
+	}
+	if !HasCondition(&s, v1alpha1.BuildConditionPodReady, corev1.ConditionTrue) {
+		t.Error("PodReady is not True")
+	}
+	if HasCondition(&s, v1alpha1.BuildConditionPodReady, corev1.ConditionFalse) {
+		t.Error("PodReady is still False")
+	}
+}
+
+func TestMarkFailed(t *testing.T) {
+	s := v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhaseRunning}
+	MarkFailed(&s, at(time.Minute), errcode.Quota, "Too many builders")
+
+	if s.Phase != v1alpha1.BuildPhaseFailed || !Finished(&s) {
+		t.Errorf("phase = %s, want Failed", s.Phase)
+	}
+	if want := at(time.Minute); s.CompletionTime == nil || !s.CompletionTime.Equal(&want) {
+		t.Errorf("completionTime = %v, want %v", s.CompletionTime, want)
+	}
+	if code, text := errcode.Parse(s.Message); code != errcode.Quota || text != "Too many builders" {
+		t.Errorf("message %q parsed as %s %q", s.Message, code, text)
+	}
+}
+
+func TestMarkCompleted(t *testing.T) {
+	s := v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhaseRunning}
+	if Finished(&s) {
+		t.Error("running build request is finished")
+	}
+	MarkCompleted(&s, at(time.Minute), "Build completed successfully")
+
+	if s.Phase != v1alpha1.BuildPhaseCompleted || !Finished(&s) {
+		t.Errorf("phase = %s, want Completed", s.Phase)
+	}
+	if s.CompletionTime == nil || s.Message != "Build completed successfully" {
+		t.Errorf("got completionTime %v and message %q", s.CompletionTime, s.Message)
+	}
+}
+
+func TestMarkQueued(t *testing.T) {
+	s := v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhasePending}
+	MarkQueued(&s, 3)
+
+	if s.Phase != v1alpha1.BuildPhaseQueued || s.QueuePosition != 3 {
+		t.Errorf("phase = %s at position %d, want Queued at 3", s.Phase, s.QueuePosition)
+	}
+	if s.Message != "Waiting for a builder slot, position 3 in queue" {
+		t.Errorf("message = %q", s.Message)
+	}
+}
+
+func TestMarkValidating(t *testing.T) {
+	var s v1alpha1.NixBuildRequestStatus
+	MarkValidating(&s, at(time.Second), "builder:test")
+
+	if s.Phase != "" || s.Message != "Validating builder image builder:test" {
+		t.Errorf("got phase %q and message %q, want the phase kept and the image named", s.Phase, s.Message)
+	}
+	if !HasCondition(&s, v1alpha1.BuildConditionImageValidated, corev1.ConditionFalse) || s.Conditions[0].Reason != ReasonValidating {
+		t.Errorf("conditions = %+v, want ImageValidated False while validating", s.Conditions)
+	}
+}
+
+func TestMarkRetrying(t *testing.T) {
+	s := v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhasePending, CreateAttempts: 2}
+	MarkRetrying(&s, at(time.Minute), 4*time.Second)
+
+	if s.NextCreateTime == nil || !s.NextCreateTime.Equal(&[]metav1.Time{at(time.Minute + 4*time.Second)}[0]) {
+		t.Errorf("nextCreateTime = %v, want %v", s.NextCreateTime, at(time.Minute+4*time.Second))
+	}
+	if s.Phase != v1alpha1.BuildPhasePending || s.Message != "Failed to create builder pod, retrying in 4s" {
+		t.Errorf("got phase %q and message %q", s.Phase, s.Message)
+	}
+}
+
+func TestMarkDryRun(t *testing.T) {
+	s := v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhasePending}
+	MarkDryRun(&s, at(time.Second), "Would create builder pod nix-builder-abc123")
+
+	if s.Phase != v1alpha1.BuildPhasePending || s.Message != "Dry run: Would create builder pod nix-builder-abc123" {
+		t.Errorf("got phase %q and message %q", s.Phase, s.Message)
+	}
+	if !HasCondition(&s, v1alpha1.BuildConditionDryRun, corev1.ConditionTrue) || s.Conditions[0].Message != "Would create builder pod nix-builder-abc123" {
+		t.Errorf("conditions = %+v, want DryRun True with the action", s.Conditions)
+	}
+}
+
+func TestMarkCreating(t *testing.T) {
+	s := v1alpha1.NixBuildRequestStatus{
+		Phase:          v1alpha1.BuildPhaseQueued,
+		QueuePosition:  1,
+		NextCreateTime: &[]metav1.Time{at(time.Second)}[0],
+	}
+	MarkCreating(&s, at(time.Minute), "Builder pod created")
+
+	if s.Phase != v1alpha1.BuildPhaseCreating || Finished(&s) {
+		t.Errorf("phase = %s, want Creating", s.Phase)
+	}
+	if s.StartTime == nil || !s.StartTime.Equal(&[]metav1.Time{at(time.Minute)}[0]) {
+		t.Errorf("startTime = %v, want %v", s.StartTime, at(time.Minute))
+	}
+	if s.QueuePosition != 0 || s.NextCreateTime != nil || s.Message != "Builder pod created" {
+		t.Errorf("got queuePosition %d, nextCreateTime %v and message %q", s.QueuePosition, s.NextCreateTime, s.Message)
+	}
+}
+
+func TestMarkRescheduled(t *testing.T) {
+	s := fullStatus()
+	s.Phase = v1alpha1.BuildPhaseRunning
+	s.Message = "Builder pod ready for connections"
+	MarkRescheduled(&s, at(2*time.Minute), "Builder node was reclaimed")
+
+	if s.Phase != v1alpha1.BuildPhasePending || Finished(&s) {
+		t.Errorf("phase = %s, want Pending", s.Phase)
+	}
+	if s.PodName != "" || s.PodIP != "" || s.SSHReadyTime != nil || s.PodReadyTime != nil {
+		t.Errorf("lost pod still described: pod %q, IP %q, sshReadyTime %v", s.PodName, s.PodIP, s.SSHReadyTime)
+	}
+	if s.Reschedules != 2 || s.CreateAttempts != 0 {
+		t.Errorf("reschedules = %d and createAttempts = %d, want 2 and 0", s.Reschedules, s.CreateAttempts)
+	}
+	if !HasCondition(&s, v1alpha1.BuildConditionPodReady, corev1.ConditionFalse) {
+		t.Error("PodReady is not False")
+	}
+	if s.BuilderNamespace == "" || s.HostKey == "" {
+		t.Error("builder namespace and host key, which the replacement reuses, were cleared")
+	}
+}
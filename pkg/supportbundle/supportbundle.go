@@ -0,0 +1,310 @@
+// Package supportbundle gathers everything known about one build session
+// into a single archive that can be attached to an issue.
+package supportbundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/adminapi"
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+// Options selects the session to collect and where its components run
+type Options struct {
+	// SessionID is the proxy session the bundle describes
+	SessionID string
+	// Namespace holds the session's build request and builder pod
+	Namespace string
+	// ComponentNamespace holds the proxy and controller pods
+	ComponentNamespace string
+	// ProxyAdminURL is the base URL of a proxy's admin API. Empty skips the
+	// proxy's live session list.
+	ProxyAdminURL string
+	// ProxyAdminToken is the bearer token the proxy's admin API requires
+	ProxyAdminToken []byte
+	// LogLines is how many recent log lines are read from each pod
+	LogLines int64
+}
+
+// components are the pods whose logs are searched for the session, by their
+// deployment's component label
+var components = []string{"proxy", "controller"}
+
+// Collect writes a gzipped tar archive describing the session to w.
+// Artifacts that cannot be read are listed in errors.txt instead of failing
+// the bundle, since the session being reported may be half cleaned up.
+func Collect(ctx context.Context, c client.Client, clientset kubernetes.Interface, opts Options, w io.Writer) error {
+	b := &bundle{files: make(map[string][]byte)}
+	name := fmt.Sprintf("build-%s", opts.SessionID)
+
+	var buildReq v1alpha1.NixBuildRequest
+	podName := fmt.Sprintf("nix-builder-%s", opts.SessionID)
+	if err := c.Get(ctx, client.ObjectKey{Namespace: opts.Namespace, Name: name}, &buildReq); err != nil {
+		b.fail("buildrequest.yaml", err)
+	} else {
+		buildReq.ManagedFields = nil
+		b.addYAML("buildrequest.yaml", &buildReq)
+		if buildReq.Status.PodName != "" {
+			podName = buildReq.Status.PodName
+		}
+	}
+
+	var pod corev1.Pod
+	podFound := false
+	if err := c.Get(ctx, client.ObjectKey{Namespace: opts.Namespace, Name: podName}, &pod); err != nil {
+		b.fail("pod.yaml", err)
+	} else {
+		podFound = true
+		pod.ManagedFields = nil
+		b.addYAML("pod.yaml", &pod)
+	}
+
+	var events corev1.EventList
+	if err := c.List(ctx, &events, client.InNamespace(opts.Namespace)); err != nil {
+		b.fail("events.yaml", err)
+	} else {
+		events.Items = slices.DeleteFunc(events.Items, func(event corev1.Event) bool {
+			return event.InvolvedObject.Name != name && event.InvolvedObject.Name != podName
+		})
+		slices.SortFunc(events.Items, func(a, b corev1.Event) int {
+			return eventTime(a).Compare(eventTime(b))
+		})
+		b.addYAML("events.yaml", &events)
+	}
+
+	if opts.ProxyAdminURL != "" {
+		if data, err := proxySession(ctx, opts.ProxyAdminURL, opts.ProxyAdminToken, opts.SessionID); err != nil {
+			b.fail("proxy-session.json", err)
+		} else {
+			b.files["proxy-session.json"] = data
+		}
+	}
+
+	if podFound {
+		if data, err := podLogs(ctx, clientset, opts.Namespace, podName, opts.LogLines); err != nil {
+			b.fail("logs/builder.log", err)
+		} else {
+			b.files["logs/builder.log"] = data
+		}
+	}
+
+	var timeline []timelineEntry
+	for _, component := range components {
+		var pods corev1.PodList
+		if err := c.List(ctx, &pods, client.InNamespace(opts.ComponentNamespace), client.MatchingLabels{"component": component}); err != nil {
+			b.fail("logs/"+component, err)
+			continue
+		}
+		for _, p := range pods.Items {
+			file := fmt.Sprintf("logs/%s-%s.log", component, p.Name)
+			data, err := podLogs(ctx, clientset, opts.ComponentNamespace, p.Name, opts.LogLines)
+			if err != nil {
+				b.fail(file, err)
+				continue
+			}
+			var matched bytes.Buffer
+			for _, line := range sessionLines(data, opts.SessionID) {
+				matched.Write(line)
+				matched.WriteByte('\n')
+				timeline = append(timeline, logEntry(p.Name, line))
+			}
+			b.files[file] = matched.Bytes()
+		}
+	}
+
+	for _, condition := range buildReq.Status.Conditions {
+		timeline = append(timeline, timelineEntry{
+			time:   condition.LastTransitionTime.Time,
+			source: "condition",
+			text:   fmt.Sprintf("%s=%s %s: %s", condition.Type, condition.Status, condition.Reason, condition.Message),
+		})
+	}
+	for _, event := range events.Items {
+		timeline = append(timeline, timelineEntry{
+			time:   eventTime(event),
+			source: "event/" + event.InvolvedObject.Kind,
+			text:   fmt.Sprintf("%s %s: %s", event.Type, event.Reason, event.Message),
+		})
+	}
+	b.files["timeline.txt"] = formatTimeline(timeline)
+
+	return b.write(w, opts.SessionID)
+}
+
+type bundle struct {
+	files  map[string][]byte
+	errors []string
+}
+
+func (b *bundle) addYAML(file string, obj any) {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		b.fail(file, err)
+		return
+	}
+	b.files[file] = data
+}
+
+func (b *bundle) fail(file string, err error) {
+	if apierrors.IsNotFound(err) {
+		b.errors = append(b.errors, fmt.Sprintf("%s: not found", file))
+		return
+	}
+	b.errors = append(b.errors, fmt.Sprintf("%s: %v", file, err))
+}
+
+// write archives the collected files under a directory named after the
+// session
+func (b *bundle) write(w io.Writer, sessionID string) error {
+	if len(b.errors) > 0 {
+		b.files["errors.txt"] = []byte(strings.Join(b.errors, "\n") + "\n")
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range slices.Sorted(maps.Keys(b.files)) {
+		data := b.files[file]
+		header := &tar.Header{
+			Name:    fmt.Sprintf("support-bundle-%s/%s", sessionID, file),
+			Mode:    0o644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close archive: %w", err)
+	}
+	return gz.Close()
+}
+
+// podLogs returns the last lines of a pod's logs
+func podLogs(ctx context.Context, clientset kubernetes.Interface, namespace, name string, lines int64) ([]byte, error) {
+	stream, err := clientset.CoreV1().Pods(namespace).GetLogs(name, &corev1.PodLogOptions{TailLines: &lines}).Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+// sessionLines returns the log lines mentioning the session
+func sessionLines(data []byte, sessionID string) [][]byte {
+	var lines [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if bytes.Contains(scanner.Bytes(), []byte(sessionID)) {
+			lines = append(lines, bytes.Clone(scanner.Bytes()))
+		}
+	}
+	return lines
+}
+
+// proxySession returns the proxy's admin API entry for the session
+func proxySession(ctx context.Context, adminURL string, token []byte, sessionID string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(adminURL, "/")+"/sessions", nil)
+	if err != nil {
+		return nil, err
+	}
+	adminapi.Authorize(req, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy admin API returned %s", resp.Status)
+	}
+
+	var sessions []map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		return nil, fmt.Errorf("failed to decode sessions: %w", err)
+	}
+	for _, session := range sessions {
+		if session["id"] == sessionID {
+			return json.MarshalIndent(session, "", "  ")
+		}
+	}
+	return nil, fmt.Errorf("session is not open on this proxy")
+}
+
+type timelineEntry struct {
+	time   time.Time
+	source string
+	text   string
+}
+
+// logEntry turns a JSON log line into a timeline entry, keeping lines that
+// are not JSON as they are
+func logEntry(pod string, line []byte) timelineEntry {
+	var fields struct {
+		Time    time.Time `json:"time"`
+		Level   string    `json:"level"`
+		Message string    `json:"message"`
+	}
+	if err := json.Unmarshal(line, &fields); err != nil || fields.Time.IsZero() {
+		return timelineEntry{source: pod, text: string(line)}
+	}
+	return timelineEntry{time: fields.Time, source: pod, text: fmt.Sprintf("%s %s", fields.Level, fields.Message)}
+}
+
+func eventTime(event corev1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	default:
+		return event.FirstTimestamp.Time
+	}
+}
+
+// formatTimeline lists the entries in time order, with untimed entries last
+func formatTimeline(entries []timelineEntry) []byte {
+	slices.SortStableFunc(entries, func(a, b timelineEntry) int {
+		switch {
+		case a.time.IsZero() && b.time.IsZero():
+			return 0
+		case a.time.IsZero():
+			return 1
+		case b.time.IsZero():
+			return -1
+		}
+		return a.time.Compare(b.time)
+	})
+
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		at := "-"
+		if !entry.time.IsZero() {
+			at = entry.time.UTC().Format(time.RFC3339Nano)
+		}
+		fmt.Fprintf(&buf, "%s\t%s\t%s\n", at, entry.source, entry.text)
+	}
+	return buf.Bytes()
+}
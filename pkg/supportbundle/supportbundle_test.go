@@ -0,0 +1,90 @@
+package supportbundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/omarjatoi/nix-remote-build-controller/pkg/apis/nixbuilder/v1alpha1"
+)
+
+func TestCollectGathersSessionArtifacts(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	buildReq := &v1alpha1.NixBuildRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "build-abc", Namespace: "default"},
+		Spec:       v1alpha1.NixBuildRequestSpec{SessionID: "abc"},
+		Status:     v1alpha1.NixBuildRequestStatus{Phase: v1alpha1.BuildPhaseFailed, PodName: "nix-builder-abc"},
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nix-builder-abc", Namespace: "default"}}
+	event := func(name, object string) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: name, Namespace: "default"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: object},
+			Reason:         "Failed",
+			Message:        "message about " + object,
+		}
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(buildReq, pod, event("ours", pod.Name), event("other", "nix-builder-xyz")).
+		Build()
+
+	var archive bytes.Buffer
+	opts := Options{SessionID: "abc", Namespace: "default", ComponentNamespace: "nix-system", LogLines: 100}
+	if err := Collect(context.Background(), c, kubefake.NewClientset(pod), opts, &archive); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+
+	files := make(map[string]string)
+	gz, err := gzip.NewReader(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[strings.TrimPrefix(header.Name, "support-bundle-abc/")] = string(data)
+	}
+
+	for _, name := range []string{"buildrequest.yaml", "pod.yaml", "events.yaml", "logs/builder.log", "timeline.txt"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("bundle has no %s", name)
+		}
+	}
+	if _, ok := files["errors.txt"]; ok {
+		t.Errorf("errors.txt = %q, want every artifact collected", files["errors.txt"])
+	}
+	if strings.Contains(files["events.yaml"], "nix-builder-xyz") {
+		t.Errorf("events.yaml includes another session's events")
+	}
+	if !strings.Contains(files["timeline.txt"], "message about nix-builder-abc") {
+		t.Errorf("timeline.txt = %q, want the pod's event", files["timeline.txt"])
+	}
+}
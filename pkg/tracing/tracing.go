@@ -0,0 +1,151 @@
+// Package tracing exports OpenTelemetry spans from the proxy and controller.
+// Every span belonging to a session shares a trace whose ID is derived from
+// the session ID, so a build can be followed from SSH accept to session close across
+// both binaries without passing trace context through the build request.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SessionIDKey is the span attribute holding the session ID
+const SessionIDKey = attribute.Key("nix.session.id")
+
+// Config selects where spans are exported
+type Config struct {
+	// Endpoint is the OTLP gRPC collector address, such as
+	// otel-collector:4317. Empty disables tracing.
+	Endpoint string
+	// Insecure connects to Endpoint without TLS
+	Insecure bool
+	// SampleRatio is the fraction of sessions traced. Sampling follows the
+	// trace ID, so the proxy and controller keep the same sessions.
+	SampleRatio float64
+	// ServiceName identifies the binary in exported spans
+	ServiceName string
+}
+
+// Setup installs the global tracer provider and returns a function that
+// flushes and stops it. With no endpoint configured it does nothing.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+	provider := NewProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// NewProvider returns a tracer provider that puts each session's spans in
+// the trace named by its session ID
+func NewProvider(opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(append(opts, sdktrace.WithIDGenerator(sessionIDGenerator{}))...)
+}
+
+// Tracer returns the named tracer from the global provider
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
+
+type sessionKey struct{}
+
+// WithSession returns a context whose new root spans join the session's
+// trace and carry its ID
+func WithSession(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, sessionID)
+}
+
+// Start starts a span for the session in ctx, if any, tagging it with the
+// session ID
+func Start(ctx context.Context, tracer trace.Tracer, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if sessionID, ok := ctx.Value(sessionKey{}).(string); ok {
+		attrs = append(attrs, SessionIDKey.String(sessionID))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Fail records err on span and marks it failed
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends span, recording err as its status when set
+func End(span trace.Span, err error) {
+	if err != nil {
+		Fail(span, err)
+	}
+	span.End()
+}
+
+// TraceID returns the trace ID of a session's spans. A UUID session ID is
+// used as is, so it can be pasted into a trace search. Other formats are
+// hashed.
+func TraceID(sessionID string) (trace.TraceID, bool) {
+	if sessionID == "" {
+		return trace.TraceID{}, false
+	}
+	if id, err := uuid.Parse(sessionID); err == nil {
+		return trace.TraceID(id), true
+	}
+	sum := sha256.Sum256([]byte(sessionID))
+	return trace.TraceID(sum[:16]), true
+}
+
+// sessionIDGenerator gives root spans started for a session the session's
+// trace ID and generates random IDs otherwise
+type sessionIDGenerator struct{}
+
+func (sessionIDGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	if sessionID, ok := ctx.Value(sessionKey{}).(string); ok {
+		if traceID, ok := TraceID(sessionID); ok {
+			return traceID, newSpanID()
+		}
+	}
+	var traceID trace.TraceID
+	rand.Read(traceID[:])
+	return traceID, newSpanID()
+}
+
+func (sessionIDGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	return newSpanID()
+}
+
+func newSpanID() trace.SpanID {
+	var spanID trace.SpanID
+	rand.Read(spanID[:])
+	return spanID
+}
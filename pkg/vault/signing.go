@@ -0,0 +1,228 @@
+package vault
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// NixSecretKey is the key in a Vault KV entry holding a Nix signing key,
+	// in the name:base64 format written by nix key generate-secret
+	NixSecretKey = "secret-key"
+
+	// nixStoreDir is the store every signed path must live in
+	nixStoreDir = "/nix/store/"
+
+	// nix32Alphabet is the digit set of Nix's base-32 hash encoding, which
+	// leaves out e, o, u and t
+	nix32Alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+)
+
+// NixSigner signs store paths for a binary cache. Signatures and public keys
+// use Nix's name:base64 format, so they can go straight into a narinfo's Sig
+// field and a client's trusted-public-keys.
+type NixSigner interface {
+	// Sign signs a path's fingerprint, as returned by Fingerprint
+	Sign(ctx context.Context, fingerprint []byte) (string, error)
+	// PublicKey returns the key clients verify signatures with
+	PublicKey(ctx context.Context) (string, error)
+}
+
+// KVSigner signs with a Nix secret key stored at Path in the KV mount. The
+// key is read through the client's cache, so a rotated key is picked up
+// after CacheTTL, and never leaves the process.
+type KVSigner struct {
+	Client *Client
+	Path   string
+}
+
+// Sign signs fingerprint with the key stored in Vault
+func (s *KVSigner) Sign(ctx context.Context, fingerprint []byte) (string, error) {
+	name, key, err := s.secretKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	return name + ":" + base64.StdEncoding.EncodeToString(ed25519.Sign(key, fingerprint)), nil
+}
+
+// PublicKey returns the public half of the key stored in Vault
+func (s *KVSigner) PublicKey(ctx context.Context) (string, error) {
+	name, key, err := s.secretKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	return name + ":" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+}
+
+func (s *KVSigner) secretKey(ctx context.Context) (string, ed25519.PrivateKey, error) {
+	data, err := s.Client.ReadKV(ctx, s.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, ok := data[NixSecretKey]
+	if !ok {
+		return "", nil, fmt.Errorf("vault path %s missing required key '%s'", s.Path, NixSecretKey)
+	}
+	name, key, err := ParseNixSecretKey(secret)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid Nix signing key at vault path %s: %w", s.Path, err)
+	}
+	return name, key, nil
+}
+
+// ParseNixSecretKey parses a Nix secret key in the name:base64 format
+func ParseNixSecretKey(secret string) (string, ed25519.PrivateKey, error) {
+	name, encoded, ok := strings.Cut(strings.TrimSpace(secret), ":")
+	if !ok || name == "" {
+		return "", nil, fmt.Errorf("key is not in name:base64 format")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, fmt.Errorf("key is not valid base64: %w", err)
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return "", nil, fmt.Errorf("key is %d bytes, want %d", len(key), ed25519.PrivateKeySize)
+	}
+	return name, ed25519.PrivateKey(key), nil
+}
+
+// TransitSigner signs with an ed25519 key held by Vault's Transit secrets
+// engine, so the private key is never readable outside Vault. Name is the
+// key name clients know the key by in trusted-public-keys, such as
+// cache.example.com-1.
+type TransitSigner struct {
+	Client *Client
+	// Mount is the mount path of the Transit engine
+	Mount string
+	// Key is the name of the Transit key
+	Key  string
+	Name string
+}
+
+type transitSignResponse struct {
+	Data struct {
+		Signature string `json:"signature"`
+	} `json:"data"`
+}
+
+type transitKeyResponse struct {
+	Data struct {
+		Type          string `json:"type"`
+		LatestVersion int    `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	} `json:"data"`
+}
+
+// Sign has Vault sign fingerprint with the latest version of the Transit key
+func (s *TransitSigner) Sign(ctx context.Context, fingerprint []byte) (string, error) {
+	var resp transitSignResponse
+	body := map[string]any{"input": base64.StdEncoding.EncodeToString(fingerprint)}
+	if err := s.Client.request(ctx, http.MethodPost, s.path("sign"), body, &resp); err != nil {
+		return "", fmt.Errorf("failed to sign with Transit key %s: %w", s.Key, err)
+	}
+
+	// Transit returns vault:v<version>:<base64 signature>
+	parts := strings.Split(resp.Data.Signature, ":")
+	if len(parts) != 3 || parts[0] != "vault" {
+		return "", fmt.Errorf("unexpected signature format from Transit key %s", s.Key)
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return "", fmt.Errorf("transit key %s did not return an ed25519 signature", s.Key)
+	}
+	return s.Name + ":" + parts[2], nil
+}
+
+// PublicKey returns the public half of the latest version of the Transit key
+func (s *TransitSigner) PublicKey(ctx context.Context) (string, error) {
+	var resp transitKeyResponse
+	if err := s.Client.request(ctx, http.MethodGet, s.path("keys"), nil, &resp); err != nil {
+		return "", fmt.Errorf("failed to read Transit key %s: %w", s.Key, err)
+	}
+	if resp.Data.Type != "ed25519" {
+		return "", fmt.Errorf("transit key %s has type %s, Nix needs ed25519", s.Key, resp.Data.Type)
+	}
+	latest, ok := resp.Data.Keys[strconv.Itoa(resp.Data.LatestVersion)]
+	if !ok || latest.PublicKey == "" {
+		return "", fmt.Errorf("transit key %s has no public key for version %d", s.Key, resp.Data.LatestVersion)
+	}
+	return s.Name + ":" + latest.PublicKey, nil
+}
+
+func (s *TransitSigner) path(operation string) string {
+	mount := s.Mount
+	if mount == "" {
+		mount = "transit"
+	}
+	return fmt.Sprintf("/v1/%s/%s/%s", strings.Trim(mount, "/"), operation, s.Key)
+}
+
+// Fingerprint returns the string Nix signs for a store path: its path, NAR
+// hash, NAR size and references. narHash may be in the sha256:<base32> form
+// of narinfo files, the SRI form newer nix path-info prints, or hex.
+func Fingerprint(path, narHash string, narSize uint64, references []string) ([]byte, error) {
+	if !strings.HasPrefix(path, nixStoreDir) {
+		return nil, fmt.Errorf("path %s is not in %s", path, nixStoreDir)
+	}
+	hash, err := nix32NarHash(narHash)
+	if err != nil {
+		return nil, fmt.Errorf("path %s: %w", path, err)
+	}
+	refs := make([]string, len(references))
+	for i, ref := range references {
+		if !strings.HasPrefix(ref, nixStoreDir) {
+			ref = nixStoreDir + ref
+		}
+		refs[i] = ref
+	}
+	sort.Strings(refs)
+	return fmt.Appendf(nil, "1;%s;sha256:%s;%d;%s", path, hash, narSize, strings.Join(refs, ",")), nil
+}
+
+// nix32NarHash converts a SHA-256 NAR hash to Nix's base-32 encoding
+func nix32NarHash(narHash string) (string, error) {
+	var digest []byte
+	var err error
+	switch {
+	case strings.HasPrefix(narHash, "sha256-"):
+		digest, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(narHash, "sha256-"))
+	case strings.HasPrefix(narHash, "sha256:"):
+		encoded := strings.TrimPrefix(narHash, "sha256:")
+		if len(encoded) == 52 && strings.Trim(encoded, nix32Alphabet) == "" {
+			return encoded, nil
+		}
+		digest, err = hex.DecodeString(encoded)
+	default:
+		return "", fmt.Errorf("NAR hash %q is not a SHA-256 hash", narHash)
+	}
+	if err != nil || len(digest) != 32 {
+		return "", fmt.Errorf("NAR hash %q is not a valid SHA-256 hash", narHash)
+	}
+	return nix32(digest), nil
+}
+
+// nix32 encodes bytes in Nix's base-32, which reads the input from its last
+// bit backwards
+func nix32(data []byte) string {
+	length := (len(data)*8-1)/5 + 1
+	out := make([]byte, 0, length)
+	for n := length - 1; n >= 0; n-- {
+		b := n * 5
+		i, j := b/8, b%8
+		c := data[i] >> j
+		if i+1 < len(data) {
+			c |= data[i+1] << (8 - j)
+		}
+		out = append(out, nix32Alphabet[c&0x1f])
+	}
+	return string(out)
+}
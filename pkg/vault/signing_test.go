@@ -0,0 +1,164 @@
+package vault
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNix32(t *testing.T) {
+	for input, want := range map[string]string{
+		"":    "0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+		"abc": "1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s",
+	} {
+		digest := sha256.Sum256([]byte(input))
+		if got := nix32(digest[:]); got != want {
+			t.Errorf("nix32(sha256(%q)) = %s, want %s", input, got, want)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	digest := sha256.Sum256([]byte("abc"))
+	want := "1;/nix/store/aaaa-hello;sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s;1024;" +
+		"/nix/store/bbbb-glibc,/nix/store/cccc-hello-lib"
+	refs := []string{"/nix/store/cccc-hello-lib", "bbbb-glibc"}
+
+	for _, narHash := range []string{
+		"sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s",
+		"sha256-" + base64.StdEncoding.EncodeToString(digest[:]),
+		"sha256:" + hex.EncodeToString(digest[:]),
+	} {
+		got, err := Fingerprint("/nix/store/aaaa-hello", narHash, 1024, refs)
+		if err != nil {
+			t.Fatalf("Fingerprint with %s: %v", narHash, err)
+		}
+		if string(got) != want {
+			t.Errorf("Fingerprint with %s = %s, want %s", narHash, got, want)
+		}
+	}
+
+	for _, tc := range []struct{ path, narHash string }{
+		{"/tmp/aaaa-hello", "sha256-" + base64.StdEncoding.EncodeToString(digest[:])},
+		{"/nix/store/aaaa-hello", "md5:900150983cd24fb0d6963f7d28e17f72"},
+		{"/nix/store/aaaa-hello", "sha256-dGVzdA=="},
+	} {
+		if _, err := Fingerprint(tc.path, tc.narHash, 1024, nil); err == nil {
+			t.Errorf("Fingerprint(%s, %s) succeeded", tc.path, tc.narHash)
+		}
+	}
+}
+
+// fakeVault serves a KV entry and a Transit key, signing with private
+func fakeVault(t *testing.T, kv map[string]string, private ed25519.PrivateKey) *Client {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/secret/data/nix-builder/signing-key", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": kv}})
+	})
+	mux.HandleFunc("POST /v1/transit/sign/nix-cache", func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Input string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		input, err := base64.StdEncoding.DecodeString(body.Input)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, input))
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"signature": "vault:v2:" + signature}})
+	})
+	mux.HandleFunc("GET /v1/transit/keys/nix-cache", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+			"type":           "ed25519",
+			"latest_version": 2,
+			"keys": map[string]any{
+				"1": map[string]any{"public_key": "b2xk"},
+				"2": map[string]any{"public_key": base64.StdEncoding.EncodeToString(private.Public().(ed25519.PublicKey))},
+			},
+		}})
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("VAULT_TOKEN", "test-token")
+	return New(Config{Address: server.URL})
+}
+
+func TestNixSigners(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fakeVault(t, map[string]string{
+		NixSecretKey: "cache.example.com-1:" + base64.StdEncoding.EncodeToString(private) + "\n",
+	}, private)
+	fingerprint, err := Fingerprint("/nix/store/aaaa-hello", "sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s", 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPublic := "cache.example.com-1:" + base64.StdEncoding.EncodeToString(public)
+
+	for name, signer := range map[string]NixSigner{
+		"kv":      &KVSigner{Client: client, Path: "nix-builder/signing-key"},
+		"transit": &TransitSigner{Client: client, Key: "nix-cache", Name: "cache.example.com-1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			publicKey, err := signer.PublicKey(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if publicKey != wantPublic {
+				t.Errorf("PublicKey() = %s, want %s", publicKey, wantPublic)
+			}
+
+			sig, err := signer.Sign(ctx, fingerprint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyName, encoded, _ := strings.Cut(sig, ":")
+			if keyName != "cache.example.com-1" {
+				t.Errorf("signature key name = %s", keyName)
+			}
+			raw, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ed25519.Verify(public, fingerprint, raw) {
+				t.Errorf("signature %s does not verify", sig)
+			}
+		})
+	}
+}
+
+func TestKVSignerRejectsInvalidKeys(t *testing.T) {
+	for name, kv := range map[string]map[string]string{
+		"missing":   {"public": "cache.example.com-1:b2xk"},
+		"no name":   {NixSecretKey: base64.StdEncoding.EncodeToString(make([]byte, ed25519.PrivateKeySize))},
+		"too short": {NixSecretKey: "cache.example.com-1:b2xk"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			signer := &KVSigner{Client: fakeVault(t, kv, nil), Path: "nix-builder/signing-key"}
+			if _, err := signer.Sign(context.Background(), []byte("1;/nix/store/aaaa-hello")); err == nil {
+				t.Error("Sign succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultServiceAccountTokenPath is where Kubernetes mounts the pod's
+	// service account token used for Vault's Kubernetes auth method
+	DefaultServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// renewFraction is the share of a token's lease after which it is renewed
+	renewFraction = 2.0 / 3.0
+)
+
+// Config holds the settings used to reach Vault
+type Config struct {
+	// Address is the Vault server URL, e.g. https://vault.example.com:8200
+	Address string
+	// Role is the Vault Kubernetes auth role to log in as. Ignored when the
+	// VAULT_TOKEN environment variable is set.
+	Role string
+	// AuthPath is the mount path of the Kubernetes auth method
+	AuthPath string
+	// KVMount is the mount path of the KV version 2 secrets engine
+	KVMount string
+	// CacheTTL is how long secrets read from Vault are reused
+	CacheTTL time.Duration
+}
+
+// Client is a minimal Vault client that reads KV version 2 secrets and signs
+// with Transit keys using Kubernetes service account authentication, caching reads and renewing its
+// token before the lease runs out
+type Client struct {
+	cfg        Config
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	token       string
+	staticToken bool
+	renewAt     time.Time
+	expiresAt   time.Time
+	cache       map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	data      map[string]string
+	fetchedAt time.Time
+}
+
+type authResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+type kvResponse struct {
+	Data struct {
+		Data map[string]string `json:"data"`
+	} `json:"data"`
+}
+
+// New creates a Vault client. If VAULT_TOKEN is set it is used as a static
+// token instead of logging in with the Kubernetes auth method.
+func New(cfg Config) *Client {
+	if cfg.AuthPath == "" {
+		cfg.AuthPath = "kubernetes"
+	}
+	if cfg.KVMount == "" {
+		cfg.KVMount = "secret"
+	}
+
+	c := &Client{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		cache:      make(map[string]cachedSecret),
+	}
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		c.token = token
+		c.staticToken = true
+	}
+	return c
+}
+
+// ReadKV returns the key/value data stored at path in the KV mount, serving
+// it from the cache while it is younger than the configured CacheTTL
+func (c *Client) ReadKV(ctx context.Context, path string) (map[string]string, error) {
+	c.mu.Lock()
+	if cached, ok := c.cache[path]; ok && time.Since(cached.fetchedAt) < c.cfg.CacheTTL {
+		c.mu.Unlock()
+		return cached.data, nil
+	}
+	c.mu.Unlock()
+
+	var resp kvResponse
+	url := fmt.Sprintf("/v1/%s/data/%s", c.cfg.KVMount, strings.TrimPrefix(path, "/"))
+	if err := c.request(ctx, http.MethodGet, url, nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to read %s from Vault: %w", path, err)
+	}
+	if resp.Data.Data == nil {
+		return nil, fmt.Errorf("no data at %s in Vault", path)
+	}
+
+	c.mu.Lock()
+	c.cache[path] = cachedSecret{data: resp.Data.Data, fetchedAt: time.Now()}
+	c.mu.Unlock()
+
+	return resp.Data.Data, nil
+}
+
+// request calls the Vault API with the client's token
+func (c *Client) request(ctx context.Context, method, path string, body any, out any) error {
+	token, err := c.ensureToken(ctx)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, method, path, token, body, out)
+}
+
+// ensureToken returns a valid token, renewing or logging in again when the
+// current lease is close to expiring
+func (c *Client) ensureToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.staticToken {
+		return c.token, nil
+	}
+
+	now := time.Now()
+	if c.token != "" && now.Before(c.renewAt) {
+		return c.token, nil
+	}
+
+	if c.token != "" && now.Before(c.expiresAt) {
+		var resp authResponse
+		if err := c.do(ctx, http.MethodPost, "/v1/auth/token/renew-self", c.token, map[string]any{}, &resp); err == nil {
+			c.setLease(resp)
+			return c.token, nil
+		}
+	}
+
+	jwt, err := os.ReadFile(DefaultServiceAccountTokenPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	var resp authResponse
+	body := map[string]any{"role": c.cfg.Role, "jwt": strings.TrimSpace(string(jwt))}
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/v1/auth/%s/login", c.cfg.AuthPath), "", body, &resp); err != nil {
+		return "", fmt.Errorf("failed to log in to Vault: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("vault login returned no token")
+	}
+	c.setLease(resp)
+	return c.token, nil
+}
+
+func (c *Client) setLease(resp authResponse) {
+	if resp.Auth.ClientToken != "" {
+		c.token = resp.Auth.ClientToken
+	}
+	lease := time.Duration(resp.Auth.LeaseDuration) * time.Second
+	now := time.Now()
+	c.expiresAt = now.Add(lease)
+	c.renewAt = now.Add(time.Duration(float64(lease) * renewFraction))
+}
+
+func (c *Client) do(ctx context.Context, method, path, token string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.cfg.Address, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("vault returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}